@@ -0,0 +1,168 @@
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// compactionDeadRatio is the share of dead bytes in a segment above which Analyze
+// recommends compacting it. Below this, rewriting the live records costs more I/O
+// than the space we would get back is worth.
+const compactionDeadRatio = 0.5
+
+// Report is the result of DiskStore.Analyze. It describes how the bytes on the
+// disk are used, so that capacity planning does not need external scripts.
+//
+// A record is live when KeyDir points at it, it is not a tombstone and it has not
+// expired. Everything else, i.e. older versions of a key, expired keys and the
+// tombstones themselves, is dead: it takes up space in the file but can never be
+// read again.
+type Report struct {
+	// Segments holds one entry per data file of the store
+	Segments []SegmentReport
+	// Records is the total number of records across all segments
+	Records int
+	// LiveBytes, DeadBytes and FormatBytes are the totals across all segments,
+	// which add up to their size
+	LiveBytes   int64
+	DeadBytes   int64
+	FormatBytes int64
+	// Tombstones is the total number of tombstones across all segments
+	Tombstones int
+	// AverageRecordSize is the mean size of a record, header included, in bytes
+	AverageRecordSize float64
+	// Plan is the recommended compaction, based on the numbers above
+	Plan CompactionPlan
+}
+
+// SegmentReport describes the usage of a single data file.
+type SegmentReport struct {
+	// Name is the path of the data file
+	Name string
+	// Remote is set when the segment was offloaded to cold storage
+	Remote      bool
+	Records     int
+	LiveRecords int
+	// Tombstones counts the records with an empty value, which is how a deletion is
+	// written to the log
+	Tombstones int
+	LiveBytes  int64
+	DeadBytes  int64
+	// FormatBytes is the size of the format record starting the file, which is
+	// neither live nor dead, and not counted in Records
+	FormatBytes int64
+}
+
+// DeadRatio returns the share of the segment's bytes which are dead, between 0
+// and 1.
+func (s SegmentReport) DeadRatio() float64 {
+	total := s.LiveBytes + s.DeadBytes
+	if total == 0 {
+		return 0
+	}
+	return float64(s.DeadBytes) / float64(total)
+}
+
+// CompactionPlan is the compaction Analyze recommends.
+type CompactionPlan struct {
+	// Recommended is set when compacting is worth the I/O it costs
+	Recommended bool
+	// Segments lists the names of the segments worth compacting
+	Segments []string
+	// ReclaimableBytes is the space compacting those segments would free
+	ReclaimableBytes int64
+	// Reason explains the recommendation in plain words
+	Reason string
+}
+
+// Analyze scans the data files and reports the live and dead bytes in them, along
+// with a recommended compaction plan. It reads the whole of the local files, so it
+// takes time proportional to the size of the database; the offloaded segments are
+// analyzed from their local index. It does not read the values into KeyDir or
+// change anything on the disk.
+func (d *DiskStore) Analyze() (Report, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var report Report
+	for _, seg := range d.segments {
+		segment, err := d.analyzeSegment(seg)
+		if err != nil {
+			return report, err
+		}
+		report.Segments = append(report.Segments, segment)
+	}
+	for _, s := range report.Segments {
+		report.Records += s.Records
+		report.LiveBytes += s.LiveBytes
+		report.DeadBytes += s.DeadBytes
+		report.FormatBytes += s.FormatBytes
+		report.Tombstones += s.Tombstones
+		if s.DeadRatio() >= compactionDeadRatio {
+			report.Plan.Segments = append(report.Plan.Segments, s.Name)
+			report.Plan.ReclaimableBytes += s.DeadBytes
+		}
+	}
+	if report.Records > 0 {
+		report.AverageRecordSize = float64(report.LiveBytes+report.DeadBytes) / float64(report.Records)
+	}
+	if len(report.Plan.Segments) > 0 {
+		report.Plan.Recommended = true
+		report.Plan.Reason = fmt.Sprintf("%d segment(s) are at least %.0f%% dead", len(report.Plan.Segments), compactionDeadRatio*100)
+	} else {
+		report.Plan.Reason = fmt.Sprintf("no segment is more than %.0f%% dead", compactionDeadRatio*100)
+	}
+	return report, nil
+}
+
+func (d *DiskStore) analyzeSegment(seg *segment) (SegmentReport, error) {
+	segment := SegmentReport{Name: seg.path, Remote: seg.remote}
+	now := time.Now()
+	count := func(offset int, key string, size int64, tombstone bool) {
+		if isFormatKey(key) {
+			// part of the file rather than of the data
+			segment.FormatBytes += size
+			return
+		}
+		segment.Records++
+		kEntry, ok := d.keyDir.get(key)
+		switch {
+		case tombstone:
+			segment.Tombstones++
+			segment.DeadBytes += size
+		case ok && kEntry.segment == seg.id && int(kEntry.position) == offset && !kEntry.expired(now):
+			segment.LiveRecords++
+			segment.LiveBytes += size
+		default:
+			segment.DeadBytes += size
+		}
+	}
+	if seg.remote {
+		err := scanRemoteIndex(seg, func(offset int, header []byte, key string) {
+			_, keySize, valueSize := decodeHeader(header)
+			count(offset, key, int64(headerSize+keySize+valueSize), valueSize == 0)
+		})
+		return segment, err
+	}
+	// we open a separate handle, so that we do not disturb the cursor of d.file
+	file, err := openFile(seg.path, os.O_RDONLY, 0)
+	if err != nil {
+		return segment, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return segment, err
+	}
+	err = scanRecords(file, info.Size(), func(offset int, data []byte) error {
+		_, key, value := decodeKV(data)
+		count(offset, key, int64(len(data)), value == "")
+		return nil
+	})
+	// the partial record is not part of the store, it is truncated on the next open
+	if errors.Is(err, errPartialRecord) {
+		err = nil
+	}
+	return segment, err
+}
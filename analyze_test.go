@@ -0,0 +1,51 @@
+package caskdb
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDiskStore_Analyze(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	liveSize, _ := encodeKV(0, "hamlet", "shakespeare")
+	deadSize, _ := encodeKV(0, "othello", "shakespeare")
+	tombstoneSize, _ := encodeKV(0, "othello", "")
+	store.Set("hamlet", "shakespeare")
+	store.Set("othello", "shakespeare")
+	store.Set("othello", "")
+
+	report, err := store.Analyze()
+	if err != nil {
+		t.Fatalf("Analyze() error = %v", err)
+	}
+	if len(report.Segments) != 1 {
+		t.Fatalf("Analyze() segments = %v, want 1", len(report.Segments))
+	}
+	if report.Records != 3 {
+		t.Errorf("Analyze() records = %v, want %v", report.Records, 3)
+	}
+	if report.Tombstones != 1 {
+		t.Errorf("Analyze() tombstones = %v, want %v", report.Tombstones, 1)
+	}
+	if report.LiveBytes != int64(liveSize) {
+		t.Errorf("Analyze() live bytes = %v, want %v", report.LiveBytes, liveSize)
+	}
+	if report.DeadBytes != int64(deadSize+tombstoneSize) {
+		t.Errorf("Analyze() dead bytes = %v, want %v", report.DeadBytes, deadSize+tombstoneSize)
+	}
+	if report.FormatBytes != int64(len(formatRecord(0))) {
+		t.Errorf("Analyze() format bytes = %v, want %v", report.FormatBytes, len(formatRecord(0)))
+	}
+	if total := report.LiveBytes + report.DeadBytes + report.FormatBytes; total != int64(store.writePosition) {
+		t.Errorf("Analyze() bytes add up to %v, want the size of the file, %v", total, store.writePosition)
+	}
+	if !report.Plan.Recommended || report.Plan.ReclaimableBytes != report.DeadBytes {
+		t.Errorf("Analyze() plan = %+v, want compaction of %v bytes", report.Plan, report.DeadBytes)
+	}
+}
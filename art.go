@@ -0,0 +1,505 @@
+package caskdb
+
+import (
+	"math/rand"
+	"strings"
+	"unsafe"
+)
+
+// artKeyDir is the table of KeyDirART, an adaptive radix tree: the keys are spelled
+// out byte by byte down the tree, so the keys sharing a prefix share the nodes
+// spelling it, and the tree is ordered, which is what scans by prefix need. A node
+// only has as many child slots as it needs, 4, 16, 48 or 256, and the nodes with a
+// single child are folded into their parent's prefix, so that the tree is as deep
+// as the keys branch rather than as long as they are.
+type artKeyDir struct {
+	root  *artNode
+	count int
+}
+
+// artNode is a node of the tree. The keys below it continue with the byte leading
+// to it and then its prefix; the key ending right there is in leaf.
+//
+// The children are kept sorted by byte, in keys and children, while there are up
+// to 16 of them. Up to 48, children holds them in no order and index maps every
+// byte to 1 more than the slot of its child, 0 for none. Past that, children has a
+// slot per byte.
+type artNode struct {
+	prefix   string
+	leaf     *artLeaf
+	n        int
+	keys     []byte
+	index    []uint8
+	children []*artNode
+}
+
+type artLeaf struct {
+	key    string
+	kEntry KeyEntry
+}
+
+func newARTKeyDir() *artKeyDir {
+	return &artKeyDir{root: &artNode{}}
+}
+
+// child returns the slot of the child of the node under byte b, nil if there is
+// none.
+func (n *artNode) child(b byte) **artNode {
+	switch {
+	case n.index != nil:
+		if i := n.index[b]; i != 0 {
+			return &n.children[i-1]
+		}
+	case len(n.children) == 256:
+		if n.children[b] != nil {
+			return &n.children[b]
+		}
+	default:
+		for i, k := range n.keys {
+			if k == b {
+				return &n.children[i]
+			}
+		}
+	}
+	return nil
+}
+
+// addChild adds a child under byte b, which the node has none under, growing the
+// node if it is full.
+func (n *artNode) addChild(b byte, child *artNode) {
+	switch {
+	case n.index != nil:
+		if n.n == 48 {
+			n.resize(256)
+			n.addChild(b, child)
+			return
+		}
+		for i, c := range n.children {
+			if c == nil {
+				n.children[i] = child
+				n.index[b] = uint8(i + 1)
+				break
+			}
+		}
+	case len(n.children) == 256:
+		n.children[b] = child
+	default:
+		if n.n == cap(n.children) && n.n > 0 {
+			n.resize(artGrowth(n.n))
+			n.addChild(b, child)
+			return
+		}
+		if n.children == nil {
+			n.keys, n.children = make([]byte, 0, 4), make([]*artNode, 0, 4)
+		}
+		i := 0
+		for i < n.n && n.keys[i] < b {
+			i++
+		}
+		n.keys = append(n.keys, 0)
+		n.children = append(n.children, nil)
+		copy(n.keys[i+1:], n.keys[i:])
+		copy(n.children[i+1:], n.children[i:])
+		n.keys[i], n.children[i] = b, child
+	}
+	n.n++
+}
+
+// artGrowth returns the size of the node after one of size.
+func artGrowth(size int) int {
+	switch size {
+	case 4:
+		return 16
+	case 16:
+		return 48
+	}
+	return 256
+}
+
+// removeChild removes the child under byte b, shrinking the node once it uses
+// well under the slots of the next size down.
+func (n *artNode) removeChild(b byte) {
+	switch {
+	case n.index != nil:
+		n.children[n.index[b]-1] = nil
+		n.index[b] = 0
+	case len(n.children) == 256:
+		n.children[b] = nil
+	default:
+		for i, k := range n.keys {
+			if k == b {
+				n.keys = append(n.keys[:i], n.keys[i+1:]...)
+				n.children = append(n.children[:i], n.children[i+1:]...)
+				break
+			}
+		}
+	}
+	n.n--
+	switch {
+	case len(n.children) == 256 && n.n <= 37:
+		n.resize(48)
+	case n.index != nil && n.n <= 12:
+		n.resize(16)
+	case n.index == nil && cap(n.children) == 16 && n.n <= 3:
+		n.resize(4)
+	case n.n == 0:
+		n.keys, n.children = nil, nil
+	}
+}
+
+// resize moves the children of the node to slots for size of them.
+func (n *artNode) resize(size int) {
+	var bytes []byte
+	var children []*artNode
+	n.each(false, func(b byte, child *artNode) bool {
+		bytes = append(bytes, b)
+		children = append(children, child)
+		return true
+	})
+	n.keys, n.index = nil, nil
+	switch size {
+	case 256:
+		n.children = make([]*artNode, 256)
+		for i, b := range bytes {
+			n.children[b] = children[i]
+		}
+	case 48:
+		n.index = make([]uint8, 256)
+		n.children = make([]*artNode, 48)
+		for i, b := range bytes {
+			n.index[b] = uint8(i + 1)
+			n.children[i] = children[i]
+		}
+	default:
+		n.keys = append(make([]byte, 0, size), bytes...)
+		n.children = append(make([]*artNode, 0, size), children...)
+	}
+}
+
+// each calls fn with the children of the node in the order of their bytes, or the
+// reverse order, until fn returns false, and reports whether fn never did.
+func (n *artNode) each(reverse bool, fn func(b byte, child *artNode) bool) bool {
+	if n.index == nil && len(n.children) != 256 {
+		for i := range n.keys {
+			if reverse {
+				i = len(n.keys) - 1 - i
+			}
+			if !fn(n.keys[i], n.children[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	for i := 0; i < 256; i++ {
+		b := byte(i)
+		if reverse {
+			b = byte(255 - i)
+		}
+		if child := n.child(b); child != nil && !fn(b, *child) {
+			return false
+		}
+	}
+	return true
+}
+
+// commonPrefix returns the length of the longest prefix of a and b.
+func commonPrefix(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// find returns the leaf of the key, nil if it is not in the tree.
+func (t *artKeyDir) find(key string) *artLeaf {
+	node, depth := t.root, 0
+	for {
+		if !strings.HasPrefix(key[depth:], node.prefix) {
+			return nil
+		}
+		depth += len(node.prefix)
+		if depth == len(key) {
+			return node.leaf
+		}
+		child := node.child(key[depth])
+		if child == nil {
+			return nil
+		}
+		node, depth = *child, depth+1
+	}
+}
+
+func (t *artKeyDir) get(key string) (KeyEntry, bool) {
+	if leaf := t.find(key); leaf != nil {
+		return leaf.kEntry, true
+	}
+	return KeyEntry{}, false
+}
+
+func (t *artKeyDir) set(key string, kEntry KeyEntry) {
+	ref, depth := &t.root, 0
+	for {
+		node := *ref
+		p := commonPrefix(node.prefix, key[depth:])
+		if p < len(node.prefix) {
+			// the key parts from the prefix of the node: split it there
+			parent := &artNode{prefix: node.prefix[:p]}
+			parent.addChild(node.prefix[p], node)
+			node.prefix = node.prefix[p+1:]
+			*ref, node = parent, parent
+		}
+		depth += p
+		if depth == len(key) {
+			if node.leaf == nil {
+				node.leaf = &artLeaf{key: key}
+				t.count++
+			}
+			node.leaf.kEntry = kEntry
+			return
+		}
+		child := node.child(key[depth])
+		if child == nil {
+			// the rest of the key is the prefix of the new leaf, sharing the
+			// memory of the key
+			node.addChild(key[depth], &artNode{prefix: key[depth+1:], leaf: &artLeaf{key: key, kEntry: kEntry}})
+			t.count++
+			return
+		}
+		ref, depth = child, depth+1
+	}
+}
+
+func (t *artKeyDir) remove(key string) {
+	if t.removeFrom(&t.root, key, 0) {
+		t.count--
+	}
+}
+
+// removeFrom removes the key from below the node in ref, which is at depth,
+// folding the nodes left with a single child into it, and reports whether the key
+// was there.
+func (t *artKeyDir) removeFrom(ref **artNode, key string, depth int) bool {
+	node := *ref
+	if !strings.HasPrefix(key[depth:], node.prefix) {
+		return false
+	}
+	depth += len(node.prefix)
+	if depth == len(key) {
+		if node.leaf == nil {
+			return false
+		}
+		node.leaf = nil
+	} else {
+		b := key[depth]
+		child := node.child(b)
+		if child == nil || !t.removeFrom(child, key, depth+1) {
+			return false
+		}
+		if c := *child; c.leaf == nil && c.n == 0 {
+			node.removeChild(b)
+		}
+	}
+	if node.leaf == nil && node.n == 1 && ref != &t.root {
+		node.each(false, func(b byte, child *artNode) bool {
+			child.prefix = node.prefix + string([]byte{b}) + child.prefix
+			*ref = child
+			return false
+		})
+	}
+	return true
+}
+
+func (t *artKeyDir) size() int {
+	return t.count
+}
+
+// each starts at a random key and wraps around, so that breaking off early samples
+// the keys at random, the way ranging over a map does.
+func (t *artKeyDir) each(fn func(key string, kEntry KeyEntry) bool) {
+	start := t.randomKey()
+	done := false
+	t.root.ascend(start, 0, true, func(leaf *artLeaf) bool {
+		done = !fn(leaf.key, leaf.kEntry)
+		return !done
+	})
+	if done || start == "" {
+		return
+	}
+	t.root.ascend("", 0, true, func(leaf *artLeaf) bool {
+		return leaf.key < start && fn(leaf.key, leaf.kEntry)
+	})
+}
+
+// randomKey returns a key picked by walking down the tree at random.
+func (t *artKeyDir) randomKey() string {
+	node := t.root
+	for {
+		i := rand.Intn(node.n + 1)
+		if i == node.n {
+			if node.leaf != nil {
+				return node.leaf.key
+			}
+			if node.n == 0 {
+				return ""
+			}
+			i = rand.Intn(node.n)
+		}
+		node.each(false, func(b byte, child *artNode) bool {
+			if i == 0 {
+				node = child
+				return false
+			}
+			i--
+			return true
+		})
+	}
+}
+
+// ascend calls fn with the leaves below the node in order, until fn returns false,
+// and reports whether fn never did. The node is at depth in the keys. If bounded,
+// the keys below the node start with start[:depth], and those less than start are
+// skipped.
+func (n *artNode) ascend(start string, depth int, bounded bool, fn func(leaf *artLeaf) bool) bool {
+	if bounded {
+		rest := start[depth:]
+		if len(rest) <= len(n.prefix) {
+			if n.prefix[:len(rest)] < rest {
+				return true
+			}
+			// every key below starts with start, or sorts after it
+			bounded = false
+		} else if c := strings.Compare(n.prefix, rest[:len(n.prefix)]); c < 0 {
+			return true
+		} else if c > 0 {
+			bounded = false
+		}
+	}
+	depth += len(n.prefix)
+	if !bounded && n.leaf != nil && !fn(n.leaf) {
+		return false
+	}
+	return n.each(false, func(b byte, child *artNode) bool {
+		if !bounded || b > start[depth] {
+			return child.ascend(start, depth+1, false, fn)
+		}
+		return b < start[depth] || child.ascend(start, depth+1, true, fn)
+	})
+}
+
+// descend calls fn with the leaves below the node whose keys are less than end,
+// in reverse order, until fn returns false, and reports whether fn never did.
+// bounded is as for ascend.
+func (n *artNode) descend(end string, depth int, bounded bool, fn func(leaf *artLeaf) bool) bool {
+	if bounded {
+		rest := end[depth:]
+		if len(rest) <= len(n.prefix) {
+			if n.prefix[:len(rest)] >= rest {
+				// every key below starts with end, or sorts after it
+				return true
+			}
+			bounded = false
+		} else if c := strings.Compare(n.prefix, rest[:len(n.prefix)]); c > 0 {
+			return true
+		} else if c < 0 {
+			bounded = false
+		}
+	}
+	depth += len(n.prefix)
+	if !n.each(true, func(b byte, child *artNode) bool {
+		if !bounded || b < end[depth] {
+			return child.descend(end, depth+1, false, fn)
+		}
+		return b > end[depth] || child.descend(end, depth+1, true, fn)
+	}) {
+		return false
+	}
+	// the key of the leaf, if bounded, is a prefix of end, which sorts before it
+	return n.leaf == nil || fn(n.leaf)
+}
+
+func (t *artKeyDir) seek(key string) (found string, ok bool) {
+	t.root.ascend(key, 0, true, func(leaf *artLeaf) bool {
+		found, ok = leaf.key, true
+		return false
+	})
+	return found, ok
+}
+
+func (t *artKeyDir) before(key string) (found string, ok bool) {
+	t.root.descend(key, 0, true, func(leaf *artLeaf) bool {
+		found, ok = leaf.key, true
+		return false
+	})
+	return found, ok
+}
+
+func (t *artKeyDir) last() (found string, ok bool) {
+	t.root.descend("", 0, false, func(leaf *artLeaf) bool {
+		found, ok = leaf.key, true
+		return false
+	})
+	return found, ok
+}
+
+func (t *artKeyDir) ascend(start string, fn func(key string) bool) {
+	t.root.ascend(start, 0, true, func(leaf *artLeaf) bool {
+		return fn(leaf.key)
+	})
+}
+
+// stats counts the nodes and their child slots, and how deep the leaves are.
+func (t *artKeyDir) stats(s *KeyDirStats) {
+	var walk func(n *artNode, depth int)
+	walk = func(n *artNode, depth int) {
+		s.Nodes++
+		if n.index != nil || len(n.children) == 256 {
+			s.Slots += len(n.children)
+		} else {
+			s.Slots += cap(n.children)
+		}
+		if n.leaf != nil && depth > s.MaxDepth {
+			s.MaxDepth = depth
+		}
+		n.each(false, func(b byte, child *artNode) bool {
+			walk(child, depth+1)
+			return true
+		})
+	}
+	walk(t.root, 0)
+	if s.Slots > 0 {
+		// every node but the root is in a slot
+		s.Occupancy = float64(s.Nodes-1) / float64(s.Slots)
+	}
+}
+
+// memory adds up the nodes, with their prefixes and child arrays, and the leaves.
+func (t *artKeyDir) memory(m *KeyDirMemory) {
+	nodeSize, leafSize := int64(unsafe.Sizeof(artNode{})), int64(unsafe.Sizeof(artLeaf{}))
+	var walk func(n *artNode)
+	walk = func(n *artNode) {
+		m.Overhead += nodeSize + int64(len(n.prefix)+cap(n.keys)+cap(n.index)) + int64(cap(n.children))*pointerSize
+		if n.leaf != nil {
+			m.Keys += int64(len(n.leaf.key))
+			m.Overhead += leafSize - keyEntrySize
+		}
+		n.each(false, func(b byte, child *artNode) bool {
+			walk(child)
+			return true
+		})
+	}
+	walk(t.root)
+	m.Entries = int64(t.count) * keyEntrySize
+}
+
+// artKeys is the keyOrder of KeyDirART, the tree itself, which keyDir keeps up to
+// date already.
+type artKeys struct {
+	*artKeyDir
+}
+
+func (artKeys) insert(key string) {}
+
+func (artKeys) remove(key string) {}
+
+func (artKeys) memory() int64 { return 0 }
@@ -0,0 +1,127 @@
+package caskdb
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func Test_artKeyDir(t *testing.T) {
+	tree := newARTKeyDir()
+	want := make(map[string]KeyEntry)
+	rnd := rand.New(rand.NewSource(1))
+	// keys which are prefixes of each other, and nodes of every size
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("b/%c/%d", rune('a'+rnd.Intn(3)), rnd.Intn(3000))
+		if rnd.Intn(9) == 0 {
+			key = key[:rnd.Intn(len(key))]
+		}
+		if rnd.Intn(3) == 0 {
+			tree.remove(key)
+			delete(want, key)
+		} else {
+			tree.set(key, KeyEntry{position: uint32(i)})
+			want[key] = KeyEntry{position: uint32(i)}
+		}
+	}
+	for i := 0; i < 256; i++ {
+		key := "x" + string(rune(i))
+		tree.set(key, KeyEntry{position: uint32(i)})
+		want[key] = KeyEntry{position: uint32(i)}
+	}
+	for i := 0; i < 200; i++ {
+		key := "x" + string(rune(i))
+		tree.remove(key)
+		delete(want, key)
+	}
+	if tree.size() != len(want) {
+		t.Errorf("size() = %d, want %d", tree.size(), len(want))
+	}
+	var keys []string
+	for key, kEntry := range want {
+		keys = append(keys, key)
+		if got, ok := tree.get(key); !ok || got != kEntry {
+			t.Errorf("get(%q) = %v, %v, want %v", key, got, ok, kEntry)
+		}
+	}
+	sort.Strings(keys)
+	var got []string
+	tree.ascend("", func(key string) bool {
+		got = append(got, key)
+		return true
+	})
+	if fmt.Sprint(got) != fmt.Sprint(keys) {
+		t.Fatalf("ascend() gave %d keys, want the %d keys in order", len(got), len(keys))
+	}
+	seen := 0
+	tree.each(func(key string, kEntry KeyEntry) bool {
+		seen++
+		return true
+	})
+	if seen != len(keys) {
+		t.Errorf("each() gave %d keys, want %d", seen, len(keys))
+	}
+	for _, key := range []string{"", "b/", "b/a", "b/a/", "b/b/1500", "b/c/29999", "x", "x\xff", "zzz"} {
+		i := sort.SearchStrings(keys, key)
+		if got, ok := tree.seek(key); i == len(keys) && ok || i < len(keys) && (!ok || got != keys[i]) {
+			t.Errorf("seek(%q) = %q, %v, want the first key not less than it", key, got, ok)
+		}
+		if got, ok := tree.before(key); i == 0 && ok || i > 0 && (!ok || got != keys[i-1]) {
+			t.Errorf("before(%q) = %q, %v, want the last key less than it", key, got, ok)
+		}
+	}
+	if got, ok := tree.last(); !ok || got != keys[len(keys)-1] {
+		t.Errorf("last() = %q, %v, want %q", got, ok, keys[len(keys)-1])
+	}
+
+	for _, key := range keys {
+		tree.remove(key)
+	}
+	if _, ok := tree.last(); ok || tree.size() != 0 || tree.root.n != 0 {
+		t.Errorf("the tree is not empty once every key is removed")
+	}
+}
+
+func TestDiskStore_KeyDirART(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{KeyDirIndex: KeyDirART}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		store.Set(fmt.Sprintf("tenant%d/books/%02d", i%3, i), "dune")
+	}
+	store.Close()
+
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	if n := store.CountPrefix("tenant1/"); n != 33 {
+		t.Errorf("CountPrefix() = %d, want 33", n)
+	}
+	if n, err := store.DeletePrefix("tenant2/"); err != nil || n != 33 {
+		t.Errorf("DeletePrefix() = %d, %v, want 33", n, err)
+	}
+	items, cursor, err := store.List("tenant0/", "", 5)
+	if err != nil || len(items) != 5 || items[0].Key != "tenant0/books/00" || cursor == "" {
+		t.Errorf("List() = %v, %q, %v, want the first 5 keys of tenant0", items, cursor, err)
+	}
+	it := store.Iterator()
+	it.Last()
+	if !it.Valid() || it.Key() != "tenant1/books/97" {
+		t.Errorf("Iterator().Last() = %q, want tenant1/books/97", it.Key())
+	}
+	it.Prev()
+	if it.Key() != "tenant1/books/94" {
+		t.Errorf("Iterator().Prev() = %q, want tenant1/books/94", it.Key())
+	}
+	stats := store.KeyDirStats()
+	if stats.Index != KeyDirART || stats.Keys != 67 || stats.Nodes == 0 || stats.MaxDepth == 0 {
+		t.Errorf("KeyDirStats() = %+v, want 67 keys in a tree", stats)
+	}
+}
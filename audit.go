@@ -0,0 +1,120 @@
+package caskdb
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// auditBatch is how many changes Audit reads from the log at a time
+const auditBatch = 1000
+
+// AuditOp is the kind of a mutation reported by Audit.
+type AuditOp string
+
+const (
+	AuditSet    AuditOp = "set"
+	AuditDelete AuditOp = "delete"
+	// AuditDeleteAll is a DeleteAll, which deleted every key
+	AuditDeleteAll AuditOp = "delete-all"
+)
+
+// AuditOptions filters the events Audit reports.
+type AuditOptions struct {
+	// Prefix only keeps the events of the keys starting with it. A DeleteAll is
+	// kept, as it deletes those keys too.
+	Prefix string
+	// Since and Until only keep the events written at or after Since, and before
+	// Until, when set.
+	Since time.Time
+	Until time.Time
+	// Values adds the values written to the events.
+	Values bool
+}
+
+// AuditEvent is a mutation of the store: who made it, when, and what it was.
+type AuditEvent struct {
+	// Offset is the position of the record in the log, as in Change
+	Offset int64
+	Time   time.Time
+	Op     AuditOp
+	Key    string
+	// ValueSize is the size of the value set, and Value the value itself if
+	// AuditOptions.Values is set
+	ValueSize int
+	Value     string
+	// Expiry is when the key set expires, zero if it does not
+	Expiry time.Time
+	// Meta is the metadata attached by PutWithMeta, nil if there was none; its
+	// Owner tells who made the change, if the writer said
+	Meta *Meta
+}
+
+// Audit calls fn with every mutation recorded in the log, oldest first, which
+// matches the options, and stops at the first error fn returns, which Audit
+// returns. The log only holds the history since the last compaction of a
+// segment: a key written several times before is only reported with its last
+// write, and the keys deleted then not at all. Compactions are not mutations, and
+// are not reported. When ctx is done, Audit stops and returns its error.
+//
+// Like ReadChanges, Audit reads the log from separate handles, and does not block
+// the store meanwhile.
+func (d *DiskStore) Audit(ctx context.Context, opts AuditOptions, fn func(AuditEvent) error) error {
+	var offset int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n := 0
+		next, err := d.scanChanges(offset, auditBatch, func(change Change, data []byte) error {
+			n++
+			event, ok, err := auditEvent(change, data, opts)
+			if err != nil || !ok {
+				return err
+			}
+			return fn(event)
+		})
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		offset = next
+	}
+}
+
+// auditEvent returns the event of a change and its record, and whether it matches
+// the options.
+func auditEvent(change Change, data []byte, opts AuditOptions) (AuditEvent, bool, error) {
+	if (!opts.Since.IsZero() && change.Timestamp.Before(opts.Since)) || (!opts.Until.IsZero() && !change.Timestamp.Before(opts.Until)) {
+		return AuditEvent{}, false, nil
+	}
+	event := AuditEvent{Offset: change.Offset, Time: change.Timestamp}
+	if change.Truncate {
+		if _, key, _ := decodeKV(data); key == compactKey {
+			return AuditEvent{}, false, nil
+		}
+		event.Op = AuditDeleteAll
+		return event, true, nil
+	}
+	if !strings.HasPrefix(change.Key, opts.Prefix) {
+		return AuditEvent{}, false, nil
+	}
+	event.Key, event.Op = change.Key, AuditSet
+	if change.Deleted {
+		event.Op = AuditDelete
+	}
+	event.ValueSize, event.Expiry = len(change.Value), change.Expiry
+	if opts.Values {
+		event.Value = change.Value
+	}
+	if block := metaBlock(data); block != "" {
+		meta, err := decodeMeta(block)
+		if err != nil {
+			return AuditEvent{}, false, err
+		}
+		event.Meta = &meta
+	}
+	return event, true, nil
+}
@@ -0,0 +1,78 @@
+package caskdb
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_Audit(t *testing.T) {
+	store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{MaxSegmentBytes: 300})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.mu.Lock()
+	store.putAt("books/othello", "shakespeare", 1000, 0, "", 0)
+	store.putAt("films/dune", "villeneuve", 2000, 0, "", 0)
+	store.mu.Unlock()
+	if err := store.DeleteAll(); err != nil {
+		t.Fatalf("DeleteAll() error = %v", err)
+	}
+	if err := store.PutWithMeta("books/dune", "herbert", Meta{Owner: "alice"}); err != nil {
+		t.Fatalf("PutWithMeta() error = %v", err)
+	}
+	store.Set("books/anathem", "stephenson")
+	if err := store.Delete("books/anathem"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	store.Set("films/alien", "scott")
+	if _, err := store.Compact(context.Background()); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+
+	audit := func(opts AuditOptions) []AuditEvent {
+		t.Helper()
+		var events []AuditEvent
+		if err := store.Audit(context.Background(), opts, func(e AuditEvent) error {
+			events = append(events, e)
+			return nil
+		}); err != nil {
+			t.Fatalf("Audit() error = %v", err)
+		}
+		return events
+	}
+	ops := func(events []AuditEvent) []string {
+		var ops []string
+		for _, e := range events {
+			ops = append(ops, string(e.Op)+" "+e.Key)
+		}
+		return ops
+	}
+
+	events := audit(AuditOptions{Prefix: "books/", Values: true})
+	want := []string{"delete-all ", "set books/dune", "set books/anathem", "delete books/anathem"}
+	if got := ops(events); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Audit() = %v, want %v", got, want)
+	}
+	if e := events[1]; e.Meta == nil || e.Meta.Owner != "alice" || e.Value != "herbert" || e.ValueSize != 7 {
+		t.Errorf("Audit() = %+v, want the value and owner of books/dune", e)
+	}
+	if e := events[2]; e.Meta != nil {
+		t.Errorf("Audit() = %+v, want no metadata", e)
+	}
+	if events := audit(AuditOptions{Prefix: "books/"}); events[1].Value != "" || events[1].ValueSize != 7 {
+		t.Errorf("Audit() = %+v, want the size of the value only", events[1])
+	}
+
+	// the writes before the DeleteAll were dropped along with their segments
+	since := time.Unix(1500, 0)
+	if got := ops(audit(AuditOptions{Since: since, Until: time.Unix(3000, 0)})); len(got) != 0 {
+		t.Errorf("Audit() between %v and then = %v, want none", since, got)
+	}
+	if got := ops(audit(AuditOptions{Since: since, Prefix: "films/"})); !reflect.DeepEqual(got, []string{"delete-all ", "set films/alien"}) {
+		t.Errorf("Audit() of films/ = %v", got)
+	}
+}
@@ -0,0 +1,82 @@
+package caskdb
+
+import (
+	"sync"
+	"time"
+)
+
+// writeBatch holds the records of an intent, from the intent record to the end
+// record, for flushBatch to append them all at once. The records are kept as
+// encoded rather than copied into a single buffer.
+type writeBatch struct {
+	// start is the offset of the intent record in the active segment
+	start int
+	bufs  [][]byte
+	size  int
+}
+
+// batchPool recycles the batches, and the slices of buffers they hold
+var batchPool = sync.Pool{New: func() any { return new(writeBatch) }}
+
+// add appends the record to the batch, whose first record lands at offset.
+func (b *writeBatch) add(data []byte, offset int) {
+	if len(b.bufs) == 0 {
+		b.start = offset
+	}
+	b.bufs = append(b.bufs, data)
+	b.size += len(data)
+}
+
+// flushBatch appends the records of the batch to the active file with a single
+// writev, and fsyncs them once. On failure, whatever made it to the file is cut
+// off, and the batch is left for discardBatch. The store must be locked.
+func (d *DiskStore) flushBatch() error {
+	b := d.batch
+	if err := d.engine().writev(d.file, b.bufs); err != nil {
+		d.log.Error("write failed", "file", d.file.Name(), "offset", b.start, "error", err)
+		d.truncateBatch()
+		return err
+	}
+	start := time.Now()
+	defer d.observe("Sync", "", b.size, d.file.Name(), start)
+	if err := d.syncFile(); err != nil {
+		d.truncateBatch()
+		return err
+	}
+	d.releaseBatch()
+	return nil
+}
+
+// truncateBatch cuts the records of the batch off the active file. Should that
+// fail too, the load drops them anyway, as an intent without an end record. The
+// store must be locked.
+func (d *DiskStore) truncateBatch() {
+	if err := truncateFile(d.file, int64(d.batch.start)); err != nil {
+		d.log.Error("failed to truncate", "file", d.file.Name(), "offset", d.batch.start, "error", err)
+	}
+}
+
+// discardBatch drops the records of the batch, which are not in the file, moving
+// the write position back to where it started. The blobs written in the batch are
+// forgotten, for the next write of their values to write them again. The store
+// must be locked.
+func (d *DiskStore) discardBatch() {
+	d.writePosition = d.batch.start
+	for _, b := range d.blobs {
+		if b.at.segment == d.active().id && int(b.at.position) >= d.writePosition {
+			b.at = KeyEntry{}
+		}
+	}
+	d.releaseBatch()
+}
+
+// releaseBatch returns the batch to the pool. The store must be locked.
+func (d *DiskStore) releaseBatch() {
+	b := d.batch
+	for i := range b.bufs {
+		b.bufs[i] = nil
+	}
+	b.bufs, b.size = b.bufs[:0], 0
+	d.batch = nil
+	batchPool.Put(b)
+}
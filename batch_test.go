@@ -0,0 +1,92 @@
+package caskdb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_writev(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.db")
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("head|")); err != nil {
+		t.Fatal(err)
+	}
+	// more buffers than a single writev takes, and some empty ones
+	var bufs [][]byte
+	want := []byte("head|")
+	for i := 0; i < 3000; i++ {
+		b := []byte(fmt.Sprintf("%d,", i))
+		if i%7 == 0 {
+			b = nil
+		}
+		bufs = append(bufs, b)
+		want = append(want, b...)
+	}
+	if err := writev(f, bufs); err != nil {
+		t.Fatalf("writev() error = %v", err)
+	}
+	got, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("writev() wrote %q, want %q", got, want)
+	}
+}
+
+func TestDiskStore_discardBatch(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{Dedup: true})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("othello", "shakespeare")
+	size := store.writePosition
+	blob := strings.Repeat("b", 200)
+
+	// a commit failing part way writes nothing
+	store.mu.Lock()
+	if err := store.beginIntent(2, 1000, 1); err != nil {
+		t.Fatalf("beginIntent() error = %v", err)
+	}
+	old, _ := store.keyDir.get("othello")
+	if _, err := store.putAt("othello", "abc", 1, 0, "", 0); err != nil {
+		t.Fatalf("putAt() error = %v", err)
+	}
+	if _, err := store.putAt("copy", blob, 1, 0, "", 0); err != nil {
+		t.Fatalf("putAt() error = %v", err)
+	}
+	store.abortIntent([]txnUndo{{"othello", old, true}, {key: "copy"}})
+	store.mu.Unlock()
+	if store.writePosition != size || store.batch != nil || store.inIntent {
+		t.Errorf("writePosition = %v, batch = %v, want %v and none", store.writePosition, store.batch, size)
+	}
+	if info, err := os.Stat(fileName); err != nil || info.Size() != int64(size) {
+		t.Errorf("file size = %v, %v, want %v", info.Size(), err, size)
+	}
+
+	// the blob of the discarded batch is written again
+	if err := store.Put("copy", blob); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	store.Close()
+	store, err = NewDiskStoreWithOptions(fileName, Options{Dedup: true})
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	for key, want := range map[string]string{"othello": "shakespeare", "copy": blob} {
+		if got, err := store.Lookup(key); err != nil || got != want {
+			t.Errorf("Lookup(%q) = %q, %v, want %q", key, got, err, want)
+		}
+	}
+}
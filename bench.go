@@ -0,0 +1,233 @@
+package caskdb
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Defaults of BenchOptions
+const (
+	DefaultBenchDuration = 10 * time.Second
+	DefaultBenchKeys     = 10000
+)
+
+// SizeDistribution is the distribution of the sizes of the keys or values Bench
+// writes, in bytes, between Min and Max inclusive. A Max below Min stands for Min,
+// for sizes which are all the same.
+type SizeDistribution struct {
+	Min, Max int
+	Shape    Shape
+}
+
+// Shape is the shape of a SizeDistribution.
+type Shape int
+
+const (
+	// ShapeUniform makes every size between Min and Max as likely
+	ShapeUniform Shape = iota
+	// ShapeNormal centres the sizes between Min and Max, with Min and Max three
+	// standard deviations away
+	ShapeNormal
+	// ShapeExponential makes most sizes close to Min, with a long tail up to Max,
+	// e.g. mostly small values and the odd large document
+	ShapeExponential
+)
+
+// String returns the name of the shape, e.g. "uniform".
+func (s Shape) String() string {
+	switch s {
+	case ShapeUniform:
+		return "uniform"
+	case ShapeNormal:
+		return "normal"
+	case ShapeExponential:
+		return "exponential"
+	}
+	return fmt.Sprintf("Shape(%d)", int(s))
+}
+
+// sample returns a size drawn from the distribution.
+func (s SizeDistribution) sample(r *rand.Rand) int {
+	spread := s.Max - s.Min
+	if spread <= 0 {
+		return s.Min
+	}
+	var size float64
+	switch s.Shape {
+	case ShapeNormal:
+		size = float64(s.Min) + float64(spread)/2 + r.NormFloat64()*float64(spread)/6
+	case ShapeExponential:
+		size = float64(s.Min) + r.ExpFloat64()*float64(spread)/8
+	default:
+		return s.Min + r.Intn(spread+1)
+	}
+	return int(math.Max(float64(s.Min), math.Min(float64(s.Max), math.Round(size))))
+}
+
+// BenchOptions configure the load Bench generates.
+type BenchOptions struct {
+	// Duration is how long the load runs for, DefaultBenchDuration by default
+	Duration time.Duration
+	// Concurrency is the number of goroutines generating the load, 1 by default
+	Concurrency int
+	// ReadRatio is the share of the operations which are reads, from 0 for writes
+	// only to 1 for reads only
+	ReadRatio float64
+	// Keys is the number of distinct keys read and written, DefaultBenchKeys by
+	// default
+	Keys int
+	// KeySize and ValueSize are the distributions of the sizes of the keys and
+	// values written. A key is never shorter than its number, and a value never
+	// empty, which would be a delete.
+	KeySize   SizeDistribution
+	ValueSize SizeDistribution
+	// Seed seeds the random choices, for a load which can be repeated
+	Seed int64
+}
+
+// BenchReport is the result of Bench.
+type BenchReport struct {
+	// Duration is how long the load ran for
+	Duration time.Duration
+	// Reads and Writes summarise the latencies of Get and Set as seen by the
+	// callers, waiting on the store included
+	Reads  LatencyStats
+	Writes LatencyStats
+	// BytesRead and BytesWritten count the keys and values of the operations
+	BytesRead    int64
+	BytesWritten int64
+	// Errors is the number of operations which failed
+	Errors uint64
+}
+
+// Throughput returns the operations per second.
+func (r BenchReport) Throughput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Reads.Count+r.Writes.Count) / r.Duration.Seconds()
+}
+
+// Bench generates load on the store, e.g. to size the hardware for a workload or
+// to compare Options: it first writes every key once, then reads and writes
+// random keys from opts.Concurrency goroutines for opts.Duration, or until ctx is
+// done, and reports the throughput and latencies. The keys are the numbers from 0
+// to opts.Keys, padded with zeroes to their size, and overwrite those of the
+// store: bench a store of its own rather than one holding data.
+func (d *DiskStore) Bench(ctx context.Context, opts BenchOptions) (BenchReport, error) {
+	if opts.Duration <= 0 {
+		opts.Duration = DefaultBenchDuration
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	if opts.Keys <= 0 {
+		opts.Keys = DefaultBenchKeys
+	}
+	if opts.ReadRatio < 0 || opts.ReadRatio > 1 {
+		return BenchReport{}, fmt.Errorf("caskdb: read ratio %v is not between 0 and 1", opts.ReadRatio)
+	}
+	r := rand.New(rand.NewSource(opts.Seed))
+	keys := make([]string, opts.Keys)
+	for i := range keys {
+		keys[i] = benchKey(i, opts.KeySize.sample(r))
+	}
+	// the values are taken from a buffer of random bytes, as the same bytes over and
+	// over would flatter compression
+	if opts.ValueSize.Max < opts.ValueSize.Min {
+		opts.ValueSize.Max = opts.ValueSize.Min
+	}
+	buf := make([]byte, opts.ValueSize.Max+1)
+	r.Read(buf)
+	value := func(r *rand.Rand) string {
+		size := opts.ValueSize.sample(r)
+		if size < 1 {
+			size = 1
+		}
+		start := r.Intn(len(buf) - size + 1)
+		return string(buf[start : start+size])
+	}
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return BenchReport{}, ctx.Err()
+		}
+		if err := d.Put(key, value(r)); err != nil {
+			return BenchReport{}, fmt.Errorf("caskdb: writing the keys: %w", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Duration)
+	defer cancel()
+	workers := make([]benchWorker, opts.Concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range workers {
+		w := &workers[i]
+		w.rand = rand.New(rand.NewSource(opts.Seed + int64(i) + 1))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				key := keys[w.rand.Intn(len(keys))]
+				if w.rand.Float64() < opts.ReadRatio {
+					w.read(d, key)
+				} else {
+					w.write(d, key, value(w.rand))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	report := BenchReport{Duration: time.Since(start)}
+	var reads, writes latencyHistogram
+	for i := range workers {
+		w := &workers[i]
+		reads.merge(&w.reads)
+		writes.merge(&w.writes)
+		report.BytesRead += w.bytesRead
+		report.BytesWritten += w.bytesWritten
+		report.Errors += w.errors
+	}
+	report.Reads, report.Writes = reads.summary(), writes.summary()
+	return report, nil
+}
+
+// benchWorker is the state of one of the goroutines of Bench.
+type benchWorker struct {
+	rand          *rand.Rand
+	reads, writes latencyHistogram
+	bytesRead     int64
+	bytesWritten  int64
+	errors        uint64
+}
+
+func (w *benchWorker) read(d *DiskStore, key string) {
+	start := time.Now()
+	value, err := d.Lookup(key)
+	w.reads.record(time.Since(start))
+	if err != nil {
+		w.errors++
+		return
+	}
+	w.bytesRead += int64(len(key) + len(value))
+}
+
+func (w *benchWorker) write(d *DiskStore, key, value string) {
+	start := time.Now()
+	err := d.Put(key, value)
+	w.writes.record(time.Since(start))
+	if err != nil {
+		w.errors++
+		return
+	}
+	w.bytesWritten += int64(len(key) + len(value))
+}
+
+// benchKey returns the i-th key of Bench, padded with zeroes to size.
+func benchKey(i, size int) string {
+	return fmt.Sprintf("%0*d", size, i)
+}
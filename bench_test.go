@@ -0,0 +1,78 @@
+package caskdb
+
+import (
+	"context"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_Bench(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	opts := BenchOptions{
+		Duration:    50 * time.Millisecond,
+		Concurrency: 4,
+		ReadRatio:   0.5,
+		Keys:        100,
+		KeySize:     SizeDistribution{Min: 8, Max: 8},
+		ValueSize:   SizeDistribution{Min: 10, Max: 100, Shape: ShapeExponential},
+	}
+	report, err := store.Bench(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Bench() error = %v", err)
+	}
+	if report.Reads.Count == 0 || report.Writes.Count == 0 || report.Errors != 0 {
+		t.Errorf("Bench() = %+v, want reads and writes without errors", report)
+	}
+	if report.Reads.P50 > report.Reads.P99 || report.Reads.P99 > report.Reads.Max {
+		t.Errorf("Bench() read latencies = %+v, want p50 <= p99 <= max", report.Reads)
+	}
+	if report.Throughput() <= 0 {
+		t.Errorf("Throughput() = %v, want more than 0", report.Throughput())
+	}
+	if got := store.Stats().Keys; got != opts.Keys {
+		t.Errorf("Stats() keys = %v, want %v", got, opts.Keys)
+	}
+	for _, key := range store.Keys() {
+		if len(key) != 8 {
+			t.Errorf("key %q is %v bytes, want 8", key, len(key))
+		}
+		if size := len(store.Get(key)); size < 10 || size > 100 {
+			t.Errorf("value of %q is %v bytes, want between 10 and 100", key, size)
+		}
+	}
+
+	if _, err := store.Bench(context.Background(), BenchOptions{ReadRatio: 2}); err == nil {
+		t.Errorf("Bench() with a read ratio of 2 error = nil, want an error")
+	}
+}
+
+func TestSizeDistribution_sample(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, shape := range []Shape{ShapeUniform, ShapeNormal, ShapeExponential} {
+		s := SizeDistribution{Min: 10, Max: 20, Shape: shape}
+		sum := 0
+		for i := 0; i < 1000; i++ {
+			size := s.sample(r)
+			if size < s.Min || size > s.Max {
+				t.Fatalf("%v sample() = %v, want between %v and %v", shape, size, s.Min, s.Max)
+			}
+			sum += size
+		}
+		mean := float64(sum) / 1000
+		if shape == ShapeExponential && mean > 13 {
+			t.Errorf("%v mean = %v, want the sizes close to the minimum", shape, mean)
+		}
+		if shape != ShapeExponential && (mean < 14 || mean > 16) {
+			t.Errorf("%v mean = %v, want the sizes centred", shape, mean)
+		}
+	}
+	if got := (SizeDistribution{Min: 5}).sample(r); got != 5 {
+		t.Errorf("sample() of a fixed size = %v, want 5", got)
+	}
+}
@@ -0,0 +1,305 @@
+// Package bitcask reads and writes the on-disk format of Riak's Bitcask, the
+// Erlang implementation CaskDB is modelled on, so that data can be migrated
+// between the two.
+//
+// A Bitcask is a directory of data files, 1.bitcask.data, 2.bitcask.data and so
+// on, the higher numbers holding the later writes. Each entry of a data file is
+//
+//	┌──────────┬────────────────┬──────────────┬─────────────────┬─────┬───────┐
+//	│ crc(32b) │ timestamp(32b) │ key_sz(16b)  │ value_sz(32b)   │ key │ value │
+//	└──────────┴────────────────┴──────────────┴─────────────────┴─────┴───────┘
+//
+// big endian, the crc covering everything after it. A delete is an entry whose
+// value starts with "bitcask_tombstone". Next to a data file, a hint file, e.g.
+// 1.bitcask.hint, lists its keys so that Bitcask opens without reading the
+// values:
+//
+//	┌────────────────┬─────────────┬───────────────┬────────────────────────────┬─────┐
+//	│ timestamp(32b) │ key_sz(16b) │ total_sz(32b) │ tombstone(1b) offset(63b)  │ key │
+//	└────────────────┴─────────────┴───────────────┴────────────────────────────┴─────┘
+//
+// ending with an entry holding the crc of the others in total_sz, with the
+// largest offset and no key.
+//
+// Bitcask has no expiry of its own keys, so Export writes the keys which expire
+// as if they did not, and the keys of Bitcask are limited to 64KB.
+package bitcask
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+const (
+	// dataHeaderSize is the size of the header of a data file entry, and
+	// hintHeaderSize that of a hint file entry
+	dataHeaderSize = 14
+	hintHeaderSize = 18
+	// maxKeySize is the size of the largest key the 16 bits of key_sz can hold
+	maxKeySize = math.MaxUint16
+	// maxOffset is the offset of the entry ending a hint file
+	maxOffset = 1<<63 - 1
+	// tombstonePrefix starts the value of every delete, whichever version of
+	// Bitcask wrote it
+	tombstonePrefix = "bitcask_tombstone"
+	// dataSuffix and hintSuffix end the names of the data and hint files
+	dataSuffix = ".bitcask.data"
+	hintSuffix = ".bitcask.hint"
+)
+
+// MaxFileBytes is the size past which Export starts a new data file, the default
+// max_file_size of Bitcask.
+const MaxFileBytes = 2 << 30
+
+// ErrKeyTooLarge is returned by Export for a key larger than Bitcask allows.
+var ErrKeyTooLarge = errors.New("bitcask: key too large")
+
+// Import merges the keys of the Bitcask in dir into the store, like
+// caskdb.DiskStore.MergeChanges does, and returns the number of keys it changed.
+// The writes keep their timestamps. Only the data files are read, as the hint
+// files hold no values. A partially written entry at the end of a data file, left
+// by a crash, ends it as it does for Bitcask.
+func Import(store *caskdb.DiskStore, dir string) (int, error) {
+	ids, err := fileIDs(dir)
+	if err != nil {
+		return 0, err
+	}
+	var changes []caskdb.Change
+	for _, id := range ids {
+		fileChanges, err := readDataFile(filepath.Join(dir, strconv.Itoa(id)+dataSuffix))
+		if err != nil {
+			return 0, err
+		}
+		changes = append(changes, fileChanges...)
+	}
+	return store.MergeChanges(changes, caskdb.MergeOptions{})
+}
+
+// fileIDs returns the numbers of the data files in dir, in order.
+func fileIDs(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), dataSuffix)
+		if name == entry.Name() || entry.IsDir() {
+			continue
+		}
+		if id, err := strconv.Atoi(name); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// readDataFile returns the entries of a data file as changes, oldest first.
+func readDataFile(fileName string) ([]caskdb.Change, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	var changes []caskdb.Change
+	header := make([]byte, dataHeaderSize)
+	for offset := int64(0); ; {
+		if _, err := io.ReadFull(r, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return changes, nil
+		} else if err != nil {
+			return nil, err
+		}
+		keySize := int(binary.BigEndian.Uint16(header[8:10]))
+		valueSize := int64(binary.BigEndian.Uint32(header[10:14]))
+		data := make([]byte, int64(keySize)+valueSize)
+		if _, err := io.ReadFull(r, data); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return changes, nil
+		} else if err != nil {
+			return nil, err
+		}
+		crc := crc32.ChecksumIEEE(header[4:])
+		if crc32.Update(crc, crc32.IEEETable, data) != binary.BigEndian.Uint32(header[0:4]) {
+			return nil, fmt.Errorf("%w: %s offset %d", caskdb.ErrCorruptRecord, fileName, offset)
+		}
+		change := caskdb.Change{
+			Key:       string(data[:keySize]),
+			Value:     string(data[keySize:]),
+			Timestamp: time.Unix(int64(binary.BigEndian.Uint32(header[4:8])), 0),
+		}
+		if strings.HasPrefix(change.Value, tombstonePrefix) {
+			change.Value, change.Deleted = "", true
+		}
+		changes = append(changes, change)
+		offset += dataHeaderSize + int64(len(data))
+	}
+}
+
+// Export writes the live keys of the store to dir as a Bitcask, in data files of
+// up to MaxFileBytes along with their hint files, and returns the number of keys
+// written. The directory is created if need be, and must not hold a Bitcask
+// already.
+func Export(store *caskdb.DiskStore, dir string) (int, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+	if ids, err := fileIDs(dir); err != nil {
+		return 0, err
+	} else if len(ids) > 0 {
+		return 0, fmt.Errorf("bitcask: %s holds a Bitcask already", dir)
+	}
+	// the latest version of every key, with its timestamp, in the order they were
+	// written
+	var changes []caskdb.Change
+	latest := make(map[string]int)
+	now := time.Now()
+	for offset := int64(0); ; {
+		batch, next, err := store.ReadChanges(offset, 1024)
+		if err != nil {
+			return 0, err
+		}
+		if next == offset {
+			break
+		}
+		for _, change := range batch {
+			if change.Truncate {
+				changes, latest = nil, make(map[string]int)
+				continue
+			}
+			if i, ok := latest[change.Key]; ok {
+				changes[i].Deleted = true
+			}
+			latest[change.Key] = len(changes)
+			changes = append(changes, change)
+		}
+		offset = next
+	}
+	w := &writer{dir: dir}
+	defer w.close()
+	n := 0
+	for _, change := range changes {
+		if change.Deleted || !change.Expiry.IsZero() && !now.Before(change.Expiry) {
+			continue
+		}
+		if err := w.write(change); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, w.close()
+}
+
+// writer writes the entries of Export to the data and hint files.
+type writer struct {
+	dir        string
+	id         int
+	data, hint *os.File
+	dataBuf    *bufio.Writer
+	hintBuf    *bufio.Writer
+	// offset is where the next entry lands in the data file, and hintCRC the crc
+	// of the hint file so far
+	offset  int64
+	hintCRC uint32
+}
+
+func (w *writer) write(change caskdb.Change) error {
+	if len(change.Key) > maxKeySize {
+		return fmt.Errorf("%w: %q is %d bytes", ErrKeyTooLarge, change.Key[:32]+"...", len(change.Key))
+	}
+	size := int64(dataHeaderSize + len(change.Key) + len(change.Value))
+	if w.data == nil || w.offset > 0 && w.offset+size > MaxFileBytes {
+		if err := w.next(); err != nil {
+			return err
+		}
+	}
+	timestamp := uint32(change.Timestamp.Unix())
+	header := make([]byte, dataHeaderSize)
+	binary.BigEndian.PutUint32(header[4:8], timestamp)
+	binary.BigEndian.PutUint16(header[8:10], uint16(len(change.Key)))
+	binary.BigEndian.PutUint32(header[10:14], uint32(len(change.Value)))
+	crc := crc32.ChecksumIEEE(header[4:])
+	crc = crc32.Update(crc, crc32.IEEETable, []byte(change.Key))
+	crc = crc32.Update(crc, crc32.IEEETable, []byte(change.Value))
+	binary.BigEndian.PutUint32(header[0:4], crc)
+	w.dataBuf.Write(header)
+	w.dataBuf.WriteString(change.Key)
+	w.dataBuf.WriteString(change.Value)
+
+	hint := encodeHint(timestamp, change.Key, uint32(size), uint64(w.offset))
+	w.hintCRC = crc32.Update(w.hintCRC, crc32.IEEETable, hint)
+	w.hintBuf.Write(hint)
+	w.offset += size
+	return nil
+}
+
+// encodeHint returns the hint file entry of a live key.
+func encodeHint(timestamp uint32, key string, totalSize uint32, offset uint64) []byte {
+	hint := make([]byte, hintHeaderSize, hintHeaderSize+len(key))
+	binary.BigEndian.PutUint32(hint[0:4], timestamp)
+	binary.BigEndian.PutUint16(hint[4:6], uint16(len(key)))
+	binary.BigEndian.PutUint32(hint[6:10], totalSize)
+	binary.BigEndian.PutUint64(hint[10:18], offset)
+	return append(hint, key...)
+}
+
+// next closes the current files, and starts the next ones.
+func (w *writer) next() error {
+	if err := w.close(); err != nil {
+		return err
+	}
+	w.id++
+	base := filepath.Join(w.dir, strconv.Itoa(w.id))
+	data, err := os.Create(base + dataSuffix)
+	if err != nil {
+		return err
+	}
+	hint, err := os.Create(base + hintSuffix)
+	if err != nil {
+		data.Close()
+		return err
+	}
+	w.data, w.hint = data, hint
+	w.dataBuf, w.hintBuf = bufio.NewWriter(data), bufio.NewWriter(hint)
+	w.offset, w.hintCRC = 0, 0
+	return nil
+}
+
+// close ends the hint file with its crc, and flushes and syncs both files. It
+// does nothing if no file is open.
+func (w *writer) close() error {
+	if w.data == nil {
+		return nil
+	}
+	end := make([]byte, hintHeaderSize)
+	binary.BigEndian.PutUint32(end[6:10], w.hintCRC)
+	binary.BigEndian.PutUint64(end[10:18], maxOffset)
+	w.hintBuf.Write(end)
+	var errs []error
+	for _, f := range []struct {
+		buf  *bufio.Writer
+		file *os.File
+	}{{w.dataBuf, w.data}, {w.hintBuf, w.hint}} {
+		errs = append(errs, f.buf.Flush(), f.file.Sync(), f.file.Close())
+	}
+	w.data, w.hint = nil, nil
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
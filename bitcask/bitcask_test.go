@@ -0,0 +1,153 @@
+package bitcask
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+func TestExportImport(t *testing.T) {
+	dir := t.TempDir()
+	src, err := caskdb.NewDiskStore(filepath.Join(dir, "src.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer src.Close()
+	src.Set("othello", "shakespeare")
+	src.Set("gitanjali", "tagore")
+	src.Set("othello", "william shakespeare")
+	src.Set("crime and punishment", "dostoyevsky")
+	if err := src.Delete("crime and punishment"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if err := src.PutWithTTL("anna karenina", "tolstoy", time.Hour); err != nil {
+		t.Fatalf("PutWithTTL() error = %v", err)
+	}
+
+	exported := filepath.Join(dir, "bitcask")
+	n, err := Export(src, exported)
+	if err != nil {
+		t.Fatalf("Export() error = %v", err)
+	}
+	if n != 3 {
+		t.Errorf("Export() = %v, want %v", n, 3)
+	}
+	if _, err := Export(src, exported); err == nil {
+		t.Errorf("Export() into a Bitcask error = nil, want an error")
+	}
+
+	dst, err := caskdb.NewDiskStore(filepath.Join(dir, "dst.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer dst.Close()
+	n, err = Import(dst, exported)
+	if err != nil {
+		t.Fatalf("Import() error = %v", err)
+	}
+	if n != 3 {
+		t.Errorf("Import() = %v, want %v", n, 3)
+	}
+	for key, want := range map[string]string{"othello": "william shakespeare", "gitanjali": "tagore", "anna karenina": "tolstoy"} {
+		if got := dst.Get(key); got != want {
+			t.Errorf("Get(%q) = %q, want %q", key, got, want)
+		}
+	}
+	if _, err := dst.Lookup("crime and punishment"); !errors.Is(err, caskdb.ErrKeyNotFound) {
+		t.Errorf("Lookup() error = %v, want %v", err, caskdb.ErrKeyNotFound)
+	}
+}
+
+func TestExport_hintFile(t *testing.T) {
+	dir := t.TempDir()
+	store, err := caskdb.NewDiskStore(filepath.Join(dir, "books.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("othello", "shakespeare")
+	store.Set("gitanjali", "tagore")
+	if _, err := Export(store, dir); err != nil {
+		t.Fatalf("Export() error = %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "1.bitcask.data"))
+	if err != nil {
+		t.Fatalf("failed to read data file: %v", err)
+	}
+	hint, err := os.ReadFile(filepath.Join(dir, "1.bitcask.hint"))
+	if err != nil {
+		t.Fatalf("failed to read hint file: %v", err)
+	}
+	first := dataHeaderSize + len("othello") + len("shakespeare")
+	if want := first + dataHeaderSize + len("gitanjali") + len("tagore"); len(data) != want {
+		t.Errorf("data file size = %v, want %v", len(data), want)
+	}
+	if got := binary.BigEndian.Uint32(data[0:4]); got != crc32.ChecksumIEEE(data[4:first]) {
+		t.Errorf("data crc = %v, want %v", got, crc32.ChecksumIEEE(data[4:first]))
+	}
+	second := hint[hintHeaderSize+len("othello"):]
+	if got := binary.BigEndian.Uint64(second[10:18]); got != uint64(first) {
+		t.Errorf("hint offset = %v, want %v", got, first)
+	}
+	end := hint[len(hint)-hintHeaderSize:]
+	if got, want := binary.BigEndian.Uint32(end[6:10]), crc32.ChecksumIEEE(hint[:len(hint)-hintHeaderSize]); got != want {
+		t.Errorf("hint crc = %v, want %v", got, want)
+	}
+	if got := binary.BigEndian.Uint64(end[10:18]); got != maxOffset {
+		t.Errorf("hint end offset = %v, want %v", got, uint64(maxOffset))
+	}
+}
+
+func TestImport(t *testing.T) {
+	dir := t.TempDir()
+	entry := func(key, value string) []byte {
+		b := make([]byte, dataHeaderSize)
+		binary.BigEndian.PutUint32(b[4:8], uint32(time.Now().Unix()))
+		binary.BigEndian.PutUint16(b[8:10], uint16(len(key)))
+		binary.BigEndian.PutUint32(b[10:14], uint32(len(value)))
+		b = append(append(b, key...), value...)
+		binary.BigEndian.PutUint32(b[0:4], crc32.ChecksumIEEE(b[4:]))
+		return b
+	}
+	var first []byte
+	first = append(first, entry("othello", "shakespeare")...)
+	first = append(first, entry("gitanjali", "tagore")...)
+	// a delete of Bitcask 2, followed by an entry cut short by a crash
+	second := append(entry("othello", "bitcask_tombstone2\x00\x00\x00\x01"), entry("beloved", "morrison")[:10]...)
+	if err := os.WriteFile(filepath.Join(dir, "1.bitcask.data"), first, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "2.bitcask.data"), second, 0644); err != nil {
+		t.Fatal(err)
+	}
+	store, err := caskdb.NewDiskStore(filepath.Join(dir, "books.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if _, err := Import(store, dir); err != nil {
+		t.Fatalf("Import() error = %v", err)
+	}
+	if got := store.Get("gitanjali"); got != "tagore" {
+		t.Errorf("Get() = %v, want %v", got, "tagore")
+	}
+	for _, key := range []string{"othello", "beloved"} {
+		if _, err := store.Lookup(key); !errors.Is(err, caskdb.ErrKeyNotFound) {
+			t.Errorf("Lookup(%q) error = %v, want %v", key, err, caskdb.ErrKeyNotFound)
+		}
+	}
+
+	first[len(first)-1] ^= 0xff
+	if err := os.WriteFile(filepath.Join(dir, "1.bitcask.data"), first, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Import(store, dir); !errors.Is(err, caskdb.ErrCorruptRecord) {
+		t.Errorf("Import() error = %v, want %v", err, caskdb.ErrCorruptRecord)
+	}
+}
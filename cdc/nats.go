@@ -0,0 +1,195 @@
+package cdc
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+// natsTimeout bounds talking to the NATS server when the context of Publish has
+// no deadline
+const natsTimeout = 10 * time.Second
+
+// Message is the JSON encoding of a Change, as published by NATSPublisher.
+type Message struct {
+	Offset    int64     `json:"offset"`
+	Key       string    `json:"key"`
+	Value     string    `json:"value,omitempty"`
+	Deleted   bool      `json:"deleted,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	// Expiry is set for the keys which expire
+	Expiry *time.Time `json:"expiry,omitempty"`
+	// Truncate is set when every key was deleted, and Key is then empty
+	Truncate bool `json:"truncate,omitempty"`
+	// Encoding is "base64" when Key and Value are encoded in base64, which they
+	// are when either is not valid UTF-8, as JSON strings cannot hold it
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// NATSPublisher publishes every change as a JSON Message to a NATS subject. It
+// speaks the NATS client protocol directly, and considers a batch published once
+// the server has answered a PING sent after it, i.e. once the server has processed
+// every message of the batch. Credentials and TLS are not supported.
+//
+// The connection is made on the first Publish, and made again on the next one
+// after a failure.
+type NATSPublisher struct {
+	addr    string
+	subject string
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// NewNATSPublisher returns a NATSPublisher publishing to the subject on the NATS
+// server at addr, e.g. "localhost:4222".
+func NewNATSPublisher(addr string, subject string) (*NATSPublisher, error) {
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return nil, fmt.Errorf("cdc: invalid NATS subject %q", subject)
+	}
+	return &NATSPublisher{addr: addr, subject: subject}, nil
+}
+
+func (p *NATSPublisher) Publish(ctx context.Context, changes []caskdb.Change) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		if err := p.connect(ctx); err != nil {
+			return err
+		}
+	}
+	if err := p.publish(ctx, changes); err != nil {
+		// we do not know what state the connection is in, start over next time
+		p.conn.Close()
+		p.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Close closes the connection to the server.
+func (p *NATSPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		return nil
+	}
+	err := p.conn.Close()
+	p.conn = nil
+	return err
+}
+
+func (p *NATSPublisher) connect(ctx context.Context) error {
+	dialer := net.Dialer{Timeout: natsTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return err
+	}
+	p.conn, p.r = conn, bufio.NewReader(conn)
+	setDeadline(ctx, conn)
+	// the server greets us with its INFO, then we introduce ourselves and make
+	// sure it took it with a PING
+	line, err := p.readLine()
+	if err == nil && !strings.HasPrefix(line, "INFO ") {
+		err = fmt.Errorf("cdc: unexpected greeting from NATS: %q", line)
+	}
+	if err == nil {
+		_, err = conn.Write([]byte("CONNECT {\"verbose\":false,\"pedantic\":false,\"lang\":\"go\",\"name\":\"caskdb-cdc\"}\r\nPING\r\n"))
+	}
+	if err == nil {
+		err = p.waitPong()
+	}
+	if err != nil {
+		conn.Close()
+		p.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (p *NATSPublisher) publish(ctx context.Context, changes []caskdb.Change) error {
+	setDeadline(ctx, p.conn)
+	w := bufio.NewWriter(p.conn)
+	for _, c := range changes {
+		msg := Message{
+			Offset:    c.Offset,
+			Key:       c.Key,
+			Value:     c.Value,
+			Deleted:   c.Deleted,
+			Timestamp: c.Timestamp,
+			Truncate:  c.Truncate,
+		}
+		if !c.Expiry.IsZero() {
+			msg.Expiry = &c.Expiry
+		}
+		if !utf8.ValidString(c.Key) || !utf8.ValidString(c.Value) {
+			msg.Key = base64.StdEncoding.EncodeToString([]byte(c.Key))
+			msg.Value = base64.StdEncoding.EncodeToString([]byte(c.Value))
+			msg.Encoding = "base64"
+		}
+		payload, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		w.WriteString("PUB " + p.subject + " " + strconv.Itoa(len(payload)) + "\r\n")
+		w.Write(payload)
+		w.WriteString("\r\n")
+	}
+	w.WriteString("PING\r\n")
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return p.waitPong()
+}
+
+// waitPong reads from the server until the PONG answering our PING, answering the
+// server's own PINGs on the way.
+func (p *NATSPublisher) waitPong() error {
+	for {
+		line, err := p.readLine()
+		if err != nil {
+			return err
+		}
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := p.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New("cdc: NATS error: " + strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+		// anything else, like an updated INFO, is of no interest to us
+	}
+}
+
+func (p *NATSPublisher) readLine() (string, error) {
+	line, err := p.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// setDeadline makes the I/O on conn give up with ctx, or after natsTimeout
+// when ctx has no deadline.
+func setDeadline(ctx context.Context, conn net.Conn) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(natsTimeout)
+	}
+	conn.SetDeadline(deadline)
+}
@@ -0,0 +1,95 @@
+package cdc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+// fakeNATS accepts a single client, speaks just enough of the NATS protocol for
+// NATSPublisher, and sends the payloads published to it on the returned channel.
+func fakeNATS(t *testing.T) (string, chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	msgs := make(chan string, 10)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		conn.Write([]byte("INFO {\"server_id\":\"fake\"}\r\n"))
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fields := strings.Fields(line)
+			switch {
+			case len(fields) == 3 && fields[0] == "PUB":
+				n, _ := strconv.Atoi(fields[2])
+				payload := make([]byte, n+2)
+				if _, err := io.ReadFull(r, payload); err != nil {
+					return
+				}
+				msgs <- fields[1] + " " + string(payload[:n])
+			case len(fields) == 1 && fields[0] == "PING":
+				conn.Write([]byte("PONG\r\n"))
+			}
+		}
+	}()
+	return ln.Addr().String(), msgs
+}
+
+func TestNATSPublisher(t *testing.T) {
+	addr, msgs := fakeNATS(t)
+	pub, err := NewNATSPublisher(addr, "caskdb.changes")
+	if err != nil {
+		t.Fatalf("NewNATSPublisher() error = %v", err)
+	}
+	defer pub.Close()
+	ts := time.Unix(1700000000, 0)
+	err = pub.Publish(context.Background(), []caskdb.Change{
+		{Offset: 0, Key: "othello", Value: "shakespeare", Timestamp: ts},
+		{Offset: 42, Key: "othello", Deleted: true, Timestamp: ts},
+		{Offset: 77, Key: "a\x00\xff", Value: "folio", Timestamp: ts},
+	})
+	if err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	for _, want := range []Message{
+		{Offset: 0, Key: "othello", Value: "shakespeare", Timestamp: ts},
+		{Offset: 42, Key: "othello", Deleted: true, Timestamp: ts},
+		// JSON cannot carry the key as it is
+		{Offset: 77, Key: "YQD/", Value: "Zm9saW8=", Timestamp: ts, Encoding: "base64"},
+	} {
+		got := <-msgs
+		subject, payload, _ := strings.Cut(got, " ")
+		if subject != "caskdb.changes" {
+			t.Errorf("published to %q, want %q", subject, "caskdb.changes")
+		}
+		var msg Message
+		if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+			t.Fatalf("published %q, which is not a Message: %v", payload, err)
+		}
+		if msg.Offset != want.Offset || msg.Key != want.Key || msg.Value != want.Value || msg.Deleted != want.Deleted || !msg.Timestamp.Equal(want.Timestamp) || msg.Encoding != want.Encoding {
+			t.Errorf("published %+v, want %+v", msg, want)
+		}
+	}
+	if _, err := NewNATSPublisher(addr, "has spaces"); err == nil {
+		t.Errorf("NewNATSPublisher() with an invalid subject error = nil, want an error")
+	}
+}
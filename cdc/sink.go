@@ -0,0 +1,213 @@
+// Package cdc publishes the changes committed to a store to a message broker, for
+// change data capture. A Sink tails the store's log with DiskStore.ReadChanges and
+// hands every change to a Publisher, in the order they were committed.
+//
+// Delivery is at least once: the position in the log is persisted to a cursor
+// file only after the Publisher has accepted the changes before it, so that after
+// a crash or a restart the Sink resumes from there. The changes published between
+// the last persisted cursor and the crash are published again, so consumers should
+// be idempotent; the Offset of a Change identifies it.
+//
+// NATSPublisher publishes to a NATS subject. Other brokers plug in by implementing
+// Publisher on top of their client, e.g. for Kafka:
+//
+//	pub := cdc.PublisherFunc(func(ctx context.Context, changes []caskdb.Change) error {
+//		msgs := make([]kafka.Message, len(changes))
+//		for i, c := range changes {
+//			msgs[i] = kafka.Message{Key: []byte(c.Key), Value: []byte(c.Value)}
+//		}
+//		return writer.WriteMessages(ctx, msgs...)
+//	})
+//
+// Using the key as the Kafka message key keeps the changes of a key in order.
+package cdc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+const (
+	// DefaultBatchSize is the number of changes published at once when
+	// Options.BatchSize is not set
+	DefaultBatchSize = 100
+	// DefaultPollInterval is how often the log is checked for new changes when
+	// Options.PollInterval is not set
+	DefaultPollInterval = 100 * time.Millisecond
+	// DefaultMaxBackoff is the longest wait between two attempts to publish when
+	// Options.MaxBackoff is not set
+	DefaultMaxBackoff = 10 * time.Second
+)
+
+// Publisher delivers changes to a broker. Publish must return only once the
+// broker has accepted all of the changes, or an error; the Sink retries the whole
+// batch on an error.
+type Publisher interface {
+	Publish(ctx context.Context, changes []caskdb.Change) error
+}
+
+// PublisherFunc adapts a function to a Publisher.
+type PublisherFunc func(ctx context.Context, changes []caskdb.Change) error
+
+func (f PublisherFunc) Publish(ctx context.Context, changes []caskdb.Change) error {
+	return f(ctx, changes)
+}
+
+// Options configures a Sink. CursorFile is required, the rest have defaults.
+type Options struct {
+	// CursorFile is where the position in the log is persisted. It is created on
+	// the first publish; delete it to publish the whole history again.
+	CursorFile string
+	// BatchSize is the most changes handed to the Publisher at once
+	BatchSize int
+	// PollInterval is how often the log is checked for new changes once the Sink
+	// has caught up
+	PollInterval time.Duration
+	// MaxBackoff caps the wait between two attempts to publish a batch, which
+	// starts at PollInterval and doubles with every failure
+	MaxBackoff time.Duration
+	// Logger receives the publish failures. When nil, nothing is logged.
+	Logger caskdb.Logger
+}
+
+// Sink publishes the changes of a store. Create it with NewSink and start it with
+// Run.
+type Sink struct {
+	store  *caskdb.DiskStore
+	pub    Publisher
+	opts   Options
+	cursor int64
+}
+
+// NewSink returns a Sink publishing the changes of the store to pub, starting from
+// the cursor persisted in opts.CursorFile, or from the beginning of the log if
+// there is none yet.
+func NewSink(store *caskdb.DiskStore, pub Publisher, opts Options) (*Sink, error) {
+	if opts.CursorFile == "" {
+		return nil, errors.New("cdc: Options.CursorFile is required")
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = DefaultPollInterval
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultMaxBackoff
+	}
+	if opts.Logger == nil {
+		opts.Logger = nopLogger{}
+	}
+	cursor, err := readCursor(opts.CursorFile)
+	if err != nil {
+		return nil, err
+	}
+	return &Sink{store: store, pub: pub, opts: opts, cursor: cursor}, nil
+}
+
+// Cursor returns the offset in the log up to which every change was published.
+func (s *Sink) Cursor() int64 {
+	return s.cursor
+}
+
+// Run publishes the changes until ctx is done, and then returns its error. A
+// failing Publisher is retried with a backoff for as long as it takes, so that
+// no change is skipped; Run returns early only when the log cannot be read.
+func (s *Sink) Run(ctx context.Context) error {
+	backoff := s.opts.PollInterval
+	for {
+		changes, next, err := s.store.ReadChanges(s.cursor, s.opts.BatchSize)
+		if err != nil {
+			return err
+		}
+		wait := s.opts.PollInterval
+		if len(changes) > 0 {
+			if err := s.publish(ctx, changes, next); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				s.opts.Logger.Warn("publish failed", "offset", s.cursor, "changes", len(changes), "retry_in", backoff, "error", err)
+				wait = backoff
+				backoff *= 2
+				if backoff > s.opts.MaxBackoff {
+					backoff = s.opts.MaxBackoff
+				}
+			} else {
+				backoff = s.opts.PollInterval
+				// there may be more waiting, keep going without a pause
+				wait = 0
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// publish hands the changes to the Publisher and then persists the cursor.
+func (s *Sink) publish(ctx context.Context, changes []caskdb.Change, next int64) error {
+	if err := s.pub.Publish(ctx, changes); err != nil {
+		return err
+	}
+	if err := writeCursor(s.opts.CursorFile, next); err != nil {
+		return fmt.Errorf("cdc: failed to persist the cursor: %w", err)
+	}
+	s.cursor = next
+	return nil
+}
+
+// nopLogger discards everything, like the store's default logger.
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, args ...any) {}
+func (nopLogger) Info(msg string, args ...any)  {}
+func (nopLogger) Warn(msg string, args ...any)  {}
+func (nopLogger) Error(msg string, args ...any) {}
+
+// readCursor returns the offset persisted in the file, 0 if there is none yet.
+func readCursor(fileName string) (int64, error) {
+	data, err := os.ReadFile(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	cursor, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil || cursor < 0 {
+		return 0, fmt.Errorf("cdc: invalid cursor file %s", fileName)
+	}
+	return cursor, nil
+}
+
+// writeCursor persists the offset, replacing the file atomically, so that a crash
+// leaves either the old or the new cursor behind and never a torn one.
+func writeCursor(fileName string, cursor int64) error {
+	tmp, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(strconv.FormatInt(cursor, 10) + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fileName)
+}
@@ -0,0 +1,99 @@
+package cdc
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+// recorder is a Publisher keeping the keys it was given, failing the first fail
+// batches.
+type recorder struct {
+	mu   sync.Mutex
+	keys []string
+	fail int
+}
+
+func (r *recorder) Publish(ctx context.Context, changes []caskdb.Change) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.fail > 0 {
+		r.fail--
+		return errors.New("broker unavailable")
+	}
+	for _, c := range changes {
+		r.keys = append(r.keys, c.Key)
+	}
+	return nil
+}
+
+func (r *recorder) published() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.keys...)
+}
+
+// runUntil runs the sink until the publisher has seen n keys.
+func runUntil(t *testing.T, sink *Sink, pub *recorder, n int) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- sink.Run(ctx) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(pub.published()) < n && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Run() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestSink(t *testing.T) {
+	store, err := caskdb.NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	opts := Options{
+		CursorFile:   filepath.Join(t.TempDir(), "cursor"),
+		BatchSize:    2,
+		PollInterval: time.Millisecond,
+	}
+
+	store.Set("othello", "shakespeare")
+	store.Set("hamlet", "shakespeare")
+	store.Set("dune", "herbert")
+	pub := &recorder{fail: 2}
+	sink, err := NewSink(store, pub, opts)
+	if err != nil {
+		t.Fatalf("NewSink() error = %v", err)
+	}
+	// the failed batches are retried, nothing is lost
+	runUntil(t, sink, pub, 3)
+	if got := pub.published(); len(got) != 3 || got[0] != "othello" || got[2] != "dune" {
+		t.Errorf("published %v, want [othello hamlet dune]", got)
+	}
+
+	// a new sink resumes from the persisted cursor
+	store.Delete("dune")
+	pub = &recorder{}
+	sink, err = NewSink(store, pub, opts)
+	if err != nil {
+		t.Fatalf("NewSink() error = %v", err)
+	}
+	runUntil(t, sink, pub, 1)
+	if got := pub.published(); len(got) != 1 || got[0] != "dune" {
+		t.Errorf("published %v after a restart, want [dune]", got)
+	}
+	if _, err := NewSink(store, pub, Options{}); err == nil {
+		t.Errorf("NewSink() without a cursor file error = nil, want an error")
+	}
+}
@@ -0,0 +1,174 @@
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Change is a mutation committed to the store, as read back from its log by
+// ReadChanges.
+type Change struct {
+	// Offset is the position of the record in the log, counting the segments as
+	// one file. Offsets only grow, so they order the changes and let a reader
+	// resume where it stopped.
+	Offset int64
+	Key    string
+	// Value is the new value of the key, empty when Deleted is set
+	Value   string
+	Deleted bool
+	// Timestamp is when the change was written, to the second
+	Timestamp time.Time
+	// Expiry is when the key expires, zero if it does not
+	Expiry time.Time
+	// Truncate is set on the change recording a DeleteAll, or starting a segment
+	// written by Compact: every key written before it is gone, or written again
+	// after it. Key and Value are empty.
+	Truncate bool
+	// Flags are those of the record, check RecordFlags
+	Flags RecordFlags
+}
+
+// ReadChanges returns up to max of the changes committed at or after offset,
+// oldest first, along with the offset to continue from. Start from 0 to read the
+// whole history. Only the changes acknowledged to their writers are returned; the
+// log is read from separate handles, so this does not block the store while
+// reading the disk, or cold storage for the offloaded segments.
+//
+// The offset must be one returned by an earlier call, or the Offset of a Change.
+// After a DeleteAll, the offsets before it read from the DeleteAll on. After a
+// Compact from the oldest segment, the offsets before it read from its Truncate
+// change on; after any Compact, those within the compacted records read from a
+// record at or before them, so some changes may be read twice, but none is missed.
+func (d *DiskStore) ReadChanges(offset int64, max int) ([]Change, int64, error) {
+	var changes []Change
+	next, err := d.scanChanges(offset, max, func(change Change, data []byte) error {
+		changes = append(changes, change)
+		return nil
+	})
+	if err != nil {
+		return nil, offset, err
+	}
+	return changes, next, nil
+}
+
+// scanChanges calls fn with up to max of the changes committed at or after
+// offset, along with their records, and returns the offset to continue from, as
+// ReadChanges does.
+func (d *DiskStore) scanChanges(offset int64, max int, fn func(change Change, data []byte) error) (int64, error) {
+	d.mu.Lock()
+	end := d.logSize()
+	if offset > end {
+		d.mu.Unlock()
+		return offset, fmt.Errorf("caskdb: offset %d is past the end of the log at %d", offset, end)
+	}
+	// the changes before the last DeleteAll are gone, along with their segments;
+	// the reader carries on from its Truncate change
+	if offset < d.logBase {
+		offset = d.logBase
+	}
+	offset, err := d.alignOffset(offset)
+	if err != nil {
+		d.mu.Unlock()
+		return offset, err
+	}
+	if offset == end || max <= 0 {
+		d.mu.Unlock()
+		return offset, nil
+	}
+	r, err := d.openLog(offset, end)
+	d.mu.Unlock()
+	if err != nil {
+		return offset, err
+	}
+	defer r.Close()
+	next, n := offset, 0
+	// errStop ends the scan once we have enough
+	errStop := errors.New("stop")
+	err = scanRecords(r, end-offset, func(pos int, data []byte) error {
+		at := r.offset(pos)
+		if !verifyKV(data) {
+			return fmt.Errorf("%w: offset %d", ErrCorruptRecord, at)
+		}
+		timestamp, key, _ := decodeKV(data)
+		next = at + int64(len(data))
+		if isTokenKey(key) || isDictKey(key) || isBlobKey(key) || isIntentKey(key) || isEpochKey(key) || isStoreKey(key) || isFormatKey(key) || key == compactRangeKey {
+			// bookkeeping, not a change
+			return nil
+		}
+		value, err := d.decodeValue(data)
+		if err == nil && decodeFlags(data)&FlagDedup != 0 {
+			d.mu.Lock()
+			value, err = d.blobValue(value)
+			d.mu.Unlock()
+		}
+		if err != nil {
+			return fmt.Errorf("offset %d: %w", at, err)
+		}
+		change := Change{
+			Offset:    at,
+			Key:       key,
+			Value:     value,
+			Deleted:   value == "",
+			Timestamp: time.Unix(int64(timestamp), 0),
+			Flags:     decodeFlags(data),
+		}
+		if key == truncateKey || key == compactKey {
+			change = Change{Offset: change.Offset, Timestamp: change.Timestamp, Truncate: true, Flags: change.Flags}
+		}
+		if expiry := decodeExpiry(data); expiry != 0 {
+			change.Expiry = time.Unix(int64(expiry), 0)
+		}
+		if err := fn(change, data); err != nil {
+			return err
+		}
+		if n++; n == max {
+			return errStop
+		}
+		return nil
+	})
+	if err != nil && err != errStop {
+		return offset, err
+	}
+	return next, nil
+}
+
+// CopyLog copies the bytes of the log from offset up to the last acknowledged
+// write to w, at most max of them, and returns the offset it stopped at, to
+// continue from next time.
+// Concatenating the copies in order gives back a data file a DiskStore can open,
+// which is what shipping the log for disaster recovery relies on; the copies may
+// skip the segments removed by DeleteAll or Compact, and overlap after a Compact.
+// Like ReadChanges, it reads from separate handles.
+func (d *DiskStore) CopyLog(w io.Writer, offset int64, max int64) (int64, error) {
+	d.mu.Lock()
+	end := d.logSize()
+	if offset > end {
+		d.mu.Unlock()
+		return offset, fmt.Errorf("caskdb: offset %d is past the end of the log at %d", offset, end)
+	}
+	if offset < d.logBase {
+		offset = d.logBase
+	}
+	offset, err := d.alignOffset(offset)
+	if err != nil {
+		d.mu.Unlock()
+		return offset, err
+	}
+	if end-offset > max {
+		end = offset + max
+	}
+	if offset == end {
+		d.mu.Unlock()
+		return offset, nil
+	}
+	r, err := d.openLog(offset, end)
+	d.mu.Unlock()
+	if err != nil {
+		return offset, err
+	}
+	defer r.Close()
+	n, err := io.Copy(w, r)
+	return offset + n, err
+}
@@ -0,0 +1,90 @@
+package caskdb
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_ReadChanges(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	store.Set("othello", "shakespeare")
+	store.Set("hamlet", "shakespeare")
+	store.Delete("othello")
+	store.PutWithTTL("session", "jojo", time.Hour)
+
+	changes, next, err := store.ReadChanges(0, 2)
+	if err != nil {
+		t.Fatalf("ReadChanges() error = %v", err)
+	}
+	if len(changes) != 2 || changes[0].Key != "othello" || changes[1].Key != "hamlet" {
+		t.Fatalf("ReadChanges() = %+v, want othello and hamlet", changes)
+	}
+	if changes[0].Offset != int64(len(formatRecord(0))) || changes[1].Offset <= changes[0].Offset || next <= changes[1].Offset {
+		t.Errorf("ReadChanges() offsets = %v, %v, next %v, want increasing from the format record", changes[0].Offset, changes[1].Offset, next)
+	}
+	changes, next, err = store.ReadChanges(next, 10)
+	if err != nil {
+		t.Fatalf("ReadChanges() error = %v", err)
+	}
+	if len(changes) != 2 {
+		t.Fatalf("ReadChanges() returned %d changes, want 2", len(changes))
+	}
+	if !changes[0].Deleted || changes[0].Key != "othello" {
+		t.Errorf("ReadChanges() = %+v, want the deletion of othello", changes[0])
+	}
+	if changes[1].Value != "jojo" || changes[1].Expiry.IsZero() {
+		t.Errorf("ReadChanges() = %+v, want session with an expiry", changes[1])
+	}
+	// caught up, nothing more to read
+	if changes, again, err := store.ReadChanges(next, 10); err != nil || len(changes) != 0 || again != next {
+		t.Errorf("ReadChanges() at the end = %v, %v, %v, want nothing", changes, again, err)
+	}
+	if _, _, err := store.ReadChanges(next+1, 10); err == nil {
+		t.Errorf("ReadChanges() past the end error = nil, want an error")
+	}
+}
+
+func TestDiskStore_CopyLog(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	var log bytes.Buffer
+	store.Set("othello", "shakespeare")
+	offset, err := store.CopyLog(&log, 0, 10)
+	if err != nil || offset != 10 {
+		t.Fatalf("CopyLog() = %v, %v, want the first 10 bytes", offset, err)
+	}
+	store.Set("dune", "herbert")
+	if offset, err = store.CopyLog(&log, offset, 1<<20); err != nil {
+		t.Fatalf("CopyLog() error = %v", err)
+	}
+	if offset != int64(log.Len()) {
+		t.Errorf("CopyLog() offset = %v, want %v", offset, log.Len())
+	}
+
+	// the copies put together are a database of their own
+	defer os.Remove("copy.db")
+	if err := os.WriteFile("copy.db", log.Bytes(), 0644); err != nil {
+		t.Fatalf("failed to write the copy: %v", err)
+	}
+	restored, err := NewDiskStore("copy.db")
+	if err != nil {
+		t.Fatalf("failed to open the copy: %v", err)
+	}
+	defer restored.Close()
+	if val := restored.Get("dune"); val != "herbert" {
+		t.Errorf("Get() from the copy = %v, want %v", val, "herbert")
+	}
+}
@@ -0,0 +1,280 @@
+// Package client talks to a CaskDB server over HTTP. A Client implements the same
+// caskdb.Store interface as the embedded DiskStore, so an application can move
+// from an embedded store to a remote one by changing how it creates the store:
+//
+//	store, err := client.New("http://localhost:8080", client.Options{})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer store.Close()
+//	store.Set("othello", "shakespeare")
+//	fmt.Println(store.Get("othello"))
+//
+// Like with a DiskStore, Get and Set panic on errors; use Lookup, Put and Delete
+// to handle them instead. Connections are pooled and reused across calls, every
+// attempt has a timeout, and the requests failing on the network or with a server
+// error are retried with an exponential backoff. Every operation of the store is
+// idempotent, so retrying one is always safe.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+const (
+	// DefaultTimeout is the timeout of a single attempt when Options.Timeout is
+	// not set
+	DefaultTimeout = 5 * time.Second
+	// DefaultRetries is the number of retries when Options.Retries is not set
+	DefaultRetries = 3
+	// DefaultRetryBackoff is the wait before the first retry when
+	// Options.RetryBackoff is not set
+	DefaultRetryBackoff = 100 * time.Millisecond
+	// DefaultMaxIdleConns is the size of the connection pool when
+	// Options.MaxIdleConns is not set
+	DefaultMaxIdleConns = 16
+)
+
+var (
+	// ErrUnauthorized is returned when the server rejects the credentials, or
+	// requires some and none were given
+	ErrUnauthorized = errors.New("client: unauthorized")
+	// ErrForbidden is returned when the user has no access to the key
+	ErrForbidden = errors.New("client: forbidden")
+)
+
+// Options tunes a Client. The zero value talks to the default namespace without
+// credentials, with the defaults above.
+type Options struct {
+	// Namespace is the namespace of the server to use, when it hosts several
+	Namespace string
+	// Username and Password authenticate with basic auth, Token with a bearer
+	// token. Set one or the other, matching the users file of the server.
+	Username string
+	Password string
+	Token    string
+	// TLSConfig is used for https:// addresses, e.g. to trust a private CA
+	TLSConfig *tls.Config
+	// Timeout bounds every attempt of a request, retries getting a fresh one
+	Timeout time.Duration
+	// Retries is how many times a failed request is retried; a negative value
+	// disables retrying
+	Retries int
+	// RetryBackoff is the wait before the first retry, doubled for each of the
+	// following ones
+	RetryBackoff time.Duration
+	// MaxIdleConns is how many connections to the server are kept open for reuse
+	MaxIdleConns int
+}
+
+// Client is a caskdb.Store backed by a remote server. It is safe to use from
+// multiple goroutines.
+type Client struct {
+	base       string
+	opts       Options
+	transport  *http.Transport
+	httpClient *http.Client
+}
+
+var _ caskdb.Store = (*Client)(nil)
+
+// New returns a Client for the server at addr, e.g. "http://localhost:8080". It
+// does not connect until the first request.
+func New(addr string, opts Options) (*Client, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("client: invalid address: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("client: invalid address %q, want http://host:port or https://host:port", addr)
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.Retries == 0 {
+		opts.Retries = DefaultRetries
+	}
+	if opts.RetryBackoff == 0 {
+		opts.RetryBackoff = DefaultRetryBackoff
+	}
+	if opts.MaxIdleConns == 0 {
+		opts.MaxIdleConns = DefaultMaxIdleConns
+	}
+	base := strings.TrimSuffix(u.String(), "/")
+	if opts.Namespace != "" {
+		base += "/ns/" + url.PathEscape(opts.Namespace)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = opts.MaxIdleConns
+	transport.MaxIdleConnsPerHost = opts.MaxIdleConns
+	transport.TLSClientConfig = opts.TLSConfig
+	return &Client{
+		base:       base,
+		opts:       opts,
+		transport:  transport,
+		httpClient: &http.Client{Transport: transport},
+	}, nil
+}
+
+func (c *Client) Get(key string) string {
+	// Get returns the value of the key, or an empty string if it does not exist.
+	// It panics if the server cannot be reached, check Lookup to handle that.
+	value, err := c.Lookup(key)
+	if errors.Is(err, caskdb.ErrKeyNotFound) {
+		return ""
+	}
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
+
+// Lookup is like Get, but reports why it could not return a value:
+// caskdb.ErrKeyNotFound if the key does not exist, or the error of the last
+// attempt.
+func (c *Client) Lookup(key string) (string, error) {
+	return c.LookupContext(context.Background(), key)
+}
+
+// LookupContext is like Lookup, and gives up once ctx is done.
+func (c *Client) LookupContext(ctx context.Context, key string) (string, error) {
+	body, _, err := c.do(ctx, http.MethodGet, key, "")
+	return string(body), err
+}
+
+// GetEntry is like Lookup, and returns the value along with when it was written
+// and when it expires, to the second. Where the record is stored is not known to
+// the client, so Size, Segment and Offset are not set.
+func (c *Client) GetEntry(key string) (caskdb.Entry, error) {
+	return c.GetEntryContext(context.Background(), key)
+}
+
+// GetEntryContext is like GetEntry, and gives up once ctx is done.
+func (c *Client) GetEntryContext(ctx context.Context, key string) (caskdb.Entry, error) {
+	body, header, err := c.do(ctx, http.MethodGet, key, "")
+	if err != nil {
+		return caskdb.Entry{}, err
+	}
+	entry := caskdb.Entry{Key: key, Value: string(body)}
+	if entry.Timestamp, err = http.ParseTime(header.Get("Last-Modified")); err != nil {
+		return caskdb.Entry{}, fmt.Errorf("client: GET %s: invalid Last-Modified: %w", key, err)
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		if entry.Expiry, err = http.ParseTime(expires); err != nil {
+			return caskdb.Entry{}, fmt.Errorf("client: GET %s: invalid Expires: %w", key, err)
+		}
+		entry.TTL = time.Until(entry.Expiry)
+	}
+	return entry, nil
+}
+
+func (c *Client) Set(key string, value string) {
+	// Set stores the key and value on the server. It panics if the write fails,
+	// check Put if you need to handle the failure.
+	if err := c.Put(key, value); err != nil {
+		panic(err)
+	}
+}
+
+// Put is like Set, but returns the error instead of panicking.
+func (c *Client) Put(key string, value string) error {
+	return c.PutContext(context.Background(), key, value)
+}
+
+// PutContext is like Put, and gives up once ctx is done. An idempotency token set
+// on ctx with caskdb.WithIdempotencyToken is sent along.
+func (c *Client) PutContext(ctx context.Context, key string, value string) error {
+	_, _, err := c.do(ctx, http.MethodPut, key, value)
+	return err
+}
+
+// Delete removes the key from the store. Deleting a key which does not exist is
+// not an error.
+func (c *Client) Delete(key string) error {
+	return c.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is like Delete, and gives up once ctx is done. Like PutContext, it
+// sends the idempotency token of ctx along.
+func (c *Client) DeleteContext(ctx context.Context, key string) error {
+	_, _, err := c.do(ctx, http.MethodDelete, key, "")
+	return err
+}
+
+// Close closes the pooled connections. The Client can still be used afterwards,
+// it then opens new ones.
+func (c *Client) Close() bool {
+	c.transport.CloseIdleConnections()
+	return true
+}
+
+// do sends the request, retrying it as configured, and returns the body and the
+// header of the response.
+func (c *Client) do(ctx context.Context, method string, key string, value string) ([]byte, http.Header, error) {
+	backoff := c.opts.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		body, header, retry, err := c.attempt(ctx, method, key, value)
+		// the caller giving up is final, unlike the timeout of a single attempt
+		if err == nil || !retry || attempt >= c.opts.Retries || ctx.Err() != nil {
+			return body, header, err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, nil, err
+		}
+		backoff *= 2
+	}
+}
+
+// attempt sends the request once. retry is set when the request failed in a way
+// another attempt may not: on the network, or with a server error.
+func (c *Client) attempt(ctx context.Context, method string, key string, value string) (body []byte, header http.Header, retry bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, c.base+"/keys/"+url.PathEscape(key), strings.NewReader(value))
+	if err != nil {
+		return nil, nil, false, err
+	}
+	switch {
+	case c.opts.Token != "":
+		req.Header.Set("Authorization", "Bearer "+c.opts.Token)
+	case c.opts.Username != "":
+		req.SetBasicAuth(c.opts.Username, c.opts.Password)
+	}
+	// the token makes the retries of a write safe, on our side and the caller's
+	if token := caskdb.IdempotencyToken(ctx); token != "" {
+		req.Header.Set("Idempotency-Key", token)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, nil, true, err
+	}
+	defer resp.Body.Close()
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, true, err
+	}
+	switch {
+	case resp.StatusCode < 300:
+		return body, resp.Header, false, nil
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil, false, caskdb.ErrKeyNotFound
+	case resp.StatusCode == http.StatusUnauthorized:
+		return nil, nil, false, ErrUnauthorized
+	case resp.StatusCode == http.StatusForbidden:
+		return nil, nil, false, ErrForbidden
+	}
+	err = fmt.Errorf("client: %s %s: %s: %s", method, key, resp.Status, strings.TrimSpace(string(body)))
+	return nil, nil, resp.StatusCode >= 500, err
+}
@@ -0,0 +1,137 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	caskdb "github.com/avinassh/go-caskdb"
+	"github.com/avinassh/go-caskdb/server"
+)
+
+func TestClient(t *testing.T) {
+	store, err := caskdb.NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv := server.NewHTTP(store, server.Options{})
+	go srv.Serve(ln)
+	defer srv.Shutdown(context.Background())
+
+	var c caskdb.Store
+	c, err = New("http://"+ln.Addr().String(), Options{})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer c.Close()
+	c.Set("othello", "shakespeare")
+	c.Set("a key/with spaces", "and slashes")
+	if val := c.Get("othello"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+	if val := c.Get("a key/with spaces"); val != "and slashes" {
+		t.Errorf("Get() = %v, want %v", val, "and slashes")
+	}
+	if val := store.Get("othello"); val != "shakespeare" {
+		t.Errorf("DiskStore.Get() = %v, want %v", val, "shakespeare")
+	}
+	if entry, err := c.(*Client).GetEntry("othello"); err != nil || entry.Value != "shakespeare" || time.Since(entry.Timestamp) > time.Minute {
+		t.Errorf("GetEntry() = %+v, %v, want shakespeare written now", entry, err)
+	}
+	if val := c.Get("hamlet"); val != "" {
+		t.Errorf("Get() of a missing key = %v, want an empty string", val)
+	}
+	if err := c.(*Client).Delete("othello"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := c.(*Client).Lookup("othello"); !errors.Is(err, caskdb.ErrKeyNotFound) {
+		t.Errorf("Lookup() of a deleted key error = %v, want %v", err, caskdb.ErrKeyNotFound)
+	}
+
+	// a retried write is applied once, even after the key changed since
+	ctx := caskdb.WithIdempotencyToken(context.Background(), "op-1")
+	if err := c.(*Client).PutContext(ctx, "dune", "herbert"); err != nil {
+		t.Fatalf("PutContext() error = %v", err)
+	}
+	store.Set("dune", "frank herbert")
+	if err := c.(*Client).PutContext(ctx, "dune", "herbert"); err != nil {
+		t.Fatalf("PutContext() retry error = %v", err)
+	}
+	if val := store.Get("dune"); val != "frank herbert" {
+		t.Errorf("DiskStore.Get() after a retry = %v, want %v", val, "frank herbert")
+	}
+}
+
+func TestClient_Retries(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("shakespeare"))
+	}))
+	defer ts.Close()
+
+	c, err := New(ts.URL, Options{RetryBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if val, err := c.Lookup("othello"); err != nil || val != "shakespeare" {
+		t.Errorf("Lookup() = %v, %v, want %v", val, err, "shakespeare")
+	}
+	if calls != 3 {
+		t.Errorf("server got %d requests, want 3", calls)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	c, _ = New(ts.URL, Options{Retries: -1})
+	if _, err := c.Lookup("othello"); err == nil {
+		t.Errorf("Lookup() without retries error = nil, want the 503")
+	}
+	if calls != 1 {
+		t.Errorf("server got %d requests without retries, want 1", calls)
+	}
+}
+
+func TestClient_Auth(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/ns/tenant42/keys/othello" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	c, _ := New(ts.URL, Options{Namespace: "tenant42", Token: "s3cret"})
+	if err := c.Put("othello", "shakespeare"); err != nil {
+		t.Errorf("Put() error = %v", err)
+	}
+	if err := c.Put("hamlet", "shakespeare"); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Put() outside the namespace error = %v, want %v", err, ErrForbidden)
+	}
+	c, _ = New(ts.URL, Options{Namespace: "tenant42"})
+	if err := c.Put("othello", "shakespeare"); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Put() without a token error = %v, want %v", err, ErrUnauthorized)
+	}
+	if _, err := New("localhost:8080", Options{}); err == nil {
+		t.Errorf("New() without a scheme error = nil, want an error")
+	}
+}
@@ -0,0 +1,222 @@
+// Package cluster shards the keys across several CaskDB instances, embedded or
+// remote, with consistent hashing. A Cluster is itself a caskdb.Store, so an
+// application can grow from one store to many without other code changes:
+//
+//	local, _ := caskdb.NewDiskStore("books.db")
+//	remote, _ := client.New("http://books-2:8080", client.Options{})
+//	c := cluster.New(0)
+//	c.Add("books-1", local)
+//	c.Add("books-2", remote)
+//	c.Set("othello", "shakespeare")
+//
+// Adding a node moves about 1/N of the keys to it. Until they are moved, lookups
+// of those keys go to the new node and miss: call Rebalance on every other node
+// after adding one. To remove a node, Remove it and then Drain it.
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+// ErrNoNodes is returned when the cluster has no node to send a key to.
+var ErrNoNodes = errors.New("cluster: no nodes")
+
+// Node is a store the cluster routes keys to. *caskdb.DiskStore and
+// *client.Client are Nodes.
+type Node interface {
+	caskdb.Store
+	Lookup(key string) (string, error)
+	Put(key string, value string) error
+	Delete(key string) error
+}
+
+// Cluster routes every key to one of its nodes. It is safe to use from multiple
+// goroutines.
+type Cluster struct {
+	mu    sync.RWMutex
+	ring  *Ring
+	nodes map[string]Node
+}
+
+var _ caskdb.Store = (*Cluster)(nil)
+
+// New returns a cluster without nodes, placing each node at virtualNodes points
+// on its ring; zero means DefaultVirtualNodes.
+func New(virtualNodes int) *Cluster {
+	return &Cluster{ring: NewRing(virtualNodes), nodes: make(map[string]Node)}
+}
+
+// Add adds the node under the name, replacing the node of that name if there is
+// one. The name places the node on the ring, so it must stay the same across
+// restarts, e.g. the address of a remote node.
+func (c *Cluster) Add(name string, node Node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nodes[name] = node
+	c.ring.Add(name)
+}
+
+// Remove removes the node and returns it, or nil if there is no node of that
+// name. Its keys are not moved; pass it to Drain for that.
+func (c *Cluster) Remove(name string) Node {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	node := c.nodes[name]
+	delete(c.nodes, name)
+	c.ring.Remove(name)
+	return node
+}
+
+// Nodes returns the names of the nodes, sorted.
+func (c *Cluster) Nodes() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ring.Nodes()
+}
+
+// Locate returns the name of the node the key belongs to, along with the node.
+func (c *Cluster) Locate(key string) (string, Node, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	name := c.ring.Node(key)
+	if name == "" {
+		return "", nil, ErrNoNodes
+	}
+	return name, c.nodes[name], nil
+}
+
+func (c *Cluster) Get(key string) string {
+	// Get returns the value of the key from its node, or an empty string if the
+	// key does not exist. Check Lookup if you need to tell apart the failures.
+	value, err := c.Lookup(key)
+	if errors.Is(err, caskdb.ErrKeyNotFound) {
+		return ""
+	}
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
+
+// Lookup is like Get, but returns the error of the node instead of panicking.
+func (c *Cluster) Lookup(key string) (string, error) {
+	_, node, err := c.Locate(key)
+	if err != nil {
+		return "", err
+	}
+	return node.Lookup(key)
+}
+
+func (c *Cluster) Set(key string, value string) {
+	// Set stores the key on its node. It panics if the write fails, check Put if
+	// you need to handle the failure.
+	if err := c.Put(key, value); err != nil {
+		panic(err)
+	}
+}
+
+// Put is like Set, but returns the error instead of panicking.
+func (c *Cluster) Put(key string, value string) error {
+	_, node, err := c.Locate(key)
+	if err != nil {
+		return err
+	}
+	return node.Put(key, value)
+}
+
+// Delete removes the key from its node.
+func (c *Cluster) Delete(key string) error {
+	_, node, err := c.Locate(key)
+	if err != nil {
+		return err
+	}
+	return node.Delete(key)
+}
+
+// Close closes every node, and reports whether they all closed cleanly.
+func (c *Cluster) Close() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	ok := true
+	for _, node := range c.nodes {
+		if !node.Close() {
+			ok = false
+		}
+	}
+	return ok
+}
+
+// Misplaced returns, grouped by the node they belong to, those of the keys held by
+// the node called name which the ring now sends elsewhere.
+func (c *Cluster) Misplaced(name string, keys []string) map[string][]string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	moves := make(map[string][]string)
+	for _, key := range keys {
+		if owner := c.ring.Node(key); owner != name && owner != "" {
+			moves[owner] = append(moves[owner], key)
+		}
+	}
+	return moves
+}
+
+// Rebalance moves the misplaced keys of the node called name to the nodes they
+// belong to, and returns how many it moved. keys are the keys the node holds; for
+// a *caskdb.DiskStore, pass its Keys(). A key is written to its new node before it
+// is deleted from the old one, so a failure leaves it on both rather than on
+// neither, and Rebalance can be run again.
+func (c *Cluster) Rebalance(name string, keys []string) (int, error) {
+	c.mu.RLock()
+	from, ok := c.nodes[name]
+	c.mu.RUnlock()
+	if !ok {
+		return 0, fmt.Errorf("cluster: no node %q", name)
+	}
+	return c.move(from, c.Misplaced(name, keys))
+}
+
+// Drain moves all the keys of a node which was removed from the cluster to the
+// nodes they belong to now, and returns how many it moved. Like Rebalance, it can
+// be run again after a failure.
+func (c *Cluster) Drain(node Node, keys []string) (int, error) {
+	// no node is called "", so every key is misplaced
+	return c.move(node, c.Misplaced("", keys))
+}
+
+// move moves the keys from the node to their owners.
+func (c *Cluster) move(from Node, moves map[string][]string) (int, error) {
+	owners := make([]string, 0, len(moves))
+	for owner := range moves {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+	moved := 0
+	for _, owner := range owners {
+		c.mu.RLock()
+		to := c.nodes[owner]
+		c.mu.RUnlock()
+		for _, key := range moves[owner] {
+			value, err := from.Lookup(key)
+			if errors.Is(err, caskdb.ErrKeyNotFound) {
+				// deleted since the keys were listed
+				continue
+			}
+			if err != nil {
+				return moved, err
+			}
+			if err := to.Put(key, value); err != nil {
+				return moved, fmt.Errorf("cluster: moving %q to %s: %w", key, owner, err)
+			}
+			if err := from.Delete(key); err != nil {
+				return moved, err
+			}
+			moved++
+		}
+	}
+	return moved, nil
+}
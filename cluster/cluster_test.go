@@ -0,0 +1,79 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+func newNode(t *testing.T) *caskdb.DiskStore {
+	store, err := caskdb.NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	return store
+}
+
+func TestCluster(t *testing.T) {
+	c := New(0)
+	if _, err := c.Lookup("othello"); !errors.Is(err, ErrNoNodes) {
+		t.Errorf("Lookup() without nodes error = %v, want %v", err, ErrNoNodes)
+	}
+	a, b := newNode(t), newNode(t)
+	c.Add("a", a)
+	c.Add("b", b)
+	defer c.Close()
+
+	for i := 0; i < 100; i++ {
+		c.Set(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+	}
+	if len(a.Keys()) == 0 || len(b.Keys()) == 0 || len(a.Keys())+len(b.Keys()) != 100 {
+		t.Errorf("nodes hold %v and %v keys, want the 100 keys split between them", len(a.Keys()), len(b.Keys()))
+	}
+	if got := c.Get("key-42"); got != "value-42" {
+		t.Errorf("Get(key-42) = %v, want %v", got, "value-42")
+	}
+	if err := c.Delete("key-42"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := c.Lookup("key-42"); !errors.Is(err, caskdb.ErrKeyNotFound) {
+		t.Errorf("Lookup() of a deleted key error = %v, want %v", err, caskdb.ErrKeyNotFound)
+	}
+
+	// after adding a node, rebalancing the others makes every key reachable again
+	d := newNode(t)
+	c.Add("d", d)
+	for _, name := range []string{"a", "b"} {
+		node := map[string]*caskdb.DiskStore{"a": a, "b": b}[name]
+		if _, err := c.Rebalance(name, node.Keys()); err != nil {
+			t.Fatalf("Rebalance(%v) error = %v", name, err)
+		}
+	}
+	if len(d.Keys()) == 0 {
+		t.Errorf("Rebalance() moved no keys to the new node")
+	}
+	checkAll := func() {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			key, want := fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i)
+			if i == 42 {
+				want = ""
+			}
+			if got := c.Get(key); got != want {
+				t.Errorf("Get(%v) = %v, want %v", key, got, want)
+			}
+		}
+	}
+	checkAll()
+
+	// draining a removed node moves all its keys away
+	removed := c.Remove("a")
+	if n, err := c.Drain(removed, a.Keys()); err != nil || len(a.Keys()) != 0 {
+		t.Fatalf("Drain() = %v, %v, left %v keys", n, err, len(a.Keys()))
+	}
+	removed.Close()
+	checkAll()
+}
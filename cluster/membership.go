@@ -0,0 +1,543 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The membership protocol follows SWIM. Every ProbeInterval, a member pings the
+// next of the others, in a random order renewed every round. Without an ack
+// within ProbeTimeout, it asks IndirectProbes other members to ping it on its
+// behalf, and without an ack through them either by the end of the interval, it
+// suspects the member. A suspect which does not refute the suspicion within
+// SuspicionTimeout is declared dead.
+//
+// Every message carries the state of every member the sender knows of, so that
+// the changes spread with the probes. The states of a member are ordered by its
+// incarnation, a counter only the member itself increments, to refute being
+// suspected or declared dead: a newer incarnation wins, and within the same one,
+// dead wins over suspect, which wins over alive. This keeps the messages small
+// enough for a UDP datagram for clusters of up to a few hundred members.
+
+const (
+	// DefaultProbeInterval is the time between two probes when
+	// MembershipOptions.ProbeInterval is not set
+	DefaultProbeInterval = time.Second
+	// DefaultProbeTimeout is the wait for an ack when
+	// MembershipOptions.ProbeTimeout is not set
+	DefaultProbeTimeout = 500 * time.Millisecond
+	// DefaultSuspicionTimeout is the time a suspect has to refute the suspicion
+	// when MembershipOptions.SuspicionTimeout is not set
+	DefaultSuspicionTimeout = 5 * time.Second
+	// DefaultIndirectProbes is the number of members asked to ping a member which
+	// did not ack when MembershipOptions.IndirectProbes is not set
+	DefaultIndirectProbes = 3
+)
+
+// ErrNoSeeds is returned by Join when none of the seeds answered.
+var ErrNoSeeds = errors.New("cluster: no seed answered")
+
+// MemberState is the state of a member, as seen by the others.
+type MemberState uint8
+
+const (
+	MemberAlive MemberState = iota
+	// MemberSuspect is a member which did not answer a probe, and has yet to
+	// refute it
+	MemberSuspect
+	MemberDead
+)
+
+var memberStateNames = []string{"alive", "suspect", "dead"}
+
+func (s MemberState) String() string {
+	if int(s) < len(memberStateNames) {
+		return memberStateNames[s]
+	}
+	return fmt.Sprintf("MemberState(%d)", uint8(s))
+}
+
+// Member is a member of the cluster, as seen by a Membership.
+type Member struct {
+	// Name identifies the member, and names its node in a Cluster
+	Name string `json:"name"`
+	// Addr is the address the member gossips on
+	Addr string `json:"addr"`
+	// Meta is set by the member, e.g. to the address of its HTTP server for the
+	// others to connect to its store
+	Meta        string      `json:"meta,omitempty"`
+	State       MemberState `json:"state"`
+	Incarnation uint64      `json:"incarnation"`
+}
+
+// MembershipOptions configures a Membership. Name is required, the rest have
+// defaults.
+type MembershipOptions struct {
+	// Name is the name of this member, unique in the cluster
+	Name string
+	// Addr is the address the others reach this member at, the local address of
+	// the connection when empty
+	Addr string
+	// Meta is handed to the others along with the name, check Member
+	Meta             string
+	ProbeInterval    time.Duration
+	ProbeTimeout     time.Duration
+	SuspicionTimeout time.Duration
+	IndirectProbes   int
+	// OnChange, when set, is called whenever a member joins or its state changes,
+	// e.g. with Cluster.Track. It is called from the goroutines of the Membership,
+	// one change at a time.
+	OnChange func(Member)
+}
+
+// Membership discovers the other members of a cluster and detects their failures,
+// gossiping over a UDP connection. It is safe to use from multiple goroutines.
+type Membership struct {
+	conn net.PacketConn
+	opts MembershipOptions
+
+	mu      sync.Mutex
+	self    Member
+	members map[string]*peer
+	seq     uint64
+	acks    map[uint64]func()
+	order   []string
+	rnd     *rand.Rand
+	// notifyMu serializes the calls to OnChange
+	notifyMu sync.Mutex
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// peer is another member, along with when it was first suspected.
+type peer struct {
+	Member
+	suspected time.Time
+}
+
+// message is what the members send each other, encoded in JSON.
+type message struct {
+	// Type is "ping", "ack", "ping-req", to ask for a ping of Target, or "gossip"
+	Type   string   `json:"type"`
+	Seq    uint64   `json:"seq,omitempty"`
+	Target string   `json:"target,omitempty"`
+	From   string   `json:"from"`
+	States []Member `json:"states"`
+}
+
+// NewMembership starts gossiping on the connection, e.g. from net.ListenPacket
+// on "udp", as the only member until it Joins others or others join it. Close
+// stops it, and closes the connection.
+func NewMembership(conn net.PacketConn, opts MembershipOptions) (*Membership, error) {
+	if opts.Name == "" {
+		return nil, errors.New("cluster: membership without a name")
+	}
+	if opts.Addr == "" {
+		opts.Addr = conn.LocalAddr().String()
+	}
+	if opts.ProbeInterval == 0 {
+		opts.ProbeInterval = DefaultProbeInterval
+	}
+	if opts.ProbeTimeout == 0 {
+		opts.ProbeTimeout = DefaultProbeTimeout
+	}
+	if opts.SuspicionTimeout == 0 {
+		opts.SuspicionTimeout = DefaultSuspicionTimeout
+	}
+	if opts.IndirectProbes == 0 {
+		opts.IndirectProbes = DefaultIndirectProbes
+	}
+	m := &Membership{
+		conn:    conn,
+		opts:    opts,
+		self:    Member{Name: opts.Name, Addr: opts.Addr, Meta: opts.Meta},
+		members: make(map[string]*peer),
+		acks:    make(map[uint64]func()),
+		rnd:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		done:    make(chan struct{}),
+	}
+	m.wg.Add(2)
+	go m.receive()
+	go m.probeLoop()
+	return m, nil
+}
+
+// Join pings the seeds, the addresses of members of the cluster to join, and
+// returns how many answered within ProbeTimeout, failing with ErrNoSeeds if none
+// did. Through them, the rest of the cluster is learned over the next probes.
+func (m *Membership) Join(seeds ...string) (int, error) {
+	acked := make(chan struct{}, len(seeds))
+	for _, seed := range seeds {
+		addr, err := net.ResolveUDPAddr("udp", seed)
+		if err != nil {
+			return 0, err
+		}
+		seq := m.expect(func() {
+			select {
+			case acked <- struct{}{}:
+			default:
+			}
+		})
+		defer m.forget(seq)
+		if err := m.send(addr, message{Type: "ping", Seq: seq}); err != nil {
+			return 0, err
+		}
+	}
+	n := 0
+	timeout := time.After(m.opts.ProbeTimeout)
+	for n < len(seeds) {
+		select {
+		case <-acked:
+			n++
+		case <-timeout:
+			if n == 0 {
+				return 0, ErrNoSeeds
+			}
+			return n, nil
+		}
+	}
+	return n, nil
+}
+
+// Members returns the members known, this one included, sorted by name. The dead
+// ones are kept, so that they are not brought back by an outdated message.
+func (m *Membership) Members() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	members := []Member{m.self}
+	for _, p := range m.members {
+		members = append(members, p.Member)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	return members
+}
+
+// Close tells the others this member is leaving, so that they declare it dead
+// without waiting for the suspicion to time out, stops gossiping and closes the
+// connection.
+func (m *Membership) Close() error {
+	m.mu.Lock()
+	m.self.State = MemberDead
+	var addrs []string
+	for _, p := range m.members {
+		if p.State != MemberDead {
+			addrs = append(addrs, p.Addr)
+		}
+	}
+	m.mu.Unlock()
+	for _, addr := range addrs {
+		if udpAddr, err := net.ResolveUDPAddr("udp", addr); err == nil {
+			m.send(udpAddr, message{Type: "gossip"})
+		}
+	}
+	close(m.done)
+	err := m.conn.Close()
+	m.wg.Wait()
+	return err
+}
+
+// receive handles the messages until the connection is closed.
+func (m *Membership) receive() {
+	defer m.wg.Done()
+	buf := make([]byte, 64<<10)
+	for {
+		n, addr, err := m.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-m.done:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		var msg message
+		if err := json.Unmarshal(buf[:n], &msg); err != nil {
+			continue
+		}
+		m.handle(msg, addr)
+	}
+}
+
+// handle merges the states the message carries, and answers it.
+func (m *Membership) handle(msg message, from net.Addr) {
+	m.merge(msg.States)
+	switch msg.Type {
+	case "ping":
+		m.send(from, message{Type: "ack", Seq: msg.Seq})
+	case "ack":
+		m.mu.Lock()
+		ack := m.acks[msg.Seq]
+		m.mu.Unlock()
+		if ack != nil {
+			ack()
+		}
+	case "ping-req":
+		target, err := net.ResolveUDPAddr("udp", msg.Target)
+		if err != nil {
+			return
+		}
+		// relay the ack of the target, if it comes in time
+		seq := m.expect(func() { m.send(from, message{Type: "ack", Seq: msg.Seq}) })
+		time.AfterFunc(m.opts.ProbeTimeout, func() { m.forget(seq) })
+		m.send(target, message{Type: "ping", Seq: seq})
+	}
+}
+
+// merge applies the states of members received from another, and calls OnChange
+// for those which changed.
+func (m *Membership) merge(states []Member) {
+	var changed []Member
+	m.mu.Lock()
+	now := time.Now()
+	for _, state := range states {
+		if state.Name == m.self.Name {
+			// refute being suspected or declared dead, unless leaving
+			if state.State != MemberAlive && state.Incarnation >= m.self.Incarnation && m.self.State == MemberAlive {
+				m.self.Incarnation = state.Incarnation + 1
+			}
+			continue
+		}
+		p, ok := m.members[state.Name]
+		switch {
+		case !ok && state.State == MemberDead:
+			// nothing to tell about a member we never saw
+			continue
+		case !ok:
+			p = &peer{Member: state}
+			m.members[state.Name] = p
+		case state.Incarnation > p.Incarnation || state.Incarnation == p.Incarnation && state.State > p.State:
+			if p.State == state.State && p.Addr == state.Addr && p.Meta == state.Meta {
+				p.Incarnation = state.Incarnation
+				continue
+			}
+			p.Member = state
+		default:
+			continue
+		}
+		if state.State == MemberSuspect {
+			p.suspected = now
+		}
+		changed = append(changed, state)
+	}
+	m.mu.Unlock()
+	m.notify(changed)
+}
+
+// notify calls OnChange for the members.
+func (m *Membership) notify(changed []Member) {
+	if m.opts.OnChange == nil || len(changed) == 0 {
+		return
+	}
+	m.notifyMu.Lock()
+	defer m.notifyMu.Unlock()
+	for _, member := range changed {
+		m.opts.OnChange(member)
+	}
+}
+
+// probeLoop probes a member every ProbeInterval until the membership is closed.
+func (m *Membership) probeLoop() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(m.opts.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+		}
+		m.expire()
+		m.probe()
+	}
+}
+
+// expire declares dead the suspects which did not refute the suspicion in time.
+func (m *Membership) expire() {
+	var changed []Member
+	m.mu.Lock()
+	for _, p := range m.members {
+		if p.State == MemberSuspect && time.Since(p.suspected) >= m.opts.SuspicionTimeout {
+			p.State = MemberDead
+			changed = append(changed, p.Member)
+		}
+	}
+	m.mu.Unlock()
+	m.notify(changed)
+}
+
+// probe pings the next member, directly then through others, and suspects it if
+// it does not ack.
+func (m *Membership) probe() {
+	target, ok := m.next()
+	if !ok {
+		return
+	}
+	addr, err := net.ResolveUDPAddr("udp", target.Addr)
+	if err != nil {
+		return
+	}
+	acked := make(chan struct{}, 1)
+	signal := func() {
+		select {
+		case acked <- struct{}{}:
+		default:
+		}
+	}
+	seq := m.expect(signal)
+	defer m.forget(seq)
+	m.send(addr, message{Type: "ping", Seq: seq})
+	select {
+	case <-acked:
+		return
+	case <-time.After(m.opts.ProbeTimeout):
+	case <-m.done:
+		return
+	}
+	for _, other := range m.others(target.Name, m.opts.IndirectProbes) {
+		if otherAddr, err := net.ResolveUDPAddr("udp", other.Addr); err == nil {
+			m.send(otherAddr, message{Type: "ping-req", Seq: seq, Target: target.Addr})
+		}
+	}
+	wait := m.opts.ProbeInterval - m.opts.ProbeTimeout
+	if wait < m.opts.ProbeTimeout {
+		wait = m.opts.ProbeTimeout
+	}
+	select {
+	case <-acked:
+		return
+	case <-time.After(wait):
+	case <-m.done:
+		return
+	}
+	m.suspect(target)
+}
+
+// suspect marks the member as suspect, unless its state changed since it was
+// probed.
+func (m *Membership) suspect(target Member) {
+	m.mu.Lock()
+	p, ok := m.members[target.Name]
+	if !ok || p.State != MemberAlive || p.Incarnation != target.Incarnation {
+		m.mu.Unlock()
+		return
+	}
+	p.State, p.suspected = MemberSuspect, time.Now()
+	member := p.Member
+	m.mu.Unlock()
+	m.notify([]Member{member})
+}
+
+// next returns the next member to probe, going through the members which are not
+// dead in a random order, renewed every round.
+func (m *Membership) next() (Member, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for {
+		if len(m.order) == 0 {
+			for name, p := range m.members {
+				if p.State != MemberDead {
+					m.order = append(m.order, name)
+				}
+			}
+			if len(m.order) == 0 {
+				return Member{}, false
+			}
+			m.rnd.Shuffle(len(m.order), func(i, j int) { m.order[i], m.order[j] = m.order[j], m.order[i] })
+		}
+		name := m.order[0]
+		m.order = m.order[1:]
+		if p, ok := m.members[name]; ok && p.State != MemberDead {
+			return p.Member, true
+		}
+	}
+}
+
+// others returns up to n random alive members other than the one called name.
+func (m *Membership) others(name string, n int) []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var others []Member
+	for _, p := range m.members {
+		if p.Name != name && p.State == MemberAlive {
+			others = append(others, p.Member)
+		}
+	}
+	m.rnd.Shuffle(len(others), func(i, j int) { others[i], others[j] = others[j], others[i] })
+	if len(others) > n {
+		others = others[:n]
+	}
+	return others
+}
+
+// expect registers the function to call on the ack of the returned sequence
+// number.
+func (m *Membership) expect(ack func()) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seq++
+	m.acks[m.seq] = ack
+	return m.seq
+}
+
+// forget stops waiting for the ack of the sequence number.
+func (m *Membership) forget(seq uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.acks, seq)
+}
+
+// send sends the message, along with the states of the members known.
+func (m *Membership) send(to net.Addr, msg message) error {
+	m.mu.Lock()
+	msg.From = m.self.Name
+	msg.States = append(msg.States, m.self)
+	for _, p := range m.members {
+		msg.States = append(msg.States, p.Member)
+	}
+	m.mu.Unlock()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = m.conn.WriteTo(data, to)
+	return err
+}
+
+// Track updates the nodes of the cluster for a change of membership, e.g. from
+// MembershipOptions.OnChange: an alive member which is not a node yet is connected
+// to with connect, e.g. with client.New and its Meta, and added, and a dead one is
+// removed and closed. A suspect stays a node until it is declared dead. Like with
+// Remove, the keys of a removed node are not moved, and since it is gone they
+// cannot be drained: they are unreachable until it comes back, unless the nodes
+// are replicated.
+func (c *Cluster) Track(member Member, connect func(Member) (Node, error)) error {
+	switch member.State {
+	case MemberAlive:
+		c.mu.RLock()
+		_, ok := c.nodes[member.Name]
+		c.mu.RUnlock()
+		if ok {
+			return nil
+		}
+		node, err := connect(member)
+		if err != nil {
+			return fmt.Errorf("cluster: connecting to %s: %w", member.Name, err)
+		}
+		c.Add(member.Name, node)
+	case MemberDead:
+		if node := c.Remove(member.Name); node != nil {
+			node.Close()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package cluster
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newMembership(t *testing.T, name string, onChange func(Member)) *Membership {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	m, err := NewMembership(conn, MembershipOptions{
+		Name:             name,
+		ProbeInterval:    20 * time.Millisecond,
+		ProbeTimeout:     5 * time.Millisecond,
+		SuspicionTimeout: 100 * time.Millisecond,
+		OnChange:         onChange,
+	})
+	if err != nil {
+		t.Fatalf("NewMembership() error = %v", err)
+	}
+	return m
+}
+
+// waitFor waits for every member to see the states of the others as want.
+func waitFor(t *testing.T, want map[string]MemberState, members ...*Membership) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ok := true
+		for _, m := range members {
+			states := make(map[string]MemberState)
+			for _, member := range m.Members() {
+				states[member.Name] = member.State
+			}
+			for name, state := range want {
+				if got, found := states[name]; name != m.opts.Name && (!found || got != state) {
+					ok = false
+				}
+			}
+		}
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("members did not converge to %v", want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMembership(t *testing.T) {
+	a := newMembership(t, "a", nil)
+	defer a.Close()
+	b := newMembership(t, "b", nil)
+	defer b.Close()
+	c := newMembership(t, "c", nil)
+	d := newMembership(t, "d", nil)
+	if _, err := b.Join(a.opts.Addr); err != nil {
+		t.Fatalf("Join() error = %v", err)
+	}
+	// c and d only know of a, and learn of the others through gossip
+	for _, m := range []*Membership{c, d} {
+		if _, err := m.Join(a.opts.Addr); err != nil {
+			t.Fatalf("Join() error = %v", err)
+		}
+	}
+	waitFor(t, map[string]MemberState{"a": MemberAlive, "b": MemberAlive, "c": MemberAlive, "d": MemberAlive}, a, b, c, d)
+
+	// c leaves, d fails without a word
+	c.Close()
+	d.conn.Close()
+	waitFor(t, map[string]MemberState{"a": MemberAlive, "b": MemberAlive, "c": MemberDead, "d": MemberDead}, a, b)
+	d.Close()
+
+	stale := newMembership(t, "stale", nil)
+	defer stale.Close()
+	if _, err := stale.Join("127.0.0.1:1"); !errors.Is(err, ErrNoSeeds) {
+		t.Errorf("Join() of a missing seed error = %v, want %v", err, ErrNoSeeds)
+	}
+}
+
+func TestCluster_Track(t *testing.T) {
+	c := New(0)
+	defer c.Close()
+	var mu sync.Mutex
+	var errs []error
+	track := func(member Member) {
+		err := c.Track(member, func(Member) (Node, error) { return newNode(t), nil })
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	a := newMembership(t, "a", track)
+	defer a.Close()
+	b := newMembership(t, "b", nil)
+	if _, err := b.Join(a.opts.Addr); err != nil {
+		t.Fatalf("Join() error = %v", err)
+	}
+	waitNodes := func(want int) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); len(c.Nodes()) != want; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Nodes() = %v, want %d nodes", c.Nodes(), want)
+			}
+		}
+	}
+	waitNodes(1)
+	if nodes := c.Nodes(); nodes[0] != "b" {
+		t.Errorf("Nodes() = %v, want b added", nodes)
+	}
+	c.Set("othello", "shakespeare")
+	b.Close()
+	waitNodes(0)
+	if _, err := c.Lookup("othello"); !errors.Is(err, ErrNoNodes) {
+		t.Errorf("Lookup() error = %v, want %v", err, ErrNoNodes)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(errs) != 0 {
+		t.Errorf("Track() errors = %v", errs)
+	}
+}
@@ -0,0 +1,107 @@
+package cluster
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// DefaultVirtualNodes is the number of points a node gets on the ring when
+// NewRing is passed zero. More points spread the keys more evenly, at the cost of
+// a larger ring to search.
+const DefaultVirtualNodes = 128
+
+// Ring maps keys to nodes with consistent hashing. Every node is placed on a ring
+// of hashes at several points, its virtual nodes, and a key belongs to the node of
+// the first point at or after the hash of the key. Adding or removing a node only
+// moves the keys next to its points, about 1/N of them, instead of reshuffling
+// them all.
+//
+// A Ring is not safe to modify from multiple goroutines; Cluster guards its own.
+type Ring struct {
+	virtualNodes int
+	// points are the hashes of the virtual nodes, sorted
+	points []uint64
+	// owners maps a point to the name of its node
+	owners map[uint64]string
+	nodes  map[string]struct{}
+}
+
+// NewRing returns an empty ring placing every node at virtualNodes points.
+func NewRing(virtualNodes int) *Ring {
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+	return &Ring{virtualNodes: virtualNodes, owners: make(map[uint64]string), nodes: make(map[string]struct{})}
+}
+
+// Add places the node on the ring. Adding a node twice does nothing.
+func (r *Ring) Add(name string) {
+	r.nodes[name] = struct{}{}
+	r.place()
+}
+
+// Remove takes the node off the ring.
+func (r *Ring) Remove(name string) {
+	delete(r.nodes, name)
+	r.place()
+}
+
+// place computes the points of the nodes. Two virtual nodes colliding is unlikely
+// with 64 bit hashes, but when they do, the point goes to the node whose name
+// sorts first, so that the ring does not depend on the order the nodes were added.
+func (r *Ring) place() {
+	r.points = r.points[:0]
+	r.owners = make(map[uint64]string, len(r.nodes)*r.virtualNodes)
+	for _, name := range r.Nodes() {
+		for i := 0; i < r.virtualNodes; i++ {
+			point := hash(name + "#" + strconv.Itoa(i))
+			if _, ok := r.owners[point]; ok {
+				continue
+			}
+			r.owners[point] = name
+			r.points = append(r.points, point)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+}
+
+// Node returns the name of the node the key belongs to, or "" if the ring is
+// empty.
+func (r *Ring) Node(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		// past the last point, the ring wraps around to the first one
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// Nodes returns the names of the nodes on the ring, sorted.
+func (r *Ring) Nodes() []string {
+	names := make([]string, 0, len(r.nodes))
+	for name := range r.nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// hash is FNV-64a, followed by the finalizer of MurmurHash3: FNV alone clusters
+// the hashes of strings which only differ in their last characters, such as the
+// names of the virtual nodes.
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
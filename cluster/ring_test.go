@@ -0,0 +1,59 @@
+package cluster
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	ring := NewRing(0)
+	if got := ring.Node("othello"); got != "" {
+		t.Errorf("Node() on an empty ring = %v, want none", got)
+	}
+	ring.Add("a")
+	ring.Add("b")
+	ring.Add("c")
+	before := make(map[string]string)
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		before[key] = ring.Node(key)
+		counts[before[key]]++
+	}
+	// with virtual nodes, each node gets roughly a third of the keys
+	for _, name := range ring.Nodes() {
+		if counts[name] < 700 || counts[name] > 1300 {
+			t.Errorf("node %v got %v keys of 3000, want about 1000", name, counts[name])
+		}
+	}
+
+	// adding a node only moves keys to it
+	ring.Add("d")
+	moved := 0
+	for key, owner := range before {
+		if now := ring.Node(key); now != owner {
+			moved++
+			if now != "d" {
+				t.Errorf("Node(%v) moved from %v to %v, want it to stay or move to d", key, owner, now)
+			}
+		}
+	}
+	if moved < 450 || moved > 1050 {
+		t.Errorf("adding a node moved %v keys of 3000, want about 750", moved)
+	}
+
+	// removing it gives back the ring we had, whatever the order of Add
+	ring.Remove("d")
+	other := NewRing(0)
+	for _, name := range []string{"c", "a", "b"} {
+		other.Add(name)
+	}
+	for key, owner := range before {
+		if got := ring.Node(key); got != owner {
+			t.Errorf("Node(%v) after removing d = %v, want %v", key, got, owner)
+		}
+		if got := other.Node(key); got != owner {
+			t.Errorf("Node(%v) on a ring built in another order = %v, want %v", key, got, owner)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+func runAnalyze(args []string) error {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	n := fs.Int("n", 10, "number of largest keys, values and prefixes to report")
+	fileName, err := parseFile(fs, args)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(fileName); err != nil {
+		return err
+	}
+	// read-only, so that the store is left as it is, and can be analyzed while a
+	// writer has it open
+	store, err := caskdb.OpenReadOnly(fileName, caskdb.Options{})
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	report, err := store.Analyze()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SEGMENT\tRECORDS\tLIVE\tTOMBSTONES\tLIVE BYTES\tDEAD BYTES\tFORMAT BYTES\tDEAD %")
+	for _, s := range report.Segments {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%.1f\n", s.Name, s.Records, s.LiveRecords, s.Tombstones, s.LiveBytes, s.DeadBytes, s.FormatBytes, s.DeadRatio()*100)
+	}
+	w.Flush()
+	fmt.Printf("\ntotal: %d records, %d live bytes, %d dead bytes, %d bytes of format records\n", report.Records, report.LiveBytes, report.DeadBytes, report.FormatBytes)
+	fmt.Printf("average record size: %.1f bytes\n", report.AverageRecordSize)
+	fmt.Printf("compaction: %s", report.Plan.Reason)
+	if report.Plan.Recommended {
+		fmt.Printf(", would reclaim %d bytes", report.Plan.ReclaimableBytes)
+	}
+	fmt.Println()
+
+	keys := store.KeyReport(*n)
+	printSizes("largest values", keys.LargestValues)
+	printSizes("largest keys", keys.LargestKeys)
+	fmt.Println("\nlargest prefixes:")
+	w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, p := range keys.Prefixes {
+		fmt.Fprintf(w, "  %q\t%d keys\t%d bytes\n", p.Prefix, p.Keys, p.Bytes)
+	}
+	w.Flush()
+	fmt.Println("\nbusiest prefixes:")
+	w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, p := range keys.HotPrefixes {
+		fmt.Fprintf(w, "  %q\t%d reads\t%d writes\n", p.Prefix, p.Reads, p.Writes)
+	}
+	w.Flush()
+	printHistogram("key sizes", keys.KeySizes)
+	printHistogram("value sizes", keys.ValueSizes)
+	return nil
+}
+
+func printSizes(title string, sizes []caskdb.KeySize) {
+	fmt.Printf("\n%s:\n", title)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, s := range sizes {
+		fmt.Fprintf(w, "  %q\t%d bytes\n", s.Key, s.Size)
+	}
+	w.Flush()
+}
+
+func printHistogram(title string, buckets []caskdb.HistogramBucket) {
+	fmt.Printf("\n%s:\n", title)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, b := range buckets {
+		fmt.Fprintf(w, "  <= %d\t%d\n", b.UpperBound, b.Count)
+	}
+	w.Flush()
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+// auditLine is the JSON encoding of an AuditEvent, printed by audit -json.
+type auditLine struct {
+	Offset    int64             `json:"offset"`
+	Time      time.Time         `json:"time"`
+	Op        caskdb.AuditOp    `json:"op"`
+	Key       string            `json:"key,omitempty"`
+	ValueSize int               `json:"value_size,omitempty"`
+	Value     string            `json:"value,omitempty"`
+	Expiry    *time.Time        `json:"expiry,omitempty"`
+	Owner     string            `json:"owner,omitempty"`
+	Type      string            `json:"content_type,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	// Encoding is "base64" when Key and Value are encoded in base64, which they
+	// are when either is not valid UTF-8
+	Encoding string `json:"encoding,omitempty"`
+}
+
+func runAudit(args []string) error {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	prefix := fs.String("prefix", "", "only the keys starting with it")
+	since := fs.String("since", "", "only the changes at or after this time, in RFC 3339, e.g. 2024-01-02T15:04:05Z")
+	until := fs.String("until", "", "only the changes before this time, in RFC 3339")
+	values := fs.Bool("values", false, "print the values too")
+	asJSON := fs.Bool("json", false, "print a JSON object per line rather than a table")
+	fileName, err := parseFile(fs, args)
+	if err != nil {
+		return err
+	}
+	opts := caskdb.AuditOptions{Prefix: *prefix, Values: *values}
+	for _, t := range []struct {
+		flag  string
+		value string
+		to    *time.Time
+	}{{"since", *since, &opts.Since}, {"until", *until, &opts.Until}} {
+		if t.value == "" {
+			continue
+		}
+		if *t.to, err = time.Parse(time.RFC3339, t.value); err != nil {
+			return fmt.Errorf("audit: -%s: %v", t.flag, err)
+		}
+	}
+	if _, err := os.Stat(fileName); err != nil {
+		return err
+	}
+	store, err := caskdb.OpenReadOnly(fileName, caskdb.Options{})
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *asJSON {
+		w := bufio.NewWriter(os.Stdout)
+		defer w.Flush()
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		return store.Audit(ctx, opts, func(e caskdb.AuditEvent) error {
+			return enc.Encode(newAuditLine(e))
+		})
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+	header := "OFFSET\tTIME\tOP\tKEY\tVALUE SIZE\tEXPIRY\tOWNER\tTAGS"
+	if *values {
+		header += "\tVALUE"
+	}
+	fmt.Fprintln(w, header)
+	return store.Audit(ctx, opts, func(e caskdb.AuditEvent) error {
+		key, expiry, owner, tags := "-", "-", "-", "-"
+		if e.Op != caskdb.AuditDeleteAll {
+			key = fmt.Sprintf("%q", e.Key)
+		}
+		if !e.Expiry.IsZero() {
+			expiry = e.Expiry.UTC().Format(time.RFC3339)
+		}
+		if e.Meta != nil && e.Meta.Owner != "" {
+			owner = e.Meta.Owner
+		}
+		if e.Meta != nil && len(e.Meta.Tags) > 0 {
+			tags = formatTags(e.Meta.Tags)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%s\t%s\t%s", e.Offset, e.Time.UTC().Format(time.RFC3339), e.Op, key, e.ValueSize, expiry, owner, tags)
+		if *values && e.Op == caskdb.AuditSet {
+			fmt.Fprintf(w, "\t%q", e.Value)
+		}
+		fmt.Fprintln(w)
+		return nil
+	})
+}
+
+// newAuditLine returns the JSON encoding of the event.
+func newAuditLine(e caskdb.AuditEvent) auditLine {
+	line := auditLine{Offset: e.Offset, Time: e.Time.UTC(), Op: e.Op, Key: e.Key, ValueSize: e.ValueSize, Value: e.Value}
+	if !e.Expiry.IsZero() {
+		expiry := e.Expiry.UTC()
+		line.Expiry = &expiry
+	}
+	if e.Meta != nil {
+		line.Owner, line.Type, line.Tags = e.Meta.Owner, e.Meta.ContentType, e.Meta.Tags
+	}
+	if !utf8.ValidString(e.Key) || !utf8.ValidString(e.Value) {
+		line.Key = base64.StdEncoding.EncodeToString([]byte(e.Key))
+		line.Value = base64.StdEncoding.EncodeToString([]byte(e.Value))
+		line.Encoding = "base64"
+	}
+	return line
+}
+
+// formatTags formats the tags as name=value pairs, sorted by name.
+func formatTags(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for name, value := range tags {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	duration := fs.Duration("duration", caskdb.DefaultBenchDuration, "how long to run the load for")
+	concurrency := fs.Int("concurrency", 1, "number of goroutines generating the load")
+	reads := fs.Float64("reads", 0.9, "share of the operations which are reads, from 0 to 1")
+	keys := fs.Int("keys", caskdb.DefaultBenchKeys, "number of distinct keys")
+	keySize := sizeFlag(fs, "key-size", caskdb.SizeDistribution{Min: 16, Max: 16})
+	valueSize := sizeFlag(fs, "value-size", caskdb.SizeDistribution{Min: 100, Max: 1000})
+	seed := fs.Int64("seed", 0, "seed of the random choices, for a load which can be repeated")
+	compression := fs.String("compression", "none", "compression of the values: none, gzip, snappy or zstd")
+	index := fs.String("index", "map", "index of KeyDir: map, robin-hood, art or mmap")
+	segmentMB := fs.Int64("max-segment-mb", 0, "size to seal the active file at, in megabytes, or 0 for no limit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("bench: expected the directory to write the database to")
+	}
+	opts := caskdb.Options{MaxSegmentBytes: *segmentMB << 20}
+	var ok bool
+	if opts.Compression, ok = parseCompression(*compression); !ok {
+		return fmt.Errorf("bench: unknown compression %q", *compression)
+	}
+	if opts.KeyDirIndex, ok = parseIndex(*index); !ok {
+		return fmt.Errorf("bench: unknown index %q", *index)
+	}
+	// the database is one of its own, in the directory given for the disk it is on,
+	// and removed after
+	dir, err := os.MkdirTemp(fs.Arg(0), "caskdb-bench-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	store, err := caskdb.NewDiskStoreWithOptions(filepath.Join(dir, "bench.db"), opts)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	fmt.Printf("writing %d keys, then running %.0f%% reads from %d goroutines for %s\n", *keys, *reads*100, *concurrency, *duration)
+	report, err := store.Bench(ctx, caskdb.BenchOptions{
+		Duration:    *duration,
+		Concurrency: *concurrency,
+		ReadRatio:   *reads,
+		Keys:        *keys,
+		KeySize:     *keySize,
+		ValueSize:   *valueSize,
+		Seed:        *seed,
+	})
+	if err != nil {
+		return err
+	}
+	seconds := report.Duration.Seconds()
+	fmt.Printf("\n%.0f ops/s, %.1f MB/s read, %.1f MB/s written, %d errors\n\n", report.Throughput(), float64(report.BytesRead)/seconds/1e6, float64(report.BytesWritten)/seconds/1e6, report.Errors)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "OP\tCOUNT\tOPS/S\tP50\tP95\tP99\tMAX")
+	for _, op := range []struct {
+		name  string
+		stats caskdb.LatencyStats
+	}{{"read", report.Reads}, {"write", report.Writes}} {
+		s := op.stats
+		fmt.Fprintf(w, "%s\t%d\t%.0f\t%s\t%s\t%s\t%s\n", op.name, s.Count, float64(s.Count)/seconds, s.P50, s.P95, s.P99, s.Max)
+	}
+	return w.Flush()
+}
+
+// sizeFlag defines a flag for a size distribution, as a size, e.g. 16, a range,
+// e.g. 100-1000, or a range with a shape, e.g. 100-1000:exponential.
+func sizeFlag(fs *flag.FlagSet, name string, value caskdb.SizeDistribution) *caskdb.SizeDistribution {
+	size := &value
+	fs.Func(name, fmt.Sprintf("size in bytes, as a size, a range like 100-1000, or a range with a shape: uniform, normal or exponential, like 100-1000:normal (default %s)", formatSize(value)), func(s string) error {
+		var err error
+		*size, err = parseSize(s)
+		return err
+	})
+	return size
+}
+
+func parseSize(s string) (caskdb.SizeDistribution, error) {
+	var size caskdb.SizeDistribution
+	s, shape, hasShape := strings.Cut(s, ":")
+	if hasShape {
+		found := false
+		for _, candidate := range []caskdb.Shape{caskdb.ShapeUniform, caskdb.ShapeNormal, caskdb.ShapeExponential} {
+			if candidate.String() == shape {
+				size.Shape, found = candidate, true
+			}
+		}
+		if !found {
+			return size, fmt.Errorf("unknown shape %q", shape)
+		}
+	}
+	min, max, isRange := strings.Cut(s, "-")
+	var err error
+	if size.Min, err = strconv.Atoi(min); err != nil {
+		return size, err
+	}
+	size.Max = size.Min
+	if isRange {
+		if size.Max, err = strconv.Atoi(max); err != nil {
+			return size, err
+		}
+	}
+	if size.Min < 0 || size.Max < size.Min {
+		return size, fmt.Errorf("invalid range %s", s)
+	}
+	return size, nil
+}
+
+func formatSize(size caskdb.SizeDistribution) string {
+	if size.Min == size.Max {
+		return strconv.Itoa(size.Min)
+	}
+	return fmt.Sprintf("%d-%d:%s", size.Min, size.Max, size.Shape)
+}
+
+func parseCompression(name string) (caskdb.Compression, bool) {
+	for _, c := range []caskdb.Compression{caskdb.CompressionNone, caskdb.CompressionGzip, caskdb.CompressionSnappy, caskdb.CompressionZstd} {
+		if c.String() == name {
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+func parseIndex(name string) (caskdb.KeyDirIndex, bool) {
+	for _, i := range []caskdb.KeyDirIndex{caskdb.KeyDirMap, caskdb.KeyDirRobinHood, caskdb.KeyDirART, caskdb.KeyDirMmap} {
+		if i.String() == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	caskdb "github.com/avinassh/go-caskdb"
+	"github.com/avinassh/go-caskdb/bitcask"
+)
+
+func runBitcask(args []string) error {
+	fs := flag.NewFlagSet("bitcask", flag.ExitOnError)
+	importDir := fs.String("import", "", "the directory of a Bitcask to merge into the database")
+	exportDir := fs.String("export", "", "the directory to write the live keys of the database to as a Bitcask")
+	fileName, err := parseFile(fs, args)
+	if err != nil {
+		return err
+	}
+	if (*importDir == "") == (*exportDir == "") {
+		return errors.New("bitcask: expected one of -import and -export")
+	}
+	store, err := caskdb.NewDiskStore(fileName)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if *importDir != "" {
+		n, err := bitcask.Import(store, *importDir)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: imported %d keys into %s\n", *importDir, n, fileName)
+		return nil
+	}
+	n, err := bitcask.Export(store, *exportDir)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: exported %d keys to %s\n", fileName, n, *exportDir)
+	return nil
+}
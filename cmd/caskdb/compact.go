@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	caskdb "github.com/avinassh/go-caskdb"
+	"github.com/avinassh/go-caskdb/server"
+)
+
+func runCompact(args []string) error {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	offline := fs.Bool("offline", false, "compact without loading the keys, sorting them on the disk; the database must not be open")
+	memory := fs.Int64("memory-mb", caskdb.DefaultOfflineMemoryBytes>>20, "the memory -offline sorts the keys in, in megabytes")
+	tempDir := fs.String("temp-dir", "", "where -offline writes the sorted keys, next to the database by default")
+	fileName, err := parseFile(fs, args)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *offline {
+		opts := caskdb.OfflineOptions{MemoryBytes: *memory << 20, TempDir: *tempDir}
+		if info.IsDir() {
+			return compactNamespaces(ctx, fileName, opts)
+		}
+		return compactOffline(ctx, fileName, opts)
+	}
+	store, err := caskdb.NewDiskStore(fileName)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	// interrupted, the compaction records its progress, and running the command
+	// again resumes it
+	freed, err := store.Compact(ctx)
+	if errors.Is(err, context.Canceled) {
+		fmt.Println("compaction interrupted, run the command again to resume it")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("freed %d bytes\n", freed)
+	return nil
+}
+
+// compactNamespaces compacts every namespace of the directory offline, as served
+// by serve -dir.
+func compactNamespaces(ctx context.Context, dir string, opts caskdb.OfflineOptions) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return nil
+		}
+		fileName := filepath.Join(dir, entry.Name(), server.DataFileName)
+		if _, err := os.Stat(fileName); err != nil || !entry.IsDir() {
+			continue
+		}
+		fmt.Printf("%s: ", entry.Name())
+		if err := compactOffline(ctx, fileName, opts); err != nil {
+			return fmt.Errorf("namespace %s: %w", entry.Name(), err)
+		}
+	}
+	return nil
+}
+
+// compactOffline compacts the database offline. Interrupted, it leaves the
+// database as it was.
+func compactOffline(ctx context.Context, fileName string, opts caskdb.OfflineOptions) error {
+	freed, err := caskdb.CompactOffline(ctx, fileName, opts)
+	if errors.Is(err, context.Canceled) {
+		fmt.Println("compaction interrupted, nothing was changed")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("freed %d bytes\n", freed)
+	return nil
+}
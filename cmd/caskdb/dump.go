@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+// dumpBatch is how many records dump reads from the log at a time
+const dumpBatch = 1000
+
+func runDump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	from := fs.Int64("from", 0, "offset in the log to start from")
+	n := fs.Int("n", 0, "number of records to print, 0 for all of them")
+	values := fs.Bool("values", false, "print the values too, JSON as is and the rest quoted")
+	fileName, err := parseFile(fs, args)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(fileName); err != nil {
+		return err
+	}
+	store, err := caskdb.NewDiskStore(fileName)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+	header := "OFFSET\tTIME\tFLAGS\tKEY\tVALUE SIZE\tEXPIRY"
+	if *values {
+		header += "\tVALUE"
+	}
+	fmt.Fprintln(w, header)
+	offset, printed := *from, 0
+	for *n == 0 || printed < *n {
+		changes, next, err := store.ReadChanges(offset, dumpBatch)
+		if err != nil {
+			return err
+		}
+		if len(changes) == 0 {
+			return nil
+		}
+		for _, c := range changes {
+			key := fmt.Sprintf("%q", c.Key)
+			if c.Truncate {
+				key = "(truncate)"
+			}
+			expiry := "-"
+			if !c.Expiry.IsZero() {
+				expiry = c.Expiry.UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%v\t%s\t%d\t%s", c.Offset, c.Timestamp.UTC().Format(time.RFC3339), c.Flags, key, len(c.Value), expiry)
+			if *values && !c.Truncate && !c.Deleted {
+				fmt.Fprintf(w, "\t%s", caskdb.RenderValue(c.Key, c.Value, c.Flags))
+			}
+			fmt.Fprintln(w)
+			if printed++; printed == *n {
+				break
+			}
+		}
+		offset = next
+	}
+	return nil
+}
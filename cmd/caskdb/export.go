@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	order := fs.String("sort", "key", "the order of the keys: key, or time for the order they were last written in")
+	memory := fs.Int64("memory-mb", caskdb.DefaultExportMemoryBytes>>20, "the memory the records are sorted in, in megabytes")
+	tempDir := fs.String("temp-dir", "", "where the sorted records are written, next to the database by default")
+	out := fs.String("o", "", "the file to write to, standard output by default")
+	fileName, err := parseFile(fs, args)
+	if err != nil {
+		return err
+	}
+	opts := caskdb.ExportOptions{MemoryBytes: *memory << 20, TempDir: *tempDir}
+	var ok bool
+	if opts.Order, ok = parseOrder(*order); !ok {
+		return fmt.Errorf("export: unknown sort %q", *order)
+	}
+	if _, err := os.Stat(fileName); err != nil {
+		return err
+	}
+	// a reader, so that a database being served can be exported
+	store, err := caskdb.OpenReadOnly(fileName, caskdb.Options{})
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	bw := bufio.NewWriter(w)
+	n, err := store.Export(ctx, bw, opts)
+	if err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if *out != "" {
+		fmt.Printf("%s: exported %d keys to %s\n", fileName, n, *out)
+	}
+	return nil
+}
+
+// parseOrder returns the ExportOrder named name.
+func parseOrder(name string) (caskdb.ExportOrder, bool) {
+	for _, o := range []caskdb.ExportOrder{caskdb.ExportByKey, caskdb.ExportByTime} {
+		if o.String() == name {
+			return o, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,97 @@
+// Command caskdb provides tools to inspect and manage CaskDB database files.
+//
+// Usage:
+//
+//	caskdb analyze [-n 10] books.db
+//	caskdb audit [-prefix tenant42/] [-since 2024-01-02T15:04:05Z] [-until ...] [-values] [-json] books.db
+//	caskdb bench [-duration 10s] [-concurrency 1] [-reads 0.9] [-keys 10000] [-key-size 16] [-value-size 100-1000:uniform] [-compression none] [-index map] dir
+//	caskdb bitcask (-import dir | -export dir) books.db
+//	caskdb compact [-offline [-memory-mb 64] [-temp-dir dir]] (books.db | data/)
+//	caskdb dump [-from 0] [-n 0] [-values] books.db
+//	caskdb export [-sort key|time] [-memory-mb 64] [-temp-dir dir] [-o books.jsonl] books.db
+//	caskdb merge a.db b.db -o out.db, or a/ b/ -o out/ for directories of namespaces
+//	caskdb migrate books.db
+//	caskdb proxy [-resp localhost:6379] [-virtual-nodes 0] [-drain-timeout 10s] [-tls-cert cert.pem -tls-key key.pem] [-auth users.json] -shard books-1:6379 -shard books-2:6379
+//	caskdb replay [-i books.jsonl] books.db
+//	caskdb split -rule tenant42/=t42.db [-extract tenant7/=t7.db] [-rule =rest.db] books.db
+//	caskdb serve [-http localhost:8080] [-resp localhost:6379] [-memcached localhost:11211] [-debug localhost:6060] [-drain-timeout 10s] [-tls-cert cert.pem -tls-key key.pem] [-auth users.json] [-nats localhost:4222] [-ship s3://bucket/books/] (books.db | -dir data/)
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+const usage = `usage: caskdb <command> [arguments]
+
+commands:
+	analyze		report disk usage, fragmentation and the largest keys and values
+	audit		print who changed which keys when, from the log
+	bench		measure throughput and latencies under a generated load
+	bitcask		import from or export to the data files of Riak's Bitcask
+	compact		rewrite the sealed segments of a database without the dead records
+	dump		print the records of the log with their flags, oldest first
+	export		write the live keys as JSON lines, sorted by key or by time
+	merge		combine databases, the latest write of every key winning
+	migrate		rewrite the files of an older format in the current one
+	proxy		route the Redis protocol to shards by consistent hashing
+	replay		apply a stream of mutations, e.g. from export, with last-writer-wins
+	serve		serve a database over the network
+	split		split a database into several by key prefix
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "analyze":
+		err = runAnalyze(os.Args[2:])
+	case "audit":
+		err = runAudit(os.Args[2:])
+	case "bench":
+		err = runBench(os.Args[2:])
+	case "bitcask":
+		err = runBitcask(os.Args[2:])
+	case "compact":
+		err = runCompact(os.Args[2:])
+	case "dump":
+		err = runDump(os.Args[2:])
+	case "export":
+		err = runExport(os.Args[2:])
+	case "merge":
+		err = runMerge(os.Args[2:])
+	case "migrate":
+		err = runMigrate(os.Args[2:])
+	case "proxy":
+		err = runProxy(os.Args[2:])
+	case "replay":
+		err = runReplay(os.Args[2:])
+	case "split":
+		err = runSplit(os.Args[2:])
+	case "serve":
+		err = runServe(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "caskdb: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// parseFile parses the flags of a command which takes a single database file as
+// its argument, and returns that file.
+func parseFile(fs *flag.FlagSet, args []string) (string, error) {
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if fs.NArg() != 1 {
+		return "", fmt.Errorf("%s: expected a database file", fs.Name())
+	}
+	return fs.Arg(0), nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	caskdb "github.com/avinassh/go-caskdb"
+	"github.com/avinassh/go-caskdb/server"
+)
+
+func runMerge(args []string) error {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	out := fs.String("o", "", "the database file, or directory of namespaces, to merge into")
+	// the flags may come after the databases too, as in merge a/ b/ -o out/
+	var inputs []string
+	for rest := args; ; rest = fs.Args()[1:] {
+		if err := fs.Parse(rest); err != nil {
+			return err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		inputs = append(inputs, fs.Arg(0))
+	}
+	if *out == "" || len(inputs) == 0 {
+		return errors.New("merge: expected -o and the databases to merge")
+	}
+	for _, input := range inputs {
+		if abs(input) == abs(*out) {
+			return fmt.Errorf("merge: %s is both an input and the output", input)
+		}
+	}
+	info, err := os.Stat(inputs[0])
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return mergeFiles(*out, inputs)
+	}
+	// directories of namespaces, as served by serve -dir: every namespace is merged
+	// with the namespaces of the same name
+	namespaces := make(map[string][]string)
+	var names []string
+	for _, dir := range inputs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			fileName := filepath.Join(dir, entry.Name(), server.DataFileName)
+			if _, err := os.Stat(fileName); err != nil || !entry.IsDir() {
+				continue
+			}
+			if _, ok := namespaces[entry.Name()]; !ok {
+				names = append(names, entry.Name())
+			}
+			namespaces[entry.Name()] = append(namespaces[entry.Name()], fileName)
+		}
+	}
+	for _, name := range names {
+		if err := os.MkdirAll(filepath.Join(*out, name), 0755); err != nil {
+			return err
+		}
+		if err := mergeFiles(filepath.Join(*out, name, server.DataFileName), namespaces[name]); err != nil {
+			return fmt.Errorf("namespace %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// mergeFiles merges the databases into out, in order, with last-writer-wins.
+func mergeFiles(out string, inputs []string) error {
+	dst, err := caskdb.NewDiskStore(out)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	for _, input := range inputs {
+		if _, err := os.Stat(input); err != nil {
+			return err
+		}
+		src, err := caskdb.NewDiskStore(input)
+		if err != nil {
+			return err
+		}
+		n, err := dst.MergeFrom(src)
+		src.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", input, err)
+		}
+		fmt.Printf("%s: merged %d keys into %s\n", input, n, out)
+	}
+	return nil
+}
+
+// abs returns the absolute path of the file, or the path as is if that fails.
+func abs(path string) string {
+	if p, err := filepath.Abs(path); err == nil {
+		return p
+	}
+	return path
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fileName, err := parseFile(fs, args)
+	if err != nil {
+		return err
+	}
+	n, err := caskdb.UpgradeFormat(fileName)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: rewrote %d files in the current format\n", fileName, n)
+	return nil
+}
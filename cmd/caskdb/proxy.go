@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/avinassh/go-caskdb/server"
+)
+
+func runProxy(args []string) error {
+	fs := flag.NewFlagSet("proxy", flag.ExitOnError)
+	respAddr := fs.String("resp", "localhost:6379", "address to serve the Redis protocol on")
+	virtualNodes := fs.Int("virtual-nodes", 0, "points of every shard on the ring, 0 for the default")
+	drainTimeout := fs.Duration("drain-timeout", 10*time.Second, "how long to wait for in-flight requests on shutdown")
+	tlsCert := fs.String("tls-cert", "", "TLS certificate file, enables TLS along with -tls-key")
+	tlsKey := fs.String("tls-key", "", "TLS private key file")
+	authFile := fs.String("auth", "", "JSON file with the users allowed to connect, enables authentication")
+	var shards []string
+	fs.Func("shard", "address of the Redis protocol of a shard, e.g. books-1:6379; repeat for every shard", func(s string) error {
+		if s == "" {
+			return errors.New("want host:port")
+		}
+		shards = append(shards, s)
+		return nil
+	})
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(shards) == 0 {
+		return errors.New("proxy: expected at least one -shard")
+	}
+	var err error
+	var opts server.Options
+	if *tlsCert != "" || *tlsKey != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			return err
+		}
+		opts.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+	if *authFile != "" {
+		if opts.Auth, err = server.LoadAuth(*authFile); err != nil {
+			return err
+		}
+	}
+	proxy := server.NewRESPProxy(shards, *virtualNodes, opts)
+	ln, err := net.Listen("tcp", *respAddr)
+	if err != nil {
+		return err
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- proxy.Serve(ln) }()
+	fmt.Fprintf(os.Stderr, "proxying the Redis protocol on %s to %d shards\n", ln.Addr(), len(shards))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	stop()
+	fmt.Fprintf(os.Stderr, "shutting down, draining for up to %s\n", *drainTimeout)
+	if err := shutdown([]frontend{proxy}, *drainTimeout); err != nil {
+		return fmt.Errorf("drain: %w", err)
+	}
+	return <-errc
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	in := fs.String("i", "", "the stream to apply, as written by export, audit -json -values or a change feed; standard input by default")
+	fileName, err := parseFile(fs, args)
+	if err != nil {
+		return err
+	}
+	var r io.Reader = os.Stdin
+	if *in != "" {
+		file, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	store, err := caskdb.NewDiskStore(fileName)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	n, err := store.Replay(r)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: changed %d keys\n", fileName, n)
+	return nil
+}
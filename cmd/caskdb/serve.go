@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	caskdb "github.com/avinassh/go-caskdb"
+	"github.com/avinassh/go-caskdb/cdc"
+	"github.com/avinassh/go-caskdb/s3"
+	"github.com/avinassh/go-caskdb/server"
+	"github.com/avinassh/go-caskdb/ship"
+)
+
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	httpAddr := fs.String("http", "localhost:8080", "address to serve HTTP on")
+	respAddr := fs.String("resp", "", "address to also serve the Redis protocol on")
+	memcachedAddr := fs.String("memcached", "", "address to also serve the memcached text protocol on")
+	debugAddr := fs.String("debug", "", "admin address to serve /debug/pprof, /debug/vars and /debug/caskdb on, for troubleshooting")
+	drainTimeout := fs.Duration("drain-timeout", 10*time.Second, "how long to wait for in-flight requests on shutdown")
+	tlsCert := fs.String("tls-cert", "", "TLS certificate file, enables TLS along with -tls-key")
+	tlsKey := fs.String("tls-key", "", "TLS private key file")
+	authFile := fs.String("auth", "", "JSON file with the users allowed to connect, enables authentication")
+	backupDir := fs.String("backup-dir", "", "directory to write the backups taken over the admin API to")
+	dir := fs.String("dir", "", "serve every namespace in this directory instead of a single database file")
+	maxNamespaces := fs.Int("max-namespaces", server.DefaultMaxNamespaces, "how many namespaces there may be with -dir")
+	natsAddr := fs.String("nats", "", "NATS server to publish every change to, for change data capture")
+	natsSubject := fs.String("nats-subject", "caskdb.changes", "NATS subject to publish the changes to")
+	shipTo := fs.String("ship", "", "ship the log for disaster recovery to s3://bucket/prefix/ or an http(s):// URL")
+	shipInterval := fs.Duration("ship-interval", ship.DefaultInterval, "how often to ship the log")
+	ioUring := fs.Bool("io-uring", false, "read and write the batches through io_uring, on Linux 5.6 and later")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if (*dir == "") == (fs.NArg() != 1) {
+		return fmt.Errorf("serve: expected either a database file or -dir")
+	}
+	if *httpAddr == "" && *respAddr == "" && *memcachedAddr == "" {
+		return fmt.Errorf("serve: expected at least one of -http, -resp and -memcached")
+	}
+	if (*natsAddr != "" || *shipTo != "") && *dir != "" {
+		return fmt.Errorf("serve: -nats and -ship cannot be used with -dir")
+	}
+	if *memcachedAddr != "" && *authFile != "" {
+		return fmt.Errorf("serve: -memcached cannot be used with -auth, the memcached protocol has no authentication")
+	}
+	var err error
+	opts := server.Options{BackupDir: *backupDir}
+	if *tlsCert != "" || *tlsKey != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			return err
+		}
+		opts.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+	if *authFile != "" {
+		if opts.Auth, err = server.LoadAuth(*authFile); err != nil {
+			return err
+		}
+	}
+	// the stores are closed last, after the servers have drained, so that every
+	// acknowledged write is synced to the disk before we exit
+	var httpSrv *server.HTTPServer
+	var respSrv *server.RESPServer
+	var memcachedSrv *server.MemcachedServer
+	var debugSrv *server.HTTPServer
+	var serving string
+	if *dir != "" {
+		nsOpts := server.NamespaceOptions{MaxNamespaces: *maxNamespaces}
+		nsOpts.Options.IOUring = *ioUring
+		ns, err := server.OpenNamespaces(*dir, nsOpts)
+		if err != nil {
+			return err
+		}
+		defer ns.Close()
+		httpSrv = server.NewNamespacedHTTP(ns, opts)
+		respSrv = server.NewNamespacedRESP(ns, opts)
+		memcachedSrv = server.NewNamespacedMemcached(ns, opts)
+		debugSrv = server.NewNamespacedDebugHTTP(ns, opts)
+		serving = fmt.Sprintf("the namespaces in %s", *dir)
+	} else {
+		store, err := caskdb.NewDiskStoreWithOptions(fs.Arg(0), caskdb.Options{IOUring: *ioUring})
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		httpSrv = server.NewHTTP(store, opts)
+		respSrv = server.NewRESP(store, opts)
+		memcachedSrv = server.NewMemcached(store, opts)
+		debugSrv = server.NewDebugHTTP(store, opts)
+		serving = fs.Arg(0)
+		if *natsAddr != "" {
+			stopSink, err := startSink(store, fs.Arg(0), *natsAddr, *natsSubject)
+			if err != nil {
+				return err
+			}
+			defer stopSink()
+		}
+		if *shipTo != "" {
+			stopShipper, err := startShipper(store, fs.Arg(0), *shipTo, *shipInterval, *drainTimeout)
+			if err != nil {
+				return err
+			}
+			defer stopShipper()
+		}
+	}
+
+	scheme := "HTTP"
+	if opts.TLSConfig != nil {
+		scheme = "HTTPS"
+	}
+	frontends := []struct {
+		name string
+		addr string
+		srv  frontend
+	}{
+		{scheme, *httpAddr, httpSrv},
+		{"RESP", *respAddr, respSrv},
+		{"memcached", *memcachedAddr, memcachedSrv},
+		{"debug " + scheme, *debugAddr, debugSrv},
+	}
+	var running []frontend
+	errc := make(chan error, len(frontends))
+	for _, f := range frontends {
+		if f.addr == "" {
+			continue
+		}
+		ln, err := net.Listen("tcp", f.addr)
+		if err != nil {
+			shutdown(running, 0)
+			return err
+		}
+		srv := f.srv
+		go func() { errc <- srv.Serve(ln) }()
+		running = append(running, srv)
+		fmt.Fprintf(os.Stderr, "serving %s over %s on %s\n", serving, f.name, ln.Addr())
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err := <-errc:
+		shutdown(running, 0)
+		return err
+	case <-ctx.Done():
+	}
+	// a second signal while draining kills us the usual way
+	stop()
+	fmt.Fprintf(os.Stderr, "shutting down, draining for up to %s\n", *drainTimeout)
+	if err := shutdown(running, *drainTimeout); err != nil {
+		return fmt.Errorf("drain: %w", err)
+	}
+	for range running {
+		if err := <-errc; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startSink publishes the changes of the store to NATS in the background, keeping
+// its cursor next to the database file, until the returned function is called.
+func startSink(store *caskdb.DiskStore, fileName string, addr string, subject string) (func(), error) {
+	pub, err := cdc.NewNATSPublisher(addr, subject)
+	if err != nil {
+		return nil, err
+	}
+	sink, err := cdc.NewSink(store, pub, cdc.Options{CursorFile: fileName + ".cdc-cursor"})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := sink.Run(ctx); err != nil && ctx.Err() == nil {
+			fmt.Fprintf(os.Stderr, "change data capture stopped: %v\n", err)
+		}
+	}()
+	fmt.Fprintf(os.Stderr, "publishing the changes to %s on %s\n", subject, addr)
+	return func() {
+		cancel()
+		<-done
+		pub.Close()
+	}, nil
+}
+
+// startShipper ships the log of the store to dest in the background, keeping its
+// state next to the database file. The returned function stops it after a last
+// round, so that the writes drained on shutdown are shipped too.
+func startShipper(store *caskdb.DiskStore, fileName string, dest string, interval time.Duration, timeout time.Duration) (func(), error) {
+	target, prefix, err := shipTarget(dest)
+	if err != nil {
+		return nil, err
+	}
+	shipper, err := ship.NewShipper(store, target, ship.Options{
+		StateFile: fileName + ".ship-state",
+		Prefix:    prefix,
+		Interval:  interval,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		shipper.Run(ctx)
+	}()
+	fmt.Fprintf(os.Stderr, "shipping the log to %s every %s\n", dest, interval)
+	return func() {
+		cancel()
+		<-done
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := shipper.Ship(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to ship the end of the log: %v\n", err)
+		}
+	}, nil
+}
+
+// shipTarget returns the target for -ship along with the prefix of the object
+// names. An s3:// destination takes its endpoint, region and credentials from the
+// usual AWS environment variables.
+func shipTarget(dest string) (ship.Target, string, error) {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return nil, "", fmt.Errorf("serve: invalid -ship: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return ship.HTTPTarget{URL: dest}, "", nil
+	case "s3":
+		region := os.Getenv("AWS_REGION")
+		if region == "" {
+			region = "us-east-1"
+		}
+		endpoint := os.Getenv("AWS_ENDPOINT_URL")
+		if endpoint == "" {
+			endpoint = "https://s3." + region + ".amazonaws.com"
+		}
+		client := &s3.Client{
+			Endpoint:     endpoint,
+			Region:       region,
+			Bucket:       u.Host,
+			AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}
+		return client, strings.TrimPrefix(u.Path, "/"), nil
+	}
+	return nil, "", fmt.Errorf("serve: -ship wants s3://bucket/prefix/ or an http(s):// URL, got %q", dest)
+}
+
+// frontend is a server speaking one of the protocols we serve the store over.
+type frontend interface {
+	Serve(l net.Listener) error
+	Shutdown(ctx context.Context) error
+}
+
+// shutdown drains the frontends concurrently, giving them up to timeout in total,
+// and returns the first error.
+func shutdown(frontends []frontend, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	errc := make(chan error, len(frontends))
+	for _, f := range frontends {
+		f := f
+		go func() { errc <- f.Shutdown(ctx) }()
+	}
+	var first error
+	for range frontends {
+		if err := <-errc; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
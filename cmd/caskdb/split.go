@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+func runSplit(args []string) error {
+	fs := flag.NewFlagSet("split", flag.ExitOnError)
+	var rules []caskdb.SplitRule
+	addRule := func(trim bool) func(string) error {
+		return func(s string) error {
+			prefix, path, ok := strings.Cut(s, "=")
+			if !ok || path == "" {
+				return errors.New("want prefix=path")
+			}
+			rules = append(rules, caskdb.SplitRule{Prefix: prefix, Path: path, TrimPrefix: trim})
+			return nil
+		}
+	}
+	fs.Func("rule", "send the keys starting with prefix to the database at path, as prefix=path; repeat for every rule", addRule(false))
+	fs.Func("extract", "like -rule, and remove the prefix from the keys", addRule(true))
+	fileName, err := parseFile(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		return errors.New("split: expected at least one -rule or -extract")
+	}
+	if _, err := os.Stat(fileName); err != nil {
+		return err
+	}
+	store, err := caskdb.NewDiskStore(fileName)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	written, err := store.Split(rules)
+	if err != nil {
+		return err
+	}
+	paths := make([]string, 0, len(written))
+	for path := range written {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		fmt.Printf("%s: %d keys\n", path, written[path])
+	}
+	return nil
+}
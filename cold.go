@@ -0,0 +1,415 @@
+package caskdb
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ColdStorage keeps sealed segments off the machine, e.g. in an S3 bucket. An
+// *s3.Client is a ColdStorage.
+type ColdStorage interface {
+	// Put stores data as the object called name, replacing it if it exists
+	Put(ctx context.Context, name string, data []byte) error
+	// GetRange returns n bytes of the object called name, starting at offset
+	GetRange(ctx context.Context, name string, offset int64, n int64) ([]byte, error)
+}
+
+// ErrNoColdStorage is returned by Offload, and when opening a store with segments
+// in cold storage, when Options.ColdStorage is not set.
+var ErrNoColdStorage = errors.New("caskdb: Options.ColdStorage is not set")
+
+// Offload moves the sealed segments which are still on the local disk to
+// Options.ColdStorage, and returns how many it moved. The keys in them stay in
+// KeyDir, marked as remote: reading one fetches its record from cold storage, and
+// keeps it in a cache of Options.ColdCacheBytes.
+//
+// For each segment, the upload is followed by writing a local index next to it,
+// books.db.000001.remote, with the keys and locations of its records, so that the
+// store can be loaded without downloading it back. Only then is the local copy
+// deleted. The uploads happen without holding the store, so reads and writes
+// carry on meanwhile.
+func (d *DiskStore) Offload(ctx context.Context) (int, error) {
+	if d.opts.ColdStorage == nil {
+		return 0, ErrNoColdStorage
+	}
+	if d.readOnly {
+		return 0, ErrReadOnly
+	}
+	d.mu.Lock()
+	var local []*segment
+	for _, seg := range d.segments[:len(d.segments)-1] {
+		if !seg.remote && !seg.moving {
+			local = append(local, seg)
+		}
+	}
+	d.mu.Unlock()
+	for i, seg := range local {
+		// sealed segments do not change, so they are safe to read unlocked
+		data, err := os.ReadFile(seg.path)
+		if err != nil {
+			return i, err
+		}
+		if int64(len(data)) < seg.size {
+			return i, fmt.Errorf("caskdb: %s is shorter than it was when sealed", seg.path)
+		}
+		if err := d.opts.ColdStorage.Put(ctx, d.coldName(seg), data[:seg.size]); err != nil {
+			return i, err
+		}
+		if err := writeFileSync(seg.path+remoteIndexSuffix, bytes.NewReader(remoteIndex(data[:seg.size]))); err != nil {
+			return i, err
+		}
+		d.mu.Lock()
+		if seg.file != nil {
+			seg.file.Close()
+			seg.file = nil
+		}
+		err = os.Remove(seg.path)
+		if err == nil {
+			seg.remote = true
+			// the remote index takes its place
+			os.Remove(seg.path + hintSuffix)
+		}
+		d.mu.Unlock()
+		if err != nil {
+			// the local copy keeps being used, and the next Offload tries again
+			return i, err
+		}
+		d.log.Info("offloaded segment", "file", seg.path, "object", d.coldName(seg), "size", seg.size)
+	}
+	return len(local), nil
+}
+
+// coldName is the name of the segment's object in cold storage.
+func (d *DiskStore) coldName(seg *segment) string {
+	return d.opts.ColdPrefix + seg.name()
+}
+
+// readRemote fetches the record kEntry points at from cold storage, unless it is
+// cached. The store must be locked.
+func (d *DiskStore) readRemote(seg *segment, kEntry KeyEntry) ([]byte, error) {
+	if d.opts.ColdStorage == nil {
+		return nil, ErrNoColdStorage
+	}
+	key := recordKey{seg.id, kEntry.position}
+	if data, ok := d.coldCache.get(key); ok {
+		return data, nil
+	}
+	data, err := d.opts.ColdStorage.GetRange(context.Background(), d.coldName(seg), int64(kEntry.position), int64(kEntry.totalSize))
+	if err != nil {
+		d.log.Error("cold storage read failed", "object", d.coldName(seg), "offset", kEntry.position, "error", err)
+		return nil, err
+	}
+	if len(data) != int(kEntry.totalSize) {
+		return nil, fmt.Errorf("%w: cold storage returned %d bytes of %s at offset %d, want %d",
+			ErrCorruptRecord, len(data), d.coldName(seg), kEntry.position, kEntry.totalSize)
+	}
+	d.coldCache.add(key, data)
+	return data, nil
+}
+
+// remoteReaderAt reads an object in cold storage.
+type remoteReaderAt struct {
+	storage ColdStorage
+	name    string
+}
+
+func (r remoteReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if r.storage == nil {
+		return 0, ErrNoColdStorage
+	}
+	data, err := r.storage.GetRange(context.Background(), r.name, off, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, data)
+	if n < len(p) {
+		return n, fmt.Errorf("caskdb: short read of %s at offset %d", r.name, off)
+	}
+	return n, nil
+}
+
+// The remote index of a segment holds the header and the key of each of its
+// records, in the order of the records, followed by the CRC-32 of all of that.
+// The values are left out: they are what we offload. The offsets of the records
+// follow from their sizes, as the records are laid out back to back.
+
+// remoteIndex builds the remote index of the segment data.
+func remoteIndex(data []byte) []byte {
+	var index []byte
+	scanRecords(bytes.NewReader(data), int64(len(data)), func(offset int, record []byte) error {
+		_, keySize, _ := decodeHeader(record)
+		index = append(index, record[:headerSize+keySize]...)
+		return nil
+	})
+	return binary.LittleEndian.AppendUint32(index, crc32.ChecksumIEEE(index))
+}
+
+// scanRemoteIndex calls fn with the offset, header and key of every record of the
+// remote segment.
+func scanRemoteIndex(seg *segment, fn func(offset int, header []byte, key string)) error {
+	index, err := os.ReadFile(seg.path + remoteIndexSuffix)
+	if err != nil {
+		return err
+	}
+	if len(index) < 4 || binary.LittleEndian.Uint32(index[len(index)-4:]) != crc32.ChecksumIEEE(index[:len(index)-4]) {
+		return fmt.Errorf("%w: %s", ErrCorruptRecord, seg.path+remoteIndexSuffix)
+	}
+	index = index[:len(index)-4]
+	offset := 0
+	for len(index) > 0 {
+		if len(index) < headerSize {
+			return fmt.Errorf("%w: %s", ErrCorruptRecord, seg.path+remoteIndexSuffix)
+		}
+		_, keySize, valueSize := decodeHeader(index)
+		if uint32(len(index)-headerSize) < keySize {
+			return fmt.Errorf("%w: %s", ErrCorruptRecord, seg.path+remoteIndexSuffix)
+		}
+		fn(offset, index[:headerSize], string(index[headerSize:headerSize+keySize]))
+		offset += headerSize + int(keySize) + int(valueSize)
+		index = index[headerSize+keySize:]
+	}
+	seg.size = int64(offset)
+	return nil
+}
+
+// loadRemoteIndex reads the keys of a remote segment into keyDir.
+func (d *DiskStore) loadRemoteIndex(seg *segment) error {
+	if d.opts.ColdStorage == nil {
+		return fmt.Errorf("%w, and %s is in cold storage", ErrNoColdStorage, seg.path)
+	}
+	now := time.Now()
+	records := 0
+	// the dictionaries and the ids of the blobs referenced are fetched once the
+	// index is read, as they are values
+	var dicts, refs []KeyEntry
+	var refKeys []string
+	var foreign error
+	err := scanRemoteIndex(seg, func(offset int, header []byte, key string) {
+		timestamp, keySize, valueSize := decodeHeader(header)
+		kEntry := NewKeyEntry(timestamp, uint32(offset), headerSize+keySize+valueSize)
+		kEntry.segment = seg.id
+		kEntry.expiry = decodeExpiry(header)
+		if isDictKey(key) {
+			dicts = append(dicts, kEntry)
+		}
+		if isStoreKey(key) && foreign == nil {
+			if err := d.loadStoreID(key); err != nil {
+				foreign = fmt.Errorf("%s offset %d: %w", seg.path, offset, err)
+			}
+		}
+		if isFormatKey(key) && foreign == nil {
+			if err := checkFormat(key); err != nil {
+				foreign = fmt.Errorf("%s offset %d: %w", seg.path, offset, err)
+			}
+		}
+		if decodeFlags(header)&FlagDedup != 0 {
+			refs, refKeys = append(refs, kEntry), append(refKeys, key)
+		}
+		d.index(key, kEntry, valueSize == 0, now)
+		if isFormatKey(key) {
+			return
+		}
+		seg.age(records, timestamp)
+		seg.mark(records, offset, key)
+		records++
+	})
+	if err == nil {
+		err = foreign
+	}
+	if err != nil {
+		return err
+	}
+	for _, kEntry := range dicts {
+		data, err := d.readRemote(seg, kEntry)
+		if err != nil {
+			return err
+		}
+		if !verifyKV(data) {
+			return fmt.Errorf("%w: %s offset %d", ErrCorruptRecord, seg.path, kEntry.position)
+		}
+		_, key, value := decodeKV(data)
+		if err := d.addDictionary(key, value); err != nil {
+			return err
+		}
+	}
+	for i, kEntry := range refs {
+		data, err := d.readRemote(seg, kEntry)
+		if err != nil {
+			return err
+		}
+		_, _, id := decodeKV(data)
+		if !verifyKV(data) || !validBlobID(id) {
+			return fmt.Errorf("%w: %s offset %d", ErrCorruptRecord, seg.path, kEntry.position)
+		}
+		b := d.refBlob(id)
+		// the key may have been written again later in the segment
+		if current, ok := d.keyDir.get(refKeys[i]); ok && current.segment == seg.id && current.position == kEntry.position {
+			current.blob = b
+			d.keyDir.set(refKeys[i], current)
+		}
+	}
+	return nil
+}
+
+// writeFileSync writes the contents of r to the file and syncs it to the disk,
+// replacing the file atomically if it exists.
+func writeFileSync(fileName string, r io.Reader) error {
+	tmp, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return renameFile(tmp.Name(), fileName)
+}
+
+// recordKey identifies a record in the store.
+type recordKey struct {
+	segment  uint32
+	position uint32
+}
+
+// recordCache is an LRU cache of records read from cold storage, bounded by their
+// total size. The values decoded from them are kept along, counted towards the
+// size, so that a Get hitting the cache returns the value as is. The stores of a
+// Manager share the records of one, each through a recordCache of its own, whose
+// owner tells its records apart; it has a lock of its own for that.
+type recordCache struct {
+	lru   *recordLRU
+	owner uint64
+}
+
+type recordLRU struct {
+	mu    sync.Mutex
+	max   int64
+	size  int64
+	order *list.List
+	items map[ownedRecordKey]*list.Element
+}
+
+// ownedRecordKey identifies a record in the stores sharing a cache.
+type ownedRecordKey struct {
+	owner uint64
+	key   recordKey
+}
+
+type cachedRecord struct {
+	key  ownedRecordKey
+	data []byte
+	// value and flags are those decoded from data, once decoded is set
+	value   string
+	flags   RecordFlags
+	decoded bool
+}
+
+func newRecordCache(max int64) *recordCache {
+	return &recordCache{lru: newRecordLRU(max)}
+}
+
+func newRecordLRU(max int64) *recordLRU {
+	return &recordLRU{max: max, order: list.New(), items: make(map[ownedRecordKey]*list.Element)}
+}
+
+func (c *recordCache) get(key recordKey) ([]byte, bool) {
+	c.lru.mu.Lock()
+	defer c.lru.mu.Unlock()
+	elem, ok := c.lru.items[ownedRecordKey{c.owner, key}]
+	if !ok {
+		return nil, false
+	}
+	c.lru.order.MoveToFront(elem)
+	return elem.Value.(*cachedRecord).data, true
+}
+
+// value returns the value decoded from the cached record, if it was.
+func (c *recordCache) value(key recordKey) (string, RecordFlags, bool) {
+	c.lru.mu.Lock()
+	defer c.lru.mu.Unlock()
+	elem, ok := c.lru.items[ownedRecordKey{c.owner, key}]
+	if !ok {
+		return "", 0, false
+	}
+	record := elem.Value.(*cachedRecord)
+	if !record.decoded {
+		return "", 0, false
+	}
+	c.lru.order.MoveToFront(elem)
+	return record.value, record.flags, true
+}
+
+// setValue keeps the value decoded from the cached record along with it.
+func (c *recordCache) setValue(key recordKey, value string, flags RecordFlags) {
+	c.lru.mu.Lock()
+	defer c.lru.mu.Unlock()
+	elem, ok := c.lru.items[ownedRecordKey{c.owner, key}]
+	if !ok {
+		return
+	}
+	record := elem.Value.(*cachedRecord)
+	if record.decoded {
+		return
+	}
+	record.value, record.flags, record.decoded = value, flags, true
+	c.lru.size += int64(len(value))
+	c.lru.shrink()
+}
+
+func (c *recordCache) add(key recordKey, data []byte) {
+	c.lru.mu.Lock()
+	defer c.lru.mu.Unlock()
+	if int64(len(data)) > c.lru.max {
+		return
+	}
+	owned := ownedRecordKey{c.owner, key}
+	c.lru.items[owned] = c.lru.order.PushFront(&cachedRecord{key: owned, data: data})
+	c.lru.size += int64(len(data))
+	c.lru.shrink()
+}
+
+// clear drops the records of the owner, whose segments and offsets no longer
+// hold the same records, e.g. after Compact.
+func (c *recordCache) clear() {
+	c.lru.mu.Lock()
+	defer c.lru.mu.Unlock()
+	for elem := c.lru.order.Front(); elem != nil; {
+		next := elem.Next()
+		if elem.Value.(*cachedRecord).key.owner == c.owner {
+			c.lru.remove(elem)
+		}
+		elem = next
+	}
+}
+
+// shrink evicts the least recently used records until the cache fits in max.
+func (c *recordLRU) shrink() {
+	for c.size > c.max {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *recordLRU) remove(elem *list.Element) {
+	record := elem.Value.(*cachedRecord)
+	c.order.Remove(elem)
+	delete(c.items, record.key)
+	c.size -= int64(len(record.data) + len(record.value))
+}
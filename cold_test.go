@@ -0,0 +1,123 @@
+package caskdb
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// memColdStorage keeps the objects in memory and counts the range reads.
+type memColdStorage struct {
+	objects map[string][]byte
+	reads   int
+}
+
+func (m *memColdStorage) Put(ctx context.Context, name string, data []byte) error {
+	m.objects[name] = append([]byte(nil), data...)
+	return nil
+}
+
+func (m *memColdStorage) GetRange(ctx context.Context, name string, offset int64, n int64) ([]byte, error) {
+	m.reads++
+	data, ok := m.objects[name]
+	if !ok || offset+n > int64(len(data)) {
+		return nil, errors.New("no such range")
+	}
+	return data[offset : offset+n], nil
+}
+
+func TestDiskStore_Offload(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	recordSize, _ := encodeKV(0, "othello", "shakespeare")
+	cold := &memColdStorage{objects: make(map[string][]byte)}
+	opts := Options{MaxSegmentBytes: int64(len(formatRecord(0)) + 2*recordSize), ColdStorage: cold, ColdPrefix: "books/", ColdCacheBytes: 1 << 10}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("othello", "shakespeare")
+	store.Set("hamlet", "shakespeare")
+	store.Set("dune", "herbert")
+	store.Delete("hamlet")
+
+	n, err := store.Offload(context.Background())
+	if err != nil {
+		t.Fatalf("Offload() error = %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("Offload() = %v, want 1 segment", n)
+	}
+	if _, ok := cold.objects["books/test.db.000001"]; !ok {
+		t.Errorf("Offload() did not upload books/test.db.000001")
+	}
+	if _, err := os.Stat(sealedPath(fileName, 1)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Offload() kept the local copy of the segment")
+	}
+	// a second round has nothing left to move
+	if n, err := store.Offload(context.Background()); n != 0 || err != nil {
+		t.Errorf("Offload() = %v, %v, want nothing to move", n, err)
+	}
+
+	// cold keys are fetched once, then served from the cache
+	for i := 0; i < 2; i++ {
+		if got := store.Get("othello"); got != "shakespeare" {
+			t.Errorf("Get(othello) = %v, want %v", got, "shakespeare")
+		}
+	}
+	if cold.reads != 1 {
+		t.Errorf("cold storage reads = %v, want 1", cold.reads)
+	}
+	store.Close()
+
+	// the remote index is enough to load the store back
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	if got := store.Get("othello"); got != "shakespeare" {
+		t.Errorf("Get(othello) after reopening = %v, want %v", got, "shakespeare")
+	}
+	if got := store.Get("hamlet"); got != "" {
+		t.Errorf("Get(hamlet) after reopening = %v, want it deleted", got)
+	}
+	changes, _, err := store.ReadChanges(0, 100)
+	if err != nil {
+		t.Fatalf("ReadChanges() error = %v", err)
+	}
+	if len(changes) != 4 || changes[0].Key != "othello" {
+		t.Errorf("ReadChanges() = %+v, want the 4 changes from othello on", changes)
+	}
+	report, err := store.Analyze()
+	if err != nil {
+		t.Fatalf("Analyze() error = %v", err)
+	}
+	if !report.Segments[0].Remote || report.Segments[0].LiveRecords != 1 {
+		t.Errorf("Analyze() = %+v, want the remote segment with othello live", report.Segments[0])
+	}
+	store.Close()
+
+	opts.ColdStorage = nil
+	if _, err := NewDiskStoreWithOptions(fileName, opts); !errors.Is(err, ErrNoColdStorage) {
+		t.Errorf("NewDiskStoreWithOptions() error = %v, want %v", err, ErrNoColdStorage)
+	}
+}
+
+func Test_recordCache(t *testing.T) {
+	cache := newRecordCache(10)
+	cache.add(recordKey{1, 0}, []byte("hamlet"))
+	cache.add(recordKey{1, 6}, []byte("dune"))
+	cache.get(recordKey{1, 0})
+	cache.add(recordKey{1, 10}, []byte("emma"))
+	if _, ok := cache.get(recordKey{1, 6}); ok {
+		t.Errorf("get() found the least recently used record, want it evicted")
+	}
+	if data, ok := cache.get(recordKey{1, 0}); !ok || string(data) != "hamlet" {
+		t.Errorf("get() = %q, %v, want %q", data, ok, "hamlet")
+	}
+	cache.add(recordKey{2, 0}, []byte("the complete works"))
+	if _, ok := cache.get(recordKey{2, 0}); ok {
+		t.Errorf("get() found a record larger than the cache")
+	}
+}
@@ -0,0 +1,999 @@
+package caskdb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// compactKey is the key of the record starting a segment written by Compact from
+// the oldest segment on. Its value is the offset of the record in the log, and the
+// id of the first segment compacted, padded so that it can be filled in once the
+// offset is known. Like the record of DeleteAll, loading the store empties KeyDir
+// when it meets it, as every live key is written again after it, and the segments
+// before the one holding it are deleted.
+//
+// compactRangeKey starts the segments compacted from a later segment. The
+// segments from the first one compacted up to the one holding it are deleted, and
+// the offset tells how many bytes of the log the compaction freed before it. Both
+// keys are reserved.
+const (
+	compactKey      = "\x00compact\x00"
+	compactRangeKey = "\x00compact-range\x00"
+)
+
+// compactMarkerSize is the size of the record of compactRangeKey, which is also
+// larger than that of compactKey
+const compactMarkerSize = int64(headerSize + len(compactRangeKey) + len("00000000000000000000 0000000000"))
+
+// compactionMarkInterval is how many records of a compacted segment there are
+// between two of its marks
+const compactionMarkInterval = 64
+
+// compactionChunkBytes is how much of the segments Compact reads at a time, and
+// sorts out with the store locked
+const compactionChunkBytes = 1 << 20
+
+// a sealed segment smaller than Options.MaxSegmentBytes divided by
+// smallSegmentDivisor is merged with the segments compacted next to it, even if
+// it has little garbage, so that the store does not end up with many small files
+const smallSegmentDivisor = 4
+
+// compactionCheckpointBytes is how much Compact writes between two records of its
+// progress
+const compactionCheckpointBytes = 16 << 20
+
+// compactStateSuffix is appended to the name of the active file for the progress
+// of an interrupted compaction, and compactOutputSuffix to the name of the segment
+// being compacted into for the file it is written to meanwhile
+const (
+	compactStateSuffix  = ".compact-state"
+	compactOutputSuffix = ".compact"
+)
+
+// DefaultTombstoneRetention is how long Compact keeps the tombstones when
+// Options.TombstoneRetention is not set.
+const DefaultTombstoneRetention = 24 * time.Hour
+
+// ErrCompacting is returned by Compact when another compaction is running.
+var ErrCompacting = errors.New("caskdb: a compaction is already running")
+
+// Compact rewrites the sealed segments holding the most dead records, i.e. older
+// versions of the keys, tombstones and expired keys, into segments holding only
+// their live records, and returns the number of bytes it freed.
+//
+// The segments go by the share of their bytes which are dead, highest first, the
+// ones below compactionDeadRatio being left alone. Each compaction starts from the
+// segment with the highest share, and takes in its neighbours as long as they are
+// worth compacting too, or small, so that they are merged into one: the live bytes
+// copied are bounded by Options.MaxSegmentBytes, while the segments written are
+// fewer. The active file is never compacted, and neither are the segments being
+// moved to Options.ColdDir.
+//
+// The tombstones are kept as long as older segments might hold a value of their
+// key. Compacting from the oldest segment, they are still kept for
+// Options.TombstoneRetention, so that the change feed readers lagging behind see
+// the deletes.
+//
+// The records are copied without holding the store, so reads and writes carry on
+// meanwhile. When ctx is done, Compact stops and returns its error, along with the
+// bytes freed so far, recording its progress next to the active file, in
+// books.db.compact-state: the next call resumes from there rather than starting
+// over, unless the segments changed in between, e.g. with DeleteAll.
+//
+// The offsets in the log keep growing: the compacted records are laid out to end
+// where the segments they come from did. See ReadChanges for the readers of the
+// change feed.
+func (d *DiskStore) Compact(ctx context.Context) (freed int64, err error) {
+	if d.readOnly {
+		return 0, ErrReadOnly
+	}
+	span := d.tracer.Start(ctx, "caskdb.Compact")
+	defer func() {
+		span.SetAttribute(spanAttrFreed, freed)
+		span.End(err)
+	}()
+	d.mu.Lock()
+	if d.compacting {
+		d.mu.Unlock()
+		return 0, ErrCompacting
+	}
+	d.compacting = true
+	statePath := d.file.Name() + compactStateSuffix
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		d.compacting = false
+		d.mu.Unlock()
+		if d.opts.OnCompaction != nil {
+			d.opts.OnCompaction(freed, err)
+		}
+	}()
+	if shared := d.opts.shared; shared != nil {
+		// the stores of a Manager take turns, ManagerOptions.CompactionWorkers at a
+		// time
+		select {
+		case shared.compactions <- struct{}{}:
+			defer func() { <-shared.compactions }()
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+	// the segments which gave nothing back, not to be picked again
+	tried := make(map[uint32]bool)
+	for {
+		c := &compaction{store: d, statePath: statePath}
+		saved := c.loadState()
+		d.mu.Lock()
+		c.inputs = d.pickCompaction(saved, tried)
+		d.mu.Unlock()
+		if c.inputs == nil {
+			return freed, nil
+		}
+		n, err := c.compact(ctx, saved)
+		freed += n
+		d.mu.Lock()
+		if err == nil {
+			d.lifetime.Compactions++
+			d.lifetime.Epoch++
+		}
+		d.lifetime.ReclaimedBytes += n
+		d.saveStats()
+		d.mu.Unlock()
+		if err != nil {
+			return freed, err
+		}
+		if n == 0 {
+			for _, seg := range c.inputs {
+				tried[seg.id] = true
+			}
+		}
+	}
+}
+
+// pickCompaction returns the run of sealed segments to compact next, or nil if
+// there are none worth it: those of the compaction saved if it can be resumed,
+// or those Compact picks by their share of dead bytes, leaving out the ones
+// tried. The store must be locked.
+func (d *DiskStore) pickCompaction(saved *compactionState, tried map[uint32]bool) []*segment {
+	sealed := d.segments[:len(d.segments)-1]
+	if saved != nil {
+		if i := saved.find(sealed); i >= 0 {
+			return sealed[i : i+len(saved.Segments)]
+		}
+	}
+	now := time.Now()
+	live := make(map[uint32]int64)
+	// a blob only referenced by older versions of the keys is as good as dead:
+	// compacting drops them, and it along with them
+	blobs := make(map[*blob]bool)
+	d.keyDir.each(func(key string, kEntry KeyEntry) bool {
+		if !kEntry.expired(now) {
+			live[kEntry.segment] += int64(kEntry.totalSize)
+			if b := kEntry.blob; b != nil && !blobs[b] {
+				blobs[b] = true
+				live[b.at.segment] += int64(b.at.totalSize)
+			}
+		}
+		return true
+	})
+	deadRatio := func(seg *segment) float64 {
+		if seg.size == 0 {
+			return 0
+		}
+		return float64(seg.size-live[seg.id]) / float64(seg.size)
+	}
+	eligible := func(seg *segment) bool {
+		return !seg.moving && !tried[seg.id]
+	}
+	first := -1
+	for i, seg := range sealed {
+		// freeing less than the record starting the output takes is no use, e.g.
+		// for a segment compacted before whose keys were all written again since
+		if seg.size-live[seg.id] <= compactMarkerSize {
+			continue
+		}
+		if eligible(seg) && deadRatio(seg) >= compactionDeadRatio && (first < 0 || deadRatio(seg) > deadRatio(sealed[first])) {
+			first = i
+		}
+	}
+	if first < 0 {
+		return nil
+	}
+	lo, hi := first, first
+	liveBytes, size := live[sealed[first].id], sealed[first].size
+	// worth reports whether the neighbour of the run fits in it and is worth
+	// compacting along with it
+	worth := func(i int) bool {
+		if i < 0 || i >= len(sealed) || !eligible(sealed[i]) {
+			return false
+		}
+		seg := sealed[i]
+		// the positions in a segment are 32 bits
+		if size+seg.size > math.MaxUint32 {
+			return false
+		}
+		if max := d.opts.MaxSegmentBytes; max > 0 && liveBytes+live[seg.id] > max {
+			return false
+		}
+		return deadRatio(seg) >= compactionDeadRatio || seg.size < d.opts.MaxSegmentBytes/smallSegmentDivisor
+	}
+	for {
+		left, right := worth(lo-1), worth(hi+1)
+		if left && right {
+			// the one with the most garbage first
+			left = deadRatio(sealed[lo-1]) >= deadRatio(sealed[hi+1])
+			right = !left
+		}
+		var next *segment
+		switch {
+		case left:
+			lo--
+			next = sealed[lo]
+		case right:
+			hi++
+			next = sealed[hi]
+		default:
+			return sealed[lo : hi+1]
+		}
+		liveBytes += live[next.id]
+		size += next.size
+	}
+}
+
+// compact runs the compaction, resuming the one saved if it was compacting the
+// same segments, and returns the bytes freed.
+func (c *compaction) compact(ctx context.Context, saved *compactionState) (int64, error) {
+	d := c.store
+	start := time.Now()
+	defer func() { d.observe("Compact", "", int(c.state.Written), c.inputs[len(c.inputs)-1].path, start) }()
+	if err := c.open(saved); err != nil {
+		return 0, err
+	}
+	defer c.close()
+	if err := c.run(ctx); err != nil {
+		if ctx.Err() != nil {
+			d.log.Info("compaction interrupted", "segments", len(c.inputs), "done", c.state.Segment, "written", c.state.Written)
+		}
+		return 0, err
+	}
+	freed, err := c.finish()
+	if err != nil {
+		return 0, err
+	}
+	d.log.Info("compacted segments", "first", c.inputs[0].name(), "segments", len(c.inputs), "freed", freed, "duration", time.Since(start))
+	return freed, nil
+}
+
+// compactionState is the progress of a compaction, kept in the state file.
+type compactionState struct {
+	// Segments and Sizes are the ids and sizes of the segments being compacted:
+	// the compaction only resumes if they are still the same
+	Segments []uint32 `json:"segments"`
+	Sizes    []int64  `json:"sizes"`
+	// Segment is the index in Segments, and Position the offset in that segment,
+	// of the next record to copy
+	Segment  int   `json:"segment"`
+	Position int64 `json:"position"`
+	// Output is the file the records are copied to, and Written the bytes copied
+	// to it so far
+	Output  string `json:"output"`
+	Written int64  `json:"written"`
+	// First is set when compacting from the oldest segment
+	First bool `json:"first"`
+	// Dropped counts the records referencing each blob which were left out, to
+	// take off the blobs once the compaction completes
+	Dropped map[string]int `json:"dropped,omitempty"`
+	// Rekey is set when the records are encrypted again under the current key,
+	// check RotateKey
+	Rekey bool `json:"rekey,omitempty"`
+}
+
+// compaction copies the live records of a run of sealed segments to a new one.
+type compaction struct {
+	store     *DiskStore
+	inputs    []*segment
+	statePath string
+	// rekey is set for RotateKey, which rewrites the inputs even if that frees
+	// nothing
+	rekey bool
+	state compactionState
+	out   *os.File
+	// records counts the records written, and marks holds the position of every
+	// compactionMarkInterval-th of them
+	records int
+	marks   []uint32
+	// kept lists the live keys copied, along with the positions of their records
+	kept []keptRecord
+	// dict compresses the values copied with the dictionary of the output, with
+	// Options.CompactionDictionary
+	dict *dictCompressor
+	// checkpointed is state.Written as of the last checkpoint
+	checkpointed int64
+}
+
+type keptRecord struct {
+	key      string
+	position uint32
+	size     uint32
+}
+
+// loadState returns the progress recorded by the last compaction, or nil if there
+// is none.
+func (c *compaction) loadState() *compactionState {
+	data, err := os.ReadFile(c.statePath)
+	if err != nil {
+		return nil
+	}
+	var state compactionState
+	if err := json.Unmarshal(data, &state); err != nil {
+		c.store.log.Warn("ignoring unreadable compaction state", "file", c.statePath, "error", err)
+		return nil
+	}
+	return &state
+}
+
+// open opens the output, picking up where the last compaction stopped if it was
+// compacting the same segments.
+func (c *compaction) open(saved *compactionState) error {
+	c.store.mu.Lock()
+	first := c.store.segments[0] == c.inputs[0]
+	c.store.mu.Unlock()
+	fresh := compactionState{Output: c.inputs[len(c.inputs)-1].path + compactOutputSuffix, First: first, Rekey: c.rekey}
+	for _, seg := range c.inputs {
+		fresh.Segments = append(fresh.Segments, seg.id)
+		fresh.Sizes = append(fresh.Sizes, seg.size)
+	}
+	c.state = fresh
+	if saved != nil {
+		if saved.resumes(fresh) {
+			c.state = *saved
+		} else if saved.Output != fresh.Output {
+			os.Remove(saved.Output)
+		}
+	}
+	file, err := openFile(c.state.Output, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	c.out = file
+	if c.state.Written > 0 {
+		err := c.reload()
+		if err == nil {
+			c.store.log.Info("resuming compaction", "file", c.state.Output, "segment", c.state.Segment, "position", c.state.Position)
+			return nil
+		}
+		c.store.log.Warn("restarting compaction", "file", c.state.Output, "error", err)
+		c.state, c.records, c.marks, c.kept, c.dict = fresh, 0, nil, nil, nil
+	}
+	if err := c.out.Truncate(0); err != nil {
+		return err
+	}
+	// the offset is filled in by finish
+	_, marker := c.marker(0)
+	if _, err := c.out.WriteAt(marker, 0); err != nil {
+		return err
+	}
+	c.track(0, marker)
+	c.state.Written = int64(len(marker))
+	if c.store.opts.CompactionDictionary && !c.store.encrypting() {
+		return c.writeDictionary()
+	}
+	return nil
+}
+
+// writeDictionary trains a dictionary on the values of the inputs, and writes it
+// after the marker, unless there are too few values to train it on.
+func (c *compaction) writeDictionary() error {
+	samples, err := c.sample()
+	if err != nil {
+		return err
+	}
+	dict := trainDictionary(samples)
+	if dict == nil {
+		return nil
+	}
+	key, id := dictKey(dict)
+	_, data := encodeRecord(uint32(time.Now().Unix()), 0, key, string(dict))
+	if _, err := c.out.WriteAt(data, c.state.Written); err != nil {
+		return err
+	}
+	if err := c.useDictionary(key, string(dict)); err != nil {
+		return err
+	}
+	c.track(int(c.state.Written), data)
+	c.state.Written += int64(len(data))
+	c.store.log.Info("trained compaction dictionary", "file", c.state.Output, "id", id, "size", len(dict), "samples", len(samples))
+	return nil
+}
+
+// sample returns the values of up to dictionarySampleBytes of the inputs, leaving
+// out the large values.
+func (c *compaction) sample() ([]string, error) {
+	d := c.store
+	var samples []string
+	read := 0
+	errEnough := errors.New("enough samples")
+	for _, seg := range c.inputs {
+		d.mu.Lock()
+		ra, file, err := d.openReaderAt(seg)
+		d.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		r := bufio.NewReader(io.NewSectionReader(ra, 0, seg.size))
+		err = scanRecords(r, seg.size, func(offset int, data []byte) error {
+			_, key, _ := decodeKV(data)
+			_, _, valueSize := decodeHeader(data)
+			if valueSize > 0 && valueSize <= dictionaryMaxValue && !strings.HasPrefix(key, "\x00") && decodeFlags(data)&FlagDedup == 0 && verifyKV(data) {
+				value, err := d.decodeValue(data)
+				if err != nil {
+					return err
+				}
+				samples = append(samples, value)
+			}
+			if read += len(data); read >= dictionarySampleBytes {
+				return errEnough
+			}
+			return nil
+		})
+		if file != nil {
+			file.Close()
+		}
+		if err == errEnough {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return samples, nil
+}
+
+// useDictionary compresses the values copied from now on with the dictionary of
+// the record.
+func (c *compaction) useDictionary(key string, dict string) error {
+	if err := c.store.addDictionary(key, dict); err != nil {
+		return err
+	}
+	_, id := dictKey([]byte(dict))
+	comp, err := newDictCompressor([]byte(dict), id, c.store.opts.CompressionLevel)
+	if err != nil {
+		return err
+	}
+	c.dict = comp
+	return nil
+}
+
+// marker returns the key and the record starting the output, with the offset it
+// lands at in the log.
+func (c *compaction) marker(offset int64) (string, []byte) {
+	key := compactKey
+	if !c.state.First {
+		key = compactRangeKey
+	}
+	_, data := encodeRecord(uint32(time.Now().Unix()), 0, key, fmt.Sprintf("%020d %010d", offset, c.inputs[0].id))
+	return key, data
+}
+
+// parseCompactMarker returns the offset and the id of the first segment compacted
+// from the value of a record of compactKey or compactRangeKey.
+func parseCompactMarker(value string) (int64, uint32, error) {
+	offset, first, _ := strings.Cut(value, " ")
+	n, err := strconv.ParseInt(offset, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	id, err := strconv.ParseUint(first, 10, 32)
+	return n, uint32(id), err
+}
+
+// resumes reports whether a compaction stopped at s can be carried on to compact
+// the segments of fresh.
+func (s compactionState) resumes(fresh compactionState) bool {
+	if s.Output != fresh.Output || s.First != fresh.First || s.Rekey != fresh.Rekey || len(s.Segments) != len(fresh.Segments) || s.Segment > len(s.Segments) {
+		return false
+	}
+	for i := range s.Segments {
+		if s.Segments[i] != fresh.Segments[i] || s.Sizes[i] != fresh.Sizes[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// find returns the index in segments of the segments of s, as they were when s
+// was recorded, or -1 if they are not all there.
+func (s compactionState) find(segments []*segment) int {
+	if len(s.Segments) == 0 || len(s.Sizes) != len(s.Segments) {
+		return -1
+	}
+	i := 0
+	for i < len(segments) && segments[i].id != s.Segments[0] {
+		i++
+	}
+	if i+len(s.Segments) > len(segments) {
+		return -1
+	}
+	for j, seg := range segments[i : i+len(s.Segments)] {
+		if seg.moving || seg.id != s.Segments[j] || seg.size != s.Sizes[j] {
+			return -1
+		}
+	}
+	return i
+}
+
+// reload reads back the records written before the last checkpoint, dropping
+// those written after it.
+func (c *compaction) reload() error {
+	if err := c.out.Truncate(c.state.Written); err != nil {
+		return err
+	}
+	err := scanRecords(io.NewSectionReader(c.out, 0, c.state.Written), c.state.Written, func(offset int, data []byte) error {
+		if !verifyKV(data) {
+			return fmt.Errorf("%w: %s offset %d", ErrCorruptRecord, c.state.Output, offset)
+		}
+		if _, key, value := decodeKV(data); isDictKey(key) {
+			if err := c.useDictionary(key, value); err != nil {
+				return err
+			}
+		}
+		c.track(offset, data)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if c.records == 0 {
+		return fmt.Errorf("%w: %s is empty", ErrCorruptRecord, c.state.Output)
+	}
+	c.checkpointed = c.state.Written
+	return nil
+}
+
+// track notes a record written to the output at position.
+func (c *compaction) track(position int, data []byte) {
+	if c.records%compactionMarkInterval == 0 {
+		c.marks = append(c.marks, uint32(position))
+	}
+	c.records++
+	_, key, value := decodeKV(data)
+	if value != "" && key != compactKey && key != compactRangeKey && !isTokenKey(key) && !isDictKey(key) && !isEpochKey(key) && !isStoreKey(key) && !isFormatKey(key) {
+		c.kept = append(c.kept, keptRecord{key, uint32(position), uint32(len(data))})
+	}
+}
+
+// run copies the live records of the segments left to the output.
+func (c *compaction) run(ctx context.Context) error {
+	for ; c.state.Segment < len(c.inputs); c.state.Segment, c.state.Position = c.state.Segment+1, 0 {
+		if err := ctx.Err(); err != nil {
+			return c.interrupt(err)
+		}
+		if err := c.copySegment(ctx, c.inputs[c.state.Segment]); err != nil {
+			return err
+		}
+	}
+	return c.out.Sync()
+}
+
+// copySegment copies the live records of the segment from state.Position on.
+func (c *compaction) copySegment(ctx context.Context, seg *segment) error {
+	d := c.store
+	d.mu.Lock()
+	ra, file, err := d.openReaderAt(seg)
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if file != nil {
+		defer file.Close()
+	}
+	base := c.state.Position
+	var batch [][]byte
+	batchBytes := 0
+	r := bufio.NewReaderSize(io.NewSectionReader(ra, base, seg.size-base), compactionChunkBytes)
+	err = scanRecords(r, seg.size-base, func(offset int, data []byte) error {
+		if !verifyKV(data) {
+			return fmt.Errorf("%w: %s offset %d", ErrCorruptRecord, seg.path, base+int64(offset))
+		}
+		batch = append(batch, data)
+		batchBytes += len(data)
+		if batchBytes < compactionChunkBytes {
+			return nil
+		}
+		if err := c.copyRecords(seg, batch); err != nil {
+			return err
+		}
+		batch, batchBytes = batch[:0], 0
+		return ctx.Err()
+	})
+	if err != nil && ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+		return c.interrupt(err)
+	}
+	if errors.Is(err, errPartialRecord) {
+		return fmt.Errorf("%w: %s is shorter than it was when sealed", ErrCorruptRecord, seg.path)
+	}
+	if err != nil {
+		return err
+	}
+	return c.copyRecords(seg, batch)
+}
+
+// copyRecords writes the records of the batch which are still needed to the
+// output, and moves state.Position past them.
+func (c *compaction) copyRecords(seg *segment, batch [][]byte) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	d := c.store
+	now := time.Now()
+	var live [][]byte
+	position := c.state.Position
+	d.mu.Lock()
+	for _, data := range batch {
+		if c.live(seg, position, data, now) {
+			live = append(live, data)
+		} else if decodeFlags(data)&FlagDedup != 0 {
+			if c.state.Dropped == nil {
+				c.state.Dropped = make(map[string]int)
+			}
+			_, _, id := decodeKV(data)
+			c.state.Dropped[id]++
+		}
+		position += int64(len(data))
+	}
+	d.mu.Unlock()
+	var out []byte
+	for _, data := range live {
+		data, err := c.recompress(data)
+		if err != nil {
+			return err
+		}
+		c.track(int(c.state.Written)+len(out), data)
+		out = append(out, data...)
+	}
+	if _, err := c.out.WriteAt(out, c.state.Written); err != nil {
+		return err
+	}
+	c.state.Written += int64(len(out))
+	c.state.Position = position
+	if c.state.Written-c.checkpointed >= compactionCheckpointBytes {
+		return c.checkpoint()
+	}
+	return nil
+}
+
+// recompress returns the record compressed with the dictionary of the output, if
+// that makes it smaller. A record compressed with the dictionary of an input is
+// decompressed otherwise, as that dictionary is not copied. For RotateKey, the
+// value is encrypted again under the current key.
+func (c *compaction) recompress(data []byte) ([]byte, error) {
+	d := c.store
+	timestamp, key, _ := decodeKV(data)
+	_, _, valueSize := decodeHeader(data)
+	rekey := c.state.Rekey && !d.encryptedWithCurrent(data)
+	if valueSize == 0 || isTokenKey(key) || decodeFlags(data)&FlagDedup != 0 || (c.dict == nil && !usesDictionary(data) && !rekey) {
+		return data, nil
+	}
+	value, err := d.decodeValue(data)
+	if err != nil {
+		return nil, fmt.Errorf("key %q: %w", key, err)
+	}
+	flags := decodeFlags(data) &^ (FlagCompressed | FlagEncrypted)
+	if c.dict != nil {
+		compressed, err := c.dict.compress(value)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed) < int(valueSize) {
+			compressed, flags, err := d.encrypt(compressed, flags|FlagCompressed)
+			if err != nil {
+				return nil, err
+			}
+			_, data := encodeRecordFlags(timestamp, decodeExpiry(data), key, metaBlock(data)+compressed, flags)
+			return data, nil
+		}
+		if !usesDictionary(data) && !rekey {
+			return data, nil
+		}
+	}
+	value, flags, err = d.encodeValue(value, flags)
+	if err != nil {
+		return nil, err
+	}
+	_, data = encodeRecordFlags(timestamp, decodeExpiry(data), key, metaBlock(data)+value, flags)
+	return data, nil
+}
+
+// live reports whether the record at position in the segment goes into the
+// compacted one. The store must be locked.
+func (c *compaction) live(seg *segment, position int64, data []byte, now time.Time) bool {
+	timestamp, key, value := decodeKV(data)
+	kEntry, ok := c.store.keyDir.get(key)
+	switch {
+	case key == truncateKey || key == compactKey || key == compactRangeKey:
+		// the record starting the compacted segment takes their place
+		return false
+	case isDictKey(key):
+		// the values compressed with it are decompressed when copied
+		return false
+	case isBlobKey(key):
+		// as long as records reference it, and it is the copy they read
+		b, ok := c.store.blobs[strings.TrimPrefix(key, blobKeyPrefix)]
+		return ok && b.at.segment == seg.id && int64(b.at.position) == position
+	case isTokenKey(key):
+		return now.Unix() < int64(decodeExpiry(data))
+	case isEpochKey(key):
+		// the store took it over when it was opened
+		return false
+	case isFormatKey(key):
+		// the compacted segment is written in the current version
+		return false
+	case isStoreKey(key):
+		// the identity of the store, which loading checks the segment against
+		return true
+	case value == "":
+		// only worth keeping while the key stays deleted, and as long as an older
+		// segment may hold a value for it, or readers may not have seen it
+		return !ok && (!c.state.First || now.Sub(time.Unix(int64(timestamp), 0)) < c.store.opts.TombstoneRetention)
+	case !c.state.First && kEntry.expired(now):
+		// likewise, the value of an expired key hides those in older segments
+		return !ok || kEntry.segment == seg.id && int64(kEntry.position) == position
+	}
+	return ok && kEntry.segment == seg.id && int64(kEntry.position) == position && !kEntry.expired(now)
+}
+
+// checkpoint syncs the output and records the progress made.
+func (c *compaction) checkpoint() error {
+	if err := c.out.Sync(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(c.state)
+	if err != nil {
+		return err
+	}
+	if err := writeFileSync(c.statePath, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	c.checkpointed = c.state.Written
+	return nil
+}
+
+// interrupt records the progress made before returning err, the error of the
+// context which stopped the compaction.
+func (c *compaction) interrupt(err error) error {
+	if cerr := c.checkpoint(); cerr != nil {
+		c.store.log.Error("failed to record compaction progress", "file", c.statePath, "error", cerr)
+	}
+	return err
+}
+
+// finish puts the compacted segment in place of the segments it was compacted
+// from, and returns the number of bytes freed.
+func (c *compaction) finish() (int64, error) {
+	d := c.store
+	first, last := c.inputs[0], c.inputs[len(c.inputs)-1]
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	i := 0
+	for i < len(d.segments)-1 && d.segments[i] != first {
+		i++
+	}
+	if c.state.First != (i == 0) || i+len(c.inputs) > len(d.segments)-1 {
+		// DeleteAll dropped them meanwhile
+		c.discard()
+		return 0, nil
+	}
+	// the compacted records end where the segments they replace did, so that their
+	// offsets are never less than they were
+	start := d.logBase
+	for _, seg := range d.segments[:i] {
+		start += seg.skipped + seg.size
+	}
+	end, size := start, int64(0)
+	for j, seg := range c.inputs {
+		if seg.removed || d.segments[i+j] != seg {
+			c.discard()
+			return 0, nil
+		}
+		end += seg.skipped + seg.size
+		size += seg.size
+	}
+	if c.state.Written >= size && !c.state.Rekey {
+		// nothing to gain
+		c.discard()
+		return 0, nil
+	}
+	offset := end - c.state.Written
+	_, marker := c.marker(offset)
+	if _, err := c.out.WriteAt(marker, 0); err != nil {
+		return 0, err
+	}
+	if err := c.out.Sync(); err != nil {
+		return 0, err
+	}
+	if err := c.out.Close(); err != nil {
+		return 0, err
+	}
+	c.out = nil
+	for _, seg := range c.inputs {
+		if seg.file != nil {
+			seg.file.Close()
+			seg.file = nil
+		}
+	}
+	if err := renameFile(c.state.Output, last.path); err != nil {
+		// the output stays, and the next Compact picks it up
+		return 0, err
+	}
+	if last.remote {
+		// the object in cold storage is replaced by the next Offload
+		if err := os.Remove(last.path + remoteIndexSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			d.log.Error("failed to delete segment", "file", last.path+remoteIndexSuffix, "error", err)
+		}
+	}
+	compacted := &segment{id: last.id, path: last.path, size: c.state.Written, compacted: true, marks: c.marks}
+	for _, seg := range c.inputs {
+		if seg.latest.After(compacted.latest) {
+			compacted.latest = seg.latest
+		}
+	}
+	if c.state.First {
+		d.logBase = offset
+	} else {
+		compacted.skipped = offset - start
+	}
+	segments := append([]*segment(nil), d.segments[:i]...)
+	segments = append(segments, compacted)
+	d.segments = append(segments, d.segments[i+len(c.inputs):]...)
+	for _, rec := range c.kept {
+		if isBlobKey(rec.key) {
+			if b, ok := d.blobs[strings.TrimPrefix(rec.key, blobKeyPrefix)]; ok && b.at.segment >= first.id && b.at.segment <= last.id {
+				b.at.segment, b.at.position, b.at.totalSize = last.id, rec.position, rec.size
+			}
+			continue
+		}
+		// a key written since points past the segments compacted
+		if kEntry, ok := d.keyDir.get(rec.key); ok && kEntry.segment >= first.id && kEntry.segment <= last.id {
+			// the record may have been compressed along the way
+			d.liveBytes += int64(rec.size) - int64(kEntry.totalSize)
+			d.quotas.add(rec.key, 0, int64(rec.size)-int64(kEntry.totalSize))
+			kEntry.segment, kEntry.position, kEntry.totalSize = last.id, rec.position, rec.size
+			d.keyDir.set(rec.key, kEntry)
+		}
+	}
+	for id, n := range c.state.Dropped {
+		if b, ok := d.blobs[id]; ok {
+			if b.refs -= n; b.refs <= 0 {
+				// the next compaction of its segment drops it
+				delete(d.blobs, id)
+			}
+		}
+	}
+	d.coldCache.clear()
+	d.removeSegments(c.inputs[:len(c.inputs)-1])
+	if err := os.Remove(c.statePath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		d.log.Error("failed to delete compaction state", "file", c.statePath, "error", err)
+	}
+	return size - c.state.Written, nil
+}
+
+// dropMerged deletes the segments compacted from after the oldest segment which
+// were left behind if we stopped before deleting them, and picks up the bytes of
+// the log each compaction freed.
+func (d *DiskStore) dropMerged() error {
+	for _, at := range d.mergedAt {
+		i := 0
+		for d.segments[i].id != at.segment {
+			i++
+		}
+		if at.position != 0 || i == len(d.segments)-1 {
+			// not where Compact wrote it, e.g. in a log restored from shipped
+			// copies, so it tells nothing about the segments
+			continue
+		}
+		data, err := d.readRecord(d.segments[i], at)
+		if err != nil {
+			return err
+		}
+		_, _, value := decodeKV(data)
+		offset, first, err := parseCompactMarker(value)
+		if err != nil {
+			return fmt.Errorf("%w: invalid compaction record in %s", ErrCorruptRecord, d.segments[i].path)
+		}
+		j := i
+		for j > 0 && d.segments[j-1].id >= first {
+			j--
+		}
+		if j < i {
+			d.removeSegments(d.segments[j:i])
+			d.segments = append(d.segments[:j], d.segments[i:]...)
+			i = j
+		}
+		start := d.logBase
+		for _, seg := range d.segments[:i] {
+			start += seg.skipped + seg.size
+		}
+		if skipped := offset - int64(at.position) - start; skipped > 0 {
+			d.segments[i].skipped = skipped
+		}
+	}
+	d.mergedAt = nil
+	return nil
+}
+
+// discard deletes the output and the progress made.
+func (c *compaction) discard() {
+	c.close()
+	for _, name := range []string{c.state.Output, c.statePath} {
+		if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			c.store.log.Error("failed to delete compaction file", "file", name, "error", err)
+		}
+	}
+}
+
+func (c *compaction) close() {
+	if c.out != nil {
+		c.out.Close()
+		c.out = nil
+	}
+}
+
+// alignOffset moves an offset within a segment written by Compact back to the
+// start of a record at or before it, and one within the bytes freed before such
+// a segment to its start. The offsets handed out before the compaction point into
+// the records as they were laid out then; every record kept was moved to an offset
+// at least as large, so reading from a record before the offset misses none of the
+// changes after it. The store must be locked.
+func (d *DiskStore) alignOffset(offset int64) (int64, error) {
+	start := d.logBase
+	for _, seg := range d.segments[:len(d.segments)-1] {
+		start += seg.skipped
+		if offset >= start+seg.size {
+			start += seg.size
+			continue
+		}
+		if offset <= start {
+			// the bytes the compaction freed were before the segment
+			return start, nil
+		}
+		if !seg.compacted {
+			return offset, nil
+		}
+		target := offset - start
+		// the first mark is the first record
+		i := sort.Search(len(seg.marks), func(i int) bool { return int64(seg.marks[i]) > target }) - 1
+		position := int64(seg.marks[i])
+		ra, file, err := d.openReaderAt(seg)
+		if err != nil {
+			return offset, err
+		}
+		if file != nil {
+			defer file.Close()
+		}
+		header := make([]byte, headerSize)
+		for {
+			if _, err := ra.ReadAt(header, position); err != nil {
+				return offset, err
+			}
+			_, keySize, valueSize := decodeHeader(header)
+			next := position + int64(headerSize+keySize+valueSize)
+			if next > target {
+				return start + position, nil
+			}
+			position = next
+		}
+	}
+	return offset, nil
+}
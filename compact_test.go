@@ -0,0 +1,296 @@
+package caskdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// replay applies the changes to the keys, like a reader of the change feed would.
+func replay(keys map[string]string, changes []Change) {
+	for _, change := range changes {
+		switch {
+		case change.Truncate:
+			for key := range keys {
+				delete(keys, key)
+			}
+		case change.Deleted:
+			delete(keys, change.Key)
+		default:
+			keys[change.Key] = change.Value
+		}
+	}
+}
+
+func TestDiskStore_Compact(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{MaxSegmentBytes: 130}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		for _, key := range []string{"othello", "hamlet", "dune"} {
+			store.Set(key, fmt.Sprintf("edition %d", i))
+		}
+		if i == 10 {
+			store.Delete("dune")
+		}
+	}
+	changes, _, err := store.ReadChanges(0, 30)
+	if err != nil {
+		t.Fatalf("ReadChanges() error = %v", err)
+	}
+	// a reader which stopped halfway
+	seen := make(map[string]string)
+	replay(seen, changes)
+	offset := changes[len(changes)-1].Offset + 1
+	before := store.Stats().Bytes
+	sealed, err := findSegments(fileName, "")
+	if err != nil {
+		t.Fatalf("findSegments() error = %v", err)
+	}
+
+	freed, err := store.Compact(context.Background())
+	if err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if freed <= 0 || store.Stats().Bytes != before-freed {
+		t.Errorf("Compact() freed %d bytes, Stats().Bytes went from %d to %d", freed, before, store.Stats().Bytes)
+	}
+	for _, key := range []string{"othello", "hamlet", "dune"} {
+		if value := store.Get(key); value != "edition 19" {
+			t.Errorf("Get(%q) after Compact() = %q, want edition 19", key, value)
+		}
+	}
+	// the reader carries on from within the compacted records
+	changes, _, err = store.ReadChanges(offset, 1000)
+	if err != nil {
+		t.Fatalf("ReadChanges() after Compact() error = %v", err)
+	}
+	replay(seen, changes)
+	if len(seen) != 3 || seen["dune"] != "edition 19" {
+		t.Errorf("replaying the changes across Compact() = %v, want every key at edition 19", seen)
+	}
+	store.Set("emma", "austen")
+	store.Close()
+	segments, err := findSegments(fileName, "")
+	if err != nil {
+		t.Fatalf("findSegments() error = %v", err)
+	}
+	if len(segments) >= len(sealed) {
+		t.Errorf("Compact() left %d sealed segments out of %d, want fewer", len(segments), len(sealed))
+	}
+
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	if keys := store.Keys(); len(keys) != 4 || store.Get("dune") != "edition 19" {
+		t.Errorf("Keys() after reopening = %v, want the 4 keys", keys)
+	}
+	if store.Stats().Bytes != before-freed+int64(len("emma")+len("austen")+headerSize) {
+		t.Errorf("Stats().Bytes after reopening = %d, want the size after Compact() and one more record", store.Stats().Bytes)
+	}
+	seen = make(map[string]string)
+	changes, _, err = store.ReadChanges(0, 1000)
+	if err != nil {
+		t.Fatalf("ReadChanges() after reopening error = %v", err)
+	}
+	replay(seen, changes)
+	if len(seen) != 4 {
+		t.Errorf("replaying the changes from 0 = %v, want the 4 keys", seen)
+	}
+}
+
+// countdownContext is done after its Err was called n times.
+type countdownContext struct {
+	context.Context
+	n int
+}
+
+func (ctx *countdownContext) Err() error {
+	if ctx.n--; ctx.n < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestDiskStore_CompactResume(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{MaxSegmentBytes: 100})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	// three sealed segments of dead records
+	for i := 0; i < 12; i++ {
+		store.Set("key", fmt.Sprintf("value-%d", i%10))
+	}
+
+	ctx := &countdownContext{Context: context.Background(), n: 2}
+	if _, err := store.Compact(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Compact() with a cancelled context error = %v, want context.Canceled", err)
+	}
+	data, err := os.ReadFile(fileName + compactStateSuffix)
+	if err != nil {
+		t.Fatalf("Compact() did not record its progress: %v", err)
+	}
+	var state compactionState
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatalf("invalid compaction state: %v", err)
+	}
+	if state.Segment != 2 || state.Written == 0 {
+		t.Errorf("compaction state = %+v, want it stopped at the third segment", state)
+	}
+	// writes carry on meanwhile
+	store.Set("emma", "austen")
+
+	freed, err := store.Compact(context.Background())
+	if err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if freed < 3*90-compactMarkerSize {
+		t.Errorf("Compact() freed %d bytes, want the three segments but for the compaction record", freed)
+	}
+	if value := store.Get("key"); value != "value-1" {
+		t.Errorf("Get(key) after resuming Compact() = %q, want value-1", value)
+	}
+	if value := store.Get("emma"); value != "austen" {
+		t.Errorf("Get(emma) after resuming Compact() = %q, want austen", value)
+	}
+	for _, name := range []string{fileName + compactStateSuffix, state.Output} {
+		if _, err := os.Stat(name); err == nil {
+			t.Errorf("Compact() left %s behind", name)
+		}
+	}
+}
+
+func TestDiskStore_OnCompaction(t *testing.T) {
+	var freed []int64
+	var errs []error
+	opts := Options{MaxSegmentBytes: 100, OnCompaction: func(n int64, err error) {
+		freed, errs = append(freed, n), append(errs, err)
+	}}
+	store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	for i := 0; i < 12; i++ {
+		store.Set("key", fmt.Sprintf("value-%d", i%10))
+	}
+
+	n, err := store.Compact(context.Background())
+	if err != nil || n <= 0 {
+		t.Fatalf("Compact() = %v, %v, want bytes freed", n, err)
+	}
+	if len(freed) != 1 || freed[0] != n || errs[0] != nil {
+		t.Errorf("OnCompaction called with %v, %v, want %v, nil", freed, errs, n)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	store.Set("key", "value")
+	if _, err := store.Compact(ctx); len(errs) != 2 || errs[1] != err {
+		t.Errorf("OnCompaction called with %v, want the error of Compact() %v", errs, err)
+	}
+}
+
+func TestDiskStore_PickCompaction(t *testing.T) {
+	store := &DiskStore{keyDir: mapKeyDir{}, opts: Options{MaxSegmentBytes: 1000}}
+	// live bytes of the sealed segments, sized 1000 but for the small fourth one
+	live := []int{900, 0, 400, 100, 800}
+	for i, n := range live {
+		seg := &segment{id: uint32(i + 1), size: 1000}
+		if i == 3 {
+			seg.size = 100
+		}
+		store.segments = append(store.segments, seg)
+		if n > 0 {
+			kEntry := NewKeyEntry(0, 0, uint32(n))
+			kEntry.segment = seg.id
+			store.keyDir.set(fmt.Sprintf("key-%d", i), kEntry)
+		}
+	}
+	store.segments = append(store.segments, &segment{id: 6})
+	ids := func(segments []*segment) []uint32 {
+		var ids []uint32
+		for _, seg := range segments {
+			ids = append(ids, seg.id)
+		}
+		return ids
+	}
+
+	// the emptiest first, along with the mostly dead and the small next to it
+	tried := make(map[uint32]bool)
+	if got := ids(store.pickCompaction(nil, tried)); fmt.Sprint(got) != "[2 3 4]" {
+		t.Errorf("pickCompaction() = %v, want [2 3 4]", got)
+	}
+	tried[2] = true
+	if got := ids(store.pickCompaction(nil, tried)); fmt.Sprint(got) != "[3 4]" {
+		t.Errorf("pickCompaction() without 2 = %v, want [3 4]", got)
+	}
+	tried[3] = true
+	if got := store.pickCompaction(nil, tried); got != nil {
+		t.Errorf("pickCompaction() without 2 and 3 = %v, want none", ids(got))
+	}
+	// a compaction which was interrupted goes first
+	saved := &compactionState{Segments: []uint32{4, 5}, Sizes: []int64{100, 1000}}
+	if got := ids(store.pickCompaction(saved, tried)); fmt.Sprint(got) != "[4 5]" {
+		t.Errorf("pickCompaction() with a saved compaction = %v, want [4 5]", got)
+	}
+}
+
+func TestDiskStore_CompactRange(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{MaxSegmentBytes: 100}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	// the oldest segment is mostly live, and is left alone
+	store.Set("emma", "jane austen, pride and prejudice")
+	store.Set("othello", "shakespeare")
+	store.Delete("othello")
+	for i := 0; i < 15; i++ {
+		store.Set("dune", fmt.Sprintf("edition %d", i))
+	}
+	if _, err := store.Compact(context.Background()); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if first := store.segments[0]; first.id != 1 || first.compacted {
+		t.Errorf("Compact() rewrote the oldest segment, which is live")
+	}
+	_, end, err := store.ReadChanges(0, 1000)
+	if err != nil {
+		t.Fatalf("ReadChanges() error = %v", err)
+	}
+	store.Close()
+
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	// the tombstone was kept, as the oldest segment still holds the value
+	if _, err := store.Lookup("othello"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Lookup(othello) after Compact() error = %v, want ErrKeyNotFound", err)
+	}
+	if store.Get("emma") == "" || store.Get("dune") != "edition 14" {
+		t.Errorf("Get() after Compact() = %q, %q, want emma and edition 14", store.Get("emma"), store.Get("dune"))
+	}
+	changes, again, err := store.ReadChanges(0, 1000)
+	if err != nil || again != end {
+		t.Errorf("ReadChanges() after reopening ends at %d, %v, want %d", again, err, end)
+	}
+	seen := make(map[string]string)
+	replay(seen, changes)
+	if len(seen) != 2 || seen["dune"] != "edition 14" {
+		t.Errorf("replaying the changes after Compact() = %v, want emma and dune", seen)
+	}
+}
@@ -0,0 +1,169 @@
+package caskdb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Compression is a codec compressing the values of the records. The value of a
+// record flagged FlagCompressed starts with a byte naming its Compression, followed
+// by the compressed bytes, so the records written with different codecs, or none,
+// live side by side in a store, and a new codec only needs a number of its own.
+type Compression uint8
+
+const (
+	// CompressionNone stores the values as they are
+	CompressionNone Compression = iota
+	// CompressionGzip compresses the values with compress/gzip
+	CompressionGzip
+	// CompressionSnappy and CompressionZstd are reserved for Snappy and Zstandard,
+	// which the standard library lacks: register an implementation of them with
+	// RegisterCompression, e.g. one from github.com/klauspost/compress, before
+	// using them or opening a store holding records written with them.
+	CompressionSnappy
+	CompressionZstd
+)
+
+// Compressor implements a Compression.
+type Compressor struct {
+	// Name is what String returns for the Compression, e.g. "gzip"
+	Name string
+	// Compress compresses a value at a level of the codec, 0 being its default
+	Compress func(value []byte, level int) ([]byte, error)
+	// Decompress returns the value back from what Compress returned
+	Decompress func(data []byte) ([]byte, error)
+}
+
+// compressors are the codecs registered with RegisterCompression, gzip from the
+// start
+var compressors = struct {
+	sync.RWMutex
+	byID map[Compression]Compressor
+}{byID: map[Compression]Compressor{CompressionGzip: {"gzip", gzipCompress, gzipDecompress}}}
+
+// RegisterCompression makes the compressor implement c, for Options.Compression
+// and to read the records compressed with it. Registering c again replaces its
+// compressor, which must read the records written by the previous one.
+func RegisterCompression(c Compression, compressor Compressor) {
+	compressors.Lock()
+	defer compressors.Unlock()
+	compressors.byID[c] = compressor
+}
+
+// compressor returns the compressor registered for c.
+func compressor(c Compression) (Compressor, bool) {
+	compressors.RLock()
+	defer compressors.RUnlock()
+	comp, ok := compressors.byID[c]
+	return comp, ok
+}
+
+// String returns the name of the compression, e.g. "gzip".
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case compressionDictionary:
+		return "dictionary"
+	}
+	if comp, ok := compressor(c); ok {
+		return comp.Name
+	}
+	switch c {
+	case CompressionSnappy:
+		return "snappy"
+	case CompressionZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("compression(%d)", uint8(c))
+}
+
+// compress compresses the value of a record with Options.Compression, and adds
+// FlagCompressed to its flags. The value is left as it is when the compression
+// would not make it smaller.
+func (d *DiskStore) compress(value string, flags RecordFlags) (string, RecordFlags, error) {
+	if d.opts.Compression == CompressionNone || value == "" {
+		return value, flags, nil
+	}
+	comp, ok := compressor(d.opts.Compression)
+	if !ok {
+		return "", 0, fmt.Errorf("%w: %v is not registered", ErrUnsupportedRecord, d.opts.Compression)
+	}
+	data, err := comp.Compress([]byte(value), d.opts.CompressionLevel)
+	if err != nil {
+		return "", 0, err
+	}
+	if 1+len(data) >= len(value) {
+		return value, flags, nil
+	}
+	return string(append([]byte{byte(d.opts.Compression)}, data...)), flags | FlagCompressed, nil
+}
+
+// decodeValue returns the value of the record, decrypted if it is flagged
+// FlagEncrypted, and decompressed if it is flagged FlagCompressed. It fails with
+// ErrUnsupportedRecord for a compression which is not registered, or a key which
+// is not known.
+func (d *DiskStore) decodeValue(data []byte) (string, error) {
+	value, err := storedValue(data)
+	if err != nil {
+		return "", err
+	}
+	if decodeFlags(data)&FlagEncrypted != 0 {
+		if value, err = d.decrypt(value); err != nil {
+			return "", err
+		}
+	}
+	if decodeFlags(data)&FlagCompressed == 0 {
+		return value, nil
+	}
+	if value == "" {
+		return "", fmt.Errorf("%w: compressed record without a compression", ErrCorruptRecord)
+	}
+	c := Compression(value[0])
+	if c == compressionDictionary {
+		decompressed, err := d.decompressDict([]byte(value[1:]))
+		if err != nil {
+			return "", fmt.Errorf("%w: %v: %v", ErrCorruptRecord, c, err)
+		}
+		return string(decompressed), nil
+	}
+	comp, ok := compressor(c)
+	if !ok {
+		return "", fmt.Errorf("%w: %v is not registered", ErrUnsupportedRecord, c)
+	}
+	decompressed, err := comp.Decompress([]byte(value[1:]))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v: %v", ErrCorruptRecord, c, err)
+	}
+	return string(decompressed), nil
+}
+
+func gzipCompress(value []byte, level int) ([]byte, error) {
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(value); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gzipDecompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
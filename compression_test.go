@@ -0,0 +1,93 @@
+package caskdb
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDiskStore_Compression(t *testing.T) {
+	defer os.Remove("test.db")
+	long := strings.Repeat("to be or not to be, ", 100)
+	store, err := NewDiskStoreWithOptions("test.db", Options{Compression: CompressionGzip})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("hamlet", long)
+	// too short to shrink, it is stored as is
+	store.Set("othello", "shakespeare")
+	if got := store.Get("hamlet"); got != long {
+		t.Errorf("Get() = %d bytes, want %d", len(got), len(long))
+	}
+	if size := store.Stats().Bytes; size >= int64(len(long)) {
+		t.Errorf("Stats().Bytes = %v, want less than the value of %v", size, len(long))
+	}
+	store.Close()
+
+	// opened without compression, the compressed records still read, and the new
+	// ones are not compressed
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("macbeth", long)
+	for _, key := range []string{"hamlet", "macbeth"} {
+		if got := store.Get(key); got != long {
+			t.Errorf("Get(%q) = %d bytes, want %d", key, len(got), len(long))
+		}
+	}
+	changes, _, err := store.ReadChanges(0, 10)
+	if err != nil {
+		t.Fatalf("ReadChanges() error = %v", err)
+	}
+	wantFlags := []RecordFlags{FlagCompressed, 0, 0}
+	for i, change := range changes {
+		if change.Flags != wantFlags[i] {
+			t.Errorf("ReadChanges()[%d].Flags = %v, want %v", i, change.Flags, wantFlags[i])
+		}
+	}
+	if len(changes) != 3 || changes[0].Value != long {
+		t.Errorf("ReadChanges() = %d changes, want 3 with the values decompressed", len(changes))
+	}
+}
+
+func TestDiskStore_CompressionRegistry(t *testing.T) {
+	defer os.Remove("test.db")
+	// a codec of the test only, which drops the repeats of the first byte
+	custom := Compression(200)
+	if _, err := NewDiskStoreWithOptions("test.db", Options{Compression: custom}); err == nil {
+		t.Fatalf("NewDiskStoreWithOptions() with an unregistered compression error = nil, want an error")
+	}
+	RegisterCompression(custom, Compressor{
+		Name: "runs",
+		Compress: func(value []byte, level int) ([]byte, error) {
+			return append([]byte{value[0], byte(len(value))}, bytes.TrimLeft(value, string(value[:1]))...), nil
+		},
+		Decompress: func(data []byte) ([]byte, error) {
+			return append(bytes.Repeat(data[:1], int(data[1])-len(data)+2), data[2:]...), nil
+		},
+	})
+	store, err := NewDiskStoreWithOptions("test.db", Options{Compression: custom})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("scream", "aaaaaaaaaaaaaaaaaaaah")
+	if got := store.Get("scream"); got != "aaaaaaaaaaaaaaaaaaaah" {
+		t.Errorf("Get() = %v, want %v", got, "aaaaaaaaaaaaaaaaaaaah")
+	}
+	if custom.String() != "runs" || CompressionGzip.String() != "gzip" || CompressionZstd.String() != "zstd" {
+		t.Errorf("String() = %v, %v, %v, want runs, gzip, zstd", custom, CompressionGzip, CompressionZstd)
+	}
+	store.Close()
+
+	// a store holding records of a codec which is not registered does not open
+	compressors.Lock()
+	delete(compressors.byID, custom)
+	compressors.Unlock()
+	if _, err := NewDiskStore("test.db"); !errors.Is(err, ErrUnsupportedRecord) {
+		t.Errorf("NewDiskStore() error = %v, want %v", err, ErrUnsupportedRecord)
+	}
+}
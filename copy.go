@@ -0,0 +1,201 @@
+package caskdb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// CopyTo writes a copy of the store to a new data file at path, with only the live
+// records: the older versions of the keys, the deleted and the expired ones are
+// left out, so the copy is compacted. The records keep their timestamps and
+// expiries. It is meant for cloning a database, e.g. from production to a staging
+// environment; open the copy with NewDiskStore.
+//
+// The store is only locked while the keys are listed, not while the records are
+// copied, so it can be used meanwhile; the copy has the keys as they were when
+// CopyTo was called. The file is written under a temporary name and renamed once
+// complete, and CopyTo fails rather than overwrite an existing file.
+func (d *DiskStore) CopyTo(path string) error {
+	_, err := d.copyLive([]string{path}, func(key string) (int, string, bool) { return 0, key, true })
+	return err
+}
+
+// copyLive copies the live records to new data files at paths, and returns the
+// number of keys copied to each. route returns the index in paths of the file to
+// copy a key to, along with the key to write it as, or false to leave the key out.
+func (d *DiskStore) copyLive(paths []string, route func(key string) (int, string, bool)) ([]int, error) {
+	for _, path := range paths {
+		if isFileExists(path) {
+			return nil, fmt.Errorf("caskdb: %s exists already", path)
+		}
+	}
+	timestamp := uint32(time.Now().Unix())
+	_, identity := encodeRecord(timestamp, 0, storeKeyPrefix+d.ID(), "1")
+	head := append(identity, encodeEpoch(d.Epoch(), timestamp)...)
+	live, readers, closeReaders, err := d.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer closeReaders()
+
+	// in the order of the log, so that the source is read sequentially
+	sort.Slice(live, func(i, j int) bool {
+		a, b := live[i].kEntry, live[j].kEntry
+		if a.segment != b.segment {
+			return a.segment < b.segment
+		}
+		return a.position < b.position
+	})
+	outputs := make([]*bufio.Writer, len(paths))
+	tmps := make([]*os.File, len(paths))
+	for i, path := range paths {
+		tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		tmps[i], outputs[i] = tmp, bufio.NewWriter(tmp)
+		// the store opened from the copy is this one, carrying on from its epoch
+		if _, err := outputs[i].Write(head); err != nil {
+			return nil, err
+		}
+	}
+	counts := make([]int, len(paths))
+	for _, l := range live {
+		i, key, ok := route(l.key)
+		if !ok {
+			continue
+		}
+		data, err := readLive(readers, l.key, l.kEntry)
+		if err != nil {
+			return nil, err
+		}
+		if key != l.key || usesDictionary(data) || l.kEntry.blob != nil {
+			// the copy has none of the dictionaries and blobs of the log, so their
+			// values are written again, compressed and encrypted the way new ones are
+			timestamp, _, value := decodeKV(data)
+			flags := decodeFlags(data)
+			if usesDictionary(data) || l.kEntry.blob != nil {
+				if value, err = l.value(d, readers, data); err != nil {
+					return nil, err
+				}
+				if value, flags, err = d.encodeValue(value, flags&^(FlagCompressed|FlagEncrypted|FlagDedup)); err != nil {
+					return nil, err
+				}
+				value = metaBlock(data) + value
+			}
+			_, data = encodeRecordFlags(timestamp, decodeExpiry(data), key, value, flags)
+		}
+		if _, err := outputs[i].Write(data); err != nil {
+			return nil, err
+		}
+		counts[i]++
+	}
+	for i, tmp := range tmps {
+		if err := outputs[i].Flush(); err != nil {
+			return nil, err
+		}
+		if err := tmp.Sync(); err != nil {
+			return nil, err
+		}
+		if err := tmp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	for i, tmp := range tmps {
+		if err := renameFile(tmp.Name(), paths[i]); err != nil {
+			return nil, err
+		}
+	}
+	return counts, nil
+}
+
+// liveRecord is a live key of a snapshot along with where its record is, and
+// where the blob holding its value is if the record references one.
+type liveRecord struct {
+	key    string
+	kEntry KeyEntry
+	blob   KeyEntry
+}
+
+// readLive reads the record at kEntry from the readers of a snapshot, and verifies
+// it.
+func readLive(readers map[uint32]io.ReaderAt, key string, kEntry KeyEntry) ([]byte, error) {
+	data := make([]byte, kEntry.totalSize)
+	if _, err := readers[kEntry.segment].ReadAt(data, int64(kEntry.position)); err != nil {
+		return nil, err
+	}
+	// do not spread a rotten record
+	if !verifyKV(data) {
+		return nil, fmt.Errorf("%w: key %q at offset %d", ErrCorruptRecord, key, kEntry.position)
+	}
+	return data, nil
+}
+
+// value returns the value of the live record, read from the readers of a
+// snapshot, given the record itself.
+func (l liveRecord) value(d *DiskStore, readers map[uint32]io.ReaderAt, data []byte) (string, error) {
+	if l.kEntry.blob != nil {
+		var err error
+		if data, err = readLive(readers, l.key, l.blob); err != nil {
+			return "", err
+		}
+	}
+	value, err := d.decodeValue(data)
+	if err != nil {
+		return "", fmt.Errorf("key %q: %w", l.key, err)
+	}
+	return value, nil
+}
+
+// snapshot lists the live keys of the store, in order, and opens a reader over
+// every segment, so that their records can be read after unlocking the store: the
+// segments are only appended to, and removed segments stay readable until closed.
+// Call closeReaders once done.
+func (d *DiskStore) snapshot() (live []liveRecord, readers map[uint32]io.ReaderAt, closeReaders func(), err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	live = make([]liveRecord, 0, d.keyDir.size())
+	d.keys.ascend("", func(key string) bool {
+		if kEntry := d.keyEntry(key); !kEntry.expired(now) {
+			l := liveRecord{key: key, kEntry: kEntry}
+			if kEntry.blob != nil {
+				l.blob = kEntry.blob.at
+			}
+			live = append(live, l)
+		}
+		return true
+	})
+	readers = make(map[uint32]io.ReaderAt, len(d.segments))
+	var files []*os.File
+	closeFiles := func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}
+	for _, seg := range d.segments {
+		r, file, err := d.openReaderAt(seg)
+		if err != nil {
+			closeFiles()
+			return nil, nil, nil, err
+		}
+		if file != nil {
+			files = append(files, file)
+		}
+		readers[seg.id] = r
+	}
+	// the files of the segments dropped meanwhile are kept until we are done
+	id := d.pin(d.segments)
+	closeReaders = func() {
+		closeFiles()
+		d.unpin(id)
+	}
+	return live, readers, closeReaders, nil
+}
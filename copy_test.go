@@ -0,0 +1,56 @@
+package caskdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_CopyTo(t *testing.T) {
+	dir := t.TempDir()
+	recordSize, _ := encodeKV(0, "othello", "shakespeare")
+	store, err := NewDiskStoreWithOptions(filepath.Join(dir, "test.db"), Options{MaxSegmentBytes: int64(2 * recordSize)})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("othello", "verdi")
+	store.Set("othello", "shakespeare")
+	store.Set("hamlet", "shakespeare")
+	store.Set("dune", "herbert")
+	store.Delete("dune")
+	store.PutWithTTL("session", "jojo", time.Hour)
+
+	copyName := filepath.Join(dir, "copy.db")
+	if err := store.CopyTo(copyName); err != nil {
+		t.Fatalf("CopyTo() error = %v", err)
+	}
+	if err := store.CopyTo(copyName); err == nil {
+		t.Errorf("CopyTo() over an existing file error = nil, want an error")
+	}
+	// the source carries on as before
+	store.Set("emma", "austen")
+
+	clone, err := NewDiskStore(copyName)
+	if err != nil {
+		t.Fatalf("failed to open the copy: %v", err)
+	}
+	defer clone.Close()
+	want := map[string]string{"othello": "shakespeare", "hamlet": "shakespeare", "session": "jojo", "dune": "", "emma": ""}
+	for key, value := range want {
+		if got := clone.Get(key); got != value {
+			t.Errorf("Get(%v) on the copy = %v, want %v", key, got, value)
+		}
+	}
+	if ttl, err := clone.TTL("session"); err != nil || ttl <= 0 {
+		t.Errorf("TTL(session) on the copy = %v, %v, want the expiry kept", ttl, err)
+	}
+	info, err := os.Stat(copyName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != clone.Stats().Bytes || clone.Stats().Bytes >= store.Stats().Bytes {
+		t.Errorf("copy is %v bytes, want only the live records", info.Size())
+	}
+}
@@ -0,0 +1,50 @@
+package caskdb
+
+import (
+	"context"
+	"time"
+)
+
+// A disk which hangs, e.g. an NFS mount whose server went away or a failing
+// device, blocks the read or write syscall, and with it the store, which holds its
+// lock meanwhile. There is no cancelling a syscall on a regular file, so the
+// operations bounded by a deadline run in a goroutine of their own, and the caller
+// stops waiting for them once the deadline passes: they carry on in the
+// background, and a write may still be applied after its caller got ErrTimeout.
+
+// bounded reports whether an operation under ctx, with timeout as the timeout of
+// its kind, has a deadline to be held to.
+func bounded(ctx context.Context, timeout time.Duration) bool {
+	return timeout > 0 || ctx.Done() != nil
+}
+
+// withDeadline runs op, and returns what it returns, unless timeout passes or ctx
+// is done first, zero meaning no timeout. It then returns ErrTimeout, or the error
+// of ctx, like the waits for Options.WriteOpsPerSecond do, and leaves op running.
+func withDeadline[T any](parent context.Context, timeout time.Duration, op func(ctx context.Context) (T, error)) (T, error) {
+	ctx := parent
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(parent, timeout)
+		defer cancel()
+	}
+	type result struct {
+		value T
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		value, err := op(ctx)
+		done <- result{value, err}
+	}()
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-ctx.Done():
+		var zero T
+		if err := parent.Err(); err != nil {
+			return zero, err
+		}
+		return zero, ErrTimeout
+	}
+}
@@ -0,0 +1,52 @@
+package caskdb
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_Timeouts(t *testing.T) {
+	opts := Options{ReadTimeout: 20 * time.Millisecond, WriteTimeout: 20 * time.Millisecond}
+	store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("othello", "shakespeare")
+	if value, err := store.Lookup("othello"); err != nil || value != "shakespeare" {
+		t.Errorf("Lookup() = %v, %v, want shakespeare", value, err)
+	}
+
+	// as if an operation hung on the disk, holding the store
+	store.mu.Lock()
+	if _, err := store.Lookup("othello"); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Lookup() error = %v, want %v", err, ErrTimeout)
+	}
+	if _, err := store.GetEntry("othello"); !errors.Is(err, ErrTimeout) {
+		t.Errorf("GetEntry() error = %v, want %v", err, ErrTimeout)
+	}
+	if err := store.Put("dune", "herbert"); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Put() error = %v, want %v", err, ErrTimeout)
+	}
+	if err := store.Delete("othello"); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Delete() error = %v, want %v", err, ErrTimeout)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := store.LookupContext(ctx, "othello"); !errors.Is(err, context.Canceled) {
+		t.Errorf("LookupContext() with a cancelled context error = %v, want %v", err, context.Canceled)
+	}
+	store.mu.Unlock()
+
+	// the writes given up on are still applied, once the disk is back
+	deadline := time.Now().Add(time.Second)
+	for (store.Has("othello") || !store.Has("dune")) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if store.Has("othello") || !store.Has("dune") {
+		t.Errorf("Has() = %v, %v, want the writes applied", store.Has("othello"), store.Has("dune"))
+	}
+}
@@ -0,0 +1,80 @@
+package caskdb
+
+import (
+	"path/filepath"
+	"sort"
+)
+
+// DebugInfo is a snapshot of the internals of the store, for troubleshooting it in
+// production, as returned by DiskStore.Debug.
+type DebugInfo struct {
+	// Segments lists the segments of the log, oldest first, the active file last
+	Segments []SegmentInfo
+	KeyDir   KeyDirStats
+	// Compaction is what Compact is up to
+	Compaction CompactionStatus
+	// Snapshots lists the snapshots open on the store, check SnapshotInfo
+	Snapshots []SnapshotInfo
+}
+
+// SegmentInfo describes a segment of the log.
+type SegmentInfo struct {
+	ID uint32
+	// Name is the name of the segment's file, e.g. books.db.000042
+	Name string
+	// Size is the number of bytes of records in the segment
+	Size int64
+	// Active is set for the active file, Remote for a segment moved to
+	// Options.ColdStorage, Moving for one being moved to Options.ColdDir, and
+	// Compacted for one written by Compact
+	Active    bool
+	Remote    bool
+	Moving    bool
+	Compacted bool
+}
+
+// CompactionStatus describes the compaction of the store.
+type CompactionStatus struct {
+	// Running is set while Compact runs
+	Running bool
+	// SavedSegments and SavedBytes are the ids of the segments of the compaction
+	// which last recorded its progress in books.db.compact-state, and the bytes it
+	// had copied by then; they are empty once it completed. Along with Running,
+	// they are the progress of a running compaction, as of its last checkpoint,
+	// and without, those of an interrupted one the next Compact resumes.
+	SavedSegments []uint32
+	SavedBytes    int64
+}
+
+// Debug returns a snapshot of the internals of the store. It computes the
+// KeyDirStats, so it takes about as long as listing the keys.
+func (d *DiskStore) Debug() DebugInfo {
+	var info DebugInfo
+	d.mu.Lock()
+	for _, seg := range d.segments {
+		info.Segments = append(info.Segments, SegmentInfo{
+			ID:        seg.id,
+			Name:      filepath.Base(seg.path),
+			Size:      seg.size,
+			Remote:    seg.remote,
+			Moving:    seg.moving,
+			Compacted: seg.compacted,
+		})
+	}
+	active := &info.Segments[len(info.Segments)-1]
+	active.Active, active.Size = true, int64(d.writePosition)
+	info.Compaction.Running = d.compacting
+	for _, ref := range d.snapshots {
+		info.Snapshots = append(info.Snapshots, SnapshotInfo{Op: ref.op, Opened: ref.opened, Segments: ref.names})
+	}
+	sort.Slice(info.Snapshots, func(i, j int) bool { return info.Snapshots[i].Opened.Before(info.Snapshots[j].Opened) })
+	statePath := d.file.Name() + compactStateSuffix
+	d.mu.Unlock()
+
+	info.KeyDir = d.KeyDirStats()
+	c := &compaction{store: d, statePath: statePath}
+	if saved := c.loadState(); saved != nil {
+		info.Compaction.SavedSegments, info.Compaction.SavedBytes = saved.Segments, saved.Written
+	}
+	return info
+}
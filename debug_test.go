@@ -0,0 +1,47 @@
+package caskdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskStore_Debug(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{MaxSegmentBytes: 100})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	for i := 0; i < 12; i++ {
+		store.Set("key", fmt.Sprintf("value-%d", i%10))
+	}
+
+	info := store.Debug()
+	if len(info.Segments) != len(store.segments) {
+		t.Fatalf("Debug() segments = %v, want %v", len(info.Segments), len(store.segments))
+	}
+	active := info.Segments[len(info.Segments)-1]
+	if !active.Active || active.Name != "test.db" || active.Size != int64(store.writePosition) {
+		t.Errorf("Debug() active segment = %+v, want test.db of %v bytes", active, store.writePosition)
+	}
+	if sealed := info.Segments[0]; sealed.Active || sealed.Name != "test.db.000001" || sealed.Size == 0 {
+		t.Errorf("Debug() first segment = %+v, want test.db.000001", sealed)
+	}
+	if info.KeyDir.Keys != 1 {
+		t.Errorf("Debug() keys = %v, want 1", info.KeyDir.Keys)
+	}
+	if info.Compaction.Running || info.Compaction.SavedSegments != nil {
+		t.Errorf("Debug() compaction = %+v, want none", info.Compaction)
+	}
+
+	ctx := &countdownContext{Context: context.Background(), n: 2}
+	if _, err := store.Compact(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Compact() with a cancelled context error = %v, want context.Canceled", err)
+	}
+	if c := store.Debug().Compaction; len(c.SavedSegments) == 0 || c.SavedBytes == 0 {
+		t.Errorf("Debug() compaction = %+v, want the progress of the interrupted one", c)
+	}
+}
@@ -0,0 +1,161 @@
+package caskdb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// With Options.Dedup, a value written under several keys is stored once. The value
+// goes in a record of its own, the blob, whose key is blobKeyPrefix followed by the
+// id of the blob: the SHA-256 of the value and of its content flags, in hex. The
+// record of each key holding the value is flagged FlagDedup, and its value is the
+// id. KeyDir points these keys at the shared blob, so reading one takes a single
+// read, of the blob.
+//
+// A blob counts the records referencing it in the log, the older versions of the
+// keys included, as the readers of the change feed still read them. Compact takes
+// the records it drops off the count, and drops the blob once none are left.
+
+// blobKeyPrefix is the prefix of the key of the records holding a blob. It is
+// reserved.
+const blobKeyPrefix = "\x00blob\x00"
+
+// dedupMinValue is the size of the smallest value stored as a blob: for the
+// shorter ones, the record referencing the blob takes about as much room as the
+// value would
+const dedupMinValue = 128
+
+// blob is a value stored once for the keys referencing it.
+type blob struct {
+	id string
+	// at is where the record of the blob is, or has a segment of 0 if that is
+	// not known yet while loading the store
+	at KeyEntry
+	// refs counts the records referencing the blob in the log
+	refs int
+}
+
+// isBlobKey reports whether the key is that of a blob record.
+func isBlobKey(key string) bool {
+	return strings.HasPrefix(key, blobKeyPrefix)
+}
+
+// blobID returns the id of the blob holding the value, written with the flags.
+func blobID(value string, flags RecordFlags) string {
+	h := sha256.New()
+	h.Write([]byte{byte(flags & contentFlags)})
+	io.WriteString(h, value)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// validBlobID reports whether id is one blobID returns.
+func validBlobID(id string) bool {
+	if len(id) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// dedups reports whether the value is stored as a blob.
+func (d *DiskStore) dedups(value string) bool {
+	return d.opts.Dedup && len(value) >= dedupMinValue
+}
+
+// putRef is putAt for a value stored as a blob: it writes the blob, unless the log
+// holds it already, and the record of the key referencing it. With
+// Options.Retention, the blob is only shared within the active segment, as a blob
+// in an older one would be dropped before the keys referencing it expire.
+func (d *DiskStore) putRef(key string, value string, timestamp uint32, expiry uint32, token string, flags RecordFlags) (int, error) {
+	id := blobID(value, flags)
+	refSize, ref := encodeRecordFlags(timestamp, expiry, key, id, flags|FlagDedup)
+	b, ok := d.blobs[id]
+	written := ok && b.at.segment != 0
+	if written && d.opts.Retention > 0 {
+		written = b.at.segment == d.active().id && !d.segmentFull(len(ref)) && !d.periodOver(time.Now())
+	}
+	var data []byte
+	if !written {
+		value, blobFlags, err := d.encodeValue(value, flags&contentFlags)
+		if err != nil {
+			return 0, err
+		}
+		_, data = encodeRecordFlags(timestamp, 0, blobKeyPrefix+id, value, blobFlags)
+	}
+	blobSize := len(data)
+	data = append(data, ref...)
+	data = d.appendToken(data, token, timestamp)
+	if err := d.checkQuota(key, len(data)); err != nil {
+		return 0, err
+	}
+	if err := d.write(data); err != nil {
+		return 0, err
+	}
+	if !ok {
+		b = &blob{id: id}
+		d.blobs[id] = b
+	}
+	if !written {
+		b.at = NewKeyEntry(timestamp, uint32(d.writePosition), uint32(blobSize))
+		b.at.segment = d.active().id
+	}
+	b.refs++
+	kEntry := NewKeyEntry(timestamp, uint32(d.writePosition+blobSize), uint32(refSize))
+	kEntry.segment = d.active().id
+	kEntry.expiry = expiry
+	kEntry.blob = b
+	d.setKey(key, d.retain(kEntry))
+	d.writePosition += len(data)
+	d.remember(token, timestamp)
+	d.countAccess(key, true)
+	return blobSize + refSize, nil
+}
+
+// refBlob returns the blob a record read back from the log references, counting
+// the reference. The store must be locked.
+func (d *DiskStore) refBlob(id string) *blob {
+	b, ok := d.blobs[id]
+	if !ok {
+		b = &blob{id: id}
+		d.blobs[id] = b
+	}
+	b.refs++
+	return b
+}
+
+// locateBlob notes where the record of a blob read back from the log is. The
+// store must be locked.
+func (d *DiskStore) locateBlob(key string, kEntry KeyEntry) {
+	id := strings.TrimPrefix(key, blobKeyPrefix)
+	b, ok := d.blobs[id]
+	if !ok {
+		b = &blob{id: id}
+		d.blobs[id] = b
+	}
+	b.at = kEntry
+}
+
+// sweepBlobs forgets the blobs no record references, once the store is loaded:
+// Compact drops them.
+func (d *DiskStore) sweepBlobs() {
+	for id, b := range d.blobs {
+		if b.refs <= 0 {
+			delete(d.blobs, id)
+		}
+	}
+}
+
+// blobValue returns the value of the blob with the id, which the value of a
+// record flagged FlagDedup holds. The store must be locked.
+func (d *DiskStore) blobValue(id string) (string, error) {
+	b, ok := d.blobs[id]
+	if !ok {
+		return "", fmt.Errorf("%w: blob %s not found", ErrCorruptRecord, id)
+	}
+	value, _, err := d.readFlags(blobKeyPrefix+id, b.at)
+	return value, err
+}
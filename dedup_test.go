@@ -0,0 +1,121 @@
+package caskdb
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiskStore_Dedup(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "test.db")
+	opts := Options{Dedup: true, MaxSegmentBytes: 4000}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	cover := strings.Repeat("the folio cover, ", 120)
+	for i := 0; i < 10; i++ {
+		store.Set(fmt.Sprintf("cover:%d", i), cover)
+	}
+	// too short to share
+	store.Set("othello", "shakespeare")
+	if size := store.Stats().Bytes; size >= int64(2*len(cover)) {
+		t.Errorf("Stats().Bytes = %d, want the cover stored once, less than %d", size, 2*len(cover))
+	}
+	for i := 0; i < 10; i++ {
+		if got := store.Get(fmt.Sprintf("cover:%d", i)); got != cover {
+			t.Errorf("Get(cover:%d) = %d bytes, want %d", i, len(got), len(cover))
+		}
+	}
+	store.Close()
+
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	if got := store.Get("cover:7"); got != cover {
+		t.Errorf("Get() after reopening = %d bytes, want %d", len(got), len(cover))
+	}
+	if len(store.blobs) != 1 || store.blobs[blobID(cover, 0)].refs != 10 {
+		t.Errorf("blobs after reopening = %v, want the cover referenced 10 times", store.blobs)
+	}
+	changes, _, err := store.ReadChanges(0, 100)
+	if err != nil {
+		t.Fatalf("ReadChanges() error = %v", err)
+	}
+	if len(changes) != 11 || changes[0].Value != cover || changes[0].Flags != FlagDedup {
+		t.Errorf("ReadChanges() = %d changes, want 11 with the cover read from its blob", len(changes))
+	}
+
+	// a copy holds the values themselves
+	copyName := filepath.Join(dir, "copy.db")
+	if err := store.CopyTo(copyName); err != nil {
+		t.Fatalf("CopyTo() error = %v", err)
+	}
+	copied, err := NewDiskStore(copyName)
+	if err != nil {
+		t.Fatalf("failed to open the copy: %v", err)
+	}
+	if got := copied.Get("cover:3"); got != cover {
+		t.Errorf("Get() from the copy = %d bytes, want %d", len(got), len(cover))
+	}
+	copied.Close()
+
+	// once no record references it, compacting drops the blob
+	for i := 0; i < 10; i++ {
+		store.Set(fmt.Sprintf("cover:%d", i), fmt.Sprintf("reprint %d", i))
+	}
+	store.Set("padding", strings.Repeat("x", 4000))
+	if _, err := store.Compact(context.Background()); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if _, ok := store.blobs[blobID(cover, 0)]; ok || len(store.blobs) != 1 {
+		t.Errorf("blobs after Compact() = %v, want only that of the padding", store.blobs)
+	}
+	if size := store.Stats().Bytes; size >= int64(len(cover))+5000 {
+		t.Errorf("Stats().Bytes after Compact() = %d, want the cover gone", size)
+	}
+	if got := store.Get("cover:4"); got != "reprint 4" {
+		t.Errorf("Get() after Compact() = %q, want reprint 4", got)
+	}
+}
+
+func TestDiskStore_DedupCompactKeepsReferenced(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{Dedup: true, MaxSegmentBytes: 2000}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	cover := strings.Repeat("the quarto cover, ", 50)
+	store.Set("hamlet", cover)
+	// the segment of the blob ends up full of garbage, but hamlet still needs it
+	for i := 0; i < 30; i++ {
+		store.Set("lear", fmt.Sprintf("edition %d", i))
+	}
+	store.Set("macbeth", cover)
+	if _, err := store.Compact(context.Background()); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	store.Close()
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	for _, key := range []string{"hamlet", "macbeth"} {
+		if got := store.Get(key); got != cover {
+			t.Errorf("Get(%q) after Compact() = %d bytes, want %d", key, len(got), len(cover))
+		}
+	}
+	if err := store.Expire("hamlet", 3600e9); err != nil {
+		t.Fatalf("Expire() error = %v", err)
+	}
+	if got := store.Get("hamlet"); got != cover {
+		t.Errorf("Get() after Expire() = %d bytes, want %d", len(got), len(cover))
+	}
+}
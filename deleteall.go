@@ -0,0 +1,160 @@
+package caskdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// truncateKey is the key of the record DeleteAll writes. Its value is the offset
+// of the record in the log. Loading the store, it empties KeyDir, and the segments
+// before the one holding it are deleted. The key is reserved.
+const truncateKey = "\x00truncate\x00"
+
+// DeleteAll removes every key from the store. Rather than writing a tombstone per
+// key, it starts a new segment with a record marking the truncation, empties
+// KeyDir, and deletes the files of the older segments in the background, so it
+// takes about as long as a single write however big the store is. Objects already
+// offloaded to Options.ColdStorage are left where they are.
+//
+// OnDelete is called for every key which was in the store. The idempotency tokens
+// seen so far are kept, so retrying a write applied before DeleteAll still does
+// nothing.
+func (d *DiskStore) DeleteAll() (err error) {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	start := time.Now()
+	defer func() { d.observe("DeleteAll", "", 0, d.fileName, start) }()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.syncErr != nil {
+		return d.syncFailure()
+	}
+	if len(d.segments) == 1 && d.writePosition == 0 {
+		// nothing was written yet
+		return nil
+	}
+	if d.writePosition > 0 {
+		if err := d.rotate(); err != nil {
+			return err
+		}
+	}
+	// the marker starts the new segment, so everything before it can go
+	if err := d.startFile(start); err != nil {
+		return err
+	}
+	position, offset := d.writePosition, d.logSize()
+	timestamp := uint32(start.Unix())
+	_, data := encodeRecord(timestamp, 0, truncateKey, strconv.FormatInt(offset, 10))
+	// the tokens were recorded in the segments we delete, so we record them again
+	for token, expiry := range d.tokens {
+		if start.Unix() < int64(expiry) {
+			_, record := encodeRecord(timestamp, expiry, tokenKeyPrefix+token, "1")
+			data = append(data, record...)
+		}
+	}
+	if err := d.write(data); err != nil {
+		return err
+	}
+	d.writePosition += len(data)
+	keys := d.keyDir
+	d.resetKeys()
+	d.coldCache.clear()
+	d.logBase = offset - int64(position)
+	d.dropSegments(len(d.segments) - 1)
+	d.log.Info("deleted all keys", "keys", keys.size(), "offset", offset)
+	if d.opts.OnDelete != nil {
+		keys.each(func(key string, kEntry KeyEntry) bool {
+			d.opts.OnDelete(key)
+			return true
+		})
+	}
+	return nil
+}
+
+// dropBefore deletes the segments older than the last DeleteAll or Compact found
+// while loading the store, which were left behind if we stopped before deleting
+// them, and picks up the offset of the log from its record.
+func (d *DiskStore) dropBefore() error {
+	if d.baseAt.segment == 0 {
+		return nil
+	}
+	i := 0
+	for d.segments[i].id != d.baseAt.segment {
+		i++
+	}
+	data, err := d.readRecord(d.segments[i], d.baseAt)
+	if err != nil {
+		return err
+	}
+	_, _, value := decodeKV(data)
+	// the record of Compact has more after the offset
+	value, _, _ = strings.Cut(value, " ")
+	offset, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid truncation record in %s", ErrCorruptRecord, d.segments[i].path)
+	}
+	d.logBase = offset - int64(d.baseAt.position)
+	if d.logBase < 0 {
+		// a log restored from shipped copies, with older records before the one
+		// which started the log it was shipped from
+		d.logBase = 0
+	}
+	d.dropSegments(i)
+	return nil
+}
+
+// dropSegments takes the first n segments out of the store and deletes their
+// files in the background. A segment being moved to Options.ColdDir is deleted
+// once it has been moved. The store must be locked.
+func (d *DiskStore) dropSegments(n int) {
+	d.removeSegments(d.segments[:n])
+	d.segments = append([]*segment(nil), d.segments[n:]...)
+}
+
+// removeSegments marks the segments, which were taken out of the store, as removed,
+// and deletes their files in the background. The store must be locked.
+func (d *DiskStore) removeSegments(segments []*segment) {
+	var drop []string
+	for _, seg := range segments {
+		seg.removed = true
+		if seg.file != nil {
+			seg.file.Close()
+			seg.file = nil
+		}
+		if !seg.moving && !d.keepPinned(seg.path) {
+			drop = append(drop, seg.path)
+		}
+	}
+	if len(drop) == 0 {
+		return
+	}
+	d.background.Go(func(ctx context.Context) error {
+		// quick enough to finish even when the store is being closed
+		for _, path := range drop {
+			d.removeSegmentFiles(path)
+		}
+		return nil
+	})
+}
+
+// removeSegmentFiles deletes the data file, the remote index and the hint of a
+// segment, whichever exist, or trashes them, check Options.TrashDelay.
+func (d *DiskStore) removeSegmentFiles(path string) {
+	if d.opts.TrashDelay > 0 {
+		d.trashSegmentFiles(path)
+		return
+	}
+	for _, name := range []string{path, path + remoteIndexSuffix, path + hintSuffix} {
+		if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			// the next time the store is opened, we try again
+			d.log.Error("failed to delete segment", "file", name, "error", err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package caskdb
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskStore_DeleteAll(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{MaxSegmentBytes: 130}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	var deleted []string
+	store.opts.OnDelete = func(key string) { deleted = append(deleted, key) }
+	ctx := WithIdempotencyToken(context.Background(), "order-1")
+	if err := store.PutContext(ctx, "othello", "shakespeare"); err != nil {
+		t.Fatalf("PutContext() error = %v", err)
+	}
+	for _, key := range []string{"hamlet", "dune", "emma"} {
+		store.Set(key, "some author")
+	}
+	_, offset, err := store.ReadChanges(0, 100)
+	if err != nil {
+		t.Fatalf("ReadChanges() error = %v", err)
+	}
+
+	if err := store.DeleteAll(); err != nil {
+		t.Fatalf("DeleteAll() error = %v", err)
+	}
+	if keys := store.Keys(); len(keys) != 0 {
+		t.Errorf("Keys() after DeleteAll() = %v, want none", keys)
+	}
+	if len(deleted) != 4 {
+		t.Errorf("OnDelete was called for %v, want the 4 keys", deleted)
+	}
+	store.Set("dune", "herbert")
+	// a change feed reader carries on with the truncation
+	changes, _, err := store.ReadChanges(offset, 10)
+	if err != nil {
+		t.Fatalf("ReadChanges() error = %v", err)
+	}
+	if len(changes) != 2 || !changes[0].Truncate || changes[1].Key != "dune" {
+		t.Errorf("ReadChanges() after DeleteAll() = %+v, want the truncation and dune", changes)
+	}
+	if changes, _, err := store.ReadChanges(0, 10); err != nil || len(changes) != 2 {
+		t.Errorf("ReadChanges(0) after DeleteAll() = %+v, %v, want the changes from the truncation on", changes, err)
+	}
+	store.Close()
+	segments, err := findSegments(fileName, "")
+	if err != nil {
+		t.Fatalf("findSegments() error = %v", err)
+	}
+	if len(segments) != 0 {
+		t.Errorf("DeleteAll() left %d sealed segments behind, want none", len(segments))
+	}
+
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	if keys := store.Keys(); len(keys) != 1 || store.Get("dune") != "herbert" {
+		t.Errorf("Keys() after reopening = %v, want dune", keys)
+	}
+	if _, next, err := store.ReadChanges(0, 10); err != nil || next <= offset {
+		t.Errorf("ReadChanges() after reopening = %v, %v, want offsets past %v", next, err, offset)
+	}
+	// the token survives, so a retry of the write is still not applied
+	if err := store.PutContext(ctx, "othello", "shakespeare"); err != nil {
+		t.Fatalf("PutContext() error = %v", err)
+	}
+	if _, err := store.Lookup("othello"); err == nil {
+		t.Errorf("PutContext() with a token seen before DeleteAll() applied the write")
+	}
+}
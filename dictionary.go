@@ -0,0 +1,186 @@
+package caskdb
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// With Options.CompactionDictionary, Compact trains a dictionary on the values of
+// the segments it compacts, and compresses the values it copies with DEFLATE
+// primed with it: small values which look alike, e.g. JSON documents with the same
+// fields, compress far better that way than each on its own. The dictionary is
+// written right after the record starting the compacted segment, as a record of
+// its own whose key is dictKeyPrefix followed by the id of the dictionary, the
+// CRC-32 of its contents. The values compressed with it are flagged
+// FlagCompressed, and start with compressionDictionary and the id, so that each
+// record still says how to read it back.
+
+// dictKeyPrefix is the prefix of the key of the records holding a dictionary. It
+// is reserved.
+const dictKeyPrefix = "\x00dict\x00"
+
+// compressionDictionary is the Compression of the values compressed with a
+// dictionary of the log
+const compressionDictionary Compression = 255
+
+const (
+	// dictionaryMaxBytes is the size of the largest dictionary, the window of
+	// DEFLATE
+	dictionaryMaxBytes = 32 << 10
+	// dictionaryMinSamples is how many bytes of values a dictionary needs to be
+	// trained on to be worth writing
+	dictionaryMinSamples = 4 << 10
+	// dictionarySampleBytes is how much of the segments is read to train it
+	dictionarySampleBytes = 1 << 20
+	// dictionaryMaxValue is the size of the largest value sampled, as the large
+	// values compress well enough on their own
+	dictionaryMaxValue = 4 << 10
+	// dictionarySampleRatio is how many times larger than the dictionary the
+	// samples are at least, for it to take less room than it saves
+	dictionarySampleRatio = 8
+)
+
+// isDictKey reports whether the key is that of a dictionary record.
+func isDictKey(key string) bool {
+	return strings.HasPrefix(key, dictKeyPrefix)
+}
+
+// dictKey returns the key of the record of the dictionary.
+func dictKey(dict []byte) (string, uint32) {
+	id := crc32.ChecksumIEEE(dict)
+	return dictKeyPrefix + strconv.FormatUint(uint64(id), 16), id
+}
+
+// addDictionary makes the dictionary of a record of the log known to the
+// decoders.
+func (d *DiskStore) addDictionary(key string, dict string) error {
+	id, err := strconv.ParseUint(strings.TrimPrefix(key, dictKeyPrefix), 16, 32)
+	if err != nil || crc32.ChecksumIEEE([]byte(dict)) != uint32(id) {
+		return fmt.Errorf("%w: invalid dictionary %q", ErrCorruptRecord, key)
+	}
+	d.dictMu.Lock()
+	defer d.dictMu.Unlock()
+	if d.dicts == nil {
+		d.dicts = make(map[uint32][]byte)
+	}
+	d.dicts[uint32(id)] = []byte(dict)
+	return nil
+}
+
+// dictionary returns the dictionary with the id.
+func (d *DiskStore) dictionary(id uint32) ([]byte, bool) {
+	d.dictMu.RLock()
+	defer d.dictMu.RUnlock()
+	dict, ok := d.dicts[id]
+	return dict, ok
+}
+
+// trainDictionary builds a dictionary out of sample values, or returns nil if
+// they are too few. It is up to 1/dictionarySampleRatio of their size. DEFLATE
+// finds the matches closest to the end of the dictionary cheapest, so the samples
+// met most often go last.
+func trainDictionary(samples []string) []byte {
+	counts := make(map[string]int)
+	var distinct []string
+	total := 0
+	for _, sample := range samples {
+		if counts[sample] == 0 {
+			distinct = append(distinct, sample)
+		}
+		counts[sample]++
+		total += len(sample)
+	}
+	if total < dictionaryMinSamples {
+		return nil
+	}
+	limit := total / dictionarySampleRatio
+	if limit > dictionaryMaxBytes {
+		limit = dictionaryMaxBytes
+	}
+	// the most frequent ones fill the dictionary from its end, the ties in the
+	// order they were met
+	sort.SliceStable(distinct, func(i, j int) bool { return counts[distinct[i]] < counts[distinct[j]] })
+	start, size := len(distinct), 0
+	for start > 0 && size < limit {
+		start--
+		size += len(distinct[start])
+	}
+	dict := []byte(strings.Join(distinct[start:], ""))
+	if len(dict) > limit {
+		dict = dict[len(dict)-limit:]
+	}
+	return dict
+}
+
+// dictCompressor compresses values with a dictionary, reusing its state from one
+// value to the next.
+type dictCompressor struct {
+	id  uint32
+	buf bytes.Buffer
+	w   *flate.Writer
+}
+
+func newDictCompressor(dict []byte, id uint32, level int) (*dictCompressor, error) {
+	if level == 0 {
+		level = flate.BestCompression
+	}
+	c := &dictCompressor{id: id}
+	w, err := flate.NewWriterDict(&c.buf, level, dict)
+	if err != nil {
+		return nil, err
+	}
+	c.w = w
+	return c, nil
+}
+
+// compress returns the value compressed with the dictionary, along with the
+// compression and id it starts with.
+func (c *dictCompressor) compress(value string) (string, error) {
+	c.buf.Reset()
+	c.buf.WriteByte(byte(compressionDictionary))
+	binary.Write(&c.buf, binary.LittleEndian, c.id)
+	c.w.Reset(&c.buf)
+	if _, err := io.WriteString(c.w, value); err != nil {
+		return "", err
+	}
+	if err := c.w.Close(); err != nil {
+		return "", err
+	}
+	return c.buf.String(), nil
+}
+
+// usesDictionary reports whether the value of the record is compressed with a
+// dictionary of the log, which a copy of the record elsewhere would lack. That of
+// an encrypted record may be, as far as can be told without decrypting it.
+func usesDictionary(data []byte) bool {
+	flags := decodeFlags(data)
+	value, err := storedValue(data)
+	if flags&FlagCompressed == 0 || err != nil || value == "" {
+		return false
+	}
+	return flags&FlagEncrypted != 0 || Compression(value[0]) == compressionDictionary
+}
+
+// decompressDict returns the value back from what dictCompressor.compress
+// returned, past its first byte.
+func (d *DiskStore) decompressDict(data []byte) ([]byte, error) {
+	if len(data) < 4 {
+		return nil, errors.New("dictionary id missing")
+	}
+	id := binary.LittleEndian.Uint32(data)
+	dict, ok := d.dictionary(id)
+	if !ok {
+		return nil, fmt.Errorf("dictionary %x not found", id)
+	}
+	r := flate.NewReaderDict(bytes.NewReader(data[4:]), dict)
+	defer r.Close()
+	return io.ReadAll(r)
+}
@@ -0,0 +1,107 @@
+package caskdb
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// compactCatalog fills a store with JSON documents which look alike, compacts it,
+// and returns the size of the store after. The books end at edition 1 if odd, 2
+// if even.
+func compactCatalog(t *testing.T, fileName string, opts Options) int64 {
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	for i := 0; i < 200; i++ {
+		store.Set(fmt.Sprintf("book:%03d", i%100), catalogEntry(i%100, i/100))
+	}
+	// the even ones again, so that the odd ones are copied
+	for i := 0; i < 100; i += 2 {
+		store.Set(fmt.Sprintf("book:%03d", i), catalogEntry(i, 2))
+	}
+	if _, err := store.Compact(context.Background()); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	return store.Stats().Bytes
+}
+
+func catalogEntry(i int, round int) string {
+	return fmt.Sprintf(`{"title":"Volume %d","author":"William Shakespeare","publisher":"Penguin Classics","language":"English","edition":%d,"pages":%d}`, i, round, 100+i)
+}
+
+func TestDiskStore_CompactionDictionary(t *testing.T) {
+	dir := t.TempDir()
+	plain := compactCatalog(t, filepath.Join(dir, "plain.db"), Options{MaxSegmentBytes: 8000})
+	fileName := filepath.Join(dir, "test.db")
+	opts := Options{MaxSegmentBytes: 8000, CompactionDictionary: true}
+	if size := compactCatalog(t, fileName, opts); size >= plain {
+		t.Errorf("Stats().Bytes after Compact() with a dictionary = %d, want less than %d without", size, plain)
+	}
+
+	// the dictionary is found again on reopening, with or without the option
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("book:%03d", i)
+		if got, want := store.Get(key), catalogEntry(i, 2-i%2); got != want {
+			t.Errorf("Get(%q) = %q, want %q", key, got, want)
+		}
+	}
+	changes, _, err := store.ReadChanges(0, 1000)
+	if err != nil {
+		t.Fatalf("ReadChanges() error = %v", err)
+	}
+	seen := make(map[string]string)
+	replay(seen, changes)
+	if len(seen) != 100 || seen["book:043"] != catalogEntry(43, 1) {
+		t.Errorf("replaying the changes = %d keys, want the 100 books decompressed", len(seen))
+	}
+
+	// a copy holds the values without the dictionary
+	copyName := filepath.Join(dir, "copy.db")
+	if err := store.CopyTo(copyName); err != nil {
+		t.Fatalf("CopyTo() error = %v", err)
+	}
+	copied, err := NewDiskStore(copyName)
+	if err != nil {
+		t.Fatalf("failed to open the copy: %v", err)
+	}
+	defer copied.Close()
+	if got, want := copied.Get("book:007"), catalogEntry(7, 1); got != want {
+		t.Errorf("Get() from the copy = %q, want %q", got, want)
+	}
+}
+
+func TestTrainDictionary(t *testing.T) {
+	if dict := trainDictionary([]string{"too", "few"}); dict != nil {
+		t.Errorf("trainDictionary() of a few samples = %q, want nil", dict)
+	}
+	var samples []string
+	for i := 0; i < 100; i++ {
+		samples = append(samples, catalogEntry(i%10, 0))
+	}
+	dict := trainDictionary(samples)
+	if len(dict) == 0 || len(dict) > dictionaryMaxBytes {
+		t.Fatalf("trainDictionary() = %d bytes, want up to %d", len(dict), dictionaryMaxBytes)
+	}
+	_, id := dictKey(dict)
+	comp, err := newDictCompressor(dict, id, 0)
+	if err != nil {
+		t.Fatalf("newDictCompressor() error = %v", err)
+	}
+	value := catalogEntry(3, 0)
+	compressed, err := comp.compress(value)
+	if err != nil {
+		t.Fatalf("compress() error = %v", err)
+	}
+	if len(compressed) >= len(value)/4 {
+		t.Errorf("compress() = %d bytes out of %d, want far fewer", len(compressed), len(value))
+	}
+}
@@ -1,11 +1,14 @@
 package caskdb
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"hash/maphash"
 	"io"
 	"io/fs"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -56,6 +59,9 @@ const defaultWhence = 0
 // accordingly. The initialisation is also a blocking operation; till it is completed,
 // we cannot use the database.
 //
+// A DiskStore is safe to use from multiple goroutines; the operations are executed
+// one at a time.
+//
 // Typical usage example:
 //
 //		store, _ := NewDiskStore("books.db")
@@ -64,12 +70,139 @@ const defaultWhence = 0
 type DiskStore struct {
 	// file object pointing the file_name
 	file *os.File
+	// fileName is the path of the active file; unlike file, it never changes, so
+	// it is read without the lock
+	fileName string
 	// current cursor position in the file where the data can be written
 	writePosition int
+	// segments are the data files of the store, oldest first; the last one is the
+	// active segment, i.e. file
+	segments []*segment
+	// coldCache keeps the records recently read from cold storage
+	coldCache *recordCache
+	// readBuf is the scratch buffer Get reads the records into, check scratch
+	readBuf []byte
+	// io is the ioEngine of the batched reads and writes, nil until first used,
+	// check engine
+	io ioEngine
+	// logBase is the offset in the log of the oldest segment, past the segments
+	// removed by DeleteAll or Compact
+	logBase int64
+	// baseAt points at the record of the last DeleteAll or Compact found while
+	// loading the store, if any, and mergedAt at those of the compactions which
+	// started after the oldest segment found after it
+	baseAt   KeyEntry
+	mergedAt []KeyEntry
+	// pins counts the snapshots referencing the files of the segments, by name,
+	// and unpinned holds the paths of those taken out of the store meanwhile,
+	// check pin; snapshots are the snapshots open, by id
+	pins         map[string]int
+	unpinned     map[string]string
+	snapshots    map[uint64]*snapshotRef
+	lastSnapshot uint64
+	// compacting is set while Compact runs
+	compacting bool
+	// background runs the work done in the background, i.e. moving the segments
+	// to Options.ColdDir and removing them after DeleteAll or Compact
+	background *supervisor
+	// loaded is closed once the active file is indexed, for a store opened with
+	// Options.LoadInBackground, check Loaded; loadErr is why it failed, if it did
+	loaded  chan struct{}
+	loadErr error
+	// onLoad is Options.OnLoad while the store is being opened, and onLoadErr the
+	// first error it returned
+	onLoad    func(LoadedRecord) error
+	onLoadErr error
+	// tokens maps the idempotency tokens seen within Options.IdempotencyWindow to
+	// the unix time they expire at
+	tokens map[string]uint32
+	// tokensAdded counts the tokens added since the expired ones were last swept
+	tokensAdded int
 	// keyDir is a map of key and KeyEntry being the value. KeyEntry contains the position
 	// of the byte offset in the file where the value exists. key_dir map acts as in-memory
-	// index to fetch the values quickly from the disk
-	keyDir map[string]KeyEntry
+	// index to fetch the values quickly from the disk. It is the table of
+	// Options.KeyDirIndex, hashing with hashSeed unless Options.KeyHash is set
+	keyDir   keyDirTable
+	hashSeed maphash.Seed
+	// keys holds the keys of keyDir in order, for the scans by prefix; it is keyDir
+	// itself for KeyDirART
+	keys keyOrder
+	// unmapKeyDir unmaps the snapshot keyDir was opened from, nil if it was not,
+	// check KeyDirMmap
+	unmapKeyDir func() error
+	// liveBytes is the total size of the records keyDir points at
+	liveBytes int64
+	// quotas holds the usage of the prefixes of Options.PrefixQuotas, nil without
+	quotas *prefixQuotas
+	// blobs maps the ids of the blobs of the log to where they are, check
+	// Options.Dedup
+	blobs map[string]*blob
+	// writeOps and writeBytes rate limit the writes, when set in opts
+	writeOps   *tokenBucket
+	writeBytes *tokenBucket
+	// accessClock ticks on every access to a key, giving KeyEntry.lastAccess
+	accessClock uint64
+	// prefixAccess counts the reads and writes of the key prefixes, kept along
+	// with the LifetimeStats, for KeyReport
+	prefixAccess map[string]*PrefixAccess
+	// opts holds the options the store was opened with
+	opts Options
+	// log is opts.Logger, or a logger discarding everything if that is not set
+	log Logger
+	// tracer is opts.Tracer, or a tracer doing nothing if that is not set
+	tracer Tracer
+	// latencies of the operations, reported by Stats; they are recorded once the
+	// store is unlocked, but for the fsyncs of the writes, check shardedHistogram
+	readLatency  shardedHistogram
+	writeLatency shardedHistogram
+	syncLatency  shardedHistogram
+	// lifetime holds the counters saved by the previous runs, to which Compact
+	// adds its own, and openedAt is when this run started. Check lifetimeStats
+	lifetime LifetimeStats
+	openedAt time.Time
+	// id is the identity of the store, check ID
+	id string
+	// lastSyncErr is the error of the last fsync, nil if it succeeded, and syncErr
+	// that of the first one which failed with writes left unsynced; those were
+	// acknowledged, and may be lost, so it fails the writes and Healthy until the
+	// store is reopened, check syncFile
+	lastSyncErr error
+	syncErr     error
+	// unsynced is set while the active file has writes not synced yet, check
+	// Options.SyncInterval; committing is set while a Txn is committed, whose
+	// writes are synced regardless
+	unsynced   bool
+	committing bool
+	// inIntent is set while Txn.Commit writes the records of an intent, which
+	// must not straddle segments
+	inIntent bool
+	// batch holds the records of the intent being written, appended to the file
+	// all at once by flushBatch
+	batch *writeBatch
+	// lease is ours on lockPath, in network filesystem mode, and leaseErr is set
+	// once it was lost, failing the writes; check acquireLease
+	lease    *lease
+	lockPath string
+	leaseErr error
+	// lock holds the lock of the OS on the lock file, on a local disk, check
+	// lockStore
+	lock *os.File
+	// readOnly is set for a store opened with OpenReadOnly, which follows the
+	// files another process writes to, check Refresh
+	readOnly bool
+	// mu guards everything above, making the store safe to use from multiple
+	// goroutines. The operations are serialised: there is a single file cursor
+	// which both reads and writes move around
+	mu sync.Mutex
+	// dicts maps the ids of the dictionaries of the log to their contents, check
+	// Options.CompactionDictionary. It has a lock of its own, dictMu, as the values
+	// are also decoded after unlocking the store
+	dictMu sync.RWMutex
+	dicts  map[uint32][]byte
+	// keyring holds the keys of Options.EncryptionKeys, and those RotateKey
+	// added. It has a lock of its own, cryptMu, for the same reason
+	cryptMu sync.RWMutex
+	keyring keyring
 }
 
 func isFileExists(fileName string) bool {
@@ -81,129 +214,887 @@ func isFileExists(fileName string) bool {
 }
 
 func NewDiskStore(fileName string) (*DiskStore, error) {
-	ds := &DiskStore{keyDir: make(map[string]KeyEntry)}
-	// if the file exists already, then we will load the key_dir
-	if isFileExists(fileName) {
-		ds.initKeyDir(fileName)
+	return NewDiskStoreWithOptions(fileName, Options{})
+}
+
+// NewDiskStoreWithOptions is like NewDiskStore, but lets the caller tune the store
+// with Options.
+func NewDiskStoreWithOptions(fileName string, opts Options) (ds *DiskStore, err error) {
+	if ds, err = newDiskStore(opts); err != nil {
+		return nil, err
 	}
+	if err := ds.checkNetworkFS(fileName); err != nil {
+		return nil, err
+	}
+	if ds.opts.NetworkFS {
+		err = ds.acquireLease(fileName)
+	} else {
+		ds.lock, err = lockStore(fileName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the store is returned as nil on failure, so the release goes by another name
+	locked := ds
+	defer func() {
+		if err != nil {
+			locked.background.stop()
+			locked.releaseLease()
+			locked.unlock()
+		}
+	}()
+	if opts.ColdDir != "" {
+		if err := os.MkdirAll(opts.ColdDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	start := time.Now()
+	ds.openedAt = start
+	ds.loadStats(fileName)
+	ds.onLoad = opts.OnLoad
+	// if the files exist already, then we will load the key_dir, unless we can
+	// map the one we saved when we last closed
+	if !ds.mapKeyDir(fileName) {
+		if err := ds.loadSegments(fileName); err != nil {
+			ds.log.Error("failed to load store", "file", fileName, "error", err)
+			return nil, err
+		}
+		if opts.LoadInBackground {
+			return ds, ds.openInBackground(fileName, start)
+		}
+		if err := ds.loadActive(fileName); err != nil {
+			ds.log.Error("failed to load store", "file", fileName, "error", err)
+			return nil, err
+		}
+	}
+	if err := ds.openActive(fileName); err != nil {
+		ds.releaseKeyDir()
+		return nil, err
+	}
+	if err := ds.finishOpen(fileName, start); err != nil {
+		ds.releaseKeyDir()
+		ds.file.Close()
+		return nil, err
+	}
+	if opts.OnOpen != nil {
+		if err := opts.OnOpen(ds); err != nil {
+			ds.Close()
+			return nil, err
+		}
+	}
+	return ds, nil
+}
+
+// openActive opens the active file for writing.
+func (d *DiskStore) openActive(fileName string) error {
 	// we open the file in following modes:
 	//	os.O_APPEND - says that the writes are append only.
 	// 	os.O_RDWR - says we can read and write to the file
 	// 	os.O_CREATE - creates the file if it does not exist
-	file, err := os.OpenFile(fileName, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0666)
+	//	os.O_SYNC - on a network filesystem, check Options.NetworkFS
+	file, err := openFile(fileName, d.openFlags(), 0666)
 	if err != nil {
+		d.log.Error("failed to open store", "file", fileName, "error", err)
+		return err
+	}
+	d.file, d.fileName = file, fileName
+	d.active().file = file
+	return nil
+}
+
+// finishOpen cleans up after the previous run once the store is loaded, and
+// starts the next epoch. The store must be locked, or not shared yet.
+func (d *DiskStore) finishOpen(fileName string, start time.Time) error {
+	d.onLoad = nil
+	err := d.dropBefore()
+	if err == nil {
+		err = d.dropMerged()
+	}
+	if err != nil {
+		d.log.Error("failed to load store", "file", fileName, "error", err)
+		return err
+	}
+	d.dropExpiredSegments(time.Now())
+	// pick up the moves to the cold tier which did not complete before we stopped
+	for _, seg := range d.segments[:len(d.segments)-1] {
+		d.demote(seg)
+	}
+	if d.id == "" {
+		if d.id, err = newStoreID(); err != nil {
+			return err
+		}
+	}
+	if d.opts.SnapshotLeakThreshold > 0 {
+		d.background.Go(d.reportLeakedSnapshotsEvery)
+	}
+	if d.opts.SyncInterval > 0 && d.opts.shared == nil {
+		// the Manager of the store syncs it along with the others otherwise
+		d.background.Go(d.syncEvery)
+	}
+	if d.opts.TrashDelay > 0 {
+		d.background.Go(func(ctx context.Context) error {
+			return d.emptyTrashEvery(ctx, fileName)
+		})
+	}
+	// saved right away, so that a crash does not hand out the epoch again
+	d.lifetime.Epoch++
+	d.saveStats()
+	d.log.Info("opened store", "file", fileName, "keys", d.keyDir.size(), "segments", len(d.segments), "size", d.writePosition, "duration", time.Since(start))
+	return nil
+}
+
+// newDiskStore returns a store with opts applied, and nothing loaded yet.
+func newDiskStore(opts Options) (*DiskStore, error) {
+	ds := &DiskStore{blobs: make(map[string]*blob), tokens: make(map[string]uint32), prefixAccess: make(map[string]*PrefixAccess), opts: opts, log: opts.Logger, tracer: opts.Tracer}
+	if ds.log == nil {
+		ds.log = nopLogger{}
+	}
+	if ds.tracer == nil {
+		ds.tracer = nopTracer{}
+	}
+	ds.hashSeed = maphash.MakeSeed()
+	ds.keyDir, ds.keys = ds.newKeyDir()
+	if ds.opts.IdempotencyWindow <= 0 {
+		ds.opts.IdempotencyWindow = DefaultIdempotencyWindow
+	}
+	if ds.opts.TombstoneRetention <= 0 {
+		ds.opts.TombstoneRetention = DefaultTombstoneRetention
+	}
+	if opts.KeyDirIndex == KeyDirMmap && opts.Dedup {
+		return nil, fmt.Errorf("caskdb: keydir %v does not support Options.Dedup", opts.KeyDirIndex)
+	}
+	if _, ok := compressor(opts.Compression); opts.Compression != CompressionNone && !ok {
+		return nil, fmt.Errorf("caskdb: compression %v is not registered", opts.Compression)
+	}
+	for i, key := range opts.EncryptionKeys {
+		if err := ds.addKey(key, i == 0); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if ds.quotas, err = newPrefixQuotas(opts.PrefixQuotas); err != nil {
 		return nil, err
 	}
-	ds.file = file
+	ds.coldCache = newRecordCache(opts.ColdCacheBytes)
+	if opts.shared != nil {
+		ds.coldCache = opts.shared.coldCache()
+	}
+	ds.background = newSupervisor()
+	if opts.WriteOpsPerSecond > 0 {
+		ds.writeOps = newTokenBucket(opts.WriteOpsPerSecond)
+	}
+	if opts.WriteBytesPerSecond > 0 {
+		ds.writeBytes = newTokenBucket(float64(opts.WriteBytesPerSecond))
+	}
 	return ds, nil
 }
 
+// normalizeKey returns the key as it is stored, check Options.NormalizeKey.
+func (d *DiskStore) normalizeKey(key string) string {
+	if d.opts.NormalizeKey == nil {
+		return key
+	}
+	return d.opts.NormalizeKey(key)
+}
+
 func (d *DiskStore) Get(key string) string {
 	// Get retrieves the value from the disk and returns. If the key does not
-	// exist then it returns an empty string
-	//
+	// exist then it returns an empty string. Check Lookup if you need to tell
+	// apart the failures.
+	value, err := d.Lookup(key)
+	if errors.Is(err, ErrKeyNotFound) {
+		return ""
+	}
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
+
+// Lookup is like Get, but reports why it could not return a value: ErrKeyNotFound
+// if the key does not exist, ErrCorruptRecord if the record fails verification,
+// ErrKeyMismatch if the record on disk belongs to another key, or the underlying
+// I/O error.
+func (d *DiskStore) Lookup(key string) (string, error) {
+	return d.LookupContext(context.Background(), key)
+}
+
+// LookupContext is like Lookup, and the span of the lookup is a child of the span
+// in ctx. Check Options.Tracer. Once Options.ReadTimeout passed, it stops waiting
+// for the lookup and returns ErrTimeout, and likewise with the error of ctx once
+// it is done.
+func (d *DiskStore) LookupContext(ctx context.Context, key string) (string, error) {
+	if !bounded(ctx, d.opts.ReadTimeout) {
+		return d.lookup(ctx, key)
+	}
+	return withDeadline(ctx, d.opts.ReadTimeout, func(ctx context.Context) (string, error) {
+		return d.lookup(ctx, key)
+	})
+}
+
+// lookup is LookupContext, without a deadline.
+func (d *DiskStore) lookup(ctx context.Context, key string) (value string, err error) {
+	key = d.normalizeKey(key)
+	span := d.tracer.Start(ctx, "caskdb.Get")
+	defer func() { span.End(err) }()
+	start, size, segment := time.Now(), 0, ""
+	defer func() { d.observe("Get", key, size, segment, start) }()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	span.SetAttribute(spanAttrWait, int64(time.Since(start)))
 	// How get works?
 	//	1. Check if there is any KeyEntry record for the key in keyDir
-	//	2. Return an empty string if key doesn't exist
+	//	2. Return ErrKeyNotFound if key doesn't exist
 	//	3. If it exists, then read KeyEntry.totalSize bytes starting from the
 	//     KeyEntry.position from the disk
 	//	4. Decode the bytes into valid KV pair and return the value
 	//
-	kEntry, ok := d.keyDir[key]
-	if !ok {
-		return ""
+	kEntry, ok := d.keyDir.get(key)
+	if !ok || kEntry.expired(start) {
+		return "", ErrKeyNotFound
 	}
-	// move the current pointer to the right offset
-	// TODO: handle errors
-	d.file.Seek(int64(kEntry.position), defaultWhence)
-	data := make([]byte, kEntry.totalSize)
-	// TODO: handle errors
-	_, err := io.ReadFull(d.file, data)
+	segment = d.segmentOf(kEntry)
+	value, err = d.read(key, kEntry)
 	if err != nil {
-		panic("read error")
+		return "", err
 	}
-	_, _, value := decodeKV(data)
-	return value
+	d.touch(key, kEntry)
+	size = int(kEntry.totalSize)
+	span.SetAttribute(spanAttrBytes, int64(size))
+	span.SetAttribute(spanAttrValueSize, int64(len(value)))
+	return value, nil
+}
+
+// read reads the value of the key from the record kEntry points at.
+func (d *DiskStore) read(key string, kEntry KeyEntry) (string, error) {
+	value, _, err := d.readFlags(key, kEntry)
+	return value, err
+}
+
+// readFlags is like read, and also returns the flags of the record, those of the
+// blob for a key referencing one.
+func (d *DiskStore) readFlags(key string, kEntry KeyEntry) (string, RecordFlags, error) {
+	if kEntry.blob != nil {
+		key, kEntry = blobKeyPrefix+kEntry.blob.id, kEntry.blob.at
+	}
+	seg := d.segment(kEntry.segment)
+	if seg == nil {
+		return "", 0, fmt.Errorf("%w: key %q points at missing segment %d", ErrKeyMismatch, key, kEntry.segment)
+	}
+	if !seg.remote {
+		// the record is only needed until it is decoded, so it is read into the
+		// scratch buffer rather than one of its own
+		buf := d.scratch(int(kEntry.totalSize))
+		defer d.releaseScratch(buf)
+		data, err := d.readLocal(seg, kEntry, buf)
+		if err != nil {
+			return "", 0, err
+		}
+		return d.decodeRecord(seg, key, kEntry, data)
+	}
+	at := recordKey{seg.id, kEntry.position}
+	if value, flags, ok := d.coldCache.value(at); ok {
+		return value, flags, nil
+	}
+	data, err := d.readRemote(seg, kEntry)
+	if err != nil {
+		return "", 0, err
+	}
+	value, flags, err := d.decodeRecord(seg, key, kEntry, data)
+	if err != nil {
+		return "", 0, err
+	}
+	d.coldCache.setValue(at, value, flags)
+	return value, flags, nil
+}
+
+// maxScratchBytes is the size of the largest record read into the scratch buffer
+// of the store, so that the buffer does not hold on to a huge one
+const maxScratchBytes = 64 << 10
+
+// scratch returns a buffer of n bytes, to read a record into and decode it. It is
+// reused by the next read, so nothing of it must be kept. The store must be
+// locked.
+func (d *DiskStore) scratch(n int) []byte {
+	if n > maxScratchBytes {
+		return make([]byte, n)
+	}
+	if d.opts.shared != nil {
+		return d.opts.shared.buffers.Get().(*[maxScratchBytes]byte)[:n]
+	}
+	if cap(d.readBuf) < n {
+		d.readBuf = make([]byte, n)
+	}
+	return d.readBuf[:n]
+}
+
+// releaseScratch hands the scratch buffer back to the buffers of the Manager of
+// the store, once the value read into it is decoded.
+func (d *DiskStore) releaseScratch(buf []byte) {
+	if d.opts.shared != nil && cap(buf) == maxScratchBytes {
+		d.opts.shared.buffers.Put((*[maxScratchBytes]byte)(buf[:maxScratchBytes]))
+	}
+}
+
+// decodeRecord checks that data, the record kEntry points at in the segment, is
+// the key's, and returns its value and flags.
+func (d *DiskStore) decodeRecord(seg *segment, key string, kEntry KeyEntry, data []byte) (string, RecordFlags, error) {
+	// the record was verified when we loaded it, but in paranoid mode we do not
+	// trust the disk to have kept it intact since then
+	if d.opts.ParanoidReads && !verifyKV(data) {
+		d.log.Error("corrupt record", "file", seg.path, "key", key, "offset", kEntry.position)
+		return "", 0, fmt.Errorf("%w: key %q at offset %d", ErrCorruptRecord, key, kEntry.position)
+	}
+	_, keySize, _ := decodeHeader(data)
+	// keyDir pointing us at some other key's record means the index is broken,
+	// and serving that value would silently hand out someone else's data. The
+	// comparison does not copy the stored key
+	if storedKey := data[headerSize : headerSize+keySize]; string(storedKey) != key {
+		d.log.Error("key mismatch", "file", seg.path, "key", key, "found", string(storedKey), "offset", kEntry.position)
+		return "", 0, fmt.Errorf("%w: looked up %q, found %q at offset %d", ErrKeyMismatch, key, storedKey, kEntry.position)
+	}
+	value, err := d.decodeValue(data)
+	if err != nil {
+		return "", 0, fmt.Errorf("key %q at offset %d: %w", key, kEntry.position, err)
+	}
+	return value, decodeFlags(data), nil
+}
+
+// readRecord reads the raw bytes of the record kEntry points at in the segment.
+func (d *DiskStore) readRecord(seg *segment, kEntry KeyEntry) ([]byte, error) {
+	return d.readRecordPrefix(seg, kEntry, int(kEntry.totalSize))
+}
+
+// readRecordPrefix reads the first n bytes of the record kEntry points at in the
+// segment, or all of it for a remote segment, which is read whole.
+func (d *DiskStore) readRecordPrefix(seg *segment, kEntry KeyEntry, n int) ([]byte, error) {
+	if seg.remote {
+		return d.readRemote(seg, kEntry)
+	}
+	return d.readLocal(seg, kEntry, make([]byte, n))
+}
+
+// readLocal reads the first len(data) bytes of the record kEntry points at in the
+// local segment into data.
+func (d *DiskStore) readLocal(seg *segment, kEntry KeyEntry, data []byte) ([]byte, error) {
+	if seg != d.active() {
+		// sealed segments are only read from, at the offsets we ask for
+		r, err := d.openSegment(seg)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := r.ReadAt(data, int64(kEntry.position)); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+	// move the current pointer to the right offset
+	if _, err := d.file.Seek(int64(kEntry.position), defaultWhence); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(d.file, data); err != nil {
+		return nil, err
+	}
+	return data, nil
 }
 
 func (d *DiskStore) Set(key string, value string) {
-	// Set stores the key and value on the disk
-	//
+	// Set stores the key and value on the disk. It panics if the write fails,
+	// check Put if you need to handle the failure.
+	if err := d.Put(key, value); err != nil {
+		panic(err)
+	}
+}
+
+// Put is like Set, but returns the error instead of panicking when the record
+// could not be written and synced to the disk.
+func (d *DiskStore) Put(key string, value string) error {
+	return d.PutContext(context.Background(), key, value)
+}
+
+// PutContext is like Put, and the span of the write is a child of the span in ctx.
+// Check Options.Tracer. Once Options.WriteTimeout passed, it stops waiting for the
+// write and returns ErrTimeout, and likewise with the error of ctx once it is
+// done; the write may still be applied afterwards.
+func (d *DiskStore) PutContext(ctx context.Context, key string, value string) error {
+	return d.putContext(ctx, key, value, 0)
+}
+
+// putContext is like PutContext, and sets the flags on the record, on top of
+// those it gets anyway.
+func (d *DiskStore) putContext(ctx context.Context, key string, value string, flags RecordFlags) error {
+	if !bounded(ctx, d.opts.WriteTimeout) {
+		return d.set(ctx, key, value, flags)
+	}
+	_, err := withDeadline(ctx, d.opts.WriteTimeout, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, d.set(ctx, key, value, flags)
+	})
+	return err
+}
+
+// set is putContext, without a deadline.
+func (d *DiskStore) set(ctx context.Context, key string, value string, flags RecordFlags) (err error) {
+	key = d.normalizeKey(key)
+	// an empty value is how we record a deletion on the disk, so that is what
+	// setting a key to one means
+	if value == "" {
+		return d.delete(ctx, key)
+	}
+	span := d.tracer.Start(ctx, "caskdb.Set")
+	defer func() { span.End(err) }()
+	span.SetAttribute(spanAttrValueSize, int64(len(value)))
+	waited := time.Now()
+	if err := d.throttle(ctx, headerSize+len(key)+len(value)); err != nil {
+		return err
+	}
+	start, size := time.Now(), 0
+	defer func() { d.observe("Set", key, size, d.fileName, start) }()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	span.SetAttribute(spanAttrWait, int64(time.Since(waited)))
+	token := IdempotencyToken(ctx)
+	if d.seen(token, start) {
+		// a retry of a write we applied already
+		return nil
+	}
+	if size, err = d.putAt(key, value, uint32(start.Unix()), 0, token, flags); err != nil {
+		return err
+	}
+	span.SetAttribute(spanAttrBytes, int64(size))
+	if d.opts.OnSet != nil {
+		d.opts.OnSet(key, value)
+	}
+	return nil
+}
+
+// put writes the record of the key and points keyDir at it, returning the size of
+// the record. expiry is the unix time after which the key is gone, 0 for never.
+func (d *DiskStore) put(key string, value string, expiry uint32) (int, error) {
+	return d.putAt(key, value, uint32(time.Now().Unix()), expiry, "", 0)
+}
+
+// putAt is like put, with the timestamp of the record given rather than now. If
+// token is set, it is recorded as seen along with the record. The flags are set on
+// the record on top of those encodeRecord sets.
+func (d *DiskStore) putAt(key string, value string, timestamp uint32, expiry uint32, token string, flags RecordFlags) (int, error) {
 	// The steps to save a KV to disk is simple:
 	// 1. Encode the KV into bytes
 	// 2. Write the bytes to disk by appending to the file
 	// 3. Update KeyDir with the KeyEntry of this key
-	timestamp := uint32(time.Now().Unix())
-	size, data := encodeKV(timestamp, key, value)
-	d.write(data)
-	d.keyDir[key] = NewKeyEntry(timestamp, uint32(d.writePosition), uint32(size))
+	if err := checkKey(key); err != nil {
+		return 0, err
+	}
+	var block string
+	if flags&FlagMeta != 0 {
+		// the metadata stays in front of the value, as is
+		var err error
+		if block, value, err = splitMeta(value); err != nil {
+			return 0, err
+		}
+	} else if d.dedups(value) {
+		return d.putRef(key, value, timestamp, expiry, token, flags)
+	}
+	value, flags, err := d.encodeValue(value, flags)
+	if err != nil {
+		return 0, err
+	}
+	size, data := encodeRecordFlags(timestamp, expiry, key, block+value, flags)
+	data = d.appendToken(data, token, timestamp)
+	if err := d.checkQuota(key, len(data)); err != nil {
+		return 0, err
+	}
+	if err := d.writeKey(data); err != nil {
+		return 0, err
+	}
+	kEntry := NewKeyEntry(timestamp, uint32(d.writePosition), uint32(size))
+	kEntry.segment = d.active().id
+	kEntry.expiry = expiry
+	d.setKey(key, d.retain(kEntry))
 	// update last write position, so that next record can be written from this point
-	d.writePosition += size
+	d.writePosition += len(data)
+	d.remember(token, timestamp)
+	d.countAccess(key, true)
+	return size, nil
+}
+
+// Delete removes the key from the store. Deleting a key which does not exist is
+// not an error.
+func (d *DiskStore) Delete(key string) error {
+	return d.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is like Delete, and the span of the delete is a child of the span
+// in ctx. Check Options.Tracer. Like PutContext, it stops waiting for the delete
+// once ctx is done or Options.WriteTimeout passed.
+func (d *DiskStore) DeleteContext(ctx context.Context, key string) error {
+	if !bounded(ctx, d.opts.WriteTimeout) {
+		return d.delete(ctx, key)
+	}
+	_, err := withDeadline(ctx, d.opts.WriteTimeout, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, d.delete(ctx, key)
+	})
+	return err
+}
+
+// delete is DeleteContext, without a deadline.
+func (d *DiskStore) delete(ctx context.Context, key string) (err error) {
+	key = d.normalizeKey(key)
+	span := d.tracer.Start(ctx, "caskdb.Delete")
+	defer func() { span.End(err) }()
+	waited := time.Now()
+	if err := d.throttle(ctx, headerSize+len(key)); err != nil {
+		return err
+	}
+	start, size := time.Now(), 0
+	defer func() { d.observe("Delete", key, size, d.fileName, start) }()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	span.SetAttribute(spanAttrWait, int64(time.Since(waited)))
+	// We cannot remove the old records from the file, since it is append only.
+	// Instead, we append a tombstone: a record with an empty value. When we load
+	// the keyDir at startup, a tombstone removes the key loaded before it.
+	token := IdempotencyToken(ctx)
+	if d.seen(token, start) {
+		// a retry of a delete we applied already
+		return nil
+	}
+	if _, ok := d.keyDir.get(key); !ok {
+		// there is nothing to delete, but the token still has to be recorded, so
+		// that a retry arriving after the key is set again does not delete it
+		return d.writeToken(token, uint32(start.Unix()))
+	}
+	if size, err = d.tombstone(key, uint32(start.Unix()), token); err != nil {
+		return err
+	}
+	span.SetAttribute(spanAttrBytes, int64(size))
+	if d.opts.OnDelete != nil {
+		d.opts.OnDelete(key)
+	}
+	return nil
+}
+
+// tombstone writes the tombstone of the key and removes it from keyDir, returning
+// the size of the record. If token is set, it is recorded as seen along with the
+// tombstone.
+func (d *DiskStore) tombstone(key string, timestamp uint32, token string) (int, error) {
+	if err := checkKey(key); err != nil {
+		return 0, err
+	}
+	size, data := encodeKV(timestamp, key, "")
+	data = d.appendToken(data, token, timestamp)
+	if err := d.writeKey(data); err != nil {
+		return 0, err
+	}
+	d.dropKey(key)
+	d.writePosition += len(data)
+	d.remember(token, timestamp)
+	d.countAccess(key, true)
+	return size, nil
+}
+
+// setKey points keyDir at the new record of the key. The store must be locked.
+func (d *DiskStore) setKey(key string, kEntry KeyEntry) {
+	old, ok := d.keyDir.get(key)
+	if ok {
+		d.liveBytes -= int64(old.totalSize)
+		d.quotas.add(key, 0, int64(kEntry.totalSize)-int64(old.totalSize))
+	} else {
+		d.keys.insert(key)
+		d.quotas.add(key, 1, int64(kEntry.totalSize))
+	}
+	d.liveBytes += int64(kEntry.totalSize)
+	d.accessClock++
+	kEntry.lastAccess, kEntry.hits = d.accessClock, old.hits+1
+	d.keyDir.set(key, kEntry)
+}
+
+// dropKey removes the key from keyDir. The store must be locked.
+func (d *DiskStore) dropKey(key string) {
+	if old, ok := d.keyDir.get(key); ok {
+		d.liveBytes -= int64(old.totalSize)
+		d.quotas.add(key, -1, -int64(old.totalSize))
+		d.keyDir.remove(key)
+		d.keys.remove(key)
+	}
+}
+
+// resetKeys empties keyDir. The store must be locked.
+func (d *DiskStore) resetKeys() {
+	d.keyDir, d.keys = d.newKeyDir()
+	d.liveBytes = 0
+	d.quotas.reset()
+	d.blobs = make(map[string]*blob)
 }
 
 func (d *DiskStore) Close() bool {
 	// before we close the file, we need to safely write the contents in the buffers
 	// to the disk. Check documentation of DiskStore.write() to understand
 	// following the operations
-	// TODO: handle errors
-	d.file.Sync()
-	if err := d.file.Close(); err != nil {
-		// TODO: log the error
-		return false
+	//
+	// the background work is stopped first, as it takes the lock; the first error
+	// it ran into makes Close report failure
+	backgroundErr := d.background.stop()
+	if backgroundErr != nil {
+		d.log.Error("background work failed", "file", d.file.Name(), "error", backgroundErr)
 	}
-	return true
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.readOnly && d.loadErr == nil {
+		d.syncFile()
+		d.saveStats()
+		d.saveKeyDir()
+	}
+	d.releaseKeyDir()
+	d.closeSegments()
+	if d.io != nil {
+		d.io.close()
+	}
+	closeErr := d.file.Close()
+	if closeErr != nil {
+		d.log.Error("close failed", "file", d.file.Name(), "error", closeErr)
+	}
+	d.releaseLease()
+	d.unlock()
+	return closeErr == nil && backgroundErr == nil
+}
+
+// Sync flushes the active file to the disk. Every write is synced as it is made,
+// unless Options.SyncInterval is set, so there is nothing left to flush in normal
+// operation; after an fsync failed, Sync retries it, and Healthy reports the store
+// ready again once it succeeds, unless it failed with writes left unsynced by
+// Options.SyncInterval. Those may be lost then, and Sync, the writes and Healthy
+// fail with ErrSyncFailed until the store is reopened.
+func (d *DiskStore) Sync() error {
+	if d.readOnly {
+		// nothing was written
+		return nil
+	}
+	start := time.Now()
+	defer d.observe("Sync", "", 0, d.fileName, start)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.syncFile(); err != nil {
+		return err
+	}
+	if d.syncErr != nil {
+		return d.syncFailure()
+	}
+	return nil
+}
+
+func (d *DiskStore) write(data []byte) error {
+	return d.writeRecord(data, true)
 }
 
-func (d *DiskStore) write(data []byte) {
+// writeKey is write for the record of a key set or deleted, which is left for the
+// next sync of the store with Options.SyncInterval, unless a Txn is committed.
+func (d *DiskStore) writeKey(data []byte) error {
+	return d.writeRecord(data, d.opts.SyncInterval <= 0 || d.committing)
+}
+
+// writeRecord appends the record to the active file, and fsyncs it if sync is
+// set, or else leaves it to syncEvery.
+func (d *DiskStore) writeRecord(data []byte, sync bool) error {
 	// saving stuff to a file reliably is hard!
 	// if you would like to explore and learn more, then
 	// start from here: https://danluu.com/file-consistency/
 	// and read this too: https://lwn.net/Articles/457667/
+	//
+	// a record never straddles two segments, so when it would take the active one
+	// past its limit, we start a new one first
+	//
+	// likewise, a record starts a new segment when it comes in a later period than
+	// the first record of the active one
+	//
+	// the records of an intent stay together though, even past the limit
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	if d.loadErr != nil {
+		// the keyDir is incomplete, whatever we write may be lost on its next load
+		return d.loadErr
+	}
+	if d.leaseErr != nil {
+		// another writer may be appending to the file meanwhile
+		return d.leaseErr
+	}
+	if d.syncErr != nil {
+		// writes acknowledged before may be lost, check syncFile
+		return d.syncFailure()
+	}
+	now := time.Now()
+	if d.writePosition > 0 && !d.inIntent && (d.segmentFull(len(data)) || d.periodOver(now)) {
+		if err := d.rotate(); err != nil {
+			return err
+		}
+	}
+	if err := d.startFile(now); err != nil {
+		return err
+	}
+	d.active().latest = now
+	if d.batch != nil {
+		d.batch.add(data, d.writePosition)
+		return nil
+	}
 	if _, err := d.file.Write(data); err != nil {
-		panic(err)
+		d.log.Error("write failed", "file", d.file.Name(), "offset", d.writePosition, "error", err)
+		return err
+	}
+	if !sync {
+		d.unsynced = true
+		return nil
 	}
 	// calling fsync after every write is important, this assures that our writes
 	// are actually persisted to the disk
-	if err := d.file.Sync(); err != nil {
-		panic(err)
+	start := time.Now()
+	defer d.observe("Sync", "", len(data), d.file.Name(), start)
+	return d.syncFile()
+}
+
+// startFile writes the format record at the start of the active file, if nothing
+// was written to it yet. The store must be locked.
+func (d *DiskStore) startFile(now time.Time) error {
+	if d.writePosition > 0 {
+		return nil
 	}
+	d.active().started = now
+	data := formatRecord(uint32(now.Unix()))
+	if d.batch != nil {
+		d.batch.add(data, d.writePosition)
+	} else if _, err := d.file.Write(data); err != nil {
+		d.log.Error("write failed", "file", d.file.Name(), "offset", d.writePosition, "error", err)
+		return err
+	}
+	d.writePosition += len(data)
+	return nil
+}
+
+// segmentFull reports whether n more bytes would take the active segment past
+// Options.MaxSegmentBytes. The store must be locked.
+func (d *DiskStore) segmentFull(n int) bool {
+	max := d.opts.MaxSegmentBytes
+	return max > 0 && int64(d.writePosition+n) > max
 }
 
-func (d *DiskStore) initKeyDir(existingFile string) {
-	// we will initialise the keyDir by reading the contents of the file, record by
-	// record. As we read each record, we will also update our keyDir with the
-	// corresponding KeyEntry
+// periodOver reports whether now is past the Options.SegmentPeriod of the first
+// record of the active segment. The periods count from the zero time, so a day
+// starts at midnight UTC. The store must be locked.
+func (d *DiskStore) periodOver(now time.Time) bool {
+	period := d.opts.SegmentPeriod
+	return period > 0 && now.Truncate(period).After(d.active().started.Truncate(period))
+}
+
+func (d *DiskStore) initKeyDir(fileName string) error {
+	// we will initialise the keyDir by reading the contents of the segments, oldest
+	// first and record by record. As we read each record, we will also update our
+	// keyDir with the corresponding KeyEntry, so the newest record of a key wins
 	//
 	// NOTE: this method is a blocking one, if the DB size is yuge then it will take
-	// a lot of time to startup
-	file, _ := os.Open(existingFile)
-	defer file.Close()
+	// a lot of time to startup. Options.LoadInBackground leaves the active file for
+	// later
+	if err := d.loadSegments(fileName); err != nil {
+		return err
+	}
+	return d.loadActive(fileName)
+}
+
+// loadSegments loads the sealed segments, and adds the active one, not loaded
+// yet.
+func (d *DiskStore) loadSegments(fileName string) error {
+	segments, err := findSegments(fileName, d.opts.ColdDir)
+	if err != nil {
+		return err
+	}
+	for _, seg := range segments {
+		if seg.remote {
+			err = d.loadRemoteIndex(seg)
+		} else {
+			err = d.loadSealed(seg)
+		}
+		if err == nil {
+			err = d.onLoadErr
+		}
+		if err != nil {
+			// a read-only store keeps the segments it loaded open
+			for _, seg := range segments {
+				if seg.file != nil {
+					seg.file.Close()
+				}
+			}
+			return err
+		}
+	}
+	// a read-only store reads the active file through the handle it opened first,
+	// which may have been sealed since
+	active := &segment{id: 1, path: fileName, file: d.file}
+	if len(segments) > 0 {
+		active.id = segments[len(segments)-1].id + 1
+	}
+	d.segments = append(segments, active)
+	return nil
+}
+
+// loadActive loads the active segment, once the sealed ones are.
+func (d *DiskStore) loadActive(fileName string) error {
+	active := d.active()
+	// the active file does not exist yet for a new store
+	if active.file != nil || isFileExists(fileName) {
+		if err := d.loadSegment(active); err != nil {
+			return err
+		}
+		if d.onLoadErr != nil {
+			return d.onLoadErr
+		}
+	}
+	d.writePosition = int(active.size)
+	d.sweepBlobs()
+	return nil
+}
+
+// errPartialRecord is returned by scanRecords when the file ends in the middle of
+// a record
+var errPartialRecord = errors.New("caskdb: partially written record")
+
+// scanRecords reads the records from r, which holds size bytes, one after the
+// other, starting at offset 0, and calls fn with the byte offset and the raw bytes
+// of each record. The records are not verified, that is left to fn, but a record
+// is only read in if it fits in what is left of r, so that a corrupt header cannot
+// have us allocate gigabytes. Scanning stops at the end of the file, at a
+// partially written record at the tail or a header claiming more than is left
+// (returning errPartialRecord), or when fn returns an error, which is then returned
+// to the caller.
+func scanRecords(r io.Reader, size int64, fn func(offset int, data []byte) error) error {
+	offset := 0
 	for {
 		header := make([]byte, headerSize)
-		_, err := io.ReadFull(file, header)
+		_, err := io.ReadFull(r, header)
 		if err == io.EOF {
-			break
+			return nil
 		}
-		// TODO: handle errors
-		if err != nil {
-			break
+		if err == io.ErrUnexpectedEOF {
+			return errPartialRecord
 		}
-		timestamp, keySize, valueSize := decodeHeader(header)
-		key := make([]byte, keySize)
-		value := make([]byte, valueSize)
-		_, err = io.ReadFull(file, key)
-		// TODO: handle errors
 		if err != nil {
-			break
+			return err
+		}
+		_, keySize, valueSize := decodeHeader(header)
+		// in int64, as the sizes of a corrupt header may overflow a uint32
+		totalSize := int64(headerSize) + int64(keySize) + int64(valueSize)
+		if totalSize > size-int64(offset) {
+			return errPartialRecord
+		}
+		data := make([]byte, totalSize)
+		copy(data, header)
+		_, err = io.ReadFull(r, data[headerSize:])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errPartialRecord
 		}
-		_, err = io.ReadFull(file, value)
-		// TODO: handle errors
 		if err != nil {
-			break
+			return err
+		}
+		if err := fn(offset, data); err != nil {
+			return err
 		}
-		totalSize := headerSize + keySize + valueSize
-		d.keyDir[string(key)] = NewKeyEntry(timestamp, uint32(d.writePosition), totalSize)
-		d.writePosition += int(totalSize)
-		fmt.Printf("loaded key=%s, value=%s\n", key, value)
+		offset += int(totalSize)
 	}
 }
@@ -1,8 +1,20 @@
 package caskdb
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestDiskStore_Get(t *testing.T) {
@@ -11,6 +23,7 @@ func TestDiskStore_Get(t *testing.T) {
 		t.Fatalf("failed to create disk store: %v", err)
 	}
 	defer os.Remove("test.db")
+	defer store.Close()
 	store.Set("name", "jojo")
 	if val := store.Get("name"); val != "jojo" {
 		t.Errorf("Get() = %v, want %v", val, "jojo")
@@ -23,6 +36,7 @@ func TestDiskStore_GetInvalid(t *testing.T) {
 		t.Fatalf("failed to create disk store: %v", err)
 	}
 	defer os.Remove("test.db")
+	defer store.Close()
 	if val := store.Get("some key"); val != "" {
 		t.Errorf("Get() = %v, want %v", val, "")
 	}
@@ -102,3 +116,389 @@ func TestDiskStore_Delete(t *testing.T) {
 	}
 	store.Close()
 }
+
+func TestDiskStore_ParanoidReads(t *testing.T) {
+	store, err := NewDiskStoreWithOptions("test.db", Options{ParanoidReads: true})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("othello", "shakespeare")
+	if val, err := store.Lookup("othello"); err != nil || val != "shakespeare" {
+		t.Fatalf("Lookup() = %v, %v, want %v, nil", val, err, "shakespeare")
+	}
+
+	// rot a byte of the value behind the store's back
+	f, err := os.OpenFile("test.db", os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatalf("failed to open db file: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("S"), int64(len(formatRecord(0))+headerSize+len("othello"))); err != nil {
+		t.Fatalf("failed to corrupt db file: %v", err)
+	}
+	f.Close()
+
+	if _, err := store.Lookup("othello"); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("Lookup() error = %v, want %v", err, ErrCorruptRecord)
+	}
+	if _, err := store.Lookup("some key"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Lookup() error = %v, want %v", err, ErrKeyNotFound)
+	}
+	store.Close()
+
+	// the corruption is caught at startup as well
+	if _, err := NewDiskStore("test.db"); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("NewDiskStore() error = %v, want %v", err, ErrCorruptRecord)
+	}
+}
+
+func TestDiskStore_UnsupportedRecord(t *testing.T) {
+	defer os.Remove("test.db")
+	_, data := encodeKV(10, "othello", "shakespeare")
+	// as if a newer version set a flag we do not know
+	data[11] = 0x80
+	binary.LittleEndian.PutUint32(data[0:4], crc32.ChecksumIEEE(data[4:]))
+	if err := os.WriteFile("test.db", data, 0666); err != nil {
+		t.Fatalf("failed to write the record: %v", err)
+	}
+	if _, err := NewDiskStore("test.db"); !errors.Is(err, ErrUnsupportedRecord) {
+		t.Errorf("NewDiskStore() error = %v, want %v", err, ErrUnsupportedRecord)
+	}
+}
+
+// legacyRecord returns a record of version 1 of the format, with a 12 byte header,
+// or of version 2, with a crc and a 16 byte header.
+func legacyRecord(version int, key string, value string) []byte {
+	n := 4 * (version + 2)
+	data := make([]byte, n, n+len(key)+len(value))
+	binary.LittleEndian.PutUint32(data[n-12:], 10)
+	binary.LittleEndian.PutUint32(data[n-8:], uint32(len(key)))
+	binary.LittleEndian.PutUint32(data[n-4:], uint32(len(value)))
+	data = append(append(data, key...), value...)
+	if version == 2 {
+		binary.LittleEndian.PutUint32(data[0:4], crc32.ChecksumIEEE(data[4:]))
+	}
+	return data
+}
+
+func TestDiskStore_UnsupportedFormat(t *testing.T) {
+	_, newer := encodeKV(10, formatKeyPrefix+"4", "4")
+	tests := map[string][]byte{
+		"version 1": append(legacyRecord(1, "othello", "shakespeare"), legacyRecord(1, "hamlet", "shakespeare")...),
+		"version 2": append(legacyRecord(2, "othello", "shakespeare"), legacyRecord(2, "hamlet", "shakespeare")...),
+		"version 4": newer,
+	}
+	for name, data := range tests {
+		fileName := filepath.Join(t.TempDir(), "test.db")
+		if err := os.WriteFile(fileName, data, 0666); err != nil {
+			t.Fatalf("failed to write the records: %v", err)
+		}
+		if _, err := NewDiskStore(fileName); !errors.Is(err, ErrUnsupportedFormat) {
+			t.Errorf("NewDiskStore() of %s error = %v, want %v", name, err, ErrUnsupportedFormat)
+		}
+		// the file is left as it was
+		if got, err := os.ReadFile(fileName); err != nil || string(got) != string(data) {
+			t.Errorf("NewDiskStore() of %s changed the file", name)
+		}
+	}
+}
+
+func TestDiskStore_KeyTooLarge(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	if err := store.Put(strings.Repeat("k", maxKeySize+1), "value"); !errors.Is(err, ErrKeyTooLarge) {
+		t.Errorf("Put() of a 16MB key error = %v, want %v", err, ErrKeyTooLarge)
+	}
+}
+
+func TestDiskStore_BinaryKeys(t *testing.T) {
+	keys := []string{"", "\x00", "\x00token", "a", "a\x00", "a\x00b", "\xff\xfe", "caf\xe9", "\x00truncate"}
+	for _, index := range []KeyDirIndex{KeyDirMap, KeyDirART, KeyDirMmap} {
+		fileName := filepath.Join(t.TempDir(), "test.db")
+		opts := Options{KeyDirIndex: index}
+		store, err := NewDiskStoreWithOptions(fileName, opts)
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		for i, key := range keys {
+			if err := store.Put(key, fmt.Sprintf("value %d", i)); err != nil {
+				t.Fatalf("%v: Put(%q) error = %v", index, key, err)
+			}
+		}
+		for _, key := range []string{truncateKey, compactKey, tokenKeyPrefix + "t", blobKeyPrefix} {
+			if err := store.Put(key, "value"); !errors.Is(err, ErrReservedKey) {
+				t.Errorf("%v: Put(%q) error = %v, want %v", index, key, err, ErrReservedKey)
+			}
+		}
+		store.Delete("a")
+		store.Delete("")
+		store.Close()
+
+		store, err = NewDiskStoreWithOptions(fileName, opts)
+		if err != nil {
+			t.Fatalf("failed to reopen disk store: %v", err)
+		}
+		for i, key := range keys {
+			want := fmt.Sprintf("value %d", i)
+			if key == "a" || key == "" {
+				want = ""
+			}
+			if got := store.Get(key); got != want {
+				t.Errorf("%v: Get(%q) after reopening = %q, want %q", index, key, got, want)
+			}
+		}
+		var got []string
+		it := store.Iterator()
+		for it.First(); it.Valid(); it.Next() {
+			got = append(got, it.Key())
+		}
+		want := []string{"\x00", "\x00token", "\x00truncate", "a\x00", "a\x00b", "caf\xe9", "\xff\xfe"}
+		if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", want) {
+			t.Errorf("%v: Iterator() = %q, want %q", index, got, want)
+		}
+		if n := store.CountPrefix("a\x00"); n != 2 {
+			t.Errorf("%v: CountPrefix(a\\x00) = %d, want 2", index, n)
+		}
+		store.Close()
+	}
+}
+
+func TestDiskStore_NormalizeKey(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{NormalizeKey: strings.ToLower})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("Books/Hamlet", "shakespeare")
+	store.Set("BOOKS/Dune", "herbert")
+	store.Set("books/dune", "frank herbert")
+	if got := store.Get("books/HAMLET"); got != "shakespeare" {
+		t.Errorf("Get() = %q, want shakespeare", got)
+	}
+	if got := store.Get("Books/Dune"); got != "frank herbert" {
+		t.Errorf("Get() = %q, want the value set last under any case", got)
+	}
+	if keys := store.Match("BOOKS/*"); fmt.Sprint(keys) != "[books/dune books/hamlet]" {
+		t.Errorf("Match() = %v, want the keys lowercased", keys)
+	}
+	if n := store.CountPrefix("Books/"); n != 2 {
+		t.Errorf("CountPrefix() = %d, want 2", n)
+	}
+	it := store.Iterator()
+	if it.Seek("BOOKS/E"); !it.Valid() || it.Key() != "books/hamlet" {
+		t.Errorf("Iterator().Seek() = %q, want books/hamlet", it.Key())
+	}
+	if err := store.Expire("Books/Hamlet", time.Hour); err != nil {
+		t.Errorf("Expire() error = %v", err)
+	}
+	store.Delete("BOOKS/DUNE")
+	if store.Has("books/dune") {
+		t.Errorf("Has() after Delete() = true, want false")
+	}
+	items, _, err := store.List("BOOKS/", "", 10)
+	if err != nil || len(items) != 1 || items[0].Key != "books/hamlet" {
+		t.Errorf("List() = %v, %v, want books/hamlet", items, err)
+	}
+}
+
+func TestDiskStore_KeyMismatch(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	store.Set("hamlet", "shakespeare")
+	store.Set("dune", "frank herbert")
+
+	// point hamlet at dune's record, as a broken index would
+	store.keyDir.set("hamlet", store.keyEntry("dune"))
+	if _, err := store.Lookup("hamlet"); !errors.Is(err, ErrKeyMismatch) {
+		t.Errorf("Lookup() error = %v, want %v", err, ErrKeyMismatch)
+	}
+	if val := store.Get("dune"); val != "frank herbert" {
+		t.Errorf("Get() = %v, want %v", val, "frank herbert")
+	}
+}
+
+// recordLogger is a Logger which keeps the messages it receives
+type recordLogger struct {
+	messages []string
+}
+
+func (l *recordLogger) Debug(msg string, args ...any) { l.messages = append(l.messages, msg) }
+func (l *recordLogger) Info(msg string, args ...any)  { l.messages = append(l.messages, msg) }
+func (l *recordLogger) Warn(msg string, args ...any)  { l.messages = append(l.messages, msg) }
+func (l *recordLogger) Error(msg string, args ...any) { l.messages = append(l.messages, msg) }
+
+func (l *recordLogger) has(msg string) bool {
+	for _, m := range l.messages {
+		if m == msg {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDiskStore_PartialRecordRecovery(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("hamlet", "shakespeare")
+	store.Close()
+
+	// simulate a crash in the middle of writing the second record
+	_, data := encodeKV(0, "dune", "frank herbert")
+	f, err := os.OpenFile("test.db", os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatalf("failed to open db file: %v", err)
+	}
+	f.Write(data[:len(data)-3])
+	f.Close()
+
+	logger := &recordLogger{}
+	store, err = NewDiskStoreWithOptions("test.db", Options{Logger: logger})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if !logger.has("truncating partially written record") || !logger.has("opened store") {
+		t.Errorf("logged %v, want the recovery and the open", logger.messages)
+	}
+	store.Set("dune", "frank herbert")
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	for key, val := range map[string]string{"hamlet": "shakespeare", "dune": "frank herbert"} {
+		if store.Get(key) != val {
+			t.Errorf("Get() = %v, want %v", store.Get(key), val)
+		}
+	}
+}
+
+func Test_scanRecords_corruptHeader(t *testing.T) {
+	_, first := encodeKV(0, "hamlet", "shakespeare")
+	_, second := encodeKV(0, "dune", "frank herbert")
+	// a flipped bit in value_size claims 4GB, which must not be allocated
+	binary.LittleEndian.PutUint32(second[12:16], math.MaxUint32)
+	data := append(first, second...)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	var offsets []int
+	err := scanRecords(bytes.NewReader(data), int64(len(data)), func(offset int, data []byte) error {
+		offsets = append(offsets, offset)
+		return nil
+	})
+	runtime.ReadMemStats(&after)
+	if !errors.Is(err, errPartialRecord) {
+		t.Errorf("scanRecords() error = %v, want %v", err, errPartialRecord)
+	}
+	if !reflect.DeepEqual(offsets, []int{0}) {
+		t.Errorf("scanRecords() read records at %v, want %v", offsets, []int{0})
+	}
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Errorf("scanRecords() allocated %v bytes, want less than 1MB", n)
+	}
+}
+
+func TestDiskStore_Callbacks(t *testing.T) {
+	var sets, deletes []string
+	store, err := NewDiskStoreWithOptions("test.db", Options{
+		OnSet:    func(key string, value string) { sets = append(sets, key+"="+value) },
+		OnDelete: func(key string) { deletes = append(deletes, key) },
+	})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	store.Set("hamlet", "shakespeare")
+	if err := store.Delete("hamlet"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	// deleting a key which does not exist does nothing
+	if err := store.Delete("dune"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if len(sets) != 1 || sets[0] != "hamlet=shakespeare" {
+		t.Errorf("OnSet called with %v, want [hamlet=shakespeare]", sets)
+	}
+	if len(deletes) != 1 || deletes[0] != "hamlet" {
+		t.Errorf("OnDelete called with %v, want [hamlet]", deletes)
+	}
+	if _, err := store.Lookup("hamlet"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Lookup() error = %v, want %v", err, ErrKeyNotFound)
+	}
+}
+
+// lookupStore returns a store holding a few keys, that of the cold case offloaded
+// and read once, so that its lookups hit the cache.
+func lookupStore(tb testing.TB, cold bool) *DiskStore {
+	tb.Helper()
+	opts := Options{MaxSegmentBytes: 50}
+	if cold {
+		opts.ColdStorage, opts.ColdCacheBytes = &memColdStorage{objects: make(map[string][]byte)}, 1<<10
+	}
+	store, err := NewDiskStoreWithOptions(filepath.Join(tb.TempDir(), "test.db"), opts)
+	if err != nil {
+		tb.Fatalf("failed to create disk store: %v", err)
+	}
+	tb.Cleanup(func() { store.Close() })
+	store.Set("othello", "shakespeare")
+	store.Set("dune", "herbert")
+	store.Set("emma", "austen")
+	if cold {
+		if n, err := store.Offload(context.Background()); n == 0 || err != nil {
+			tb.Fatalf("Offload() = %v, %v, want the sealed segments moved", n, err)
+		}
+		store.Get("othello")
+	}
+	return store
+}
+
+func TestDiskStore_LookupAllocs(t *testing.T) {
+	// the value read from the disk is the one allocation left, and a cached value
+	// needs none
+	for _, tt := range []struct {
+		cold bool
+		want float64
+	}{{false, 1}, {true, 0}} {
+		store := lookupStore(t, tt.cold)
+		allocs := testing.AllocsPerRun(100, func() {
+			if _, err := store.Lookup("othello"); err != nil {
+				t.Fatalf("Lookup() error = %v", err)
+			}
+		})
+		if allocs > tt.want {
+			t.Errorf("Lookup() with cold = %v allocates %v times, want %v", tt.cold, allocs, tt.want)
+		}
+	}
+}
+
+func BenchmarkDiskStore_Lookup(b *testing.B) {
+	for _, cold := range []bool{false, true} {
+		name := "local"
+		if cold {
+			name = "cold-cache"
+		}
+		b.Run(name, func(b *testing.B) {
+			store := lookupStore(b, cold)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				store.Lookup("othello")
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package caskdb
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// The value of a record flagged FlagEncrypted starts with the length of the id of
+// the key it is encrypted under and the id, followed by the nonce and the value
+// sealed with AES-GCM. The value is compressed, if at all, before it is encrypted.
+// Records encrypted under different keys, or not at all, live side by side in a
+// store, so that a key is retired by re-encrypting the records under it, which is
+// what RotateKey does.
+
+// EncryptionKey is a named AES key, of 16, 24 or 32 bytes for AES-128, AES-192 or
+// AES-256. The ID is recorded in every record encrypted under the key, so it must
+// not change, nor be given to another key.
+type EncryptionKey struct {
+	ID  string
+	Key []byte
+}
+
+// keyring holds the keys the store encrypts and decrypts with.
+type keyring struct {
+	aeads map[string]cipher.AEAD
+	// current is the id of the key encrypting the new records, empty if they are
+	// not encrypted
+	current string
+}
+
+// addKey makes the key known to the store, as the one encrypting the new records
+// if current is set. Adding a key known already under another id, or under the
+// same id with other contents, fails.
+func (d *DiskStore) addKey(key EncryptionKey, current bool) error {
+	if key.ID == "" || len(key.ID) > 255 {
+		return fmt.Errorf("caskdb: invalid encryption key id %q", key.ID)
+	}
+	block, err := aes.NewCipher(key.Key)
+	if err != nil {
+		return fmt.Errorf("caskdb: encryption key %q: %w", key.ID, err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return fmt.Errorf("caskdb: encryption key %q: %w", key.ID, err)
+	}
+	d.cryptMu.Lock()
+	defer d.cryptMu.Unlock()
+	if d.keyring.aeads == nil {
+		d.keyring.aeads = make(map[string]cipher.AEAD)
+	}
+	if _, ok := d.keyring.aeads[key.ID]; ok && !d.keyring.sameKey(key, aead) {
+		return fmt.Errorf("caskdb: encryption key %q is known with other contents", key.ID)
+	}
+	d.keyring.aeads[key.ID] = aead
+	if current {
+		d.keyring.current = key.ID
+	}
+	return nil
+}
+
+// sameKey reports whether aead, made from key, seals the same way as the key with
+// its id.
+func (k *keyring) sameKey(key EncryptionKey, aead cipher.AEAD) bool {
+	nonce := make([]byte, aead.NonceSize())
+	return string(aead.Seal(nil, nonce, nil, nil)) == string(k.aeads[key.ID].Seal(nil, nonce, nil, nil))
+}
+
+// encrypting reports whether the new records are encrypted.
+func (d *DiskStore) encrypting() bool {
+	d.cryptMu.RLock()
+	defer d.cryptMu.RUnlock()
+	return d.keyring.current != ""
+}
+
+// encrypt encrypts the value of a record under the current key, and adds
+// FlagEncrypted to its flags. The value is left as it is if there is no current
+// key.
+func (d *DiskStore) encrypt(value string, flags RecordFlags) (string, RecordFlags, error) {
+	d.cryptMu.RLock()
+	id := d.keyring.current
+	aead := d.keyring.aeads[id]
+	d.cryptMu.RUnlock()
+	if id == "" || value == "" {
+		return value, flags, nil
+	}
+	// the nonces are random, which is safe for about 2^32 records per key: rotate
+	// the key well before then
+	out := make([]byte, 1+len(id)+aead.NonceSize(), 1+len(id)+aead.NonceSize()+len(value)+aead.Overhead())
+	out[0] = byte(len(id))
+	copy(out[1:], id)
+	nonce := out[1+len(id):]
+	if _, err := rand.Read(nonce); err != nil {
+		return "", 0, err
+	}
+	out = aead.Seal(out, nonce, []byte(value), nil)
+	return string(out), flags | FlagEncrypted, nil
+}
+
+// encryptionKeyID returns the id of the key the value of an encrypted record is
+// encrypted under.
+func encryptionKeyID(value string) (string, error) {
+	if value == "" || len(value) < 1+int(value[0]) {
+		return "", errors.New("encryption key id missing")
+	}
+	return value[1 : 1+int(value[0])], nil
+}
+
+// checkEncrypted reports whether the key the value of an encrypted record is
+// encrypted under is known, failing with ErrUnsupportedRecord if it is not.
+func (d *DiskStore) checkEncrypted(value string) error {
+	id, err := encryptionKeyID(value)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCorruptRecord, err)
+	}
+	d.cryptMu.RLock()
+	_, ok := d.keyring.aeads[id]
+	d.cryptMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: encryption key %q is not known", ErrUnsupportedRecord, id)
+	}
+	return nil
+}
+
+// decrypt returns the value of an encrypted record back from what encrypt
+// returned. It fails with ErrUnsupportedRecord for a key which is not known, and
+// with ErrCorruptRecord for a value which does not decrypt.
+func (d *DiskStore) decrypt(value string) (string, error) {
+	if err := d.checkEncrypted(value); err != nil {
+		return "", err
+	}
+	id, _ := encryptionKeyID(value)
+	d.cryptMu.RLock()
+	aead := d.keyring.aeads[id]
+	d.cryptMu.RUnlock()
+	sealed := []byte(value[1+len(id):])
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("%w: encrypted value too short", ErrCorruptRecord)
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("%w: encryption key %q: %v", ErrCorruptRecord, id, err)
+	}
+	return string(plain), nil
+}
+
+// encryptedWithCurrent reports whether the record is encrypted under the current
+// key.
+func (d *DiskStore) encryptedWithCurrent(data []byte) bool {
+	if decodeFlags(data)&FlagEncrypted == 0 {
+		return false
+	}
+	value, err := storedValue(data)
+	if err != nil {
+		return false
+	}
+	id, err := encryptionKeyID(value)
+	d.cryptMu.RLock()
+	defer d.cryptMu.RUnlock()
+	return err == nil && id == d.keyring.current
+}
+
+// encodeValue compresses the value of a record with Options.Compression, and
+// encrypts it under the current key, setting the flags accordingly.
+func (d *DiskStore) encodeValue(value string, flags RecordFlags) (string, RecordFlags, error) {
+	value, flags, err := d.compress(value, flags)
+	if err != nil {
+		return "", 0, err
+	}
+	return d.encrypt(value, flags)
+}
+
+// RotateKey makes newKey the key encrypting the records, and re-encrypts the live
+// records under it: the active segment is sealed, and every sealed segment is then
+// rewritten the way Compact rewrites them, with the records encrypted under
+// another key, or not encrypted, encrypted under newKey, and the dead records left
+// out. Like Compact, it does not hold the store while copying, so reads and writes
+// carry on meanwhile, those made since encrypted under newKey already, and it
+// fails with ErrCompacting while a compaction runs.
+//
+// Once it returns, no record of the store is encrypted under the other keys, so a
+// compromised key can be left out of Options.EncryptionKeys the next time the
+// store is opened, which must list newKey. If it fails, calling it again carries
+// on; the records are readable all along.
+func (d *DiskStore) RotateKey(newKey EncryptionKey) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	if err := d.addKey(newKey, true); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	if d.compacting {
+		d.mu.Unlock()
+		return ErrCompacting
+	}
+	d.compacting = true
+	statePath := d.file.Name() + compactStateSuffix
+	var err error
+	if d.writePosition > 0 {
+		err = d.rotate()
+	}
+	inputs := append([]*segment(nil), d.segments[:len(d.segments)-1]...)
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		d.compacting = false
+		d.mu.Unlock()
+	}()
+	if err != nil {
+		return err
+	}
+	for _, seg := range inputs {
+		d.mu.Lock()
+		moving, removed := seg.moving, seg.removed
+		d.mu.Unlock()
+		if removed {
+			// DeleteAll dropped it meanwhile
+			continue
+		}
+		if moving {
+			return fmt.Errorf("caskdb: %s is being moved to the cold tier, rotate the key again once it is", seg.path)
+		}
+		c := &compaction{store: d, statePath: statePath, inputs: []*segment{seg}, rekey: true}
+		if _, err := c.compact(context.Background(), c.loadState()); err != nil {
+			return err
+		}
+	}
+	d.log.Info("rotated encryption key", "key", newKey.ID, "segments", len(inputs))
+	return nil
+}
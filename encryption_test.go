@@ -0,0 +1,144 @@
+package caskdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var (
+	keyA = EncryptionKey{ID: "2024-a", Key: bytes.Repeat([]byte{1}, 32)}
+	keyB = EncryptionKey{ID: "2025-b", Key: bytes.Repeat([]byte{2}, 16)}
+)
+
+// logContains reports whether any file of the store holds s.
+func logContains(t *testing.T, fileName string, s string) bool {
+	matches, err := filepath.Glob(fileName + "*")
+	if err != nil {
+		t.Fatalf("Glob() error = %v", err)
+	}
+	for _, match := range matches {
+		data, err := os.ReadFile(match)
+		if err != nil {
+			t.Fatalf("ReadFile() error = %v", err)
+		}
+		if bytes.Contains(data, []byte(s)) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDiskStore_Encryption(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{EncryptionKeys: []EncryptionKey{keyA}, Compression: CompressionGzip, Dedup: true}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	long := strings.Repeat("to be or not to be, ", 100)
+	store.Set("othello", "shakespeare")
+	store.Set("hamlet", long)
+	store.Set("quarto", long)
+	for key, want := range map[string]string{"othello": "shakespeare", "hamlet": long, "quarto": long} {
+		if got := store.Get(key); got != want {
+			t.Errorf("Get(%q) = %d bytes, want %d", key, len(got), len(want))
+		}
+	}
+	store.Close()
+	if logContains(t, fileName, "shakespeare") || logContains(t, fileName, "to be or not") {
+		t.Errorf("the log holds the values in the clear")
+	}
+
+	if _, err := NewDiskStore(fileName); !errors.Is(err, ErrUnsupportedRecord) {
+		t.Errorf("NewDiskStore() without the key error = %v, want %v", err, ErrUnsupportedRecord)
+	}
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	changes, _, err := store.ReadChanges(0, 10)
+	if err != nil {
+		t.Fatalf("ReadChanges() error = %v", err)
+	}
+	if len(changes) != 3 || changes[0].Value != "shakespeare" || changes[0].Flags != FlagEncrypted {
+		t.Errorf("ReadChanges() = %+v, want the 3 values decrypted", changes)
+	}
+}
+
+func TestDiskStore_EncryptionKeyInvalid(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	for _, key := range []EncryptionKey{{ID: "short", Key: []byte("too short")}, {Key: keyA.Key}} {
+		if _, err := NewDiskStoreWithOptions(fileName, Options{EncryptionKeys: []EncryptionKey{key}}); err == nil {
+			t.Errorf("NewDiskStoreWithOptions() with key %q error = nil, want an error", key.ID)
+		}
+	}
+	store, err := NewDiskStoreWithOptions(fileName, Options{EncryptionKeys: []EncryptionKey{keyA}})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if err := store.RotateKey(EncryptionKey{ID: keyA.ID, Key: keyB.Key}); err == nil {
+		t.Errorf("RotateKey() to another key under the same id error = nil, want an error")
+	}
+}
+
+func TestDiskStore_RotateKey(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	// the records written before encryption was turned on are encrypted too
+	store, err := NewDiskStoreWithOptions(fileName, Options{MaxSegmentBytes: 200})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("emma", "austen")
+	store.Close()
+	opts := Options{MaxSegmentBytes: 200, EncryptionKeys: []EncryptionKey{keyA}}
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		store.Set(fmt.Sprintf("book:%02d", i), fmt.Sprintf("edition %d", i))
+	}
+	store.Delete("book:07")
+	if err := store.RotateKey(keyB); err != nil {
+		t.Fatalf("RotateKey() error = %v", err)
+	}
+	store.Set("dune", "herbert")
+	if got := store.Get("book:03"); got != "edition 3" {
+		t.Errorf("Get() after RotateKey() = %q, want edition 3", got)
+	}
+	store.Close()
+	if logContains(t, fileName, "austen") {
+		t.Errorf("the log holds the value written before encryption in the clear")
+	}
+
+	// the retired key is no longer needed
+	if _, err := NewDiskStoreWithOptions(fileName, Options{EncryptionKeys: []EncryptionKey{keyA}}); !errors.Is(err, ErrUnsupportedRecord) {
+		t.Errorf("NewDiskStoreWithOptions() with the retired key only error = %v, want %v", err, ErrUnsupportedRecord)
+	}
+	store, err = NewDiskStoreWithOptions(fileName, Options{EncryptionKeys: []EncryptionKey{keyB}})
+	if err != nil {
+		t.Fatalf("NewDiskStoreWithOptions() with the new key only error = %v", err)
+	}
+	defer store.Close()
+	want := map[string]string{"emma": "austen", "dune": "herbert"}
+	for i := 0; i < 20; i++ {
+		if i != 7 {
+			want[fmt.Sprintf("book:%02d", i)] = fmt.Sprintf("edition %d", i)
+		}
+	}
+	if keys := store.Keys(); len(keys) != len(want) {
+		t.Errorf("Keys() = %d keys, want %d", len(keys), len(want))
+	}
+	for key, value := range want {
+		if got := store.Get(key); got != value {
+			t.Errorf("Get(%q) = %q, want %q", key, got, value)
+		}
+	}
+}
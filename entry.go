@@ -0,0 +1,99 @@
+package caskdb
+
+import (
+	"context"
+	"time"
+)
+
+// Entry is a key along with its value, and when and where it was written, as
+// returned by GetEntry.
+type Entry struct {
+	Key   string
+	Value string
+	// Timestamp is when the value was written, to the second
+	Timestamp time.Time
+	// Expiry is when the key expires, zero if it does not, and TTL the time left
+	// until then
+	Expiry time.Time
+	TTL    time.Duration
+	// Size is the size of the record on disk, header and key included; for a
+	// deduplicated value, that of the record referencing the blob
+	Size int
+	// Segment is the path of the data file holding the record, and Offset the
+	// position of the record in it
+	Segment string
+	Offset  int64
+	// Flags are those of the record, those of the blob for a deduplicated value,
+	// check RecordFlags
+	Flags RecordFlags
+	// Meta is the metadata attached to the key, check PutWithMeta
+	Meta Meta
+}
+
+// GetEntry is like Lookup, and returns the value along with when and where it was
+// written, e.g. to tell whether it is fresh enough without asking TTL apart.
+func (d *DiskStore) GetEntry(key string) (Entry, error) {
+	return d.GetEntryContext(context.Background(), key)
+}
+
+// GetEntryContext is like GetEntry, and the span of the lookup is a child of the
+// span in ctx. Check Options.Tracer. Like LookupContext, it stops waiting for the
+// lookup once ctx is done or Options.ReadTimeout passed.
+func (d *DiskStore) GetEntryContext(ctx context.Context, key string) (Entry, error) {
+	if !bounded(ctx, d.opts.ReadTimeout) {
+		return d.getEntry(ctx, key)
+	}
+	return withDeadline(ctx, d.opts.ReadTimeout, func(ctx context.Context) (Entry, error) {
+		return d.getEntry(ctx, key)
+	})
+}
+
+// getEntry is GetEntryContext, without a deadline.
+func (d *DiskStore) getEntry(ctx context.Context, key string) (entry Entry, err error) {
+	key = d.normalizeKey(key)
+	span := d.tracer.Start(ctx, "caskdb.Get")
+	defer func() { span.End(err) }()
+	start, size, segment := time.Now(), 0, ""
+	defer func() { d.observe("Get", key, size, segment, start) }()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	span.SetAttribute(spanAttrWait, int64(time.Since(start)))
+	kEntry, ok := d.keyDir.get(key)
+	if !ok || kEntry.expired(start) {
+		return Entry{}, ErrKeyNotFound
+	}
+	segment = d.segmentOf(kEntry)
+	value, flags, err := d.readFlags(key, kEntry)
+	if err != nil {
+		return Entry{}, err
+	}
+	entry = Entry{
+		Key:       key,
+		Value:     value,
+		Timestamp: time.Unix(int64(kEntry.timestamp), 0),
+		Size:      int(kEntry.totalSize),
+		Offset:    int64(kEntry.position),
+		Flags:     flags,
+	}
+	if seg := d.segment(kEntry.segment); seg != nil {
+		entry.Segment = seg.path
+	}
+	if kEntry.expiry != 0 {
+		entry.Expiry = time.Unix(int64(kEntry.expiry), 0)
+		entry.TTL = entry.Expiry.Sub(start)
+	}
+	if flags&FlagMeta != 0 {
+		block, err := d.readMetaBlock(key, kEntry)
+		if err != nil {
+			return Entry{}, err
+		}
+		if entry.Meta, err = decodeMeta(block); err != nil {
+			return Entry{}, err
+		}
+	}
+	d.touch(key, kEntry)
+	size = int(kEntry.totalSize)
+	span.SetAttribute(spanAttrBytes, int64(size))
+	span.SetAttribute(spanAttrValueSize, int64(len(value)))
+	return entry, nil
+}
@@ -0,0 +1,52 @@
+package caskdb
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_GetEntry(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	before := time.Now().Truncate(time.Second)
+	store.Set("othello", "shakespeare")
+	if err := store.PutWithTTL("hamlet", "prince", time.Hour); err != nil {
+		t.Fatalf("PutWithTTL() error = %v", err)
+	}
+	meta := Meta{ContentType: "text/plain"}
+	if err := store.PutWithMeta("lear", "cordelia", meta); err != nil {
+		t.Fatalf("PutWithMeta() error = %v", err)
+	}
+
+	entry, err := store.GetEntry("othello")
+	if err != nil {
+		t.Fatalf("GetEntry() error = %v", err)
+	}
+	if entry.Key != "othello" || entry.Value != "shakespeare" || entry.Timestamp.Before(before) || !entry.Expiry.IsZero() || entry.TTL != 0 {
+		t.Errorf("GetEntry() = %+v, want othello written now, without expiry", entry)
+	}
+	// after the format record
+	first := int64(len(formatRecord(0)))
+	if entry.Segment != fileName || entry.Offset != first || entry.Size != headerSize+len("othello")+len("shakespeare") {
+		t.Errorf("GetEntry() = %+v, want the first record of %s", entry, fileName)
+	}
+	entry, err = store.GetEntry("hamlet")
+	if err != nil || entry.Value != "prince" || entry.Flags != FlagTTL || entry.TTL <= 59*time.Minute || entry.TTL > time.Hour+time.Second {
+		t.Errorf("GetEntry() = %+v, %v, want prince expiring in an hour", entry, err)
+	}
+	if entry.Offset != first+int64(headerSize+len("othello")+len("shakespeare")) {
+		t.Errorf("GetEntry().Offset = %d, want that of the second record", entry.Offset)
+	}
+	if entry, err = store.GetEntry("lear"); err != nil || entry.Value != "cordelia" || entry.Meta.ContentType != meta.ContentType {
+		t.Errorf("GetEntry() = %+v, %v, want cordelia with its metadata", entry, err)
+	}
+	if _, err := store.GetEntry("macbeth"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("GetEntry() error = %v, want %v", err, ErrKeyNotFound)
+	}
+}
@@ -0,0 +1,44 @@
+package caskdb
+
+import (
+	"strconv"
+	"strings"
+)
+
+// epochKeyPrefix starts the key of the record CopyTo and Split start a copy with,
+// which ends with the epoch of the store copied, e.g. "\x00epoch\x0042". The key
+// carries it rather than the value, so that it can be read from the index of a
+// remote segment too.
+const epochKeyPrefix = "\x00epoch\x00"
+
+// isEpochKey reports whether the key is that of an epoch record.
+func isEpochKey(key string) bool {
+	return strings.HasPrefix(key, epochKeyPrefix)
+}
+
+// encodeEpoch returns the record of the epoch.
+func encodeEpoch(epoch uint64, timestamp uint32) []byte {
+	_, data := encodeRecord(timestamp, 0, epochKeyPrefix+strconv.FormatUint(epoch, 10), "1")
+	return data
+}
+
+// Epoch returns the generation of the store: it goes up every time the store is
+// opened for writing, and every time Compact rewrites segments, so that tooling
+// can tell files of different generations of a store apart, e.g. a segment or a
+// backup restored next to newer files. It is kept in LifetimeStats, and the
+// copies CopyTo and Split write start with a record of it, which the store opened
+// from a copy carries on from.
+func (d *DiskStore) Epoch() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lifetime.Epoch
+}
+
+// loadEpoch applies an epoch record read back from the log. The store must be
+// locked.
+func (d *DiskStore) loadEpoch(key string) {
+	epoch, err := strconv.ParseUint(strings.TrimPrefix(key, epochKeyPrefix), 10, 64)
+	if err == nil && epoch > d.lifetime.Epoch {
+		d.lifetime.Epoch = epoch
+	}
+}
@@ -0,0 +1,64 @@
+package caskdb
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskStore_Epoch(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "test.db")
+	opts := Options{MaxSegmentBytes: 100}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if epoch := store.Epoch(); epoch != 1 {
+		t.Errorf("Epoch() of a new store = %v, want 1", epoch)
+	}
+	for i := 0; i < 12; i++ {
+		store.Set("key", fmt.Sprintf("value-%d", i%10))
+	}
+	if _, err := store.Compact(context.Background()); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if epoch := store.Stats().Lifetime.Epoch; epoch != 2 {
+		t.Errorf("Stats().Lifetime.Epoch after Compact() = %v, want 2", epoch)
+	}
+	store.Close()
+
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	if epoch := store.Epoch(); epoch != 3 {
+		t.Errorf("Epoch() after reopening = %v, want 3", epoch)
+	}
+	reader, err := OpenReadOnly(fileName, Options{})
+	if err != nil {
+		t.Fatalf("OpenReadOnly() error = %v", err)
+	}
+	defer reader.Close()
+	if epoch := reader.Epoch(); epoch != 3 {
+		t.Errorf("Epoch() of a reader = %v, want 3, that of the writer", epoch)
+	}
+
+	copyName := filepath.Join(dir, "copy.db")
+	if err := store.CopyTo(copyName); err != nil {
+		t.Fatalf("CopyTo() error = %v", err)
+	}
+	clone, err := NewDiskStore(copyName)
+	if err != nil {
+		t.Fatalf("failed to open the copy: %v", err)
+	}
+	defer clone.Close()
+	if epoch := clone.Epoch(); epoch != 4 {
+		t.Errorf("Epoch() of the copy = %v, want 4, carrying on from the store", epoch)
+	}
+	if keys := clone.Keys(); len(keys) != 1 {
+		t.Errorf("Keys() of the copy = %v, want the epoch left out", keys)
+	}
+}
@@ -0,0 +1,66 @@
+package caskdb
+
+import "errors"
+
+var (
+	// ErrKeyNotFound is returned when the requested key does not exist in the store
+	ErrKeyNotFound = errors.New("caskdb: key not found")
+	// ErrCorruptRecord is returned when a record read from the disk fails its
+	// checksum verification, i.e. the bytes on disk are not the ones we wrote
+	ErrCorruptRecord = errors.New("caskdb: corrupt record")
+	// ErrKeyMismatch is returned when the record found at a key's offset belongs to
+	// a different key, which means the in-memory index itself has gone bad
+	ErrKeyMismatch = errors.New("caskdb: key mismatch")
+	// ErrSyncFailed is returned by Healthy when the last fsync failed, so we cannot
+	// be sure the recent writes made it to the disk, and by the writes as well when
+	// it failed for writes already acknowledged, check DiskStore.Sync
+	ErrSyncFailed = errors.New("caskdb: last sync failed")
+	// ErrLowDiskSpace is returned by Healthy when the disk has less free space than
+	// Options.MinFreeDiskBytes
+	ErrLowDiskSpace = errors.New("caskdb: low disk space")
+	// ErrStoreFull is returned by the writes which would take the store past
+	// Options.MaxBytes or Options.MaxKeys
+	ErrStoreFull = errors.New("caskdb: store is full")
+	// ErrInvalidCursor is returned by List for a cursor it did not hand out, or
+	// one handed out for another prefix
+	ErrInvalidCursor = errors.New("caskdb: invalid cursor")
+	// ErrKeyTooLarge is returned by the writes of a key larger than the header of
+	// a record can describe, i.e. 16MB
+	ErrKeyTooLarge = errors.New("caskdb: key too large")
+	// ErrReservedKey is returned by the writes of a key the store uses for records
+	// of its own, all of which start with a zero byte, e.g. "\x00truncate\x00"
+	ErrReservedKey = errors.New("caskdb: reserved key")
+	// ErrMetaTooLarge is returned by PutWithMeta for a Meta whose encoding is
+	// larger than 4KB
+	ErrMetaTooLarge = errors.New("caskdb: metadata too large")
+	// ErrReadOnly is returned by the writes to a store opened with OpenReadOnly
+	ErrReadOnly = errors.New("caskdb: store is read-only")
+	// ErrUnsupportedRecord is returned when loading a store holding records with
+	// RecordFlags this version cannot read, e.g. written by a newer one
+	ErrUnsupportedRecord = errors.New("caskdb: unsupported record")
+	// ErrUnsupportedFormat is returned when loading a store whose files have a
+	// layout this version cannot read, either older, check UpgradeFormat, or newer
+	ErrUnsupportedFormat = errors.New("caskdb: unsupported format version")
+	// ErrForeignSegment is returned when loading a store holding a segment which
+	// carries the ID of another store, check DiskStore.ID
+	ErrForeignSegment = errors.New("caskdb: segment of another store")
+	// ErrInvalidJSON is returned by GetJSON for a value which does not decode into
+	// the target
+	ErrInvalidJSON = errors.New("caskdb: invalid JSON")
+	// ErrInvalidValue is returned by TypedStore.Get for a value its codec fails
+	// to decode
+	ErrInvalidValue = errors.New("caskdb: invalid value")
+	// ErrLoading is returned by Healthy while a store opened with
+	// Options.LoadInBackground is still indexing its active file
+	ErrLoading = errors.New("caskdb: store is loading")
+	// ErrTimeout is returned by the operations which did not complete within
+	// Options.ReadTimeout or Options.WriteTimeout, or the deadline of their context
+	ErrTimeout = errors.New("caskdb: operation timed out")
+	// ErrLocked is returned when opening a store another writer has open, or whose
+	// lease it holds, and by the writes of a store which lost its lease, check
+	// Options.NetworkFS
+	ErrLocked = errors.New("caskdb: store is locked by another writer")
+	// ErrNetworkFS is returned when opening a store on a network filesystem with
+	// options which are not safe there, check Options.NetworkFS
+	ErrNetworkFS = errors.New("caskdb: not supported on a network filesystem")
+)
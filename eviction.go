@@ -0,0 +1,100 @@
+package caskdb
+
+import (
+	"fmt"
+	"time"
+)
+
+// EvictionPolicy picks the keys a store in cache mode deletes to make room. Check
+// Options.Eviction.
+type EvictionPolicy int
+
+const (
+	// EvictNone never deletes keys: the writes past the quota fail with
+	// ErrStoreFull
+	EvictNone EvictionPolicy = iota
+	// EvictLRU deletes the least recently read or written keys
+	EvictLRU
+	// EvictLFU deletes the least frequently read or written keys
+	EvictLFU
+)
+
+// evictionSamples is the number of keys looked at to pick one to evict. Like
+// Redis, we approximate the policy by sampling rather than keeping the keys
+// sorted by their accesses, which would cost on every read.
+const evictionSamples = 5
+
+// touch records a read of the key for the eviction policy, and for KeyReport. The
+// store must be locked.
+func (d *DiskStore) touch(key string, kEntry KeyEntry) {
+	d.countAccess(key, false)
+	if d.opts.Eviction == EvictNone {
+		return
+	}
+	d.accessClock++
+	kEntry.lastAccess = d.accessClock
+	kEntry.hits++
+	d.keyDir.set(key, kEntry)
+}
+
+// evict deletes keys, other than key, until writing size bytes for key fits
+// within Options.MaxKeys and Options.CacheBytes. The store must be locked.
+func (d *DiskStore) evict(key string, size int) error {
+	if d.opts.CacheBytes > 0 && int64(size) > d.opts.CacheBytes {
+		return fmt.Errorf("%w: a record of %d bytes does not fit in the cache", ErrStoreFull, size)
+	}
+	old, exists := d.keyDir.get(key)
+	for {
+		keys, bytes := d.keyDir.size(), d.liveBytes+int64(size)-int64(old.totalSize)
+		if !exists {
+			keys++
+		}
+		if (d.opts.MaxKeys <= 0 || keys <= d.opts.MaxKeys) && (d.opts.CacheBytes <= 0 || bytes <= d.opts.CacheBytes) {
+			return nil
+		}
+		victim, ok := d.pickVictim(key)
+		if !ok {
+			return fmt.Errorf("%w: nothing left to evict", ErrStoreFull)
+		}
+		if _, err := d.tombstone(victim, uint32(time.Now().Unix()), ""); err != nil {
+			return err
+		}
+		d.log.Debug("evicted key", "key", victim)
+		if d.opts.OnDelete != nil {
+			d.opts.OnDelete(victim)
+		}
+	}
+}
+
+// pickVictim returns the key to evict next among a sample of the keys other than
+// key, preferring the expired ones. The store must be locked.
+func (d *DiskStore) pickVictim(key string) (string, bool) {
+	now := time.Now()
+	var victim string
+	var best KeyEntry
+	found, sampled := false, 0
+	// the iteration order of keyDir is random, which gives us the sample
+	d.keyDir.each(func(k string, kEntry KeyEntry) bool {
+		if k == key {
+			return true
+		}
+		if kEntry.expired(now) {
+			victim, found = k, true
+			return false
+		}
+		if !found || d.colder(kEntry, best) {
+			victim, best, found = k, kEntry, true
+		}
+		sampled++
+		return sampled < evictionSamples
+	})
+	return victim, found
+}
+
+// colder reports whether a is a better pick for eviction than b.
+func (d *DiskStore) colder(a KeyEntry, b KeyEntry) bool {
+	if d.opts.Eviction == EvictLFU && a.hits != b.hits {
+		return a.hits < b.hits
+	}
+	return a.lastAccess < b.lastAccess
+}
@@ -0,0 +1,71 @@
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestDiskStore_Eviction(t *testing.T) {
+	tests := []struct {
+		policy EvictionPolicy
+		want   string
+	}{
+		// hamlet was read last, othello read the most
+		{EvictLRU, "othello"},
+		{EvictLFU, "hamlet"},
+	}
+	for _, tt := range tests {
+		store, err := NewDiskStoreWithOptions("test.db", Options{Eviction: tt.policy, MaxKeys: 2})
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		store.Set("othello", "shakespeare")
+		store.Set("hamlet", "shakespeare")
+		store.Get("othello")
+		store.Get("othello")
+		store.Get("hamlet")
+		var evicted []string
+		store.opts.OnDelete = func(key string) { evicted = append(evicted, key) }
+		if err := store.Put("dune", "herbert"); err != nil {
+			t.Errorf("Put() with %v error = %v", tt.policy, err)
+		}
+		if fmt.Sprint(evicted) != "["+tt.want+"]" {
+			t.Errorf("Put() with %v evicted %v, want %v", tt.policy, evicted, tt.want)
+		}
+		if len(store.Keys()) != 2 {
+			t.Errorf("Keys() = %v, want 2 keys", store.Keys())
+		}
+		store.Close()
+		os.Remove("test.db")
+	}
+}
+
+func TestDiskStore_CacheBytes(t *testing.T) {
+	// room for two records of 38 bytes
+	store, err := NewDiskStoreWithOptions("test.db", Options{Eviction: EvictLRU, CacheBytes: 80})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	for _, key := range []string{"othello", "hamlet1", "macbeth"} {
+		if err := store.Put(key, "shakespeare"); err != nil {
+			t.Fatalf("Put() error = %v", err)
+		}
+	}
+	if _, err := store.Lookup("othello"); err == nil {
+		t.Errorf("Lookup() found othello, want it evicted")
+	}
+	if store.liveBytes != 76 {
+		t.Errorf("liveBytes = %v, want 76", store.liveBytes)
+	}
+	if err := store.Put("hamlet1", string(make([]byte, 100))); !errors.Is(err, ErrStoreFull) {
+		t.Errorf("Put() of a record larger than the cache error = %v, want ErrStoreFull", err)
+	}
+	if len(store.Keys()) != 2 {
+		t.Errorf("Put() of a record larger than the cache evicted keys")
+	}
+}
@@ -0,0 +1,355 @@
+package caskdb
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+	"unicode/utf8"
+)
+
+// DefaultExportMemoryBytes is the memory Export sorts the records in when
+// ExportOptions.MemoryBytes is not set.
+const DefaultExportMemoryBytes = 64 << 20
+
+// exportEntryOverhead is roughly what an entry takes in memory besides its key
+// and value
+const exportEntryOverhead = 48
+
+// ExportOrder is the order Export writes the keys in.
+type ExportOrder uint8
+
+const (
+	// ExportByKey orders the keys bytewise
+	ExportByKey ExportOrder = iota
+	// ExportByTime orders the keys by when they were last written, oldest first,
+	// and then bytewise; replayed in that order, the writes happen as they did
+	ExportByTime
+)
+
+func (o ExportOrder) String() string {
+	switch o {
+	case ExportByKey:
+		return "key"
+	case ExportByTime:
+		return "time"
+	}
+	return fmt.Sprintf("order(%d)", uint8(o))
+}
+
+// ExportOptions tunes Export.
+type ExportOptions struct {
+	Order ExportOrder
+	// MemoryBytes bounds the memory taken by the records sorted at a time; the
+	// rest wait in sorted runs on the disk. When zero, DefaultExportMemoryBytes is
+	// used.
+	MemoryBytes int64
+	// TempDir is where the sorted runs are written, next to the store when empty.
+	TempDir string
+}
+
+// ExportRecord is a line of the output of Export, in JSON.
+type ExportRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	// Timestamp is when the key was last written, to the second
+	Timestamp time.Time `json:"timestamp"`
+	// Expiry is set for the keys which expire
+	Expiry *time.Time `json:"expiry,omitempty"`
+	// Encoding is "base64" when Key and Value are encoded in base64, which they
+	// are when either is not valid UTF-8, as JSON strings cannot hold it
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// Export writes the live keys of the store to w, one ExportRecord per line, in the
+// order of ExportOptions.Order, and returns the number of keys written. The same
+// store always exports to the same lines, so that two dumps can be diffed.
+//
+// The records are read in the order of the log, which is sequential on the disk,
+// and sorted in runs of ExportOptions.MemoryBytes, which are merged as they are
+// written: a store of any size is exported in bounded memory. Like CopyTo, the
+// store is only locked while the keys are listed, and the output has the keys as
+// they were then. When ctx is done, Export stops and returns its error.
+func (d *DiskStore) Export(ctx context.Context, w io.Writer, opts ExportOptions) (int, error) {
+	if opts.MemoryBytes <= 0 {
+		opts.MemoryBytes = DefaultExportMemoryBytes
+	}
+	if opts.TempDir == "" {
+		opts.TempDir = filepath.Dir(d.file.Name())
+	}
+	live, readers, closeReaders, err := d.snapshot()
+	if err != nil {
+		return 0, err
+	}
+	defer closeReaders()
+	sort.Slice(live, func(i, j int) bool {
+		a, b := live[i].kEntry, live[j].kEntry
+		if a.segment != b.segment {
+			return a.segment < b.segment
+		}
+		return a.position < b.position
+	})
+	s := &exportSort{opts: opts}
+	defer s.close()
+	for i, l := range live {
+		if i%1000 == 0 {
+			if err := ctx.Err(); err != nil {
+				return 0, err
+			}
+		}
+		data, err := readLive(readers, l.key, l.kEntry)
+		if err != nil {
+			return 0, err
+		}
+		value, err := l.value(d, readers, data)
+		if err != nil {
+			return 0, err
+		}
+		if err := s.add(exportEntry{key: l.key, value: value, timestamp: l.kEntry.timestamp, expiry: l.kEntry.expiry}); err != nil {
+			return 0, err
+		}
+	}
+	return len(live), s.write(ctx, w)
+}
+
+// exportEntry is a record being exported.
+type exportEntry struct {
+	key       string
+	value     string
+	timestamp uint32
+	expiry    uint32
+}
+
+// exportLess reports whether a comes before b in the order.
+func exportLess(order ExportOrder, a, b exportEntry) bool {
+	if order == ExportByTime && a.timestamp != b.timestamp {
+		return a.timestamp < b.timestamp
+	}
+	return a.key < b.key
+}
+
+// record returns the line of the entry.
+func (e exportEntry) record() ExportRecord {
+	r := ExportRecord{Key: e.key, Value: e.value, Timestamp: time.Unix(int64(e.timestamp), 0).UTC()}
+	if e.expiry != 0 {
+		expiry := time.Unix(int64(e.expiry), 0).UTC()
+		r.Expiry = &expiry
+	}
+	if !utf8.ValidString(e.key) || !utf8.ValidString(e.value) {
+		r.Key = base64.StdEncoding.EncodeToString([]byte(e.key))
+		r.Value = base64.StdEncoding.EncodeToString([]byte(e.value))
+		r.Encoding = "base64"
+	}
+	return r
+}
+
+// append appends the encoding of the entry to buf.
+func (e exportEntry) append(buf []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(e.key)))
+	buf = append(buf, e.key...)
+	buf = binary.AppendUvarint(buf, uint64(len(e.value)))
+	buf = append(buf, e.value...)
+	buf = binary.AppendUvarint(buf, uint64(e.timestamp))
+	return binary.AppendUvarint(buf, uint64(e.expiry))
+}
+
+// readExportEntry reads back an entry encoded with append.
+func readExportEntry(r *bufio.Reader) (exportEntry, error) {
+	var e exportEntry
+	readString := func() (string, error) {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return "", err
+		}
+		buf := make([]byte, n)
+		_, err = io.ReadFull(r, buf)
+		return string(buf), err
+	}
+	var err error
+	if e.key, err = readString(); err != nil {
+		return e, err
+	}
+	var timestamp, expiry uint64
+	if e.value, err = readString(); err == nil {
+		if timestamp, err = binary.ReadUvarint(r); err == nil {
+			expiry, err = binary.ReadUvarint(r)
+		}
+	}
+	if err == io.EOF {
+		// only the end of a run between two entries is expected
+		err = io.ErrUnexpectedEOF
+	}
+	e.timestamp, e.expiry = uint32(timestamp), uint32(expiry)
+	return e, err
+}
+
+// exportSort is the external merge sort of Export.
+type exportSort struct {
+	opts ExportOptions
+	// batch holds the entries not sorted yet, batchBytes their size, and runs the
+	// files of the sorted runs
+	batch      []exportEntry
+	batchBytes int64
+	runs       []*os.File
+}
+
+// add adds the entry to the batch, and sorts the batch into a run once it takes
+// ExportOptions.MemoryBytes.
+func (s *exportSort) add(entry exportEntry) error {
+	s.batch = append(s.batch, entry)
+	s.batchBytes += int64(len(entry.key)+len(entry.value)) + exportEntryOverhead
+	if s.batchBytes < s.opts.MemoryBytes {
+		return nil
+	}
+	return s.flush()
+}
+
+// sortBatch sorts the batch in the order.
+func (s *exportSort) sortBatch() {
+	sort.Slice(s.batch, func(i, j int) bool { return exportLess(s.opts.Order, s.batch[i], s.batch[j]) })
+}
+
+// flush writes the batch, sorted, to a run.
+func (s *exportSort) flush() error {
+	if len(s.batch) == 0 {
+		return nil
+	}
+	s.sortBatch()
+	run, err := os.CreateTemp(s.opts.TempDir, "caskdb-export")
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, run)
+	w := bufio.NewWriter(run)
+	var buf []byte
+	for _, entry := range s.batch {
+		buf = entry.append(buf[:0])
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if _, err := run.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.batch, s.batchBytes = s.batch[:0], 0
+	return nil
+}
+
+// write writes the entries to w in order: the batch as is if it holds them all,
+// or else merged with the runs.
+func (s *exportSort) write(ctx context.Context, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	// the values are data, not markup
+	enc.SetEscapeHTML(false)
+	if len(s.runs) == 0 {
+		s.sortBatch()
+		for i, entry := range s.batch {
+			if i%1000 == 0 {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+			}
+			if err := enc.Encode(entry.record()); err != nil {
+				return err
+			}
+		}
+		return bw.Flush()
+	}
+	if err := s.flush(); err != nil {
+		return err
+	}
+	h := &exportHeap{order: s.opts.Order}
+	for _, run := range s.runs {
+		r := bufio.NewReader(run)
+		entry, err := readExportEntry(r)
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		h.entries = append(h.entries, entry)
+		h.readers = append(h.readers, r)
+	}
+	heap.Init(h)
+	for i := 0; ; i++ {
+		if i%1000 == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		entry, err := h.next()
+		if err == io.EOF {
+			return bw.Flush()
+		}
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(entry.record()); err != nil {
+			return err
+		}
+	}
+}
+
+// close deletes the runs.
+func (s *exportSort) close() {
+	for _, run := range s.runs {
+		run.Close()
+		os.Remove(run.Name())
+	}
+}
+
+// exportHeap merges the runs: it holds the next entry of each, first in the order
+// at the top.
+type exportHeap struct {
+	order   ExportOrder
+	entries []exportEntry
+	readers []*bufio.Reader
+}
+
+func (h *exportHeap) Len() int { return len(h.entries) }
+func (h *exportHeap) Less(i, j int) bool {
+	return exportLess(h.order, h.entries[i], h.entries[j])
+}
+func (h *exportHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	h.readers[i], h.readers[j] = h.readers[j], h.readers[i]
+}
+func (h *exportHeap) Push(x any) {}
+func (h *exportHeap) Pop() any {
+	n := len(h.entries) - 1
+	h.entries, h.readers = h.entries[:n], h.readers[:n]
+	return nil
+}
+
+// next returns the next entry of the merged runs, or io.EOF once they are all
+// read.
+func (h *exportHeap) next() (exportEntry, error) {
+	if len(h.entries) == 0 {
+		return exportEntry{}, io.EOF
+	}
+	entry := h.entries[0]
+	following, err := readExportEntry(h.readers[0])
+	switch {
+	case err == io.EOF:
+		heap.Remove(h, 0)
+	case err != nil:
+		return exportEntry{}, err
+	default:
+		h.entries[0] = following
+		heap.Fix(h, 0)
+	}
+	return entry, nil
+}
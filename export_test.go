@@ -0,0 +1,107 @@
+package caskdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_Export(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewDiskStoreWithOptions(filepath.Join(dir, "test.db"), Options{MaxSegmentBytes: 100})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	// written out of the order of the keys, over several segments
+	writes := []struct {
+		key       string
+		value     string
+		timestamp uint32
+	}{
+		{"dune", "herbert", 1000},
+		{"othello", "shakespeare", 3000},
+		{"anathem", "stephenson", 2000},
+		{"binary", "\xff\xfe", 1000},
+		{"othello", "<the moor>", 4000},
+	}
+	store.mu.Lock()
+	for _, w := range writes {
+		if _, err := store.putAt(w.key, w.value, w.timestamp, 0, "", 0); err != nil {
+			t.Fatalf("putAt() error = %v", err)
+		}
+	}
+	store.mu.Unlock()
+	if err := store.PutWithTTL("zz-expiring", "soon", time.Hour); err != nil {
+		t.Fatalf("PutWithTTL() error = %v", err)
+	}
+
+	export := func(opts ExportOptions) []ExportRecord {
+		t.Helper()
+		var buf bytes.Buffer
+		n, err := store.Export(context.Background(), &buf, opts)
+		if err != nil {
+			t.Fatalf("Export() error = %v", err)
+		}
+		var records []ExportRecord
+		dec := json.NewDecoder(&buf)
+		for dec.More() {
+			var r ExportRecord
+			if err := dec.Decode(&r); err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			records = append(records, r)
+		}
+		if n != len(records) {
+			t.Errorf("Export() = %v, wrote %v records", n, len(records))
+		}
+		return records
+	}
+	keys := func(records []ExportRecord) []string {
+		var keys []string
+		for _, r := range records {
+			keys = append(keys, r.Key)
+		}
+		return keys
+	}
+
+	byKey := export(ExportOptions{Order: ExportByKey})
+	want := []string{"anathem", "YmluYXJ5", "dune", "othello", "zz-expiring"}
+	if got := keys(byKey); !reflect.DeepEqual(got, want) {
+		t.Errorf("Export() by key = %v, want %v", got, want)
+	}
+	if r := byKey[1]; r.Encoding != "base64" || r.Value != "//4=" {
+		t.Errorf("Export() of a binary value = %+v, want it in base64", r)
+	}
+	if r := byKey[3]; r.Value != "<the moor>" || r.Timestamp.Unix() != 4000 || r.Expiry != nil {
+		t.Errorf("Export() = %+v, want the latest value of othello", r)
+	}
+	if r := byKey[4]; r.Expiry == nil {
+		t.Errorf("Export() = %+v, want its expiry", r)
+	}
+
+	byTime := export(ExportOptions{Order: ExportByTime})
+	want = []string{"YmluYXJ5", "dune", "anathem", "othello", "zz-expiring"}
+	if got := keys(byTime); !reflect.DeepEqual(got, want) {
+		t.Errorf("Export() by time = %v, want %v", got, want)
+	}
+
+	// sorted on the disk, a record a run, the output is the same
+	for _, order := range []ExportOrder{ExportByKey, ExportByTime} {
+		inMemory := export(ExportOptions{Order: order})
+		onDisk := export(ExportOptions{Order: order, MemoryBytes: 1, TempDir: t.TempDir()})
+		if !reflect.DeepEqual(onDisk, inMemory) {
+			t.Errorf("Export() by %v in runs = %+v, want %+v", order, onDisk, inMemory)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := store.Export(ctx, &bytes.Buffer{}, ExportOptions{}); err != context.Canceled {
+		t.Errorf("Export() with a cancelled context error = %v, want %v", err, context.Canceled)
+	}
+}
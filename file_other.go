@@ -0,0 +1,20 @@
+//go:build !windows
+
+package caskdb
+
+import "os"
+
+// openFile opens a file of the store, like os.OpenFile.
+func openFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+// renameFile replaces dst with src, atomically.
+func renameFile(src string, dst string) error {
+	return os.Rename(src, dst)
+}
+
+// truncateFile truncates an open file to size.
+func truncateFile(file *os.File, size int64) error {
+	return file.Truncate(size)
+}
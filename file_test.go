@@ -0,0 +1,91 @@
+package caskdb
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_renameFile(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "test.db.tmp"), filepath.Join(dir, "test.db")
+	if err := os.WriteFile(dst, []byte("old"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(src, []byte("new"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	// a reader holding the file replaced, as a store opened with OpenReadOnly does
+	reader, err := openFile(dst, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if err := renameFile(src, filepath.Join(dir, "test.db.000001")); err != nil {
+		t.Fatalf("renameFile() error = %v", err)
+	}
+	if err := renameFile(dst, src); err != nil {
+		t.Fatalf("renameFile() of an open file error = %v", err)
+	}
+	if err := renameFile(filepath.Join(dir, "test.db.000001"), src); err != nil {
+		t.Fatalf("renameFile() over a file error = %v", err)
+	}
+	if got, err := os.ReadFile(src); err != nil || string(got) != "new" {
+		t.Errorf("ReadFile() = %q, %v, want %q", got, err, "new")
+	}
+}
+
+func Test_truncateFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.db")
+	file, err := openFile(name, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.Write([]byte("head|torn")); err != nil {
+		t.Fatal(err)
+	}
+	if err := truncateFile(file, 5); err != nil {
+		t.Fatalf("truncateFile() error = %v", err)
+	}
+	// the writes carry on from the new end
+	if _, err := file.Write([]byte("tail")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(name); err != nil || string(got) != "head|tail" {
+		t.Errorf("ReadFile() = %q, %v, want %q", got, err, "head|tail")
+	}
+}
+
+func TestDiskStore_locked(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("othello", "shakespeare")
+	if _, err := NewDiskStore(fileName); !errors.Is(err, ErrLocked) {
+		t.Errorf("NewDiskStore() of a store in use error = %v, want %v", err, ErrLocked)
+	}
+	if _, err := CompactOffline(context.Background(), fileName, OfflineOptions{}); !errors.Is(err, ErrLocked) {
+		t.Errorf("CompactOffline() of a store in use error = %v, want %v", err, ErrLocked)
+	}
+	// readers need no lock
+	reader, err := OpenReadOnly(fileName, Options{})
+	if err != nil {
+		t.Fatalf("OpenReadOnly() error = %v", err)
+	}
+	defer reader.Close()
+	store.Close()
+
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("NewDiskStore() after Close() error = %v", err)
+	}
+	defer store.Close()
+	if got := store.Get("othello"); got != "shakespeare" {
+		t.Errorf("Get() = %q, want %q", got, "shakespeare")
+	}
+}
@@ -0,0 +1,117 @@
+//go:build windows
+
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// On Windows, os.File.Sync is FlushFileBuffers, which the store needs nothing
+// more than; what differs is that an open file cannot be renamed or deleted
+// unless it was opened to allow it, which os.OpenFile does not.
+
+var procMoveFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("MoveFileExW")
+
+const (
+	_FILE_FLAG_WRITE_THROUGH   = 0x80000000
+	_MOVEFILE_REPLACE_EXISTING = 0x1
+	_MOVEFILE_WRITE_THROUGH    = 0x8
+	_ERROR_SHARING_VIOLATION   = syscall.Errno(32)
+	maxRenameRetries           = 50
+	renameRetryInterval        = 10 * time.Millisecond
+)
+
+// openFile opens a file of the store, like os.OpenFile, but shares it for
+// deletion too: a segment a reader has open, e.g. a store opened with
+// OpenReadOnly, can still be sealed, compacted or trashed by the writer.
+func openFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	path, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	var access uint32
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_RDONLY:
+		access = syscall.GENERIC_READ
+	case os.O_WRONLY:
+		access = syscall.GENERIC_WRITE
+	case os.O_RDWR:
+		access = syscall.GENERIC_READ | syscall.GENERIC_WRITE
+	}
+	if flag&os.O_APPEND != 0 {
+		// like os.OpenFile: with write access, the writes would land at the
+		// offset of the file rather than its end; check truncateFile
+		access &^= syscall.GENERIC_WRITE
+		access |= syscall.FILE_APPEND_DATA
+	}
+	var mode uint32
+	switch {
+	case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		mode = syscall.CREATE_NEW
+	case flag&(os.O_CREATE|os.O_TRUNC) == os.O_CREATE|os.O_TRUNC:
+		mode = syscall.CREATE_ALWAYS
+	case flag&os.O_CREATE != 0:
+		mode = syscall.OPEN_ALWAYS
+	case flag&os.O_TRUNC != 0:
+		mode = syscall.TRUNCATE_EXISTING
+	default:
+		mode = syscall.OPEN_EXISTING
+	}
+	attrs := uint32(syscall.FILE_ATTRIBUTE_NORMAL)
+	if perm&0200 == 0 {
+		attrs = syscall.FILE_ATTRIBUTE_READONLY
+	}
+	if flag&os.O_SYNC != 0 {
+		attrs |= _FILE_FLAG_WRITE_THROUGH
+	}
+	share := uint32(syscall.FILE_SHARE_READ | syscall.FILE_SHARE_WRITE | syscall.FILE_SHARE_DELETE)
+	handle, err := syscall.CreateFile(path, access, share, nil, mode, attrs, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return os.NewFile(uintptr(handle), name), nil
+}
+
+// renameFile replaces dst with src, with MoveFileEx, which writes it through to
+// the disk before returning. Replacing a file fails while another process has it
+// open without sharing it for deletion, or until every handle of a file deleted
+// before is closed, so we try again for a while.
+func renameFile(src string, dst string) error {
+	from, err := syscall.UTF16PtrFromString(src)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: src, New: dst, Err: err}
+	}
+	to, err := syscall.UTF16PtrFromString(dst)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: src, New: dst, Err: err}
+	}
+	for i := 0; ; i++ {
+		r, _, err := procMoveFileEx.Call(uintptr(unsafe.Pointer(from)), uintptr(unsafe.Pointer(to)), _MOVEFILE_REPLACE_EXISTING|_MOVEFILE_WRITE_THROUGH)
+		if r != 0 {
+			return nil
+		}
+		retry := errors.Is(err, syscall.ERROR_ACCESS_DENIED) || errors.Is(err, _ERROR_SHARING_VIOLATION)
+		if !retry || i == maxRenameRetries {
+			return &os.LinkError{Op: "rename", Old: src, New: dst, Err: err}
+		}
+		time.Sleep(renameRetryInterval)
+	}
+}
+
+// truncateFile truncates an open file to size. A file opened for appending has no
+// right to truncate it, so the file is truncated through a handle of its own.
+func truncateFile(file *os.File, size int64) error {
+	other, err := openFile(file.Name(), os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	if err := other.Truncate(size); err != nil {
+		other.Close()
+		return err
+	}
+	return other.Close()
+}
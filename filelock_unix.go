@@ -0,0 +1,22 @@
+//go:build linux || darwin || freebsd
+
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive flock on the file, and reports false rather than
+// waiting when another open file holds it. The lock goes when the file is closed.
+func lockFile(file *os.File) (bool, error) {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+	if err != nil {
+		return false, &os.PathError{Op: "flock", Path: file.Name(), Err: err}
+	}
+	return true, nil
+}
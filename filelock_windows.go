@@ -0,0 +1,33 @@
+//go:build windows
+
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+const (
+	_LOCKFILE_FAIL_IMMEDIATELY = 0x1
+	_LOCKFILE_EXCLUSIVE_LOCK   = 0x2
+	_ERROR_LOCK_VIOLATION      = syscall.Errno(33)
+)
+
+// lockFile takes an exclusive lock on the first byte of the file, with
+// LockFileEx, and reports false rather than waiting when another handle holds it.
+// The lock goes when the file is closed.
+func lockFile(file *os.File) (bool, error) {
+	var overlapped syscall.Overlapped
+	r, _, err := procLockFileEx.Call(file.Fd(), _LOCKFILE_EXCLUSIVE_LOCK|_LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if r != 0 {
+		return true, nil
+	}
+	if errors.Is(err, _ERROR_LOCK_VIOLATION) {
+		return false, nil
+	}
+	return false, &os.PathError{Op: "lock", Path: file.Name(), Err: err}
+}
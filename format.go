@@ -36,32 +36,209 @@ package caskdb
 //    func encodeKV(timestamp uint32, key string, value string) (int, []byte)
 //    func decodeKV(data []byte) (uint32, string, string)
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
 
 // headerSize specifies the total header size. Our key value pair, when stored on disk
 // looks like this:
 //
-//	┌───────────┬──────────┬────────────┬─────┬───────┐
-//	│ timestamp │ key_size │ value_size │ key │ value │
-//	└───────────┴──────────┴────────────┴─────┴───────┘
+//	┌─────┬───────────┬──────────┬────────────┬────────┬─────┬───────┐
+//	│ crc │ timestamp │ key_size │ value_size │ expiry │ key │ value │
+//	└─────┴───────────┴──────────┴────────────┴────────┴─────┴───────┘
 //
 // This is analogous to a typical database's row (or a record). The total length of
 // the row is variable, depending on the contents of the key and value.
 //
-// The first three fields form the header:
+// The first five fields form the header:
 //
-//	┌───────────────┬──────────────┬────────────────┐
-//	│ timestamp(4B) │ key_size(4B) │ value_size(4B) │
-//	└───────────────┴──────────────┴────────────────┘
+//	┌─────────┬───────────────┬──────────────┬────────────────┬────────────┐
+//	│ crc(4B) │ timestamp(4B) │ key_size(4B) │ value_size(4B) │ expiry(4B) │
+//	└─────────┴───────────────┴──────────────┴────────────────┴────────────┘
 //
-// These three fields store unsigned integers of size 4 bytes, giving our header a
-// fixed length of 12 bytes. Timestamp field stores the time the record we
-// inserted in unix epoch seconds. Key size and value size fields store the length of
-// bytes occupied by the key and value. The maximum integer
-// stored by 4 bytes is 4,294,967,295 (2 ** 32 - 1), roughly ~4.2GB. So, the size of
-// each key or value cannot exceed this. Theoretically, a single row can be as large
-// as ~8.4GB.
-const headerSize = 12
+// These five fields store unsigned integers of size 4 bytes, giving our header a
+// fixed length of 20 bytes. The last byte of key_size holds the RecordFlags
+// rather than the size, so the keys are at most 16MB; the records written before
+// the flags have none, and read the same as ever. The crc field stores the CRC-32
+// checksum of everything that follows it in the row, so that we can detect a torn
+// write or bit rot when we read the row back. Timestamp field stores the time the
+// record we inserted in unix epoch seconds. Key size and value size fields store
+// the length of bytes occupied by the key and value. The maximum integer stored by
+// 4 bytes is 4,294,967,295 (2 ** 32 - 1), roughly ~4.2GB, so a value cannot exceed
+// this, while a key has the three bytes left by the flags, up to maxKeySize.
+// Theoretically, a single row can be as large as ~4.2GB and 16MB. The expiry field
+// stores the time, in unix epoch seconds, after which the key no longer exists,
+// or 0 if the key does not expire.
+const headerSize = 20
+
+// maxKeySize is the size of the largest key, which the three bytes of key_size
+// left by the flags can hold
+const maxKeySize = 1<<24 - 1
+
+// checkKey reports whether the key can be written. Keys are opaque bytes: any key
+// of up to maxKeySize bytes can, zero bytes and invalid UTF-8 included, except the
+// keys of the records the store writes for itself.
+func checkKey(key string) error {
+	if len(key) > maxKeySize {
+		return fmt.Errorf("%w: %d bytes", ErrKeyTooLarge, len(key))
+	}
+	if reservedKey(key) {
+		return fmt.Errorf("%w: %q", ErrReservedKey, key)
+	}
+	return nil
+}
+
+// reservedKey reports whether the key is one of those of the records the store
+// writes for itself. They all start with a zero byte, but the other keys starting
+// with one are fine.
+func reservedKey(key string) bool {
+	if key == "" || key[0] != 0 {
+		return false
+	}
+	switch key {
+	case truncateKey, compactKey, compactRangeKey, intentKey, intentEndKey:
+		return true
+	}
+	return isTokenKey(key) || isDictKey(key) || isBlobKey(key) || isEpochKey(key) || isStoreKey(key) || isFormatKey(key)
+}
+
+// formatVersion is the version of the layout of the records. Version 1 had a 12
+// byte header of timestamp, key_size and value_size, version 2 added the crc, and
+// version 3 the expiry.
+const formatVersion = 3
+
+// formatKeyPrefix starts the key of the record which the store writes first in
+// every file it starts appending to, and which ends with the formatVersion, e.g.
+// "\x00format\x003". The record is written in the layout of version 3 whatever
+// the version, so that every version can read it and tell whether it can read the
+// rest of the file.
+const formatKeyPrefix = "\x00format\x00"
+
+// isFormatKey reports whether the key is that of a format record.
+func isFormatKey(key string) bool {
+	return strings.HasPrefix(key, formatKeyPrefix)
+}
+
+// formatRecord returns the format record of the current version.
+func formatRecord(timestamp uint32) []byte {
+	version := strconv.Itoa(formatVersion)
+	_, data := encodeRecord(timestamp, 0, formatKeyPrefix+version, version)
+	return data
+}
+
+// checkFormat returns ErrUnsupportedFormat if the format record of the key names a
+// version newer than this one.
+func checkFormat(key string) error {
+	name := strings.TrimPrefix(key, formatKeyPrefix)
+	if version, err := strconv.Atoi(name); err != nil || version > formatVersion {
+		return fmt.Errorf("%w: %q", ErrUnsupportedFormat, name)
+	}
+	return nil
+}
+
+// legacyFormat returns the version of the layout of a file of size bytes which
+// does not read as the current one, or 0 if it reads as none of the older ones
+// either. A file of version 2 starts with a record whose crc matches with a 16 byte
+// header. Those of version 1 have no crc, so they are told apart by their 12 byte
+// headers leading to the end of the file exactly.
+func legacyFormat(r io.ReaderAt, size int64) int {
+	if checksumAt(r, size, headerSize, maxKeySize) {
+		return 0
+	}
+	if checksumAt(r, size, 16, 1<<32-1) {
+		return 2
+	}
+	var header [12]byte
+	offset := int64(0)
+	for offset < size {
+		if _, err := r.ReadAt(header[:], offset); err != nil {
+			return 0
+		}
+		offset += 12 + int64(binary.LittleEndian.Uint32(header[4:8])) + int64(binary.LittleEndian.Uint32(header[8:12]))
+	}
+	if offset == size && size > 0 {
+		return 1
+	}
+	return 0
+}
+
+// checksumAt reports whether the file starts with a record whose crc matches, with
+// a header of n bytes holding the key and value sizes after the crc and the
+// timestamp, the key size masked with keyMask.
+func checksumAt(r io.ReaderAt, size int64, n int, keyMask uint32) bool {
+	header := make([]byte, n)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return false
+	}
+	total := int64(n) + int64(binary.LittleEndian.Uint32(header[8:12])&keyMask) + int64(binary.LittleEndian.Uint32(header[12:16]))
+	if total > size {
+		return false
+	}
+	data := make([]byte, total)
+	if _, err := r.ReadAt(data, 0); err != nil {
+		return false
+	}
+	return binary.LittleEndian.Uint32(data[0:4]) == crc32.ChecksumIEEE(data[4:])
+}
+
+// RecordFlags describe a record. New kinds of records, e.g. with a compressed
+// value, get a flag of their own rather than a new format.
+type RecordFlags uint8
+
+const (
+	// FlagTombstone is set on the record of a delete
+	FlagTombstone RecordFlags = 1 << iota
+	// FlagCompressed is set on the records whose value is compressed, check
+	// Compression
+	FlagCompressed
+	// FlagEncrypted is set on the records whose value is encrypted, check
+	// Options.EncryptionKeys
+	FlagEncrypted
+	// FlagTTL is set on the record of a key which expires
+	FlagTTL
+	// FlagJSON is set on the record of a value written by SetJSON, for the readers
+	// of the log to know it holds JSON
+	FlagJSON
+	// FlagDedup is set on the records whose value is the id of the blob holding
+	// it, check Options.Dedup
+	FlagDedup
+	// FlagMeta is set on the records whose value starts with the metadata of the
+	// key, check PutWithMeta
+	FlagMeta
+)
+
+// supportedFlags are the flags of the records this version can read
+const supportedFlags = FlagTombstone | FlagCompressed | FlagEncrypted | FlagTTL | FlagJSON | FlagDedup | FlagMeta
+
+// contentFlags are the flags describing the value, which a record written again
+// with the same value keeps
+const contentFlags = FlagJSON | FlagMeta
+
+var flagNames = []string{"tombstone", "compressed", "encrypted", "ttl", "json", "dedup", "meta"}
+
+// String returns the names of the flags set, separated by "|", or "-" if none
+// are.
+func (f RecordFlags) String() string {
+	var names []string
+	for i, name := range flagNames {
+		if f&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	if rest := f &^ (1<<len(flagNames) - 1); rest != 0 {
+		names = append(names, fmt.Sprintf("%#x", uint8(rest)))
+	}
+	if len(names) == 0 {
+		return "-"
+	}
+	return strings.Join(names, "|")
+}
 
 // KeyEntry keeps the metadata about the KV, specially the position of
 // the byte offset in the file. Whenever we insert/update a key, we create a new
@@ -70,37 +247,76 @@ type KeyEntry struct {
 	// Timestamp at which we wrote the KV pair to the disk. The value
 	// is current time in seconds since the epoch.
 	timestamp uint32
+	// The segment is the id of the data file holding the record
+	segment uint32
 	// The position is the byte offset in the file where the data
 	// exists
 	position uint32
 	// Total size of bytes of the value. We use this value to know
 	// how many bytes we need to read from the file
 	totalSize uint32
+	// The time in seconds since the epoch after which the key is gone,
+	// or 0 if it does not expire
+	expiry uint32
+	// lastAccess orders the keys by their last read or write, and hits counts
+	// them, for Options.Eviction
+	lastAccess uint64
+	hits       uint32
+	// blob is the blob holding the value, for a record flagged FlagDedup
+	blob *blob
 }
 
 func NewKeyEntry(timestamp uint32, position uint32, totalSize uint32) KeyEntry {
-	return KeyEntry{timestamp, position, totalSize}
+	return KeyEntry{timestamp: timestamp, position: position, totalSize: totalSize}
+}
+
+// expired reports whether the key has expired by now.
+func (k KeyEntry) expired(now time.Time) bool {
+	return k.expiry != 0 && now.Unix() >= int64(k.expiry)
 }
 
+// encodeHeader leaves the crc field zeroed; it is filled in by encodeKV once the
+// key and value are known.
 func encodeHeader(timestamp uint32, keySize uint32, valueSize uint32) []byte {
 	header := make([]byte, headerSize)
-	binary.LittleEndian.PutUint32(header[0:4], timestamp)
-	binary.LittleEndian.PutUint32(header[4:8], keySize)
-	binary.LittleEndian.PutUint32(header[8:12], valueSize)
+	binary.LittleEndian.PutUint32(header[4:8], timestamp)
+	binary.LittleEndian.PutUint32(header[8:12], keySize)
+	binary.LittleEndian.PutUint32(header[12:16], valueSize)
 	return header
 }
 
 func decodeHeader(header []byte) (uint32, uint32, uint32) {
-	timestamp := binary.LittleEndian.Uint32(header[0:4])
-	keySize := binary.LittleEndian.Uint32(header[4:8])
-	valueSize := binary.LittleEndian.Uint32(header[8:12])
+	timestamp := binary.LittleEndian.Uint32(header[4:8])
+	keySize := binary.LittleEndian.Uint32(header[8:12]) & maxKeySize
+	valueSize := binary.LittleEndian.Uint32(header[12:16])
 	return timestamp, keySize, valueSize
 }
 
 func encodeKV(timestamp uint32, key string, value string) (int, []byte) {
+	return encodeRecord(timestamp, 0, key, value)
+}
+
+// encodeRecord is like encodeKV, and also sets the expiry of the record.
+func encodeRecord(timestamp uint32, expiry uint32, key string, value string) (int, []byte) {
+	return encodeRecordFlags(timestamp, expiry, key, value, 0)
+}
+
+// encodeRecordFlags is like encodeRecord, and also sets the flags, on top of those
+// it sets itself.
+func encodeRecordFlags(timestamp uint32, expiry uint32, key string, value string, flags RecordFlags) (int, []byte) {
 	header := encodeHeader(timestamp, uint32(len(key)), uint32(len(value)))
+	binary.LittleEndian.PutUint32(header[16:20], expiry)
+	if value == "" {
+		flags |= FlagTombstone
+	}
+	if expiry != 0 {
+		flags |= FlagTTL
+	}
+	header[11] = byte(flags)
 	data := append([]byte(key), []byte(value)...)
-	return headerSize + len(data), append(header, data...)
+	record := append(header, data...)
+	binary.LittleEndian.PutUint32(record[0:4], crc32.ChecksumIEEE(record[4:]))
+	return headerSize + len(data), record
 }
 
 func decodeKV(data []byte) (uint32, string, string) {
@@ -109,3 +325,22 @@ func decodeKV(data []byte) (uint32, string, string) {
 	value := string(data[headerSize+keySize : headerSize+keySize+valueSize])
 	return timestamp, key, value
 }
+
+// decodeExpiry returns the expiry stored in the record's header.
+func decodeExpiry(data []byte) uint32 {
+	return binary.LittleEndian.Uint32(data[16:20])
+}
+
+// decodeFlags returns the flags stored in the record's header.
+func decodeFlags(data []byte) RecordFlags {
+	return RecordFlags(data[11])
+}
+
+// verifyKV reports whether the checksum stored in the record's header matches the
+// rest of the record. data must hold exactly one full record.
+func verifyKV(data []byte) bool {
+	if len(data) < headerSize {
+		return false
+	}
+	return binary.LittleEndian.Uint32(data[0:4]) == crc32.ChecksumIEEE(data[4:])
+}
@@ -0,0 +1,126 @@
+package caskdb
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// getManyGapBytes is the largest gap between two records GetMany reads through
+// rather than issuing another read
+const getManyGapBytes = 4 << 10
+
+// getManyMaxReadBytes bounds the size of a single read of GetMany, so that a batch
+// of keys spread over a large segment does not read all of it at once
+const getManyMaxReadBytes = 1 << 20
+
+// getManyRead is a record for GetMany to read: that of the key asked for as name,
+// or of the blob holding its value.
+type getManyRead struct {
+	name   string
+	key    string
+	kEntry KeyEntry
+}
+
+// getManyRun is a run of records of a segment GetMany reads at once.
+type getManyRun struct {
+	segment uint32
+	start   int64
+	end     int64
+	reads   []getManyRead
+}
+
+// GetMany looks up the keys, and returns the values of those which exist, by the
+// keys as given. The records are sorted by segment and position, and those close
+// to one another are read with a single pread, so that looking up many scattered
+// keys takes far fewer syscalls than as many Lookups. It fails with the first
+// error reading or decoding a record does, like Lookup.
+func (d *DiskStore) GetMany(keys []string) (values map[string]string, err error) {
+	span := d.tracer.Start(context.Background(), "caskdb.GetMany")
+	defer func() { span.End(err) }()
+	start, size := time.Now(), 0
+	defer func() { d.observe("GetMany", "", size, "", start) }()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	span.SetAttribute(spanAttrWait, int64(time.Since(start)))
+
+	values = make(map[string]string, len(keys))
+	var reads []getManyRead
+	for _, name := range keys {
+		key := d.normalizeKey(name)
+		kEntry, ok := d.keyDir.get(key)
+		if !ok || kEntry.expired(start) {
+			continue
+		}
+		d.touch(key, kEntry)
+		size += int(kEntry.totalSize)
+		if kEntry.blob != nil {
+			key, kEntry = blobKeyPrefix+kEntry.blob.id, kEntry.blob.at
+		}
+		if seg := d.segment(kEntry.segment); seg == nil || seg.remote {
+			// remote records go through the cache of readRemote, and a missing
+			// segment gets the error of read
+			if values[name], err = d.read(key, kEntry); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		reads = append(reads, getManyRead{name: name, key: key, kEntry: kEntry})
+	}
+	// the runs are read all at once, which takes a single system call with
+	// Options.IOUring
+	runs := getManyRuns(reads)
+	runReads := make([]ioRead, len(runs))
+	for i, run := range runs {
+		seg := d.segment(run.segment)
+		file := d.file
+		if seg != d.active() {
+			if file, err = d.openSegment(seg); err != nil {
+				return nil, err
+			}
+		}
+		runReads[i] = ioRead{file: file, buf: make([]byte, run.end-run.start), off: run.start}
+	}
+	if err := d.engine().readAt(runReads); err != nil {
+		return nil, err
+	}
+	for i, run := range runs {
+		seg := d.segment(run.segment)
+		for _, r := range run.reads {
+			offset := int64(r.kEntry.position) - run.start
+			data := runReads[i].buf[offset : offset+int64(r.kEntry.totalSize)]
+			if values[r.name], _, err = d.decodeRecord(seg, r.key, r.kEntry, data); err != nil {
+				return nil, err
+			}
+		}
+	}
+	span.SetAttribute(spanAttrBytes, int64(size))
+	return values, nil
+}
+
+// getManyRuns sorts the reads by segment and position, and merges those which are
+// close into runs.
+func getManyRuns(reads []getManyRead) []getManyRun {
+	sort.Slice(reads, func(i, j int) bool {
+		if reads[i].kEntry.segment != reads[j].kEntry.segment {
+			return reads[i].kEntry.segment < reads[j].kEntry.segment
+		}
+		return reads[i].kEntry.position < reads[j].kEntry.position
+	})
+	var runs []getManyRun
+	for _, r := range reads {
+		start, end := int64(r.kEntry.position), int64(r.kEntry.position)+int64(r.kEntry.totalSize)
+		if n := len(runs); n > 0 {
+			last := &runs[n-1]
+			if last.segment == r.kEntry.segment && start <= last.end+getManyGapBytes && end-last.start <= getManyMaxReadBytes {
+				if end > last.end {
+					last.end = end
+				}
+				last.reads = append(last.reads, r)
+				continue
+			}
+		}
+		runs = append(runs, getManyRun{segment: r.kEntry.segment, start: start, end: end, reads: []getManyRead{r}})
+	}
+	return runs
+}
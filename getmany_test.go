@@ -0,0 +1,82 @@
+package caskdb
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiskStore_GetMany(t *testing.T) {
+	store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{MaxSegmentBytes: 300, Dedup: true})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	want := make(map[string]string)
+	for i := 0; i < 30; i++ {
+		key, value := fmt.Sprintf("key-%d", i%12), fmt.Sprintf("value-%d", i)
+		if err := store.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = value
+	}
+	// values stored in a blob, shared by two keys
+	blob := strings.Repeat("b", 200)
+	for _, key := range []string{"blob-1", "blob-2"} {
+		if err := store.Put(key, blob); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = blob
+	}
+	store.Delete("key-3")
+	delete(want, "key-3")
+	if len(store.segments) < 3 {
+		t.Fatalf("segments = %v, want the store to have rotated", len(store.segments))
+	}
+
+	keys := []string{"missing", "key-3"}
+	for key := range want {
+		keys = append(keys, key)
+	}
+	got, err := store.GetMany(keys)
+	if err != nil {
+		t.Fatalf("GetMany() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetMany() = %v, want %v", got, want)
+	}
+	if got, err := store.GetMany(nil); err != nil || len(got) != 0 {
+		t.Errorf("GetMany(nil) = %v, %v, want no values", got, err)
+	}
+}
+
+func Test_getManyRuns(t *testing.T) {
+	read := func(segment uint32, position uint32, size uint32) getManyRead {
+		return getManyRead{kEntry: KeyEntry{segment: segment, position: position, totalSize: size}}
+	}
+	reads := []getManyRead{
+		read(2, 0, 100),
+		read(1, 500, 100),
+		read(1, 0, 100),
+		read(1, 600+getManyGapBytes+1, 100),
+		read(1, 100, 50),
+		read(2, 200, getManyMaxReadBytes),
+	}
+	var got [][3]int64
+	for _, run := range getManyRuns(reads) {
+		got = append(got, [3]int64{int64(run.segment), run.start, run.end})
+	}
+	// the records close to one another are read at once, but not past the gap, and
+	// not into a read larger than getManyMaxReadBytes
+	want := [][3]int64{
+		{1, 0, 600},
+		{1, 600 + getManyGapBytes + 1, 700 + getManyGapBytes + 1},
+		{2, 0, 100},
+		{2, 200, 200 + getManyMaxReadBytes},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("getManyRuns() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,128 @@
+package caskdb
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Match returns the keys matching the glob pattern, as understood by MatchGlob,
+// in order. Only KeyDir is looked at, no value is read, and when the pattern
+// starts with literal characters, only the keys starting with them are visited.
+func (d *DiskStore) Match(pattern string) []string {
+	pattern = d.normalizeKey(pattern)
+	prefix := pattern
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		prefix = pattern[:i]
+	}
+	return d.match(prefix, func(key string) bool { return MatchGlob(pattern, key) })
+}
+
+// MatchRegexp is like Match, with a regular expression, which matches anywhere in
+// the key unless anchored with ^ and $. It visits every key.
+func (d *DiskStore) MatchRegexp(re *regexp.Regexp) []string {
+	return d.match("", re.MatchString)
+}
+
+// match returns the live keys starting with prefix for which fn returns true, in
+// order.
+func (d *DiskStore) match(prefix string, fn func(key string) bool) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	var keys []string
+	d.keys.ascend(prefix, func(key string) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		if fn(key) && !d.keyEntry(key).expired(now) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys
+}
+
+// MatchGlob reports whether s matches the Redis style glob pattern, in which '*'
+// matches any sequence of characters, including none, '?' any single character,
+// [abc] one of the characters, [^abc] any other character, [a-z] a range of
+// characters and \x the character x literally.
+//
+// Unlike path.Match, '*' also matches '/', since keys are not paths.
+func MatchGlob(pattern string, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			// collapse consecutive stars, then try every split of s
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if MatchGlob(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			rest, ok := matchClass(pattern[1:], s[0])
+			if !ok {
+				return false
+			}
+			pattern, s = rest, s[1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		}
+	}
+	return len(s) == 0
+}
+
+// matchClass matches c against the character class at the start of pattern, just
+// after the '['. It returns the pattern after the closing ']' and whether c is in
+// the class. An unterminated class runs to the end of the pattern.
+func matchClass(pattern string, c byte) (string, bool) {
+	negate := len(pattern) > 0 && pattern[0] == '^'
+	if negate {
+		pattern = pattern[1:]
+	}
+	matched := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) > 1:
+			matched = matched || pattern[1] == c
+			pattern = pattern[2:]
+		case len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']':
+			lo, hi := pattern[0], pattern[2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || (lo <= c && c <= hi)
+			pattern = pattern[3:]
+		default:
+			matched = matched || pattern[0] == c
+			pattern = pattern[1:]
+		}
+	}
+	if len(pattern) > 0 {
+		pattern = pattern[1:]
+	}
+	return pattern, matched != negate
+}
@@ -0,0 +1,61 @@
+package caskdb
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"testing"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"*", "", true},
+		{"*", "books/hamlet", true},
+		{"book:*", "book:hamlet", true},
+		{"book:*", "author:tolstoy", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"*:*:*", "a:b:c", true},
+		{"*:*:*", "a:b", false},
+	}
+	for _, tt := range tests {
+		if got := MatchGlob(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("MatchGlob(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestDiskStore_Match(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	for _, key := range []string{"books/hamlet", "books/othello", "films/hamlet", "books/dune"} {
+		store.Set(key, "some author")
+	}
+	store.Delete("books/othello")
+	if got := store.Match("books/*"); fmt.Sprint(got) != "[books/dune books/hamlet]" {
+		t.Errorf("Match() = %v, want [books/dune books/hamlet]", got)
+	}
+	if got := store.Match("*/hamlet"); fmt.Sprint(got) != "[books/hamlet films/hamlet]" {
+		t.Errorf("Match() = %v, want [books/hamlet films/hamlet]", got)
+	}
+	if got := store.MatchRegexp(regexp.MustCompile(`^(books|films)/h`)); fmt.Sprint(got) != "[books/hamlet films/hamlet]" {
+		t.Errorf("MatchRegexp() = %v, want [books/hamlet films/hamlet]", got)
+	}
+}
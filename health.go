@@ -0,0 +1,64 @@
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+// errDiskFreeUnsupported is returned by diskFree on platforms where we do not know
+// how to ask for the free space. Healthy skips the check there.
+var errDiskFreeUnsupported = errors.New("caskdb: free disk space is not supported on this platform")
+
+// Ping checks that the store's file is still open and usable. It does no I/O on
+// the data itself, so it is cheap enough for a liveness probe. It does not wait
+// for a store which is loading in the background.
+func (d *DiskStore) Ping() error {
+	if d.loading() {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, err := d.file.Stat()
+	return err
+}
+
+// Healthy checks that the store can take writes: the file is usable (see Ping),
+// the last fsync succeeded, none failed with writes left unsynced (check Sync),
+// and the disk has at least Options.MinFreeDiskBytes free. It is meant for a
+// readiness probe; a store which fails it can usually still serve reads. A store
+// which is loading in the background is not ready until it is done, and Healthy
+// returns ErrLoading until then, or the error the load failed with.
+func (d *DiskStore) Healthy() error {
+	if d.loading() {
+		return ErrLoading
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.loadErr != nil {
+		return d.loadErr
+	}
+	if d.leaseErr != nil {
+		return d.leaseErr
+	}
+	if _, err := d.file.Stat(); err != nil {
+		return err
+	}
+	if err := d.syncFailure(); err != nil {
+		return err
+	}
+	if d.opts.MinFreeDiskBytes == 0 {
+		return nil
+	}
+	free, err := diskFree(filepath.Dir(d.file.Name()))
+	if errors.Is(err, errDiskFreeUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if free < d.opts.MinFreeDiskBytes {
+		return fmt.Errorf("%w: %d bytes free, want at least %d", ErrLowDiskSpace, free, d.opts.MinFreeDiskBytes)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package caskdb
+
+import (
+	"errors"
+	"math"
+	"os"
+	"testing"
+)
+
+func TestDiskStore_Healthy(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("hamlet", "shakespeare")
+	if err := store.Ping(); err != nil {
+		t.Errorf("Ping() error = %v", err)
+	}
+	if err := store.Healthy(); err != nil {
+		t.Errorf("Healthy() error = %v", err)
+	}
+	store.Close()
+	if err := store.Ping(); err == nil {
+		t.Errorf("Ping() on a closed store error = nil, want an error")
+	}
+}
+
+func TestDiskStore_HealthyLowDiskSpace(t *testing.T) {
+	if _, err := diskFree("."); errors.Is(err, errDiskFreeUnsupported) {
+		t.Skip("free disk space is not supported on this platform")
+	}
+	store, err := NewDiskStoreWithOptions("test.db", Options{MinFreeDiskBytes: math.MaxUint64})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	if err := store.Healthy(); !errors.Is(err, ErrLowDiskSpace) {
+		t.Errorf("Healthy() error = %v, want %v", err, ErrLowDiskSpace)
+	}
+}
+
+func TestDiskStore_Sync(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	store.lastSyncErr = errors.New("input/output error")
+	if err := store.Healthy(); !errors.Is(err, ErrSyncFailed) {
+		t.Errorf("Healthy() after a failed fsync error = %v, want ErrSyncFailed", err)
+	}
+	if err := store.Sync(); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	if err := store.Healthy(); err != nil {
+		t.Errorf("Healthy() after Sync() error = %v", err)
+	}
+}
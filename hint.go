@@ -0,0 +1,151 @@
+package caskdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"os"
+)
+
+// A hint file sits next to a sealed segment, e.g. books.db.000042.hint, and holds
+// what loading the store needs from the segment: the header and key of every
+// record, and the value of the few records hintValue lists. Loading a segment
+// from its hint reads a fraction of the bytes of a full scan, and skips checking
+// every record, which was done when the hint was written.
+//
+// The hint starts with hintMagic and the size and modification time of the
+// segment it was written from, in nanoseconds since the epoch, and ends with the
+// CRC32 of everything before. A hint which does not match its segment, or fails
+// its checksum, is discarded, and the segment is scanned instead:
+//
+//	magic | segment_size | segment_mtime | hints... | crc
+//
+// The hints are written by the first load of a sealed segment which had none, so
+// that the next ones can use them. A store opened with OpenReadOnly uses them, but
+// never writes any.
+
+// hintSuffix is appended to the name of a sealed segment for its hint file
+const hintSuffix = ".hint"
+
+// hintMagic starts every hint file
+const hintMagic = "CKH1"
+
+// hintHeaderSize is the size of the magic, segment size and modification time
+const hintHeaderSize = len(hintMagic) + 8 + 8
+
+// hintValue reports whether the hint of a record holds its value: the
+// dictionaries, the blob ids of the records referencing one, and the outcome of an
+// intent are needed to load the segment.
+func hintValue(key string, flags RecordFlags) bool {
+	return isDictKey(key) || flags&FlagDedup != 0 || key == intentEndKey
+}
+
+// appendHint appends the hint of the record to hint.
+func appendHint(hint []byte, data []byte) []byte {
+	_, keySize, _ := decodeHeader(data)
+	end := headerSize + int(keySize)
+	if hintValue(string(data[headerSize:end]), decodeFlags(data)) {
+		end = len(data)
+	}
+	return append(hint, data[:end]...)
+}
+
+// loadSealed loads a sealed segment from its hint file, or scans it when its hint
+// is missing or stale, and then writes a fresh one.
+func (d *DiskStore) loadSealed(seg *segment) error {
+	info, err := os.Stat(seg.path)
+	if err != nil {
+		return err
+	}
+	if hint := d.readHint(seg, info); hint != nil {
+		if d.readOnly {
+			// a read-only store keeps the segment open, like loadSegment does
+			if seg.file, err = openFile(seg.path, os.O_RDONLY, 0); err != nil {
+				return err
+			}
+		}
+		return d.loadHint(seg, hint)
+	}
+	if d.readOnly {
+		return d.loadSegment(seg)
+	}
+	hint := make([]byte, hintHeaderSize, hintHeaderSize+int(info.Size()/8))
+	if err := d.scanSegment(seg, &hint); err != nil {
+		return err
+	}
+	if seg.size != info.Size() {
+		// changed under us; better no hint than a wrong one
+		return nil
+	}
+	copy(hint, hintMagic)
+	binary.LittleEndian.PutUint64(hint[len(hintMagic):], uint64(info.Size()))
+	binary.LittleEndian.PutUint64(hint[len(hintMagic)+8:], uint64(info.ModTime().UnixNano()))
+	hint = binary.LittleEndian.AppendUint32(hint, crc32.ChecksumIEEE(hint))
+	// the store is fine without it, the next load scans the segment again
+	if err := writeFileSync(seg.path+hintSuffix, bytes.NewReader(hint)); err != nil {
+		d.log.Error("failed to write hint", "file", seg.path+hintSuffix, "error", err)
+	}
+	return nil
+}
+
+// readHint returns the hints of the segment, without the header and checksum, or
+// nil if it has no hint file which matches it.
+func (d *DiskStore) readHint(seg *segment, info fs.FileInfo) []byte {
+	name := seg.path + hintSuffix
+	hint, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	n := len(hint) - 4
+	switch {
+	case err != nil:
+		d.log.Warn("discarding unreadable hint", "file", name, "error", err)
+	case n < hintHeaderSize || string(hint[:len(hintMagic)]) != hintMagic || binary.LittleEndian.Uint32(hint[n:]) != crc32.ChecksumIEEE(hint[:n]):
+		d.log.Warn("discarding corrupt hint", "file", name)
+	case int64(binary.LittleEndian.Uint64(hint[len(hintMagic):])) != info.Size() || int64(binary.LittleEndian.Uint64(hint[len(hintMagic)+8:])) != info.ModTime().UnixNano():
+		d.log.Warn("discarding stale hint", "file", name)
+	default:
+		return hint[hintHeaderSize:n]
+	}
+	return nil
+}
+
+// loadHint applies the hints of the segment to keyDir.
+func (d *DiskStore) loadHint(seg *segment, hint []byte) error {
+	l := d.newSegmentLoader(seg)
+	offset := 0
+	for len(hint) > 0 {
+		if len(hint) < headerSize {
+			return errCorruptHint(seg)
+		}
+		_, keySize, valueSize := decodeHeader(hint)
+		end := headerSize + int(keySize)
+		if len(hint) < end {
+			return errCorruptHint(seg)
+		}
+		key, value := string(hint[headerSize:end]), ""
+		if hintValue(key, decodeFlags(hint)) {
+			if len(hint) < end+int(valueSize) {
+				return errCorruptHint(seg)
+			}
+			value = string(hint[end : end+int(valueSize)])
+			end += int(valueSize)
+		}
+		if err := l.load(offset, hint[:headerSize], key, value); err != nil {
+			return err
+		}
+		offset += headerSize + int(keySize) + int(valueSize)
+		hint = hint[end:]
+	}
+	if l.pending != nil {
+		return errCorruptHint(seg)
+	}
+	return nil
+}
+
+func errCorruptHint(seg *segment) error {
+	return fmt.Errorf("%w: %s", ErrCorruptRecord, seg.path+hintSuffix)
+}
@@ -0,0 +1,87 @@
+package caskdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_hints(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{MaxSegmentBytes: 100, Dedup: true}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	want := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		key, value := fmt.Sprintf("key-%d", i%7), fmt.Sprintf("value-%d", i)
+		store.Set(key, value)
+		want[key] = value
+	}
+	store.Delete("key-3")
+	delete(want, "key-3")
+	txn := store.Begin()
+	txn.Put("key-0", "in a txn")
+	txn.Put("key-1", string(make([]byte, 200)))
+	txn.Commit()
+	want["key-0"], want["key-1"] = "in a txn", string(make([]byte, 200))
+	// the commit goes to a sealed segment too
+	for i := 0; i < 5; i++ {
+		store.Set("key-6", fmt.Sprintf("value-%d", i))
+	}
+	want["key-6"] = "value-4"
+	store.Close()
+
+	check := func(logger *recordLogger, wantLogged string) {
+		t.Helper()
+		opts.Logger = logger
+		store, err := NewDiskStoreWithOptions(fileName, opts)
+		if err != nil {
+			t.Fatalf("failed to reopen disk store: %v", err)
+		}
+		defer store.Close()
+		for key, value := range want {
+			if got := store.Get(key); got != value {
+				t.Errorf("Get(%q) = %q, want %q", key, got, value)
+			}
+		}
+		if len(store.Keys()) != len(want) {
+			t.Errorf("Keys() = %v, want %v keys", store.Keys(), len(want))
+		}
+		if wantLogged != "" && !logger.has(wantLogged) {
+			t.Errorf("logged %v, want %q", logger.messages, wantLogged)
+		}
+	}
+	// the first load of the segments writes their hints, which the next one uses
+	check(&recordLogger{}, "")
+	hint := sealedPath(fileName, 1) + hintSuffix
+	if _, err := os.Stat(hint); err != nil {
+		t.Fatalf("hint file error = %v, want one written", err)
+	}
+	check(&recordLogger{}, "")
+
+	data, err := os.ReadFile(hint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := os.WriteFile(hint, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	check(&recordLogger{}, "discarding corrupt hint")
+
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(sealedPath(fileName, 1), later, later); err != nil {
+		t.Fatal(err)
+	}
+	check(&recordLogger{}, "discarding stale hint")
+	// and written anew
+	logger := &recordLogger{}
+	check(logger, "")
+	if logger.has("discarding stale hint") || logger.has("discarding corrupt hint") {
+		t.Errorf("logged %v, want the hint rewritten", logger.messages)
+	}
+}
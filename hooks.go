@@ -0,0 +1,35 @@
+package caskdb
+
+import (
+	"fmt"
+	"time"
+)
+
+// LoadedRecord is a record of the log read back as the store is opened, for
+// Options.OnLoad. It tells about the key only: the values are not read at startup.
+type LoadedRecord struct {
+	Key string
+	// Deleted is set for a delete; an expired key is reported as it was written,
+	// with its Expiry
+	Deleted   bool
+	Timestamp time.Time
+	// Expiry is when the key expires, zero if it does not
+	Expiry time.Time
+	// Size is the size of the record on the disk
+	Size int
+}
+
+// reportLoad passes the record of key read back from the log to onLoad, and keeps
+// the first error it returns for loadSegments and loadActive to fail with.
+func (d *DiskStore) reportLoad(key string, kEntry KeyEntry, tombstone bool) {
+	if d.onLoad == nil || d.onLoadErr != nil {
+		return
+	}
+	r := LoadedRecord{Key: key, Deleted: tombstone, Timestamp: time.Unix(int64(kEntry.timestamp), 0), Size: int(kEntry.totalSize)}
+	if kEntry.expiry != 0 {
+		r.Expiry = time.Unix(int64(kEntry.expiry), 0)
+	}
+	if err := d.onLoad(r); err != nil {
+		d.onLoadErr = fmt.Errorf("caskdb: loading %q: %w", key, err)
+	}
+}
@@ -0,0 +1,76 @@
+package caskdb
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiskStore_OnLoad(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{MaxSegmentBytes: 100})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.mu.Lock()
+	store.putAt("othello", "shakespeare", 1000, 0, "", 0)
+	store.putAt("dune", "herbert", 2000, 5000, "", 0)
+	store.putAt("othello", "", 3000, 0, "", 0)
+	store.mu.Unlock()
+	store.Close()
+
+	var got []LoadedRecord
+	var opened bool
+	store, err = NewDiskStoreWithOptions(fileName, Options{
+		MaxSegmentBytes: 100,
+		OnLoad: func(r LoadedRecord) error {
+			got = append(got, LoadedRecord{Key: r.Key, Deleted: r.Deleted})
+			if r.Key == "dune" && (r.Timestamp.Unix() != 2000 || r.Expiry.Unix() != 5000 || r.Size != headerSize+4+7) {
+				t.Errorf("OnLoad() with %+v, want the timestamp, expiry and size of dune", r)
+			}
+			return nil
+		},
+		OnOpen: func(d *DiskStore) error {
+			opened = d.Get("dune") == "" && d.Get("othello") == ""
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	store.Close()
+	// the expired dune is reported all the same
+	want := []LoadedRecord{{Key: "othello"}, {Key: "dune"}, {Key: "othello", Deleted: true}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("OnLoad() called with %+v, want %+v", got, want)
+	}
+	if !opened {
+		t.Errorf("OnOpen() was not called with the store loaded")
+	}
+
+	errInvalid := errors.New("invalid key")
+	_, err = NewDiskStoreWithOptions(fileName, Options{OnLoad: func(r LoadedRecord) error {
+		if r.Key == "dune" {
+			return errInvalid
+		}
+		return nil
+	}})
+	if !errors.Is(err, errInvalid) {
+		t.Errorf("NewDiskStoreWithOptions() error = %v, want %v", err, errInvalid)
+	}
+	_, err = NewDiskStoreWithOptions(fileName, Options{OnOpen: func(*DiskStore) error { return errInvalid }})
+	if !errors.Is(err, errInvalid) {
+		t.Errorf("NewDiskStoreWithOptions() error = %v, want %v", err, errInvalid)
+	}
+
+	store, err = NewDiskStoreWithOptions(fileName, Options{LoadInBackground: true, OnOpen: func(*DiskStore) error { return errInvalid }})
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	<-store.Loaded()
+	if err := store.Healthy(); !errors.Is(err, errInvalid) {
+		t.Errorf("Healthy() = %v, want %v", err, errInvalid)
+	}
+	store.Close()
+}
@@ -0,0 +1,112 @@
+package caskdb
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// DefaultIdempotencyWindow is how long the idempotency tokens are remembered when
+// Options.IdempotencyWindow is not set.
+const DefaultIdempotencyWindow = 24 * time.Hour
+
+// tokenKeyPrefix is the prefix of the key of the records holding idempotency
+// tokens. They are written to the log right after the write they belong to, so
+// that the tokens survive a restart, but they never make it into KeyDir. Keys
+// starting with it are reserved.
+const tokenKeyPrefix = "\x00token\x00"
+
+// tokenSweepInterval is the number of tokens added between two sweeps of the
+// expired ones
+const tokenSweepInterval = 1024
+
+type idempotencyTokenKey struct{}
+
+// WithIdempotencyToken returns a context carrying an idempotency token for the
+// write it is passed to, i.e. PutContext or DeleteContext. The store records the
+// token along with the write, and a write carrying a token it has seen within
+// Options.IdempotencyWindow is not applied again. Retrying a write with the same
+// token is then safe, even after the key was written since: at-least-once
+// delivery becomes exactly-once.
+//
+// The token must be unique per write, e.g. a UUID or the ID of the message which
+// caused the write.
+func WithIdempotencyToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, idempotencyTokenKey{}, token)
+}
+
+// IdempotencyToken returns the token set on ctx with WithIdempotencyToken, or ""
+// if there is none.
+func IdempotencyToken(ctx context.Context) string {
+	token, _ := ctx.Value(idempotencyTokenKey{}).(string)
+	return token
+}
+
+// seen reports whether the token was recorded, and has not expired by now. The
+// store must be locked.
+func (d *DiskStore) seen(token string, now time.Time) bool {
+	if token == "" {
+		return false
+	}
+	expiry, ok := d.tokens[token]
+	if ok && now.Unix() >= int64(expiry) {
+		delete(d.tokens, token)
+		return false
+	}
+	return ok
+}
+
+// appendToken appends the record of the token to data, unless the token is empty.
+func (d *DiskStore) appendToken(data []byte, token string, timestamp uint32) []byte {
+	if token == "" {
+		return data
+	}
+	// the record of the write comes first: if we crash in the middle, we would
+	// rather apply a retry again than lose the write
+	_, record := encodeRecord(timestamp, d.tokenExpiry(timestamp), tokenKeyPrefix+token, "1")
+	return append(data, record...)
+}
+
+// writeToken records the token of a write which had nothing to write, unless the
+// token is empty. The store must be locked.
+func (d *DiskStore) writeToken(token string, timestamp uint32) error {
+	data := d.appendToken(nil, token, timestamp)
+	if data == nil {
+		return nil
+	}
+	if err := d.write(data); err != nil {
+		return err
+	}
+	d.writePosition += len(data)
+	d.remember(token, timestamp)
+	return nil
+}
+
+// remember records the token as seen. The store must be locked.
+func (d *DiskStore) remember(token string, timestamp uint32) {
+	if token == "" {
+		return
+	}
+	d.tokens[token] = d.tokenExpiry(timestamp)
+	d.tokensAdded++
+	if d.tokensAdded < tokenSweepInterval {
+		return
+	}
+	d.tokensAdded = 0
+	now := time.Now().Unix()
+	for token, expiry := range d.tokens {
+		if now >= int64(expiry) {
+			delete(d.tokens, token)
+		}
+	}
+}
+
+// tokenExpiry returns when a token recorded at timestamp expires.
+func (d *DiskStore) tokenExpiry(timestamp uint32) uint32 {
+	return timestamp + uint32(d.opts.IdempotencyWindow/time.Second)
+}
+
+// isTokenKey reports whether the key is that of an idempotency token record.
+func isTokenKey(key string) bool {
+	return strings.HasPrefix(key, tokenKeyPrefix)
+}
@@ -0,0 +1,71 @@
+package caskdb
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_IdempotencyToken(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	set := WithIdempotencyToken(context.Background(), "set-1")
+	if err := store.PutContext(set, "othello", "shakespeare"); err != nil {
+		t.Fatalf("PutContext() error = %v", err)
+	}
+	store.Set("othello", "verdi")
+	// a late retry does not overwrite the newer value
+	if err := store.PutContext(set, "othello", "shakespeare"); err != nil {
+		t.Fatalf("PutContext() retry error = %v", err)
+	}
+	if val := store.Get("othello"); val != "verdi" {
+		t.Errorf("Get() after a retry = %v, want %v", val, "verdi")
+	}
+	// deleting a missing key records its token all the same
+	del := WithIdempotencyToken(context.Background(), "delete-1")
+	if err := store.DeleteContext(del, "hamlet"); err != nil {
+		t.Fatalf("DeleteContext() error = %v", err)
+	}
+	store.Set("hamlet", "shakespeare")
+	store.Close()
+
+	// the tokens survive a restart
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	store.DeleteContext(del, "hamlet")
+	store.PutContext(set, "othello", "shakespeare")
+	if val := store.Get("hamlet"); val != "shakespeare" {
+		t.Errorf("Get(hamlet) after a retried delete = %v, want %v", val, "shakespeare")
+	}
+	if val := store.Get("othello"); val != "verdi" {
+		t.Errorf("Get(othello) after a retried set = %v, want %v", val, "verdi")
+	}
+	if keys := store.Keys(); len(keys) != 2 {
+		t.Errorf("Keys() = %v, want the tokens left out", keys)
+	}
+	changes, _, err := store.ReadChanges(0, 100)
+	if err != nil {
+		t.Fatalf("ReadChanges() error = %v", err)
+	}
+	for _, change := range changes {
+		if isTokenKey(change.Key) {
+			t.Errorf("ReadChanges() returned the token record %q", change.Key)
+		}
+	}
+
+	// once the window has passed, the token is forgotten
+	if !store.seen("set-1", time.Now()) {
+		t.Errorf("seen() = false, want the token within the window")
+	}
+	if store.seen("set-1", time.Now().Add(DefaultIdempotencyWindow+time.Second)) {
+		t.Errorf("seen() = true, want the token forgotten after the window")
+	}
+}
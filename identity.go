@@ -0,0 +1,59 @@
+package caskdb
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+)
+
+// storeKeyPrefix starts the key of the record of the identity of a store, which
+// ends with its ID, e.g. "\x00store\x00f47ac10b-58cc-4372-a567-0e02b2c3d479". The
+// copies CopyTo and Split write start with one, and Compact keeps it. Like the
+// epoch, the ID is in the key so that it can be read from the index of a remote
+// segment too.
+const storeKeyPrefix = "\x00store\x00"
+
+// isStoreKey reports whether the key is that of an identity record.
+func isStoreKey(key string) bool {
+	return strings.HasPrefix(key, storeKeyPrefix)
+}
+
+// newStoreID returns a random UUID, version 4.
+func newStoreID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// ID returns the identity of the store, a UUID assigned when it was created and
+// kept in books.db.stats along with the LifetimeStats. Copies of the store keep
+// it, so that replication, backup and merge tools can check that two stores, or a
+// store and a file, are the same database before mixing them. It is also part of
+// Stats.
+//
+// Segments have no header of their own, so a segment carries the ID only if it
+// holds the start of a copy, or was compacted from one. Loading a store fails with
+// ErrForeignSegment on such a segment of another store.
+func (d *DiskStore) ID() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.id
+}
+
+// loadStoreID applies an identity record read back from the log: a store which
+// has no ID yet, e.g. opened from a copy, takes it on. The store must be locked.
+func (d *DiskStore) loadStoreID(key string) error {
+	id := strings.TrimPrefix(key, storeKeyPrefix)
+	if d.id == "" {
+		d.id = id
+		return nil
+	}
+	if id != d.id {
+		return fmt.Errorf("%w: %s, want %s", ErrForeignSegment, id, d.id)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestDiskStore_ID(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	id := store.ID()
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(id) {
+		t.Errorf("ID() = %q, want a UUID", id)
+	}
+	store.Set("othello", "shakespeare")
+	store.Close()
+
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	if got := store.Stats().ID; got != id {
+		t.Errorf("Stats().ID after reopening = %q, want %q", got, id)
+	}
+	copyName := filepath.Join(dir, "copy.db")
+	if err := store.CopyTo(copyName); err != nil {
+		t.Fatalf("CopyTo() error = %v", err)
+	}
+	clone, err := NewDiskStore(copyName)
+	if err != nil {
+		t.Fatalf("failed to open the copy: %v", err)
+	}
+	if got := clone.ID(); got != id {
+		t.Errorf("ID() of the copy = %q, want %q, that of the store", got, id)
+	}
+	clone.Close()
+
+	// the copy of the store turns up as a segment of another one
+	other := filepath.Join(dir, "other.db")
+	otherStore, err := NewDiskStore(other)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	otherStore.Close()
+	if err := os.Rename(copyName, sealedPath(other, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDiskStore(other); !errors.Is(err, ErrForeignSegment) {
+		t.Errorf("NewDiskStore() with a segment of another store error = %v, want %v", err, ErrForeignSegment)
+	}
+}
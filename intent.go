@@ -0,0 +1,79 @@
+package caskdb
+
+import "strconv"
+
+// The records of a Txn.Commit of more than one write are written between an
+// intent record and an end record, so that they are applied all or none: on
+// load, the records following an intent are held back until its end record, and
+// dropped if it never comes, e.g. after a crash in the middle of the commit. The
+// value of the intent record is the number of records of the commit, and that of
+// the end record is intentCommit, or intentAbort for a commit which failed part
+// way. The records are held in a writeBatch until the end record, and appended
+// with a single writev, so a commit failing part way now writes nothing, but the
+// logs of earlier versions can still hold aborted ones.
+const (
+	intentKey    = "\x00intent\x00"
+	intentEndKey = "\x00intent-end\x00"
+	intentCommit = "commit"
+	intentAbort  = "abort"
+)
+
+// isIntentKey reports whether the key is that of an intent or end record.
+func isIntentKey(key string) bool {
+	return key == intentKey || key == intentEndKey
+}
+
+// txnUndo is what a write of Txn.Commit replaced in keyDir, to put it back when
+// the commit fails part way.
+type txnUndo struct {
+	key    string
+	old    KeyEntry
+	exists bool
+}
+
+// beginIntent writes the intent record of a commit of n records of about size
+// bytes. The commit goes to a new segment if it would take the active one past
+// its limit, and stays in the one it starts in. The store must be locked.
+func (d *DiskStore) beginIntent(n int, size int, timestamp uint32) error {
+	_, data := encodeRecord(timestamp, 0, intentKey, strconv.Itoa(n))
+	if d.writePosition > 0 && d.segmentFull(len(data)+size) {
+		if err := d.rotate(); err != nil {
+			return err
+		}
+	}
+	d.batch = batchPool.Get().(*writeBatch)
+	if err := d.write(data); err != nil {
+		d.releaseBatch()
+		return err
+	}
+	d.writePosition += len(data)
+	d.inIntent = true
+	return nil
+}
+
+// endIntent writes the end record of the commit, and appends the records of the
+// commit to the file. The store must be locked.
+func (d *DiskStore) endIntent(timestamp uint32) error {
+	defer func() { d.inIntent = false }()
+	_, data := encodeRecord(timestamp, 0, intentEndKey, intentCommit)
+	if err := d.write(data); err != nil {
+		return err
+	}
+	d.writePosition += len(data)
+	return d.flushBatch()
+}
+
+// abortIntent ends the commit which failed part way: the writes it applied are
+// taken back from keyDir, and its records, which never made it to the file, are
+// discarded. The store must be locked.
+func (d *DiskStore) abortIntent(undo []txnUndo) {
+	for i := len(undo) - 1; i >= 0; i-- {
+		if u := undo[i]; u.exists {
+			d.setKey(u.key, u.old)
+		} else {
+			d.dropKey(u.key)
+		}
+	}
+	d.discardBatch()
+	d.inIntent = false
+}
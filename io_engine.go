@@ -0,0 +1,51 @@
+package caskdb
+
+import "os"
+
+// ioEngine does the reads of the local segments and the batched writes of the
+// store: with plain syscalls, or with io_uring, check Options.IOUring. It is used
+// with the store locked.
+type ioEngine interface {
+	// readAt fills the buffer of each of the reads, and fails with the first error
+	// one of them runs into
+	readAt(reads []ioRead) error
+	// writev appends the buffers to the file, check writev
+	writev(file *os.File, bufs [][]byte) error
+	close() error
+}
+
+// ioRead is a read of len(buf) bytes of the file, at off.
+type ioRead struct {
+	file *os.File
+	buf  []byte
+	off  int64
+}
+
+// syscallEngine is the ioEngine doing a pread per read, and a writev per batch.
+type syscallEngine struct{}
+
+func (syscallEngine) readAt(reads []ioRead) error {
+	for _, r := range reads {
+		if _, err := r.file.ReadAt(r.buf, r.off); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (syscallEngine) writev(file *os.File, bufs [][]byte) error {
+	return writev(file, bufs)
+}
+
+func (syscallEngine) close() error {
+	return nil
+}
+
+// engine returns the ioEngine of the store, setting it up on first use, so that a
+// store which fails to open has nothing to release. The store must be locked.
+func (d *DiskStore) engine() ioEngine {
+	if d.io == nil {
+		d.io = newIOEngine(d.opts, d.log)
+	}
+	return d.io
+}
@@ -0,0 +1,102 @@
+package caskdb
+
+import "time"
+
+// Iterator walks the keys of a DiskStore in order, forwards or backwards. It
+// does not hold the store between calls: every move looks up the key next to the
+// current one, so writes carry on meanwhile, and the iterator sees the keys as
+// they are when it moves. A key added behind it is not visited, one added ahead of
+// it is.
+//
+// Typical usage, from the first key on or from the last one back:
+//
+//	it := store.Iterator()
+//	for it.Seek("books/"); it.Valid(); it.Next() {
+//		value, err := it.Value()
+//	}
+//	for it.Last(); it.Valid(); it.Prev() {
+//	}
+type Iterator struct {
+	store *DiskStore
+	key   string
+	valid bool
+}
+
+// Iterator returns an iterator over the keys of the store. It is not positioned
+// on any key until First, Last or Seek is called.
+func (d *DiskStore) Iterator() *Iterator {
+	return &Iterator{store: d}
+}
+
+// First moves to the first key.
+func (it *Iterator) First() {
+	it.move(func(x keyOrder) (string, bool) { return x.seek("") }, true)
+}
+
+// Last moves to the last key.
+func (it *Iterator) Last() {
+	it.move(func(x keyOrder) (string, bool) { return x.last() }, false)
+}
+
+// Seek moves to the first key not less than key.
+func (it *Iterator) Seek(key string) {
+	key = it.store.normalizeKey(key)
+	it.move(func(x keyOrder) (string, bool) { return x.seek(key) }, true)
+}
+
+// Next moves to the key after the current one.
+func (it *Iterator) Next() {
+	if !it.valid {
+		return
+	}
+	// nothing sorts between a key and the key followed by a zero byte
+	key := it.key + "\x00"
+	it.move(func(x keyOrder) (string, bool) { return x.seek(key) }, true)
+}
+
+// Prev moves to the key before the current one.
+func (it *Iterator) Prev() {
+	if !it.valid {
+		return
+	}
+	key := it.key
+	it.move(func(x keyOrder) (string, bool) { return x.before(key) }, false)
+}
+
+// Valid reports whether the iterator is on a key. It is not once it moved past
+// either end.
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+// Key returns the current key.
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+// Value reads the value of the current key. It fails with ErrKeyNotFound if the
+// key was deleted since the iterator moved to it.
+func (it *Iterator) Value() (string, error) {
+	return it.store.Lookup(it.key)
+}
+
+// move positions the iterator on the key find returns, skipping expired keys
+// forwards or backwards.
+func (it *Iterator) move(find func(x keyOrder) (string, bool), forward bool) {
+	d := it.store
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	key, ok := find(d.keys)
+	for ok && d.keyEntry(key).expired(now) {
+		if forward {
+			key, ok = d.keys.seek(key + "\x00")
+		} else {
+			key, ok = d.keys.before(key)
+		}
+	}
+	it.valid = ok
+	if it.valid {
+		it.key = key
+	}
+}
@@ -0,0 +1,62 @@
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestIterator(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	for _, key := range []string{"dune", "othello", "hamlet", "emma"} {
+		store.Set(key, "some author")
+	}
+	it := store.Iterator()
+	var forward, backward []string
+	for it.First(); it.Valid(); it.Next() {
+		forward = append(forward, it.Key())
+	}
+	for it.Last(); it.Valid(); it.Prev() {
+		backward = append(backward, it.Key())
+	}
+	if fmt.Sprint(forward) != "[dune emma hamlet othello]" {
+		t.Errorf("iterating forwards = %v, want [dune emma hamlet othello]", forward)
+	}
+	if fmt.Sprint(backward) != "[othello hamlet emma dune]" {
+		t.Errorf("iterating backwards = %v, want [othello hamlet emma dune]", backward)
+	}
+
+	it.Seek("f")
+	if !it.Valid() || it.Key() != "hamlet" {
+		t.Fatalf("Seek() = %v, want hamlet", it.Key())
+	}
+	if value, err := it.Value(); err != nil || value != "some author" {
+		t.Errorf("Value() = %v, %v, want some author", value, err)
+	}
+	// the iterator carries on from where it is, whatever was written meanwhile
+	store.Delete("emma")
+	store.Set("fiction", "some author")
+	it.Prev()
+	if !it.Valid() || it.Key() != "fiction" {
+		t.Errorf("Prev() = %v, want fiction", it.Key())
+	}
+	store.Delete("fiction")
+	if _, err := it.Value(); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Value() of a deleted key error = %v, want ErrKeyNotFound", err)
+	}
+	it.Next()
+	if !it.Valid() || it.Key() != "hamlet" {
+		t.Errorf("Next() = %v, want hamlet", it.Key())
+	}
+	it.Seek("zzz")
+	if it.Valid() {
+		t.Errorf("Seek() past the last key is on %v, want not valid", it.Key())
+	}
+}
@@ -0,0 +1,33 @@
+package caskdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// SetJSON stores the JSON encoding of v as the value of the key, as json.Marshal
+// encodes it, and sets FlagJSON on its record. Like Put, it returns the error of
+// the write rather than panicking, and also that of the encoding.
+func (d *DiskStore) SetJSON(key string, v any) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("caskdb: encoding the value of %q: %w", key, err)
+	}
+	return d.putContext(context.Background(), key, string(value), FlagJSON)
+}
+
+// GetJSON decodes the value of the key into out, as json.Unmarshal does, e.g. into
+// a pointer to a struct. Like Lookup, it fails with ErrKeyNotFound if the key does
+// not exist, and it fails with ErrInvalidJSON if the value does not decode into
+// out, whether it was stored with SetJSON or not.
+func (d *DiskStore) GetJSON(key string, out any) error {
+	value, err := d.Lookup(key)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(value), out); err != nil {
+		return fmt.Errorf("%w: value of %q: %v", ErrInvalidJSON, key, err)
+	}
+	return nil
+}
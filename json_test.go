@@ -0,0 +1,62 @@
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+type book struct {
+	Title  string   `json:"title"`
+	Author string   `json:"author"`
+	Year   int      `json:"year"`
+	Tags   []string `json:"tags,omitempty"`
+}
+
+func TestDiskStore_JSON(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	want := book{Title: "Othello", Author: "Shakespeare", Year: 1603, Tags: []string{"tragedy"}}
+	if err := store.SetJSON("othello", want); err != nil {
+		t.Fatalf("SetJSON() error = %v", err)
+	}
+	var got book
+	if err := store.GetJSON("othello", &got); err != nil {
+		t.Fatalf("GetJSON() error = %v", err)
+	}
+	if got.Title != want.Title || got.Author != want.Author || got.Year != want.Year || len(got.Tags) != 1 {
+		t.Errorf("GetJSON() = %+v, want %+v", got, want)
+	}
+	if v := store.Get("othello"); v != `{"title":"Othello","author":"Shakespeare","year":1603,"tags":["tragedy"]}` {
+		t.Errorf("Get() = %v, want the JSON encoding", v)
+	}
+
+	// the record is flagged, and keeps the flag when its expiry changes
+	if err := store.Expire("othello", time.Hour); err != nil {
+		t.Fatalf("Expire() error = %v", err)
+	}
+	changes, _, err := store.ReadChanges(0, 10)
+	if err != nil {
+		t.Fatalf("ReadChanges() error = %v", err)
+	}
+	if len(changes) != 2 || changes[0].Flags != FlagJSON || changes[1].Flags != FlagJSON|FlagTTL {
+		t.Errorf("ReadChanges() = %+v, want two changes flagged json", changes)
+	}
+
+	store.Set("gitanjali", "tagore")
+	if err := store.GetJSON("gitanjali", &got); !errors.Is(err, ErrInvalidJSON) {
+		t.Errorf("GetJSON() error = %v, want %v", err, ErrInvalidJSON)
+	}
+	if err := store.GetJSON("beloved", &got); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("GetJSON() error = %v, want %v", err, ErrKeyNotFound)
+	}
+	if err := store.SetJSON("beloved", make(chan int)); err == nil {
+		t.Errorf("SetJSON() of a channel error = nil, want an error")
+	}
+}
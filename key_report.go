@@ -0,0 +1,198 @@
+package caskdb
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// prefixDelimiters are the characters which end a key's prefix. Keys are commonly
+// namespaced like "user:42" or "books/hamlet", and KeyReport groups them by the
+// part up to and including the first of these.
+const prefixDelimiters = ":/"
+
+// maxPrefixAccess bounds the number of prefixes whose reads and writes are
+// counted; the prefixes seen once there are that many are not counted.
+const maxPrefixAccess = 1024
+
+// KeyReport is the result of DiskStore.KeyReport. It describes the shape of the
+// live keys and values: which are the largest, which prefixes take up the most
+// space, which are the busiest and how the sizes are distributed.
+type KeyReport struct {
+	// LargestKeys and LargestValues list the live keys with the largest key and
+	// value respectively, largest first
+	LargestKeys   []KeySize
+	LargestValues []KeySize
+	// Prefixes lists the key prefixes taking up the most space, largest first
+	Prefixes []PrefixUsage
+	// HotPrefixes lists the key prefixes read and written the most, busiest
+	// first. They are counted since the store was created, and saved along with
+	// the LifetimeStats, so that a store opened with OpenReadOnly reports those of
+	// the writer as of its last save
+	HotPrefixes []PrefixAccess
+	// KeySizes and ValueSizes are the distributions of the key and value sizes
+	KeySizes   []HistogramBucket
+	ValueSizes []HistogramBucket
+}
+
+// KeySize is a key along with the size of whatever is being reported on, in bytes.
+type KeySize struct {
+	Key  string
+	Size int
+}
+
+// PrefixUsage is the number of live keys sharing a prefix and the bytes their
+// records take up on the disk, headers included.
+type PrefixUsage struct {
+	Prefix string
+	Keys   int
+	Bytes  int64
+}
+
+// PrefixAccess is the number of reads and writes of the keys sharing a prefix.
+// Reads of keys which do not exist are not counted.
+type PrefixAccess struct {
+	Prefix string
+	Reads  uint64
+	Writes uint64
+}
+
+// HistogramBucket counts the sizes which are at most UpperBound bytes and larger
+// than the UpperBound of the previous bucket. The buckets are powers of two.
+type HistogramBucket struct {
+	UpperBound int
+	Count      int
+}
+
+// KeyReport reports the n largest keys, values and prefixes, and the n busiest
+// prefixes, along with the key and value size distributions. It is computed from
+// KeyDir alone, so it is cheap even for a large database: the sizes are known from
+// the KeyEntry and no values are read from the disk.
+func (d *DiskStore) KeyReport(n int) KeyReport {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var report KeyReport
+	var keys, values []KeySize
+	var keySizes, valueSizes []int
+	prefixes := make(map[string]*PrefixUsage)
+	now := time.Now()
+	d.keyDir.each(func(key string, kEntry KeyEntry) bool {
+		if kEntry.expired(now) {
+			return true
+		}
+		valueSize := int(kEntry.totalSize) - headerSize - len(key)
+		keys = append(keys, KeySize{key, len(key)})
+		values = append(values, KeySize{key, valueSize})
+		keySizes = append(keySizes, len(key))
+		valueSizes = append(valueSizes, valueSize)
+		if prefix, ok := keyPrefix(key); ok {
+			usage, ok := prefixes[prefix]
+			if !ok {
+				usage = &PrefixUsage{Prefix: prefix}
+				prefixes[prefix] = usage
+			}
+			usage.Keys++
+			usage.Bytes += int64(kEntry.totalSize)
+		}
+		return true
+	})
+	report.LargestKeys = largest(keys, n)
+	report.LargestValues = largest(values, n)
+	for _, usage := range prefixes {
+		report.Prefixes = append(report.Prefixes, *usage)
+	}
+	sort.Slice(report.Prefixes, func(i, j int) bool {
+		a, b := report.Prefixes[i], report.Prefixes[j]
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		return a.Prefix < b.Prefix
+	})
+	if len(report.Prefixes) > n {
+		report.Prefixes = report.Prefixes[:n]
+	}
+	for _, access := range d.prefixAccess {
+		report.HotPrefixes = append(report.HotPrefixes, *access)
+	}
+	sort.Slice(report.HotPrefixes, func(i, j int) bool {
+		a, b := report.HotPrefixes[i], report.HotPrefixes[j]
+		if a.Reads+a.Writes != b.Reads+b.Writes {
+			return a.Reads+a.Writes > b.Reads+b.Writes
+		}
+		return a.Prefix < b.Prefix
+	})
+	if len(report.HotPrefixes) > n {
+		report.HotPrefixes = report.HotPrefixes[:n]
+	}
+	report.KeySizes = histogram(keySizes)
+	report.ValueSizes = histogram(valueSizes)
+	return report
+}
+
+// countAccess counts a read or a write of the key towards its prefix, check
+// KeyReport.HotPrefixes. The store must be locked.
+func (d *DiskStore) countAccess(key string, write bool) {
+	prefix, ok := keyPrefix(key)
+	if !ok {
+		return
+	}
+	access, ok := d.prefixAccess[prefix]
+	if !ok {
+		if len(d.prefixAccess) >= maxPrefixAccess {
+			return
+		}
+		access = &PrefixAccess{Prefix: prefix}
+		d.prefixAccess[prefix] = access
+	}
+	if write {
+		access.Writes++
+	} else {
+		access.Reads++
+	}
+}
+
+// keyPrefix returns the part of the key up to and including the first of the
+// prefixDelimiters, or false if the key has none.
+func keyPrefix(key string) (string, bool) {
+	i := strings.IndexAny(key, prefixDelimiters)
+	if i < 0 {
+		return "", false
+	}
+	return key[:i+1], true
+}
+
+// largest sorts the sizes, largest first, and returns the first n of them. Ties
+// are broken by the key, so that the report is stable across runs.
+func largest(sizes []KeySize, n int) []KeySize {
+	sort.Slice(sizes, func(i, j int) bool {
+		if sizes[i].Size != sizes[j].Size {
+			return sizes[i].Size > sizes[j].Size
+		}
+		return sizes[i].Key < sizes[j].Key
+	})
+	if len(sizes) > n {
+		sizes = sizes[:n]
+	}
+	return sizes
+}
+
+// histogram buckets the sizes by powers of two. Only the buckets from the
+// smallest up to the largest size are returned, empty ones in between included.
+func histogram(sizes []int) []HistogramBucket {
+	var buckets []HistogramBucket
+	for _, size := range sizes {
+		i := 0
+		for bound := 1; bound < size; bound <<= 1 {
+			i++
+		}
+		for len(buckets) <= i {
+			buckets = append(buckets, HistogramBucket{UpperBound: 1 << len(buckets)})
+		}
+		buckets[i].Count++
+	}
+	// drop the leading empty buckets, they only add noise to the report
+	for len(buckets) > 0 && buckets[0].Count == 0 {
+		buckets = buckets[1:]
+	}
+	return buckets
+}
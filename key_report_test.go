@@ -0,0 +1,87 @@
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiskStore_KeyReport(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	store.Set("book:hamlet", "shakespeare")
+	store.Set("book:dune", "frank herbert")
+	store.Set("author:tolstoy", "russia")
+	store.Set("deleted", "x")
+	store.Set("deleted", "")
+	for i := 0; i < 3; i++ {
+		store.Get("author:tolstoy")
+	}
+
+	report := store.KeyReport(2)
+	wantValues := []KeySize{{"book:dune", 13}, {"book:hamlet", 11}}
+	if !reflect.DeepEqual(report.LargestValues, wantValues) {
+		t.Errorf("KeyReport() largest values = %v, want %v", report.LargestValues, wantValues)
+	}
+	wantKeys := []KeySize{{"author:tolstoy", 14}, {"book:hamlet", 11}}
+	if !reflect.DeepEqual(report.LargestKeys, wantKeys) {
+		t.Errorf("KeyReport() largest keys = %v, want %v", report.LargestKeys, wantKeys)
+	}
+	if len(report.Prefixes) != 2 || report.Prefixes[0].Prefix != "book:" || report.Prefixes[0].Keys != 2 {
+		t.Errorf("KeyReport() prefixes = %+v, want book: first with 2 keys", report.Prefixes)
+	}
+	wantHot := []PrefixAccess{{"author:", 3, 1}, {"book:", 0, 2}}
+	if !reflect.DeepEqual(report.HotPrefixes, wantHot) {
+		t.Errorf("KeyReport() hot prefixes = %+v, want %+v", report.HotPrefixes, wantHot)
+	}
+	count := 0
+	for _, b := range report.ValueSizes {
+		count += b.Count
+	}
+	if count != 3 {
+		t.Errorf("KeyReport() value sizes count = %v, want %v", count, 3)
+	}
+}
+
+func TestDiskStore_KeyReport_hotPrefixes(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{MaxKeys: 1})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("book:hamlet", "shakespeare")
+	store.Get("book:hamlet")
+	// the writes which fail are not counted
+	if err := store.Put("book:dune", "frank herbert"); !errors.Is(err, ErrStoreFull) {
+		t.Fatalf("Put() past the quota error = %v, want %v", err, ErrStoreFull)
+	}
+	want := []PrefixAccess{{"book:", 1, 1}}
+	if got := store.KeyReport(10).HotPrefixes; !reflect.DeepEqual(got, want) {
+		t.Errorf("KeyReport() hot prefixes = %+v, want %+v", got, want)
+	}
+	store.Close()
+
+	// they are saved along with the lifetime stats, for the readers
+	reader, err := OpenReadOnly(fileName, Options{})
+	if err != nil {
+		t.Fatalf("OpenReadOnly() error = %v", err)
+	}
+	defer reader.Close()
+	if got := reader.KeyReport(10).HotPrefixes; !reflect.DeepEqual(got, want) {
+		t.Errorf("KeyReport() hot prefixes of a reader = %+v, want %+v", got, want)
+	}
+}
+
+func Test_histogram(t *testing.T) {
+	got := histogram([]int{3, 4, 5, 16})
+	want := []HistogramBucket{{4, 2}, {8, 1}, {16, 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("histogram() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,344 @@
+package caskdb
+
+import (
+	"fmt"
+	"hash/maphash"
+	"math/rand"
+	"unsafe"
+)
+
+// KeyDirIndex is the hash table KeyDir is kept in, check Options.KeyDirIndex. The
+// tables differ in how much memory they take per key and how their lookups behave
+// as they fill up, which matters for very large keyspaces; KeyDirStats tells how a
+// table is doing.
+type KeyDirIndex uint8
+
+const (
+	// KeyDirMap keeps KeyDir in a Go map, which is a swiss table as of Go 1.24:
+	// groups of slots with a byte of the hash of each, probed a group at a time
+	KeyDirMap KeyDirIndex = iota
+	// KeyDirRobinHood keeps KeyDir in a table of its own, with open addressing and
+	// robin hood hashing: a key inserted takes the slot of a key closer to its home
+	// slot, which keeps the probes short and even at high occupancy. It hashes the
+	// keys with Options.KeyHash.
+	KeyDirRobinHood
+	// KeyDirART keeps KeyDir in an adaptive radix tree, in which the keys sharing a
+	// prefix share the nodes spelling it. The tree keeps the keys in order, so the
+	// scans by prefix and the iterators walk it rather than an ordered index kept
+	// alongside the table, which saves memory on keys with long common prefixes,
+	// e.g. "tenant42/books/".
+	KeyDirART
+	// KeyDirMmap keeps KeyDir in a robin hood table laid out in bytes, which the
+	// store writes to books.db.keydir on Close and maps back into memory on the
+	// next open, rather than loading the segments, as long as they did not change
+	// meanwhile. Opening even a huge store then takes about as long as opening a
+	// file, and the processes opening the store read-only share the pages of the
+	// table until they change them. It does not go with Options.Dedup
+	KeyDirMmap
+)
+
+// String returns the name of the index, e.g. "map".
+func (i KeyDirIndex) String() string {
+	switch i {
+	case KeyDirMap:
+		return "map"
+	case KeyDirRobinHood:
+		return "robin-hood"
+	case KeyDirART:
+		return "art"
+	case KeyDirMmap:
+		return "mmap"
+	}
+	return fmt.Sprintf("keydir(%d)", uint8(i))
+}
+
+// KeyDirStats describe the hash table of KeyDir, as returned by
+// DiskStore.KeyDirStats.
+type KeyDirStats struct {
+	Index KeyDirIndex
+	Keys  int
+	// Slots is the number of slots of the table, and Occupancy the share of them
+	// holding a key; for KeyDirART, they are the slots for the children of its
+	// nodes. They are 0 for KeyDirMap, whose layout is the runtime's
+	Slots     int
+	Occupancy float64
+	// Nodes is the number of nodes of KeyDirART, and MaxDepth how many nodes down
+	// its deepest key is
+	Nodes    int
+	MaxDepth int
+	// Displaced counts the keys which are not in their home slot, having collided
+	// with another key, and MeanProbe and MaxProbe are how many slots past it the
+	// keys are, on average and at most, i.e. how many more slots a lookup of them
+	// reads. They are 0 for KeyDirMap
+	Displaced int
+	MeanProbe float64
+	MaxProbe  int
+	// HashCollisions counts the keys whose 64-bit hash under Options.KeyHash is
+	// also that of another key, ideally none: many of them point at a poor hash
+	// function for the keys
+	HashCollisions int
+}
+
+// keyDirTable is a hash table of KeyDir. The store must be locked to use it.
+type keyDirTable interface {
+	get(key string) (KeyEntry, bool)
+	set(key string, kEntry KeyEntry)
+	remove(key string)
+	size() int
+	// each calls fn with every key and its entry, in no particular order, until fn
+	// returns false. fn must not change the table
+	each(fn func(key string, kEntry KeyEntry) bool)
+	// stats fills in the stats of the layout of the table
+	stats(s *KeyDirStats)
+	// memory fills in an estimate of the memory of the table
+	memory(m *KeyDirMemory)
+}
+
+// newKeyDir returns an empty table of the kind of the options, and the keyOrder
+// to keep alongside it.
+func (d *DiskStore) newKeyDir() (keyDirTable, keyOrder) {
+	switch d.opts.KeyDirIndex {
+	case KeyDirRobinHood:
+		return newRobinHoodKeyDir(d.keyHash), newKeyIndex()
+	case KeyDirART:
+		t := newARTKeyDir()
+		return t, artKeys{t}
+	case KeyDirMmap:
+		t := newMmapKeyDir()
+		return t, &lazyKeys{table: t}
+	}
+	return mapKeyDir{}, newKeyIndex()
+}
+
+// keyHash hashes the key with Options.KeyHash, or maphash with a seed of the store
+// if that is not set.
+func (d *DiskStore) keyHash(key string) uint64 {
+	if d.opts.KeyHash != nil {
+		return d.opts.KeyHash(key)
+	}
+	return maphash.String(d.hashSeed, key)
+}
+
+// keyEntry returns the entry of the key, the zero KeyEntry if it is not in keyDir.
+// The store must be locked.
+func (d *DiskStore) keyEntry(key string) KeyEntry {
+	kEntry, _ := d.keyDir.get(key)
+	return kEntry
+}
+
+// KeyDirStats returns the stats of the hash table of KeyDir. Counting the hash
+// collisions hashes every key, so it takes about as long as listing the keys.
+func (d *DiskStore) KeyDirStats() KeyDirStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s := KeyDirStats{Index: d.opts.KeyDirIndex, Keys: d.keyDir.size()}
+	d.keyDir.stats(&s)
+	hashes := make(map[uint64]int, s.Keys)
+	d.keyDir.each(func(key string, kEntry KeyEntry) bool {
+		hashes[d.keyHash(key)]++
+		return true
+	})
+	for _, n := range hashes {
+		if n > 1 {
+			s.HashCollisions += n
+		}
+	}
+	return s
+}
+
+// mapKeyDir is the table of KeyDirMap.
+type mapKeyDir map[string]KeyEntry
+
+func (m mapKeyDir) get(key string) (KeyEntry, bool) {
+	kEntry, ok := m[key]
+	return kEntry, ok
+}
+
+func (m mapKeyDir) set(key string, kEntry KeyEntry) {
+	m[key] = kEntry
+}
+
+func (m mapKeyDir) remove(key string) {
+	delete(m, key)
+}
+
+func (m mapKeyDir) size() int {
+	return len(m)
+}
+
+func (m mapKeyDir) each(fn func(key string, kEntry KeyEntry) bool) {
+	for key, kEntry := range m {
+		if !fn(key, kEntry) {
+			return
+		}
+	}
+}
+
+func (m mapKeyDir) stats(s *KeyDirStats) {}
+
+func (m mapKeyDir) memory(mem *KeyDirMemory) {
+	for key := range m {
+		mem.Keys += int64(len(key))
+	}
+	mem.Entries = int64(len(m)) * keyEntrySize
+	mem.Overhead = mapMemory(len(m), stringHeaderSize+keyEntrySize) - mem.Entries
+}
+
+// robinHoodMaxLoad is the occupancy past which the table of KeyDirRobinHood
+// doubles
+const robinHoodMaxLoad = 0.85
+
+// robinHoodKeyDir is the table of KeyDirRobinHood. The number of slots is a power
+// of two, and the home slot of a key is its hash modulo that.
+type robinHoodKeyDir struct {
+	hash  func(key string) uint64
+	slots []robinHoodSlot
+	count int
+}
+
+type robinHoodSlot struct {
+	key    string
+	kEntry KeyEntry
+	// probe is 1 more than how many slots past its home slot the key is, 0 for an
+	// empty slot
+	probe uint32
+}
+
+func newRobinHoodKeyDir(hash func(key string) uint64) *robinHoodKeyDir {
+	return &robinHoodKeyDir{hash: hash, slots: make([]robinHoodSlot, 16)}
+}
+
+// find returns the slot of the key, or -1 if it is not in the table.
+func (t *robinHoodKeyDir) find(key string) int {
+	mask := len(t.slots) - 1
+	i := int(t.hash(key)) & mask
+	for probe := uint32(1); ; probe++ {
+		slot := &t.slots[i]
+		// a key further from its home slot than the one we look for would have
+		// been displaced by it
+		if slot.probe < probe {
+			return -1
+		}
+		if slot.probe == probe && slot.key == key {
+			return i
+		}
+		i = (i + 1) & mask
+	}
+}
+
+func (t *robinHoodKeyDir) get(key string) (KeyEntry, bool) {
+	if i := t.find(key); i >= 0 {
+		return t.slots[i].kEntry, true
+	}
+	return KeyEntry{}, false
+}
+
+func (t *robinHoodKeyDir) set(key string, kEntry KeyEntry) {
+	if i := t.find(key); i >= 0 {
+		t.slots[i].kEntry = kEntry
+		return
+	}
+	if float64(t.count+1) > robinHoodMaxLoad*float64(len(t.slots)) {
+		t.grow()
+	}
+	t.insert(robinHoodSlot{key: key, kEntry: kEntry, probe: 1})
+	t.count++
+}
+
+// insert puts a key which is not in the table in it.
+func (t *robinHoodKeyDir) insert(slot robinHoodSlot) {
+	mask := len(t.slots) - 1
+	i := int(t.hash(slot.key)) & mask
+	for {
+		if t.slots[i].probe == 0 {
+			t.slots[i] = slot
+			return
+		}
+		// the richer key, closer to its home slot, moves on
+		if t.slots[i].probe < slot.probe {
+			t.slots[i], slot = slot, t.slots[i]
+		}
+		i = (i + 1) & mask
+		slot.probe++
+	}
+}
+
+// grow doubles the slots, inserting the keys again.
+func (t *robinHoodKeyDir) grow() {
+	old := t.slots
+	t.slots = make([]robinHoodSlot, 2*len(old))
+	for _, slot := range old {
+		if slot.probe != 0 {
+			slot.probe = 1
+			t.insert(slot)
+		}
+	}
+}
+
+// remove takes the key out, shifting the keys after it back by a slot until one
+// in its home slot, so that no tombstones are left.
+func (t *robinHoodKeyDir) remove(key string) {
+	i := t.find(key)
+	if i < 0 {
+		return
+	}
+	mask := len(t.slots) - 1
+	for {
+		next := (i + 1) & mask
+		if t.slots[next].probe <= 1 {
+			break
+		}
+		t.slots[i] = t.slots[next]
+		t.slots[i].probe--
+		i = next
+	}
+	t.slots[i] = robinHoodSlot{}
+	t.count--
+}
+
+func (t *robinHoodKeyDir) size() int {
+	return t.count
+}
+
+// each starts at a random slot, so that breaking off early samples the keys at
+// random, the way ranging over a map does.
+func (t *robinHoodKeyDir) each(fn func(key string, kEntry KeyEntry) bool) {
+	mask := len(t.slots) - 1
+	start := rand.Intn(len(t.slots))
+	for n := range t.slots {
+		slot := &t.slots[(start+n)&mask]
+		if slot.probe != 0 && !fn(slot.key, slot.kEntry) {
+			return
+		}
+	}
+}
+
+func (t *robinHoodKeyDir) memory(m *KeyDirMemory) {
+	for _, slot := range t.slots {
+		m.Keys += int64(len(slot.key))
+	}
+	m.Entries = int64(t.count) * keyEntrySize
+	m.Overhead = int64(len(t.slots))*int64(unsafe.Sizeof(robinHoodSlot{})) - m.Entries
+}
+
+func (t *robinHoodKeyDir) stats(s *KeyDirStats) {
+	s.Slots = len(t.slots)
+	s.Occupancy = float64(t.count) / float64(len(t.slots))
+	total := 0
+	for _, slot := range t.slots {
+		if slot.probe == 0 {
+			continue
+		}
+		distance := int(slot.probe) - 1
+		if distance > 0 {
+			s.Displaced++
+		}
+		if distance > s.MaxProbe {
+			s.MaxProbe = distance
+		}
+		total += distance
+	}
+	if t.count > 0 {
+		s.MeanProbe = float64(total) / float64(t.count)
+	}
+}
@@ -0,0 +1,89 @@
+package caskdb
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestRobinHoodKeyDir(t *testing.T) {
+	// a poor hash sends the keys to a few home slots, so they collide a lot
+	table := newRobinHoodKeyDir(func(key string) uint64 { return uint64(len(key) % 4) })
+	want := make(map[string]KeyEntry)
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		table.set(key, KeyEntry{position: uint32(i)})
+		want[key] = KeyEntry{position: uint32(i)}
+		if i%3 == 0 {
+			table.remove(fmt.Sprintf("key-%d", i/2))
+			delete(want, fmt.Sprintf("key-%d", i/2))
+		}
+	}
+	table.set("key-9", KeyEntry{position: 9000})
+	want["key-9"] = KeyEntry{position: 9000}
+	if table.size() != len(want) {
+		t.Errorf("size() = %d, want %d", table.size(), len(want))
+	}
+	for key, kEntry := range want {
+		if got, ok := table.get(key); !ok || got != kEntry {
+			t.Errorf("get(%q) = %v, %v, want %v", key, got, ok, kEntry)
+		}
+	}
+	seen := 0
+	table.each(func(key string, kEntry KeyEntry) bool {
+		if want[key] != kEntry {
+			t.Errorf("each() gave %q = %v, want %v", key, kEntry, want[key])
+		}
+		seen++
+		return true
+	})
+	if seen != len(want) {
+		t.Errorf("each() gave %d keys, want %d", seen, len(want))
+	}
+	if _, ok := table.get("key-0"); ok {
+		t.Errorf("get() of a removed key found it")
+	}
+}
+
+func TestDiskStore_KeyDirIndex(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{KeyDirIndex: KeyDirRobinHood}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		store.Set(fmt.Sprintf("book:%d", i), fmt.Sprintf("edition %d", i))
+	}
+	store.Delete("book:7")
+	store.Close()
+
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	if got := store.Get("book:42"); got != "edition 42" {
+		t.Errorf("Get() = %q, want edition 42", got)
+	}
+	if got := store.Get("book:7"); got != "" {
+		t.Errorf("Get() of a deleted key = %q, want it gone", got)
+	}
+	stats := store.KeyDirStats()
+	if stats.Index != KeyDirRobinHood || stats.Keys != 999 || stats.Slots < 999 || stats.Occupancy > robinHoodMaxLoad {
+		t.Errorf("KeyDirStats() = %+v, want 999 keys in a robin-hood table", stats)
+	}
+	if stats.HashCollisions != 0 {
+		t.Errorf("KeyDirStats().HashCollisions = %d, want 0", stats.HashCollisions)
+	}
+	store.Close()
+
+	// every key hashing the same collides with all the others
+	store, err = NewDiskStoreWithOptions(fileName, Options{KeyHash: func(string) uint64 { return 42 }})
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	if stats := store.KeyDirStats(); stats.Index != KeyDirMap || stats.HashCollisions != 999 || stats.Slots != 0 {
+		t.Errorf("KeyDirStats() = %+v, want 999 colliding keys in a map", stats)
+	}
+}
@@ -0,0 +1,155 @@
+package caskdb
+
+import "unsafe"
+
+// keyIndexMaxLevel bounds the levels of the skip list; with every level holding a
+// quarter of the keys of the one below, 16 levels are plenty for 4 billion keys
+const keyIndexMaxLevel = 16
+
+// keyOrder keeps the keys of KeyDir in order, so that scanning the keys sharing a
+// prefix, or a range of keys, does not have to go through all of them. Like
+// KeyDir, it is guarded by the lock of the store.
+type keyOrder interface {
+	insert(key string)
+	remove(key string)
+	// seek returns the first key not less than key, false if there is none
+	seek(key string) (string, bool)
+	// before returns the last key less than key, false if there is none
+	before(key string) (string, bool)
+	// last returns the last key, false if there are none
+	last() (string, bool)
+	// ascend calls fn with the keys not less than start, in order, until fn
+	// returns false. fn must not change the keys
+	ascend(start string, fn func(key string) bool)
+	// memory returns an estimate of the memory of the order, but for the bytes of
+	// the keys, which are those of KeyDir
+	memory() int64
+}
+
+// keyIndex is the keyOrder of the hash tables of KeyDir. It is a skip list: each
+// key is linked to the next one, and a random subset of them also to keys further
+// down the list, which searches hop along.
+type keyIndex struct {
+	// head holds the first node of every level, and no key
+	head  *keyNode
+	level int
+	// seed drives the levels picked for new keys
+	seed uint64
+}
+
+type keyNode struct {
+	key  string
+	next []*keyNode
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{head: &keyNode{next: make([]*keyNode, keyIndexMaxLevel)}, level: 1, seed: 0x9e3779b97f4a7c15}
+}
+
+// search returns the first node whose key is not less than key, or nil if there is
+// none. If update is not nil, it is filled with the last node before key on every
+// level.
+func (x *keyIndex) search(key string, update []*keyNode) *keyNode {
+	node := x.head
+	for level := x.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && node.next[level].key < key {
+			node = node.next[level]
+		}
+		if update != nil {
+			update[level] = node
+		}
+	}
+	return node.next[0]
+}
+
+// insert adds the key, unless it is there already.
+func (x *keyIndex) insert(key string) {
+	var update [keyIndexMaxLevel]*keyNode
+	if node := x.search(key, update[:]); node != nil && node.key == key {
+		return
+	}
+	level := x.randomLevel()
+	for ; x.level < level; x.level++ {
+		update[x.level] = x.head
+	}
+	node := &keyNode{key: key, next: make([]*keyNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+}
+
+// remove takes the key out, if it is there.
+func (x *keyIndex) remove(key string) {
+	var update [keyIndexMaxLevel]*keyNode
+	node := x.search(key, update[:])
+	if node == nil || node.key != key {
+		return
+	}
+	for i := range node.next {
+		update[i].next[i] = node.next[i]
+	}
+	for x.level > 1 && x.head.next[x.level-1] == nil {
+		x.level--
+	}
+}
+
+func (x *keyIndex) seek(key string) (string, bool) {
+	if node := x.search(key, nil); node != nil {
+		return node.key, true
+	}
+	return "", false
+}
+
+func (x *keyIndex) before(key string) (string, bool) {
+	var update [keyIndexMaxLevel]*keyNode
+	x.search(key, update[:])
+	if update[0] == x.head {
+		return "", false
+	}
+	return update[0].key, true
+}
+
+func (x *keyIndex) last() (string, bool) {
+	node := x.head
+	for level := x.level - 1; level >= 0; level-- {
+		for node.next[level] != nil {
+			node = node.next[level]
+		}
+	}
+	if node == x.head {
+		return "", false
+	}
+	return node.key, true
+}
+
+func (x *keyIndex) ascend(start string, fn func(key string) bool) {
+	for node := x.search(start, nil); node != nil; node = node.next[0] {
+		if !fn(node.key) {
+			return
+		}
+	}
+}
+
+func (x *keyIndex) memory() int64 {
+	nodeSize := int64(unsafe.Sizeof(keyNode{}))
+	var m int64
+	for node := x.head; node != nil; node = node.next[0] {
+		m += nodeSize + int64(cap(node.next))*pointerSize
+	}
+	return m
+}
+
+// randomLevel picks the number of levels of a new node: one, and then one more
+// with a probability of 1/4 each.
+func (x *keyIndex) randomLevel() int {
+	// xorshift64, we only need the levels to be spread out
+	x.seed ^= x.seed << 13
+	x.seed ^= x.seed >> 7
+	x.seed ^= x.seed << 17
+	level := 1
+	for r := x.seed; level < keyIndexMaxLevel && r&3 == 0; r >>= 2 {
+		level++
+	}
+	return level
+}
@@ -0,0 +1,44 @@
+package caskdb
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func Test_keyIndex(t *testing.T) {
+	index := newKeyIndex()
+	want := make(map[string]bool)
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("key%04d", rnd.Intn(2000))
+		if rnd.Intn(3) == 0 {
+			index.remove(key)
+			delete(want, key)
+		} else {
+			index.insert(key)
+			want[key] = true
+		}
+	}
+	var keys []string
+	for key := range want {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var got []string
+	index.ascend("", func(key string) bool {
+		got = append(got, key)
+		return true
+	})
+	if fmt.Sprint(got) != fmt.Sprint(keys) {
+		t.Fatalf("keyIndex holds %d keys, want the %d keys in order", len(got), len(keys))
+	}
+	for _, key := range []string{"key0500", "key05000", "key", "zzz"} {
+		i := sort.SearchStrings(keys, key)
+		got, ok := index.seek(key)
+		if i == len(keys) && ok || i < len(keys) && (!ok || got != keys[i]) {
+			t.Errorf("seek(%v) = %v, %v, want the first key not less than it", key, got, ok)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package caskdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A store on a network filesystem, such as NFS or SMB, cannot count on what a
+// local disk gives: fcntl locks and mmap are unreliable there, and the client
+// may cache writes past an fsync. With Options.NetworkFS, or when the directory
+// of the store is on one, which is detected on Linux, the store:
+//
+//   - refuses KeyDirMmap with ErrNetworkFS,
+//   - opens the active file with O_SYNC, on top of the fsync after every write,
+//   - and holds a lease on books.db.lock rather than trusting a lock, so that a
+//     second writer, on this host or another, fails with ErrLocked.
+//
+// The lease names its owner and when it expires, and is renewed every third of
+// Options.LeaseDuration. A lease which was not renewed in time, e.g. because its
+// owner crashed, is taken over by the next writer to open the store; the owner
+// finding it taken over fails its writes with ErrLocked from then on. Leases
+// compare the clocks of the hosts, which must agree to well within the duration.
+//
+// On a local disk, the writer takes a lock of the OS on books.db.lock instead,
+// flock or LockFileEx, which goes with the process: a writer which crashed leaves
+// the file behind, but not the lock.
+
+// lockSuffix is appended to the name of the active file for its lease
+const lockSuffix = ".lock"
+
+// DefaultLeaseDuration is the Options.LeaseDuration used when none is set
+const DefaultLeaseDuration = 30 * time.Second
+
+// lease is the content of the lock file.
+type lease struct {
+	Owner   string    `json:"owner"`
+	Host    string    `json:"host"`
+	PID     int       `json:"pid"`
+	Expires time.Time `json:"expires"`
+}
+
+// checkNetworkFS turns on the network filesystem mode when the store asks for it
+// or lives on one, and checks that its options work there.
+func (d *DiskStore) checkNetworkFS(fileName string) error {
+	if !d.opts.NetworkFS && isNetworkFS(filepath.Dir(fileName)) {
+		d.log.Info("network filesystem detected", "file", fileName)
+		d.opts.NetworkFS = true
+	}
+	if !d.opts.NetworkFS {
+		return nil
+	}
+	if d.opts.KeyDirIndex == KeyDirMmap {
+		return fmt.Errorf("%w: keydir %v maps its snapshot", ErrNetworkFS, d.opts.KeyDirIndex)
+	}
+	if d.opts.LeaseDuration <= 0 {
+		d.opts.LeaseDuration = DefaultLeaseDuration
+	}
+	return nil
+}
+
+// openFlags returns the flags the active file is opened with.
+func (d *DiskStore) openFlags() int {
+	flags := os.O_APPEND | os.O_RDWR | os.O_CREATE
+	if d.opts.NetworkFS {
+		flags |= os.O_SYNC
+	}
+	return flags
+}
+
+// lockStore takes the lock of the OS on the lock file of the store, or fails with
+// ErrLocked when another writer holds it. Closing the file returned releases it;
+// the file is left, as removing it could let two writers lock different files of
+// the same name.
+func lockStore(fileName string) (*os.File, error) {
+	path := fileName + lockSuffix
+	file, err := openFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := lockFile(file)
+	if err == nil && !ok {
+		err = fmt.Errorf("%w: %s", ErrLocked, path)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// unlock releases the lock of lockStore, if the store holds it.
+func (d *DiskStore) unlock() {
+	if d.lock != nil {
+		d.lock.Close()
+		d.lock = nil
+	}
+}
+
+// acquireLease takes the lease of the store, unless another owner holds it, and
+// starts renewing it in the background.
+func (d *DiskStore) acquireLease(fileName string) error {
+	owner, err := newStoreID()
+	if err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	path := fileName + lockSuffix
+	current, err := readLease(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err == nil && time.Now().Before(current.Expires):
+		return fmt.Errorf("%w: %s is held by pid %d on %s until %v", ErrLocked, path, current.PID, current.Host, current.Expires.Format(time.RFC3339))
+	default:
+		if err != nil {
+			d.log.Warn("taking over unreadable lease", "file", path, "error", err)
+		} else {
+			d.log.Warn("taking over expired lease", "file", path, "host", current.Host, "pid", current.PID)
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	// an exclusive create, so that of two writers taking the lease at once, one
+	// fails; renewals replace the file
+	file, err := openFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("%w: %s was just taken", ErrLocked, path)
+	}
+	if err != nil {
+		return err
+	}
+	file.Close()
+	d.lease, d.lockPath = &lease{Owner: owner, Host: host, PID: os.Getpid()}, path
+	if err := d.writeLease(time.Now()); err != nil {
+		os.Remove(path)
+		d.lease = nil
+		return err
+	}
+	d.background.Go(d.renewLeaseEvery)
+	return nil
+}
+
+// readLease reads the lease in the lock file.
+func readLease(path string) (lease, error) {
+	var l lease
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return l, err
+	}
+	if err := json.Unmarshal(data, &l); err != nil {
+		return l, fmt.Errorf("%w: %s: %v", ErrCorruptRecord, path, err)
+	}
+	return l, nil
+}
+
+// writeLease writes our lease, expiring LeaseDuration after now.
+func (d *DiskStore) writeLease(now time.Time) error {
+	l := *d.lease
+	l.Expires = now.Add(d.opts.LeaseDuration)
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	if err := writeFileSync(d.lockPath, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	d.lease.Expires = l.Expires
+	return nil
+}
+
+// renewLeaseEvery renews the lease every third of its duration, until ctx is
+// done or the lease is lost.
+func (d *DiskStore) renewLeaseEvery(ctx context.Context) error {
+	ticker := time.NewTicker(d.opts.LeaseDuration / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			if err := d.renewLease(now); err != nil {
+				d.mu.Lock()
+				d.leaseErr = err
+				d.mu.Unlock()
+				d.log.Error("lost lease", "file", d.lockPath, "error", err)
+				return err
+			}
+		}
+	}
+}
+
+// renewLease extends the lease, and returns ErrLocked if it was lost: taken over
+// by another owner, or expired before we could renew it.
+func (d *DiskStore) renewLease(now time.Time) error {
+	current, err := readLease(d.lockPath)
+	if err == nil && current.Owner != d.lease.Owner {
+		return fmt.Errorf("%w: %s was taken over by pid %d on %s", ErrLocked, d.lockPath, current.PID, current.Host)
+	}
+	if err == nil {
+		err = d.writeLease(now)
+	}
+	if err == nil {
+		return nil
+	}
+	if now.After(d.lease.Expires) {
+		return fmt.Errorf("%w: %s expired: %v", ErrLocked, d.lockPath, err)
+	}
+	// the next tick tries again, before the lease expires
+	d.log.Warn("failed to renew lease", "file", d.lockPath, "error", err)
+	return nil
+}
+
+// releaseLease removes the lock file, unless the lease was lost. The renewals
+// must be stopped.
+func (d *DiskStore) releaseLease() {
+	if d.lease == nil {
+		return
+	}
+	if current, err := readLease(d.lockPath); err == nil && current.Owner == d.lease.Owner {
+		if err := os.Remove(d.lockPath); err != nil {
+			d.log.Error("failed to release lease", "file", d.lockPath, "error", err)
+		}
+	}
+	d.lease = nil
+}
@@ -0,0 +1,101 @@
+package caskdb
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_NetworkFS(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{NetworkFS: true}
+	if _, err := NewDiskStoreWithOptions(fileName, Options{NetworkFS: true, KeyDirIndex: KeyDirMmap}); !errors.Is(err, ErrNetworkFS) {
+		t.Errorf("NewDiskStoreWithOptions() with KeyDirMmap error = %v, want %v", err, ErrNetworkFS)
+	}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("othello", "shakespeare")
+	if _, err := NewDiskStoreWithOptions(fileName, opts); !errors.Is(err, ErrLocked) {
+		t.Errorf("NewDiskStoreWithOptions() of a store in use error = %v, want %v", err, ErrLocked)
+	}
+	// readers take no lease
+	reader, err := OpenReadOnly(fileName, opts)
+	if err != nil {
+		t.Fatalf("OpenReadOnly() error = %v", err)
+	}
+	reader.Close()
+	if !store.Close() {
+		t.Errorf("Close() = false, want true")
+	}
+	if _, err := os.Stat(fileName + lockSuffix); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("lock file error = %v, want it removed by Close", err)
+	}
+
+	// the lease of a writer which crashed is taken over once it expires
+	expired, _ := json.Marshal(lease{Owner: "crashed", Host: "elsewhere", PID: 1, Expires: time.Now().Add(-time.Second)})
+	if err := os.WriteFile(fileName+lockSuffix, expired, 0666); err != nil {
+		t.Fatal(err)
+	}
+	logger := &recordLogger{}
+	opts.Logger = logger
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("NewDiskStoreWithOptions() with an expired lease error = %v", err)
+	}
+	defer store.Close()
+	if !logger.has("taking over expired lease") {
+		t.Errorf("logged %v, want the lease taken over", logger.messages)
+	}
+	if got := store.Get("othello"); got != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", got, "shakespeare")
+	}
+}
+
+func TestDiskStore_lostLease(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{NetworkFS: true, LeaseDuration: 30 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	// another writer took over, e.g. after we stalled past the lease
+	other, _ := json.Marshal(lease{Owner: "other", Host: "elsewhere", PID: 1, Expires: time.Now().Add(time.Hour)})
+	if err := os.WriteFile(fileName+lockSuffix, other, 0666); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for store.Healthy() == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := store.Healthy(); !errors.Is(err, ErrLocked) {
+		t.Errorf("Healthy() error = %v, want %v", err, ErrLocked)
+	}
+	if err := store.Put("othello", "shakespeare"); !errors.Is(err, ErrLocked) {
+		t.Errorf("Put() error = %v, want %v", err, ErrLocked)
+	}
+	if store.Close() {
+		t.Errorf("Close() = true, want false after losing the lease")
+	}
+	// the lease of the other writer is left alone
+	if got, err := readLease(fileName + lockSuffix); err != nil || got.Owner != "other" {
+		t.Errorf("readLease() = %v, %v, want the other writer's", got, err)
+	}
+}
+
+func TestDiskStore_leaseReleasedOnFailure(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	// a segment in cold storage, which the store cannot read
+	if err := os.WriteFile(sealedPath(fileName, 1)+remoteIndexSuffix, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDiskStoreWithOptions(fileName, Options{NetworkFS: true}); !errors.Is(err, ErrNoColdStorage) {
+		t.Fatalf("NewDiskStoreWithOptions() error = %v, want %v", err, ErrNoColdStorage)
+	}
+	if _, err := os.Stat(fileName + lockSuffix); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("lock file error = %v, want it removed", err)
+	}
+}
@@ -0,0 +1,72 @@
+package caskdb
+
+import (
+	"encoding/base64"
+	"strings"
+	"time"
+)
+
+// DefaultListLimit is the number of items List returns when it is not given a
+// limit.
+const DefaultListLimit = 100
+
+// Item is a key along with its value, as returned by List.
+type Item struct {
+	Key   string
+	Value string
+}
+
+// List returns a page of at most limit items whose keys start with prefix, in the
+// order of the keys, along with the cursor to pass to get the next page, which is
+// empty after the last one. Start with an empty cursor.
+//
+// The cursor is opaque, and meant to be handed to clients, e.g. of an HTTP API. It
+// stays valid across writes: the next page starts after the last key of this one,
+// even if that key was deleted since.
+func (d *DiskStore) List(prefix string, cursor string, limit int) ([]Item, string, error) {
+	prefix = d.normalizeKey(prefix)
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	start := prefix
+	if cursor != "" {
+		last, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil || !strings.HasPrefix(string(last), prefix) {
+			return nil, "", ErrInvalidCursor
+		}
+		// nothing sorts between a key and the key followed by a zero byte
+		start = string(last) + "\x00"
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	var items []Item
+	var more bool
+	var err error
+	d.keys.ascend(start, func(key string) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		kEntry := d.keyEntry(key)
+		if kEntry.expired(now) {
+			return true
+		}
+		if len(items) == limit {
+			more = true
+			return false
+		}
+		var value string
+		if value, err = d.read(key, kEntry); err != nil {
+			return false
+		}
+		items = append(items, Item{key, value})
+		return true
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if more {
+		return items, base64.RawURLEncoding.EncodeToString([]byte(items[len(items)-1].Key)), nil
+	}
+	return items, "", nil
+}
@@ -0,0 +1,43 @@
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestDiskStore_List(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	for _, key := range []string{"books/othello", "books/hamlet", "books/dune", "books/emma", "films/dune"} {
+		store.Set(key, "some author")
+	}
+	items, cursor, err := store.List("books/", "", 2)
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(items) != 2 || items[0].Key != "books/dune" || items[1].Key != "books/emma" || cursor == "" {
+		t.Fatalf("List() = %v, %q, want dune and emma and a cursor", items, cursor)
+	}
+	if items[0].Value != "some author" {
+		t.Errorf("List() value = %v, want some author", items[0].Value)
+	}
+	// the cursor survives the writes made since
+	store.Delete("books/emma")
+	store.Set("books/anna", "tolstoy")
+	items, cursor, err = store.List("books/", cursor, 2)
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(items) != 2 || items[0].Key != "books/hamlet" || items[1].Key != "books/othello" || cursor != "" {
+		t.Errorf("List() = %v, %q, want hamlet and othello and no cursor", items, cursor)
+	}
+	if _, _, err := store.List("films/", "!", 2); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("List() with an invalid cursor error = %v, want ErrInvalidCursor", err)
+	}
+}
@@ -0,0 +1,73 @@
+package caskdb
+
+import (
+	"context"
+	"time"
+)
+
+// openInBackground opens the active file and indexes it in the background, check
+// Options.LoadInBackground. The sealed segments are loaded already. The store
+// stays locked until the active file is indexed: its records are the newest, so
+// no read or write can be answered before, and every call waits for the load
+// instead, which takes as long as a scan of one segment at most.
+func (d *DiskStore) openInBackground(fileName string, start time.Time) error {
+	if err := d.openActive(fileName); err != nil {
+		return err
+	}
+	d.loaded = make(chan struct{})
+	d.mu.Lock()
+	d.background.Go(func(context.Context) error {
+		defer close(d.loaded)
+		err := d.loadActiveInBackground(fileName, start)
+		if err != nil || d.opts.OnOpen == nil {
+			return err
+		}
+		// called unlocked, so that it can read the store
+		if err := d.opts.OnOpen(d); err != nil {
+			d.log.Error("failed to load store", "file", fileName, "error", err)
+			d.mu.Lock()
+			d.loadErr = err
+			d.mu.Unlock()
+			return err
+		}
+		return nil
+	})
+	return nil
+}
+
+// loadActiveInBackground indexes the active file and finishes opening the store,
+// which is locked, for openInBackground.
+func (d *DiskStore) loadActiveInBackground(fileName string, start time.Time) error {
+	defer d.mu.Unlock()
+	err := d.loadActive(fileName)
+	if err == nil {
+		err = d.finishOpen(fileName, start)
+	}
+	if err != nil {
+		d.log.Error("failed to load store", "file", fileName, "error", err)
+		d.loadErr = err
+	}
+	return err
+}
+
+// Loaded returns a channel which is closed once the store is loaded; for a store
+// opened with Options.LoadInBackground, that is when the active file is indexed.
+// Healthy reports whether the load failed.
+func (d *DiskStore) Loaded() <-chan struct{} {
+	if d.loaded == nil {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	return d.loaded
+}
+
+// loading reports whether the store is still being loaded in the background.
+func (d *DiskStore) loading() bool {
+	select {
+	case <-d.Loaded():
+		return false
+	default:
+		return true
+	}
+}
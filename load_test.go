@@ -0,0 +1,86 @@
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskStore_LoadInBackground(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{MaxSegmentBytes: 100}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		store.Set(fmt.Sprintf("key-%d", i%7), fmt.Sprintf("value-%d", i))
+	}
+	// the newest record is in the active file
+	store.Set("key-0", "latest")
+	store.Close()
+
+	opts.LoadInBackground = true
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	if err := store.Healthy(); err != nil && !errors.Is(err, ErrLoading) {
+		t.Errorf("Healthy() = %v, want nil or %v", err, ErrLoading)
+	}
+	if err := store.Ping(); err != nil {
+		t.Errorf("Ping() = %v, want nil", err)
+	}
+	// a read waits for the active file
+	if got := store.Get("key-0"); got != "latest" {
+		t.Errorf("Get(key-0) = %q, want %q", got, "latest")
+	}
+	<-store.Loaded()
+	if err := store.Healthy(); err != nil {
+		t.Errorf("Healthy() = %v, want nil", err)
+	}
+	if got := store.Get("key-6"); got != "value-13" {
+		t.Errorf("Get(key-6) = %q, want %q", got, "value-13")
+	}
+	if err := store.Put("key-7", "value"); err != nil {
+		t.Errorf("Put() = %v, want nil", err)
+	}
+	if !store.Close() {
+		t.Errorf("Close() = false, want true")
+	}
+}
+
+func TestDiskStore_LoadInBackground_failed(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("key", "value")
+	store.Close()
+	// a record of a foreign store fails the load of the active file
+	_, data := encodeRecord(1, 0, storeKeyPrefix+"another", "1")
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(data)
+	f.Close()
+
+	store, err = NewDiskStoreWithOptions(fileName, Options{LoadInBackground: true})
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	<-store.Loaded()
+	if err := store.Healthy(); !errors.Is(err, ErrForeignSegment) {
+		t.Errorf("Healthy() = %v, want %v", err, ErrForeignSegment)
+	}
+	if err := store.Put("key", "other"); !errors.Is(err, ErrForeignSegment) {
+		t.Errorf("Put() = %v, want %v", err, ErrForeignSegment)
+	}
+	if store.Close() {
+		t.Errorf("Close() = true, want false")
+	}
+}
@@ -0,0 +1,21 @@
+package caskdb
+
+// Logger receives the structured events the store emits: opening the store,
+// recovering from a partially written record, sync failures and corruption. The
+// args are alternating key value pairs, so *slog.Logger from the standard library
+// satisfies this interface and can be passed as is.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// nopLogger discards everything. It is used when Options.Logger is not set, so
+// that the store stays silent unless asked otherwise.
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, args ...any) {}
+func (nopLogger) Info(msg string, args ...any)  {}
+func (nopLogger) Warn(msg string, args ...any)  {}
+func (nopLogger) Error(msg string, args ...any) {}
@@ -0,0 +1,234 @@
+package caskdb
+
+import (
+	"time"
+)
+
+// Version is a version of a key, as compared by MergeChanges.
+type Version struct {
+	Value   string
+	Deleted bool
+	// Timestamp is when the version was written, to the second
+	Timestamp time.Time
+	// Expiry is when the key expires, zero if it does not
+	Expiry time.Time
+	// Node is the ID of the node which wrote the version
+	Node string
+}
+
+// MergeOptions configures MergeChanges.
+type MergeOptions struct {
+	// Node is the ID of this store, and Peer the ID of the store the changes come
+	// from. When two versions were written in the same second, the one of the
+	// node with the greater ID wins, so that every node picks the same winner.
+	Node string
+	Peer string
+	// Resolve, when set, settles the conflicts instead of the timestamps: it is
+	// called with both versions whenever they differ, and returns the version to
+	// keep, which may be either of them or a new one, e.g. the union of two sets.
+	// A new version is written with the later of the two timestamps. Like OnSet,
+	// it is called with the store locked.
+	Resolve func(key string, local Version, remote Version) Version
+}
+
+// MergeChanges merges the changes of a peer, e.g. read with ReadChanges from a
+// store replicating the same keys, into the store, with last-writer-wins: for
+// every key, the version with the later timestamp is kept, be it a write or a
+// deletion. It returns the number of keys it changed.
+//
+// Merging is commutative and idempotent, so peers which merge each other's
+// changes, in any order and as often as needed, end up with the same data. The
+// merged records keep the timestamps they were written with, so a merged version
+// does not look newer than it is to the next merge.
+//
+// Deletions are only known from the log, so the store is locked while its log is
+// read back to find the deletion times of the keys in changes it does not hold.
+func (d *DiskStore) MergeChanges(changes []Change, opts MergeOptions) (int, error) {
+	remote := make(map[string]Version)
+	for _, change := range changes {
+		if change.Truncate {
+			// a DeleteAll of the peer; only the keys it writes after are merged
+			continue
+		}
+		version := Version{change.Value, change.Deleted, change.Timestamp, change.Expiry, opts.Peer}
+		// the log is in the order of the writes, but the clock may have stepped back
+		// in between
+		if current, ok := remote[change.Key]; !ok || !current.Timestamp.After(version.Timestamp) {
+			remote[change.Key] = version
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	local, err := d.versions(remote, opts.Node)
+	if err != nil {
+		return 0, err
+	}
+	changed := 0
+	for key, theirs := range remote {
+		ours, ok := local[key]
+		keep := theirs
+		switch {
+		case !ok:
+			// a key we never had; a deletion of it is nothing to merge
+			if theirs.Deleted {
+				continue
+			}
+		case ours.equal(theirs):
+			continue
+		case opts.Resolve != nil:
+			keep = opts.Resolve(key, ours, theirs)
+			latest := ours.Timestamp
+			if theirs.Timestamp.After(latest) {
+				latest = theirs.Timestamp
+			}
+			if keep.Timestamp.Before(latest) {
+				keep.Timestamp = latest
+			}
+		case !theirs.newer(ours):
+			continue
+		}
+		if ok && keep.equal(ours) {
+			continue
+		}
+		if err := d.apply(key, keep); err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+// versions returns the latest local version of each of the keys, tombstones
+// included. Those of the keys in keyDir are read from their records, and the log
+// is only read back for the others. The store must be locked.
+func (d *DiskStore) versions(keys map[string]Version, node string) (map[string]Version, error) {
+	versions := make(map[string]Version)
+	deleted := make(map[string]bool)
+	for key := range keys {
+		kEntry, ok := d.keyDir.get(key)
+		if !ok {
+			deleted[key] = true
+			continue
+		}
+		value, err := d.read(key, kEntry)
+		if err != nil {
+			return nil, err
+		}
+		version := Version{Value: value, Timestamp: time.Unix(int64(kEntry.timestamp), 0), Node: node}
+		if kEntry.expiry != 0 {
+			version.Expiry = time.Unix(int64(kEntry.expiry), 0)
+		}
+		versions[key] = version
+	}
+	if len(deleted) == 0 {
+		return versions, nil
+	}
+	size := d.logSize()
+	r, err := d.openLog(0, size)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	err = scanRecords(r, size, func(offset int, data []byte) error {
+		timestamp, key, _ := decodeKV(data)
+		if key == truncateKey {
+			// DeleteAll deleted every key then
+			for k := range deleted {
+				versions[k] = Version{Deleted: true, Timestamp: time.Unix(int64(timestamp), 0), Node: node}
+			}
+			return nil
+		}
+		if !deleted[key] {
+			return nil
+		}
+		value, err := d.decodeValue(data)
+		if err == nil && decodeFlags(data)&FlagDedup != 0 {
+			value, err = d.blobValue(value)
+		}
+		if err != nil {
+			return err
+		}
+		version := Version{Value: value, Deleted: value == "", Timestamp: time.Unix(int64(timestamp), 0), Node: node}
+		if expiry := decodeExpiry(data); expiry != 0 {
+			version.Expiry = time.Unix(int64(expiry), 0)
+		}
+		versions[key] = version
+		return nil
+	})
+	return versions, err
+}
+
+// apply writes the version of the key with its own timestamp. The store must be
+// locked.
+func (d *DiskStore) apply(key string, version Version) error {
+	timestamp := uint32(version.Timestamp.Unix())
+	if version.Deleted || version.Value == "" {
+		if _, ok := d.keyDir.get(key); !ok {
+			return nil
+		}
+		if _, err := d.tombstone(key, timestamp, ""); err != nil {
+			return err
+		}
+		if d.opts.OnDelete != nil {
+			d.opts.OnDelete(key)
+		}
+		return nil
+	}
+	var expiry uint32
+	if !version.Expiry.IsZero() {
+		expiry = uint32(version.Expiry.Unix())
+	}
+	if _, err := d.putAt(key, version.Value, timestamp, expiry, "", 0); err != nil {
+		return err
+	}
+	if d.opts.OnSet != nil {
+		d.opts.OnSet(key, version.Value)
+	}
+	return nil
+}
+
+// newer reports whether v wins over other with last-writer-wins.
+func (v Version) newer(other Version) bool {
+	if !v.Timestamp.Equal(other.Timestamp) {
+		return v.Timestamp.After(other.Timestamp)
+	}
+	return v.Node > other.Node
+}
+
+// equal reports whether both versions hold the same data, whenever and wherever
+// they were written.
+func (v Version) equal(other Version) bool {
+	return v.Deleted == other.Deleted && v.Value == other.Value && v.Expiry.Equal(other.Expiry)
+}
+
+// MergeFrom merges all the keys of other into the store with last-writer-wins,
+// like MergeChanges, and returns the number of keys it changed. Versions written
+// in the same second go to other. It is meant for combining two copies of a
+// database which diverged, e.g. after a split-brain, or for consolidating several
+// databases into one.
+func (d *DiskStore) MergeFrom(other *DiskStore) (int, error) {
+	var changes []Change
+	latest := make(map[string]int)
+	for offset := int64(0); ; {
+		batch, next, err := other.ReadChanges(offset, 1024)
+		if err != nil {
+			return 0, err
+		}
+		if next == offset {
+			break
+		}
+		// only the latest version of each key takes part in the merge
+		for _, change := range batch {
+			i, ok := latest[change.Key]
+			if !ok {
+				latest[change.Key] = len(changes)
+				changes = append(changes, change)
+			} else if !changes[i].Timestamp.After(change.Timestamp) {
+				changes[i] = change
+			}
+		}
+		offset = next
+	}
+	// "other" sorts after "local", so other wins the ties
+	return d.MergeChanges(changes, MergeOptions{Node: "local", Peer: "other"})
+}
@@ -0,0 +1,116 @@
+package caskdb
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_MergeChanges(t *testing.T) {
+	a, err := NewDiskStore(filepath.Join(t.TempDir(), "a.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer a.Close()
+	b, err := NewDiskStore(filepath.Join(t.TempDir(), "b.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer b.Close()
+
+	earlier := uint32(time.Now().Add(-time.Hour).Unix())
+	later := earlier + 60
+	// a wrote hamlet first, b overwrote it later
+	a.putAt("hamlet", "shakespeare", earlier, 0, "", 0)
+	b.putAt("hamlet", "kyd", later, 0, "", 0)
+	// b deleted dune after a wrote it
+	a.putAt("dune", "herbert", earlier, 0, "", 0)
+	b.putAt("dune", "herbert", earlier, 0, "", 0)
+	b.tombstone("dune", later, "")
+	// both wrote emma in the same second, and b wins the tie with the greater ID
+	a.putAt("emma", "austen", later, 0, "", 0)
+	b.putAt("emma", "brontë", later, 0, "", 0)
+	// only a has othello
+	a.putAt("othello", "shakespeare", earlier, 0, "", 0)
+
+	merge := func(dst, src *DiskStore, node, peer string) int {
+		t.Helper()
+		changes, _, err := src.ReadChanges(0, 100)
+		if err != nil {
+			t.Fatalf("ReadChanges() error = %v", err)
+		}
+		n, err := dst.MergeChanges(changes, MergeOptions{Node: node, Peer: peer})
+		if err != nil {
+			t.Fatalf("MergeChanges() error = %v", err)
+		}
+		return n
+	}
+	if n := merge(a, b, "a", "b"); n != 3 {
+		t.Errorf("MergeChanges() changed %v keys, want 3", n)
+	}
+	if n := merge(b, a, "b", "a"); n != 1 {
+		t.Errorf("MergeChanges() changed %v keys, want othello only", n)
+	}
+	// merging again changes nothing
+	if n := merge(a, b, "a", "b"); n != 0 {
+		t.Errorf("MergeChanges() again changed %v keys, want 0", n)
+	}
+	want := map[string]string{"hamlet": "kyd", "dune": "", "emma": "brontë", "othello": "shakespeare"}
+	for key, value := range want {
+		if got := a.Get(key); got != value {
+			t.Errorf("a.Get(%v) = %v, want %v", key, got, value)
+		}
+		if got := b.Get(key); got != value {
+			t.Errorf("b.Get(%v) = %v, want %v", key, got, value)
+		}
+	}
+	if kEntry := a.keyEntry("hamlet"); kEntry.timestamp != later {
+		t.Errorf("merged timestamp = %v, want the original %v", kEntry.timestamp, later)
+	}
+
+	// a resolver overrides the timestamps
+	a.putAt("macbeth", "shakespeare", later, 0, "", 0)
+	b.putAt("macbeth", "middleton", later+1, 0, "", 0)
+	changes, _, _ := b.ReadChanges(0, 100)
+	_, err = a.MergeChanges(changes, MergeOptions{Node: "a", Peer: "b", Resolve: func(key string, local, remote Version) Version {
+		local.Value = local.Value + " & " + remote.Value
+		return local
+	}})
+	if err != nil {
+		t.Fatalf("MergeChanges() error = %v", err)
+	}
+	if got := a.Get("macbeth"); got != "shakespeare & middleton" {
+		t.Errorf("Get(macbeth) = %v, want the resolved value", got)
+	}
+}
+
+func TestDiskStore_MergeFrom(t *testing.T) {
+	a, err := NewDiskStore(filepath.Join(t.TempDir(), "a.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer a.Close()
+	b, err := NewDiskStore(filepath.Join(t.TempDir(), "b.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer b.Close()
+
+	earlier := uint32(time.Now().Add(-time.Hour).Unix())
+	a.putAt("hamlet", "shakespeare", earlier, 0, "", 0)
+	a.putAt("othello", "shakespeare", earlier, 0, "", 0)
+	b.putAt("hamlet", "kyd", earlier+1, 0, "", 0)
+	b.putAt("hamlet", "shakespeare", earlier+2, 0, "", 0)
+	b.putAt("dune", "herbert", earlier, 0, "", 0)
+	b.tombstone("othello", earlier+1, "")
+
+	if n, err := a.MergeFrom(b); err != nil || n != 2 {
+		t.Fatalf("MergeFrom() = %v, %v, want dune and othello changed", n, err)
+	}
+	want := map[string]string{"hamlet": "shakespeare", "dune": "herbert", "othello": ""}
+	for key, value := range want {
+		if got := a.Get(key); got != value {
+			t.Errorf("Get(%v) = %v, want %v", key, got, value)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package caskdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrInvalidStoreName is returned by Manager.Open for a name which is not 1 to 64
+// letters, digits, underscores or dashes.
+var ErrInvalidStoreName = errors.New("caskdb: invalid store name")
+
+// managedFileName is the name of the data file of a store of a Manager, in the
+// directory named after the store
+const managedFileName = "data.db"
+
+// validStoreName limits the names of the stores of a Manager to something which
+// is safe to use as a directory name on every platform
+var validStoreName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// cacheOwners hands out the owners of the records of the stores sharing a cache
+var cacheOwners uint64
+
+// sharedResources are those the stores of a Manager share.
+type sharedResources struct {
+	// cache holds the records the stores read from cold storage
+	cache *recordLRU
+	// buffers are the scratch buffers the stores read records into, check scratch
+	buffers sync.Pool
+	// compactions holds a token for every compaction running
+	compactions chan struct{}
+}
+
+// coldCache returns the view of a new store on the shared cache.
+func (s *sharedResources) coldCache() *recordCache {
+	return &recordCache{lru: s.cache, owner: atomic.AddUint64(&cacheOwners, 1)}
+}
+
+// ManagerOptions tunes a Manager.
+type ManagerOptions struct {
+	// Options are those every store is opened with. Options.ColdCacheBytes bounds
+	// the cache the stores share, rather than the cache of each. With
+	// Options.SyncInterval, the Manager syncs the stores one after the other,
+	// spread over the interval, rather than each store on its own.
+	Options Options
+	// CompactionWorkers is how many stores may run Compact at the same time; the
+	// others wait for their turn. When zero, one at a time.
+	CompactionWorkers int
+}
+
+// Manager opens many small stores, e.g. one per tenant, which share their
+// resources so that the memory and the I/O they use stay bounded however many
+// there are: the cache of the records read from cold storage, the buffers the
+// records are read into, the compactions running at a time, and the fsyncs of
+// Options.SyncInterval. Each store is in a directory of its own, named after it,
+// under the directory of the Manager.
+//
+// The stores are opened with Open, and closed with CloseStore or Close, not with
+// DiskStore.Close, so that the Manager lets go of them.
+type Manager struct {
+	dir        string
+	opts       Options
+	shared     *sharedResources
+	background *supervisor
+
+	mu     sync.Mutex
+	stores map[string]*DiskStore
+}
+
+// NewManager returns a Manager of the stores in dir, creating the directory if
+// needed. The stores are opened as they are asked for.
+func NewManager(dir string, opts ManagerOptions) (*Manager, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	workers := opts.CompactionWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	shared := &sharedResources{
+		cache:       newRecordLRU(opts.Options.ColdCacheBytes),
+		buffers:     sync.Pool{New: func() any { return new([maxScratchBytes]byte) }},
+		compactions: make(chan struct{}, workers),
+	}
+	m := &Manager{dir: dir, opts: opts.Options, shared: shared, background: newSupervisor(), stores: make(map[string]*DiskStore)}
+	m.opts.shared = shared
+	if m.opts.SyncInterval > 0 {
+		m.background.Go(m.syncEvery)
+	}
+	return m, nil
+}
+
+// Open returns the store of the name, opening it, or creating it, if it is not
+// open yet.
+func (m *Manager) Open(name string) (*DiskStore, error) {
+	if !validStoreName.MatchString(name) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidStoreName, name)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.stores[name]; ok {
+		return s, nil
+	}
+	dir := filepath.Join(m.dir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	opts := m.opts
+	if opts.ColdDir != "" {
+		opts.ColdDir = filepath.Join(opts.ColdDir, name)
+	}
+	if opts.ColdPrefix != "" {
+		opts.ColdPrefix += name + "/"
+	}
+	s, err := NewDiskStoreWithOptions(filepath.Join(dir, managedFileName), opts)
+	if err != nil {
+		return nil, fmt.Errorf("store %q: %w", name, err)
+	}
+	m.stores[name] = s
+	return s, nil
+}
+
+// Names returns the names of the stores open, sorted.
+func (m *Manager) Names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.stores))
+	for name := range m.stores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CloseStore closes the store of the name, if it is open. It returns false if the
+// store failed to close.
+func (m *Manager) CloseStore(name string) bool {
+	m.mu.Lock()
+	s, ok := m.stores[name]
+	delete(m.stores, name)
+	m.mu.Unlock()
+	if !ok {
+		return true
+	}
+	return s.Close()
+}
+
+// Compact compacts every store open, CompactionWorkers at a time, and returns the
+// number of bytes freed. It stops at the first store which fails, or when ctx is
+// done.
+func (m *Manager) Compact(ctx context.Context) (int64, error) {
+	stores := m.open()
+	freed := make([]int64, len(stores))
+	errs := make([]error, len(stores))
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i, s := range stores {
+		wg.Add(1)
+		go func(i int, s *DiskStore) {
+			defer wg.Done()
+			if freed[i], errs[i] = s.Compact(ctx); errs[i] != nil {
+				cancel()
+			}
+		}(i, s)
+	}
+	wg.Wait()
+	var total int64
+	for _, n := range freed {
+		total += n
+	}
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return total, err
+		}
+	}
+	return total, ctx.Err()
+}
+
+// Close closes every store open. It returns false if any of them failed to close.
+func (m *Manager) Close() bool {
+	// the syncs are stopped first, as they go through the stores
+	ok := m.background.stop() == nil
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, s := range m.stores {
+		ok = s.Close() && ok
+		delete(m.stores, name)
+	}
+	return ok
+}
+
+// open returns the stores open, in the order of their names.
+func (m *Manager) open() []*DiskStore {
+	names := m.Names()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stores := make([]*DiskStore, 0, len(names))
+	for _, name := range names {
+		if s, ok := m.stores[name]; ok {
+			stores = append(stores, s)
+		}
+	}
+	return stores
+}
+
+// syncEvery syncs the writes the stores left unsynced every Options.SyncInterval,
+// until ctx is done. The stores are synced one at a time, spread over the
+// interval, so that they never all fsync at once.
+func (m *Manager) syncEvery(ctx context.Context) error {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+	for {
+		stores := m.open()
+		turns := len(stores)
+		if turns == 0 {
+			turns = 1
+		}
+		for i := 0; i < turns; i++ {
+			timer.Reset(m.opts.SyncInterval / time.Duration(turns))
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-timer.C:
+			}
+			if i < len(stores) {
+				stores[i].syncUnsynced()
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package caskdb
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestManager(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewManager(dir, ManagerOptions{Options: Options{SyncInterval: 10 * time.Millisecond, ColdCacheBytes: 1 << 20}})
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+	alice, err := m.Open("alice")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	bob, err := m.Open("bob")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if s, err := m.Open("alice"); err != nil || s != alice {
+		t.Errorf("Open() = %p, %v, want the store open %p", s, err, alice)
+	}
+	if _, err := m.Open("../carol"); !errors.Is(err, ErrInvalidStoreName) {
+		t.Errorf("Open() error = %v, want %v", err, ErrInvalidStoreName)
+	}
+	if got, want := m.Names(), []string{"alice", "bob"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Names() = %v, want %v", got, want)
+	}
+	if alice.coldCache.lru != bob.coldCache.lru || alice.coldCache.owner == bob.coldCache.owner {
+		t.Errorf("the stores do not share a cache, each with records of its own")
+	}
+
+	alice.Set("othello", "shakespeare")
+	bob.Set("othello", "verdi")
+	if got := alice.Get("othello"); got != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", got, "shakespeare")
+	}
+	// the Manager syncs the writes of the stores in turn
+	unsynced := func(s *DiskStore) bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.unsynced
+	}
+	for deadline := time.Now().Add(5 * time.Second); unsynced(alice) || unsynced(bob); {
+		if time.Now().After(deadline) {
+			t.Fatalf("unsynced = true, want the writes synced by the manager")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := m.Compact(context.Background()); err != nil {
+		t.Errorf("Compact() error = %v", err)
+	}
+	// with the one worker busy, a compaction waits for its turn
+	m.shared.compactions <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := alice.Compact(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Compact() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	<-m.shared.compactions
+
+	if !m.CloseStore("bob") {
+		t.Errorf("CloseStore() = false, want true")
+	}
+	if !m.Close() {
+		t.Errorf("Close() = false, want true")
+	}
+
+	m, err = NewManager(dir, ManagerOptions{})
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+	defer m.Close()
+	bob, err = m.Open("bob")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if got := bob.Get("othello"); got != "verdi" {
+		t.Errorf("Get() = %v, want %v", got, "verdi")
+	}
+}
@@ -0,0 +1,105 @@
+package caskdb
+
+import (
+	"container/list"
+	"unsafe"
+)
+
+// sizes of the Go values making up the structures of the store
+const (
+	pointerSize      = int64(unsafe.Sizeof(uintptr(0)))
+	stringHeaderSize = int64(unsafe.Sizeof(""))
+	sliceHeaderSize  = int64(unsafe.Sizeof([]byte(nil)))
+	keyEntrySize     = int64(unsafe.Sizeof(KeyEntry{}))
+)
+
+// MemoryUsage is an estimate of the memory a store takes up, in bytes, as returned
+// by DiskStore.MemoryUsage, for budgeting the memory of the stores of a process.
+// It counts the structures the store keeps, as laid out by the Go runtime, but not
+// the garbage the runtime has yet to collect, nor the buffers of the reads and
+// writes in flight: the store keeps no buffer pools, but those of its Manager, and
+// allocates those as it goes.
+type MemoryUsage struct {
+	KeyDir KeyDirMemory
+	// KeyIndex is the ordered index of the keys, for the scans by prefix. It shares
+	// the bytes of the keys with KeyDir, and is 0 with KeyDirART, whose tree is
+	// ordered already, and with KeyDirMmap until a scan needed the keys in order.
+	KeyIndex int64
+	// ColdCache is the cache of the records read from cold storage, bounded by
+	// Options.ColdCacheBytes; for the stores of a Manager, the cache they share
+	ColdCache int64
+	// Dictionaries are those of Options.CompactionDictionary, Blobs the index of
+	// the blobs of Options.Dedup, and IdempotencyTokens the tokens seen within
+	// Options.IdempotencyWindow
+	Dictionaries      int64
+	Blobs             int64
+	IdempotencyTokens int64
+	// Stats is the latency histograms of Stats
+	Stats int64
+}
+
+// KeyDirMemory is the memory of KeyDir: Keys is the bytes of the keys, Entries
+// those of their KeyEntry, and Overhead that of the table around them, e.g. its
+// empty slots or the nodes of a tree.
+type KeyDirMemory struct {
+	Keys     int64
+	Entries  int64
+	Overhead int64
+}
+
+// Total returns the memory of KeyDir.
+func (m KeyDirMemory) Total() int64 {
+	return m.Keys + m.Entries + m.Overhead
+}
+
+// Total returns the memory of the store.
+func (m MemoryUsage) Total() int64 {
+	return m.KeyDir.Total() + m.KeyIndex + m.ColdCache + m.Dictionaries + m.Blobs + m.IdempotencyTokens + m.Stats
+}
+
+// MemoryUsage estimates the memory the store takes up. It goes through every key,
+// so it takes about as long as listing them.
+func (d *DiskStore) MemoryUsage() MemoryUsage {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var m MemoryUsage
+	d.keyDir.memory(&m.KeyDir)
+	m.KeyIndex = d.keys.memory()
+	m.ColdCache = d.coldCache.memory()
+	for id, b := range d.blobs {
+		m.Blobs += int64(len(id)) + int64(unsafe.Sizeof(*b))
+	}
+	m.Blobs += mapMemory(len(d.blobs), stringHeaderSize+pointerSize)
+	for token := range d.tokens {
+		m.IdempotencyTokens += int64(len(token))
+	}
+	m.IdempotencyTokens += mapMemory(len(d.tokens), stringHeaderSize+4)
+	m.Stats = int64(unsafe.Sizeof(d.readLatency) + unsafe.Sizeof(d.writeLatency) + unsafe.Sizeof(d.syncLatency))
+	d.dictMu.RLock()
+	for _, dict := range d.dicts {
+		m.Dictionaries += int64(cap(dict))
+	}
+	m.Dictionaries += mapMemory(len(d.dicts), 4+sliceHeaderSize)
+	d.dictMu.RUnlock()
+	return m
+}
+
+// mapMemory estimates the memory of a map of n entries of entrySize bytes each,
+// the key and the value. The maps of the runtime are swiss tables of a power of
+// two slots, with a control byte each, at most 7/8 full.
+func mapMemory(n int, entrySize int64) int64 {
+	slots := int64(8)
+	for slots*7/8 < int64(n) {
+		slots *= 2
+	}
+	return slots * (entrySize + 1)
+}
+
+// memory returns the memory of the cache: the records, and for each of them its
+// element of the LRU list and its entry in the map.
+func (c *recordCache) memory() int64 {
+	c.lru.mu.Lock()
+	defer c.lru.mu.Unlock()
+	elem := int64(unsafe.Sizeof(list.Element{}) + unsafe.Sizeof(cachedRecord{}))
+	return c.lru.size + int64(len(c.lru.items))*elem + mapMemory(len(c.lru.items), int64(unsafe.Sizeof(ownedRecordKey{}))+pointerSize)
+}
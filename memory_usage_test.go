@@ -0,0 +1,57 @@
+package caskdb
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskStore_MemoryUsage(t *testing.T) {
+	for _, index := range []KeyDirIndex{KeyDirMap, KeyDirRobinHood, KeyDirART} {
+		t.Run(index.String(), func(t *testing.T) {
+			store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{KeyDirIndex: index})
+			if err != nil {
+				t.Fatalf("failed to create disk store: %v", err)
+			}
+			defer store.Close()
+			empty := store.MemoryUsage()
+			keys := 0
+			for i := 0; i < 1000; i++ {
+				key := fmt.Sprintf("book:%d", i)
+				store.Set(key, "shakespeare")
+				keys += len(key)
+			}
+
+			m := store.MemoryUsage()
+			if m.KeyDir.Keys != int64(keys) {
+				t.Errorf("MemoryUsage() keys = %v, want %v", m.KeyDir.Keys, keys)
+			}
+			if m.KeyDir.Entries != 1000*keyEntrySize || m.KeyDir.Overhead <= 0 {
+				t.Errorf("MemoryUsage() KeyDir = %+v, want 1000 entries and some overhead", m.KeyDir)
+			}
+			if (m.KeyIndex == 0) != (index == KeyDirART) {
+				t.Errorf("MemoryUsage() key index = %v, want it only without KeyDirART", m.KeyIndex)
+			}
+			if m.Stats == 0 || m.Total() <= empty.Total() {
+				t.Errorf("MemoryUsage() = %+v, want more than the %+v of the empty store", m, empty)
+			}
+		})
+	}
+}
+
+func Test_mapMemory(t *testing.T) {
+	tests := []struct {
+		n    int
+		want int64
+	}{
+		{0, 8 * 9},
+		{7, 8 * 9},
+		{8, 16 * 9},
+		{100, 128 * 9},
+	}
+	for _, tt := range tests {
+		if got := mapMemory(tt.n, 8); got != tt.want {
+			t.Errorf("mapMemory(%v) = %v, want %v", tt.n, got, tt.want)
+		}
+	}
+}
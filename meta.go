@@ -0,0 +1,213 @@
+package caskdb
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"time"
+)
+
+// The value of a record flagged FlagMeta starts with the metadata of the key: the
+// length of its encoding as a uvarint, the CRC32 of the encoding, and the encoding
+// itself, followed by the value as it would be stored otherwise, compressed or
+// encrypted. The metadata is neither, so that GetMeta reads it off the start of
+// the record, with a checksum of its own since it does not read the record whole.
+
+// maxMetaSize is the size of the largest encoding of a Meta
+const maxMetaSize = 4096
+
+// Meta is the metadata attached to a key along with its value by PutWithMeta. It
+// is meant to be small: its encoding is capped at 4KB. Like the keys, it is
+// stored in the clear, even with Options.EncryptionKeys set.
+type Meta struct {
+	ContentType string
+	Owner       string
+	Tags        map[string]string
+}
+
+// encodeMeta returns the block of the metadata put in front of the value.
+func encodeMeta(m Meta) (string, error) {
+	var body []byte
+	body = appendString(body, m.ContentType)
+	body = appendString(body, m.Owner)
+	names := make([]string, 0, len(m.Tags))
+	for name := range m.Tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	body = binary.AppendUvarint(body, uint64(len(names)))
+	for _, name := range names {
+		body = appendString(body, name)
+		body = appendString(body, m.Tags[name])
+	}
+	if len(body) > maxMetaSize {
+		return "", fmt.Errorf("%w: %d bytes", ErrMetaTooLarge, len(body))
+	}
+	block := binary.AppendUvarint(nil, uint64(len(body)))
+	block = binary.LittleEndian.AppendUint32(block, crc32.ChecksumIEEE(body))
+	return string(append(block, body...)), nil
+}
+
+// appendString appends the length of s as a uvarint, and s.
+func appendString(b []byte, s string) []byte {
+	return append(binary.AppendUvarint(b, uint64(len(s))), s...)
+}
+
+// splitMeta splits the value of a record flagged FlagMeta into the block of the
+// metadata and the value.
+func splitMeta(value string) (block string, rest string, err error) {
+	prefix := value
+	if len(prefix) > binary.MaxVarintLen64 {
+		prefix = prefix[:binary.MaxVarintLen64]
+	}
+	size, n := binary.Uvarint([]byte(prefix))
+	if n <= 0 || size > maxMetaSize || len(value) < n+4 || uint64(len(value)-n-4) < size {
+		return "", "", fmt.Errorf("%w: invalid metadata", ErrCorruptRecord)
+	}
+	end := n + 4 + int(size)
+	return value[:end], value[end:], nil
+}
+
+// decodeMeta returns the metadata back from its block.
+func decodeMeta(block string) (Meta, error) {
+	var m Meta
+	_, n := binary.Uvarint([]byte(block))
+	if n <= 0 || len(block) < n+4 {
+		return m, fmt.Errorf("%w: invalid metadata", ErrCorruptRecord)
+	}
+	body := []byte(block[n+4:])
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32([]byte(block[n:n+4])) {
+		return m, fmt.Errorf("%w: metadata checksum mismatch", ErrCorruptRecord)
+	}
+	errInvalid := fmt.Errorf("%w: invalid metadata", ErrCorruptRecord)
+	readString := func() (string, bool) {
+		size, n := binary.Uvarint(body)
+		if n <= 0 || uint64(len(body)-n) < size {
+			return "", false
+		}
+		s := string(body[n : n+int(size)])
+		body = body[n+int(size):]
+		return s, true
+	}
+	var ok bool
+	if m.ContentType, ok = readString(); !ok {
+		return m, errInvalid
+	}
+	if m.Owner, ok = readString(); !ok {
+		return m, errInvalid
+	}
+	count, n := binary.Uvarint(body)
+	if n <= 0 || count > uint64(len(body)) {
+		return m, errInvalid
+	}
+	body = body[n:]
+	if count > 0 {
+		m.Tags = make(map[string]string, count)
+	}
+	for i := uint64(0); i < count; i++ {
+		name, ok := readString()
+		if !ok {
+			return m, errInvalid
+		}
+		if m.Tags[name], ok = readString(); !ok {
+			return m, errInvalid
+		}
+	}
+	return m, nil
+}
+
+// metaBlock returns the block of the metadata of the record, empty if it has
+// none.
+func metaBlock(data []byte) string {
+	if decodeFlags(data)&FlagMeta == 0 {
+		return ""
+	}
+	_, _, value := decodeKV(data)
+	block, _, _ := splitMeta(value)
+	return block
+}
+
+// storedValue returns the value of the record as stored, past the block of its
+// metadata, still compressed or encrypted.
+func storedValue(data []byte) (string, error) {
+	_, keySize, valueSize := decodeHeader(data)
+	value := string(data[headerSize+keySize : headerSize+keySize+valueSize])
+	if decodeFlags(data)&FlagMeta == 0 {
+		return value, nil
+	}
+	_, value, err := splitMeta(value)
+	return value, err
+}
+
+// PutWithMeta is like Put, and attaches the metadata to the key, which GetMeta
+// returns without reading the value. Writing the key again, with Put or
+// PutWithMeta, replaces the metadata; Expire keeps it. Such a value is never
+// deduplicated, check Options.Dedup, and the change feed and MergeChanges carry
+// it without its metadata.
+func (d *DiskStore) PutWithMeta(key string, value string, meta Meta) error {
+	if value == "" {
+		return d.Delete(key)
+	}
+	block, err := encodeMeta(meta)
+	if err != nil {
+		return err
+	}
+	return d.putContext(context.Background(), key, block+value, FlagMeta)
+}
+
+// GetMeta returns the metadata attached to the key by PutWithMeta, the zero Meta
+// if there is none. It only reads the start of the record, whatever the size of
+// the value. It fails with ErrKeyNotFound if the key does not exist.
+func (d *DiskStore) GetMeta(key string) (Meta, error) {
+	key = d.normalizeKey(key)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	kEntry, ok := d.keyDir.get(key)
+	if !ok || kEntry.expired(time.Now()) {
+		return Meta{}, ErrKeyNotFound
+	}
+	block, err := d.readMetaBlock(key, kEntry)
+	if err != nil || block == "" {
+		return Meta{}, err
+	}
+	return decodeMeta(block)
+}
+
+// readMetaBlock reads the block of the metadata of the record of the key, empty
+// if it has none, from the start of the record. The store must be locked.
+func (d *DiskStore) readMetaBlock(key string, kEntry KeyEntry) (string, error) {
+	if kEntry.blob != nil {
+		// the values with metadata are not deduplicated
+		return "", nil
+	}
+	seg := d.segment(kEntry.segment)
+	if seg == nil {
+		return "", fmt.Errorf("%w: key %q points at missing segment %d", ErrKeyMismatch, key, kEntry.segment)
+	}
+	size := headerSize + len(key) + binary.MaxVarintLen64 + 4 + maxMetaSize
+	if size > int(kEntry.totalSize) {
+		size = int(kEntry.totalSize)
+	}
+	data, err := d.readRecordPrefix(seg, kEntry, size)
+	if err != nil {
+		return "", err
+	}
+	_, keySize, _ := decodeHeader(data)
+	if int(keySize) != len(key) || string(data[headerSize:headerSize+keySize]) != key {
+		storedKey := string(data[headerSize:])
+		if int(keySize) < len(storedKey) {
+			storedKey = storedKey[:keySize]
+		}
+		return "", fmt.Errorf("%w: looked up %q, found %q at offset %d", ErrKeyMismatch, key, storedKey, kEntry.position)
+	}
+	if decodeFlags(data)&FlagMeta == 0 {
+		return "", nil
+	}
+	block, _, err := splitMeta(string(data[headerSize+keySize:]))
+	if err != nil {
+		return "", fmt.Errorf("key %q at offset %d: %w", key, kEntry.position, err)
+	}
+	return block, nil
+}
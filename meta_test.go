@@ -0,0 +1,65 @@
+package caskdb
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_PutWithMeta(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{EncryptionKeys: []EncryptionKey{keyA}, Compression: CompressionGzip}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	long := strings.Repeat("to be or not to be, ", 100)
+	meta := Meta{ContentType: "text/plain", Owner: "globe", Tags: map[string]string{"act": "3", "scene": "1"}}
+	if err := store.PutWithMeta("hamlet", long, meta); err != nil {
+		t.Fatalf("PutWithMeta() error = %v", err)
+	}
+	store.Set("othello", "shakespeare")
+	if got := store.Get("hamlet"); got != long {
+		t.Errorf("Get() = %d bytes, want %d", len(got), len(long))
+	}
+	if got, err := store.GetMeta("hamlet"); err != nil || !reflect.DeepEqual(got, meta) {
+		t.Errorf("GetMeta() = %+v, %v, want %+v", got, err, meta)
+	}
+	if got, err := store.GetMeta("othello"); err != nil || !reflect.DeepEqual(got, Meta{}) {
+		t.Errorf("GetMeta() of a key without metadata = %+v, %v, want none", got, err)
+	}
+	if _, err := store.GetMeta("macbeth"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("GetMeta() error = %v, want %v", err, ErrKeyNotFound)
+	}
+	if err := store.PutWithMeta("lear", "cordelia", Meta{Owner: strings.Repeat("o", maxMetaSize)}); !errors.Is(err, ErrMetaTooLarge) {
+		t.Errorf("PutWithMeta() error = %v, want %v", err, ErrMetaTooLarge)
+	}
+	if err := store.Expire("hamlet", time.Hour); err != nil {
+		t.Fatalf("Expire() error = %v", err)
+	}
+	store.Set("othello", "moor")
+	if _, err := store.Compact(context.Background()); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	store.Close()
+
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	if got, err := store.GetMeta("hamlet"); err != nil || !reflect.DeepEqual(got, meta) {
+		t.Errorf("GetMeta() after Expire and Compact = %+v, %v, want %+v", got, err, meta)
+	}
+	if got := store.Get("hamlet"); got != long {
+		t.Errorf("Get() after Expire and Compact = %d bytes, want %d", len(got), len(long))
+	}
+	store.Set("hamlet", "prince")
+	if got, err := store.GetMeta("hamlet"); err != nil || !reflect.DeepEqual(got, Meta{}) {
+		t.Errorf("GetMeta() after Set = %+v, %v, want none", got, err)
+	}
+}
@@ -0,0 +1,114 @@
+package caskdb
+
+import (
+	"context"
+	"fmt"
+)
+
+// MigrateFunc transforms a key and its value for Migrate: it returns the key and
+// value to store instead, and false to delete the key.
+type MigrateFunc func(key string, value string) (newKey string, newValue string, keep bool)
+
+// Migrate rewrites every live key of the store through fn, for a change of the
+// layout of the keys or of the encoding of the values, and returns the number of
+// keys it changed. A key whose new key and value are its own is left alone. The
+// expiry of a key, and the metadata attached by PutWithMeta, are carried over to
+// its new key. Once every key went through fn, the store is compacted, so that
+// the records of the old layout are dropped.
+//
+// A key moved to a new key is deleted and written there in a Txn, so that a
+// crash leaves it at either place, never at both or neither. Migrate as a whole
+// is not atomic though: interrupted, or when ctx is done, part of the keys are
+// migrated, and calling it again carries on, so fn must take the keys and values
+// it returned before through unchanged. Moving a key onto another key of the
+// store fails, as one would be lost.
+//
+// Like CopyTo, the store is only locked while the keys are listed and while each
+// key is written, so reads and writes carry on meanwhile; a key written since it
+// was listed is left as written.
+func (d *DiskStore) Migrate(ctx context.Context, fn MigrateFunc) (int, error) {
+	if d.readOnly {
+		return 0, ErrReadOnly
+	}
+	changed, err := d.migrateKeys(ctx, fn)
+	if err != nil || changed == 0 {
+		return changed, err
+	}
+	// the old records are in sealed segments once the active file is too
+	if err := d.Rotate(); err != nil {
+		return changed, err
+	}
+	_, err = d.Compact(ctx)
+	return changed, err
+}
+
+// migrateKeys rewrites the keys listed by a snapshot through fn, and returns the
+// number of keys it changed.
+func (d *DiskStore) migrateKeys(ctx context.Context, fn MigrateFunc) (int, error) {
+	live, readers, closeReaders, err := d.snapshot()
+	if err != nil {
+		return 0, err
+	}
+	defer closeReaders()
+	changed := 0
+	for _, l := range live {
+		if err := ctx.Err(); err != nil {
+			return changed, err
+		}
+		data, err := readLive(readers, l.key, l.kEntry)
+		if err != nil {
+			return changed, err
+		}
+		value, err := l.value(d, readers, data)
+		if err != nil {
+			return changed, err
+		}
+		newKey, newValue, keep := fn(l.key, value)
+		newKey = d.normalizeKey(newKey)
+		if keep && newKey == l.key && newValue == value {
+			continue
+		}
+		ok, err := d.migrateKey(l, metaBlock(data), newKey, newValue, keep)
+		if err != nil {
+			return changed, err
+		}
+		if ok {
+			changed++
+		}
+	}
+	return changed, nil
+}
+
+// migrateKey writes the new version of the live key l, whose record has the block
+// of metadata given, if any, and reports whether it did, which it does not if the
+// key was written since it was listed.
+func (d *DiskStore) migrateKey(l liveRecord, block string, newKey string, newValue string, keep bool) (bool, error) {
+	txn := d.Begin()
+	if !keep || newKey != l.key {
+		txn.Delete(l.key)
+	}
+	if keep {
+		w := txnWrite{key: newKey, value: newValue, expiry: l.kEntry.expiry}
+		if block != "" && newValue != "" {
+			w.value, w.flags = block+newValue, FlagMeta
+		}
+		if err := txn.put(w); err != nil {
+			return false, fmt.Errorf("caskdb: migrating %q: %w", l.key, err)
+		}
+	}
+	if err := txn.Prepare(); err != nil {
+		return false, err
+	}
+	if kEntry, ok := d.keyDir.get(l.key); !ok || kEntry.segment != l.kEntry.segment || kEntry.position != l.kEntry.position {
+		txn.Rollback()
+		return false, nil
+	}
+	if _, ok := d.keyDir.get(newKey); ok && keep && newKey != l.key {
+		txn.Rollback()
+		return false, fmt.Errorf("caskdb: migrating %q onto %q, which exists", l.key, newKey)
+	}
+	if err := txn.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,89 @@
+package caskdb
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_Migrate(t *testing.T) {
+	store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{MaxSegmentBytes: 200})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("book:othello", "shakespeare")
+	store.Set("book:dune", "herbert")
+	store.Set("draft:anathem", "stephenson")
+	store.Set("tenant42/config", "{}")
+	if err := store.PutWithMeta("book:hamlet", "shakespeare", Meta{Owner: "alice"}); err != nil {
+		t.Fatalf("PutWithMeta() error = %v", err)
+	}
+	if err := store.PutWithTTL("book:alien", "scott", time.Hour); err != nil {
+		t.Fatalf("PutWithTTL() error = %v", err)
+	}
+
+	// book:x becomes books/x with the author in capitals, the drafts go
+	migrate := func(key string, value string) (string, string, bool) {
+		switch {
+		case strings.HasPrefix(key, "book:"):
+			return "books/" + strings.TrimPrefix(key, "book:"), strings.ToUpper(value), true
+		case strings.HasPrefix(key, "books/"):
+			// migrated already
+			return key, value, true
+		case strings.HasPrefix(key, "draft:"):
+			return "", "", false
+		}
+		return key, value, true
+	}
+	n, err := store.Migrate(context.Background(), migrate)
+	if err != nil || n != 5 {
+		t.Fatalf("Migrate() = %v, %v, want 5 keys changed", n, err)
+	}
+	want := map[string]string{"books/othello": "SHAKESPEARE", "books/dune": "HERBERT", "books/hamlet": "SHAKESPEARE", "books/alien": "SCOTT", "tenant42/config": "{}"}
+	if keys := store.Keys(); len(keys) != len(want) {
+		t.Errorf("Keys() = %v, want %d keys", keys, len(want))
+	}
+	for key, value := range want {
+		if got := store.Get(key); got != value {
+			t.Errorf("Get(%q) = %q, want %q", key, got, value)
+		}
+	}
+	if meta, err := store.GetMeta("books/hamlet"); err != nil || meta.Owner != "alice" {
+		t.Errorf("GetMeta() = %+v, %v, want the metadata carried over", meta, err)
+	}
+	if ttl, err := store.TTL("books/alien"); err != nil || ttl <= 0 {
+		t.Errorf("TTL() = %v, %v, want the expiry carried over", ttl, err)
+	}
+	if stats := store.Stats(); stats.Lifetime.ReclaimedBytes == 0 {
+		t.Errorf("Lifetime.ReclaimedBytes = %v, want the old records compacted", stats.Lifetime.ReclaimedBytes)
+	}
+
+	// again, nothing changes
+	if n, err := store.Migrate(context.Background(), migrate); err != nil || n != 0 {
+		t.Errorf("Migrate() again = %v, %v, want nothing changed", n, err)
+	}
+
+	// a key moved onto another is not lost
+	_, err = store.Migrate(context.Background(), func(key string, value string) (string, string, bool) {
+		return "tenant42/config", value, true
+	})
+	if err == nil || !strings.Contains(err.Error(), "which exists") {
+		t.Errorf("Migrate() onto an existing key error = %v", err)
+	}
+	if got := store.Get("tenant42/config"); got != "{}" {
+		t.Errorf("Get() = %q, want it kept", got)
+	}
+
+	reader, err := OpenReadOnly(store.file.Name(), Options{})
+	if err != nil {
+		t.Fatalf("OpenReadOnly() error = %v", err)
+	}
+	defer reader.Close()
+	if _, err := reader.Migrate(context.Background(), migrate); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Migrate() of a reader error = %v, want %v", err, ErrReadOnly)
+	}
+}
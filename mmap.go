@@ -0,0 +1,636 @@
+package caskdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// The table of KeyDirMmap is a robin hood table, like that of KeyDirRobinHood,
+// laid out in bytes rather than Go values, so that it can be written to a file and
+// mapped back into memory as is. Every slot is mmapSlotSize bytes:
+//
+//	hash | key_offset | key_size | probe | timestamp | segment | position | total_size | expiry | hits | last_access
+//
+// hash is the FNV-1a hash of the key, which unlike maphash is the same in every
+// process, and probe is 1 more than how many slots past its home slot the key is,
+// 0 for an empty slot. The keys are kept apart from the slots, one after the other:
+// those of the snapshot the table was opened from in base, and those added since
+// in extra, after them. The bytes of a removed key are only reclaimed when the
+// snapshot is written.
+const mmapSlotSize = 56
+
+type mmapKeyDir struct {
+	slots []byte
+	base  []byte
+	extra []byte
+	count int
+}
+
+func newMmapKeyDir() *mmapKeyDir {
+	return &mmapKeyDir{slots: make([]byte, 16*mmapSlotSize)}
+}
+
+// mmapHash is the 64-bit FNV-1a hash of the key.
+func mmapHash(key string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+func (t *mmapKeyDir) slotCount() int {
+	return len(t.slots) / mmapSlotSize
+}
+
+func (t *mmapKeyDir) slot(i int) []byte {
+	return t.slots[i*mmapSlotSize : (i+1)*mmapSlotSize]
+}
+
+func slotProbe(slot []byte) uint32 {
+	return binary.LittleEndian.Uint32(slot[20:])
+}
+
+// keyOf returns the bytes of the key of the slot.
+func (t *mmapKeyDir) keyOf(slot []byte) []byte {
+	offset, size := int(binary.LittleEndian.Uint64(slot[8:])), int(binary.LittleEndian.Uint32(slot[16:]))
+	if offset < len(t.base) {
+		return t.base[offset : offset+size]
+	}
+	offset -= len(t.base)
+	return t.extra[offset : offset+size]
+}
+
+func slotEntry(slot []byte) KeyEntry {
+	le := binary.LittleEndian
+	return KeyEntry{
+		timestamp:  le.Uint32(slot[24:]),
+		segment:    le.Uint32(slot[28:]),
+		position:   le.Uint32(slot[32:]),
+		totalSize:  le.Uint32(slot[36:]),
+		expiry:     le.Uint32(slot[40:]),
+		hits:       le.Uint32(slot[44:]),
+		lastAccess: le.Uint64(slot[48:]),
+	}
+}
+
+func putSlotEntry(slot []byte, kEntry KeyEntry) {
+	le := binary.LittleEndian
+	le.PutUint32(slot[24:], kEntry.timestamp)
+	le.PutUint32(slot[28:], kEntry.segment)
+	le.PutUint32(slot[32:], kEntry.position)
+	le.PutUint32(slot[36:], kEntry.totalSize)
+	le.PutUint32(slot[40:], kEntry.expiry)
+	le.PutUint32(slot[44:], kEntry.hits)
+	le.PutUint64(slot[48:], kEntry.lastAccess)
+}
+
+// find returns the slot of the key, or -1 if it is not in the table.
+func (t *mmapKeyDir) find(key string) int {
+	mask := t.slotCount() - 1
+	hash := mmapHash(key)
+	i := int(hash & uint64(mask))
+	for probe := uint32(1); ; probe++ {
+		slot := t.slot(i)
+		// a key further from its home slot than the one we look for would have
+		// been displaced by it
+		if slotProbe(slot) < probe {
+			return -1
+		}
+		if slotProbe(slot) == probe && binary.LittleEndian.Uint64(slot) == hash && string(t.keyOf(slot)) == key {
+			return i
+		}
+		i = (i + 1) & mask
+	}
+}
+
+func (t *mmapKeyDir) get(key string) (KeyEntry, bool) {
+	if i := t.find(key); i >= 0 {
+		return slotEntry(t.slot(i)), true
+	}
+	return KeyEntry{}, false
+}
+
+func (t *mmapKeyDir) set(key string, kEntry KeyEntry) {
+	if i := t.find(key); i >= 0 {
+		putSlotEntry(t.slot(i), kEntry)
+		return
+	}
+	if float64(t.count+1) > robinHoodMaxLoad*float64(t.slotCount()) {
+		t.grow()
+	}
+	var slot [mmapSlotSize]byte
+	binary.LittleEndian.PutUint64(slot[0:], mmapHash(key))
+	binary.LittleEndian.PutUint64(slot[8:], uint64(len(t.base)+len(t.extra)))
+	binary.LittleEndian.PutUint32(slot[16:], uint32(len(key)))
+	binary.LittleEndian.PutUint32(slot[20:], 1)
+	putSlotEntry(slot[:], kEntry)
+	t.extra = append(t.extra, key...)
+	t.insert(slot)
+	t.count++
+}
+
+// insert puts a key which is not in the table in it.
+func (t *mmapKeyDir) insert(slot [mmapSlotSize]byte) {
+	mask := t.slotCount() - 1
+	i := int(binary.LittleEndian.Uint64(slot[:]) & uint64(mask))
+	for {
+		current := t.slot(i)
+		if slotProbe(current) == 0 {
+			copy(current, slot[:])
+			return
+		}
+		// the richer key, closer to its home slot, moves on
+		if slotProbe(current) < slotProbe(slot[:]) {
+			var displaced [mmapSlotSize]byte
+			copy(displaced[:], current)
+			copy(current, slot[:])
+			slot = displaced
+		}
+		i = (i + 1) & mask
+		binary.LittleEndian.PutUint32(slot[20:], slotProbe(slot[:])+1)
+	}
+}
+
+// grow doubles the slots, inserting the keys again; their bytes stay where they
+// are.
+func (t *mmapKeyDir) grow() {
+	old := t.slots
+	t.slots = make([]byte, 2*len(old))
+	for i := 0; i < len(old); i += mmapSlotSize {
+		var slot [mmapSlotSize]byte
+		copy(slot[:], old[i:i+mmapSlotSize])
+		if slotProbe(slot[:]) != 0 {
+			binary.LittleEndian.PutUint32(slot[20:], 1)
+			t.insert(slot)
+		}
+	}
+}
+
+// remove takes the key out, shifting the keys after it back by a slot until one
+// in its home slot, so that no tombstones are left.
+func (t *mmapKeyDir) remove(key string) {
+	i := t.find(key)
+	if i < 0 {
+		return
+	}
+	mask := t.slotCount() - 1
+	for {
+		next := (i + 1) & mask
+		if slotProbe(t.slot(next)) <= 1 {
+			break
+		}
+		copy(t.slot(i), t.slot(next))
+		binary.LittleEndian.PutUint32(t.slot(i)[20:], slotProbe(t.slot(i))-1)
+		i = next
+	}
+	copy(t.slot(i), make([]byte, mmapSlotSize))
+	t.count--
+}
+
+func (t *mmapKeyDir) size() int {
+	return t.count
+}
+
+// each starts at a random slot, like that of KeyDirRobinHood.
+func (t *mmapKeyDir) each(fn func(key string, kEntry KeyEntry) bool) {
+	n := t.slotCount()
+	start := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		slot := t.slot((start + i) & (n - 1))
+		if slotProbe(slot) != 0 && !fn(string(t.keyOf(slot)), slotEntry(slot)) {
+			return
+		}
+	}
+}
+
+func (t *mmapKeyDir) memory(m *KeyDirMemory) {
+	for i := 0; i < t.slotCount(); i++ {
+		if slot := t.slot(i); slotProbe(slot) != 0 {
+			m.Keys += int64(binary.LittleEndian.Uint32(slot[16:]))
+		}
+	}
+	m.Entries = int64(t.count) * keyEntrySize
+	// the bytes of the removed keys are overhead too
+	m.Overhead = int64(len(t.slots)+len(t.base)+len(t.extra)) - m.Keys - m.Entries
+}
+
+func (t *mmapKeyDir) stats(s *KeyDirStats) {
+	s.Slots = t.slotCount()
+	s.Occupancy = float64(t.count) / float64(s.Slots)
+	total := 0
+	for i := 0; i < s.Slots; i++ {
+		probe := int(slotProbe(t.slot(i)))
+		if probe == 0 {
+			continue
+		}
+		distance := probe - 1
+		if distance > 0 {
+			s.Displaced++
+		}
+		if distance > s.MaxProbe {
+			s.MaxProbe = distance
+		}
+		total += distance
+	}
+	if t.count > 0 {
+		s.MeanProbe = float64(total) / float64(t.count)
+	}
+}
+
+// writeTo writes the slots of the table and then the bytes of its keys, packed in
+// the order of the slots, keySize of them.
+func (t *mmapKeyDir) writeTo(w io.Writer) error {
+	var offset uint64
+	var slot [mmapSlotSize]byte
+	for i := 0; i < t.slotCount(); i++ {
+		copy(slot[:], t.slot(i))
+		if slotProbe(slot[:]) != 0 {
+			binary.LittleEndian.PutUint64(slot[8:], offset)
+			offset += uint64(binary.LittleEndian.Uint32(slot[16:]))
+		}
+		if _, err := w.Write(slot[:]); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < t.slotCount(); i++ {
+		if slot := t.slot(i); slotProbe(slot) != 0 {
+			if _, err := w.Write(t.keyOf(slot)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// keySize returns the total size of the keys in the table.
+func (t *mmapKeyDir) keySize() int64 {
+	var m KeyDirMemory
+	t.memory(&m)
+	return m.Keys
+}
+
+// lazyKeys is the keyOrder of KeyDirMmap: the keys are only put in order by the
+// first scan which needs them so, rather than when the store is opened, which
+// would read every key of the snapshot.
+type lazyKeys struct {
+	table keyDirTable
+	order *keyIndex
+}
+
+func (o *lazyKeys) sorted() *keyIndex {
+	if o.order == nil {
+		o.order = newKeyIndex()
+		o.table.each(func(key string, _ KeyEntry) bool {
+			o.order.insert(key)
+			return true
+		})
+	}
+	return o.order
+}
+
+func (o *lazyKeys) insert(key string) {
+	if o.order != nil {
+		o.order.insert(key)
+	}
+}
+
+func (o *lazyKeys) remove(key string) {
+	if o.order != nil {
+		o.order.remove(key)
+	}
+}
+
+func (o *lazyKeys) seek(key string) (string, bool) {
+	return o.sorted().seek(key)
+}
+
+func (o *lazyKeys) before(key string) (string, bool) {
+	return o.sorted().before(key)
+}
+
+func (o *lazyKeys) last() (string, bool) {
+	return o.sorted().last()
+}
+
+func (o *lazyKeys) ascend(start string, fn func(key string) bool) {
+	o.sorted().ascend(start, fn)
+}
+
+func (o *lazyKeys) memory() int64 {
+	if o.order == nil {
+		return 0
+	}
+	return o.order.memory()
+}
+
+// A store opened with KeyDirMmap writes its table to books.db.keydir when it is
+// closed, along with what else loading the segments would have found, e.g. the
+// sizes and ages of the segments, and the size and modification time of every
+// segment file as it was then:
+//
+//	magic | state_size | slots | keys | key_size | crc | state | slots... | keys...
+//
+// The state is JSON, and crc is the CRC32 of everything before it and of the
+// state. The next open maps the file back into memory rather than loading the
+// segments, when the segment files are still those the state lists. Any write
+// since, or a crash after one, changes the active file, so a stale snapshot is
+// discarded and the segments loaded instead; the file is written whole and
+// renamed into place, so it is never torn.
+
+// keyDirSuffix is appended to the name of the store for the snapshot of KeyDir
+const keyDirSuffix = ".keydir"
+
+// keyDirMagic starts every snapshot of KeyDir
+const keyDirMagic = "CKD1"
+
+// keyDirHeaderSize is the size of the magic, the sizes and the crc
+const keyDirHeaderSize = len(keyDirMagic) + 4 + 8 + 8 + 8 + 4
+
+// keyDirState is what loading the segments finds besides KeyDir.
+type keyDirState struct {
+	ID          string
+	Segments    []segmentState
+	BaseAt      entryState
+	MergedAt    []entryState      `json:",omitempty"`
+	Tokens      map[string]uint32 `json:",omitempty"`
+	Dicts       map[uint32][]byte `json:",omitempty"`
+	LiveBytes   int64
+	AccessClock uint64
+}
+
+// segmentState is a segment, and FileSize and ModTime those of its file, or of its
+// remote index.
+type segmentState struct {
+	ID        uint32
+	Path      string
+	Remote    bool `json:",omitempty"`
+	Size      int64
+	Compacted bool     `json:",omitempty"`
+	Marks     []uint32 `json:",omitempty"`
+	Skipped   int64    `json:",omitempty"`
+	Started   time.Time
+	Latest    time.Time
+	FileSize  int64
+	ModTime   int64
+}
+
+type entryState struct {
+	Timestamp, Segment, Position, TotalSize, Expiry uint32
+}
+
+func newEntryState(k KeyEntry) entryState {
+	return entryState{k.timestamp, k.segment, k.position, k.totalSize, k.expiry}
+}
+
+func (e entryState) keyEntry() KeyEntry {
+	return KeyEntry{timestamp: e.Timestamp, segment: e.Segment, position: e.Position, totalSize: e.TotalSize, expiry: e.Expiry}
+}
+
+// segmentFile returns the size and modification time of the file of the segment.
+func (d *DiskStore) segmentFile(seg *segment, active bool) (int64, int64, error) {
+	var info fs.FileInfo
+	var err error
+	switch {
+	case active && d.file != nil:
+		info, err = d.file.Stat()
+	case seg.remote:
+		info, err = os.Stat(seg.path + remoteIndexSuffix)
+	default:
+		info, err = os.Stat(seg.path)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return info.Size(), info.ModTime().UnixNano(), nil
+}
+
+// saveKeyDir writes the snapshot of KeyDir, for a store opened with KeyDirMmap. It
+// is done on Close, with the store locked; the store is fine without it, the next
+// open loads the segments instead.
+func (d *DiskStore) saveKeyDir() {
+	table, ok := d.keyDir.(*mmapKeyDir)
+	if !ok {
+		return
+	}
+	fileName := d.file.Name() + keyDirSuffix
+	state := keyDirState{ID: d.id, BaseAt: newEntryState(d.baseAt), Tokens: d.tokens, Dicts: d.dicts, LiveBytes: d.liveBytes, AccessClock: d.accessClock}
+	for _, kEntry := range d.mergedAt {
+		state.MergedAt = append(state.MergedAt, newEntryState(kEntry))
+	}
+	for _, seg := range d.segments {
+		s := segmentState{ID: seg.id, Path: seg.path, Remote: seg.remote, Size: seg.size, Compacted: seg.compacted, Marks: seg.marks, Skipped: seg.skipped, Started: seg.started, Latest: seg.latest}
+		if seg == d.active() {
+			s.Size = int64(d.writePosition)
+		}
+		var err error
+		if s.FileSize, s.ModTime, err = d.segmentFile(seg, seg == d.active()); err != nil {
+			d.log.Error("failed to write keydir", "file", fileName, "error", err)
+			return
+		}
+		state.Segments = append(state.Segments, s)
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		d.log.Error("failed to write keydir", "file", fileName, "error", err)
+		return
+	}
+	header := make([]byte, keyDirHeaderSize)
+	copy(header, keyDirMagic)
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(data)))
+	binary.LittleEndian.PutUint64(header[8:], uint64(table.slotCount()))
+	binary.LittleEndian.PutUint64(header[16:], uint64(table.count))
+	binary.LittleEndian.PutUint64(header[24:], uint64(table.keySize()))
+	crc := crc32.NewIEEE()
+	crc.Write(header[:32])
+	crc.Write(data)
+	binary.LittleEndian.PutUint32(header[32:], crc.Sum32())
+	r, w := io.Pipe()
+	defer r.Close()
+	go func() {
+		bw := bufio.NewWriter(w)
+		bw.Write(header)
+		bw.Write(data)
+		err := table.writeTo(bw)
+		if err == nil {
+			err = bw.Flush()
+		}
+		w.CloseWithError(err)
+	}()
+	if err := writeFileSync(fileName, r); err != nil {
+		d.log.Error("failed to write keydir", "file", fileName, "error", err)
+	}
+}
+
+// errStaleKeyDir is why a snapshot of KeyDir does not match the segments.
+var errStaleKeyDir = errors.New("segments changed")
+
+// mapKeyDir opens the store from the snapshot of KeyDir, for a store opened with
+// KeyDirMmap, reporting whether it did. A missing snapshot, or one which does not
+// match the segments, is passed over, and the segments are loaded instead, as
+// they are when Options.OnLoad is set.
+func (d *DiskStore) mapKeyDir(fileName string) bool {
+	if d.opts.KeyDirIndex != KeyDirMmap || d.onLoad != nil {
+		return false
+	}
+	name := fileName + keyDirSuffix
+	file, err := openFile(name, os.O_RDONLY, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+	if err == nil {
+		// the mapping outlives the file
+		defer file.Close()
+		err = d.adoptKeyDir(fileName, file)
+	}
+	if err != nil {
+		d.log.Warn("discarding keydir", "file", name, "error", err)
+		return false
+	}
+	return true
+}
+
+// adoptKeyDir maps the snapshot of KeyDir in file, if it matches the segments.
+func (d *DiskStore) adoptKeyDir(fileName string, file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header := make([]byte, keyDirHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil || string(header[:len(keyDirMagic)]) != keyDirMagic {
+		return errCorruptKeyDir(file)
+	}
+	le := binary.LittleEndian
+	stateSize, slots, count, keySize := int64(le.Uint32(header[4:])), int64(le.Uint64(header[8:])), int64(le.Uint64(header[16:])), int64(le.Uint64(header[24:]))
+	if slots == 0 || slots&(slots-1) != 0 || count > slots || info.Size() != int64(keyDirHeaderSize)+stateSize+slots*mmapSlotSize+keySize {
+		return errCorruptKeyDir(file)
+	}
+	data := make([]byte, stateSize)
+	if _, err := file.ReadAt(data, int64(keyDirHeaderSize)); err != nil {
+		return err
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(header[:32])
+	crc.Write(data)
+	if crc.Sum32() != le.Uint32(header[32:]) {
+		return errCorruptKeyDir(file)
+	}
+	var state keyDirState
+	if err := json.Unmarshal(data, &state); err != nil || len(state.Segments) == 0 {
+		return errCorruptKeyDir(file)
+	}
+	segments, err := d.stateSegments(fileName, state.Segments)
+	if err != nil {
+		return err
+	}
+	mapped, release, err := mapFile(file, int(info.Size()))
+	if err != nil {
+		d.closeFiles(segments)
+		return err
+	}
+	start := int64(keyDirHeaderSize) + stateSize
+	table := &mmapKeyDir{slots: mapped[start : start+slots*mmapSlotSize], base: mapped[start+slots*mmapSlotSize:], count: int(count)}
+	d.keyDir, d.keys, d.unmapKeyDir = table, &lazyKeys{table: table}, release
+	d.segments = segments
+	d.writePosition = int(state.Segments[len(state.Segments)-1].Size)
+	d.baseAt = state.BaseAt.keyEntry()
+	for _, e := range state.MergedAt {
+		d.mergedAt = append(d.mergedAt, e.keyEntry())
+	}
+	now := uint32(time.Now().Unix())
+	for token, expiry := range state.Tokens {
+		if expiry > now {
+			d.tokens[token] = expiry
+		}
+	}
+	d.dicts = state.Dicts
+	d.liveBytes, d.accessClock = state.LiveBytes, state.AccessClock
+	if d.id == "" {
+		d.id = state.ID
+	}
+	if d.quotas != nil {
+		table.each(func(key string, kEntry KeyEntry) bool {
+			d.quotas.add(key, 1, int64(kEntry.totalSize))
+			return true
+		})
+	}
+	return nil
+}
+
+// stateSegments returns the segments of the state, if the segment files are those
+// it lists. A read-only store opens the sealed ones, like loadSegment does.
+func (d *DiskStore) stateSegments(fileName string, states []segmentState) ([]*segment, error) {
+	found, err := findSegments(fileName, d.opts.ColdDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(found) != len(states)-1 {
+		return nil, errStaleKeyDir
+	}
+	var segments []*segment
+	for i, s := range states {
+		seg := &segment{id: s.ID, path: s.Path, remote: s.Remote, size: s.Size, compacted: s.Compacted, marks: s.Marks, skipped: s.Skipped, started: s.Started, latest: s.Latest}
+		active := i == len(found)
+		var err error
+		switch {
+		case active && s.Path != fileName:
+			err = errStaleKeyDir
+		case active:
+			seg.file = d.file
+		case found[i].id != s.ID || found[i].path != s.Path || found[i].remote != s.Remote:
+			err = errStaleKeyDir
+		}
+		if err == nil {
+			var size, modTime int64
+			size, modTime, err = d.segmentFile(seg, active)
+			if err == nil && (size != s.FileSize || modTime != s.ModTime) {
+				err = errStaleKeyDir
+			}
+		}
+		if err == nil && d.readOnly && !seg.remote && seg.file == nil {
+			seg.file, err = openFile(seg.path, os.O_RDONLY, 0)
+		}
+		if err != nil {
+			d.closeFiles(segments)
+			return nil, err
+		}
+		segments = append(segments, seg)
+	}
+	return segments, nil
+}
+
+// closeFiles closes the read handles of the sealed segments.
+func (d *DiskStore) closeFiles(segments []*segment) {
+	for _, seg := range segments {
+		if seg.file != nil && seg.file != d.file {
+			seg.file.Close()
+		}
+	}
+}
+
+// releaseKeyDir unmaps the snapshot KeyDir was opened from, if it was, leaving
+// KeyDir empty. The store must be locked.
+func (d *DiskStore) releaseKeyDir() {
+	if d.unmapKeyDir == nil {
+		return
+	}
+	d.keyDir, d.keys = d.newKeyDir()
+	if err := d.unmapKeyDir(); err != nil {
+		d.log.Error("failed to unmap keydir", "error", err)
+	}
+	d.unmapKeyDir = nil
+}
+
+func errCorruptKeyDir(file *os.File) error {
+	return fmt.Errorf("%w: %s", ErrCorruptRecord, file.Name())
+}
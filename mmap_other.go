@@ -0,0 +1,17 @@
+//go:build !linux && !darwin && !freebsd
+
+package caskdb
+
+import (
+	"io"
+	"os"
+)
+
+// mapFile reads the file into memory, where mapping it is not supported.
+func mapFile(file *os.File, size int) (data []byte, release func() error, err error) {
+	data = make([]byte, size)
+	if _, err := io.ReadFull(io.NewSectionReader(file, 0, int64(size)), data); err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return nil }, nil
+}
@@ -0,0 +1,164 @@
+package caskdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMmapKeyDir(t *testing.T) {
+	table := newMmapKeyDir()
+	want := make(map[string]KeyEntry)
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		table.set(key, KeyEntry{position: uint32(i), hits: 1, lastAccess: uint64(i)})
+		want[key] = KeyEntry{position: uint32(i), hits: 1, lastAccess: uint64(i)}
+		if i%3 == 0 {
+			table.remove(fmt.Sprintf("key-%d", i/2))
+			delete(want, fmt.Sprintf("key-%d", i/2))
+		}
+	}
+	table.set("key-9", KeyEntry{position: 9000})
+	want["key-9"] = KeyEntry{position: 9000}
+	if table.size() != len(want) {
+		t.Errorf("size() = %d, want %d", table.size(), len(want))
+	}
+	for key, kEntry := range want {
+		if got, ok := table.get(key); !ok || got != kEntry {
+			t.Errorf("get(%q) = %v, %v, want %v", key, got, ok, kEntry)
+		}
+	}
+	seen := 0
+	table.each(func(key string, kEntry KeyEntry) bool {
+		if want[key] != kEntry {
+			t.Errorf("each() gave %q = %v, want %v", key, kEntry, want[key])
+		}
+		seen++
+		return true
+	})
+	if seen != len(want) {
+		t.Errorf("each() gave %d keys, want %d", seen, len(want))
+	}
+	if _, ok := table.get("key-0"); ok {
+		t.Errorf("get() of a removed key found it")
+	}
+}
+
+func TestDiskStore_KeyDirMmap(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{KeyDirIndex: KeyDirMmap, MaxSegmentBytes: 200}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	want := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		key, value := fmt.Sprintf("key-%02d", i%30), fmt.Sprintf("value-%d", i)
+		store.Set(key, value)
+		want[key] = value
+	}
+	store.Delete("key-07")
+	delete(want, "key-07")
+	store.Close()
+
+	check := func(store *DiskStore) {
+		t.Helper()
+		for key, value := range want {
+			if got := store.Get(key); got != value {
+				t.Errorf("Get(%q) = %q, want %q", key, got, value)
+			}
+		}
+		if got := store.Keys(); len(got) != len(want) {
+			t.Errorf("Keys() = %v, want %d keys", got, len(want))
+		}
+	}
+	open := func(logger *recordLogger) *DiskStore {
+		t.Helper()
+		opts.Logger = logger
+		store, err := NewDiskStoreWithOptions(fileName, opts)
+		if err != nil {
+			t.Fatalf("failed to reopen disk store: %v", err)
+		}
+		return store
+	}
+	// the store is opened from the snapshot written on Close
+	store = open(&recordLogger{})
+	if _, ok := store.keyDir.(*mmapKeyDir); !ok || store.unmapKeyDir == nil {
+		t.Errorf("keyDir = %T, want the mapped snapshot", store.keyDir)
+	}
+	check(store)
+	if stats := store.KeyDirStats(); stats.Index != KeyDirMmap || stats.Keys != len(want) {
+		t.Errorf("KeyDirStats() = %+v, want %d keys of %v", stats, len(want), KeyDirMmap)
+	}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("new-%d", i)
+		store.Set(key, "value")
+		want[key] = "value"
+	}
+	store.Delete("key-08")
+	delete(want, "key-08")
+	check(store)
+
+	reader, err := OpenReadOnly(fileName, Options{KeyDirIndex: KeyDirMmap})
+	if err != nil {
+		t.Fatalf("OpenReadOnly() error = %v", err)
+	}
+	// the writer changed the active file since the snapshot
+	if reader.unmapKeyDir != nil {
+		t.Errorf("OpenReadOnly() mapped a stale snapshot")
+	}
+	check(reader)
+	reader.Close()
+	store.Close()
+
+	reader, err = OpenReadOnly(fileName, Options{KeyDirIndex: KeyDirMmap})
+	if err != nil {
+		t.Fatalf("OpenReadOnly() error = %v", err)
+	}
+	if reader.unmapKeyDir == nil {
+		t.Errorf("OpenReadOnly() did not map the snapshot")
+	}
+	check(reader)
+	reader.Close()
+
+	// a write made without the snapshot makes it stale
+	other, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	other.Set("other", "value")
+	want["other"] = "value"
+	other.Close()
+	logger := &recordLogger{}
+	store = open(logger)
+	if store.unmapKeyDir != nil || !logger.has("discarding keydir") {
+		t.Errorf("logged %v, want the stale snapshot discarded", logger.messages)
+	}
+	check(store)
+	store.Close()
+
+	// so does a corrupt one
+	data, err := os.ReadFile(fileName + keyDirSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[keyDirHeaderSize] ^= 0xff
+	if err := os.WriteFile(fileName+keyDirSuffix, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	logger = &recordLogger{}
+	store = open(logger)
+	if store.unmapKeyDir != nil || !logger.has("discarding keydir") {
+		t.Errorf("logged %v, want the corrupt snapshot discarded", logger.messages)
+	}
+	check(store)
+	store.Close()
+}
+
+func TestDiskStore_KeyDirMmap_Dedup(t *testing.T) {
+	_, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{KeyDirIndex: KeyDirMmap, Dedup: true})
+	if err == nil {
+		t.Errorf("NewDiskStoreWithOptions() error = nil, want one for %v with Dedup", KeyDirMmap)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build linux || darwin || freebsd
+
+package caskdb
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps the file privately: the pages are shared with every other process
+// mapping it until written to, when they are copied. release unmaps it.
+func mapFile(file *os.File, size int) (data []byte, release func() error, err error) {
+	if size == 0 {
+		return nil, func() error { return nil }, nil
+	}
+	data, err = syscall.Mmap(int(file.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
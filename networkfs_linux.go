@@ -0,0 +1,24 @@
+package caskdb
+
+import "syscall"
+
+// networkFSMagic are the statfs types of the network filesystems: NFS, SMB,
+// CIFS, SMB2, Ceph, AFS and 9P
+var networkFSMagic = map[uint32]bool{
+	0x6969:     true,
+	0x517b:     true,
+	0xff534d42: true,
+	0xfe534d42: true,
+	0x00c36400: true,
+	0x5346414f: true,
+	0x01021997: true,
+}
+
+// isNetworkFS reports whether dir is on a network filesystem.
+func isNetworkFS(dir string) bool {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return false
+	}
+	return networkFSMagic[uint32(st.Type)]
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package caskdb
+
+// isNetworkFS reports whether dir is on a network filesystem. It is only known on
+// Linux; elsewhere, set Options.NetworkFS.
+func isNetworkFS(dir string) bool {
+	return false
+}
@@ -0,0 +1,635 @@
+package caskdb
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultOfflineMemoryBytes is the memory CompactOffline sorts the index of the log
+// in when OfflineOptions.MemoryBytes is not set.
+const DefaultOfflineMemoryBytes = 64 << 20
+
+// offlineEntryOverhead is roughly what an entry takes in memory besides its key
+const offlineEntryOverhead = 64
+
+// OfflineOptions tunes CompactOffline.
+type OfflineOptions struct {
+	// MemoryBytes bounds the memory taken by the entries of the index sorted at a
+	// time; the rest wait in sorted runs on the disk. When zero,
+	// DefaultOfflineMemoryBytes is used.
+	MemoryBytes int64
+	// TempDir is where the sorted runs are written, next to the store when empty.
+	TempDir string
+	// TombstoneRetention is how long the tombstones are kept, as with
+	// Options.TombstoneRetention. When zero, DefaultTombstoneRetention is used.
+	TombstoneRetention time.Duration
+}
+
+// CompactOffline compacts the sealed segments of the store at fileName, which must
+// not be open, into a single segment, and returns the number of bytes it freed. It
+// fails with ErrLocked while a writer has the store open.
+// Unlike Compact, it never holds the keys of the store in memory, which suits
+// large stores on machines with little of it: the index of the log is sorted by
+// key in runs of OfflineOptions.MemoryBytes on the disk, and the runs are merged
+// to find the newest record of every key.
+//
+// The compacted segment takes the place of the last sealed segment, and starts
+// with a record of Compact, so that the store loads it and the offsets of the log
+// carry on the same way. The dictionaries of the log are all copied to it. The
+// active file is left as it is. The store must not be offloaded to cold storage,
+// and an interrupted Compact must be finished first, by opening the store and
+// calling Compact again. When ctx is done, CompactOffline stops and changes
+// nothing.
+func CompactOffline(ctx context.Context, fileName string, opts OfflineOptions) (int64, error) {
+	if opts.MemoryBytes <= 0 {
+		opts.MemoryBytes = DefaultOfflineMemoryBytes
+	}
+	if opts.TempDir == "" {
+		opts.TempDir = filepath.Dir(fileName)
+	}
+	if opts.TombstoneRetention <= 0 {
+		opts.TombstoneRetention = DefaultTombstoneRetention
+	}
+	lock, err := lockStore(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Close()
+	if _, err := os.Stat(fileName + compactStateSuffix); err == nil {
+		return 0, fmt.Errorf("caskdb: %s: finish the interrupted compaction first", fileName)
+	}
+	segments, err := findSegments(fileName, "")
+	if err != nil {
+		return 0, err
+	}
+	for _, seg := range segments {
+		if seg.remote {
+			return 0, fmt.Errorf("caskdb: %s is in cold storage", seg.path)
+		}
+	}
+	if len(segments) == 0 {
+		return 0, nil
+	}
+	c := &offlineCompaction{opts: opts, now: time.Now()}
+	defer c.close()
+	if err := c.open(fileName, segments); err != nil {
+		return 0, err
+	}
+	if err := c.index(ctx); err != nil {
+		return 0, err
+	}
+	return c.write(ctx, fileName)
+}
+
+// offlineCompaction is the state of CompactOffline.
+type offlineCompaction struct {
+	opts OfflineOptions
+	now  time.Time
+	// segments are those read, oldest first, the active file last; the sealed
+	// ones before the last record emptying the store are left out, in dropped
+	segments []*segment
+	dropped  []*segment
+	// end is the offset in the log the sealed segments end at, and size their size
+	end  int64
+	size int64
+	// reset is the number of the last record emptying the store, the records
+	// before it being dead
+	reset uint64
+	// dicts are the records of the dictionaries of the log
+	dicts [][]byte
+	// batch holds the entries not sorted yet, batchBytes their size, and runs the
+	// files of the sorted runs
+	batch      []offlineEntry
+	batchBytes int64
+	runs       []*os.File
+}
+
+// offlineEntry is the index entry of a record of the log.
+type offlineEntry struct {
+	key string
+	// seq numbers the records in the order of the log
+	seq       uint64
+	segment   int
+	position  int64
+	size      uint32
+	timestamp uint32
+	expiry    uint32
+	tombstone bool
+	// ref is the id of the blob a record flagged FlagDedup references
+	ref string
+}
+
+// open opens the segments and the active file, and works out the offset of the
+// log they start at, and which segments an earlier Compact or DeleteAll left
+// behind.
+func (c *offlineCompaction) open(fileName string, sealed []*segment) error {
+	active := &segment{id: sealed[len(sealed)-1].id + 1, path: fileName}
+	all := append(sealed, active)
+	for _, seg := range all {
+		file, err := openFile(seg.path, os.O_RDONLY, 0)
+		if errors.Is(err, fs.ErrNotExist) && seg == active {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		seg.file = file
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		seg.size = info.Size()
+	}
+	// the last segment starting with the record of DeleteAll or of a Compact from
+	// the oldest segment holds everything the store kept from before it
+	first := 0
+	var base int64
+	for i, seg := range sealed {
+		key, value, position, err := firstRecord(seg)
+		if err != nil {
+			return err
+		}
+		if key == truncateKey || key == compactKey {
+			offset, _, _ := strings.Cut(value, " ")
+			if base, err = strconv.ParseInt(offset, 10, 64); err != nil {
+				return fmt.Errorf("%w: invalid truncation record in %s", ErrCorruptRecord, seg.path)
+			}
+			base -= position
+			first = i
+		}
+	}
+	c.dropped = sealed[:first]
+	sealed = sealed[first:]
+	// a Compact from a later segment replaced the segments from the first one it
+	// compacted, which may have been left behind
+	c.end = base
+	for _, seg := range sealed {
+		key, value, _, err := firstRecord(seg)
+		if err != nil {
+			return err
+		}
+		if key == compactRangeKey {
+			offset, from, err := parseCompactMarker(value)
+			if err != nil {
+				return fmt.Errorf("%w: invalid compaction record in %s", ErrCorruptRecord, seg.path)
+			}
+			kept := c.segments[:0]
+			for _, prev := range c.segments {
+				if prev.id >= from {
+					c.dropped = append(c.dropped, prev)
+					c.end -= prev.size
+					c.size -= prev.size
+					continue
+				}
+				kept = append(kept, prev)
+			}
+			c.segments = kept
+			if offset > c.end {
+				c.end = offset
+			}
+		}
+		c.segments = append(c.segments, seg)
+		c.end += seg.size
+		c.size += seg.size
+	}
+	c.segments = append(c.segments, active)
+	return nil
+}
+
+// firstRecord returns the key and the value of the first record of the segment
+// after its format record, along with its position, if it is one of those Compact
+// and DeleteAll start a segment with, or else an empty key.
+func firstRecord(seg *segment) (string, string, int64, error) {
+	var position int64
+	for {
+		header := make([]byte, headerSize)
+		if _, err := seg.file.ReadAt(header, position); err == io.EOF {
+			return "", "", 0, nil
+		} else if err != nil {
+			return "", "", 0, err
+		}
+		_, keySize, valueSize := decodeHeader(header)
+		size := int64(headerSize) + int64(keySize) + int64(valueSize)
+		if size > compactMarkerSize || position+size > seg.size {
+			// too large for one of them
+			return "", "", 0, nil
+		}
+		data := make([]byte, size)
+		if _, err := seg.file.ReadAt(data, position); err != nil {
+			return "", "", 0, err
+		}
+		if !verifyKV(data) {
+			return "", "", 0, nil
+		}
+		_, key, value := decodeKV(data)
+		if position > 0 || !isFormatKey(key) {
+			return key, value, position, nil
+		}
+		position = size
+	}
+}
+
+// index reads the records of the segments into sorted runs of index entries.
+func (c *offlineCompaction) index(ctx context.Context) error {
+	var seq uint64
+	for i, seg := range c.segments {
+		if seg.file == nil {
+			continue
+		}
+		r := bufio.NewReaderSize(io.NewSectionReader(seg.file, 0, seg.size), compactionChunkBytes)
+		var pending []offlineEntry
+		err := scanRecords(r, seg.size, func(offset int, data []byte) error {
+			if !verifyKV(data) {
+				return fmt.Errorf("%w: %s offset %d", ErrCorruptRecord, seg.path, offset)
+			}
+			if flags := decodeFlags(data); flags&^supportedFlags != 0 {
+				return fmt.Errorf("%w: %s offset %d is %v", ErrUnsupportedRecord, seg.path, offset, flags)
+			}
+			seq++
+			timestamp, key, value := decodeKV(data)
+			switch {
+			case key == truncateKey || key == compactKey:
+				c.reset = seq
+				return nil
+			case key == compactRangeKey || isFormatKey(key):
+				return nil
+			case key == intentKey:
+				// the records of a commit count once it ended, like on load
+				pending = []offlineEntry{}
+				return nil
+			case key == intentEndKey:
+				if value == intentAbort {
+					pending = nil
+				}
+				for _, entry := range pending {
+					if err := c.add(ctx, entry); err != nil {
+						return err
+					}
+				}
+				pending = nil
+				return nil
+			case isDictKey(key):
+				c.dicts = append(c.dicts, data)
+				return nil
+			}
+			entry := offlineEntry{
+				key:       key,
+				seq:       seq,
+				segment:   i,
+				position:  int64(offset),
+				size:      uint32(len(data)),
+				timestamp: timestamp,
+				expiry:    decodeExpiry(data),
+				tombstone: value == "",
+			}
+			if decodeFlags(data)&FlagDedup != 0 {
+				entry.ref = value
+			}
+			if pending != nil {
+				pending = append(pending, entry)
+				return nil
+			}
+			return c.add(ctx, entry)
+		})
+		if errors.Is(err, errPartialRecord) && i == len(c.segments)-1 {
+			// cut off the next time the store is opened
+			err = nil
+		}
+		if errors.Is(err, errPartialRecord) {
+			return fmt.Errorf("%w: %s ends in a partial record", ErrCorruptRecord, seg.path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return c.flush()
+}
+
+// add adds the entry to the batch, and sorts the batch into a run once it takes
+// OfflineOptions.MemoryBytes.
+func (c *offlineCompaction) add(ctx context.Context, entry offlineEntry) error {
+	c.batch = append(c.batch, entry)
+	c.batchBytes += int64(len(entry.key)+len(entry.ref)) + offlineEntryOverhead
+	if c.batchBytes < c.opts.MemoryBytes {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.flush()
+}
+
+// flush writes the batch, sorted by key and then in the order of the log, to a
+// run.
+func (c *offlineCompaction) flush() error {
+	if len(c.batch) == 0 {
+		return nil
+	}
+	sort.Slice(c.batch, func(i, j int) bool {
+		a, b := c.batch[i], c.batch[j]
+		if a.key != b.key {
+			return a.key < b.key
+		}
+		return a.seq < b.seq
+	})
+	run, err := os.CreateTemp(c.opts.TempDir, "caskdb-run")
+	if err != nil {
+		return err
+	}
+	c.runs = append(c.runs, run)
+	w := bufio.NewWriter(run)
+	var buf []byte
+	for _, entry := range c.batch {
+		buf = entry.append(buf[:0])
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if _, err := run.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	c.batch, c.batchBytes = c.batch[:0], 0
+	return nil
+}
+
+// append appends the encoding of the entry to buf.
+func (e offlineEntry) append(buf []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(e.key)))
+	buf = append(buf, e.key...)
+	for _, n := range []uint64{e.seq, uint64(e.segment), uint64(e.position), uint64(e.size), uint64(e.timestamp), uint64(e.expiry)} {
+		buf = binary.AppendUvarint(buf, n)
+	}
+	if e.tombstone {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(e.ref)))
+	return append(buf, e.ref...)
+}
+
+// readOfflineEntry reads back an entry encoded with append.
+func readOfflineEntry(r *bufio.Reader) (offlineEntry, error) {
+	var e offlineEntry
+	readString := func() (string, error) {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return "", err
+		}
+		buf := make([]byte, n)
+		_, err = io.ReadFull(r, buf)
+		return string(buf), err
+	}
+	var err error
+	if e.key, err = readString(); err != nil {
+		return e, err
+	}
+	var fields [6]uint64
+	for i := range fields {
+		if fields[i], err = binary.ReadUvarint(r); err != nil {
+			return e, err
+		}
+	}
+	e.seq, e.segment, e.position, e.size = fields[0], int(fields[1]), int64(fields[2]), uint32(fields[3])
+	e.timestamp, e.expiry = uint32(fields[4]), uint32(fields[5])
+	tombstone, err := r.ReadByte()
+	if err != nil {
+		return e, err
+	}
+	e.tombstone = tombstone == 1
+	e.ref, err = readString()
+	return e, err
+}
+
+// runHeap merges the runs: it holds the next entry of each, smallest first.
+type runHeap struct {
+	entries []offlineEntry
+	readers []*bufio.Reader
+}
+
+func (h *runHeap) Len() int { return len(h.entries) }
+func (h *runHeap) Less(i, j int) bool {
+	a, b := h.entries[i], h.entries[j]
+	if a.key != b.key {
+		return a.key < b.key
+	}
+	return a.seq < b.seq
+}
+func (h *runHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	h.readers[i], h.readers[j] = h.readers[j], h.readers[i]
+}
+func (h *runHeap) Push(x any) {}
+func (h *runHeap) Pop() any {
+	n := len(h.entries) - 1
+	h.entries, h.readers = h.entries[:n], h.readers[:n]
+	return nil
+}
+
+// next returns the next entry of the merged runs, or io.EOF once they are all
+// read.
+func (h *runHeap) next() (offlineEntry, error) {
+	if len(h.entries) == 0 {
+		return offlineEntry{}, io.EOF
+	}
+	entry := h.entries[0]
+	following, err := readOfflineEntry(h.readers[0])
+	switch {
+	case err == io.EOF:
+		heap.Remove(h, 0)
+	case err != nil:
+		return offlineEntry{}, err
+	default:
+		h.entries[0] = following
+		heap.Fix(h, 0)
+	}
+	return entry, nil
+}
+
+// write merges the runs, and writes the newest record of every key which is still
+// needed to the compacted segment, which then takes the place of the sealed ones.
+func (c *offlineCompaction) write(ctx context.Context, fileName string) (int64, error) {
+	h := &runHeap{}
+	for _, run := range c.runs {
+		r := bufio.NewReader(run)
+		entry, err := readOfflineEntry(r)
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		h.entries, h.readers = append(h.entries, entry), append(h.readers, r)
+	}
+	heap.Init(h)
+	sealed := c.segments[:len(c.segments)-1]
+	if len(sealed) == 0 {
+		return 0, nil
+	}
+	last := sealed[len(sealed)-1]
+	out, err := os.CreateTemp(filepath.Dir(last.path), filepath.Base(last.path)+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	w := bufio.NewWriter(out)
+	// the marker is filled in once the size of the segment is known
+	_, marker := encodeRecord(uint32(c.now.Unix()), 0, compactKey, fmt.Sprintf("%020d %010d", 0, sealed[0].id))
+	written := int64(len(marker))
+	if _, err := w.Write(marker); err != nil {
+		return 0, err
+	}
+	copyRecord := func(e offlineEntry) error {
+		data := make([]byte, e.size)
+		if _, err := c.segments[e.segment].file.ReadAt(data, e.position); err != nil {
+			return err
+		}
+		written += int64(len(data))
+		_, err := w.Write(data)
+		return err
+	}
+	for _, data := range c.dicts {
+		written += int64(len(data))
+		if _, err := w.Write(data); err != nil {
+			return 0, err
+		}
+	}
+	// the blobs come after the keys referencing them, which may sort either way
+	blobs := make(map[string]offlineEntry)
+	referenced := make(map[string]bool)
+	var newest offlineEntry
+	for n := 0; ; n++ {
+		entry, err := h.next()
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if n > 0 && (err == io.EOF || entry.key != newest.key) {
+			if err := c.keep(newest, blobs, referenced, copyRecord); err != nil {
+				return 0, err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		newest = entry
+		if n%4096 == 0 {
+			if err := ctx.Err(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	ids := make([]string, 0, len(referenced))
+	for id := range referenced {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if b, ok := blobs[id]; ok {
+			if err := copyRecord(b); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if written >= c.size {
+		// nothing to gain
+		return 0, nil
+	}
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	// the compacted records end where the segments they come from did
+	_, marker = encodeRecord(uint32(c.now.Unix()), 0, compactKey, fmt.Sprintf("%020d %010d", c.end-written, sealed[0].id))
+	if _, err := out.WriteAt(marker, 0); err != nil {
+		return 0, err
+	}
+	if err := out.Sync(); err != nil {
+		return 0, err
+	}
+	if err := out.Close(); err != nil {
+		return 0, err
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if err := renameFile(out.Name(), last.path); err != nil {
+		return 0, err
+	}
+	// a store opened before they are all gone drops them anyway, as they come
+	// before the record of the compaction
+	freed := c.size - written
+	for _, seg := range c.dropped {
+		freed += seg.size
+	}
+	for _, seg := range append(c.dropped, sealed[:len(sealed)-1]...) {
+		for _, name := range []string{seg.path, seg.path + hintSuffix} {
+			if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return freed, err
+			}
+		}
+	}
+	return freed, nil
+}
+
+// keep copies the newest record of a key if it is still needed, or notes where
+// the record of a blob is, until it is known whether a key references it.
+func (c *offlineCompaction) keep(e offlineEntry, blobs map[string]offlineEntry, referenced map[string]bool, copyRecord func(offlineEntry) error) error {
+	if e.seq < c.reset {
+		// emptied by DeleteAll, or written again by Compact after it
+		return nil
+	}
+	if e.ref != "" && !e.tombstone {
+		referenced[e.ref] = true
+	}
+	if e.segment == len(c.segments)-1 {
+		// in the active file, which stays
+		return nil
+	}
+	expired := e.expiry != 0 && c.now.Unix() >= int64(e.expiry)
+	switch {
+	case isBlobKey(e.key):
+		blobs[strings.TrimPrefix(e.key, blobKeyPrefix)] = e
+		return nil
+	case isTokenKey(e.key), !e.tombstone:
+		if expired {
+			return nil
+		}
+	case c.now.Sub(time.Unix(int64(e.timestamp), 0)) >= c.opts.TombstoneRetention:
+		// a tombstone readers of the change feed had time to see
+		return nil
+	}
+	return copyRecord(e)
+}
+
+// close closes the segments, and deletes the runs.
+func (c *offlineCompaction) close() {
+	for _, seg := range c.segments {
+		if seg.file != nil {
+			seg.file.Close()
+		}
+	}
+	for _, seg := range c.dropped {
+		if seg.file != nil {
+			seg.file.Close()
+		}
+	}
+	for _, run := range c.runs {
+		run.Close()
+		os.Remove(run.Name())
+	}
+}
@@ -0,0 +1,110 @@
+package caskdb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompactOffline(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "test.db")
+	opts := Options{MaxSegmentBytes: 512, Dedup: true}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	want := make(map[string]string)
+	blob := strings.Repeat("shakespeare", 20)
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 20; i++ {
+			key, value := fmt.Sprintf("book%02d", i), fmt.Sprintf("edition %d", round)
+			if i%5 == 0 {
+				value = blob
+			}
+			store.Set(key, value)
+			want[key] = value
+		}
+	}
+	for i := 0; i < 20; i += 3 {
+		key := fmt.Sprintf("book%02d", i)
+		store.Delete(key)
+		delete(want, key)
+	}
+	size := store.logSize()
+	segments := len(store.segments)
+	store.Close()
+
+	// a run every few records
+	runs := t.TempDir()
+	freed, err := CompactOffline(context.Background(), fileName, OfflineOptions{MemoryBytes: 512, TempDir: runs})
+	if err != nil {
+		t.Fatalf("CompactOffline() error = %v", err)
+	}
+	if freed <= 0 {
+		t.Errorf("CompactOffline() = %v, want bytes freed", freed)
+	}
+	if left, _ := os.ReadDir(runs); len(left) != 0 {
+		t.Errorf("runs left behind: %v", left)
+	}
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	if len(store.segments) != 2 {
+		t.Errorf("segments = %v, want the %v segments compacted into one and the active file", len(store.segments), segments)
+	}
+	if got := store.logSize(); got != size {
+		t.Errorf("logSize() = %v, want %v as before", got, size)
+	}
+	if got := len(store.Keys()); got != len(want) {
+		t.Errorf("Keys() = %v keys, want %v", got, len(want))
+	}
+	for key, value := range want {
+		if got := store.Get(key); got != value {
+			t.Errorf("Get(%q) = %v, want %v", key, got, value)
+		}
+	}
+}
+
+func TestCompactOffline_DeleteAll(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{MaxSegmentBytes: 256}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		store.Set(fmt.Sprintf("book%02d", i), "shakespeare")
+	}
+	store.DeleteAll()
+	for i := 0; i < 20; i++ {
+		store.Set(fmt.Sprintf("book%02d", i%4), fmt.Sprint(i))
+	}
+	size := store.logSize()
+	store.Close()
+
+	if _, err := CompactOffline(context.Background(), fileName, OfflineOptions{}); err != nil {
+		t.Fatalf("CompactOffline() error = %v", err)
+	}
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	if got := store.logSize(); got != size {
+		t.Errorf("logSize() = %v, want %v as before", got, size)
+	}
+	if got := len(store.Keys()); got != 4 {
+		t.Errorf("Keys() = %v keys, want 4", got)
+	}
+	for i := 16; i < 20; i++ {
+		if got, want := store.Get(fmt.Sprintf("book%02d", i%4)), fmt.Sprint(i); got != want {
+			t.Errorf("Get() = %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package caskdb
+
+import "time"
+
+// Options lets the caller tune the behaviour of a DiskStore. The zero value is
+// ready to use and gives the same behaviour as NewDiskStore.
+type Options struct {
+	// ParanoidReads makes every Get re-verify the checksum of the record it reads
+	// from the disk. Records are always verified when the store is loaded at
+	// startup, but a long-lived file can still rot underneath us afterwards. With
+	// this enabled, such a record is reported as ErrCorruptRecord instead of its
+	// bytes being served to the caller.
+	ParanoidReads bool
+	// Logger receives the store's structured events. Pass a *slog.Logger, or
+	// anything else implementing Logger. When nil, the store logs nothing.
+	Logger Logger
+	// Tracer starts a span for each Get, Set, Delete and Compact. When nil, nothing
+	// is traced.
+	Tracer Tracer
+	// OnSet and OnDelete are called after a write or a delete has been persisted
+	// to the disk. They are useful for metrics, cache invalidation or replicating
+	// the writes elsewhere. They are called synchronously with the store locked,
+	// so keep them quick and do not call back into the store from them.
+	OnSet    func(key string, value string)
+	OnDelete func(key string)
+	// OnCompaction is called at the end of every Compact which ran, with the bytes
+	// it freed and the error it returns, if any. It is called without holding the
+	// store.
+	OnCompaction func(freed int64, err error)
+	// SyncInterval leaves the writes of Set, Put and Delete unsynced, and syncs the
+	// active file every SyncInterval instead, as well as when a segment is sealed
+	// and when the store is closed: writes get faster, at the cost of those made
+	// since the last sync on a crash of the machine. A Txn, and the writes made
+	// before it, are still synced as they are committed. OnSet and OnDelete are
+	// called before the write is synced then. Zero syncs every write.
+	//
+	// SyncJitter adds a random delay of up to SyncJitter to every interval, so
+	// that the stores of a process opened together do not all fsync at once.
+	SyncInterval time.Duration
+	SyncJitter   time.Duration
+	// OnLoad is called with every record of a key as the store is opened, oldest
+	// first, and OnOpen with the store once it is opened, before it is returned, or
+	// once it is loaded for LoadInBackground. They let the caller check the
+	// invariants of its data, or build indexes of its own, as the store loads. An
+	// error from either fails the opening; with LoadInBackground, an error from
+	// OnOpen fails the load instead, as with Healthy. OnLoad sees each write of a
+	// key in turn, not only the last one, and no values, which are not read at
+	// startup. It makes KeyDirMmap load the segments rather than the snapshot of
+	// KeyDir. OpenReadOnly calls neither.
+	OnLoad func(r LoadedRecord) error
+	OnOpen func(d *DiskStore) error
+	// SlowOpThreshold makes the store log every read, write, fsync and compaction
+	// which takes longer than it, along with the key, size and segment involved,
+	// check SlowOp. Zero disables it.
+	SlowOpThreshold time.Duration
+	// OnSlowOp is called for every slow operation, in addition to the log, when
+	// SlowOpThreshold is set. Like OnSet, it may be called with the store locked.
+	OnSlowOp func(op SlowOp)
+	// MinFreeDiskBytes makes Healthy fail when the disk holding the store has less
+	// free space than it. Zero disables the check.
+	MinFreeDiskBytes uint64
+	// MaxSegmentBytes is the size past which the data file is sealed and a new one
+	// started. Sealed segments are what Offload moves to cold storage. Zero keeps
+	// the store in a single file.
+	MaxSegmentBytes int64
+	// SegmentPeriod seals the data file when a write comes in a later period than
+	// its first record, e.g. every hour or every day, so that each segment holds
+	// the records of a single period. Periods are aligned on the zero time, a day
+	// starting at midnight UTC. It can be combined with MaxSegmentBytes. Zero
+	// rotates by size only.
+	SegmentPeriod time.Duration
+	// Retention drops the records once they are older than it, for time series
+	// and logs: their keys expire Retention after they were written, as with
+	// PutWithTTL, and the sealed segments whose newest record is that old are
+	// deleted whole when a segment is sealed and when the store is opened. Combine
+	// it with SegmentPeriod for the segments to age a period at a time. Zero keeps
+	// the records until they are deleted.
+	Retention time.Duration
+	// Compression compresses the values of the new records with a codec, check
+	// Compression, at CompressionLevel, 0 being the default level of the codec.
+	// Every record keeps the codec it was written with, so both can be changed
+	// from one opening of the store to the next. A value which would not shrink is
+	// stored as is. CompressionNone, the zero value, compresses nothing.
+	Compression      Compression
+	CompressionLevel int
+	// CompactionDictionary makes Compact train a dictionary on the values of the
+	// segments it compacts, and compress the values it copies with DEFLATE primed
+	// with it, at CompressionLevel. It pays off for many small values which look
+	// alike, e.g. JSON documents with the same fields.
+	CompactionDictionary bool
+	// Dedup stores the values written under several keys once, for workloads
+	// storing the same payloads over and over. The values of at least
+	// dedupMinValue bytes are stored in blobs named by their SHA-256, which the
+	// records of the keys reference; Compact drops a blob once no record
+	// references it.
+	Dedup bool
+	// EncryptionKeys encrypt the values of the new records with AES-GCM under the
+	// first key; the others only decrypt the records written under them, until
+	// RotateKey re-encrypts those. Opening a store holding records encrypted under
+	// a key which is not listed fails with ErrUnsupportedRecord. The keys, the
+	// timestamps and the expiries of the records are not encrypted, and neither are
+	// the ids of the blobs of Dedup; CompactionDictionary is ignored, as the
+	// dictionaries are made of values.
+	EncryptionKeys []EncryptionKey
+	// ColdDir is a directory, typically on a slower and cheaper volume than the
+	// active file, where the sealed segments are moved in the background. They are
+	// read from there, and looked for there when the store is opened. Empty keeps
+	// them next to the active file.
+	ColdDir string
+	// ColdStorage is where Offload moves the sealed segments. It is required to
+	// open a store some of whose segments were offloaded.
+	ColdStorage ColdStorage
+	// ColdPrefix is prepended to the names of the objects in ColdStorage, e.g.
+	// "books/"
+	ColdPrefix string
+	// ColdCacheBytes bounds the memory used to cache the records read from
+	// ColdStorage, and the values decoded from them, which a Get hitting the cache
+	// returns without allocating. Zero disables the cache.
+	ColdCacheBytes int64
+	// IdempotencyWindow is how long the idempotency tokens of the writes are
+	// remembered, i.e. how late a retry can arrive and still be recognised. When
+	// zero, DefaultIdempotencyWindow is used.
+	IdempotencyWindow time.Duration
+	// MaxBytes caps the size of the log, as reported in Stats.Bytes: a write which
+	// would take it past the cap fails with ErrStoreFull. Deletes are still
+	// accepted, but do not shrink the log; DeleteAll and Compact do. Zero disables
+	// the cap.
+	MaxBytes int64
+	// MaxKeys caps the number of keys: a write adding a key past it fails with
+	// ErrStoreFull, while writes to the existing keys are still accepted. Zero
+	// disables the cap.
+	MaxKeys int
+	// PrefixQuotas caps the keys under prefixes, e.g. those of each tenant of a
+	// store hosting several, independently of one another: a write taking the keys
+	// of a prefix past its quota fails with ErrStoreFull. A key counts towards the
+	// quota of the longest prefix of it with one. Stats.Prefixes reports the usage
+	// of each prefix.
+	PrefixQuotas []PrefixQuota
+	// Eviction turns the store into a persistent cache: rather than failing the
+	// writes past MaxKeys or CacheBytes, it deletes keys to make room for them,
+	// picked by the policy. MaxBytes is still enforced with ErrStoreFull.
+	Eviction EvictionPolicy
+	// CacheBytes caps the total size of the records of the live keys, headers
+	// included, when Eviction is set. Zero leaves only MaxKeys.
+	CacheBytes int64
+	// WriteOpsPerSecond and WriteBytesPerSecond limit the rate of the writes and
+	// deletes, allowing bursts of up to a second's worth, so that a bulk job cannot
+	// take all the disk bandwidth from the readers. A write over the limit waits,
+	// without holding the store, until its turn or until its context is done. Zero
+	// disables the limit.
+	WriteOpsPerSecond   float64
+	WriteBytesPerSecond int64
+	// TombstoneRetention is how long Compact keeps the tombstones of the deleted
+	// keys, i.e. how far behind a reader of the change feed can fall and still see
+	// every delete. When zero, DefaultTombstoneRetention is used.
+	TombstoneRetention time.Duration
+	// NormalizeKey maps the keys to the form they are stored under, e.g.
+	// strings.ToLower for case-insensitive keys, so that the keys it maps to the
+	// same one are the same key. Every method taking a key applies it, as do the
+	// scans and Match to their prefix or pattern, so it must map the prefixes of a
+	// key to prefixes of its normalized form, as lowercasing does, and give back
+	// a normalized key unchanged. The keys already stored are not normalized
+	// again: set it before writing the first key, and keep it.
+	NormalizeKey func(key string) string
+	// KeyDirIndex is the hash table the keys are indexed in memory with, KeyDirMap
+	// by default. KeyDirStats tells how it copes with the keys.
+	KeyDirIndex KeyDirIndex
+	// KeyHash hashes the keys for KeyDirRobinHood, and for the collisions counted
+	// by KeyDirStats. When nil, the keys are hashed with hash/maphash under a
+	// random seed.
+	KeyHash func(key string) uint64
+	// RefreshInterval is how often a store opened with OpenReadOnly catches up
+	// with the writes of the process owning it, check Refresh. Zero leaves it to
+	// the caller.
+	RefreshInterval time.Duration
+	// LoadInBackground makes NewDiskStoreWithOptions return once the sealed
+	// segments are loaded, from their hint files where they have them, and index
+	// the active file in the background, check Loaded.
+	LoadInBackground bool
+	// TrashDelay moves the segments Compact, DeleteAll and Retention drop to
+	// books.db.trash rather than deleting them, and deletes them from there once
+	// they were trashed that long ago. Zero deletes them right away.
+	TrashDelay time.Duration
+	// SnapshotLeakThreshold makes the store log a warning for every snapshot, e.g.
+	// of a CopyTo, open for longer than it, as likely never closed: the files of the
+	// segments it references are kept until it is. Zero disables the warning.
+	SnapshotLeakThreshold time.Duration
+	// ReadTimeout and WriteTimeout bound how long Get and Lookup, and Set, Put and
+	// Delete, wait for the disk, e.g. a hung NFS mount, before returning
+	// ErrTimeout; the Context variants of the methods also stop waiting once their
+	// ctx is done, returning its error. The operation carries on in the
+	// background, and a write may still be applied after its caller gave up on it.
+	// Zero waits as long as it takes.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// IOUring makes the store read the records of a GetMany, and append those of a
+	// Txn, through io_uring on Linux 5.6 and later: the reads are submitted all at
+	// once and completed with a single system call, rather than a pread each. A
+	// single Get gains nothing from it, and still makes a pread. Where io_uring is
+	// not available, e.g. on another platform, an older kernel or in a sandbox
+	// forbidding it, the store logs a warning and makes plain system calls.
+	IOUring bool
+	// NetworkFS makes the store safe to keep on a network filesystem such as NFS
+	// or SMB: it refuses KeyDirMmap with ErrNetworkFS, opens the active file with
+	// O_SYNC, and holds a lease on books.db.lock, renewed in the background, so
+	// that a second writer fails to open the store with ErrLocked. It is turned on
+	// when the store is found on a network filesystem, which is only detected on
+	// Linux.
+	NetworkFS bool
+	// LeaseDuration is how long the lease of NetworkFS lasts without being renewed,
+	// i.e. how long a writer which crashed keeps the store locked. When zero,
+	// DefaultLeaseDuration is used.
+	LeaseDuration time.Duration
+	// shared holds what the store shares with the other stores of its Manager, nil
+	// for a store opened on its own
+	shared *sharedResources
+}
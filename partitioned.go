@@ -0,0 +1,253 @@
+package caskdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrPartitionMismatch is returned by NewPartitionedStore when a directory holds
+// another partition than the one it is opened as, e.g. because the directories
+// were passed in another order, or a different number of them, than when the store
+// was created. Opening it anyway would send the keys to the wrong partitions.
+var ErrPartitionMismatch = errors.New("caskdb: partition mismatch")
+
+// partitionSuffix is appended to the data file's name for the file recording which
+// partition it is
+const partitionSuffix = ".partition"
+
+// PartitionedStore splits the keys across independent DiskStores, one per
+// directory, by the hash of the key. Each partition has its own file and lock, so
+// writes to different partitions, and their fsyncs, run in parallel; with each
+// directory on a disk of its own, so does the I/O. The partitions are also loaded
+// in parallel at startup.
+//
+// The number and the order of the directories decide where every key lives, so
+// they must stay the same for the life of the store. NewPartitionedStore records
+// them, and refuses to open the store with others.
+type PartitionedStore struct {
+	partitions []*DiskStore
+}
+
+var _ Store = (*PartitionedStore)(nil)
+
+// NewPartitionedStore opens, or creates, a store partitioned across the
+// directories, with a data file called fileName in each. The options apply to
+// every partition. The hooks, such as OnSet, are called from the partitions
+// concurrently; with ColdDir or ColdPrefix set, each partition gets a directory,
+// or a prefix, of its own under it.
+func NewPartitionedStore(dirs []string, fileName string, opts Options) (*PartitionedStore, error) {
+	if len(dirs) == 0 {
+		return nil, errors.New("caskdb: a partitioned store needs at least one directory")
+	}
+	ps := &PartitionedStore{partitions: make([]*DiskStore, len(dirs))}
+	errs := make([]error, len(dirs))
+	var wg sync.WaitGroup
+	for i, dir := range dirs {
+		wg.Add(1)
+		go func(i int, dir string) {
+			defer wg.Done()
+			ps.partitions[i], errs[i] = openPartition(dir, fileName, i, len(dirs), opts)
+		}(i, dir)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			ps.Close()
+			return nil, err
+		}
+	}
+	return ps, nil
+}
+
+// openPartition opens the partition i of n.
+func openPartition(dir string, fileName string, i int, n int, opts Options) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, fileName)
+	want := fmt.Sprintf("%d/%d", i, n)
+	data, err := os.ReadFile(path + partitionSuffix)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if err := os.WriteFile(path+partitionSuffix, []byte(want+"\n"), 0666); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	case strings.TrimSpace(string(data)) != want:
+		return nil, fmt.Errorf("%w: %s is partition %s, opened as %s", ErrPartitionMismatch, dir, strings.TrimSpace(string(data)), want)
+	}
+	if opts.ColdDir != "" {
+		opts.ColdDir = filepath.Join(opts.ColdDir, strconv.Itoa(i))
+	}
+	if opts.ColdPrefix != "" {
+		opts.ColdPrefix += strconv.Itoa(i) + "/"
+	}
+	return NewDiskStoreWithOptions(path, opts)
+}
+
+// Partition returns the partition the key belongs to.
+func (p *PartitionedStore) Partition(key string) *DiskStore {
+	key = p.partitions[0].normalizeKey(key)
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return p.partitions[h.Sum64()%uint64(len(p.partitions))]
+}
+
+// Partitions returns the partitions, in the order of the directories they were
+// opened from.
+func (p *PartitionedStore) Partitions() []*DiskStore {
+	return p.partitions
+}
+
+func (p *PartitionedStore) Get(key string) string {
+	// Get returns the value of the key from its partition, or an empty string if
+	// the key does not exist. Check Lookup if you need to tell apart the failures.
+	return p.Partition(key).Get(key)
+}
+
+// Lookup is like DiskStore.Lookup, on the partition of the key.
+func (p *PartitionedStore) Lookup(key string) (string, error) {
+	return p.Partition(key).Lookup(key)
+}
+
+// LookupContext is like DiskStore.LookupContext, on the partition of the key.
+func (p *PartitionedStore) LookupContext(ctx context.Context, key string) (string, error) {
+	return p.Partition(key).LookupContext(ctx, key)
+}
+
+func (p *PartitionedStore) Set(key string, value string) {
+	// Set stores the key in its partition. It panics if the write fails, check Put
+	// if you need to handle the failure.
+	p.Partition(key).Set(key, value)
+}
+
+// Put is like DiskStore.Put, on the partition of the key.
+func (p *PartitionedStore) Put(key string, value string) error {
+	return p.Partition(key).Put(key, value)
+}
+
+// PutContext is like DiskStore.PutContext, on the partition of the key.
+func (p *PartitionedStore) PutContext(ctx context.Context, key string, value string) error {
+	return p.Partition(key).PutContext(ctx, key, value)
+}
+
+// Delete is like DiskStore.Delete, on the partition of the key.
+func (p *PartitionedStore) Delete(key string) error {
+	return p.Partition(key).Delete(key)
+}
+
+// DeleteContext is like DiskStore.DeleteContext, on the partition of the key.
+func (p *PartitionedStore) DeleteContext(ctx context.Context, key string) error {
+	return p.Partition(key).DeleteContext(ctx, key)
+}
+
+// Keys returns the keys of all the partitions, in no particular order.
+func (p *PartitionedStore) Keys() []string {
+	var keys []string
+	for _, partition := range p.partitions {
+		keys = append(keys, partition.Keys()...)
+	}
+	return keys
+}
+
+// Match returns the keys of every partition matching the glob pattern, in order.
+func (p *PartitionedStore) Match(pattern string) []string {
+	var keys []string
+	for _, partition := range p.partitions {
+		keys = append(keys, partition.Match(pattern)...)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// MatchRegexp is like Match, with a regular expression.
+func (p *PartitionedStore) MatchRegexp(re *regexp.Regexp) []string {
+	var keys []string
+	for _, partition := range p.partitions {
+		keys = append(keys, partition.MatchRegexp(re)...)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CountPrefix returns the number of live keys starting with prefix, over every
+// partition.
+func (p *PartitionedStore) CountPrefix(prefix string) int {
+	var n int
+	for _, partition := range p.partitions {
+		n += partition.CountPrefix(prefix)
+	}
+	return n
+}
+
+// SizePrefix returns the bytes taken up by the records of the live keys starting
+// with prefix, over every partition.
+func (p *PartitionedStore) SizePrefix(prefix string) int64 {
+	var size int64
+	for _, partition := range p.partitions {
+		size += partition.SizePrefix(prefix)
+	}
+	return size
+}
+
+// DeletePrefix removes every key starting with prefix from every partition, and
+// returns how many it removed. Each partition removes its keys in a single write,
+// but a failing partition leaves the ones after it untouched.
+func (p *PartitionedStore) DeletePrefix(prefix string) (int, error) {
+	var n int
+	for _, partition := range p.partitions {
+		deleted, err := partition.DeletePrefix(prefix)
+		n += deleted
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// DeleteAll removes every key from every partition. It stops at the first
+// partition failing, leaving the ones after it untouched.
+func (p *PartitionedStore) DeleteAll() error {
+	for _, partition := range p.partitions {
+		if err := partition.DeleteAll(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compact compacts the partitions one after the other, and returns the bytes
+// freed. When ctx is done, the partition being compacted records its progress, and
+// the next call resumes it; the partitions before it are done already.
+func (p *PartitionedStore) Compact(ctx context.Context) (int64, error) {
+	var freed int64
+	for _, partition := range p.partitions {
+		n, err := partition.Compact(ctx)
+		freed += n
+		if err != nil {
+			return freed, err
+		}
+	}
+	return freed, nil
+}
+
+// Close closes every partition, and reports whether they all closed cleanly.
+func (p *PartitionedStore) Close() bool {
+	ok := true
+	for _, partition := range p.partitions {
+		if partition != nil && !partition.Close() {
+			ok = false
+		}
+	}
+	return ok
+}
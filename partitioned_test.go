@@ -0,0 +1,75 @@
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPartitionedStore_NormalizeKey(t *testing.T) {
+	root := t.TempDir()
+	dirs := []string{filepath.Join(root, "p0"), filepath.Join(root, "p1"), filepath.Join(root, "p2")}
+	store, err := NewPartitionedStore(dirs, "test.db", Options{NormalizeKey: strings.ToUpper})
+	if err != nil {
+		t.Fatalf("NewPartitionedStore() error = %v", err)
+	}
+	defer store.Close()
+	for i := 0; i < 30; i++ {
+		store.Set(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+	}
+	for i := 0; i < 30; i++ {
+		if got, want := store.Get(fmt.Sprintf("KEY-%d", i)), fmt.Sprintf("value-%d", i); got != want {
+			t.Errorf("Get(KEY-%d) = %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestPartitionedStore(t *testing.T) {
+	root := t.TempDir()
+	dirs := []string{filepath.Join(root, "p0"), filepath.Join(root, "p1"), filepath.Join(root, "p2")}
+	store, err := NewPartitionedStore(dirs, "test.db", Options{})
+	if err != nil {
+		t.Fatalf("NewPartitionedStore() error = %v", err)
+	}
+	for i := 0; i < 300; i++ {
+		store.Set(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+	}
+	if err := store.Delete("key-42"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	for i, partition := range store.Partitions() {
+		if n := len(partition.Keys()); n < 50 {
+			t.Errorf("partition %d holds %v keys of 299, want about a third", i, n)
+		}
+	}
+	store.Close()
+
+	store, err = NewPartitionedStore(dirs, "test.db", Options{})
+	if err != nil {
+		t.Fatalf("failed to reopen partitioned store: %v", err)
+	}
+	if n := len(store.Keys()); n != 299 {
+		t.Errorf("Keys() returned %v keys, want 299", n)
+	}
+	for i := 0; i < 300; i++ {
+		key, want := fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i)
+		if i == 42 {
+			want = ""
+		}
+		if got := store.Get(key); got != want {
+			t.Errorf("Get(%v) = %v, want %v", key, got, want)
+		}
+	}
+	store.Close()
+
+	// the keys would land in the wrong partitions
+	swapped := []string{dirs[1], dirs[0], dirs[2]}
+	if _, err := NewPartitionedStore(swapped, "test.db", Options{}); !errors.Is(err, ErrPartitionMismatch) {
+		t.Errorf("NewPartitionedStore() with swapped directories error = %v, want %v", err, ErrPartitionMismatch)
+	}
+	if _, err := NewPartitionedStore(dirs[:2], "test.db", Options{}); !errors.Is(err, ErrPartitionMismatch) {
+		t.Errorf("NewPartitionedStore() with fewer directories error = %v, want %v", err, ErrPartitionMismatch)
+	}
+}
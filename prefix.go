@@ -0,0 +1,87 @@
+package caskdb
+
+import (
+	"strings"
+	"time"
+)
+
+// DeletePrefix removes every key starting with prefix, and returns how many it
+// removed. The tombstones of all of them are written with a single write and
+// fsync, and the keys are found through the ordered index, so the cost depends on
+// the number of matching keys rather than on the size of the store. OnDelete is
+// called for each of them.
+//
+// Either all the keys are removed, or, if the write fails, none. To remove every
+// key, DeleteAll is faster.
+func (d *DiskStore) DeletePrefix(prefix string) (n int, err error) {
+	prefix = d.normalizeKey(prefix)
+	start, size := time.Now(), 0
+	defer func() { d.observe("DeletePrefix", prefix, size, d.fileName, start) }()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	timestamp := uint32(start.Unix())
+	var keys []string
+	var data []byte
+	d.keys.ascend(prefix, func(key string) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		if !d.keyEntry(key).expired(start) {
+			_, record := encodeKV(timestamp, key, "")
+			data = append(data, record...)
+			keys = append(keys, key)
+		}
+		return true
+	})
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	if err := d.write(data); err != nil {
+		return 0, err
+	}
+	d.writePosition += len(data)
+	size = len(data)
+	for _, key := range keys {
+		d.dropKey(key)
+	}
+	if d.opts.OnDelete != nil {
+		for _, key := range keys {
+			d.opts.OnDelete(key)
+		}
+	}
+	return len(keys), nil
+}
+
+// CountPrefix returns the number of live keys starting with prefix. Like KeyReport,
+// it is computed from KeyDir alone, and only visits the matching keys.
+func (d *DiskStore) CountPrefix(prefix string) int {
+	return d.prefixUsage(prefix).Keys
+}
+
+// SizePrefix returns the bytes taken up on the disk by the records of the live
+// keys starting with prefix, headers included, e.g. for the usage of a tenant.
+// Like CountPrefix, no value is read.
+func (d *DiskStore) SizePrefix(prefix string) int64 {
+	return d.prefixUsage(prefix).Bytes
+}
+
+// prefixUsage returns the number of live keys starting with prefix and the size of
+// their records.
+func (d *DiskStore) prefixUsage(prefix string) PrefixUsage {
+	prefix = d.normalizeKey(prefix)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	usage := PrefixUsage{Prefix: prefix}
+	now := time.Now()
+	d.keys.ascend(prefix, func(key string) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		if kEntry := d.keyEntry(key); !kEntry.expired(now) {
+			usage.Keys++
+			usage.Bytes += int64(kEntry.totalSize)
+		}
+		return true
+	})
+	return usage
+}
@@ -0,0 +1,74 @@
+package caskdb
+
+import (
+	"os"
+	"sort"
+	"testing"
+)
+
+func TestDiskStore_DeletePrefix(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	for _, key := range []string{"tenant1/othello", "tenant1/hamlet", "tenant10/dune", "tenant2/emma"} {
+		store.Set(key, "some author")
+	}
+	var deleted []string
+	store.opts.OnDelete = func(key string) { deleted = append(deleted, key) }
+	n, err := store.DeletePrefix("tenant1/")
+	if err != nil {
+		t.Fatalf("DeletePrefix() error = %v", err)
+	}
+	if n != 2 || len(deleted) != 2 {
+		t.Errorf("DeletePrefix() = %v, called OnDelete for %v, want 2 keys", n, deleted)
+	}
+	keys := store.Keys()
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "tenant10/dune" || keys[1] != "tenant2/emma" {
+		t.Errorf("Keys() after DeletePrefix() = %v, want tenant10/dune and tenant2/emma", keys)
+	}
+	if n, err := store.DeletePrefix("tenant1/"); n != 0 || err != nil {
+		t.Errorf("DeletePrefix() again = %v, %v, want 0", n, err)
+	}
+	store.Close()
+
+	// the deletions were persisted
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	if _, err := store.Lookup("tenant1/hamlet"); err == nil {
+		t.Errorf("Lookup() after reopening found a deleted key")
+	}
+	if len(store.Keys()) != 2 {
+		t.Errorf("Keys() after reopening = %v, want 2 keys", store.Keys())
+	}
+}
+
+func TestDiskStore_CountPrefix(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	store.Set("tenant1/othello", "shakespeare")
+	store.Set("tenant1/hamlet", "shakespeare")
+	store.Set("tenant1/hamlet", "william shakespeare")
+	store.Set("tenant2/dune", "herbert")
+	if got := store.CountPrefix("tenant1/"); got != 2 {
+		t.Errorf("CountPrefix() = %v, want 2", got)
+	}
+	want := int64(2*headerSize + len("tenant1/othello") + len("shakespeare") + len("tenant1/hamlet") + len("william shakespeare"))
+	if got := store.SizePrefix("tenant1/"); got != want {
+		t.Errorf("SizePrefix() = %v, want %v", got, want)
+	}
+	if got := store.CountPrefix("tenant3/"); got != 0 {
+		t.Errorf("CountPrefix() = %v, want 0", got)
+	}
+}
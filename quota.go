@@ -0,0 +1,214 @@
+package caskdb
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// PrefixQuota caps the keys under a prefix, check Options.PrefixQuotas.
+type PrefixQuota struct {
+	Prefix string
+	// MaxBytes caps the total size of the records of the live keys under the
+	// prefix, headers included, and MaxKeys their number. Zero disables the cap.
+	MaxBytes int64
+	MaxKeys  int
+}
+
+// prefixQuota is a PrefixQuota along with the usage of its prefix.
+type prefixQuota struct {
+	PrefixQuota
+	keys  int
+	bytes int64
+}
+
+// prefixQuotas finds the quota of a key: the quotas by prefix, and the lengths of
+// the prefixes, longest first, for the lookups of the prefixes of the key.
+type prefixQuotas struct {
+	byPrefix map[string]*prefixQuota
+	lengths  []int
+}
+
+func newPrefixQuotas(quotas []PrefixQuota) (*prefixQuotas, error) {
+	if len(quotas) == 0 {
+		return nil, nil
+	}
+	q := &prefixQuotas{byPrefix: make(map[string]*prefixQuota, len(quotas))}
+	seen := make(map[int]bool)
+	for _, quota := range quotas {
+		if _, ok := q.byPrefix[quota.Prefix]; ok {
+			return nil, fmt.Errorf("caskdb: quota for prefix %q set twice", quota.Prefix)
+		}
+		q.byPrefix[quota.Prefix] = &prefixQuota{PrefixQuota: quota}
+		if !seen[len(quota.Prefix)] {
+			seen[len(quota.Prefix)] = true
+			q.lengths = append(q.lengths, len(quota.Prefix))
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(q.lengths)))
+	return q, nil
+}
+
+// of returns the quota of the key, the one of the longest prefix of the key, or
+// nil if there is none.
+func (q *prefixQuotas) of(key string) *prefixQuota {
+	if q == nil {
+		return nil
+	}
+	for _, n := range q.lengths {
+		if n <= len(key) {
+			if quota, ok := q.byPrefix[key[:n]]; ok {
+				return quota
+			}
+		}
+	}
+	return nil
+}
+
+// add accounts for keys more keys and bytes more bytes under the quota of the key.
+func (q *prefixQuotas) add(key string, keys int, bytes int64) {
+	if quota := q.of(key); quota != nil {
+		quota.keys += keys
+		quota.bytes += bytes
+	}
+}
+
+// reset forgets the usage of every prefix, for a store emptied of its keys.
+func (q *prefixQuotas) reset() {
+	if q == nil {
+		return
+	}
+	for _, quota := range q.byPrefix {
+		quota.keys, quota.bytes = 0, 0
+	}
+}
+
+// usage returns the usage of every prefix with a quota, sorted by prefix.
+func (q *prefixQuotas) usage() []PrefixUsage {
+	if q == nil {
+		return nil
+	}
+	usage := make([]PrefixUsage, 0, len(q.byPrefix))
+	for _, quota := range q.byPrefix {
+		usage = append(usage, PrefixUsage{Prefix: quota.Prefix, Keys: quota.keys, Bytes: quota.bytes})
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Prefix < usage[j].Prefix })
+	return usage
+}
+
+// checkQuota returns ErrStoreFull if writing size bytes for the key would take the
+// store past Options.MaxBytes or Options.MaxKeys, or the prefix of the key past
+// its quota, or makes room for them in cache mode. The store must be locked.
+func (d *DiskStore) checkQuota(key string, size int) error {
+	if err := d.checkPrefixQuota(key, size); err != nil {
+		return err
+	}
+	if max := d.opts.MaxBytes; max > 0 {
+		if used := d.diskSize(); used+int64(size) > max {
+			return fmt.Errorf("%w: %d of %d bytes used", ErrStoreFull, used, max)
+		}
+	}
+	if d.opts.Eviction != EvictNone {
+		return d.evict(key, size)
+	}
+	if max := d.opts.MaxKeys; max > 0 && d.keyDir.size() >= max {
+		if _, ok := d.keyDir.get(key); ok {
+			return nil
+		}
+		// keys which expired stay in keyDir until they are written again, and
+		// should not hold up a new one
+		d.dropExpired(time.Now())
+		if d.keyDir.size() >= max {
+			return fmt.Errorf("%w: %d of %d keys used", ErrStoreFull, d.keyDir.size(), max)
+		}
+	}
+	return nil
+}
+
+// checkPrefixQuota returns ErrStoreFull if writing size bytes for the key would
+// take its prefix past its quota, check Options.PrefixQuotas. The quotas are
+// enforced in cache mode too: the keys of a prefix are not evicted to make room
+// for one another. The store must be locked.
+func (d *DiskStore) checkPrefixQuota(key string, size int) error {
+	quota := d.quotas.of(key)
+	if quota == nil {
+		return nil
+	}
+	old, ok := d.keyDir.get(key)
+	if max := quota.MaxBytes; max > 0 && quota.bytes-int64(old.totalSize)+int64(size) > max {
+		return fmt.Errorf("%w: %d of %d bytes of prefix %q used", ErrStoreFull, quota.bytes, max, quota.Prefix)
+	}
+	if max := quota.MaxKeys; max > 0 && !ok && quota.keys >= max {
+		d.dropExpired(time.Now())
+		if quota.keys >= max {
+			return fmt.Errorf("%w: %d of %d keys of prefix %q used", ErrStoreFull, quota.keys, max, quota.Prefix)
+		}
+	}
+	return nil
+}
+
+// checkPrefixQuotas is checkPrefixQuota for the writes of a Txn, applied
+// together. The sizes of the records are estimated as in txnSize. The store must
+// be locked.
+func (d *DiskStore) checkPrefixQuotas(writes []txnWrite) error {
+	if d.quotas == nil {
+		return nil
+	}
+	type change struct {
+		keys  int
+		bytes int64
+	}
+	usage := func() map[*prefixQuota]change {
+		changes := make(map[*prefixQuota]change)
+		for _, w := range writes {
+			quota := d.quotas.of(w.key)
+			if quota == nil {
+				continue
+			}
+			c := changes[quota]
+			old, ok := d.keyDir.get(w.key)
+			c.bytes -= int64(old.totalSize)
+			if w.value != "" {
+				c.bytes += int64(headerSize + len(w.key) + len(w.value))
+			}
+			if w.value == "" && ok {
+				c.keys--
+			} else if w.value != "" && !ok {
+				c.keys++
+			}
+			changes[quota] = c
+		}
+		return changes
+	}
+	over := func(changes map[*prefixQuota]change) error {
+		for quota, c := range changes {
+			if max := quota.MaxBytes; max > 0 && c.bytes > 0 && quota.bytes+c.bytes > max {
+				return fmt.Errorf("%w: %d of %d bytes of prefix %q needed", ErrStoreFull, quota.bytes+c.bytes, max, quota.Prefix)
+			}
+			if max := quota.MaxKeys; max > 0 && c.keys > 0 && quota.keys+c.keys > max {
+				return fmt.Errorf("%w: %d of %d keys of prefix %q needed", ErrStoreFull, quota.keys+c.keys, max, quota.Prefix)
+			}
+		}
+		return nil
+	}
+	if err := over(usage()); err == nil {
+		return nil
+	}
+	d.dropExpired(time.Now())
+	return over(usage())
+}
+
+// dropExpired removes the keys which expired from keyDir. Their records need no
+// tombstone: loading the store skips them as well. The store must be locked.
+func (d *DiskStore) dropExpired(now time.Time) {
+	var expired []string
+	d.keyDir.each(func(key string, kEntry KeyEntry) bool {
+		if kEntry.expired(now) {
+			expired = append(expired, key)
+		}
+		return true
+	})
+	for _, key := range expired {
+		d.dropKey(key)
+	}
+}
@@ -0,0 +1,131 @@
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_MaxKeys(t *testing.T) {
+	store, err := NewDiskStoreWithOptions("test.db", Options{MaxKeys: 2})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	store.Set("othello", "shakespeare")
+	store.Set("hamlet", "shakespeare")
+	if err := store.Put("dune", "herbert"); !errors.Is(err, ErrStoreFull) {
+		t.Errorf("Put() of a third key error = %v, want ErrStoreFull", err)
+	}
+	// the existing keys can still be written and deleted
+	if err := store.Put("hamlet", "william shakespeare"); err != nil {
+		t.Errorf("Put() of an existing key error = %v", err)
+	}
+	if err := store.Delete("othello"); err != nil {
+		t.Errorf("Delete() error = %v", err)
+	}
+	if err := store.Put("dune", "herbert"); err != nil {
+		t.Errorf("Put() after a Delete() error = %v", err)
+	}
+	// an expired key makes room too
+	store.keyDir.set("dune", KeyEntry{expiry: uint32(time.Now().Add(-time.Minute).Unix())})
+	if err := store.Put("emma", "austen"); err != nil {
+		t.Errorf("Put() with an expired key error = %v", err)
+	}
+}
+
+func TestDiskStore_MaxBytes(t *testing.T) {
+	store, err := NewDiskStoreWithOptions("test.db", Options{MaxBytes: 130})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	// 38 bytes a record, after the 30 of the format record
+	store.Set("othello", "shakespeare")
+	store.Set("othello", "shakespeare")
+	if err := store.Put("othello", "shakespeare"); !errors.Is(err, ErrStoreFull) {
+		t.Errorf("Put() past MaxBytes error = %v, want ErrStoreFull", err)
+	}
+	if store.Stats().Bytes != 106 {
+		t.Errorf("Stats().Bytes = %v, want the rejected write left out", store.Stats().Bytes)
+	}
+	if err := store.DeleteAll(); err != nil {
+		t.Fatalf("DeleteAll() error = %v", err)
+	}
+	if err := store.Put("othello", "shakespeare"); err != nil {
+		t.Errorf("Put() after DeleteAll() error = %v", err)
+	}
+}
+
+func TestDiskStore_PrefixQuotas(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{PrefixQuotas: []PrefixQuota{
+		{Prefix: "tenant1/", MaxKeys: 2},
+		{Prefix: "tenant1/vip/"},
+		{Prefix: "tenant2/", MaxBytes: 100},
+	}}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("tenant1/othello", "shakespeare")
+	store.Set("tenant1/hamlet", "shakespeare")
+	if err := store.Put("tenant1/dune", "herbert"); !errors.Is(err, ErrStoreFull) {
+		t.Errorf("Put() of a third key of the prefix error = %v, want ErrStoreFull", err)
+	}
+	// the longest prefix wins, and the keys without a quota are not limited
+	for _, key := range []string{"tenant1/vip/dune", "dune"} {
+		if err := store.Put(key, "herbert"); err != nil {
+			t.Errorf("Put(%q) error = %v", key, err)
+		}
+	}
+	// 69 bytes a record
+	value := strings.Repeat("x", 40)
+	store.Set("tenant2/a", value)
+	if err := store.Put("tenant2/b", value); !errors.Is(err, ErrStoreFull) {
+		t.Errorf("Put() past MaxBytes of the prefix error = %v, want ErrStoreFull", err)
+	}
+	if err := store.Put("tenant2/a", value+"x"); err != nil {
+		t.Errorf("Put() overwriting a key of the prefix error = %v", err)
+	}
+	store.Delete("tenant1/hamlet")
+	if err := store.Put("tenant1/dune", "herbert"); err != nil {
+		t.Errorf("Put() after a Delete() error = %v", err)
+	}
+	txn := store.Begin()
+	txn.Put("tenant1/emma", "austen")
+	if err := txn.Commit(); !errors.Is(err, ErrStoreFull) {
+		t.Errorf("Commit() past the quota of the prefix error = %v, want ErrStoreFull", err)
+	}
+
+	want := []PrefixUsage{
+		{Prefix: "tenant1/", Keys: 2, Bytes: 2*headerSize + int64(len("tenant1/othelloshakespeare")+len("tenant1/duneherbert"))},
+		{Prefix: "tenant1/vip/", Keys: 1, Bytes: headerSize + int64(len("tenant1/vip/duneherbert"))},
+		{Prefix: "tenant2/", Keys: 1, Bytes: 70},
+	}
+	if got := store.Stats().Prefixes; !reflect.DeepEqual(got, want) {
+		t.Errorf("Stats().Prefixes = %v, want %v", got, want)
+	}
+	store.Close()
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	if got := store.Stats().Prefixes; !reflect.DeepEqual(got, want) {
+		t.Errorf("Stats().Prefixes after reopening = %v, want %v", got, want)
+	}
+
+	opts.PrefixQuotas = append(opts.PrefixQuotas, PrefixQuota{Prefix: "tenant2/"})
+	if _, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), opts); err == nil {
+		t.Errorf("NewDiskStoreWithOptions() with a prefix twice error = nil, want an error")
+	}
+}
@@ -0,0 +1,85 @@
+package caskdb
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// tokenBucket limits a rate of events, or of bytes, allowing bursts of up to a
+// second's worth, and at least one. It has its own lock, so that the writers wait
+// for their turn without holding the store.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	burst := math.Max(rate, 1)
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve takes n tokens and returns how long to wait before using them. The
+// bucket may go into debt, so that a request larger than the burst still goes
+// through, once its time has come, and delays the ones after it.
+func (b *tokenBucket) reserve(n float64, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// refund gives back the tokens of a reservation which was not used.
+func (b *tokenBucket) refund(n float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += n
+}
+
+// throttle waits until a write of size bytes is within Options.WriteOpsPerSecond
+// and Options.WriteBytesPerSecond, or until ctx is done. It is called before
+// locking the store, so the reads carry on while a writer waits.
+func (d *DiskStore) throttle(ctx context.Context, size int) error {
+	if d.writeOps == nil && d.writeBytes == nil {
+		return nil
+	}
+	now := time.Now()
+	var wait time.Duration
+	if d.writeOps != nil {
+		wait = d.writeOps.reserve(1, now)
+	}
+	if d.writeBytes != nil {
+		if w := d.writeBytes.reserve(float64(size), now); w > wait {
+			wait = w
+		}
+	}
+	if wait == 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		if d.writeOps != nil {
+			d.writeOps.refund(1)
+		}
+		if d.writeBytes != nil {
+			d.writeBytes.refund(float64(size))
+		}
+		return ctx.Err()
+	}
+}
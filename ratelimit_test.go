@@ -0,0 +1,50 @@
+package caskdb
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_tokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(10)
+	b.last = now
+	// a second's worth goes through at once
+	if wait := b.reserve(10, now); wait != 0 {
+		t.Errorf("reserve() of the burst = %v, want 0", wait)
+	}
+	if wait := b.reserve(5, now); wait != 500*time.Millisecond {
+		t.Errorf("reserve() past the burst = %v, want 500ms", wait)
+	}
+	b.refund(5)
+	if wait := b.reserve(1, now.Add(time.Second)); wait != 0 {
+		t.Errorf("reserve() a second later = %v, want 0", wait)
+	}
+}
+
+func TestDiskStore_WriteOpsPerSecond(t *testing.T) {
+	store, err := NewDiskStoreWithOptions("test.db", Options{WriteOpsPerSecond: 1})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	if err := store.Put("othello", "shakespeare"); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := store.PutContext(ctx, "hamlet", "shakespeare"); err != context.DeadlineExceeded {
+		t.Errorf("PutContext() over the limit error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	// the reads are not held up meanwhile
+	if value, err := store.Lookup("othello"); err != nil || value != "shakespeare" {
+		t.Errorf("Lookup() = %v, %v, want shakespeare", value, err)
+	}
+	if store.Has("hamlet") {
+		t.Errorf("PutContext() which timed out wrote the key")
+	}
+}
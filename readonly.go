@@ -0,0 +1,226 @@
+package caskdb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// maxLoadAttempts bounds how many times OpenReadOnly loads the store again when
+// the writer sealed the active file while it was being loaded
+const maxLoadAttempts = 3
+
+// OpenReadOnly opens the store at fileName for reading only, while the process
+// which opened it with NewDiskStore keeps writing to it, e.g. from a sidecar
+// running analytics against a live store. Nothing is ever written to the files of
+// the store: the writes, Compact, DeleteAll and the like fail with ErrReadOnly.
+//
+// The store sees the writes made after it was opened once Refresh is called, or
+// every Options.RefreshInterval when that is set. The options should be those of
+// the writer, as far as reading the records goes, e.g. Options.EncryptionKeys and
+// Options.ColdDir. The active file must exist, i.e. the writer must have opened
+// the store first.
+func OpenReadOnly(fileName string, opts Options) (*DiskStore, error) {
+	start := time.Now()
+	ds, err := openReadOnly(fileName, opts)
+	if err != nil {
+		return nil, err
+	}
+	ds.openedAt = start
+	ds.loadStats(fileName)
+	if opts.RefreshInterval > 0 {
+		ds.background.Go(func(ctx context.Context) error {
+			return ds.refreshEvery(ctx, fileName)
+		})
+	}
+	ds.log.Info("opened store read-only", "file", fileName, "keys", ds.keyDir.size(), "segments", len(ds.segments), "size", ds.writePosition, "duration", time.Since(start))
+	return ds, nil
+}
+
+// openReadOnly loads the files of the store for reading only. The active file is
+// opened first and read through its handle, so that what is loaded as the active
+// segment is the file the handle points at; when the writer sealed it meanwhile,
+// the sealed segments found may miss it, and the store is loaded again.
+func openReadOnly(fileName string, opts Options) (*DiskStore, error) {
+	for attempt := 1; ; attempt++ {
+		ds, err := newDiskStore(opts)
+		if err != nil {
+			return nil, err
+		}
+		ds.readOnly = true
+		// a reader takes no lease, but does not map the keydir either
+		if err := ds.checkNetworkFS(fileName); err != nil {
+			return nil, err
+		}
+		if ds.file, err = openFile(fileName, os.O_RDONLY, 0); err != nil {
+			ds.log.Error("failed to open store", "file", fileName, "error", err)
+			return nil, err
+		}
+		ds.fileName = fileName
+		if ds.mapKeyDir(fileName) {
+			return ds, nil
+		}
+		if err := ds.initKeyDir(fileName); err != nil {
+			ds.log.Error("failed to load store", "file", fileName, "error", err)
+			ds.file.Close()
+			return nil, err
+		}
+		if attempt == maxLoadAttempts || ds.activeCurrent() {
+			return ds, nil
+		}
+		ds.closeSegments()
+		ds.file.Close()
+	}
+}
+
+// activeCurrent reports whether the file the store reads as its active segment is
+// still the active file of the writer.
+func (d *DiskStore) activeCurrent() bool {
+	return sameFile(d.file.Name(), d.file)
+}
+
+// Refresh catches up with the writes made to a store opened with OpenReadOnly
+// since it was opened or last refreshed: the records appended to the active file
+// are added to KeyDir, and when the writer sealed the active file, the segments
+// it started since are loaded too. The changes which cannot be followed record by
+// record, e.g. Compact replacing the sealed segments, load the store anew. A
+// record the writer is in the middle of appending is left to the next Refresh.
+//
+// A store opened for writing is always up to date, and Refresh does nothing.
+func (d *DiskStore) Refresh() error {
+	if !d.readOnly {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fileName := d.file.Name()
+	found, err := findSegments(fileName, d.opts.ColdDir)
+	if err != nil {
+		return err
+	}
+	sealed := d.segments[:len(d.segments)-1]
+	if !sameSegments(sealed, found) {
+		return d.reload(fileName)
+	}
+	// the segments found were sealed before we read the tail, so if the active
+	// file is among them, we read it to its end
+	active := d.active()
+	if err := d.loadSegment(active); err != nil {
+		return err
+	}
+	d.writePosition = int(active.size)
+	if newer := found[len(sealed):]; len(newer) > 0 {
+		if err := d.followRotation(fileName, newer); err != nil {
+			d.log.Warn("reloading store", "file", fileName, "error", err)
+			return d.reload(fileName)
+		}
+	}
+	d.sweepBlobs()
+	return nil
+}
+
+// sameSegments reports whether the sealed segments found on disk start with those
+// the store has, in the files it loaded them from.
+func sameSegments(sealed, found []*segment) bool {
+	if len(found) < len(sealed) {
+		return false
+	}
+	for i, seg := range sealed {
+		if found[i].id != seg.id || found[i].path != seg.path || found[i].remote != seg.remote {
+			return false
+		}
+		if !seg.remote && !sameFile(seg.path, seg.file) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameFile reports whether path names the file open as file.
+func sameFile(path string, file *os.File) bool {
+	if file == nil {
+		return false
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	current, err := file.Stat()
+	return err == nil && os.SameFile(info, current)
+}
+
+// followRotation seals the active segment, which the writer sealed as the first
+// of newer, then loads the rest of newer and the new active file. The store must
+// be locked, and is left in a mess on failure, for reload to clean up.
+func (d *DiskStore) followRotation(fileName string, newer []*segment) error {
+	active := d.active()
+	if newer[0].id != active.id || newer[0].remote || !sameFile(newer[0].path, d.file) {
+		return fmt.Errorf("segment %s is not the active file", newer[0].path)
+	}
+	file, err := openFile(fileName, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	// the handle of the active file is kept to read the sealed segment from
+	active.path, active.file = newer[0].path, d.file
+	d.file = file
+	for _, seg := range newer[1:] {
+		if err := d.loadSegment(seg); err != nil {
+			return err
+		}
+		d.segments = append(d.segments, seg)
+	}
+	next := &segment{id: newer[len(newer)-1].id + 1, path: fileName, file: file}
+	d.segments = append(d.segments, next)
+	if err := d.loadSegment(next); err != nil {
+		return err
+	}
+	d.writePosition = int(next.size)
+	return nil
+}
+
+// reload loads the store anew, replacing what it loaded before once that succeeds.
+// The store must be locked.
+func (d *DiskStore) reload(fileName string) error {
+	fresh, err := openReadOnly(fileName, d.opts)
+	if err != nil {
+		return err
+	}
+	// a failed followRotation may have left the sealed handle of the active file in
+	// the last segment
+	for _, seg := range d.segments {
+		if seg.file != nil && seg.file != d.file {
+			seg.file.Close()
+		}
+	}
+	d.file.Close()
+	d.releaseKeyDir()
+	d.unmapKeyDir = fresh.unmapKeyDir
+	d.file, d.writePosition, d.segments = fresh.file, fresh.writePosition, fresh.segments
+	d.coldCache, d.logBase, d.baseAt, d.mergedAt = fresh.coldCache, fresh.logBase, fresh.baseAt, fresh.mergedAt
+	d.tokens, d.tokensAdded = fresh.tokens, fresh.tokensAdded
+	d.keyDir, d.hashSeed, d.keys, d.liveBytes, d.quotas, d.blobs = fresh.keyDir, fresh.hashSeed, fresh.keys, fresh.liveBytes, fresh.quotas, fresh.blobs
+	d.dictMu.Lock()
+	d.dicts = fresh.dicts
+	d.dictMu.Unlock()
+	d.log.Info("reloaded store", "file", fileName, "keys", d.keyDir.size(), "segments", len(d.segments), "size", d.writePosition)
+	return nil
+}
+
+// refreshEvery calls Refresh every Options.RefreshInterval until ctx is done. A
+// failed Refresh is logged, and the next one tries again.
+func (d *DiskStore) refreshEvery(ctx context.Context, fileName string) error {
+	ticker := time.NewTicker(d.opts.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := d.Refresh(); err != nil {
+				d.log.Error("failed to refresh store", "file", fileName, "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package caskdb
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOpenReadOnly(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	recordSize, _ := encodeKV(0, "othello", "shakespeare")
+	opts := Options{MaxSegmentBytes: int64(3 * recordSize)}
+	if _, err := OpenReadOnly(fileName, opts); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("OpenReadOnly() of a missing store error = %v, want %v", err, os.ErrNotExist)
+	}
+	writer, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer writer.Close()
+	writer.Set("othello", "shakespeare")
+	reader, err := OpenReadOnly(fileName, opts)
+	if err != nil {
+		t.Fatalf("OpenReadOnly() error = %v", err)
+	}
+	defer reader.Close()
+	if got := reader.Get("othello"); got != "shakespeare" {
+		t.Errorf("Get() = %v, want shakespeare", got)
+	}
+
+	// appends to the active file
+	writer.Set("dune", "herbert")
+	if got := reader.Get("dune"); got != "" {
+		t.Errorf("Get() before Refresh() = %v, want no value", got)
+	}
+	if err := reader.Refresh(); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	if got := reader.Get("dune"); got != "herbert" {
+		t.Errorf("Get() = %v, want herbert", got)
+	}
+
+	// a record the writer is in the middle of appending
+	_, data := encodeKV(uint32(time.Now().Unix()), "emma", "austen")
+	if _, err := writer.file.Write(data[:headerSize]); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if err := reader.Refresh(); err != nil {
+		t.Fatalf("Refresh() of a partial record error = %v", err)
+	}
+	if _, err := writer.file.Write(data[headerSize:]); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	writer.writePosition += len(data)
+	if err := reader.Refresh(); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	if got := reader.Get("emma"); got != "austen" {
+		t.Errorf("Get() of a record completed since = %v, want austen", got)
+	}
+
+	// rotations, twice between two refreshes
+	books := map[string]string{"hamlet": "shakespeare", "ulysses": "joyce", "lolita": "nabokov", "the trial": "kafka", "macbeth": "shakespeare"}
+	for key, value := range books {
+		writer.Set(key, value)
+	}
+	writer.Delete("dune")
+	if len(writer.segments) < 3 {
+		t.Fatalf("segments = %v, want the writer to have rotated twice", len(writer.segments))
+	}
+	if err := reader.Refresh(); err != nil {
+		t.Fatalf("Refresh() after rotations error = %v", err)
+	}
+	if len(reader.segments) != len(writer.segments) {
+		t.Errorf("segments = %v, want %v", len(reader.segments), len(writer.segments))
+	}
+	for key, value := range books {
+		if got := reader.Get(key); got != value {
+			t.Errorf("Get(%q) = %v, want %v", key, got, value)
+		}
+	}
+	if reader.Has("dune") {
+		t.Errorf("Has() of a deleted key = true, want false")
+	}
+
+	// a compaction replaces the sealed segments
+	for i := 0; i < 6; i++ {
+		writer.Set("othello", "shakespeare")
+	}
+	if freed, err := writer.Compact(context.Background()); err != nil || freed == 0 {
+		t.Fatalf("Compact() = %v, %v, want segments compacted", freed, err)
+	}
+	writer.Set("emma", "austen!")
+	if err := reader.Refresh(); err != nil {
+		t.Fatalf("Refresh() after Compact() error = %v", err)
+	}
+	if got := reader.Get("emma"); got != "austen!" {
+		t.Errorf("Get() = %v, want austen!", got)
+	}
+	if got, want := reader.Keys(), writer.Keys(); len(got) != len(want) {
+		t.Errorf("Keys() = %v, want %v", got, want)
+	}
+
+	if err := reader.Put("dune", "herbert"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Put() error = %v, want %v", err, ErrReadOnly)
+	}
+	if err := reader.DeleteAll(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("DeleteAll() error = %v, want %v", err, ErrReadOnly)
+	}
+	if _, err := reader.Compact(context.Background()); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Compact() error = %v, want %v", err, ErrReadOnly)
+	}
+	if got := writer.Get("dune"); got != "" {
+		t.Errorf("Get() of the writer = %v, want the key still deleted", got)
+	}
+}
+
+func TestOpenReadOnly_RefreshInterval(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	writer, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer writer.Close()
+	// the writer saved its epoch when it opened
+	os.Remove(fileName + statsSuffix)
+	reader, err := OpenReadOnly(fileName, Options{RefreshInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("OpenReadOnly() error = %v", err)
+	}
+	writer.Set("othello", "shakespeare")
+	for deadline := time.Now().Add(5 * time.Second); !reader.Has("othello"); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Has() = false, want the key picked up in the background")
+		}
+	}
+	if !reader.Close() {
+		t.Errorf("Close() = false, want true")
+	}
+	if _, err := os.Stat(fileName + statsSuffix); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("stats file error = %v, want none written by the reader", err)
+	}
+}
@@ -0,0 +1,147 @@
+package caskdb
+
+import (
+	"context"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// A snapshot, such as the one CopyTo, Split and ExportSSTable read the records
+// from after unlocking the store, reads from the files of the segments as they
+// were when it was taken. The segments it references are pinned until it is
+// closed: Compact, DeleteAll and Retention take them out of the store as usual,
+// but their files are only removed once no snapshot references them, and
+// Options.TrashDelay keeps them in the trash until then too.
+
+// snapshotRef is an open snapshot.
+type snapshotRef struct {
+	// op is the method of the store which took it, e.g. "CopyTo"
+	op     string
+	opened time.Time
+	// names are those of the files of the segments it references
+	names []string
+	// warned is set once it was reported as leaked
+	warned bool
+}
+
+// SnapshotInfo describes a snapshot open on the store, as listed by Debug.
+type SnapshotInfo struct {
+	// Op is the method which took the snapshot, e.g. "CopyTo"
+	Op     string
+	Opened time.Time
+	// Segments are the names of the files of the segments it references
+	Segments []string
+}
+
+// pin takes a snapshot of the segments, whose files are then kept until unpin
+// with the id it returns. The store must be locked.
+func (d *DiskStore) pin(segments []*segment) uint64 {
+	if d.pins == nil {
+		d.pins = make(map[string]int)
+		d.snapshots = make(map[uint64]*snapshotRef)
+		d.unpinned = make(map[string]string)
+	}
+	ref := &snapshotRef{op: snapshotOp(), opened: time.Now()}
+	for _, seg := range segments {
+		name := filepath.Base(seg.path)
+		d.pins[name]++
+		ref.names = append(ref.names, name)
+	}
+	d.lastSnapshot++
+	d.snapshots[d.lastSnapshot] = ref
+	return d.lastSnapshot
+}
+
+// unpin closes the snapshot, and removes the files of the segments dropped while
+// it was open which no other snapshot references.
+func (d *DiskStore) unpin(id uint64) {
+	d.mu.Lock()
+	var drop []string
+	if ref, ok := d.snapshots[id]; ok {
+		delete(d.snapshots, id)
+		for _, name := range ref.names {
+			if d.pins[name]--; d.pins[name] > 0 {
+				continue
+			}
+			delete(d.pins, name)
+			if path, ok := d.unpinned[name]; ok {
+				drop = append(drop, path)
+				delete(d.unpinned, name)
+			}
+		}
+	}
+	d.mu.Unlock()
+	for _, path := range drop {
+		d.removeSegmentFiles(path)
+	}
+}
+
+// keepPinned reports whether a snapshot references the file of a segment taken
+// out of the store at path, which unpin then removes. The store must be locked.
+func (d *DiskStore) keepPinned(path string) bool {
+	name := filepath.Base(path)
+	if d.pins[name] == 0 {
+		return false
+	}
+	d.unpinned[name] = path
+	return true
+}
+
+// pinned reports whether a snapshot references the file of a segment named name.
+func (d *DiskStore) pinned(name string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.pins[name] > 0
+}
+
+// snapshotOp returns the name of the exported method of the store which is taking
+// a snapshot, from the stack.
+func snapshotOp() string {
+	pc := make([]uintptr, 16)
+	frames := runtime.CallersFrames(pc[:runtime.Callers(3, pc)])
+	for {
+		frame, more := frames.Next()
+		if _, method, ok := strings.Cut(frame.Function, ".(*DiskStore)."); ok && method != "" && method[0] >= 'A' && method[0] <= 'Z' {
+			return method
+		}
+		if !more {
+			return "snapshot"
+		}
+	}
+}
+
+// reportLeakedSnapshots logs the snapshots open for longer than
+// Options.SnapshotLeakThreshold, once each: most likely, they were never closed,
+// and keep the files of the segments they reference.
+func (d *DiskStore) reportLeakedSnapshots(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, ref := range d.snapshots {
+		if age := now.Sub(ref.opened); !ref.warned && age >= d.opts.SnapshotLeakThreshold {
+			ref.warned = true
+			d.log.Warn("snapshot open too long", "op", ref.op, "age", age, "segments", ref.names)
+		}
+	}
+}
+
+// reportLeakedSnapshotsEvery calls reportLeakedSnapshots until ctx is done, as
+// often as it takes for no leak to go unreported for more than
+// maxTrashSweepInterval past the threshold.
+func (d *DiskStore) reportLeakedSnapshotsEvery(ctx context.Context) error {
+	interval := d.opts.SnapshotLeakThreshold
+	if interval > maxTrashSweepInterval {
+		interval = maxTrashSweepInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			d.reportLeakedSnapshots(now)
+		}
+	}
+}
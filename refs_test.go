@@ -0,0 +1,57 @@
+package caskdb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_pin(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	logger := &recordLogger{}
+	store, err := NewDiskStoreWithOptions(fileName, Options{MaxSegmentBytes: 100, SnapshotLeakThreshold: time.Hour, Logger: logger})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	for i := 0; i < 20; i++ {
+		store.Set(fmt.Sprintf("key-%d", i%3), fmt.Sprintf("value-%d", i))
+	}
+	_, _, closeReaders, err := store.snapshot()
+	if err != nil {
+		t.Fatalf("snapshot() error = %v", err)
+	}
+	if _, err := store.Compact(context.Background()); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	// the snapshot still reads from the segments compacted
+	if _, err := os.Stat(sealedPath(fileName, 1)); err != nil {
+		t.Errorf("segment 1 was removed under the snapshot: %v", err)
+	}
+	if snapshots := store.Debug().Snapshots; len(snapshots) != 1 || len(snapshots[0].Segments) == 0 {
+		t.Errorf("Debug().Snapshots = %+v, want the snapshot", snapshots)
+	}
+
+	store.reportLeakedSnapshots(time.Now().Add(2 * time.Hour))
+	store.reportLeakedSnapshots(time.Now().Add(3 * time.Hour))
+	reported := 0
+	for _, msg := range logger.messages {
+		if msg == "snapshot open too long" {
+			reported++
+		}
+	}
+	if reported != 1 {
+		t.Errorf("logged %v, want the leaked snapshot reported once", logger.messages)
+	}
+
+	closeReaders()
+	if _, err := os.Stat(sealedPath(fileName, 1)); !os.IsNotExist(err) {
+		t.Errorf("segment 1 is still there once the snapshot closed: %v", err)
+	}
+	if snapshots := store.Debug().Snapshots; len(snapshots) != 0 {
+		t.Errorf("Debug().Snapshots = %+v, want none", snapshots)
+	}
+}
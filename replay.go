@@ -0,0 +1,122 @@
+package caskdb
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// replayBatch is how many changes Replay merges at a time
+const replayBatch = 4096
+
+// replayLine is a line of a stream Replay applies: the union of the fields of an
+// ExportRecord, a cdc.Message and a line of caskdb audit -json.
+type replayLine struct {
+	Key       string     `json:"key"`
+	Value     string     `json:"value"`
+	Encoding  string     `json:"encoding"`
+	Timestamp time.Time  `json:"timestamp"`
+	Time      time.Time  `json:"time"`
+	Expiry    *time.Time `json:"expiry"`
+	Deleted   bool       `json:"deleted"`
+	Truncate  bool       `json:"truncate"`
+	Op        AuditOp    `json:"op"`
+	ValueSize int        `json:"value_size"`
+}
+
+// Replay applies a stream of mutations, one JSON object per line, to the store,
+// and returns the number of keys it changed. It reads the output of Export, of
+// the cdc package's NATS messages, and of caskdb audit -json -values, so that a
+// store can be restored from a dump, or a copy kept up to date from a change feed.
+//
+// The mutations are merged with last-writer-wins, as with MergeChanges, using the
+// timestamps of the stream: replaying a stream twice, or a stream overlapping one
+// replayed before, changes nothing more, and the lines may come in any order. A
+// DeleteAll in the stream is skipped, like MergeChanges does, as the keys it
+// deleted are not known. Replay stops at the first line it cannot apply, the
+// lines before it being applied.
+func (d *DiskStore) Replay(r io.Reader) (int, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	changed := 0
+	changes := make([]Change, 0, replayBatch)
+	merge := func() error {
+		n, err := d.MergeChanges(changes, MergeOptions{Node: "local", Peer: "replay"})
+		changed += n
+		changes = changes[:0]
+		return err
+	}
+	for line := 1; ; line++ {
+		var l replayLine
+		err := dec.Decode(&l)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return changed, fmt.Errorf("caskdb: replay line %d: %w", line, err)
+		}
+		change, err := l.change()
+		if err != nil {
+			return changed, fmt.Errorf("caskdb: replay line %d: %w", line, err)
+		}
+		if change.Truncate {
+			continue
+		}
+		if changes = append(changes, change); len(changes) == replayBatch {
+			if err := merge(); err != nil {
+				return changed, err
+			}
+		}
+	}
+	if len(changes) == 0 {
+		return changed, nil
+	}
+	return changed, merge()
+}
+
+// change returns the change of the line.
+func (l replayLine) change() (Change, error) {
+	if l.Truncate || l.Op == AuditDeleteAll {
+		return Change{Truncate: true}, nil
+	}
+	change := Change{Key: l.Key, Value: l.Value, Timestamp: l.Timestamp}
+	switch l.Encoding {
+	case "":
+	case "base64":
+		key, err := base64.StdEncoding.DecodeString(l.Key)
+		if err != nil {
+			return change, err
+		}
+		value, err := base64.StdEncoding.DecodeString(l.Value)
+		if err != nil {
+			return change, err
+		}
+		change.Key, change.Value = string(key), string(value)
+	default:
+		return change, fmt.Errorf("unknown encoding %q", l.Encoding)
+	}
+	if change.Timestamp.IsZero() {
+		change.Timestamp = l.Time
+	}
+	if l.Expiry != nil {
+		change.Expiry = *l.Expiry
+	}
+	change.Deleted = l.Deleted || l.Op == AuditDelete
+	switch {
+	case change.Key == "":
+		return change, errors.New("no key")
+	case change.Timestamp.IsZero():
+		return change, fmt.Errorf("key %q has no timestamp", change.Key)
+	case !change.Deleted && change.Value == "" && l.ValueSize > 0:
+		return change, fmt.Errorf("key %q has no value; audit with -values", change.Key)
+	case !change.Deleted && change.Value == "":
+		// an empty value is a delete, as with Put
+		change.Deleted = true
+	case change.Deleted:
+		change.Value = ""
+	}
+	return change, nil
+}
@@ -0,0 +1,77 @@
+package caskdb
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_Replay(t *testing.T) {
+	dir := t.TempDir()
+	source, err := NewDiskStore(filepath.Join(dir, "source.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer source.Close()
+	source.Set("othello", "shakespeare")
+	source.Set("binary", "\xff\xfe")
+	if err := source.PutWithTTL("dune", "herbert", time.Hour); err != nil {
+		t.Fatalf("PutWithTTL() error = %v", err)
+	}
+	var dump bytes.Buffer
+	if _, err := source.Export(context.Background(), &dump, ExportOptions{}); err != nil {
+		t.Fatalf("Export() error = %v", err)
+	}
+
+	store, err := NewDiskStore(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if n, err := store.Replay(bytes.NewReader(dump.Bytes())); err != nil || n != 3 {
+		t.Fatalf("Replay() = %v, %v, want 3 keys changed", n, err)
+	}
+	for _, key := range []string{"othello", "binary", "dune"} {
+		if got, want := store.Get(key), source.Get(key); got != want {
+			t.Errorf("Get(%q) = %q, want %q", key, got, want)
+		}
+	}
+	if ttl, err := store.TTL("dune"); err != nil || ttl <= 0 {
+		t.Errorf("TTL() = %v, %v, want the expiry replayed", ttl, err)
+	}
+	// again, nothing changes
+	if n, err := store.Replay(bytes.NewReader(dump.Bytes())); err != nil || n != 0 {
+		t.Errorf("Replay() again = %v, %v, want nothing changed", n, err)
+	}
+
+	// a change feed, and an audit, with a DeleteAll, a stale write and a delete
+	stream := strings.Join([]string{
+		`{"offset":0,"truncate":true,"timestamp":"2001-01-01T00:00:00Z"}`,
+		`{"offset":10,"key":"b3RoZWxsbw==","value":"aWFnbw==","timestamp":"2001-01-01T00:00:00Z","encoding":"base64"}`,
+		`{"offset":20,"time":"2100-01-01T00:00:00Z","op":"delete","key":"binary"}`,
+		`{"offset":30,"time":"2100-01-01T00:00:00Z","op":"set","key":"anathem","value_size":10,"value":"stephenson","owner":"alice"}`,
+	}, "\n")
+	if n, err := store.Replay(strings.NewReader(stream)); err != nil || n != 2 {
+		t.Fatalf("Replay() = %v, %v, want 2 keys changed", n, err)
+	}
+	if got := store.Get("othello"); got != "shakespeare" {
+		t.Errorf("Get() = %q, want the later write kept", got)
+	}
+	if store.Has("binary") || store.Get("anathem") != "stephenson" {
+		t.Errorf("Has() = %v, Get() = %q, want binary deleted and anathem set", store.Has("binary"), store.Get("anathem"))
+	}
+
+	for _, line := range []string{
+		`{"time":"2100-01-01T00:00:00Z","op":"set","key":"anathem","value_size":10}`,
+		`{"value":"herbert","timestamp":"2100-01-01T00:00:00Z"}`,
+		`{"key":"dune","value":"herbert"}`,
+		`not json`,
+	} {
+		if _, err := store.Replay(strings.NewReader(line)); err == nil {
+			t.Errorf("Replay(%s) error = nil", line)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+// Package replica serves reads from a local copy of the keys of a primary store,
+// e.g. kept up to date by merging the primary's change feed with MergeChanges, and
+// repairs the keys it finds stale as it reads them:
+//
+//	local, _ := caskdb.NewDiskStore("books-replica.db")
+//	primary, _ := client.New("http://books-1:8080", client.Options{})
+//	r := replica.New(local, primary, replica.Options{})
+//	defer r.Close()
+//	fmt.Println(r.Get("othello"))
+//
+// Every read is served from the local copy. In the background, the replica asks
+// the primary for the key, and when the primary's version was written after the
+// local one, merges it into the local copy, with its own timestamp, so the next
+// read gets it. Timestamps have a precision of a second, so two writes of the
+// primary within the same second look alike. Deletions are left to the change
+// feed: a key missing from the primary may just not have been written there yet.
+//
+// With Options.MaxLag set, the reads are bounded in staleness: once the local
+// copy lags the primary by more than MaxLag, they fail with ErrTooStale, or with
+// Options.ProxyStale, go to the primary. The lag is the time since the copy last
+// caught up with the primary, as reported with Synced by whatever keeps it up to
+// date:
+//
+//	for {
+//		start := time.Now()
+//		changes, next, _ := feed.ReadChanges(offset, 1024)
+//		local.MergeChanges(changes, caskdb.MergeOptions{Node: "replica", Peer: "primary"})
+//		if len(changes) < 1024 {
+//			// every write acknowledged before start is merged
+//			r.Synced(start)
+//		}
+//		offset = next
+//	}
+package replica
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+// DefaultMaxRepairs is the number of repairs in flight when Options.MaxRepairs is
+// not set.
+const DefaultMaxRepairs = 16
+
+// ErrTooStale is returned by the reads of a replica lagging the primary by more
+// than Options.MaxLag.
+var ErrTooStale = errors.New("replica: too stale")
+
+// Primary is the store a replica copies. *caskdb.DiskStore and *client.Client are
+// Primaries.
+type Primary interface {
+	GetEntry(key string) (caskdb.Entry, error)
+}
+
+// Options tunes a Replica. The zero value has the defaults above.
+type Options struct {
+	// MaxRepairs bounds the repairs in flight; the reads of stale keys beyond it
+	// are served without being repaired, until a later read
+	MaxRepairs int
+	// OnRepair, when set, is called after every check of a key with the primary,
+	// with whether the local copy was repaired, or the error of the primary or of
+	// the merge. It is called from the goroutine of the repair.
+	OnRepair func(key string, repaired bool, err error)
+	// MaxLag, when set, is the staleness the reads accept: once the replica lags
+	// the primary by more, they fail with ErrTooStale, or go to the primary if
+	// ProxyStale is set. A replica never Synced lags without bound.
+	MaxLag     time.Duration
+	ProxyStale bool
+}
+
+// Replica serves reads from a local store, and repairs the keys found stale from
+// the primary. It is safe to use from multiple goroutines.
+type Replica struct {
+	store   *caskdb.DiskStore
+	primary Primary
+	opts    Options
+
+	mu      sync.Mutex
+	pending map[string]bool
+	wg      sync.WaitGroup
+	// synced is when the local store last held every write of the primary
+	synced time.Time
+}
+
+var _ caskdb.Store = (*Replica)(nil)
+
+// New returns a Replica serving reads from the store, repairing it from the
+// primary.
+func New(store *caskdb.DiskStore, primary Primary, opts Options) *Replica {
+	if opts.MaxRepairs == 0 {
+		opts.MaxRepairs = DefaultMaxRepairs
+	}
+	return &Replica{store: store, primary: primary, opts: opts, pending: make(map[string]bool)}
+}
+
+func (r *Replica) Get(key string) string {
+	// Get returns the local value of the key, or an empty string if the key does
+	// not exist. Check Lookup if you need to tell apart the failures.
+	value, err := r.Lookup(key)
+	if errors.Is(err, caskdb.ErrKeyNotFound) {
+		return ""
+	}
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
+
+// Lookup is like Get, but returns the error of the store instead of panicking. A
+// key missing from the local store is checked with the primary too.
+func (r *Replica) Lookup(key string) (string, error) {
+	entry, err := r.GetEntry(key)
+	return entry.Value, err
+}
+
+// GetEntry is like Lookup, and returns the local entry of the key, check
+// caskdb.DiskStore.GetEntry. With Options.MaxLag set, it fails with ErrTooStale
+// or returns the entry of the primary when the replica lags too much.
+func (r *Replica) GetEntry(key string) (caskdb.Entry, error) {
+	if r.opts.MaxLag > 0 && r.Lag() > r.opts.MaxLag {
+		if r.opts.ProxyStale {
+			return r.primary.GetEntry(key)
+		}
+		return caskdb.Entry{}, ErrTooStale
+	}
+	entry, err := r.store.GetEntry(key)
+	found := err == nil
+	if found || errors.Is(err, caskdb.ErrKeyNotFound) {
+		r.check(key, entry, found)
+	}
+	return entry, err
+}
+
+func (r *Replica) Set(key string, value string) {
+	// Set stores the key in the local store only; the writes meant for every
+	// replica go to the primary.
+	r.store.Set(key, value)
+}
+
+// Synced records that the local store holds every write the primary acknowledged
+// before at, e.g. the time a pass merging the change feed of the primary started,
+// once it read the feed to its end. A time before that of an earlier call is
+// ignored.
+func (r *Replica) Synced(at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if at.After(r.synced) {
+		r.synced = at
+	}
+}
+
+// Lag returns how far the local store lags the primary at most: the time since it
+// was last Synced. It is unbounded, as far as a time.Duration goes, for a replica
+// never Synced.
+func (r *Replica) Lag() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.synced.IsZero() {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Since(r.synced)
+}
+
+// Wait waits for the repairs in flight to finish.
+func (r *Replica) Wait() {
+	r.wg.Wait()
+}
+
+// Close waits for the repairs in flight, and closes the local store.
+func (r *Replica) Close() bool {
+	r.Wait()
+	return r.store.Close()
+}
+
+// check starts checking the key with the primary, unless it is being checked
+// already or too many keys are.
+func (r *Replica) check(key string, local caskdb.Entry, found bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pending[key] || len(r.pending) >= r.opts.MaxRepairs {
+		return
+	}
+	r.pending[key] = true
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		repaired, err := r.repair(key, local, found)
+		r.mu.Lock()
+		delete(r.pending, key)
+		r.mu.Unlock()
+		if r.opts.OnRepair != nil {
+			r.opts.OnRepair(key, repaired, err)
+		}
+	}()
+}
+
+// repair merges the version of the key of the primary into the local store, if
+// it was written after the local one.
+func (r *Replica) repair(key string, local caskdb.Entry, found bool) (bool, error) {
+	remote, err := r.primary.GetEntry(key)
+	if errors.Is(err, caskdb.ErrKeyNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if found && !remote.Timestamp.After(local.Timestamp) {
+		return false, nil
+	}
+	change := caskdb.Change{Key: key, Value: remote.Value, Timestamp: remote.Timestamp, Expiry: remote.Expiry}
+	// "primary" sorts after "replica", so the primary wins the ties with the writes
+	// made since the check
+	n, err := r.store.MergeChanges([]caskdb.Change{change}, caskdb.MergeOptions{Node: "replica", Peer: "primary"})
+	return n > 0, err
+}
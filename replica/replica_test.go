@@ -0,0 +1,117 @@
+package replica
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	caskdb "github.com/avinassh/go-caskdb"
+	"github.com/avinassh/go-caskdb/client"
+	"github.com/avinassh/go-caskdb/server"
+)
+
+func newStore(t *testing.T) *caskdb.DiskStore {
+	store, err := caskdb.NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	return store
+}
+
+func TestReplica(t *testing.T) {
+	primary := newStore(t)
+	defer primary.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv := server.NewHTTP(primary, server.Options{})
+	go srv.Serve(ln)
+	defer srv.Shutdown(context.Background())
+	c, err := client.New("http://"+ln.Addr().String(), client.Options{})
+	if err != nil {
+		t.Fatalf("client.New() error = %v", err)
+	}
+	defer c.Close()
+
+	local := newStore(t)
+	// the replica missed the latest write of othello, and has a later write of
+	// hamlet than the primary
+	hourAgo := time.Now().Add(-time.Hour)
+	changes := []caskdb.Change{
+		{Key: "othello", Value: "moor", Timestamp: hourAgo},
+		{Key: "hamlet", Value: "ghost", Timestamp: time.Now().Add(time.Hour)},
+	}
+	if _, err := local.MergeChanges(changes, caskdb.MergeOptions{}); err != nil {
+		t.Fatalf("MergeChanges() error = %v", err)
+	}
+	primary.Set("othello", "shakespeare")
+	primary.Set("hamlet", "prince")
+	if err := primary.PutWithTTL("lear", "cordelia", time.Hour); err != nil {
+		t.Fatalf("PutWithTTL() error = %v", err)
+	}
+
+	var mu sync.Mutex
+	repairs := make(map[string]bool)
+	r := New(local, c, Options{OnRepair: func(key string, repaired bool, err error) {
+		if err != nil {
+			t.Errorf("repair of %q error = %v", key, err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		repairs[key] = repairs[key] || repaired
+	}})
+	defer r.Close()
+	for key, want := range map[string]string{"othello": "moor", "hamlet": "ghost", "lear": "", "macbeth": ""} {
+		if got := r.Get(key); got != want {
+			t.Errorf("Get(%q) = %q, want the local value %q", key, got, want)
+		}
+		r.Wait()
+	}
+	if !repairs["othello"] || repairs["hamlet"] || !repairs["lear"] || repairs["macbeth"] {
+		t.Errorf("repairs = %v, want othello and lear repaired", repairs)
+	}
+	for key, want := range map[string]string{"othello": "shakespeare", "hamlet": "ghost", "lear": "cordelia"} {
+		if got := r.Get(key); got != want {
+			t.Errorf("Get(%q) after the repairs = %q, want %q", key, got, want)
+		}
+	}
+	r.Wait()
+	entry, err := local.GetEntry("lear")
+	if err != nil || entry.Expiry.IsZero() || entry.Timestamp.Before(hourAgo.Add(time.Minute)) {
+		t.Errorf("GetEntry() = %+v, %v, want the version of the primary, expiring", entry, err)
+	}
+}
+
+func TestReplica_MaxLag(t *testing.T) {
+	primary := newStore(t)
+	defer primary.Close()
+	primary.Set("othello", "shakespeare")
+	local := newStore(t)
+	local.Set("othello", "moor")
+
+	r := New(local, primary, Options{MaxLag: time.Minute})
+	defer r.Close()
+	if _, err := r.Lookup("othello"); !errors.Is(err, ErrTooStale) {
+		t.Errorf("Lookup() of a replica never synced error = %v, want %v", err, ErrTooStale)
+	}
+	r.Synced(time.Now())
+	if got, err := r.Lookup("othello"); err != nil || got != "moor" {
+		t.Errorf("Lookup() = %q, %v, want the local value", got, err)
+	}
+	r.Wait()
+	r.Synced(time.Now().Add(-time.Hour))
+	if lag := r.Lag(); lag > time.Minute {
+		t.Errorf("Lag() = %v after an older Synced, want the newer one kept", lag)
+	}
+
+	proxy := New(local, primary, Options{MaxLag: time.Minute, ProxyStale: true})
+	proxy.Synced(time.Now().Add(-time.Hour))
+	if got, err := proxy.Lookup("othello"); err != nil || got != "shakespeare" {
+		t.Errorf("Lookup() of a stale replica = %q, %v, want the value of the primary", got, err)
+	}
+}
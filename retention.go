@@ -0,0 +1,109 @@
+package caskdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"time"
+)
+
+// retentionExpiry returns the unix time a record written at timestamp expires at
+// under Options.Retention, rounded up to the second, or 0 if it does not.
+func (d *DiskStore) retentionExpiry(timestamp uint32) uint32 {
+	if d.opts.Retention <= 0 {
+		return 0
+	}
+	seconds := int64(d.opts.Retention / time.Second)
+	if d.opts.Retention%time.Second > 0 {
+		seconds++
+	}
+	if int64(timestamp)+seconds > math.MaxUint32 {
+		return 0
+	}
+	return timestamp + uint32(seconds)
+}
+
+// retain caps the expiry of the key with Options.Retention, counted from when its
+// record was written. The keys of the records older than it thus behave as if
+// they expired, and leave keyDir the way the expired ones do, check dropExpired:
+// deleting their segments does not need to go through keyDir.
+func (d *DiskStore) retain(kEntry KeyEntry) KeyEntry {
+	if expiry := d.retentionExpiry(kEntry.timestamp); expiry != 0 && (kEntry.expiry == 0 || expiry < kEntry.expiry) {
+		kEntry.expiry = expiry
+	}
+	return kEntry
+}
+
+// dropExpiredSegments deletes the oldest sealed segments whose records are all
+// past Options.Retention. They are replaced by a segment holding only a record of
+// compactKey, as if Compact had found nothing live in them, so that the offsets
+// of the log carry on from where they ended once the store is opened again. The
+// store must be locked.
+func (d *DiskStore) dropExpiredSegments(now time.Time) {
+	if d.opts.Retention <= 0 || d.compacting {
+		// a compaction would find its segments gone, the next rotation retries
+		return
+	}
+	sealed := d.segments[:len(d.segments)-1]
+	n := 0
+	for n < len(sealed) && !sealed[n].moving && !sealed[n].latest.IsZero() {
+		expiry := d.retentionExpiry(uint32(sealed[n].latest.Unix()))
+		if expiry == 0 || now.Unix() < int64(expiry) {
+			break
+		}
+		n++
+	}
+	if n == 0 || n == 1 && sealed[0].compacted && sealed[0].size <= compactMarkerSize {
+		// nothing, or the record left by the previous time
+		return
+	}
+	if err := d.replaceExpired(sealed[:n], now); err != nil {
+		d.log.Error("failed to delete expired segments", "file", sealed[n-1].path, "error", err)
+	}
+}
+
+// replaceExpired puts the segment holding the record of compactKey in place of
+// the expired ones. The store must be locked.
+func (d *DiskStore) replaceExpired(expired []*segment, now time.Time) error {
+	end := d.logBase
+	for _, seg := range expired {
+		end += seg.skipped + seg.size
+	}
+	last := expired[len(expired)-1]
+	// the marker ends where the expired segments did
+	offset := end - int64(headerSize+len(compactKey)+len("00000000000000000000 0000000000"))
+	_, marker := encodeRecord(uint32(now.Unix()), 0, compactKey, fmt.Sprintf("%020d %010d", offset, expired[0].id))
+	for _, seg := range expired {
+		if seg.file != nil {
+			seg.file.Close()
+			seg.file = nil
+		}
+	}
+	if err := writeFileSync(last.path, bytes.NewReader(marker)); err != nil {
+		return err
+	}
+	if last.remote {
+		// the object in cold storage is left where it is, like DeleteAll does
+		if err := os.Remove(last.path + remoteIndexSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			d.log.Error("failed to delete segment", "file", last.path+remoteIndexSuffix, "error", err)
+		}
+	}
+	// the records kept are those of the marker only
+	replaced := &segment{id: last.id, path: last.path, size: int64(len(marker)), compacted: true, marks: []uint32{0}, latest: last.latest}
+	last.removed = true
+	d.removeSegments(expired[:len(expired)-1])
+	d.segments = append([]*segment{replaced}, d.segments[len(expired):]...)
+	d.logBase = offset
+	d.coldCache.clear()
+	// the keys referencing them expired along with them
+	for id, b := range d.blobs {
+		if b.at.segment <= last.id {
+			delete(d.blobs, id)
+		}
+	}
+	d.log.Info("deleted expired segments", "segments", len(expired), "offset", d.logBase)
+	return nil
+}
@@ -0,0 +1,84 @@
+package caskdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_Retention(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{MaxSegmentBytes: 100}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	// a few segments written two hours ago, then some written now
+	old := uint32(time.Now().Add(-2 * time.Hour).Unix())
+	for i := 0; i < 6; i++ {
+		if _, err := store.putAt(fmt.Sprintf("old-%d", i), "yesterday's news", old, 0, "", 0); err != nil {
+			t.Fatalf("putAt() error = %v", err)
+		}
+	}
+	for i := 0; i < 6; i++ {
+		store.Set(fmt.Sprintf("new-%d", i), "today's news")
+	}
+	before := store.Stats().Bytes
+	_, end, err := store.ReadChanges(0, 1000)
+	if err != nil {
+		t.Fatalf("ReadChanges() error = %v", err)
+	}
+	store.Close()
+
+	opts.Retention = time.Hour
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	if value := store.Get("old-0"); value != "" {
+		t.Errorf("Get(old-0) = %q past the retention, want none", value)
+	}
+	if value := store.Get("new-0"); value != "today's news" {
+		t.Errorf("Get(new-0) = %q, want today's news", value)
+	}
+	if store.Stats().Bytes >= before {
+		t.Errorf("Stats().Bytes = %d, want less than %d once the old segments are deleted", store.Stats().Bytes, before)
+	}
+	store.Close()
+	if _, err := os.Stat(sealedPath(fileName, 1)); !os.IsNotExist(err) {
+		t.Errorf("the oldest segment is still there: %v", err)
+	}
+
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	changes, again, err := store.ReadChanges(0, 1000)
+	if err != nil || again != end {
+		t.Errorf("ReadChanges() after reopening ends at %d, %v, want %d", again, err, end)
+	}
+	seen := make(map[string]string)
+	replay(seen, changes)
+	if len(seen) != 6 || seen["new-5"] != "today's news" {
+		t.Errorf("replaying the changes = %v, want the 6 new keys", seen)
+	}
+	if keys := store.Keys(); len(keys) != 6 {
+		t.Errorf("Keys() = %v, want the 6 new keys", keys)
+	}
+}
+
+func TestDiskStore_RetentionExpiry(t *testing.T) {
+	store := &DiskStore{opts: Options{Retention: 90 * time.Minute}}
+	kEntry := store.retain(NewKeyEntry(1000, 0, 0))
+	if kEntry.expiry != 1000+5400 {
+		t.Errorf("retain() expiry = %d, want %d", kEntry.expiry, 1000+5400)
+	}
+	kEntry = NewKeyEntry(1000, 0, 0)
+	kEntry.expiry = 2000
+	if got := store.retain(kEntry).expiry; got != 2000 {
+		t.Errorf("retain() of a key expiring sooner = %d, want 2000", got)
+	}
+}
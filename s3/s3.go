@@ -0,0 +1,202 @@
+// Package s3 is a minimal client for S3 and the object stores compatible with it,
+// such as MinIO. It covers what CaskDB needs to keep data off the machine, i.e.
+// uploading objects and reading ranges of them back, and signs the requests with AWS Signature Version 4. Buckets
+// are addressed path-style, as https://endpoint/bucket/key, which every S3
+// compatible store supports.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	amzDateFormat  = "20060102T150405Z"
+	signingAlgo    = "AWS4-HMAC-SHA256"
+	signingService = "s3"
+)
+
+// Client talks to a bucket.
+type Client struct {
+	// Endpoint is the base URL of the service, e.g. https://s3.eu-west-1.amazonaws.com
+	// or http://localhost:9000 for a local MinIO
+	Endpoint string
+	// Region is the region of the bucket, e.g. eu-west-1; us-east-1 for MinIO
+	Region string
+	Bucket string
+	// AccessKey and SecretKey are the credentials to sign the requests with, and
+	// SessionToken the token going with temporary ones
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	// HTTPClient sends the requests. When nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+}
+
+// Error is the error returned by the service.
+type Error struct {
+	StatusCode int
+	// Body is the body of the response, an XML document with the details
+	Body string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+// Put uploads data as the object named key, replacing it if it exists.
+func (c *Client) Put(ctx context.Context, key string, data []byte) error {
+	resp, err := c.do(ctx, http.MethodPut, key, data, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// GetRange downloads n bytes of the object named key, starting at offset.
+func (c *Client) GetRange(ctx context.Context, key string, offset int64, n int64) ([]byte, error) {
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+n-1)}}
+	resp, err := c.do(ctx, http.MethodGet, key, nil, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(io.LimitReader(resp.Body, n))
+}
+
+// do sends a signed request for the object and returns the response, or an
+// *Error if the service did not answer with a 2xx.
+func (c *Client) do(ctx context.Context, method string, key string, body []byte, header http.Header) (*http.Response, error) {
+	if c.Endpoint == "" || c.Bucket == "" {
+		return nil, errors.New("s3: Client.Endpoint and Client.Bucket are required")
+	}
+	u := strings.TrimSuffix(c.Endpoint, "/") + "/" + c.Bucket + "/" + escapePath(key)
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	c.sign(req, body, time.Now())
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		return nil, &Error{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(data))}
+	}
+	return resp, nil
+}
+
+// sign adds the Signature Version 4 Authorization header to the request. Every
+// header already set on the request is signed along with the host.
+func (c *Client) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format(amzDateFormat)
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	date := now.Format("20060102")
+	scope := date + "/" + c.Region + "/" + signingService + "/aws4_request"
+	stringToSign := strings.Join([]string{signingAlgo, amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.SecretKey), date)
+	key = hmacSHA256(key, c.Region)
+	key = hmacSHA256(key, signingService)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		signingAlgo, c.AccessKey, scope, signedHeaders, signature))
+}
+
+// canonicalQuery encodes the query the way Signature Version 4 wants it: sorted by
+// name, then value, with every character but the unreserved ones escaped.
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, escape(name, true)+"="+escape(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// escapePath escapes the object key for the URL, keeping its slashes.
+func escapePath(key string) string {
+	return escape(key, false)
+}
+
+// escape percent-encodes every byte but the unreserved characters, and the
+// slashes unless escapeSlash is set.
+func escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case 'A' <= ch && ch <= 'Z', 'a' <= ch && ch <= 'z', '0' <= ch && ch <= '9',
+			ch == '-', ch == '_', ch == '.', ch == '~', ch == '/' && !escapeSlash:
+			b.WriteByte(ch)
+		default:
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
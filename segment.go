@@ -0,0 +1,583 @@
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The log of a store is split in segments. New records are appended to the active
+// segment, which is the file the store was opened with, e.g. books.db. Once it
+// grows past Options.MaxSegmentBytes, it is sealed: renamed to books.db.000001, the
+// next one to books.db.000002 and so on, and a new active file is started. Sealed
+// segments are never written to again. With Options.SegmentPeriod, the active
+// segment is also sealed when a write comes in a later period than its first
+// record.
+//
+// A store which never rotated is a single file, which is how every store was laid
+// out before segments, and such a file opens unchanged.
+
+// segmentIDDigits is how many digits a sealed segment's number is padded to, so
+// that the file names sort in the order of the segments
+const segmentIDDigits = 6
+
+// remoteIndexSuffix is appended to the name of a sealed segment for the index we
+// keep locally once the segment itself has moved to cold storage
+const remoteIndexSuffix = ".remote"
+
+// segment is a data file of the store.
+type segment struct {
+	// id orders the segments: records in a segment with a higher id were written
+	// after those in a lower one
+	id uint32
+	// path is the local path of the segment's file; for a remote segment, the file
+	// no longer exists and path is what it was called
+	path string
+	// size is the number of bytes of records in a sealed segment; the size of the
+	// active one is writePosition
+	size int64
+	// file is a read handle, opened on the first read of a sealed segment; for
+	// the active segment it is the store's own file
+	file *os.File
+	// remote is set once the segment was moved to Options.ColdStorage
+	remote bool
+	// moving is set while the segment is being moved to Options.ColdDir
+	moving bool
+	// removed is set once DeleteAll or Compact dropped the segment
+	removed bool
+	// compacted is set for a segment written by Compact, and marks then holds the
+	// position of every compactionMarkInterval-th record in it, for alignOffset
+	compacted bool
+	marks     []uint32
+	// skipped is the number of bytes of the log before the segment which Compact
+	// freed, when it compacted segments after the oldest one
+	skipped int64
+	// started and latest are the times of the first and of the newest record of
+	// the segment, zero while it has none, for Options.SegmentPeriod and
+	// Options.Retention
+	started time.Time
+	latest  time.Time
+}
+
+// mark notes the n-th record of the segment, at offset, while loading it.
+func (s *segment) mark(n int, offset int, key string) {
+	if n == 0 && (key == compactKey || key == compactRangeKey) {
+		s.compacted = true
+	}
+	if s.compacted && n%compactionMarkInterval == 0 {
+		s.marks = append(s.marks, uint32(offset))
+	}
+}
+
+// age notes the timestamp of the n-th record of the segment while loading it.
+func (s *segment) age(n int, timestamp uint32) {
+	t := time.Unix(int64(timestamp), 0)
+	if n == 0 {
+		s.started = t
+	}
+	if t.After(s.latest) {
+		s.latest = t
+	}
+}
+
+// name is the name of the segment's file, which is also the name of its object in
+// cold storage.
+func (s *segment) name() string {
+	return filepath.Base(s.path)
+}
+
+// sealedPath returns the path of the sealed segment with the id.
+func sealedPath(fileName string, id uint32) string {
+	return fmt.Sprintf("%s.%0*d", fileName, segmentIDDigits, id)
+}
+
+// findSegments returns the sealed segments of the store whose active file is
+// fileName, ordered by id, looking for them next to it and in coldDir, if set. A
+// sealed segment found only as a remote index is returned as remote.
+func findSegments(fileName string, coldDir string) ([]*segment, error) {
+	dirs := []string{filepath.Dir(fileName)}
+	if coldDir != "" {
+		// a segment found in both directories was being moved when we stopped, and
+		// the copy next to the active file is the one known to be complete
+		dirs = []string{coldDir, filepath.Dir(fileName)}
+	}
+	byID := make(map[uint32]*segment)
+	for _, dir := range dirs {
+		base := filepath.Join(dir, filepath.Base(fileName))
+		matches, err := filepath.Glob(globEscape(base) + ".*")
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			suffix := strings.TrimPrefix(match, base+".")
+			remote := strings.HasSuffix(suffix, remoteIndexSuffix)
+			suffix = strings.TrimSuffix(suffix, remoteIndexSuffix)
+			id, err := strconv.ParseUint(suffix, 10, 32)
+			if err != nil || id == 0 {
+				// not one of ours, e.g. books.db.cdc-cursor
+				continue
+			}
+			seg, ok := byID[uint32(id)]
+			if !ok {
+				seg = &segment{id: uint32(id), path: sealedPath(base, uint32(id)), remote: true}
+				byID[seg.id] = seg
+			}
+			// if both the data file and the remote index exist, we crashed before
+			// deleting the local copy after an upload; the local copy wins
+			if !remote {
+				seg.remote = false
+				seg.path = sealedPath(base, uint32(id))
+			}
+		}
+	}
+	segments := make([]*segment, 0, len(byID))
+	for _, seg := range byID {
+		segments = append(segments, seg)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].id < segments[j].id })
+	return segments, nil
+}
+
+// globEscape escapes the characters filepath.Glob treats as special.
+func globEscape(path string) string {
+	var b strings.Builder
+	for _, ch := range path {
+		if strings.ContainsRune(`*?[\`, ch) && filepath.Separator != '\\' {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(ch)
+	}
+	return b.String()
+}
+
+// segment returns the segment with the id, or nil if there is none.
+func (d *DiskStore) segment(id uint32) *segment {
+	i := sort.Search(len(d.segments), func(i int) bool { return d.segments[i].id >= id })
+	if i < len(d.segments) && d.segments[i].id == id {
+		return d.segments[i]
+	}
+	return nil
+}
+
+// active returns the segment new records are appended to.
+func (d *DiskStore) active() *segment {
+	return d.segments[len(d.segments)-1]
+}
+
+// loadSegment reads the records of a local segment into keyDir, oldest first,
+// from seg.file if set or else from seg.path, starting at seg.size: a read-only
+// store carries on from where it stopped, check Refresh. A partially written
+// record at the tail, most likely from crashing in the middle of a write, is cut
+// off: it was never acknowledged, and our appends would otherwise land after it.
+// A read-only store leaves it be, as the writer may still be appending it, and
+// keeps the file open as seg.file, so that it reads the records from the file it
+// loaded even once the writer replaced it, e.g. with Compact.
+func (d *DiskStore) loadSegment(seg *segment) error {
+	return d.scanSegment(seg, nil)
+}
+
+// scanSegment is loadSegment, appending the hint of every record to hint if set,
+// check loadSealed.
+func (d *DiskStore) scanSegment(seg *segment, hint *[]byte) error {
+	file := seg.file
+	if file == nil {
+		f, err := openFile(seg.path, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		if d.readOnly {
+			seg.file = f
+		} else {
+			defer f.Close()
+		}
+		file = f
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	from := seg.size
+	if from == 0 {
+		// a file of an older layout must be left as it is, rather than cut off at
+		// what looks like a partial record
+		if version := legacyFormat(file, info.Size()); version != 0 {
+			return fmt.Errorf("%w: %s is version %d, check UpgradeFormat", ErrUnsupportedFormat, seg.path, version)
+		}
+	}
+	l := d.newSegmentLoader(seg)
+	size := info.Size() - from
+	err = scanRecords(io.NewSectionReader(file, from, size), size, func(offset int, data []byte) error {
+		offset += int(from)
+		if !verifyKV(data) {
+			d.log.Error("corrupt record", "file", seg.path, "offset", offset)
+			return fmt.Errorf("%w: %s offset %d", ErrCorruptRecord, seg.path, offset)
+		}
+		if flags := decodeFlags(data); flags&^supportedFlags != 0 {
+			return fmt.Errorf("%w: %s offset %d is %v", ErrUnsupportedRecord, seg.path, offset, flags)
+		}
+		_, key, value := decodeKV(data)
+		switch flags := decodeFlags(data); {
+		case flags&FlagEncrypted != 0:
+			// decrypting every record would slow the start down, so only the key is
+			// checked
+			value, err := storedValue(data)
+			if err == nil {
+				err = d.checkEncrypted(value)
+			}
+			if err != nil {
+				return fmt.Errorf("%s offset %d: %w", seg.path, offset, err)
+			}
+		case flags&FlagCompressed != 0:
+			if _, err := d.decodeValue(data); err != nil {
+				return fmt.Errorf("%s offset %d: %w", seg.path, offset, err)
+			}
+		}
+		if hint != nil {
+			*hint = appendHint(*hint, data)
+		}
+		return l.load(offset, data[:headerSize], key, value)
+	})
+	if l.pending != nil && (err == nil || errors.Is(err, errPartialRecord)) {
+		// seg.size is where the intent starts, so a store following the file
+		// reads it again on Refresh, when it may have ended
+		if d.readOnly {
+			return nil
+		}
+		d.log.Warn("truncating incomplete commit", "file", seg.path, "offset", seg.size, "records", len(l.pending)-1)
+		return os.Truncate(seg.path, seg.size)
+	}
+	if errors.Is(err, errPartialRecord) && d.readOnly {
+		return nil
+	}
+	if errors.Is(err, errPartialRecord) {
+		d.log.Warn("truncating partially written record", "file", seg.path, "offset", seg.size)
+		return os.Truncate(seg.path, seg.size)
+	}
+	return err
+}
+
+// segmentLoader applies the records of a segment to keyDir, in order, from a scan
+// of the segment or from its hint file.
+type segmentLoader struct {
+	d   *DiskStore
+	seg *segment
+	now time.Time
+	// records counts the records applied: only the first record of a segment
+	// counts for age and mark, and a tail never starts at it
+	records int
+	// pending holds the records of an intent until its end, check intentKey
+	pending []func()
+}
+
+func (d *DiskStore) newSegmentLoader(seg *segment) *segmentLoader {
+	l := &segmentLoader{d: d, seg: seg, now: time.Now()}
+	if seg.size > 0 {
+		l.records = 1
+	}
+	return l
+}
+
+// load applies the record at offset, of which it gets the header, the key, and
+// the value if the record is one hintValue holds.
+func (l *segmentLoader) load(offset int, header []byte, key string, value string) error {
+	d, seg := l.d, l.seg
+	timestamp, keySize, valueSize := decodeHeader(header)
+	size := headerSize + int(keySize) + int(valueSize)
+	if isDictKey(key) {
+		if err := d.addDictionary(key, value); err != nil {
+			return fmt.Errorf("%s offset %d: %w", seg.path, offset, err)
+		}
+	}
+	if isStoreKey(key) {
+		if err := d.loadStoreID(key); err != nil {
+			return fmt.Errorf("%s offset %d: %w", seg.path, offset, err)
+		}
+	}
+	if isFormatKey(key) {
+		if err := checkFormat(key); err != nil {
+			return fmt.Errorf("%s offset %d: %w", seg.path, offset, err)
+		}
+	}
+	kEntry := NewKeyEntry(timestamp, uint32(offset), uint32(size))
+	kEntry.segment = seg.id
+	kEntry.expiry = decodeExpiry(header)
+	if decodeFlags(header)&FlagDedup != 0 {
+		if !validBlobID(value) {
+			return fmt.Errorf("%w: %s offset %d references no blob", ErrCorruptRecord, seg.path, offset)
+		}
+		kEntry.blob = d.refBlob(value)
+	}
+	apply := func() {
+		d.index(key, kEntry, valueSize == 0, l.now)
+		seg.size = int64(offset + size)
+		if isFormatKey(key) {
+			// part of the file, which tells nothing of the age of its records
+			return
+		}
+		seg.age(l.records, timestamp)
+		seg.mark(l.records, offset, key)
+		l.records++
+	}
+	// the records of an intent wait for its end; a second intent drops those of
+	// one which never ended
+	switch {
+	case key == intentKey:
+		l.pending = []func(){apply}
+	case l.pending != nil && key == intentEndKey && value == intentAbort:
+		l.pending = nil
+		seg.size = int64(offset + size)
+	case l.pending != nil:
+		l.pending = append(l.pending, apply)
+		if key == intentEndKey {
+			for _, apply := range l.pending {
+				apply()
+			}
+			l.pending = nil
+		}
+	default:
+		apply()
+	}
+	return nil
+}
+
+// index applies a record read back from the log to keyDir.
+func (d *DiskStore) index(key string, kEntry KeyEntry, tombstone bool, now time.Time) {
+	kEntry = d.retain(kEntry)
+	if key == truncateKey || key == compactKey {
+		// everything written before is gone, or was written again after it
+		d.resetKeys()
+		d.baseAt = kEntry
+		d.mergedAt = nil
+		return
+	}
+	if key == compactRangeKey {
+		d.mergedAt = append(d.mergedAt, kEntry)
+		return
+	}
+	if isDictKey(key) {
+		// a dictionary, not a key, which loadSegment picked up
+		return
+	}
+	if isBlobKey(key) {
+		d.locateBlob(key, kEntry)
+		return
+	}
+	if isIntentKey(key) {
+		// the bounds of a commit, which loadSegment took care of
+		return
+	}
+	if isEpochKey(key) {
+		d.loadEpoch(key)
+		return
+	}
+	if isStoreKey(key) || isFormatKey(key) {
+		// the identity of the store, or the version of the file, which loadSegment
+		// checked
+		return
+	}
+	if isTokenKey(key) {
+		// not a key, but an idempotency token recorded along with a write
+		if !kEntry.expired(now) {
+			d.tokens[strings.TrimPrefix(key, tokenKeyPrefix)] = kEntry.expiry
+		}
+		return
+	}
+	d.reportLoad(key, kEntry, tombstone)
+	if tombstone || kEntry.expired(now) {
+		// a tombstone, the key was deleted, or it expired while we were down
+		d.dropKey(key)
+		return
+	}
+	d.setKey(key, kEntry)
+}
+
+// rotate seals the active segment and starts a new one. The store must be locked.
+func (d *DiskStore) rotate() error {
+	active := d.active()
+	fileName := d.file.Name()
+	sealed := sealedPath(fileName, active.id)
+	// the writes left for the next sync are synced first, so closing loses nothing
+	if d.unsynced {
+		if err := d.syncFile(); err != nil {
+			return err
+		}
+	}
+	if err := d.file.Close(); err != nil {
+		return err
+	}
+	renameErr := renameFile(fileName, sealed)
+	file, err := openFile(fileName, d.openFlags(), 0666)
+	if err != nil {
+		return err
+	}
+	d.file = file
+	if renameErr != nil {
+		// carry on appending to the segment we have
+		d.log.Error("failed to seal segment", "file", fileName, "error", renameErr)
+		active.file = file
+		return renameErr
+	}
+	active.path, active.size, active.file = sealed, int64(d.writePosition), nil
+	d.segments = append(d.segments, &segment{id: active.id + 1, path: fileName, file: file})
+	d.writePosition = 0
+	d.log.Info("sealed segment", "file", sealed, "size", active.size)
+	d.demote(active)
+	d.dropExpiredSegments(time.Now())
+	return nil
+}
+
+// Rotate seals the active file and starts a new one, whatever its size, e.g. to
+// have every write so far in a sealed segment before a backup or before shipping
+// the segments. It does nothing when the active file has no records yet.
+func (d *DiskStore) Rotate() error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.loadErr != nil {
+		return d.loadErr
+	}
+	if d.writePosition == 0 {
+		return nil
+	}
+	return d.rotate()
+}
+
+// openSegment returns the read handle of a local sealed segment, opening it on
+// first use. The handle is kept until the store is closed.
+func (d *DiskStore) openSegment(seg *segment) (*os.File, error) {
+	if seg.file == nil {
+		file, err := openFile(seg.path, os.O_RDONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		seg.file = file
+	}
+	return seg.file, nil
+}
+
+// logSize returns the size of the log, i.e. the offset the next record lands at.
+// Offsets in the log count from the start of the oldest segment, as if the
+// segments were a single file, so they keep growing across rotations. Segments
+// removed by DeleteAll or Compact keep counting, from logBase, and so do the bytes
+// Compact skipped.
+func (d *DiskStore) logSize() int64 {
+	size := d.logBase
+	for _, seg := range d.segments[:len(d.segments)-1] {
+		size += seg.skipped + seg.size
+	}
+	return size + int64(d.writePosition)
+}
+
+// diskSize returns the number of bytes in the segments of the store.
+func (d *DiskStore) diskSize() int64 {
+	var size int64
+	for _, seg := range d.segments[:len(d.segments)-1] {
+		size += seg.size
+	}
+	return size + int64(d.writePosition)
+}
+
+// logReader reads a range of the log. It reads from handles of its own, so that
+// it can be used after unlocking the store: sealed segments do not change, and the
+// active one is only appended to.
+type logReader struct {
+	io.Reader
+	files []*os.File
+	// starts holds the offset in the log of every segment read, and ends where
+	// each ends in what is read, as the bytes skipped by Compact are not
+	starts, ends []int64
+}
+
+// offset returns the offset in the log of the byte at pos in what is read.
+func (r *logReader) offset(pos int) int64 {
+	i := sort.Search(len(r.ends), func(i int) bool { return r.ends[i] > int64(pos) })
+	if i == len(r.ends) {
+		i--
+	}
+	if i > 0 {
+		return r.starts[i] + int64(pos) - r.ends[i-1]
+	}
+	return r.starts[0] + int64(pos)
+}
+
+func (r *logReader) Close() error {
+	for _, file := range r.files {
+		file.Close()
+	}
+	return nil
+}
+
+// openLog returns a reader over the log from offset to end. An offset before
+// logBase, in segments which were removed, reads from logBase, and one in bytes
+// skipped by Compact from the segment after them. The store must be locked.
+func (d *DiskStore) openLog(offset int64, end int64) (*logReader, error) {
+	r := &logReader{}
+	var readers []io.Reader
+	start := d.logBase
+	for i, seg := range d.segments {
+		size := seg.size
+		if i == len(d.segments)-1 {
+			size = int64(d.writePosition)
+		}
+		start += seg.skipped
+		from, to := offset-start, end-start
+		start += size
+		if from < 0 {
+			from = 0
+		}
+		if to > size {
+			to = size
+		}
+		if from >= to {
+			continue
+		}
+		ra, file, err := d.openReaderAt(seg)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		if file != nil {
+			r.files = append(r.files, file)
+		}
+		readers = append(readers, io.NewSectionReader(ra, from, to-from))
+		read := to - from
+		if len(r.ends) > 0 {
+			read += r.ends[len(r.ends)-1]
+		}
+		r.starts, r.ends = append(r.starts, start-size+from), append(r.ends, read)
+	}
+	r.Reader = io.MultiReader(readers...)
+	return r, nil
+}
+
+// openReaderAt returns a reader over the segment for use after unlocking the
+// store, along with the file to close once done, if it opened one. The store must
+// be locked.
+func (d *DiskStore) openReaderAt(seg *segment) (io.ReaderAt, *os.File, error) {
+	if seg.remote {
+		return remoteReaderAt{d.opts.ColdStorage, d.coldName(seg)}, nil, nil
+	}
+	file, err := openFile(seg.path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, file, nil
+}
+
+// closeSegments closes the read handles of the sealed segments.
+func (d *DiskStore) closeSegments() {
+	for _, seg := range d.segments[:len(d.segments)-1] {
+		if seg.file != nil {
+			seg.file.Close()
+			seg.file = nil
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package caskdb
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_rotate(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	recordSize, _ := encodeKV(0, "othello", "shakespeare")
+	opts := Options{MaxSegmentBytes: int64(2 * recordSize)}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	books := map[string]string{
+		"othello":   "shakespeare",
+		"hamlet":    "shakespeare",
+		"macbeth":   "shakespeare",
+		"dune":      "herbert",
+		"emma":      "austen",
+		"ulysses":   "joyce",
+		"lolita":    "nabokov",
+		"the trial": "kafka",
+	}
+	for key, value := range books {
+		store.Set(key, value)
+	}
+	store.Delete("dune")
+	delete(books, "dune")
+	if len(store.segments) < 3 {
+		t.Fatalf("segments = %v, want the log split in segments of %v bytes", len(store.segments), opts.MaxSegmentBytes)
+	}
+	if _, err := os.Stat(sealedPath(fileName, 1)); err != nil {
+		t.Errorf("sealed segment 1 is missing: %v", err)
+	}
+	for key, value := range books {
+		if got := store.Get(key); got != value {
+			t.Errorf("Get(%q) = %v, want %v", key, got, value)
+		}
+	}
+	var log bytes.Buffer
+	if _, err := store.CopyLog(&log, 0, 1<<20); err != nil {
+		t.Fatalf("CopyLog() error = %v", err)
+	}
+	if int64(log.Len()) != store.Stats().Bytes {
+		t.Errorf("CopyLog() copied %v bytes, want %v", log.Len(), store.Stats().Bytes)
+	}
+	store.Close()
+
+	// the keys are loaded back from all the segments, the newest record winning
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	for key, value := range books {
+		if got := store.Get(key); got != value {
+			t.Errorf("Get(%q) after reopening = %v, want %v", key, got, value)
+		}
+	}
+	if got := store.Get("dune"); got != "" {
+		t.Errorf("Get(dune) after reopening = %v, want it deleted", got)
+	}
+	changes, _, err := store.ReadChanges(0, 100)
+	if err != nil {
+		t.Fatalf("ReadChanges() error = %v", err)
+	}
+	if len(changes) != len(books)+2 {
+		t.Errorf("ReadChanges() returned %v changes, want %v", len(changes), len(books)+2)
+	}
+}
+
+func TestDiskStore_rotateByPeriod(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{SegmentPeriod: 24 * time.Hour}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("othello", "shakespeare")
+	store.Set("hamlet", "shakespeare")
+	if len(store.segments) != 1 {
+		t.Errorf("segments = %v after writes within the day, want 1", len(store.segments))
+	}
+	store.Close()
+
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	if started := store.active().started; time.Since(started) > time.Minute {
+		t.Errorf("active segment started at %v after reopening, want the time of its first record", started)
+	}
+	// as if the first records were written yesterday
+	store.active().started = store.active().started.Add(-24 * time.Hour)
+	store.Set("dune", "herbert")
+	if len(store.segments) != 2 {
+		t.Fatalf("segments = %v after a write the next day, want 2", len(store.segments))
+	}
+	store.Set("emma", "austen")
+	if len(store.segments) != 2 || store.Get("othello") != "shakespeare" || store.Get("emma") != "austen" {
+		t.Errorf("segments = %v after another write that day, want 2 and every key", len(store.segments))
+	}
+}
+
+func TestDiskStore_Rotate(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	// an empty active file is left as it is
+	if err := store.Rotate(); err != nil || len(store.segments) != 1 {
+		t.Errorf("Rotate() of an empty store = %v, %v segments, want nil, 1", err, len(store.segments))
+	}
+	store.Set("othello", "shakespeare")
+	if err := store.Rotate(); err != nil {
+		t.Fatalf("Rotate() error = %v", err)
+	}
+	if _, err := os.Stat(sealedPath(fileName, 1)); err != nil || len(store.segments) != 2 || store.writePosition != 0 {
+		t.Errorf("Rotate() left %v segments, %v, want segment 1 sealed", len(store.segments), err)
+	}
+	store.Set("hamlet", "shakespeare")
+	if store.Get("othello") != "shakespeare" || store.Get("hamlet") != "shakespeare" {
+		t.Errorf("Get() after Rotate() = %q, %q, want both keys", store.Get("othello"), store.Get("hamlet"))
+	}
+}
+
+func Test_findSegments(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "test.db")
+	for _, name := range []string{"test.db", "test.db.000002", "test.db.000001.remote", "test.db.000001", "test.db.000003.remote", "test.db.cdc-cursor"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	segments, err := findSegments(fileName, "")
+	if err != nil {
+		t.Fatalf("findSegments() error = %v", err)
+	}
+	want := []struct {
+		id     uint32
+		remote bool
+	}{{1, false}, {2, false}, {3, true}}
+	if len(segments) != len(want) {
+		t.Fatalf("findSegments() returned %v segments, want %v", len(segments), len(want))
+	}
+	for i, seg := range segments {
+		if seg.id != want[i].id || seg.remote != want[i].remote {
+			t.Errorf("findSegments()[%d] = %v remote %v, want %v remote %v", i, seg.id, seg.remote, want[i].id, want[i].remote)
+		}
+	}
+}
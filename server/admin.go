@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+// adminPath is the URL path the admin operations live under
+const adminPath = "/admin/"
+
+// errBackupsDisabled is returned by a backup when Options.BackupDir is not set.
+var errBackupsDisabled = errors.New("backups are disabled, set a backup directory")
+
+// backup copies the store of the namespace to a new file in Options.BackupDir,
+// named after the namespace and the time, and returns its path.
+func backup(opts Options, store *caskdb.DiskStore, namespace string) (string, error) {
+	if opts.BackupDir == "" {
+		return "", errBackupsDisabled
+	}
+	name := fmt.Sprintf("%s-%s.db", namespace, time.Now().UTC().Format("20060102T150405.000000000Z"))
+	path := filepath.Join(opts.BackupDir, name)
+	return path, store.CopyTo(path)
+}
+
+// adminResult is the JSON encoding of the result of an admin operation.
+type adminResult struct {
+	FreedBytes int64  `json:"freed_bytes,omitempty"`
+	Path       string `json:"path,omitempty"`
+}
+
+func (s *HTTPServer) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	s.serveAdmin(w, r, DefaultNamespace, strings.TrimPrefix(r.URL.Path, adminPath))
+}
+
+// serveAdmin runs an admin operation on the store of the namespace:
+//
+//	POST /admin/compact  compacts the store, check caskdb.DiskStore.Compact
+//	POST /admin/sync     flushes the store to the disk
+//	POST /admin/rotate   seals the active file, check caskdb.DiskStore.Rotate
+//	POST /admin/backup   copies the store to Options.BackupDir
+//	GET  /admin/stats    returns the store's Stats as JSON
+//
+// A compaction stops when the client goes away, and the next one resumes it.
+func (s *HTTPServer) serveAdmin(w http.ResponseWriter, r *http.Request, namespace string, op string) {
+	method := http.MethodPost
+	if op == "stats" {
+		method = http.MethodGet
+	}
+	switch op {
+	case "compact", "sync", "rotate", "backup", "stats":
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorizeUser(w, r, func(u *User) bool { return u.canAdmin(namespace) }) {
+		return
+	}
+	store, ok := s.store(w, namespace, false)
+	if !ok {
+		return
+	}
+	var result adminResult
+	var err error
+	switch op {
+	case "compact":
+		result.FreedBytes, err = store.Compact(r.Context())
+	case "sync":
+		err = store.Sync()
+	case "rotate":
+		err = store.Rotate()
+	case "backup":
+		result.Path, err = backup(s.opts, store, namespace)
+	case "stats":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(store.Stats())
+		return
+	}
+	switch {
+	case errors.Is(err, caskdb.ErrCompacting):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, errBackupsDisabled):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// admin checks that the client may run admin operations on the current
+// namespace, and returns its store, writing the error reply if not.
+func (c *respConn) admin() (*caskdb.DiskStore, bool) {
+	if c.user != nil && !c.user.canAdmin(c.namespace) {
+		c.w.writeError("NOPERM this user has no permissions to run admin commands")
+		return nil, false
+	}
+	store, ok := c.store(false)
+	if ok && store == nil {
+		c.w.writeError("ERR " + ErrNamespaceNotFound.Error())
+		return nil, false
+	}
+	return store, ok
+}
+
+// cmdCompact compacts the store, and replies with the number of bytes freed. The
+// compaction runs to its end, even if the client goes away.
+func cmdCompact(c *respConn, args []string) {
+	store, ok := c.admin()
+	if !ok {
+		return
+	}
+	freed, err := store.Compact(context.Background())
+	if err != nil {
+		c.w.writeError("ERR " + err.Error())
+		return
+	}
+	c.w.writeInt(freed)
+}
+
+// cmdFsync flushes the store to the disk.
+func cmdFsync(c *respConn, args []string) {
+	store, ok := c.admin()
+	if !ok {
+		return
+	}
+	if err := store.Sync(); err != nil {
+		c.w.writeError("ERR " + err.Error())
+		return
+	}
+	c.w.writeSimple("OK")
+}
+
+// cmdRotate seals the active file of the store.
+func cmdRotate(c *respConn, args []string) {
+	store, ok := c.admin()
+	if !ok {
+		return
+	}
+	if err := store.Rotate(); err != nil {
+		c.w.writeError("ERR " + err.Error())
+		return
+	}
+	c.w.writeSimple("OK")
+}
+
+// cmdBackup copies the store to Options.BackupDir, and replies with the path of
+// the copy.
+func cmdBackup(c *respConn, args []string) {
+	store, ok := c.admin()
+	if !ok {
+		return
+	}
+	path, err := backup(c.server.opts, store, c.namespace)
+	if err != nil {
+		c.w.writeError("ERR " + err.Error())
+		return
+	}
+	c.w.writeBulk(path)
+}
+
+// cmdInfo replies with the Stats of the store as lines of field:value, like the
+// INFO of Redis. The section asked for, if any, is ignored.
+func cmdInfo(c *respConn, args []string) {
+	store, ok := c.admin()
+	if !ok {
+		return
+	}
+	stats := store.Stats()
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Keyspace\r\nkeys:%d\r\nbytes:%d\r\n", stats.Keys, stats.Bytes)
+	b.WriteString("# Latency\r\n")
+	for _, op := range []struct {
+		name    string
+		summary caskdb.LatencyStats
+	}{{"reads", stats.Reads}, {"writes", stats.Writes}, {"syncs", stats.Syncs}} {
+		fmt.Fprintf(&b, "%s:count=%d,p50=%s,p99=%s\r\n", op.name, op.summary.Count, op.summary.P50, op.summary.P99)
+	}
+	fmt.Fprintf(&b, "# Lifetime\r\nwrites:%d\r\ncompactions:%d\r\nreclaimed_bytes:%d\r\nuptime_seconds:%d\r\n",
+		stats.Lifetime.Writes, stats.Lifetime.Compactions, stats.Lifetime.ReclaimedBytes, int64(stats.Lifetime.Uptime.Seconds()))
+	c.w.writeBulk(b.String())
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHTTPServer_Admin(t *testing.T) {
+	dir := t.TempDir()
+	srv, url, _ := startHTTP(t, Options{BackupDir: dir})
+	defer srv.Shutdown(context.Background())
+	do(t, http.MethodPut, url+"/keys/othello", "shakespeare")
+
+	for _, op := range []string{"compact", "sync", "rotate", "backup"} {
+		if code, body := do(t, http.MethodPost, url+"/admin/"+op, ""); code != http.StatusOK {
+			t.Errorf("POST /admin/%s status = %v, %s, want %v", op, code, body, http.StatusOK)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 || !strings.HasPrefix(entries[0].Name(), DefaultNamespace+"-") {
+		t.Errorf("POST /admin/backup wrote %v, %v, want one copy of the store", entries, err)
+	}
+	code, body := do(t, http.MethodGet, url+"/admin/stats", "")
+	var stats struct{ Keys int }
+	if err := json.Unmarshal([]byte(body), &stats); code != http.StatusOK || err != nil || stats.Keys != 1 {
+		t.Errorf("GET /admin/stats = %v, %s, want the stats of 1 key", code, body)
+	}
+	if code, _ := do(t, http.MethodGet, url+"/admin/compact", ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /admin/compact status = %v, want %v", code, http.StatusMethodNotAllowed)
+	}
+	if code, _ := do(t, http.MethodPost, url+"/admin/reboot", ""); code != http.StatusNotFound {
+		t.Errorf("POST /admin/reboot status = %v, want %v", code, http.StatusNotFound)
+	}
+}
+
+func TestHTTPServer_AdminAuth(t *testing.T) {
+	auth := NewAuth([]User{
+		{Name: "admin", Password: "hunter2", Admin: true},
+		{Name: "tenant", Token: "s3cret"},
+	})
+	srv, url, _ := startHTTP(t, Options{Auth: auth})
+	defer srv.Shutdown(context.Background())
+
+	tests := []struct {
+		name  string
+		setup func(r *http.Request)
+		want  int
+	}{
+		{"no credentials", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"not an admin", func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cret") }, http.StatusForbidden},
+		{"admin", func(r *http.Request) { r.SetBasicAuth("admin", "hunter2") }, http.StatusOK},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodPost, url+"/admin/sync", nil)
+		tt.setup(req)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: request failed: %v", tt.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: status = %v, want %v", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+	// backups are disabled without a directory
+	req, _ := http.NewRequest(http.MethodPost, url+"/admin/backup", nil)
+	req.SetBasicAuth("admin", "hunter2")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("POST /admin/backup status = %v, want %v", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestRESPServer_Admin(t *testing.T) {
+	auth := NewAuth([]User{
+		{Name: "admin", Password: "hunter2", Admin: true},
+		{Name: "tenant", Token: "s3cret"},
+	})
+	srv, addr := startRESP(t, Options{Auth: auth})
+	defer srv.Shutdown(context.Background())
+	c := dialRESP(t, addr)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"AUTH", "s3cret"}, "+OK"},
+		{[]string{"SET", "othello", "shakespeare"}, "+OK"},
+		{[]string{"FSYNC"}, "-NOPERM this user has no permissions to run admin commands"},
+		{[]string{"AUTH", "admin", "hunter2"}, "+OK"},
+		{[]string{"FSYNC"}, "+OK"},
+		{[]string{"ROTATE"}, "+OK"},
+		{[]string{"COMPACT"}, ":0"},
+		{[]string{"BACKUP"}, "-ERR " + errBackupsDisabled.Error()},
+	}
+	for _, tt := range tests {
+		if got := c.do(tt.args...); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+	if info := c.do("INFO"); !strings.Contains(info, "keys:1\r\n") {
+		t.Errorf("INFO = %q, want keys:1", info)
+	}
+}
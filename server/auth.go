@@ -0,0 +1,148 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// User is someone allowed to talk to the server. A user authenticates either with
+// a static bearer token or with a name and password over basic auth, whichever
+// is set.
+type User struct {
+	Name     string `json:"name"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+	// Namespaces restricts the user to the listed namespaces. When empty, the user
+	// has access to all of them.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Prefixes restricts the user to the keys starting with one of them, e.g.
+	// "tenant42:". When empty, the user has access to all the keys.
+	Prefixes []string `json:"prefixes,omitempty"`
+	// ReadOnly users can only read keys
+	ReadOnly bool `json:"read_only,omitempty"`
+	// Admin users may run the admin operations, e.g. compact the store, on the
+	// namespaces they have access to
+	Admin bool `json:"admin,omitempty"`
+}
+
+// can reports whether the user may access the key in the namespace, for writing
+// if write is set. An empty key stands for the namespace as a whole, which the
+// key prefixes do not restrict.
+func (u *User) can(namespace string, key string, write bool) bool {
+	if write && u.ReadOnly {
+		return false
+	}
+	if len(u.Namespaces) > 0 && !contains(u.Namespaces, namespace) {
+		return false
+	}
+	if len(u.Prefixes) == 0 || key == "" {
+		return true
+	}
+	for _, prefix := range u.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// canList reports whether the user may list the keys starting with prefix in the
+// namespace, i.e. may read every one of them.
+func (u *User) canList(namespace string, prefix string) bool {
+	if len(u.Prefixes) == 0 {
+		return u.can(namespace, "", false)
+	}
+	return prefix != "" && u.can(namespace, prefix, false)
+}
+
+// canStats reports whether the user may see the stats of the namespace, which are
+// those of all its keys: only the users reading the whole namespace may, and its
+// admins.
+func (u *User) canStats(namespace string) bool {
+	return u.canList(namespace, "") || u.canAdmin(namespace)
+}
+
+// canAdmin reports whether the user may run the admin operations on the
+// namespace.
+func (u *User) canAdmin(namespace string) bool {
+	return u.Admin && u.can(namespace, "", false)
+}
+
+// canDebug reports whether the user may see the debug endpoints, which are those
+// of the whole process: only the admins of every namespace and key may.
+func (u *User) canDebug() bool {
+	return u.Admin && len(u.Namespaces) == 0 && len(u.Prefixes) == 0
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Auth authenticates the requests against a fixed list of users.
+type Auth struct {
+	users []User
+}
+
+// NewAuth returns an Auth accepting the given users.
+func NewAuth(users []User) *Auth {
+	return &Auth{users: users}
+}
+
+// LoadAuth reads the users from a JSON file holding an array of User.
+func LoadAuth(fileName string) (*Auth, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var users []User
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, err
+	}
+	return NewAuth(users), nil
+}
+
+// authenticate returns the user the request's credentials belong to, or false if
+// they do not match any.
+func (a *Auth) authenticate(r *http.Request) (*User, bool) {
+	if name, password, ok := r.BasicAuth(); ok {
+		return a.login(name, password)
+	}
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return a.loginToken(strings.TrimPrefix(header, "Bearer "))
+	}
+	return nil, false
+}
+
+func (a *Auth) login(name string, password string) (*User, bool) {
+	for i := range a.users {
+		u := &a.users[i]
+		// comparing in constant time, so that the response time does not give
+		// away how much of the password was right
+		if u.Password != "" && u.Name == name && equal(u.Password, password) {
+			return u, true
+		}
+	}
+	return nil, false
+}
+
+func (a *Auth) loginToken(token string) (*User, bool) {
+	for i := range a.users {
+		u := &a.users[i]
+		if u.Token != "" && equal(u.Token, token) {
+			return u, true
+		}
+	}
+	return nil, false
+}
+
+func equal(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPServer_Auth(t *testing.T) {
+	auth := NewAuth([]User{
+		{Name: "admin", Password: "hunter2"},
+		{Name: "tenant", Token: "s3cret", Prefixes: []string{"tenant:"}},
+		{Name: "reader", Token: "r3ader", ReadOnly: true},
+	})
+	srv, url, _ := startHTTP(t, Options{Auth: auth})
+	defer srv.Shutdown(context.Background())
+
+	tests := []struct {
+		name   string
+		method string
+		key    string
+		setup  func(r *http.Request)
+		want   int
+	}{
+		{"no credentials", http.MethodPut, "tenant:a", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"wrong password", http.MethodPut, "tenant:a", func(r *http.Request) { r.SetBasicAuth("admin", "hunter3") }, http.StatusUnauthorized},
+		{"password", http.MethodPut, "anything", func(r *http.Request) { r.SetBasicAuth("admin", "hunter2") }, http.StatusNoContent},
+		{"token", http.MethodPut, "tenant:a", func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cret") }, http.StatusNoContent},
+		{"token outside prefix", http.MethodGet, "anything", func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cret") }, http.StatusForbidden},
+		{"token list outside prefix", http.MethodGet, "", func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cret") }, http.StatusForbidden},
+		{"token list in prefix", http.MethodGet, "?prefix=tenant:", func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cret") }, http.StatusOK},
+		{"read only read", http.MethodGet, "tenant:a", func(r *http.Request) { r.Header.Set("Authorization", "Bearer r3ader") }, http.StatusOK},
+		{"read only write", http.MethodDelete, "tenant:a", func(r *http.Request) { r.Header.Set("Authorization", "Bearer r3ader") }, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, url+"/keys/"+tt.key, strings.NewReader("value"))
+		tt.setup(req)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: request failed: %v", tt.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: status = %v, want %v", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+	// the stats are of every key, so a user restricted to a prefix may not see them
+	for token, want := range map[string]int{"s3cret": http.StatusForbidden, "r3ader": http.StatusOK} {
+		req, _ := http.NewRequest(http.MethodGet, url+"/stats", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET /stats failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("GET /stats with token %s status = %v, want %v", token, resp.StatusCode, want)
+		}
+	}
+	// the probes do not need credentials
+	if code, _ := do(t, http.MethodGet, url+"/healthz", ""); code != http.StatusOK {
+		t.Errorf("GET /healthz status = %v, want %v", code, http.StatusOK)
+	}
+}
+
+func TestHTTPServer_TLS(t *testing.T) {
+	cert := selfSignedCert(t)
+	srv, url, _ := startHTTP(t, Options{TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}})
+	defer srv.Shutdown(context.Background())
+	url = strings.Replace(url, "http://", "https://", 1)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := client.Get(url + "/healthz")
+	if err != nil {
+		t.Fatalf("GET over TLS failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET over TLS status = %v, want %v", resp.StatusCode, http.StatusOK)
+	}
+	// Go's server answers plain HTTP on a TLS port with a 400
+	resp, err = http.Get(strings.Replace(url, "https://", "http://", 1) + "/healthz")
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Errorf("GET over plain HTTP status = %v, want an error", resp.StatusCode)
+		}
+	}
+}
+
+// selfSignedCert returns a certificate for 127.0.0.1, valid for an hour
+func selfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"expvar"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strconv"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+// NewDebugHTTP returns an HTTPServer serving the debug endpoints of the process
+// and the store, for troubleshooting in production, meant for an admin port of its
+// own:
+//
+//	GET /debug/pprof/   the profiles of net/http/pprof
+//	GET /debug/vars     the variables of expvar, and the Stats of the store under "caskdb"
+//	GET /debug/caskdb   a page with the segments, KeyDir and compaction of the store
+//
+// The profiles and variables are those of the whole process, so with Options.Auth
+// set, only the admins of every namespace may see them. Like NewHTTP, the store is
+// left to the caller to close.
+func NewDebugHTTP(store *caskdb.DiskStore, opts Options) *HTTPServer {
+	return newDebugHTTP(singleStore{store}, opts)
+}
+
+// NewNamespacedDebugHTTP is like NewDebugHTTP, for the namespaces in ns which are
+// open.
+func NewNamespacedDebugHTTP(ns *Namespaces, opts Options) *HTTPServer {
+	return newDebugHTTP(ns, opts)
+}
+
+func newDebugHTTP(b backend, opts Options) *HTTPServer {
+	s := &HTTPServer{backend: b, opts: opts}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/vars", s.handleVars)
+	mux.HandleFunc("/debug/caskdb", s.handleDebug)
+	s.server = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.authorizeUser(w, r, (*User).canDebug) {
+			mux.ServeHTTP(w, r)
+		}
+	})}
+	return s
+}
+
+// handleVars writes the variables of expvar like expvar.Handler, along with the
+// Stats of the open stores, by namespace, under "caskdb". They are not published
+// with expvar.Publish, which would allow a single server per process.
+func (s *HTTPServer) handleVars(w http.ResponseWriter, r *http.Request) {
+	stats := make(map[string]caskdb.Stats)
+	for namespace, store := range s.backend.open() {
+		stats[namespace] = store.Stats()
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{\n")
+	expvar.Do(func(kv expvar.KeyValue) {
+		fmt.Fprintf(w, "%q: %s,\n", kv.Key, kv.Value)
+	})
+	fmt.Fprintf(w, "%q: %s\n}\n", "caskdb", expvar.Func(func() any { return stats }))
+}
+
+// debugPage is the page of /debug/caskdb.
+var debugPage = template.Must(template.New("debug").Funcs(template.FuncMap{"bytes": formatBytes}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>caskdb</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 2px 8px; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+</style>
+</head>
+<body>
+{{range .}}
+<h2>{{if .Namespace}}{{.Namespace}}{{else}}caskdb{{end}}</h2>
+<h3>KeyDir</h3>
+<table>
+<tr><th>index</th><td>{{.KeyDir.Index}}</td></tr>
+<tr><th>keys</th><td>{{.KeyDir.Keys}}</td></tr>
+<tr><th>slots</th><td>{{.KeyDir.Slots}}</td></tr>
+<tr><th>occupancy</th><td>{{printf "%.2f" .KeyDir.Occupancy}}</td></tr>
+<tr><th>max probe</th><td>{{.KeyDir.MaxProbe}}</td></tr>
+<tr><th>hash collisions</th><td>{{.KeyDir.HashCollisions}}</td></tr>
+</table>
+<h3>Compaction</h3>
+<p>{{if .Compaction.Running}}running{{else}}idle{{end}}{{with .Compaction.SavedSegments}}, progress saved for segments {{.}}{{end}}{{if .Compaction.SavedBytes}}, {{bytes .Compaction.SavedBytes}} copied{{end}}</p>
+<h3>Segments</h3>
+<table>
+<tr><th>file</th><th>id</th><th>size</th><th>state</th></tr>
+{{range .Segments}}<tr><td>{{.Name}}</td><td>{{.ID}}</td><td>{{bytes .Size}}</td><td>{{if .Active}}active{{else if .Remote}}remote{{else if .Moving}}moving{{else if .Compacted}}compacted{{else}}sealed{{end}}</td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
+
+// debugStore is a store on the page of /debug/caskdb.
+type debugStore struct {
+	Namespace string
+	caskdb.DebugInfo
+}
+
+// handleDebug writes the page of /debug/caskdb, with the open stores sorted by
+// namespace. With a single store, it has no namespace.
+func (s *HTTPServer) handleDebug(w http.ResponseWriter, r *http.Request) {
+	var stores []debugStore
+	_, single := s.backend.(singleStore)
+	for namespace, store := range s.backend.open() {
+		if single {
+			namespace = ""
+		}
+		stores = append(stores, debugStore{namespace, store.Debug()})
+	}
+	sort.Slice(stores, func(i, j int) bool { return stores[i].Namespace < stores[j].Namespace })
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	debugPage.Execute(w, stores)
+}
+
+// formatBytes formats n bytes for people, e.g. 1.5 MB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.FormatInt(n, 10) + " B"
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
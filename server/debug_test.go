@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+func startDebug(t *testing.T, opts Options) (*HTTPServer, string) {
+	t.Helper()
+	store, err := caskdb.NewDiskStore(filepath.Join(t.TempDir(), "books.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	store.Set("othello", "shakespeare")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv := NewDebugHTTP(store, opts)
+	go srv.Serve(ln)
+	return srv, "http://" + ln.Addr().String()
+}
+
+func TestDebugHTTP(t *testing.T) {
+	srv, url := startDebug(t, Options{})
+	defer srv.Shutdown(context.Background())
+
+	if code, body := do(t, http.MethodGet, url+"/debug/pprof/", ""); code != http.StatusOK || !strings.Contains(body, "goroutine") {
+		t.Errorf("GET /debug/pprof/ = %v, want %v and the profiles", code, http.StatusOK)
+	}
+	code, body := do(t, http.MethodGet, url+"/debug/vars", "")
+	var vars struct {
+		Memstats json.RawMessage
+		Caskdb   map[string]caskdb.Stats
+	}
+	if err := json.Unmarshal([]byte(body), &vars); code != http.StatusOK || err != nil {
+		t.Fatalf("GET /debug/vars = %v, %v, want JSON", code, err)
+	}
+	if vars.Memstats == nil || vars.Caskdb[DefaultNamespace].Keys != 1 {
+		t.Errorf("GET /debug/vars = %s, want memstats and the stats of 1 key", body)
+	}
+	code, body = do(t, http.MethodGet, url+"/debug/caskdb", "")
+	if code != http.StatusOK || !strings.Contains(body, "<td>books.db</td>") || !strings.Contains(body, "idle") {
+		t.Errorf("GET /debug/caskdb = %v, %s, want the page of books.db", code, body)
+	}
+}
+
+func TestDebugHTTP_Auth(t *testing.T) {
+	auth := NewAuth([]User{
+		{Name: "admin", Password: "hunter2", Admin: true},
+		{Name: "tenant42", Password: "s3cret", Admin: true, Namespaces: []string{"tenant42"}},
+	})
+	srv, url := startDebug(t, Options{Auth: auth})
+	defer srv.Shutdown(context.Background())
+
+	tests := []struct {
+		name     string
+		password string
+		want     int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"tenant42", "s3cret", http.StatusForbidden},
+		{"admin", "hunter2", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, url+"/debug/caskdb", nil)
+		if tt.name != "" {
+			req.SetBasicAuth(tt.name, tt.password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET /debug/caskdb failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("GET /debug/caskdb as %q status = %v, want %v", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func Test_formatBytes(t *testing.T) {
+	for n, want := range map[int64]string{0: "0 B", 1023: "1023 B", 1536: "1.5 KB", 3 << 30: "3.0 GB"} {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%v) = %v, want %v", n, got, want)
+		}
+	}
+}
@@ -0,0 +1,383 @@
+// Package server exposes a CaskDB store over the network.
+//
+// The HTTP frontend maps the keys to URLs under /keys/:
+//
+//	GET    /keys/{key}  returns the value, or 404 if the key does not exist
+//	GET    /keys/       lists the keys and values as JSON, a page at a time
+//	PUT    /keys/{key}  sets the key to the request body, or 507 if the store is full
+//	DELETE /keys/{key}  deletes the key
+//	GET    /stats       returns the store's Stats as JSON
+//	GET    /healthz     liveness probe, check DiskStore.Ping
+//	GET    /readyz      readiness probe, check DiskStore.Healthy
+//
+// The admin operations let operators manage a running store: POST /admin/compact,
+// /admin/sync and /admin/backup compact the store, flush it to the disk and copy
+// it to Options.BackupDir, and GET /admin/stats returns its Stats. With
+// Options.Auth set, only the users with User.Admin may run them.
+//
+// The listing takes the prefix of the keys, a limit and the cursor returned along
+// with the previous page as query parameters, e.g.
+// /keys/?prefix=books/&limit=50&cursor=Ym9va3MvaGFtbGV0, and returns
+// {"items": [{"key": ..., "value": ...}, ...], "next_cursor": ...}, without
+// next_cursor after the last page. Check caskdb.DiskStore.List.
+//
+// Keys are opaque bytes: in the URLs, escape them with url.PathEscape, which
+// leaves zero bytes, invalid UTF-8 and slashes intact through %XX. JSON strings
+// cannot hold invalid UTF-8, so the items of a listing whose key or value is not
+// valid UTF-8 carry both in base64 along with "encoding": "base64".
+//
+// When serving Namespaces, the same URLs under /ns/{namespace}/ address the keys
+// stats and admin operations of that namespace, e.g. /ns/tenant42/keys/{key}. The URLs without the
+// prefix address the default namespace.
+//
+// With Options.Auth set, the requests on the keys need either basic auth or a
+// bearer token; they get 401 without valid credentials and 403 for keys the user
+// has no access to. The stats are those of every key, so only the users who may
+// read the whole namespace, or are its admins, may see them.
+//
+// A PUT or DELETE with an Idempotency-Key header is applied once: retrying it with
+// the same key is a no-op, check caskdb.WithIdempotencyToken.
+//
+// NewDebugHTTP serves the debug endpoints, /debug/pprof, /debug/vars and
+// /debug/caskdb, on an admin port of their own.
+//
+// RESPServer and MemcachedServer serve the same store to Redis and memcached
+// clients respectively.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+const (
+	// keysPath is the URL path the keys live under
+	keysPath = "/keys/"
+	// statsPath is the URL path of the stats
+	statsPath = "/stats"
+	// namespacesPath is the URL path the namespaces live under
+	namespacesPath = "/ns/"
+	// idempotencyKeyHeader carries the idempotency token of a write
+	idempotencyKeyHeader = "Idempotency-Key"
+)
+
+// HTTPServer serves a store over HTTP.
+type HTTPServer struct {
+	backend backend
+	opts    Options
+	server  *http.Server
+}
+
+// NewHTTP returns an HTTPServer serving the store. The server does not own the
+// store: closing it once the server is shut down is left to the caller.
+func NewHTTP(store *caskdb.DiskStore, opts Options) *HTTPServer {
+	return newHTTP(singleStore{store}, opts)
+}
+
+// NewNamespacedHTTP returns an HTTPServer serving every namespace in ns. A write
+// to a namespace which does not exist yet creates it. Closing ns once the server
+// is shut down is left to the caller.
+func NewNamespacedHTTP(ns *Namespaces, opts Options) *HTTPServer {
+	return newHTTP(ns, opts)
+}
+
+func newHTTP(b backend, opts Options) *HTTPServer {
+	s := &HTTPServer{backend: b, opts: opts}
+	mux := http.NewServeMux()
+	mux.HandleFunc(statsPath, s.handleStats)
+	mux.HandleFunc(adminPath, s.handleAdmin)
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	s.server = &http.Server{Handler: s.route(mux)}
+	return s
+}
+
+// route hands the requests on the keys to their handlers itself, and the others
+// to mux: a mux cleans the paths, e.g. /keys/a//b into /keys/a/b, which would
+// change the keys.
+func (s *HTTPServer) route(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, keysPath):
+			s.handleKey(w, r)
+		case strings.HasPrefix(r.URL.Path, namespacesPath):
+			s.handleNamespace(w, r)
+		default:
+			mux.ServeHTTP(w, r)
+		}
+	})
+}
+
+// Serve accepts connections on l until Shutdown is called. It returns nil after
+// a Shutdown, and the error which stopped it otherwise.
+func (s *HTTPServer) Serve(l net.Listener) error {
+	if s.opts.TLSConfig != nil {
+		l = tls.NewListener(l, s.opts.TLSConfig)
+	}
+	if err := s.server.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops accepting new connections and waits for the in-flight requests
+// to finish. If ctx is done first, the remaining connections are closed and the
+// error of ctx is returned.
+func (s *HTTPServer) Shutdown(ctx context.Context) error {
+	err := s.server.Shutdown(ctx)
+	if err != nil {
+		s.server.Close()
+	}
+	return err
+}
+
+// handleNamespace strips the /ns/{namespace} prefix and hands the request over to
+// the handler of the rest of the path.
+func (s *HTTPServer) handleNamespace(w http.ResponseWriter, r *http.Request) {
+	namespace, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, namespacesPath), "/")
+	switch {
+	case strings.HasPrefix("/"+rest, keysPath):
+		s.serveKey(w, r, namespace, strings.TrimPrefix("/"+rest, keysPath))
+	case "/"+rest == statsPath:
+		s.serveStats(w, r, namespace)
+	case strings.HasPrefix("/"+rest, adminPath):
+		s.serveAdmin(w, r, namespace, strings.TrimPrefix("/"+rest, adminPath))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *HTTPServer) handleKey(w http.ResponseWriter, r *http.Request) {
+	s.serveKey(w, r, DefaultNamespace, strings.TrimPrefix(r.URL.Path, keysPath))
+}
+
+func (s *HTTPServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	s.serveStats(w, r, DefaultNamespace)
+}
+
+func (s *HTTPServer) serveKey(w http.ResponseWriter, r *http.Request, namespace string, key string) {
+	if key == "" && r.Method == http.MethodGet {
+		s.serveList(w, r, namespace)
+		return
+	}
+	if key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	}
+	write := r.Method != http.MethodGet
+	if !s.authorize(w, r, namespace, key, write) {
+		return
+	}
+	store, ok := s.store(w, namespace, r.Method == http.MethodPut)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	if token := r.Header.Get(idempotencyKeyHeader); token != "" {
+		ctx = caskdb.WithIdempotencyToken(ctx, token)
+	}
+	switch r.Method {
+	case http.MethodGet:
+		entry, err := store.GetEntryContext(ctx, key)
+		if errors.Is(err, caskdb.ErrKeyNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		// the write timestamp, to the second like the header, lets replicas tell
+		// whether their copy is stale
+		w.Header().Set("Last-Modified", entry.Timestamp.UTC().Format(http.TimeFormat))
+		if !entry.Expiry.IsZero() {
+			w.Header().Set("Expires", entry.Expiry.UTC().Format(http.TimeFormat))
+		}
+		io.WriteString(w, entry.Value)
+	case http.MethodPut:
+		value, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = store.PutContext(ctx, key, string(value))
+		if errors.Is(err, caskdb.ErrStoreFull) {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if err := store.DeleteContext(ctx, key); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// listPage is the JSON encoding of a page of List.
+type listPage struct {
+	Items      []listItem `json:"items"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+type listItem struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	// Encoding is "base64" when the key and value are encoded in base64, which
+	// they are when either is not valid UTF-8, as JSON strings cannot hold it
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// newListItem returns the listItem of the key and value.
+func newListItem(key string, value string) listItem {
+	if utf8.ValidString(key) && utf8.ValidString(value) {
+		return listItem{Key: key, Value: value}
+	}
+	return listItem{
+		Key:      base64.StdEncoding.EncodeToString([]byte(key)),
+		Value:    base64.StdEncoding.EncodeToString([]byte(value)),
+		Encoding: "base64",
+	}
+}
+
+func (s *HTTPServer) serveList(w http.ResponseWriter, r *http.Request, namespace string) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	limit := 0
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	// a user restricted to some key prefixes may only list under one of them
+	if !s.authorizeUser(w, r, func(u *User) bool { return u.canList(namespace, prefix) }) {
+		return
+	}
+	store, ok := s.store(w, namespace, false)
+	if !ok {
+		return
+	}
+	items, next, err := store.List(prefix, query.Get("cursor"), limit)
+	if errors.Is(err, caskdb.ErrInvalidCursor) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page := listPage{Items: make([]listItem, len(items)), NextCursor: next}
+	for i, item := range items {
+		page.Items[i] = newListItem(item.Key, item.Value)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+func (s *HTTPServer) serveStats(w http.ResponseWriter, r *http.Request, namespace string) {
+	if !s.authorizeUser(w, r, func(u *User) bool { return u.canStats(namespace) }) {
+		return
+	}
+	store, ok := s.store(w, namespace, false)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(store.Stats())
+}
+
+// store returns the store of the namespace, or writes the error response if there
+// is none.
+func (s *HTTPServer) store(w http.ResponseWriter, namespace string, create bool) (*caskdb.DiskStore, bool) {
+	store, err := s.backend.store(namespace, create)
+	switch {
+	case errors.Is(err, ErrNamespaceNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil, false
+	case errors.Is(err, ErrInvalidNamespace):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	case errors.Is(err, ErrTooManyNamespaces):
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return nil, false
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return store, true
+}
+
+// authorize checks the request's credentials when authentication is enabled, and
+// writes the error response if it may not access the key. An empty key stands for
+// the namespace as a whole.
+func (s *HTTPServer) authorize(w http.ResponseWriter, r *http.Request, namespace string, key string, write bool) bool {
+	return s.authorizeUser(w, r, func(u *User) bool { return u.can(namespace, key, write) })
+}
+
+// authorizeUser is like authorize, with the access of the user checked by can.
+func (s *HTTPServer) authorizeUser(w http.ResponseWriter, r *http.Request, can func(u *User) bool) bool {
+	if s.opts.Auth == nil {
+		return true
+	}
+	user, ok := s.opts.Auth.authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="caskdb"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	if !can(user) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (s *HTTPServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	for namespace, store := range s.backend.open() {
+		if err := store.Ping(); err != nil {
+			writeProbe(w, namespace, err)
+			return
+		}
+	}
+	writeProbe(w, "", nil)
+}
+
+func (s *HTTPServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	for namespace, store := range s.backend.open() {
+		if err := store.Healthy(); err != nil {
+			writeProbe(w, namespace, err)
+			return
+		}
+	}
+	writeProbe(w, "", nil)
+}
+
+func writeProbe(w http.ResponseWriter, namespace string, err error) {
+	if err != nil {
+		http.Error(w, "namespace "+namespace+": "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	io.WriteString(w, "ok\n")
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+// startHTTP serves a fresh store on a random local port and returns the server
+// along with its base URL and the error channel of Serve.
+func startHTTP(t *testing.T, opts Options) (*HTTPServer, string, chan error) {
+	t.Helper()
+	store, err := caskdb.NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv := NewHTTP(store, opts)
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(ln) }()
+	return srv, "http://" + ln.Addr().String(), errc
+}
+
+func do(t *testing.T, method string, url string, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+func TestHTTPServer_Keys(t *testing.T) {
+	srv, url, _ := startHTTP(t, Options{})
+	defer srv.Shutdown(context.Background())
+
+	if code, _ := do(t, http.MethodPut, url+"/keys/othello", "shakespeare"); code != http.StatusNoContent {
+		t.Errorf("PUT status = %v, want %v", code, http.StatusNoContent)
+	}
+	if code, body := do(t, http.MethodGet, url+"/keys/othello", ""); code != http.StatusOK || body != "shakespeare" {
+		t.Errorf("GET = %v %q, want %v %q", code, body, http.StatusOK, "shakespeare")
+	}
+	if code, _ := do(t, http.MethodDelete, url+"/keys/othello", ""); code != http.StatusNoContent {
+		t.Errorf("DELETE status = %v, want %v", code, http.StatusNoContent)
+	}
+	if code, _ := do(t, http.MethodGet, url+"/keys/othello", ""); code != http.StatusNotFound {
+		t.Errorf("GET deleted key status = %v, want %v", code, http.StatusNotFound)
+	}
+	if code, _ := do(t, http.MethodGet, url+"/readyz", ""); code != http.StatusOK {
+		t.Errorf("GET /readyz status = %v, want %v", code, http.StatusOK)
+	}
+}
+
+func TestHTTPServer_List(t *testing.T) {
+	srv, url, _ := startHTTP(t, Options{})
+	defer srv.Shutdown(context.Background())
+
+	for _, key := range []string{"books/othello", "books/hamlet", "books/dune", "films/dune"} {
+		do(t, http.MethodPut, url+"/keys/"+key, "some author")
+	}
+	var keys []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		code, body := do(t, http.MethodGet, url+"/keys/?prefix=books/&limit=2&cursor="+cursor, "")
+		if code != http.StatusOK || pages > 2 {
+			t.Fatalf("GET /keys/ = %v %q, want 2 pages", code, body)
+		}
+		var page listPage
+		if err := json.Unmarshal([]byte(body), &page); err != nil {
+			t.Fatalf("GET /keys/ returned %q: %v", body, err)
+		}
+		for _, item := range page.Items {
+			keys = append(keys, item.Key)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	if strings.Join(keys, " ") != "books/dune books/hamlet books/othello" {
+		t.Errorf("GET /keys/ listed %v, want the books in order", keys)
+	}
+	if code, _ := do(t, http.MethodGet, url+"/keys/?cursor=%21", ""); code != http.StatusBadRequest {
+		t.Errorf("GET /keys/ with an invalid cursor status = %v, want %v", code, http.StatusBadRequest)
+	}
+}
+
+func TestHTTPServer_BinaryKeys(t *testing.T) {
+	srv, base, _ := startHTTP(t, Options{})
+	defer srv.Shutdown(context.Background())
+
+	keys := []string{"a\x00b", "\xff\xfe", "a//b", "../etc", "x/./y", "%41"}
+	for i, key := range keys {
+		value := fmt.Sprintf("value %d", i)
+		if code, body := do(t, http.MethodPut, base+"/keys/"+url.PathEscape(key), value); code != http.StatusNoContent {
+			t.Errorf("PUT %q status = %v %q, want %v", key, code, body, http.StatusNoContent)
+		}
+		if code, body := do(t, http.MethodGet, base+"/keys/"+url.PathEscape(key), ""); code != http.StatusOK || body != value {
+			t.Errorf("GET %q = %v %q, want %v %q", key, code, body, http.StatusOK, value)
+		}
+	}
+	_, body := do(t, http.MethodGet, base+"/keys/?prefix="+url.QueryEscape("\xff"), "")
+	var page listPage
+	if err := json.Unmarshal([]byte(body), &page); err != nil {
+		t.Fatalf("GET /keys/ returned %q: %v", body, err)
+	}
+	want := listItem{Key: base64.StdEncoding.EncodeToString([]byte("\xff\xfe")), Value: base64.StdEncoding.EncodeToString([]byte("value 1")), Encoding: "base64"}
+	if len(page.Items) != 1 || page.Items[0] != want {
+		t.Errorf("GET /keys/ listed %+v, want %+v", page.Items, want)
+	}
+}
+
+func TestHTTPServer_Shutdown(t *testing.T) {
+	srv, url, errc := startHTTP(t, Options{})
+	do(t, http.MethodPut, url+"/keys/hamlet", "shakespeare")
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("Serve() error = %v, want nil after Shutdown", err)
+	}
+	if _, err := http.Get(url + "/keys/hamlet"); err == nil {
+		t.Errorf("GET after Shutdown succeeded, want an error")
+	}
+}
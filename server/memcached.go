@@ -0,0 +1,321 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+// ErrAuthUnsupported is returned by MemcachedServer.Serve when Options.Auth is
+// set, since the memcached text protocol has no way to authenticate.
+var ErrAuthUnsupported = errors.New("server: the memcached protocol does not support authentication")
+
+const (
+	// maxItemSize is the largest value a memcached client may set, which is the
+	// default limit of memcached itself
+	maxItemSize = 1 << 20
+	// maxKeyLen is the longest key the memcached protocol allows
+	maxKeyLen = 250
+	// relativeExptimeLimit is the largest exptime memcached takes as a number of
+	// seconds from now; larger ones are Unix timestamps
+	relativeExptimeLimit = 30 * 24 * 60 * 60
+)
+
+// MemcachedServer serves a store over the memcached text protocol, so that
+// applications using a memcached client get a cache which survives restarts. It
+// supports the commands
+//
+//	get <key>*
+//	set|add|replace <key> <flags> <exptime> <bytes> [noreply]
+//	delete <key> [noreply]
+//	version and quit
+//
+// The store keeps no flags, so only 0 is accepted. Since the store records a
+// deletion as an empty value, setting a key to an empty value deletes it.
+type MemcachedServer struct {
+	backend backend
+	opts    Options
+	tcp     *tcpServer
+	// writeMu makes checking for a key and writing it a single step for add and
+	// replace. It only orders the writes made over memcached: a write from another
+	// frontend in between can still be overwritten.
+	writeMu sync.Mutex
+}
+
+// NewMemcached returns a MemcachedServer serving the store. The server does not
+// own the store: closing it once the server is shut down is left to the caller.
+func NewMemcached(store *caskdb.DiskStore, opts Options) *MemcachedServer {
+	return newMemcached(singleStore{store}, opts)
+}
+
+// NewNamespacedMemcached returns a MemcachedServer serving the default namespace
+// of ns; the protocol has no way to pick another one. Closing ns once the server
+// is shut down is left to the caller.
+func NewNamespacedMemcached(ns *Namespaces, opts Options) *MemcachedServer {
+	return newMemcached(ns, opts)
+}
+
+func newMemcached(b backend, opts Options) *MemcachedServer {
+	s := &MemcachedServer{backend: b, opts: opts}
+	s.tcp = newTCPServer(opts.TLSConfig, s.serveConn)
+	return s
+}
+
+// Serve accepts connections on l until Shutdown is called. It returns nil after
+// a Shutdown, ErrAuthUnsupported if Options.Auth is set, and the error which
+// stopped it otherwise.
+func (s *MemcachedServer) Serve(l net.Listener) error {
+	if s.opts.Auth != nil {
+		l.Close()
+		return ErrAuthUnsupported
+	}
+	return s.tcp.serve(l)
+}
+
+// Shutdown stops accepting new connections and waits for the commands in flight
+// to be handled and replied to; idle connections are closed right away. If ctx is
+// done first, the remaining connections are closed and the error of ctx is
+// returned.
+func (s *MemcachedServer) Shutdown(ctx context.Context) error {
+	return s.tcp.shutdown(ctx)
+}
+
+func (s *MemcachedServer) serveConn(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			var perr protocolError
+			if errors.As(err, &perr) {
+				w.WriteString("CLIENT_ERROR " + perr.Error() + "\r\n")
+				w.Flush()
+			}
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		quit, err := s.handle(r, w, args)
+		if err != nil {
+			// the data block could not be read, so we do not know where the next
+			// command starts
+			var perr protocolError
+			if errors.As(err, &perr) {
+				w.WriteString("CLIENT_ERROR " + perr.Error() + "\r\n")
+				w.Flush()
+			}
+			return
+		}
+		// like RESP, a client may pipeline its commands
+		if quit || r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// handle runs a single command and writes its reply. It returns true when the
+// connection should be closed, and an error when the connection cannot be used
+// any more.
+func (s *MemcachedServer) handle(r *bufio.Reader, w *bufio.Writer, args []string) (bool, error) {
+	switch args[0] {
+	case "get":
+		s.get(w, args[1:])
+	case "set", "add", "replace":
+		return false, s.store(r, w, args[0], args[1:])
+	case "delete":
+		s.delete(w, args[1:])
+	case "version":
+		w.WriteString("VERSION caskdb\r\n")
+	case "quit":
+		return true, nil
+	default:
+		w.WriteString("ERROR\r\n")
+	}
+	return false, nil
+}
+
+func (s *MemcachedServer) get(w *bufio.Writer, keys []string) {
+	if len(keys) == 0 {
+		w.WriteString("ERROR\r\n")
+		return
+	}
+	store, err := s.backend.store(DefaultNamespace, false)
+	if errors.Is(err, ErrNamespaceNotFound) {
+		w.WriteString("END\r\n")
+		return
+	}
+	if err != nil {
+		w.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+		return
+	}
+	for _, key := range keys {
+		value, err := store.Lookup(key)
+		if errors.Is(err, caskdb.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			w.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+			return
+		}
+		w.WriteString("VALUE " + key + " 0 " + strconv.Itoa(len(value)) + "\r\n")
+		w.WriteString(value)
+		w.WriteString("\r\n")
+	}
+	w.WriteString("END\r\n")
+}
+
+// store handles set, add and replace. It returns an error only when the data
+// block cannot be read, after which the connection is closed.
+func (s *MemcachedServer) store(r *bufio.Reader, w *bufio.Writer, cmd string, args []string) error {
+	if len(args) != 4 && len(args) != 5 {
+		w.WriteString("ERROR\r\n")
+		return nil
+	}
+	key := args[0]
+	flags, ferr := strconv.ParseUint(args[1], 10, 32)
+	exptime, eerr := strconv.ParseInt(args[2], 10, 64)
+	size, serr := strconv.Atoi(args[3])
+	noreply := len(args) == 5 && args[4] == "noreply"
+	if serr != nil || size < 0 {
+		// without a size we cannot skip the data block
+		return protocolError("bad command line format")
+	}
+	if size > maxItemSize {
+		if _, err := io.CopyN(io.Discard, r, int64(size)+2); err != nil {
+			return err
+		}
+		reply(w, noreply, "SERVER_ERROR object too large for cache")
+		return nil
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	if data[size] != '\r' || data[size+1] != '\n' {
+		return protocolError("bad data chunk")
+	}
+	switch {
+	case ferr != nil || eerr != nil || (len(args) == 5 && !noreply) || !validKey(key):
+		reply(w, noreply, "CLIENT_ERROR bad command line format")
+		return nil
+	case flags != 0:
+		reply(w, noreply, "CLIENT_ERROR flags are not supported")
+		return nil
+	}
+	value := string(data[:size])
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	db, err := s.backend.store(DefaultNamespace, true)
+	if err != nil {
+		reply(w, noreply, "SERVER_ERROR "+err.Error())
+		return nil
+	}
+	if (cmd == "add" && db.Has(key)) || (cmd == "replace" && !db.Has(key)) {
+		reply(w, noreply, "NOT_STORED")
+		return nil
+	}
+	ttl, expired := exptimeTTL(exptime, time.Now())
+	switch {
+	case expired:
+		err = db.Delete(key)
+	case ttl > 0:
+		err = db.PutWithTTL(key, value, ttl)
+	default:
+		err = db.Put(key, value)
+	}
+	if err != nil {
+		reply(w, noreply, "SERVER_ERROR "+err.Error())
+		return nil
+	}
+	reply(w, noreply, "STORED")
+	return nil
+}
+
+func (s *MemcachedServer) delete(w *bufio.Writer, args []string) {
+	// memcached still accepts a legacy time argument of 0
+	noreply := len(args) > 1 && args[len(args)-1] == "noreply"
+	if noreply {
+		args = args[:len(args)-1]
+	}
+	if len(args) == 2 && args[1] == "0" {
+		args = args[:1]
+	}
+	if len(args) != 1 {
+		reply(w, noreply, "CLIENT_ERROR bad command line format")
+		return
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	db, err := s.backend.store(DefaultNamespace, false)
+	if errors.Is(err, ErrNamespaceNotFound) {
+		reply(w, noreply, "NOT_FOUND")
+		return
+	}
+	if err != nil {
+		reply(w, noreply, "SERVER_ERROR "+err.Error())
+		return
+	}
+	if !db.Has(args[0]) {
+		reply(w, noreply, "NOT_FOUND")
+		return
+	}
+	if err := db.Delete(args[0]); err != nil {
+		reply(w, noreply, "SERVER_ERROR "+err.Error())
+		return
+	}
+	reply(w, noreply, "DELETED")
+}
+
+// reply writes the reply line, unless the client asked for none.
+func reply(w *bufio.Writer, noreply bool, line string) {
+	if !noreply {
+		w.WriteString(line + "\r\n")
+	}
+}
+
+// validKey reports whether the key is one memcached would take: at most 250 bytes
+// and no whitespace or control characters.
+func validKey(key string) bool {
+	if len(key) == 0 || len(key) > maxKeyLen {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// exptimeTTL converts a memcached exptime to a TTL: 0 means the key does not
+// expire, up to 30 days it is a number of seconds from now, above that a Unix
+// timestamp. expired is set when the key expires right away, as with a negative
+// exptime or a timestamp in the past.
+func exptimeTTL(exptime int64, now time.Time) (ttl time.Duration, expired bool) {
+	switch {
+	case exptime == 0:
+		return 0, false
+	case exptime < 0:
+		return 0, true
+	case exptime <= relativeExptimeLimit:
+		return time.Duration(exptime) * time.Second, false
+	}
+	ttl = time.Unix(exptime, 0).Sub(now)
+	return ttl, ttl <= 0
+}
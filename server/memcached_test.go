@@ -0,0 +1,99 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+func TestMemcachedServer(t *testing.T) {
+	store, err := caskdb.NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv := NewMemcached(store, Options{})
+	go srv.Serve(ln)
+	defer srv.Shutdown(context.Background())
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	tests := []struct {
+		request string
+		want    string
+	}{
+		{"set othello 0 0 11\r\nshakespeare\r\n", "STORED\r\n"},
+		{"get othello\r\n", "VALUE othello 0 11\r\nshakespeare\r\nEND\r\n"},
+		{"add othello 0 0 1\r\nx\r\n", "NOT_STORED\r\n"},
+		{"replace hamlet 0 0 1\r\nx\r\n", "NOT_STORED\r\n"},
+		{"add hamlet 0 0 4\r\n1603\r\n", "STORED\r\n"},
+		{"replace hamlet 0 0 4\r\n1601\r\n", "STORED\r\n"},
+		{"get othello lear hamlet\r\n", "VALUE othello 0 11\r\nshakespeare\r\nVALUE hamlet 0 4\r\n1601\r\nEND\r\n"},
+		{"delete hamlet\r\n", "DELETED\r\n"},
+		{"delete hamlet\r\n", "NOT_FOUND\r\n"},
+		{"set lear 0 -1 4\r\n1606\r\n", "STORED\r\n"},
+		{"get lear\r\n", "END\r\n"},
+		{"set lear 0 100 4\r\n1606\r\n", "STORED\r\n"},
+		{"set lear 1 0 4\r\n1606\r\n", "CLIENT_ERROR flags are not supported\r\n"},
+		// noreply commands are pipelined ahead of the get answering for them
+		{"set macbeth 0 0 4 noreply\r\n1606\r\ndelete othello noreply\r\nget macbeth othello\r\n", "VALUE macbeth 0 4\r\n1606\r\nEND\r\n"},
+		{"flush_all\r\n", "ERROR\r\n"},
+	}
+	for _, tt := range tests {
+		if _, err := conn.Write([]byte(tt.request)); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var got strings.Builder
+		for got.Len() < len(tt.want) {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("%q: failed to read reply: %v", tt.request, err)
+			}
+			got.WriteString(line)
+		}
+		if got.String() != tt.want {
+			t.Errorf("%q = %q, want %q", tt.request, got.String(), tt.want)
+		}
+	}
+	if ttl, err := store.TTL("lear"); err != nil || ttl <= 99*time.Second {
+		t.Errorf("TTL(lear) = %v, %v, want about 100s", ttl, err)
+	}
+}
+
+func Test_exptimeTTL(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		exptime     int64
+		wantTTL     time.Duration
+		wantExpired bool
+	}{
+		{0, 0, false},
+		{-1, 0, true},
+		{60, time.Minute, false},
+		{relativeExptimeLimit, 30 * 24 * time.Hour, false},
+		{1700000000 + 3600, time.Hour, false},
+		{1700000000 - 3600, -time.Hour, true},
+	}
+	for _, tt := range tests {
+		ttl, expired := exptimeTTL(tt.exptime, now)
+		if ttl != tt.wantTTL || expired != tt.wantExpired {
+			t.Errorf("exptimeTTL(%v) = %v, %v, want %v, %v", tt.exptime, ttl, expired, tt.wantTTL, tt.wantExpired)
+		}
+	}
+}
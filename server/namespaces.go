@@ -0,0 +1,190 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+// DefaultNamespace is the namespace used when a request does not name one.
+const DefaultNamespace = "default"
+
+// DataFileName is the name of the data file inside a namespace's directory, that
+// of the stores of a caskdb.Manager
+const DataFileName = "data.db"
+
+// DefaultMaxNamespaces is how many namespaces there may be when
+// NamespaceOptions.MaxNamespaces is zero
+const DefaultMaxNamespaces = 1024
+
+// validNamespace limits the namespace names to something which is safe to use as
+// a directory name on every platform
+var validNamespace = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+var (
+	// ErrInvalidNamespace is returned for a namespace name which is not 1 to 64
+	// letters, digits, underscores or dashes
+	ErrInvalidNamespace = errors.New("server: invalid namespace")
+	// ErrNamespaceNotFound is returned when reading from a namespace which was
+	// never written to
+	ErrNamespaceNotFound = errors.New("server: namespace not found")
+	// ErrTooManyNamespaces is returned when writing to a new namespace once there
+	// are NamespaceOptions.MaxNamespaces of them
+	ErrTooManyNamespaces = errors.New("server: too many namespaces")
+)
+
+// backend resolves a namespace to the store serving it.
+type backend interface {
+	// check returns an error if the namespace can never be served
+	check(namespace string) error
+	// store returns the store of the namespace, creating it if create is set
+	store(namespace string, create bool) (*caskdb.DiskStore, error)
+	// open returns the stores which are currently open, by namespace
+	open() map[string]*caskdb.DiskStore
+}
+
+// singleStore serves one store as the default namespace, and nothing else.
+type singleStore struct {
+	s *caskdb.DiskStore
+}
+
+func (b singleStore) check(namespace string) error {
+	if namespace != DefaultNamespace {
+		return fmt.Errorf("%w: %q", ErrNamespaceNotFound, namespace)
+	}
+	return nil
+}
+
+func (b singleStore) store(namespace string, create bool) (*caskdb.DiskStore, error) {
+	if err := b.check(namespace); err != nil {
+		return nil, err
+	}
+	return b.s, nil
+}
+
+func (b singleStore) open() map[string]*caskdb.DiskStore {
+	return map[string]*caskdb.DiskStore{DefaultNamespace: b.s}
+}
+
+// NamespaceOptions tunes Namespaces.
+type NamespaceOptions struct {
+	// ManagerOptions are those of the caskdb.Manager of the stores, e.g. the
+	// Options every store is opened with
+	caskdb.ManagerOptions
+	// MaxNamespaces is how many namespaces there may be: the first write to a new
+	// one past it fails with ErrTooManyNamespaces, so that clients cannot fill the
+	// disk with empty stores. When zero, DefaultMaxNamespaces.
+	MaxNamespaces int
+}
+
+// Namespaces hosts multiple logical databases in one directory. Each namespace is
+// a store of its own, in a subdirectory named after it, so the namespaces have
+// independent stats and can be backed up or removed separately. The stores are
+// those of a caskdb.Manager, so they share their caches, compactions and syncs.
+type Namespaces struct {
+	dir     string
+	manager *caskdb.Manager
+	max     int
+
+	mu     sync.Mutex
+	stores map[string]*caskdb.DiskStore
+}
+
+// OpenNamespaces opens the namespaces in dir, creating the directory if needed.
+// The namespaces already in dir are opened right away, so that a corrupt one is
+// reported now rather than on its first request.
+func OpenNamespaces(dir string, opts NamespaceOptions) (*Namespaces, error) {
+	manager, err := caskdb.NewManager(dir, opts.ManagerOptions)
+	if err != nil {
+		return nil, err
+	}
+	n := &Namespaces{dir: dir, manager: manager, max: opts.MaxNamespaces, stores: make(map[string]*caskdb.DiskStore)}
+	if n.max <= 0 {
+		n.max = DefaultMaxNamespaces
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		n.Close()
+		return nil, err
+	}
+	// those in dir are opened even past the limit, which is only on creating them
+	for _, entry := range entries {
+		if !entry.IsDir() || !validNamespace.MatchString(entry.Name()) {
+			continue
+		}
+		if _, err := n.store(entry.Name(), false); err != nil {
+			n.Close()
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// Names returns the names of the namespaces, sorted.
+func (n *Namespaces) Names() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	names := make([]string, 0, len(n.stores))
+	for name := range n.stores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Close closes the stores of all the namespaces. It returns false if any of them
+// failed to close.
+func (n *Namespaces) Close() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.stores = make(map[string]*caskdb.DiskStore)
+	return n.manager.Close()
+}
+
+func (n *Namespaces) check(namespace string) error {
+	if !validNamespace.MatchString(namespace) {
+		return fmt.Errorf("%w: %q", ErrInvalidNamespace, namespace)
+	}
+	return nil
+}
+
+func (n *Namespaces) store(namespace string, create bool) (*caskdb.DiskStore, error) {
+	if err := n.check(namespace); err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if s, ok := n.stores[namespace]; ok {
+		return s, nil
+	}
+	if _, err := os.Stat(filepath.Join(n.dir, namespace)); os.IsNotExist(err) {
+		if !create {
+			return nil, fmt.Errorf("%w: %q", ErrNamespaceNotFound, namespace)
+		}
+		if len(n.stores) >= n.max {
+			return nil, fmt.Errorf("%w: %d", ErrTooManyNamespaces, n.max)
+		}
+	}
+	s, err := n.manager.Open(namespace)
+	if err != nil {
+		return nil, err
+	}
+	n.stores[namespace] = s
+	return s, nil
+}
+
+func (n *Namespaces) open() map[string]*caskdb.DiskStore {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	stores := make(map[string]*caskdb.DiskStore, len(n.stores))
+	for name, s := range n.stores {
+		stores[name] = s
+	}
+	return stores
+}
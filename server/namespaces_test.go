@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHTTPServer_Namespaces(t *testing.T) {
+	dir := t.TempDir()
+	ns, err := OpenNamespaces(dir, NamespaceOptions{})
+	if err != nil {
+		t.Fatalf("OpenNamespaces() error = %v", err)
+	}
+	auth := NewAuth([]User{{Name: "tenant", Token: "s3cret", Namespaces: []string{"tenant42"}}})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv := NewNamespacedHTTP(ns, Options{Auth: auth})
+	go srv.Serve(ln)
+	url := "http://" + ln.Addr().String()
+
+	request := func(method string, path string, body string) int {
+		req, _ := http.NewRequest(method, url+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer s3cret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := request(http.MethodGet, "/ns/tenant42/keys/hamlet", ""); code != http.StatusNotFound {
+		t.Errorf("GET in a missing namespace status = %v, want %v", code, http.StatusNotFound)
+	}
+	if code := request(http.MethodPut, "/ns/tenant42/keys/hamlet", "shakespeare"); code != http.StatusNoContent {
+		t.Errorf("PUT status = %v, want %v", code, http.StatusNoContent)
+	}
+	if code := request(http.MethodGet, "/ns/tenant42/keys/hamlet", ""); code != http.StatusOK {
+		t.Errorf("GET status = %v, want %v", code, http.StatusOK)
+	}
+	if code := request(http.MethodGet, "/ns/tenant42/stats", ""); code != http.StatusOK {
+		t.Errorf("GET stats status = %v, want %v", code, http.StatusOK)
+	}
+	if code := request(http.MethodPut, "/ns/other/keys/hamlet", "shakespeare"); code != http.StatusForbidden {
+		t.Errorf("PUT in another namespace status = %v, want %v", code, http.StatusForbidden)
+	}
+	if code := request(http.MethodPut, "/ns/../keys/hamlet", "shakespeare"); code == http.StatusNoContent {
+		t.Errorf("PUT in an invalid namespace status = %v, want an error", code)
+	}
+	srv.Shutdown(context.Background())
+	ns.Close()
+
+	// the namespace is there when we open the directory again
+	ns, err = OpenNamespaces(dir, NamespaceOptions{})
+	if err != nil {
+		t.Fatalf("OpenNamespaces() error = %v", err)
+	}
+	defer ns.Close()
+	if names := ns.Names(); len(names) != 1 || names[0] != "tenant42" {
+		t.Errorf("Names() = %v, want [tenant42]", names)
+	}
+	store, err := ns.store("tenant42", false)
+	if err != nil {
+		t.Fatalf("store() error = %v", err)
+	}
+	if val := store.Get("hamlet"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+}
+
+func TestNamespaces_MaxNamespaces(t *testing.T) {
+	dir := t.TempDir()
+	ns, err := OpenNamespaces(dir, NamespaceOptions{MaxNamespaces: 2})
+	if err != nil {
+		t.Fatalf("OpenNamespaces() error = %v", err)
+	}
+	for _, name := range []string{"hamlet", "macbeth"} {
+		if _, err := ns.store(name, true); err != nil {
+			t.Fatalf("store(%q) error = %v", name, err)
+		}
+	}
+	if _, err := ns.store("othello", true); !errors.Is(err, ErrTooManyNamespaces) {
+		t.Errorf("store() past the limit error = %v, want %v", err, ErrTooManyNamespaces)
+	}
+	// the existing namespaces are still there to write to
+	if _, err := ns.store("hamlet", true); err != nil {
+		t.Errorf("store() of an existing namespace error = %v", err)
+	}
+	ns.Close()
+
+	// a lower limit does not hide the namespaces already created
+	ns, err = OpenNamespaces(dir, NamespaceOptions{MaxNamespaces: 1})
+	if err != nil {
+		t.Fatalf("OpenNamespaces() error = %v", err)
+	}
+	defer ns.Close()
+	if names := ns.Names(); len(names) != 2 {
+		t.Errorf("Names() = %v, want [hamlet macbeth]", names)
+	}
+}
@@ -0,0 +1,17 @@
+package server
+
+import "crypto/tls"
+
+// Options configures how a server is exposed. The zero value serves plain text to
+// anyone who can connect, which is fine on localhost only.
+type Options struct {
+	// TLSConfig makes the server accept TLS connections only. It needs at least
+	// one certificate.
+	TLSConfig *tls.Config
+	// Auth makes the server require credentials for every request on the keys.
+	// The health probes stay open, so that orchestrators can reach them.
+	Auth *Auth
+	// BackupDir is the directory the backups taken over the admin API are written
+	// to. Backups are disabled when it is empty.
+	BackupDir string
+}
@@ -0,0 +1,483 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/avinassh/go-caskdb/cluster"
+)
+
+const (
+	// proxyDialTimeout bounds connecting to a shard
+	proxyDialTimeout = 5 * time.Second
+	// proxyIdleConns is the number of idle connections kept open to every shard
+	proxyIdleConns = 16
+)
+
+// RESPProxy speaks RESP to clients, like RESPServer, and forwards every command to
+// the shard owning its key, placed with a cluster.Ring named after the addresses
+// of the shards. It keeps no state besides the connections, so any number of
+// proxies with the same shards route the keys the same way, and so does a
+// cluster.Cluster whose nodes are named after the same addresses.
+//
+// The shards are RESPServers. The commands on a single key are forwarded as they
+// are, along with SELECT for the namespace of the client:
+//
+//	GET, SET, EXPIRE, TTL and PTTL
+//
+// DEL, EXISTS, MGET and MSET are split by shard, and their replies combined; MSET
+// is not atomic across shards. DBSIZE adds up the sizes of all the shards. PING,
+// ECHO, QUIT, AUTH, SELECT and COMMAND are answered by the proxy. SCAN and the
+// admin commands are not supported.
+//
+// With Options.Auth, the clients authenticate with the proxy, which checks their
+// permissions on the keys; the shards must then accept the proxy without
+// credentials, e.g. on a private network.
+type RESPProxy struct {
+	ring   *cluster.Ring
+	shards map[string]*shardPool
+	opts   Options
+	tcp    *tcpServer
+}
+
+// NewRESPProxy returns a RESPProxy routing the keys to the shards, given by
+// address, e.g. "books-1:6379", each placed at virtualNodes points on the ring;
+// zero means cluster.DefaultVirtualNodes.
+func NewRESPProxy(shards []string, virtualNodes int, opts Options) *RESPProxy {
+	p := &RESPProxy{ring: cluster.NewRing(virtualNodes), shards: make(map[string]*shardPool), opts: opts}
+	for _, addr := range shards {
+		p.ring.Add(addr)
+		p.shards[addr] = &shardPool{addr: addr, idle: make(chan *shardConn, proxyIdleConns)}
+	}
+	p.tcp = newTCPServer(opts.TLSConfig, p.serveConn)
+	return p
+}
+
+// Serve accepts connections on l until Shutdown is called. It returns nil after
+// a Shutdown, and the error which stopped it otherwise.
+func (p *RESPProxy) Serve(l net.Listener) error {
+	return p.tcp.serve(l)
+}
+
+// Shutdown stops accepting new connections and waits for the commands in flight,
+// like RESPServer.Shutdown, then closes the idle connections to the shards.
+func (p *RESPProxy) Shutdown(ctx context.Context) error {
+	err := p.tcp.shutdown(ctx)
+	for _, pool := range p.shards {
+		pool.close()
+	}
+	return err
+}
+
+// proxyConn is the state of a single client connection.
+type proxyConn struct {
+	proxy     *RESPProxy
+	r         *bufio.Reader
+	w         respWriter
+	namespace string
+	user      *User
+}
+
+func (p *RESPProxy) serveConn(conn net.Conn) {
+	c := &proxyConn{
+		proxy:     p,
+		r:         bufio.NewReader(conn),
+		w:         respWriter{bufio.NewWriter(conn)},
+		namespace: DefaultNamespace,
+	}
+	for {
+		args, err := readCommand(c.r)
+		if err != nil {
+			var perr protocolError
+			if errors.As(err, &perr) {
+				c.w.writeError("ERR Protocol error: " + perr.Error())
+				c.w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := c.handle(args)
+		if quit || c.r.Buffered() == 0 {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// proxyCommands are the commands the proxy runs, along with the arguments they
+// take. The keys of those with keys set are checked against the permissions of
+// the user, for writing if write is set.
+var proxyCommands = map[string]struct {
+	run                 func(c *proxyConn, args []string)
+	minArgs, maxArgs    int
+	noAuth, keys, write bool
+}{
+	"PING":    {run: proxyPing, minArgs: 0, maxArgs: 1, noAuth: true},
+	"ECHO":    {run: proxyEcho, minArgs: 1, maxArgs: 1},
+	"QUIT":    {minArgs: 0, maxArgs: -1, noAuth: true},
+	"AUTH":    {run: proxyAuth, minArgs: 1, maxArgs: 2, noAuth: true},
+	"SELECT":  {run: proxySelect, minArgs: 1, maxArgs: 1},
+	"COMMAND": {run: proxyCommand, minArgs: 0, maxArgs: -1, noAuth: true},
+	"GET":     {run: proxyForward, minArgs: 1, maxArgs: 1, keys: true},
+	"SET":     {run: proxyForward, minArgs: 2, maxArgs: 4, keys: true, write: true},
+	"EXPIRE":  {run: proxyForward, minArgs: 2, maxArgs: 2, keys: true, write: true},
+	"TTL":     {run: proxyForward, minArgs: 1, maxArgs: 1, keys: true},
+	"PTTL":    {run: proxyForward, minArgs: 1, maxArgs: 1, keys: true},
+	"DEL":     {run: proxyCount, minArgs: 1, maxArgs: -1, keys: true, write: true},
+	"EXISTS":  {run: proxyCount, minArgs: 1, maxArgs: -1, keys: true},
+	"MGET":    {run: proxyMGet, minArgs: 1, maxArgs: -1, keys: true},
+	"MSET":    {run: proxyMSet, minArgs: 2, maxArgs: -1, keys: true, write: true},
+	"DBSIZE":  {run: proxyDBSize, minArgs: 0, maxArgs: 0},
+}
+
+// handle runs a single command and writes its reply. It returns true when the
+// connection should be closed.
+func (c *proxyConn) handle(args []string) bool {
+	name := strings.ToUpper(args[0])
+	cmd, ok := proxyCommands[name]
+	if !ok {
+		if _, ok := respCommands[name]; ok {
+			c.w.writeError(fmt.Sprintf("ERR '%s' is not supported by the proxy", strings.ToLower(name)))
+		} else {
+			c.w.writeError(fmt.Sprintf("ERR unknown command '%s'", args0(name)))
+		}
+		return false
+	}
+	if n := len(args) - 1; n < cmd.minArgs || (cmd.maxArgs >= 0 && n > cmd.maxArgs) {
+		c.w.writeError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return false
+	}
+	if c.proxy.opts.Auth != nil && c.user == nil && !cmd.noAuth {
+		c.w.writeError("NOAUTH Authentication required.")
+		return false
+	}
+	if name == "QUIT" {
+		c.w.writeSimple("OK")
+		return true
+	}
+	if c.user != nil && cmd.keys {
+		for _, key := range commandKeys(name, args[1:]) {
+			if !c.user.can(c.namespace, key, cmd.write) {
+				c.w.writeError("NOPERM this user has no permissions to access the key")
+				return false
+			}
+		}
+	}
+	cmd.run(c, args)
+	return false
+}
+
+// commandKeys returns the keys of the command, given its arguments.
+func commandKeys(name string, args []string) []string {
+	switch name {
+	case "DEL", "EXISTS", "MGET":
+		return args
+	case "MSET":
+		var keys []string
+		for i := 0; i < len(args); i += 2 {
+			keys = append(keys, args[i])
+		}
+		return keys
+	}
+	return args[:1]
+}
+
+func proxyPing(c *proxyConn, args []string) {
+	if len(args) == 2 {
+		c.w.writeBulk(args[1])
+		return
+	}
+	c.w.writeSimple("PONG")
+}
+
+func proxyEcho(c *proxyConn, args []string) {
+	c.w.writeBulk(args[1])
+}
+
+func proxyCommand(c *proxyConn, args []string) {
+	c.w.writeArrayLen(0)
+}
+
+func proxyAuth(c *proxyConn, args []string) {
+	auth := c.proxy.opts.Auth
+	if auth == nil {
+		c.w.writeError("ERR AUTH called without any password configured")
+		return
+	}
+	var user *User
+	var ok bool
+	if len(args) == 2 {
+		user, ok = auth.loginToken(args[1])
+	} else {
+		user, ok = auth.login(args[1], args[2])
+	}
+	if !ok {
+		c.w.writeError("WRONGPASS invalid username-password pair or user is disabled.")
+		return
+	}
+	c.user = user
+	c.w.writeSimple("OK")
+}
+
+// proxySelect picks the namespace without asking the shards, which are asked for
+// it along with the commands.
+func proxySelect(c *proxyConn, args []string) {
+	namespace := args[1]
+	if namespace == "0" {
+		namespace = DefaultNamespace
+	}
+	if c.user != nil && !c.user.can(namespace, "", false) {
+		c.w.writeError("NOPERM this user has no permissions to access the namespace")
+		return
+	}
+	c.namespace = namespace
+	c.w.writeSimple("OK")
+}
+
+// proxyForward forwards the command to the shard of its key, and relays the
+// reply.
+func proxyForward(c *proxyConn, args []string) {
+	reply, err := c.proxy.do(c.proxy.ring.Node(args[1]), c.namespace, args)
+	if err != nil {
+		c.w.writeError("ERR " + err.Error())
+		return
+	}
+	c.w.Write(reply)
+}
+
+// proxyCount splits DEL or EXISTS by key, and replies with the sum of the counts
+// of the shards.
+func proxyCount(c *proxyConn, args []string) {
+	var total int64
+	for _, key := range args[1:] {
+		reply, err := c.proxy.do(c.proxy.ring.Node(key), c.namespace, []string{args[0], key})
+		if err == nil {
+			var n int64
+			if n, err = replyInt(reply); err == nil {
+				total += n
+				continue
+			}
+		}
+		c.w.writeError("ERR " + err.Error())
+		return
+	}
+	c.w.writeInt(total)
+}
+
+func proxyMGet(c *proxyConn, args []string) {
+	replies := make([][]byte, 0, len(args)-1)
+	for _, key := range args[1:] {
+		reply, err := c.proxy.do(c.proxy.ring.Node(key), c.namespace, []string{"GET", key})
+		if err != nil {
+			c.w.writeError("ERR " + err.Error())
+			return
+		}
+		replies = append(replies, reply)
+	}
+	c.w.writeArrayLen(len(replies))
+	for _, reply := range replies {
+		c.w.Write(reply)
+	}
+}
+
+func proxyMSet(c *proxyConn, args []string) {
+	if len(args)%2 != 1 {
+		c.w.writeError("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+	for i := 1; i < len(args); i += 2 {
+		reply, err := c.proxy.do(c.proxy.ring.Node(args[i]), c.namespace, []string{"SET", args[i], args[i+1]})
+		if err == nil && reply[0] == '-' {
+			err = errors.New(strings.TrimPrefix(strings.TrimSpace(string(reply[1:])), "ERR "))
+		}
+		if err != nil {
+			c.w.writeError("ERR " + err.Error())
+			return
+		}
+	}
+	c.w.writeSimple("OK")
+}
+
+func proxyDBSize(c *proxyConn, args []string) {
+	var total int64
+	for _, shard := range c.proxy.ring.Nodes() {
+		reply, err := c.proxy.do(shard, c.namespace, args)
+		if err == nil {
+			var n int64
+			if n, err = replyInt(reply); err == nil {
+				total += n
+				continue
+			}
+		}
+		c.w.writeError("ERR " + err.Error())
+		return
+	}
+	c.w.writeInt(total)
+}
+
+// replyInt returns the integer of an integer reply, or the error of an error
+// reply.
+func replyInt(reply []byte) (int64, error) {
+	line := strings.TrimSpace(string(reply[1:]))
+	switch reply[0] {
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '-':
+		return 0, errors.New(strings.TrimPrefix(line, "ERR "))
+	}
+	return 0, fmt.Errorf("unexpected reply %q", reply)
+}
+
+// do sends the command to the shard, in the namespace, and returns its reply as
+// is.
+func (p *RESPProxy) do(shard string, namespace string, args []string) ([]byte, error) {
+	pool, ok := p.shards[shard]
+	if !ok {
+		return nil, errors.New("no shards")
+	}
+	conn, err := pool.get()
+	if err != nil {
+		return nil, fmt.Errorf("shard %s: %w", shard, err)
+	}
+	reply, err := conn.do(namespace, args)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("shard %s: %w", shard, err)
+	}
+	pool.put(conn)
+	return reply, nil
+}
+
+// shardPool keeps the idle connections to a shard.
+type shardPool struct {
+	addr string
+	idle chan *shardConn
+}
+
+// shardConn is a connection to a shard, along with its namespace.
+type shardConn struct {
+	net.Conn
+	r         *bufio.Reader
+	w         *bufio.Writer
+	namespace string
+}
+
+func (p *shardPool) get() (*shardConn, error) {
+	select {
+	case conn := <-p.idle:
+		return conn, nil
+	default:
+	}
+	conn, err := net.DialTimeout("tcp", p.addr, proxyDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &shardConn{Conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn), namespace: DefaultNamespace}, nil
+}
+
+func (p *shardPool) put(conn *shardConn) {
+	select {
+	case p.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (p *shardPool) close() {
+	for {
+		select {
+		case conn := <-p.idle:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// do sends the command, after a SELECT if the connection is on another namespace,
+// and reads the reply.
+func (c *shardConn) do(namespace string, args []string) ([]byte, error) {
+	if namespace != c.namespace {
+		reply, err := c.roundTrip([]string{"SELECT", namespace})
+		if err != nil {
+			return nil, err
+		}
+		if reply[0] == '-' {
+			// the error of SELECT stands for that of the command
+			return reply, nil
+		}
+		c.namespace = namespace
+	}
+	return c.roundTrip(args)
+}
+
+func (c *shardConn) roundTrip(args []string) ([]byte, error) {
+	w := respWriter{c.w}
+	w.writeArrayLen(len(args))
+	for _, arg := range args {
+		w.writeBulk(arg)
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return readReply(c.r)
+}
+
+// readReply reads a whole reply, as is.
+func readReply(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return nil, protocolError("line too long")
+	}
+	if err != nil {
+		return nil, err
+	}
+	reply := append([]byte(nil), line...)
+	if len(line) < 3 {
+		return nil, protocolError("empty reply")
+	}
+	switch line[0] {
+	case '+', '-', ':':
+		return reply, nil
+	case '$':
+		size, err := strconv.Atoi(strings.TrimSpace(string(line[1:])))
+		if err != nil || size > maxBulkLen {
+			return nil, protocolError("invalid bulk length")
+		}
+		if size < 0 {
+			return reply, nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return append(reply, data...), nil
+	case '*':
+		n, err := strconv.Atoi(strings.TrimSpace(string(line[1:])))
+		if err != nil || n > maxArgs {
+			return nil, protocolError("invalid multibulk length")
+		}
+		for i := 0; i < n; i++ {
+			element, err := readReply(r)
+			if err != nil {
+				return nil, err
+			}
+			reply = append(reply, element...)
+		}
+		return reply, nil
+	}
+	return nil, protocolError(fmt.Sprintf("unexpected reply type '%c'", line[0]))
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+func TestRESPProxy(t *testing.T) {
+	var shards []string
+	stores := make(map[string]*caskdb.DiskStore)
+	for i := 0; i < 3; i++ {
+		store, err := caskdb.NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		defer store.Close()
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		srv := NewRESP(store, Options{})
+		go srv.Serve(ln)
+		defer srv.Shutdown(context.Background())
+		shards = append(shards, ln.Addr().String())
+		stores[ln.Addr().String()] = store
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	proxy := NewRESPProxy(shards, 0, Options{})
+	go proxy.Serve(ln)
+	defer proxy.Shutdown(context.Background())
+	c := dialRESP(t, ln.Addr().String())
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"PING"}, "+PONG"},
+		{[]string{"SET", "othello", "shakespeare"}, "+OK"},
+		{[]string{"GET", "othello"}, "shakespeare"},
+		{[]string{"GET", "hamlet"}, "(nil)"},
+		{[]string{"MSET", "hamlet", "1603", "macbeth", "1606"}, "+OK"},
+		{[]string{"MGET", "hamlet", "lear", "macbeth"}, "[1603 (nil) 1606]"},
+		{[]string{"EXISTS", "hamlet", "lear", "macbeth"}, ":2"},
+		{[]string{"DBSIZE"}, ":3"},
+		{[]string{"DEL", "hamlet", "lear"}, ":1"},
+		{[]string{"SET", "lear", "1606", "EX", "100"}, "+OK"},
+		{[]string{"TTL", "lear"}, ":100"},
+		{[]string{"SET", "lear", "1606", "EX", "soon"}, "-ERR invalid expire time in 'set' command"},
+		{[]string{"SELECT", "tenant"}, "+OK"},
+		{[]string{"GET", "othello"}, "-ERR DB index is out of range"},
+		{[]string{"SELECT", "0"}, "+OK"},
+		{[]string{"SCAN", "0"}, "-ERR 'scan' is not supported by the proxy"},
+		{[]string{"FLUSHALL"}, "-ERR unknown command 'FLUSHALL'"},
+	}
+	for _, tt := range tests {
+		if got := c.do(tt.args...); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+
+	// every key is on the shard the ring places it on, and only there
+	for i := 0; i < 50; i++ {
+		c.do("SET", fmt.Sprintf("key-%d", i), "value")
+	}
+	for addr, store := range stores {
+		if len(store.Keys()) == 0 {
+			t.Errorf("shard %s holds no keys", addr)
+		}
+		for _, key := range store.Keys() {
+			if owner := proxy.ring.Node(key); owner != addr {
+				t.Errorf("key %q is on %s, want %s", key, addr, owner)
+			}
+		}
+	}
+}
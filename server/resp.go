@@ -0,0 +1,712 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+// limits on what a client may send us, so that a bad or hostile client cannot
+// make us allocate without bounds. They are the same as Redis'.
+const (
+	maxBulkLen = 512 << 20
+	maxArgs    = 1 << 20
+)
+
+// defaultScanCount is the number of keys SCAN looks at when no COUNT is given
+const defaultScanCount = 10
+
+// maxScanCursors is the number of SCAN cursors a connection keeps; past it, the
+// oldest is dropped, and continuing from it fails
+const maxScanCursors = 16
+
+// RESPServer serves a store over RESP, the Redis protocol, so that Redis clients
+// can talk to it. It supports the commands
+//
+//	PING, ECHO, QUIT, AUTH, SELECT, COMMAND,
+//	GET, SET [EX seconds | PX milliseconds], DEL, EXISTS, MGET, MSET,
+//	EXPIRE, TTL, PTTL, SCAN [MATCH pattern] [COUNT count] and DBSIZE
+//
+// along with the admin commands COMPACT, FSYNC, BACKUP and INFO, which only the
+// users with User.Admin may run when Options.Auth is set.
+//
+// Commands may be pipelined: the replies are written in order, and flushed once
+// every command the client has sent so far is handled.
+//
+// The cursors of SCAN belong to the connection which started the iteration, and
+// only the last few it started are kept.
+//
+// SELECT takes the name of a namespace, with 0 standing for the default one. Since
+// the store records a deletion as an empty value, setting a key to an empty string
+// deletes it.
+type RESPServer struct {
+	backend backend
+	opts    Options
+	tcp     *tcpServer
+}
+
+// NewRESP returns a RESPServer serving the store. The server does not own the
+// store: closing it once the server is shut down is left to the caller.
+func NewRESP(store *caskdb.DiskStore, opts Options) *RESPServer {
+	return newRESP(singleStore{store}, opts)
+}
+
+// NewNamespacedRESP returns a RESPServer serving every namespace in ns, selected
+// with SELECT. Closing ns once the server is shut down is left to the caller.
+func NewNamespacedRESP(ns *Namespaces, opts Options) *RESPServer {
+	return newRESP(ns, opts)
+}
+
+func newRESP(b backend, opts Options) *RESPServer {
+	s := &RESPServer{backend: b, opts: opts}
+	s.tcp = newTCPServer(opts.TLSConfig, s.serveConn)
+	return s
+}
+
+// Serve accepts connections on l until Shutdown is called. It returns nil after
+// a Shutdown, and the error which stopped it otherwise.
+func (s *RESPServer) Serve(l net.Listener) error {
+	return s.tcp.serve(l)
+}
+
+// Shutdown stops accepting new connections and waits for the commands in flight
+// to be handled and replied to; idle connections are closed right away. If ctx is
+// done first, the remaining connections are closed and the error of ctx is
+// returned.
+func (s *RESPServer) Shutdown(ctx context.Context) error {
+	return s.tcp.shutdown(ctx)
+}
+
+// respConn is the state of a single client connection.
+type respConn struct {
+	server *RESPServer
+	r      *bufio.Reader
+	w      respWriter
+	// namespace is the namespace picked with SELECT
+	namespace string
+	// user is who the client authenticated as, nil until it does
+	user *User
+	// scans are the SCAN iterations in progress, by cursor, and lastScan the last
+	// cursor handed out
+	scans    map[uint64]scanCursor
+	lastScan uint64
+}
+
+// scanCursor is where a SCAN iteration stopped: the key to carry on from, in the
+// namespace it iterates over.
+type scanCursor struct {
+	namespace string
+	key       string
+}
+
+func (s *RESPServer) serveConn(conn net.Conn) {
+	c := &respConn{
+		server:    s,
+		r:         bufio.NewReader(conn),
+		w:         respWriter{bufio.NewWriter(conn)},
+		namespace: DefaultNamespace,
+	}
+	for {
+		args, err := readCommand(c.r)
+		if err != nil {
+			var perr protocolError
+			if errors.As(err, &perr) {
+				c.w.writeError("ERR Protocol error: " + perr.Error())
+				c.w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := c.handle(args)
+		// with pipelining, the client may have sent more commands already; we
+		// answer them all in one go before flushing
+		if quit || c.r.Buffered() == 0 {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// handle runs a single command and writes its reply. It returns true when the
+// connection should be closed.
+func (c *respConn) handle(args []string) bool {
+	name := strings.ToUpper(args[0])
+	args = args[1:]
+	cmd, ok := respCommands[name]
+	if !ok {
+		c.w.writeError(fmt.Sprintf("ERR unknown command '%s'", args0(name)))
+		return false
+	}
+	if len(args) < cmd.minArgs || (cmd.maxArgs >= 0 && len(args) > cmd.maxArgs) {
+		c.w.writeError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return false
+	}
+	if c.server.opts.Auth != nil && c.user == nil && !cmd.noAuth {
+		c.w.writeError("NOAUTH Authentication required.")
+		return false
+	}
+	if name == "QUIT" {
+		c.w.writeSimple("OK")
+		return true
+	}
+	cmd.run(c, args)
+	return false
+}
+
+// args0 keeps an unknown command's name short in the error we echo back
+func args0(name string) string {
+	if len(name) > 64 {
+		return name[:64] + "..."
+	}
+	return name
+}
+
+// can reports whether the client may access the key in the current namespace,
+// writing the error reply if not.
+func (c *respConn) can(key string, write bool) bool {
+	if c.user == nil || c.user.can(c.namespace, key, write) {
+		return true
+	}
+	c.w.writeError("NOPERM this user has no permissions to access the key")
+	return false
+}
+
+// store returns the store of the current namespace. Reading from a namespace
+// which does not exist yet gives a nil store, which the commands treat as empty.
+func (c *respConn) store(create bool) (*caskdb.DiskStore, bool) {
+	store, err := c.server.backend.store(c.namespace, create)
+	if errors.Is(err, ErrNamespaceNotFound) && !create {
+		return nil, true
+	}
+	if err != nil {
+		c.w.writeError("ERR " + err.Error())
+		return nil, false
+	}
+	return store, true
+}
+
+type respCommand struct {
+	run func(c *respConn, args []string)
+	// the number of arguments the command takes, not counting its name; a
+	// maxArgs of -1 means there is no upper bound
+	minArgs int
+	maxArgs int
+	// noAuth commands can be run before authenticating
+	noAuth bool
+}
+
+var respCommands = map[string]respCommand{
+	"PING":    {run: cmdPing, minArgs: 0, maxArgs: 1, noAuth: true},
+	"ECHO":    {run: cmdEcho, minArgs: 1, maxArgs: 1},
+	"QUIT":    {minArgs: 0, maxArgs: -1, noAuth: true},
+	"AUTH":    {run: cmdAuth, minArgs: 1, maxArgs: 2, noAuth: true},
+	"SELECT":  {run: cmdSelect, minArgs: 1, maxArgs: 1},
+	"COMMAND": {run: cmdCommand, minArgs: 0, maxArgs: -1, noAuth: true},
+	"GET":     {run: cmdGet, minArgs: 1, maxArgs: 1},
+	"SET":     {run: cmdSet, minArgs: 2, maxArgs: 4},
+	"DEL":     {run: cmdDel, minArgs: 1, maxArgs: -1},
+	"EXISTS":  {run: cmdExists, minArgs: 1, maxArgs: -1},
+	"MGET":    {run: cmdMGet, minArgs: 1, maxArgs: -1},
+	"MSET":    {run: cmdMSet, minArgs: 2, maxArgs: -1},
+	"EXPIRE":  {run: cmdExpire, minArgs: 2, maxArgs: 2},
+	"TTL":     {run: cmdTTL(time.Second), minArgs: 1, maxArgs: 1},
+	"PTTL":    {run: cmdTTL(time.Millisecond), minArgs: 1, maxArgs: 1},
+	"SCAN":    {run: cmdScan, minArgs: 1, maxArgs: 5},
+	"DBSIZE":  {run: cmdDBSize, minArgs: 0, maxArgs: 0},
+	"COMPACT": {run: cmdCompact, minArgs: 0, maxArgs: 0},
+	"FSYNC":   {run: cmdFsync, minArgs: 0, maxArgs: 0},
+	"ROTATE":  {run: cmdRotate, minArgs: 0, maxArgs: 0},
+	"BACKUP":  {run: cmdBackup, minArgs: 0, maxArgs: 0},
+	"INFO":    {run: cmdInfo, minArgs: 0, maxArgs: 1},
+}
+
+func cmdPing(c *respConn, args []string) {
+	if len(args) == 1 {
+		c.w.writeBulk(args[0])
+		return
+	}
+	c.w.writeSimple("PONG")
+}
+
+func cmdEcho(c *respConn, args []string) {
+	c.w.writeBulk(args[0])
+}
+
+func cmdAuth(c *respConn, args []string) {
+	auth := c.server.opts.Auth
+	if auth == nil {
+		c.w.writeError("ERR AUTH called without any password configured")
+		return
+	}
+	// AUTH token, or AUTH username password
+	var user *User
+	var ok bool
+	if len(args) == 1 {
+		user, ok = auth.loginToken(args[0])
+	} else {
+		user, ok = auth.login(args[0], args[1])
+	}
+	if !ok {
+		c.w.writeError("WRONGPASS invalid username-password pair or user is disabled.")
+		return
+	}
+	c.user = user
+	c.w.writeSimple("OK")
+}
+
+func cmdSelect(c *respConn, args []string) {
+	namespace := args[0]
+	if namespace == "0" {
+		namespace = DefaultNamespace
+	}
+	if err := c.server.backend.check(namespace); err != nil {
+		c.w.writeError("ERR DB index is out of range")
+		return
+	}
+	if c.user != nil && !c.user.can(namespace, "", false) {
+		c.w.writeError("NOPERM this user has no permissions to access the namespace")
+		return
+	}
+	c.namespace = namespace
+	c.w.writeSimple("OK")
+}
+
+// cmdCommand answers the introspection clients such as redis-cli do on connect
+// with an empty list, which they take as no extra information.
+func cmdCommand(c *respConn, args []string) {
+	c.w.writeArrayLen(0)
+}
+
+func cmdGet(c *respConn, args []string) {
+	if !c.can(args[0], false) {
+		return
+	}
+	store, ok := c.store(false)
+	if !ok {
+		return
+	}
+	c.writeValue(store, args[0])
+}
+
+// writeValue writes the value of the key as a bulk string, or a null if the key
+// does not exist.
+func (c *respConn) writeValue(store *caskdb.DiskStore, key string) {
+	if store == nil {
+		c.w.writeNull()
+		return
+	}
+	value, err := store.Lookup(key)
+	switch {
+	case errors.Is(err, caskdb.ErrKeyNotFound):
+		c.w.writeNull()
+	case err != nil:
+		c.w.writeError("ERR " + err.Error())
+	default:
+		c.w.writeBulk(value)
+	}
+}
+
+func cmdSet(c *respConn, args []string) {
+	key, value := args[0], args[1]
+	var ttl time.Duration
+	if len(args) > 2 {
+		if len(args) != 4 {
+			c.w.writeError("ERR syntax error")
+			return
+		}
+		n, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil || n <= 0 {
+			c.w.writeError("ERR invalid expire time in 'set' command")
+			return
+		}
+		switch strings.ToUpper(args[2]) {
+		case "EX":
+			ttl = time.Duration(n) * time.Second
+		case "PX":
+			ttl = time.Duration(n) * time.Millisecond
+		default:
+			c.w.writeError("ERR syntax error")
+			return
+		}
+	}
+	if !c.can(key, true) {
+		return
+	}
+	store, ok := c.store(true)
+	if !ok {
+		return
+	}
+	var err error
+	if ttl > 0 {
+		err = store.PutWithTTL(key, value, ttl)
+	} else {
+		err = store.Put(key, value)
+	}
+	if err != nil {
+		c.w.writeError("ERR " + err.Error())
+		return
+	}
+	c.w.writeSimple("OK")
+}
+
+func cmdDel(c *respConn, args []string) {
+	for _, key := range args {
+		if !c.can(key, true) {
+			return
+		}
+	}
+	store, ok := c.store(false)
+	if !ok {
+		return
+	}
+	deleted := 0
+	for _, key := range args {
+		if store == nil || !store.Has(key) {
+			continue
+		}
+		if err := store.Delete(key); err != nil {
+			c.w.writeError("ERR " + err.Error())
+			return
+		}
+		deleted++
+	}
+	c.w.writeInt(int64(deleted))
+}
+
+func cmdExists(c *respConn, args []string) {
+	for _, key := range args {
+		if !c.can(key, false) {
+			return
+		}
+	}
+	store, ok := c.store(false)
+	if !ok {
+		return
+	}
+	found := 0
+	for _, key := range args {
+		if store != nil && store.Has(key) {
+			found++
+		}
+	}
+	c.w.writeInt(int64(found))
+}
+
+func cmdMGet(c *respConn, args []string) {
+	for _, key := range args {
+		if !c.can(key, false) {
+			return
+		}
+	}
+	store, ok := c.store(false)
+	if !ok {
+		return
+	}
+	var values map[string]string
+	if store != nil {
+		var err error
+		if values, err = store.GetMany(args); err != nil {
+			c.w.writeError("ERR " + err.Error())
+			return
+		}
+	}
+	c.w.writeArrayLen(len(args))
+	for _, key := range args {
+		if value, ok := values[key]; ok {
+			c.w.writeBulk(value)
+		} else {
+			c.w.writeNull()
+		}
+	}
+}
+
+// cmdMSet sets the keys in a single Txn, so that, as with Redis, either all of them
+// are set or none.
+func cmdMSet(c *respConn, args []string) {
+	if len(args)%2 != 0 {
+		c.w.writeError("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+	for i := 0; i < len(args); i += 2 {
+		if !c.can(args[i], true) {
+			return
+		}
+	}
+	store, ok := c.store(true)
+	if !ok {
+		return
+	}
+	txn := store.Begin()
+	for i := 0; i < len(args); i += 2 {
+		if err := txn.Put(args[i], args[i+1]); err != nil {
+			txn.Rollback()
+			c.w.writeError("ERR " + err.Error())
+			return
+		}
+	}
+	if err := txn.Commit(); err != nil {
+		c.w.writeError("ERR " + err.Error())
+		return
+	}
+	c.w.writeSimple("OK")
+}
+
+func cmdExpire(c *respConn, args []string) {
+	seconds, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		c.w.writeError("ERR value is not an integer or out of range")
+		return
+	}
+	if !c.can(args[0], true) {
+		return
+	}
+	store, ok := c.store(false)
+	if !ok {
+		return
+	}
+	if store == nil {
+		c.w.writeInt(0)
+		return
+	}
+	err = store.Expire(args[0], time.Duration(seconds)*time.Second)
+	switch {
+	case errors.Is(err, caskdb.ErrKeyNotFound):
+		c.w.writeInt(0)
+	case err != nil:
+		c.w.writeError("ERR " + err.Error())
+	default:
+		c.w.writeInt(1)
+	}
+}
+
+// cmdTTL returns the handler of TTL and PTTL, which reply in units of unit: -2 if
+// the key does not exist, -1 if it does not expire, the time left otherwise.
+func cmdTTL(unit time.Duration) func(c *respConn, args []string) {
+	return func(c *respConn, args []string) {
+		if !c.can(args[0], false) {
+			return
+		}
+		store, ok := c.store(false)
+		if !ok {
+			return
+		}
+		if store == nil {
+			c.w.writeInt(-2)
+			return
+		}
+		ttl, err := store.TTL(args[0])
+		switch {
+		case errors.Is(err, caskdb.ErrKeyNotFound):
+			c.w.writeInt(-2)
+		case err != nil:
+			c.w.writeError("ERR " + err.Error())
+		case ttl == 0:
+			c.w.writeInt(-1)
+		default:
+			// expiry times are kept to the second, rounded up, so rounding the
+			// time left down gives back the TTL the key was set with
+			c.w.writeInt(int64(ttl / unit))
+		}
+	}
+}
+
+// cmdScan iterates over the keys of the namespace, in order. Redis clients expect
+// the cursor to be a number, so it stands for the key to carry on from, which the
+// connection keeps. Walking the keys with a caskdb.Iterator, every key which exists
+// for the whole iteration is returned, even with writes in between, which is the
+// guarantee SCAN gives, and a page costs no more than the keys on it.
+func cmdScan(c *respConn, args []string) {
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		c.w.writeError("ERR invalid cursor")
+		return
+	}
+	match, count := "", defaultScanCount
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			c.w.writeError("ERR syntax error")
+			return
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			match = args[i+1]
+		case "COUNT":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil || count < 1 {
+				c.w.writeError("ERR value is not an integer or out of range")
+				return
+			}
+		default:
+			c.w.writeError("ERR syntax error")
+			return
+		}
+	}
+	from := ""
+	if cursor != 0 {
+		sc, ok := c.scans[cursor]
+		if !ok || sc.namespace != c.namespace {
+			c.w.writeError("ERR invalid cursor")
+			return
+		}
+		delete(c.scans, cursor)
+		from = sc.key
+	}
+	store, ok := c.store(false)
+	if !ok {
+		return
+	}
+	var next uint64
+	var matched []string
+	if store != nil {
+		it := store.Iterator()
+		n := 0
+		for it.Seek(from); it.Valid(); it.Next() {
+			if n == count {
+				next = c.saveScan(it.Key())
+				break
+			}
+			n++
+			key := it.Key()
+			if c.user != nil && !c.user.can(c.namespace, key, false) {
+				continue
+			}
+			if match == "" || caskdb.MatchGlob(match, key) {
+				matched = append(matched, key)
+			}
+		}
+	}
+	c.w.writeArrayLen(2)
+	c.w.writeBulk(strconv.FormatUint(next, 10))
+	c.w.writeArrayLen(len(matched))
+	for _, key := range matched {
+		c.w.writeBulk(key)
+	}
+}
+
+// saveScan keeps the key a SCAN iteration carries on from, and returns its cursor.
+func (c *respConn) saveScan(key string) uint64 {
+	if c.scans == nil {
+		c.scans = make(map[uint64]scanCursor)
+	}
+	c.lastScan++
+	c.scans[c.lastScan] = scanCursor{namespace: c.namespace, key: key}
+	delete(c.scans, c.lastScan-maxScanCursors)
+	return c.lastScan
+}
+
+func cmdDBSize(c *respConn, args []string) {
+	store, ok := c.store(false)
+	if !ok {
+		return
+	}
+	if store == nil {
+		c.w.writeInt(0)
+		return
+	}
+	c.w.writeInt(int64(len(store.Keys())))
+}
+
+// protocolError is a malformed request, after which we cannot tell where the next
+// command starts, so the connection is closed.
+type protocolError string
+
+func (e protocolError) Error() string { return string(e) }
+
+// readCommand reads the next command, either in the RESP array form clients send,
+// or inline, as typed into telnet: the arguments separated by spaces on a line.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > maxArgs {
+		return nil, protocolError("invalid multibulk length")
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, protocolError(fmt.Sprintf("expected '$', got '%.1s'", line))
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxBulkLen {
+			return nil, protocolError("invalid bulk length")
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		if data[size] != '\r' || data[size+1] != '\n' {
+			return nil, protocolError("bulk string is not terminated by CRLF")
+		}
+		args = append(args, string(data[:size]))
+	}
+	return args, nil
+}
+
+// readLine reads a line without its line ending. A line longer than the buffer
+// of r is a protocol error; the lines we expect are short.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return "", protocolError("line too long")
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// respWriter writes the RESP replies.
+type respWriter struct {
+	*bufio.Writer
+}
+
+func (w respWriter) writeSimple(s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func (w respWriter) writeError(msg string) {
+	// an error is a single line, so a message from the store must not break it
+	msg = strings.NewReplacer("\r", " ", "\n", " ").Replace(msg)
+	w.WriteString("-" + msg + "\r\n")
+}
+
+func (w respWriter) writeInt(n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w respWriter) writeBulk(s string) {
+	w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n")
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
+
+func (w respWriter) writeNull() {
+	w.WriteString("$-1\r\n")
+}
+
+func (w respWriter) writeArrayLen(n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
@@ -0,0 +1,370 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+// startRESP serves a fresh store over RESP on a random local port and returns the
+// server along with its address.
+func startRESP(t *testing.T, opts Options) (*RESPServer, string) {
+	t.Helper()
+	store, err := caskdb.NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv := NewRESP(store, opts)
+	go srv.Serve(ln)
+	return srv, ln.Addr().String()
+}
+
+// respClient is just enough of a Redis client to test the server with.
+type respClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialRESP(t *testing.T, addr string) *respClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &respClient{t, conn, bufio.NewReader(conn)}
+}
+
+// send writes the commands without waiting for their replies.
+func (c *respClient) send(cmds ...[]string) {
+	c.t.Helper()
+	var b strings.Builder
+	for _, args := range cmds {
+		fmt.Fprintf(&b, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if _, err := c.conn.Write([]byte(b.String())); err != nil {
+		c.t.Fatalf("failed to send: %v", err)
+	}
+}
+
+// reply reads a reply and formats it as "+OK", "-ERR ...", ":1", the value of a
+// bulk string, "(nil)" or the elements of an array in brackets.
+func (c *respClient) reply() string {
+	c.t.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("failed to read reply: %v", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return "(nil)"
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			c.t.Fatalf("failed to read reply: %v", err)
+		}
+		return string(data[:n])
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		elems := make([]string, n)
+		for i := range elems {
+			elems[i] = c.reply()
+		}
+		return "[" + strings.Join(elems, " ") + "]"
+	}
+	return line
+}
+
+func (c *respClient) do(args ...string) string {
+	c.t.Helper()
+	c.send(args)
+	return c.reply()
+}
+
+func TestRESPServer_Commands(t *testing.T) {
+	srv, addr := startRESP(t, Options{})
+	defer srv.Shutdown(context.Background())
+	c := dialRESP(t, addr)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"PING"}, "+PONG"},
+		{[]string{"SET", "othello", "shakespeare"}, "+OK"},
+		{[]string{"GET", "othello"}, "shakespeare"},
+		{[]string{"GET", "hamlet"}, "(nil)"},
+		{[]string{"MSET", "hamlet", "1603", "macbeth", "1606"}, "+OK"},
+		{[]string{"MGET", "hamlet", "lear", "macbeth"}, "[1603 (nil) 1606]"},
+		// MSET sets all of the keys or none
+		{[]string{"MSET", "lear", "1606", "\x00format\x00", "3"}, `-ERR caskdb: reserved key: "\x00format\x00"`},
+		{[]string{"GET", "lear"}, "(nil)"},
+		{[]string{"EXISTS", "hamlet", "lear", "macbeth"}, ":2"},
+		{[]string{"DBSIZE"}, ":3"},
+		{[]string{"DEL", "hamlet", "lear"}, ":1"},
+		{[]string{"TTL", "othello"}, ":-1"},
+		{[]string{"TTL", "lear"}, ":-2"},
+		{[]string{"EXPIRE", "othello", "100"}, ":1"},
+		{[]string{"TTL", "othello"}, ":100"},
+		{[]string{"EXPIRE", "lear", "100"}, ":0"},
+		{[]string{"SET", "lear", "1606", "EX", "2"}, "+OK"},
+		{[]string{"TTL", "lear"}, ":2"},
+		{[]string{"EXPIRE", "lear", "0"}, ":1"},
+		{[]string{"GET", "lear"}, "(nil)"},
+		{[]string{"SET", "lear", "1606", "EX", "soon"}, "-ERR invalid expire time in 'set' command"},
+		{[]string{"GET"}, "-ERR wrong number of arguments for 'get' command"},
+		{[]string{"FLUSHALL"}, "-ERR unknown command 'FLUSHALL'"},
+	}
+	for _, tt := range tests {
+		if got := c.do(tt.args...); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestRESPServer_Pipelining(t *testing.T) {
+	srv, addr := startRESP(t, Options{})
+	defer srv.Shutdown(context.Background())
+	c := dialRESP(t, addr)
+
+	// every command is sent before reading any reply, and the replies must come
+	// back in order
+	var cmds [][]string
+	for i := 0; i < 100; i++ {
+		cmds = append(cmds, []string{"SET", fmt.Sprint("key", i), fmt.Sprint(i)}, []string{"GET", fmt.Sprint("key", i)})
+	}
+	c.send(cmds...)
+	for i := 0; i < 100; i++ {
+		if got := c.reply(); got != "+OK" {
+			t.Errorf("SET key%d = %q, want %q", i, got, "+OK")
+		}
+		if got, want := c.reply(), fmt.Sprint(i); got != want {
+			t.Errorf("GET key%d = %q, want %q", i, got, want)
+		}
+	}
+	// inline commands, as typed into telnet, work too
+	if _, err := c.conn.Write([]byte("PING\r\nGET key7\r\n")); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	if got := c.reply(); got != "+PONG" {
+		t.Errorf("inline PING = %q, want %q", got, "+PONG")
+	}
+	if got := c.reply(); got != "7" {
+		t.Errorf("inline GET = %q, want %q", got, "7")
+	}
+}
+
+func TestRESPServer_ProtocolError(t *testing.T) {
+	srv, addr := startRESP(t, Options{})
+	defer srv.Shutdown(context.Background())
+
+	for _, req := range []string{"*-1\r\n", "*2\r\n$-5\r\n", "*1\r\n+PING\r\n"} {
+		c := dialRESP(t, addr)
+		if _, err := c.conn.Write([]byte(req)); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		if got := c.reply(); !strings.HasPrefix(got, "-ERR Protocol error") {
+			t.Errorf("%q = %q, want a protocol error", req, got)
+		}
+	}
+	// the server is still up
+	if got := dialRESP(t, addr).do("PING"); got != "+PONG" {
+		t.Errorf("PING = %q, want %q", got, "+PONG")
+	}
+}
+
+func TestRESPServer_Scan(t *testing.T) {
+	srv, addr := startRESP(t, Options{})
+	defer srv.Shutdown(context.Background())
+	c := dialRESP(t, addr)
+
+	var want []string
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprint("user:", i)
+		c.do("SET", key, "x")
+		want = append(want, key)
+		c.do("SET", fmt.Sprint("book:", i), "x")
+	}
+	var got []string
+	cursor := "0"
+	for {
+		c.send([]string{"SCAN", cursor, "MATCH", "user:*", "COUNT", "7"})
+		// the reply is [cursor [keys...]]
+		if line := c.reply0(); line != "*2" {
+			t.Fatalf("SCAN reply = %q, want an array of 2", line)
+		}
+		cursor = c.reply()
+		keys := strings.Trim(c.reply(), "[]")
+		if keys != "" {
+			got = append(got, strings.Fields(keys)...)
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("SCAN returned %v, want %v", got, want)
+	}
+}
+
+// reply0 reads the first line of a reply only.
+func (c *respClient) reply0() string {
+	c.t.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("failed to read reply: %v", err)
+	}
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+func TestRESPServer_ScanWrites(t *testing.T) {
+	srv, addr := startRESP(t, Options{})
+	defer srv.Shutdown(context.Background())
+	c := dialRESP(t, addr)
+
+	var keys []string
+	for i := 0; i < 25; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		c.do("SET", key, "x")
+		keys = append(keys, key)
+	}
+	seen := make(map[string]int)
+	cursor := "0"
+	for pages := 0; ; pages++ {
+		if pages > len(keys) {
+			t.Fatalf("SCAN did not finish after %d pages", pages)
+		}
+		c.send([]string{"SCAN", cursor, "COUNT", "10"})
+		c.reply0()
+		cursor = c.reply()
+		for _, key := range strings.Fields(strings.Trim(c.reply(), "[]")) {
+			seen[key]++
+		}
+		if cursor == "0" {
+			break
+		}
+		// keys deleted behind the cursor and added anywhere do not throw it off
+		c.do("DEL", fmt.Sprintf("key%02d", pages))
+		c.do("SET", fmt.Sprintf("key%02d-%d", pages, pages), "x")
+		c.do("SET", fmt.Sprintf("a%d", pages), "x")
+	}
+	for _, key := range keys {
+		if seen[key] != 1 {
+			t.Errorf("SCAN returned %s %d times, want once", key, seen[key])
+		}
+	}
+	if got := c.do("SCAN", "12345"); got != "-ERR invalid cursor" {
+		t.Errorf("SCAN of an unknown cursor = %q, want %q", got, "-ERR invalid cursor")
+	}
+}
+
+func TestRESPServer_Auth(t *testing.T) {
+	auth := NewAuth([]User{
+		{Name: "admin", Password: "hunter2"},
+		{Name: "tenant", Token: "s3cret", Prefixes: []string{"tenant:"}},
+	})
+	srv, addr := startRESP(t, Options{Auth: auth})
+	defer srv.Shutdown(context.Background())
+	c := dialRESP(t, addr)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"PING"}, "+PONG"},
+		{[]string{"GET", "tenant:a"}, "-NOAUTH Authentication required."},
+		{[]string{"AUTH", "admin", "hunter3"}, "-WRONGPASS invalid username-password pair or user is disabled."},
+		{[]string{"AUTH", "s3cret"}, "+OK"},
+		{[]string{"SET", "tenant:a", "1"}, "+OK"},
+		{[]string{"SET", "other", "1"}, "-NOPERM this user has no permissions to access the key"},
+		{[]string{"AUTH", "admin", "hunter2"}, "+OK"},
+		{[]string{"SET", "other", "1"}, "+OK"},
+	}
+	for _, tt := range tests {
+		if got := c.do(tt.args...); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestRESPServer_Select(t *testing.T) {
+	ns, err := OpenNamespaces(t.TempDir(), NamespaceOptions{})
+	if err != nil {
+		t.Fatalf("OpenNamespaces() error = %v", err)
+	}
+	defer ns.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv := NewNamespacedRESP(ns, Options{})
+	go srv.Serve(ln)
+	defer srv.Shutdown(context.Background())
+	c := dialRESP(t, ln.Addr().String())
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"SET", "hamlet", "default"}, "+OK"},
+		{[]string{"SELECT", "books"}, "+OK"},
+		{[]string{"GET", "hamlet"}, "(nil)"},
+		{[]string{"DBSIZE"}, ":0"},
+		{[]string{"SET", "hamlet", "books"}, "+OK"},
+		{[]string{"SELECT", "0"}, "+OK"},
+		{[]string{"GET", "hamlet"}, "default"},
+		{[]string{"SELECT", "../etc"}, "-ERR DB index is out of range"},
+	}
+	for _, tt := range tests {
+		if got := c.do(tt.args...); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+	if got := ns.Names(); strings.Join(got, " ") != "books default" {
+		t.Errorf("Names() = %v, want [books default]", got)
+	}
+}
+
+func TestRESPServer_Shutdown(t *testing.T) {
+	srv, addr := startRESP(t, Options{})
+	c := dialRESP(t, addr)
+	c.do("SET", "hamlet", "shakespeare")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	// the idle connection is closed by the server
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Errorf("read after Shutdown succeeded, want the connection closed")
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Errorf("Dial() after Shutdown succeeded, want an error")
+	}
+}
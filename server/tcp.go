@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+)
+
+// tcpServer is the connection handling shared by the frontends speaking a protocol
+// of their own over TCP. It accepts the connections, serves each with handle in a
+// goroutine of its own and keeps track of them, so that they can be drained on
+// shutdown.
+type tcpServer struct {
+	tlsConfig *tls.Config
+	// handle serves a connection until the client is done or a read fails; the
+	// connection is closed once it returns
+	handle func(conn net.Conn)
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closing  bool
+	wg       sync.WaitGroup
+}
+
+func newTCPServer(tlsConfig *tls.Config, handle func(conn net.Conn)) *tcpServer {
+	return &tcpServer{tlsConfig: tlsConfig, handle: handle, conns: make(map[net.Conn]struct{})}
+}
+
+func (s *tcpServer) serve(l net.Listener) error {
+	if s.tlsConfig != nil {
+		l = tls.NewListener(l, s.tlsConfig)
+	}
+	s.mu.Lock()
+	s.listener = l
+	closing := s.closing
+	s.mu.Unlock()
+	if closing {
+		l.Close()
+		return nil
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closing := s.closing
+			s.mu.Unlock()
+			if closing {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closing {
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer func() {
+				conn.Close()
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+				s.wg.Done()
+			}()
+			s.handle(conn)
+		}()
+	}
+}
+
+func (s *tcpServer) shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	// a read deadline in the past wakes up the connections waiting for their next
+	// command, while the ones in the middle of a command get to finish it
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
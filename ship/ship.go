@@ -0,0 +1,217 @@
+// Package ship copies a store's log to a remote target on a schedule, for disaster
+// recovery. Every round uploads the part of the log written since the previous
+// one as an object of its own, so that at most one interval's worth of writes is
+// lost with the machine.
+//
+// The objects are named after the offset in the log they start at, zero padded,
+// so that listing them gives them in order:
+//
+//	books/00000000000000000000.log
+//	books/00000000000000004096.log
+//	...
+//
+// To restore, download them and concatenate them in that order into a data file,
+// e.g. with cat; a DiskStore opens it like any other.
+package ship
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+const (
+	// DefaultInterval is the time between two rounds when Options.Interval is not
+	// set
+	DefaultInterval = time.Minute
+	// DefaultMaxObjectBytes is the largest object uploaded when
+	// Options.MaxObjectBytes is not set
+	DefaultMaxObjectBytes = 64 << 20
+)
+
+// Target stores the shipped objects. *s3.Client and HTTPTarget are Targets.
+type Target interface {
+	Put(ctx context.Context, name string, data []byte) error
+}
+
+// HTTPTarget uploads every object with a PUT to URL/name, e.g. to a WebDAV server
+// or a presigned endpoint.
+type HTTPTarget struct {
+	URL string
+	// Header is sent along with every request, e.g. for an Authorization
+	Header http.Header
+	// Client sends the requests. When nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+func (t HTTPTarget) Put(ctx context.Context, name string, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, strings.TrimSuffix(t.URL, "/")+"/"+name, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for key, values := range t.Header {
+		req.Header[key] = values
+	}
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("ship: PUT %s: %s", req.URL, resp.Status)
+	}
+	return nil
+}
+
+// Options configures a Shipper. StateFile is required, the rest have defaults.
+type Options struct {
+	// StateFile is where the offset shipped so far is persisted, so that a restart
+	// carries on from there. Delete it to ship the whole log again.
+	StateFile string
+	// Prefix is prepended to the object names, e.g. "books/"
+	Prefix string
+	// Interval is the time between two rounds in Run
+	Interval time.Duration
+	// MaxObjectBytes caps the size of an object; a round with more to ship
+	// uploads several
+	MaxObjectBytes int64
+	// Logger receives the failed rounds of Run. When nil, nothing is logged.
+	Logger caskdb.Logger
+}
+
+// Shipper ships the log of a store. Create it with NewShipper.
+type Shipper struct {
+	store   *caskdb.DiskStore
+	target  Target
+	opts    Options
+	shipped int64
+}
+
+// NewShipper returns a Shipper uploading the log of the store to target, starting
+// from the offset persisted in opts.StateFile, or from the beginning of the log if
+// there is none yet.
+func NewShipper(store *caskdb.DiskStore, target Target, opts Options) (*Shipper, error) {
+	if opts.StateFile == "" {
+		return nil, errors.New("ship: Options.StateFile is required")
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultInterval
+	}
+	if opts.MaxObjectBytes <= 0 {
+		opts.MaxObjectBytes = DefaultMaxObjectBytes
+	}
+	if opts.Logger == nil {
+		opts.Logger = nopLogger{}
+	}
+	shipped, err := readOffset(opts.StateFile)
+	if err != nil {
+		return nil, err
+	}
+	return &Shipper{store: store, target: target, opts: opts, shipped: shipped}, nil
+}
+
+// Shipped returns the offset in the log up to which everything was shipped.
+func (s *Shipper) Shipped() int64 {
+	return s.shipped
+}
+
+// Ship uploads everything written since the last round. It is what Run does on
+// every tick; call it directly to ship once more before closing the store.
+func (s *Shipper) Ship(ctx context.Context) error {
+	for {
+		var buf bytes.Buffer
+		next, err := s.store.CopyLog(&buf, s.shipped, s.opts.MaxObjectBytes)
+		if err != nil {
+			return err
+		}
+		if next == s.shipped {
+			return nil
+		}
+		name := fmt.Sprintf("%s%020d.log", s.opts.Prefix, s.shipped)
+		if err := s.target.Put(ctx, name, buf.Bytes()); err != nil {
+			return err
+		}
+		if err := writeOffset(s.opts.StateFile, next); err != nil {
+			return fmt.Errorf("ship: failed to persist the state: %w", err)
+		}
+		s.opts.Logger.Debug("shipped log", "object", name, "bytes", buf.Len())
+		s.shipped = next
+	}
+}
+
+// Run ships a round every Options.Interval, starting right away, until ctx is
+// done, and then returns its error. A failed round is logged and retried on the
+// next tick.
+func (s *Shipper) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.opts.Interval)
+	defer ticker.Stop()
+	for {
+		if err := s.Ship(ctx); err != nil && ctx.Err() == nil {
+			s.opts.Logger.Warn("shipping failed", "offset", s.shipped, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// nopLogger discards everything, like the store's default logger.
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, args ...any) {}
+func (nopLogger) Info(msg string, args ...any)  {}
+func (nopLogger) Warn(msg string, args ...any)  {}
+func (nopLogger) Error(msg string, args ...any) {}
+
+// readOffset returns the offset persisted in the file, 0 if there is none yet.
+func readOffset(fileName string) (int64, error) {
+	data, err := os.ReadFile(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("ship: invalid state file %s", fileName)
+	}
+	return offset, nil
+}
+
+// writeOffset persists the offset, replacing the file atomically, so that a crash
+// leaves either the old or the new offset behind and never a torn one.
+func writeOffset(fileName string, offset int64) error {
+	tmp, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(strconv.FormatInt(offset, 10) + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fileName)
+}
@@ -0,0 +1,92 @@
+package ship
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+// memTarget keeps the objects in memory, failing the uploads while fail is set.
+type memTarget struct {
+	objects map[string][]byte
+	fail    bool
+}
+
+func (m *memTarget) Put(ctx context.Context, name string, data []byte) error {
+	if m.fail {
+		return errors.New("bucket unavailable")
+	}
+	m.objects[name] = append([]byte(nil), data...)
+	return nil
+}
+
+// restore concatenates the objects in the order of their names.
+func (m *memTarget) restore() []byte {
+	var names []string
+	for name := range m.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var data []byte
+	for _, name := range names {
+		data = append(data, m.objects[name]...)
+	}
+	return data
+}
+
+func TestShipper(t *testing.T) {
+	store, err := caskdb.NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	opts := Options{StateFile: filepath.Join(t.TempDir(), "state"), Prefix: "books/", MaxObjectBytes: 40}
+	target := &memTarget{objects: make(map[string][]byte)}
+	shipper, err := NewShipper(store, target, opts)
+	if err != nil {
+		t.Fatalf("NewShipper() error = %v", err)
+	}
+
+	store.Set("othello", "shakespeare")
+	store.Set("hamlet", "shakespeare")
+	if err := shipper.Ship(context.Background()); err != nil {
+		t.Fatalf("Ship() error = %v", err)
+	}
+	if len(target.objects) < 2 {
+		t.Errorf("Ship() uploaded %d objects, want the log split in objects of 40 bytes", len(target.objects))
+	}
+	if _, ok := target.objects["books/00000000000000000000.log"]; !ok {
+		t.Errorf("Ship() did not upload books/00000000000000000000.log")
+	}
+
+	// a failed round ships nothing, and the next one catches up
+	store.Set("dune", "herbert")
+	target.fail = true
+	if err := shipper.Ship(context.Background()); err == nil {
+		t.Fatalf("Ship() error = nil, want the upload failure")
+	}
+	target.fail = false
+	// a restarted shipper carries on from the persisted state
+	shipper, err = NewShipper(store, target, opts)
+	if err != nil {
+		t.Fatalf("NewShipper() error = %v", err)
+	}
+	if err := shipper.Ship(context.Background()); err != nil {
+		t.Fatalf("Ship() error = %v", err)
+	}
+
+	var log bytes.Buffer
+	if _, err := store.CopyLog(&log, 0, 1<<20); err != nil {
+		t.Fatalf("CopyLog() error = %v", err)
+	}
+	if !bytes.Equal(target.restore(), log.Bytes()) {
+		t.Errorf("the shipped objects do not add up to the log")
+	}
+}
@@ -0,0 +1,62 @@
+package caskdb
+
+import "time"
+
+// SlowOp describes an operation which took longer than Options.SlowOpThreshold.
+type SlowOp struct {
+	// Operation is what took long:
+	//   - "Get", a Lookup, Get or GetEntry
+	//   - "GetMany", a GetMany
+	//   - "Set", a Set, Put or PutWithTTL, or an Expire
+	//   - "Delete", a Delete
+	//   - "DeletePrefix", a DeletePrefix, whose Key is the prefix
+	//   - "DeleteAll", a DeleteAll
+	//   - "Commit", the Commit of a Txn
+	//   - "Sync", an fsync of the active file, on its own or as part of a write
+	//   - "Compact", the compaction of a run of segments by Compact
+	Operation string
+	// Key is the key the operation was on; it is empty for the operations on
+	// many keys, or on none
+	Key string
+	// Size is the number of bytes the operation read or wrote, header included
+	Size int
+	// Segment is the data file the operation read from or wrote to, empty for a
+	// GetMany; for Compact, it is the segment the compacted records went to
+	Segment  string
+	Duration time.Duration
+}
+
+// observe records the latency of the operation started at start for Stats, and
+// reports it as slow if it took longer than the configured threshold. The report
+// goes to the logger and to Options.OnSlowOp.
+func (d *DiskStore) observe(operation string, key string, size int, segment string, start time.Time) {
+	elapsed := time.Since(start)
+	switch operation {
+	case "Get":
+		d.readLatency.record(elapsed)
+	case "Set", "Delete":
+		d.writeLatency.record(elapsed)
+	case "Sync":
+		d.syncLatency.record(elapsed)
+	}
+	if d.opts.SlowOpThreshold <= 0 || elapsed < d.opts.SlowOpThreshold {
+		return
+	}
+	op := SlowOp{Operation: operation, Key: key, Size: size, Segment: segment, Duration: elapsed}
+	d.log.Warn("slow operation", "op", op.Operation, "key", op.Key, "size", op.Size, "segment", op.Segment, "duration", op.Duration)
+	if d.opts.OnSlowOp != nil {
+		d.opts.OnSlowOp(op)
+	}
+}
+
+// segmentOf returns the path of the segment the record of kEntry is read from.
+// The store must be locked.
+func (d *DiskStore) segmentOf(kEntry KeyEntry) string {
+	if kEntry.blob != nil {
+		kEntry = kEntry.blob.at
+	}
+	if seg := d.segment(kEntry.segment); seg != nil {
+		return seg.path
+	}
+	return ""
+}
@@ -0,0 +1,99 @@
+package caskdb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_SlowOps(t *testing.T) {
+	var ops []SlowOp
+	store, err := NewDiskStoreWithOptions("test.db", Options{
+		// every operation takes at least a nanosecond, so all of them are slow
+		SlowOpThreshold: time.Nanosecond,
+		OnSlowOp:        func(op SlowOp) { ops = append(ops, op) },
+	})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	size, _ := encodeKV(0, "othello", "shakespeare")
+	store.Set("othello", "shakespeare")
+	store.Get("othello")
+	want := []SlowOp{
+		{Operation: "Sync", Size: size},
+		{Operation: "Set", Key: "othello", Size: size},
+		{Operation: "Get", Key: "othello", Size: size},
+	}
+	if len(ops) != len(want) {
+		t.Fatalf("got %v slow ops, want %v", len(ops), len(want))
+	}
+	for i, op := range ops {
+		if op.Operation != want[i].Operation || op.Key != want[i].Key || op.Size != want[i].Size {
+			t.Errorf("slow op = %+v, want %+v", op, want[i])
+		}
+		if op.Segment != "test.db" || op.Duration <= 0 {
+			t.Errorf("slow op = %+v, want segment test.db and a duration", op)
+		}
+	}
+}
+
+func TestDiskStore_SlowOps_segments(t *testing.T) {
+	var ops []SlowOp
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{
+		MaxSegmentBytes: 100,
+		SlowOpThreshold: time.Nanosecond,
+		OnSlowOp:        func(op SlowOp) { ops = append(ops, op) },
+	})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("othello", "shakespeare")
+	for i := 0; i < 12; i++ {
+		store.Set("key", fmt.Sprintf("value-%d", i%10))
+	}
+
+	ops = nil
+	store.Get("othello")
+	if len(ops) != 1 || ops[0].Segment != sealedPath(fileName, 1) {
+		t.Errorf("slow ops of Get() = %+v, want one on %s", ops, sealedPath(fileName, 1))
+	}
+	ops = nil
+	if _, err := store.Compact(context.Background()); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if len(ops) == 0 || ops[0].Operation != "Compact" || !strings.HasPrefix(ops[0].Segment, fileName+".") || ops[0].Size <= 0 {
+		t.Errorf("slow ops of Compact() = %+v, want the compaction into a sealed segment", ops)
+	}
+}
+
+func TestDiskStore_SlowOps_unlocked(t *testing.T) {
+	var store *DiskStore
+	var has []bool
+	store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{
+		SlowOpThreshold: time.Nanosecond,
+		// the store would deadlock if the Get were reported with it locked
+		OnSlowOp: func(op SlowOp) {
+			if op.Operation == "Get" {
+				has = append(has, store.Has(op.Key))
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("othello", "shakespeare")
+	store.Get("othello")
+	if len(has) != 1 || !has[0] {
+		t.Errorf("Has() from OnSlowOp = %v, want [true]", has)
+	}
+}
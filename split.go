@@ -0,0 +1,67 @@
+package caskdb
+
+import (
+	"errors"
+	"strings"
+)
+
+// SplitRule sends the keys starting with Prefix to the data file at Path, for
+// Split.
+type SplitRule struct {
+	Prefix string
+	Path   string
+	// TrimPrefix writes the keys without the prefix, e.g. to extract a tenant
+	// whose keys are tenant42/... into a store of its own
+	TrimPrefix bool
+}
+
+// Split partitions the live keys of the store into new data files according to
+// the rules, and returns the number of keys written to each path. A key goes to
+// the rule with the longest prefix it starts with; a rule with an empty prefix
+// catches the keys no other rule does, and without one those keys are left out.
+// Several rules may share a path.
+//
+// Like CopyTo, the records keep their timestamps and expiries, the store is not
+// blocked while they are copied, and Split fails rather than overwrite an
+// existing file. The store itself is left as it is.
+func (d *DiskStore) Split(rules []SplitRule) (map[string]int, error) {
+	if len(rules) == 0 {
+		return nil, errors.New("caskdb: Split needs at least one rule")
+	}
+	var paths []string
+	index := make(map[string]int)
+	for _, rule := range rules {
+		if _, ok := index[rule.Path]; !ok {
+			index[rule.Path] = len(paths)
+			paths = append(paths, rule.Path)
+		}
+	}
+	counts, err := d.copyLive(paths, func(key string) (int, string, bool) {
+		match := -1
+		for i, rule := range rules {
+			if strings.HasPrefix(key, rule.Prefix) && (match < 0 || len(rule.Prefix) > len(rules[match].Prefix)) {
+				match = i
+			}
+		}
+		if match < 0 {
+			return 0, "", false
+		}
+		rule := rules[match]
+		if rule.TrimPrefix {
+			key = strings.TrimPrefix(key, rule.Prefix)
+			if key == "" {
+				// the key is the prefix itself, and there is nothing left to write it as
+				return 0, "", false
+			}
+		}
+		return index[rule.Path], key, true
+	})
+	if err != nil {
+		return nil, err
+	}
+	written := make(map[string]int, len(paths))
+	for i, path := range paths {
+		written[path] = counts[i]
+	}
+	return written, nil
+}
@@ -0,0 +1,55 @@
+package caskdb
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskStore_Split(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewDiskStore(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("tenant42/othello", "shakespeare")
+	store.Set("tenant42/hamlet", "shakespeare")
+	store.Set("tenant42/archive/dune", "herbert")
+	store.Set("tenant7/emma", "austen")
+	store.Set("config", "v1")
+
+	t42, archive, rest := filepath.Join(dir, "t42.db"), filepath.Join(dir, "archive.db"), filepath.Join(dir, "rest.db")
+	written, err := store.Split([]SplitRule{
+		{Prefix: "tenant42/", Path: t42, TrimPrefix: true},
+		{Prefix: "tenant42/archive/", Path: archive},
+		{Prefix: "", Path: rest},
+	})
+	if err != nil {
+		t.Fatalf("Split() error = %v", err)
+	}
+	if written[t42] != 2 || written[archive] != 1 || written[rest] != 2 {
+		t.Errorf("Split() = %v, want 2, 1 and 2 keys", written)
+	}
+	check := func(path string, want map[string]string) {
+		t.Helper()
+		s, err := NewDiskStore(path)
+		if err != nil {
+			t.Fatalf("failed to open %v: %v", path, err)
+		}
+		defer s.Close()
+		if keys := s.Keys(); len(keys) != len(want) {
+			t.Errorf("%v holds %v, want %v", path, keys, want)
+		}
+		for key, value := range want {
+			if got := s.Get(key); got != value {
+				t.Errorf("Get(%v) on %v = %v, want %v", key, path, got, value)
+			}
+		}
+	}
+	check(t42, map[string]string{"othello": "shakespeare", "hamlet": "shakespeare"})
+	check(archive, map[string]string{"tenant42/archive/dune": "herbert"})
+	check(rest, map[string]string{"tenant7/emma": "austen", "config": "v1"})
+	if got := store.Get("tenant42/othello"); got != "shakespeare" {
+		t.Errorf("Get() on the source after Split() = %v, want it untouched", got)
+	}
+}
@@ -0,0 +1,221 @@
+package caskdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+)
+
+// An SSTable is a file of key/value pairs sorted by key, as written by LevelDB
+// and read by the LSM engines descended from it, such as Pebble and RocksDB. The
+// pairs are packed in data blocks of about 4KB, followed by an index block
+// pointing at the last key of every data block, an empty meta index block and a
+// footer pointing at both:
+//
+//	┌──────────────┬─────┬──────────────┬──────────────────┬─────────────┬──────────────┐
+//	│ data block 1 │ ... │ data block n │ meta index block │ index block │ footer (48B) │
+//	└──────────────┴─────┴──────────────┴──────────────────┴─────────────┴──────────────┘
+//
+// Within a block, the keys share their prefix with the previous key, restarting
+// in full every 16 keys, and every block ends with a byte for its compression,
+// always none here, and a masked CRC-32C. The keys are internal keys: the key of
+// the store followed by 8 bytes of sequence number and kind, 0 and a set, which
+// is what a file ingested into an engine carries.
+
+const (
+	// sstableBlockSize is the size past which a data block is ended
+	sstableBlockSize = 4096
+	// sstableRestartInterval is how many keys of a block share a restart point
+	sstableRestartInterval = 16
+	// sstableFooterSize is the size of the footer, two block handles padded to 40
+	// bytes followed by the magic number
+	sstableFooterSize = 48
+	sstableMagic      = 0xdb4775248b80fb57
+	// sstableKindSet is the kind of an internal key for a set
+	sstableKindSet = 1
+)
+
+// sstableCRCTable is the table of CRC-32C, the checksum of the blocks
+var sstableCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ExportSSTable writes the live keys and values of the store to a new SSTable at
+// path, sorted by key, and returns the number of keys written, for bulk loading
+// them into an LSM engine such as Pebble or RocksDB. Expiries are left out, as the
+// format has no place for them.
+//
+// Like CopyTo, the store is only locked while the keys are listed, the file has
+// the keys as they were then, and ExportSSTable fails rather than overwrite an
+// existing file.
+func (d *DiskStore) ExportSSTable(path string) (int, error) {
+	if isFileExists(path) {
+		return 0, fmt.Errorf("caskdb: %s exists already", path)
+	}
+	live, readers, closeReaders, err := d.snapshot()
+	if err != nil {
+		return 0, err
+	}
+	defer closeReaders()
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	w := &sstableWriter{w: bufio.NewWriter(tmp)}
+	for _, l := range live {
+		data, err := readLive(readers, l.key, l.kEntry)
+		if err != nil {
+			return 0, err
+		}
+		value, err := l.value(d, readers, data)
+		if err != nil {
+			return 0, err
+		}
+		if err := w.add(l.key, value); err != nil {
+			return 0, err
+		}
+	}
+	if err := w.finish(); err != nil {
+		return 0, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	return len(live), renameFile(tmp.Name(), path)
+}
+
+// sstableWriter writes an SSTable, the keys being added in order.
+type sstableWriter struct {
+	w *bufio.Writer
+	// offset is where the next block lands in the file
+	offset uint64
+	data   sstableBlock
+	index  sstableBlock
+	// lastKey is the internal key last added, which the index points at for the
+	// data block it ends
+	lastKey []byte
+}
+
+// add appends the key and value to the current data block, ending the block
+// once it is full.
+func (w *sstableWriter) add(key string, value string) error {
+	internalKey := make([]byte, len(key)+8)
+	copy(internalKey, key)
+	// sequence number 0 in the high 56 bits, the kind in the low 8
+	binary.LittleEndian.PutUint64(internalKey[len(key):], sstableKindSet)
+	w.data.add(internalKey, []byte(value))
+	w.lastKey = internalKey
+	if len(w.data.buf) >= sstableBlockSize {
+		return w.flushData()
+	}
+	return nil
+}
+
+// flushData writes the current data block, if it has any key, and adds it to the
+// index.
+func (w *sstableWriter) flushData() error {
+	if w.data.count == 0 {
+		return nil
+	}
+	handle, err := w.writeBlock(&w.data)
+	if err != nil {
+		return err
+	}
+	w.index.add(w.lastKey, handle)
+	return nil
+}
+
+// writeBlock writes the block along with its trailer, resets it, and returns its
+// encoded handle.
+func (w *sstableWriter) writeBlock(b *sstableBlock) ([]byte, error) {
+	contents := b.finish()
+	trailer := make([]byte, 5)
+	trailer[0] = 0 // no compression
+	crc := crc32.Update(crc32.Checksum(contents, sstableCRCTable), sstableCRCTable, trailer[:1])
+	binary.LittleEndian.PutUint32(trailer[1:], maskCRC(crc))
+	if _, err := w.w.Write(contents); err != nil {
+		return nil, err
+	}
+	if _, err := w.w.Write(trailer); err != nil {
+		return nil, err
+	}
+	handle := binary.AppendUvarint(binary.AppendUvarint(nil, w.offset), uint64(len(contents)))
+	w.offset += uint64(len(contents) + len(trailer))
+	*b = sstableBlock{}
+	return handle, nil
+}
+
+// finish writes the last data block, the meta index and index blocks and the
+// footer, and flushes the file.
+func (w *sstableWriter) finish() error {
+	if err := w.flushData(); err != nil {
+		return err
+	}
+	metaIndex, err := w.writeBlock(&sstableBlock{})
+	if err != nil {
+		return err
+	}
+	index, err := w.writeBlock(&w.index)
+	if err != nil {
+		return err
+	}
+	footer := make([]byte, sstableFooterSize)
+	copy(footer, append(metaIndex, index...))
+	binary.LittleEndian.PutUint64(footer[sstableFooterSize-8:], sstableMagic)
+	if _, err := w.w.Write(footer); err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
+
+// maskCRC masks a checksum stored along with the data it covers, as LevelDB does,
+// so that the checksum of data holding checksums stays meaningful.
+func maskCRC(crc uint32) uint32 {
+	return (crc>>15 | crc<<17) + 0xa282ead8
+}
+
+// sstableBlock builds a block of an SSTable.
+type sstableBlock struct {
+	buf      []byte
+	restarts []uint32
+	count    int
+	lastKey  []byte
+}
+
+// add appends a key, which must sort after the previous one, and its value.
+func (b *sstableBlock) add(key []byte, value []byte) {
+	shared := 0
+	if b.count%sstableRestartInterval == 0 {
+		b.restarts = append(b.restarts, uint32(len(b.buf)))
+	} else {
+		for shared < len(key) && shared < len(b.lastKey) && key[shared] == b.lastKey[shared] {
+			shared++
+		}
+	}
+	b.buf = binary.AppendUvarint(b.buf, uint64(shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(key)-shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(value)))
+	b.buf = append(b.buf, key[shared:]...)
+	b.buf = append(b.buf, value...)
+	b.lastKey = append(b.lastKey[:0], key...)
+	b.count++
+}
+
+// finish returns the contents of the block, its entries followed by the restart
+// points and their number. An empty block has a single restart point.
+func (b *sstableBlock) finish() []byte {
+	restarts := b.restarts
+	if len(restarts) == 0 {
+		restarts = []uint32{0}
+	}
+	for _, restart := range restarts {
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, restart)
+	}
+	return binary.LittleEndian.AppendUint32(b.buf, uint32(len(restarts)))
+}
@@ -0,0 +1,111 @@
+package caskdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readSSTableBlock returns the entries of the block at the handle, checking its
+// trailer.
+func readSSTableBlock(t *testing.T, file []byte, handle []byte) [][2]string {
+	t.Helper()
+	offset, n := binary.Uvarint(handle)
+	size, _ := binary.Uvarint(handle[n:])
+	block := file[offset : offset+size]
+	trailer := file[offset+size : offset+size+5]
+	if trailer[0] != 0 {
+		t.Fatalf("block at %d compression = %v, want 0", offset, trailer[0])
+	}
+	crc := crc32.Update(crc32.Checksum(block, sstableCRCTable), sstableCRCTable, trailer[:1])
+	if got := binary.LittleEndian.Uint32(trailer[1:]); got != maskCRC(crc) {
+		t.Fatalf("block at %d crc = %v, want %v", offset, got, maskCRC(crc))
+	}
+	restarts := int(binary.LittleEndian.Uint32(block[len(block)-4:]))
+	entries := block[:len(block)-4-4*restarts]
+	var pairs [][2]string
+	var key []byte
+	for len(entries) > 0 {
+		shared, n1 := binary.Uvarint(entries)
+		unshared, n2 := binary.Uvarint(entries[n1:])
+		valueSize, n3 := binary.Uvarint(entries[n1+n2:])
+		entries = entries[n1+n2+n3:]
+		key = append(key[:shared], entries[:unshared]...)
+		pairs = append(pairs, [2]string{string(key), string(entries[unshared : unshared+valueSize])})
+		entries = entries[unshared+valueSize:]
+	}
+	return pairs
+}
+
+func TestDiskStore_ExportSSTable(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewDiskStore(filepath.Join(dir, "books.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	// enough keys for several data blocks, written out of order
+	for i := 499; i >= 0; i-- {
+		store.Set(fmt.Sprintf("books/%04d", i), strings.Repeat("x", i%50+1))
+	}
+	store.Set("books/0001", "shakespeare")
+	if err := store.Delete("books/0002"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+
+	path := filepath.Join(dir, "books.sst")
+	n, err := store.ExportSSTable(path)
+	if err != nil {
+		t.Fatalf("ExportSSTable() error = %v", err)
+	}
+	if n != 499 {
+		t.Errorf("ExportSSTable() = %v, want %v", n, 499)
+	}
+	if _, err := store.ExportSSTable(path); err == nil {
+		t.Errorf("ExportSSTable() over an existing file error = nil, want an error")
+	}
+
+	file, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read the table: %v", err)
+	}
+	footer := file[len(file)-sstableFooterSize:]
+	if got := binary.LittleEndian.Uint64(footer[sstableFooterSize-8:]); got != sstableMagic {
+		t.Fatalf("magic = %x, want %x", got, uint64(sstableMagic))
+	}
+	// skip the meta index handle
+	_, n1 := binary.Uvarint(footer)
+	_, n2 := binary.Uvarint(footer[n1:])
+	index := readSSTableBlock(t, file, footer[n1+n2:])
+	if len(index) < 2 {
+		t.Errorf("data blocks = %v, want several", len(index))
+	}
+	var keys []string
+	for _, entry := range index {
+		pairs := readSSTableBlock(t, file, []byte(entry[1]))
+		if last := pairs[len(pairs)-1][0]; last != entry[0] {
+			t.Errorf("index key = %q, want the last key of the block %q", entry[0], last)
+		}
+		for _, pair := range pairs {
+			internalKey := pair[0]
+			if trailer := internalKey[len(internalKey)-8:]; binary.LittleEndian.Uint64([]byte(trailer)) != sstableKindSet {
+				t.Errorf("trailer of %q = %x, want a set at sequence number 0", internalKey, trailer)
+			}
+			key := internalKey[:len(internalKey)-8]
+			if len(keys) > 0 && keys[len(keys)-1] >= key {
+				t.Errorf("key %q after %q, want them in order", key, keys[len(keys)-1])
+			}
+			keys = append(keys, key)
+			if want := store.Get(key); pair[1] != want {
+				t.Errorf("value of %q = %q, want %q", key, pair[1], want)
+			}
+		}
+	}
+	if len(keys) != 499 || keys[0] != "books/0000" || keys[1] != "books/0001" || keys[2] != "books/0003" {
+		t.Errorf("keys = %v..., want books/0000 to books/0499 but books/0002", keys[:3])
+	}
+}
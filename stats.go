@@ -0,0 +1,303 @@
+package caskdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"math/bits"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// statsSuffix is appended to the name of the active file for the file keeping the
+// LifetimeStats across restarts, e.g. books.db.stats
+const statsSuffix = ".stats"
+
+// Stats is a point in time summary of the store, returned by DiskStore.Stats.
+type Stats struct {
+	// Keys is the number of live keys
+	Keys int
+	// Bytes is the size of the data files, dead records and offloaded segments
+	// included
+	Bytes int64
+	// Reads, Writes and Syncs summarise the latencies of Get, of Set and Delete,
+	// and of the fsync which follows every write, since the store was opened
+	Reads  LatencyStats
+	Writes LatencyStats
+	Syncs  LatencyStats
+	// Prefixes is the usage of the prefixes of Options.PrefixQuotas, sorted by
+	// prefix
+	Prefixes []PrefixUsage
+	// Lifetime holds the counters kept since the store was created, across
+	// restarts
+	Lifetime LifetimeStats
+	// ID is the identity of the store, check DiskStore.ID
+	ID string
+}
+
+// LifetimeStats are cumulative counters, kept next to the active file, in
+// books.db.stats, so that they survive restarts. They are saved by Close and
+// Compact: those of a process which crashed are lost since the last save.
+type LifetimeStats struct {
+	// Writes is the number of calls to Set and Delete
+	Writes uint64
+	// Compactions is the number of runs of segments Compact rewrote, and
+	// ReclaimedBytes the bytes it freed doing so
+	Compactions    uint64
+	ReclaimedBytes int64
+	// Uptime is how long the store was open for
+	Uptime time.Duration
+	// Epoch is the generation of the store, check DiskStore.Epoch
+	Epoch uint64
+}
+
+// LatencyStats summarises the latencies of one kind of operation. The percentiles
+// come from a histogram, so they may be overstated by up to 12.5%.
+type LatencyStats struct {
+	Count uint64
+	P50   time.Duration
+	P95   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+// Stats returns the current statistics of the store.
+func (d *DiskStore) Stats() Stats {
+	// the latencies are summed up before locking the store, as they take a while
+	reads, writes, syncs := d.readLatency.snapshot(), d.writeLatency.snapshot(), d.syncLatency.snapshot()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return Stats{
+		Keys:   d.keyDir.size(),
+		Bytes:  d.diskSize(),
+		Reads:  reads.summary(),
+		Writes: writes.summary(),
+		Syncs:  syncs.summary(),
+
+		Prefixes: d.quotas.usage(),
+		Lifetime: d.lifetimeStats(),
+		ID:       d.id,
+	}
+}
+
+// lifetimeStats returns the counters of the previous runs along with those of
+// this one. The store must be locked.
+func (d *DiskStore) lifetimeStats() LifetimeStats {
+	stats := d.lifetime
+	stats.Writes += d.writeLatency.count()
+	stats.Uptime += time.Since(d.openedAt)
+	return stats
+}
+
+// savedStats is the content of the stats file: the counters, the ID of the store,
+// and the reads and writes of the key prefixes.
+type savedStats struct {
+	LifetimeStats
+	ID          string         `json:",omitempty"`
+	HotPrefixes []PrefixAccess `json:",omitempty"`
+}
+
+// loadStats reads the counters saved by the previous runs. A missing file stands
+// for a new store, and an unreadable one is started over. So does a file left
+// next to an active file which is gone, from a store deleted since.
+func (d *DiskStore) loadStats(fileName string) {
+	if !isFileExists(fileName) {
+		return
+	}
+	data, err := os.ReadFile(fileName + statsSuffix)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	var saved savedStats
+	if err == nil {
+		err = json.Unmarshal(data, &saved)
+	}
+	if err != nil {
+		d.log.Warn("ignoring unreadable stats", "file", fileName+statsSuffix, "error", err)
+		return
+	}
+	d.lifetime, d.id = saved.LifetimeStats, saved.ID
+	for i := range saved.HotPrefixes {
+		if len(d.prefixAccess) < maxPrefixAccess {
+			d.prefixAccess[saved.HotPrefixes[i].Prefix] = &saved.HotPrefixes[i]
+		}
+	}
+}
+
+// saveStats writes the counters to the stats file. Failing to is logged only, as
+// the store is fine without them. The store must be locked.
+func (d *DiskStore) saveStats() {
+	fileName := d.file.Name() + statsSuffix
+	saved := savedStats{LifetimeStats: d.lifetimeStats(), ID: d.id}
+	for _, access := range d.prefixAccess {
+		saved.HotPrefixes = append(saved.HotPrefixes, *access)
+	}
+	data, err := json.Marshal(saved)
+	if err == nil {
+		err = writeFileSync(fileName, bytes.NewReader(data))
+	}
+	if err != nil {
+		d.log.Error("failed to save stats", "file", fileName, "error", err)
+	}
+}
+
+// the histogram keeps halfBuckets buckets for every power of two, so each bucket
+// spans at most 1/8th of its lower bound. Values below subBuckets get a bucket of
+// their own. This is the scheme HDR histograms use: a fixed amount of memory
+// covers the whole range of durations with a bounded relative error.
+const (
+	subBucketBits = 4
+	subBuckets    = 1 << subBucketBits
+	halfBuckets   = subBuckets / 2
+	// a uint64 needs 64-subBucketBits shifts, each with halfBuckets buckets
+	histogramBuckets = subBuckets + (64-subBucketBits)*halfBuckets
+)
+
+// latencyHistogram records durations in nanoseconds. It is not safe for
+// concurrent use, check shardedHistogram.
+type latencyHistogram struct {
+	counts [histogramBuckets]uint64
+	count  uint64
+	max    uint64
+}
+
+func (h *latencyHistogram) record(d time.Duration) {
+	v := uint64(0)
+	if d > 0 {
+		v = uint64(d)
+	}
+	h.counts[bucketIndex(v)]++
+	h.count++
+	if v > h.max {
+		h.max = v
+	}
+}
+
+// merge adds the durations recorded by other.
+func (h *latencyHistogram) merge(other *latencyHistogram) {
+	for i, c := range other.counts {
+		h.counts[i] += c
+	}
+	h.count += other.count
+	if other.max > h.max {
+		h.max = other.max
+	}
+}
+
+// quantile returns the upper bound of the bucket holding the q-th quantile, which
+// is never larger than the largest value recorded.
+func (h *latencyHistogram) quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(h.count))
+	if rank == 0 {
+		rank = 1
+	}
+	var seen uint64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			if upper := bucketUpperBound(i); upper < h.max {
+				return time.Duration(upper)
+			}
+			break
+		}
+	}
+	return time.Duration(h.max)
+}
+
+func (h *latencyHistogram) summary() LatencyStats {
+	return LatencyStats{
+		Count: h.count,
+		P50:   h.quantile(0.50),
+		P95:   h.quantile(0.95),
+		P99:   h.quantile(0.99),
+		Max:   time.Duration(h.max),
+	}
+}
+
+// histogramShards is the number of shards of a shardedHistogram
+const histogramShards = 8
+
+// shardedHistogram is a latencyHistogram which many goroutines record durations
+// into at once without a lock, for the latencies of the store: the operations
+// record theirs once they unlocked the store, all but the fsyncs of the writes,
+// which are made with the store locked. Its counters are atomic, and split over
+// shards, so that the goroutines recording at the same time mostly update
+// counters of their own rather than contend for the same cache lines. A duration
+// goes to the shard picked by its lowest bits, which are as good as random at the
+// resolution of the clock.
+type shardedHistogram struct {
+	shards [histogramShards]histogramShard
+}
+
+type histogramShard struct {
+	counts [histogramBuckets]atomic.Uint64
+	count  atomic.Uint64
+	max    atomic.Uint64
+}
+
+func (h *shardedHistogram) record(d time.Duration) {
+	v := uint64(0)
+	if d > 0 {
+		v = uint64(d)
+	}
+	shard := &h.shards[(v^v>>8)%histogramShards]
+	shard.counts[bucketIndex(v)].Add(1)
+	shard.count.Add(1)
+	for {
+		max := shard.max.Load()
+		if v <= max || shard.max.CompareAndSwap(max, v) {
+			break
+		}
+	}
+}
+
+// count returns the number of durations recorded.
+func (h *shardedHistogram) count() uint64 {
+	var n uint64
+	for i := range h.shards {
+		n += h.shards[i].count.Load()
+	}
+	return n
+}
+
+// snapshot sums the shards up. The durations recorded meanwhile may be counted in
+// some counters and not yet in others.
+func (h *shardedHistogram) snapshot() *latencyHistogram {
+	var sum latencyHistogram
+	for i := range h.shards {
+		shard := &h.shards[i]
+		for j := range shard.counts {
+			sum.counts[j] += shard.counts[j].Load()
+		}
+		sum.count += shard.count.Load()
+		if max := shard.max.Load(); max > sum.max {
+			sum.max = max
+		}
+	}
+	return &sum
+}
+
+func bucketIndex(v uint64) int {
+	if v < subBuckets {
+		return int(v)
+	}
+	// keep the top subBucketBits bits of v; the top one is always set, so the
+	// remaining bits pick one of halfBuckets buckets for this shift
+	shift := bits.Len64(v) - subBucketBits
+	top := v >> shift
+	return subBuckets + (shift-1)*halfBuckets + int(top-halfBuckets)
+}
+
+func bucketUpperBound(i int) uint64 {
+	if i < subBuckets {
+		return uint64(i)
+	}
+	shift := (i-subBuckets)/halfBuckets + 1
+	top := uint64((i-subBuckets)%halfBuckets + halfBuckets)
+	return (top+1)<<shift - 1
+}
@@ -0,0 +1,159 @@
+package caskdb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_Stats(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	store.Set("hamlet", "shakespeare")
+	store.Set("dune", "frank herbert")
+	store.Delete("dune")
+	store.Get("hamlet")
+	store.Get("dune")
+
+	stats := store.Stats()
+	if stats.Keys != 1 {
+		t.Errorf("Stats() keys = %v, want %v", stats.Keys, 1)
+	}
+	if stats.Reads.Count != 2 || stats.Writes.Count != 3 || stats.Syncs.Count != 3 {
+		t.Errorf("Stats() counts = %v/%v/%v, want 2/3/3", stats.Reads.Count, stats.Writes.Count, stats.Syncs.Count)
+	}
+	if stats.Writes.P50 > stats.Writes.P99 || stats.Writes.P99 > stats.Writes.Max {
+		t.Errorf("Stats() write latencies = %+v, want p50 <= p99 <= max", stats.Writes)
+	}
+}
+
+func Test_latencyHistogram(t *testing.T) {
+	var h latencyHistogram
+	for i := 1; i <= 1000; i++ {
+		h.record(time.Duration(i) * time.Microsecond)
+	}
+	tests := []struct {
+		q    float64
+		want time.Duration
+	}{
+		{0.50, 500 * time.Microsecond},
+		{0.95, 950 * time.Microsecond},
+		{0.99, 990 * time.Microsecond},
+	}
+	for _, tt := range tests {
+		got := h.quantile(tt.q)
+		// the buckets are at most 1/8th wide
+		if got < tt.want || got > tt.want+tt.want/8 {
+			t.Errorf("quantile(%v) = %v, want within 1/8th above %v", tt.q, got, tt.want)
+		}
+	}
+	if h.quantile(1) != time.Millisecond {
+		t.Errorf("quantile(1) = %v, want %v", h.quantile(1), time.Millisecond)
+	}
+}
+
+func Test_shardedHistogram(t *testing.T) {
+	var h shardedHistogram
+	var want latencyHistogram
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 1; i <= 1000; i++ {
+				h.record(time.Duration(i) * time.Microsecond)
+			}
+		}()
+		for i := 1; i <= 1000; i++ {
+			want.record(time.Duration(i) * time.Microsecond)
+		}
+	}
+	wg.Wait()
+	got := h.snapshot()
+	if *got != want {
+		t.Errorf("snapshot() = %+v, want %+v", got.summary(), want.summary())
+	}
+	if h.count() != 8000 {
+		t.Errorf("count() = %v, want 8000", h.count())
+	}
+}
+
+func Test_bucketIndex(t *testing.T) {
+	for _, v := range []uint64{0, 1, 15, 16, 17, 31, 32, 1000, 1 << 40, 1<<64 - 1} {
+		i := bucketIndex(v)
+		if upper := bucketUpperBound(i); v > upper {
+			t.Errorf("bucketUpperBound(bucketIndex(%v)) = %v, want >= %v", v, upper, v)
+		}
+		if i > 0 && v <= bucketUpperBound(i-1) {
+			t.Errorf("bucketIndex(%v) = %v, but the previous bucket already holds it", v, i)
+		}
+	}
+	if i := bucketIndex(1<<64 - 1); i != histogramBuckets-1 {
+		t.Errorf("bucketIndex(max) = %v, want %v", i, histogramBuckets-1)
+	}
+}
+
+func TestDiskStore_LifetimeStats(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{MaxSegmentBytes: 100}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	for i := 0; i < 12; i++ {
+		store.Set("key", fmt.Sprintf("value-%d", i%10))
+	}
+	freed, err := store.Compact(context.Background())
+	if err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	store.Close()
+
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	store.Delete("key")
+	lifetime := store.Stats().Lifetime
+	if lifetime.Writes != 13 || lifetime.Compactions != 1 || lifetime.ReclaimedBytes != freed || lifetime.Uptime <= 0 {
+		t.Errorf("Stats().Lifetime after reopening = %+v, want 13 writes and 1 compaction freeing %d bytes", lifetime, freed)
+	}
+	if store.Stats().Writes.Count != 1 {
+		t.Errorf("Stats().Writes.Count after reopening = %v, want 1", store.Stats().Writes.Count)
+	}
+}
+
+func TestDiskStore_LifetimeStats_deleted(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("othello", "shakespeare")
+	id := store.ID()
+	store.Close()
+
+	// the stats file outlives the store, which is created again
+	os.Remove(fileName)
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if lifetime := store.Stats().Lifetime; lifetime.Writes != 0 || lifetime.Epoch != 1 {
+		t.Errorf("Stats().Lifetime of the new store = %+v, want no writes and epoch 1", lifetime)
+	}
+	if store.ID() == id {
+		t.Errorf("ID() of the new store = %v, want a new one", id)
+	}
+}
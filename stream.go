@@ -0,0 +1,61 @@
+package caskdb
+
+import (
+	"context"
+	"errors"
+)
+
+// StreamKeys sends the keys of the store, in order, on the returned channel, and
+// closes it after the last one or once ctx is done. Several goroutines can receive
+// from it to share the work. Like an Iterator, it does not hold the store between
+// two keys, so writes carry on meanwhile.
+func (d *DiskStore) StreamKeys(ctx context.Context) <-chan string {
+	keys := make(chan string)
+	go func() {
+		defer close(keys)
+		it := d.Iterator()
+		for it.First(); it.Valid(); it.Next() {
+			select {
+			case keys <- it.Key():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return keys
+}
+
+// StreamItems is like StreamKeys, with the values of the keys. A key deleted
+// before its value is read is skipped. The error channel receives the error which
+// stopped the stream early, i.e. that of ctx or of a failed read, and is closed
+// once the items are.
+func (d *DiskStore) StreamItems(ctx context.Context) (<-chan Item, <-chan error) {
+	items := make(chan Item)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(errc)
+		defer close(items)
+		it := d.Iterator()
+		for it.First(); it.Valid(); it.Next() {
+			if err := ctx.Err(); err != nil {
+				errc <- err
+				return
+			}
+			value, err := it.Value()
+			if errors.Is(err, ErrKeyNotFound) {
+				continue
+			}
+			if err != nil {
+				errc <- err
+				return
+			}
+			select {
+			case items <- Item{it.Key(), value}:
+			case <-ctx.Done():
+				errc <- ctx.Err()
+				return
+			}
+		}
+	}()
+	return items, errc
+}
@@ -0,0 +1,55 @@
+package caskdb
+
+import (
+	"context"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestDiskStore_StreamKeys(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	for _, key := range []string{"dune", "othello", "hamlet", "emma"} {
+		store.Set(key, "some author")
+	}
+	// fan out over a few workers
+	keys := store.StreamKeys(context.Background())
+	var mu sync.Mutex
+	var got []string
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				mu.Lock()
+				got = append(got, key)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	sort.Strings(got)
+	if len(got) != 4 || got[0] != "dune" || got[3] != "othello" {
+		t.Errorf("StreamKeys() = %v, want the 4 keys", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	items, errc := store.StreamItems(ctx)
+	if item := <-items; item.Key != "dune" || item.Value != "some author" {
+		t.Errorf("StreamItems() = %v, want dune", item)
+	}
+	cancel()
+	for range items {
+	}
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("StreamItems() error = %v, want %v", err, context.Canceled)
+	}
+}
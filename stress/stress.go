@@ -0,0 +1,299 @@
+// Package stress runs randomized concurrent workloads against a store while
+// checking that it keeps its promises: a read returns the last write acknowledged
+// before it, or one still in flight, and no acknowledged write is ever lost, not
+// even across a restart of the store:
+//
+//	store, _ := caskdb.NewDiskStore("stress.db")
+//	report, err := stress.Run(ctx, store, stress.Options{
+//		Duration: time.Minute,
+//		Reopen: func() (stress.Store, error) {
+//			store.Close()
+//			return caskdb.NewDiskStore("stress.db")
+//		},
+//	})
+//	if err != nil {
+//		// a *Violation, or the error of Reopen
+//	}
+//
+// Maintainers use it as a soak test of changes to the store, and embedders to
+// check a deployment, e.g. a cluster.Cluster or a client.Client of a server behind
+// a proxy, before trusting it with their data.
+//
+// Every key is written by a single worker, which numbers its writes, and read by
+// all of them. The values carry the key and the number of the write, and are
+// filled up to their size with a byte derived from them, so that a value of
+// another key, or a corrupted one, is caught too.
+package stress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+// Defaults of Options
+const (
+	DefaultDuration      = 10 * time.Second
+	DefaultWorkers       = 4
+	DefaultKeysPerWorker = 100
+	DefaultMaxValueSize  = 256
+)
+
+// Store is the store under stress. *caskdb.DiskStore, *client.Client and
+// *cluster.Cluster are Stores.
+type Store interface {
+	// Lookup returns the value of the key, or caskdb.ErrKeyNotFound
+	Lookup(key string) (string, error)
+	Put(key string, value string) error
+	Delete(key string) error
+}
+
+// Options tune Run. The zero value has the defaults above.
+type Options struct {
+	// Duration is how long the workload runs for
+	Duration time.Duration
+	// Workers is the number of goroutines running the workload, each writing
+	// KeysPerWorker keys of its own
+	Workers       int
+	KeysPerWorker int
+	// ReadWeight, WriteWeight and DeleteWeight are how often each operation is
+	// picked relative to the others, 2:2:1 when none is set
+	ReadWeight   int
+	WriteWeight  int
+	DeleteWeight int
+	// MaxValueSize is the size of the largest value written, in bytes
+	MaxValueSize int
+	// Seed seeds the random choices of the workers
+	Seed int64
+	// Reopen, if set, is called once the workload stops, to close the store and
+	// open it again, e.g. after simulating a crash. Every key is then checked
+	// against the store it returns: the writes acknowledged before must all be
+	// there.
+	Reopen func() (Store, error)
+}
+
+// Report is the result of Run.
+type Report struct {
+	Reads, Writes, Deletes uint64
+	// Errors counts the operations the store failed. A write which failed may or
+	// may not have been applied, and either is accepted from then on.
+	Errors uint64
+	// Checked is the number of keys checked once the workload stopped
+	Checked int
+}
+
+// Violation is an invariant the store broke, returned by Run.
+type Violation struct {
+	Key string
+	// Op is the operation which saw it: "read", or "check" once the workload
+	// stopped
+	Op string
+	// Got is the value read, or "" for a key which was not found
+	Got string
+	// Want describes what the read was allowed to return
+	Want string
+}
+
+func (v *Violation) Error() string {
+	got := strconv.Quote(v.Got)
+	if v.Got == "" {
+		got = "not found"
+	}
+	return fmt.Sprintf("stress: %s of %q got %s, want %s", v.Op, v.Key, got, v.Want)
+}
+
+// Run runs the workload on the store until opts.Duration passed or ctx is done,
+// and then checks every key, through opts.Reopen when set. It stops at the first
+// Violation, and returns it, along with the report of what ran until then. The
+// keys are under "stress/", and are left in the store.
+func Run(ctx context.Context, store Store, opts Options) (Report, error) {
+	if opts.Duration <= 0 {
+		opts.Duration = DefaultDuration
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultWorkers
+	}
+	if opts.KeysPerWorker <= 0 {
+		opts.KeysPerWorker = DefaultKeysPerWorker
+	}
+	if opts.ReadWeight <= 0 && opts.WriteWeight <= 0 && opts.DeleteWeight <= 0 {
+		opts.ReadWeight, opts.WriteWeight, opts.DeleteWeight = 2, 2, 1
+	}
+	if opts.MaxValueSize <= 0 {
+		opts.MaxValueSize = DefaultMaxValueSize
+	}
+	r := &run{store: store, opts: opts, keys: make([]keyState, opts.Workers*opts.KeysPerWorker)}
+	for i := range r.keys {
+		r.keys[i].name = fmt.Sprintf("stress/%d/%d", i/opts.KeysPerWorker, i%opts.KeysPerWorker)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Duration)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		w := &worker{run: r, rand: rand.New(rand.NewSource(opts.Seed + int64(i))), first: i * opts.KeysPerWorker}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil && r.violation() == nil {
+				w.step()
+			}
+		}()
+	}
+	wg.Wait()
+	report := Report{Reads: r.reads.Load(), Writes: r.writes.Load(), Deletes: r.deletes.Load(), Errors: r.failures.Load()}
+	if v := r.violation(); v != nil {
+		return report, v
+	}
+
+	if opts.Reopen != nil {
+		var err error
+		if r.store, err = opts.Reopen(); err != nil {
+			return report, fmt.Errorf("stress: reopening the store: %w", err)
+		}
+	}
+	for i := range r.keys {
+		if err := r.check(&r.keys[i], "check"); err != nil {
+			return report, err
+		}
+		report.Checked++
+	}
+	return report, nil
+}
+
+// run is the state shared by the workers.
+type run struct {
+	store Store
+	opts  Options
+	keys  []keyState
+
+	reads, writes, deletes, failures atomic.Uint64
+
+	mu    sync.Mutex
+	first *Violation
+}
+
+// keyState tracks the writes of a key. Its writer numbers them from 1, and
+// stores the number in issued before the write, and in acked after it succeeded;
+// deleted holds the number of the last delete issued.
+type keyState struct {
+	name    string
+	acked   atomic.Int64
+	issued  atomic.Int64
+	deleted atomic.Int64
+}
+
+// check reads the key and checks that the value is that of a write acknowledged
+// before the read or issued since: a read racing a write may see either.
+func (r *run) check(k *keyState, op string) error {
+	acked := k.acked.Load()
+	value, err := r.store.Lookup(k.name)
+	issued, deleted := k.issued.Load(), k.deleted.Load()
+	if err != nil && !errors.Is(err, caskdb.ErrKeyNotFound) {
+		r.failures.Add(1)
+		return nil
+	}
+	want := fmt.Sprintf("write %d to %d", acked, issued)
+	if acked == 0 {
+		want = fmt.Sprintf("not found or write 1 to %d", issued)
+	}
+	if err != nil {
+		// the delete is the last write acknowledged, or one issued since; a key
+		// never written counts as deleted by write 0
+		if deleted >= acked {
+			return nil
+		}
+		return r.violate(&Violation{Key: k.name, Op: op, Want: want})
+	}
+	if seq, ok := parseValue(k.name, value); !ok || seq < acked || seq > issued {
+		return r.violate(&Violation{Key: k.name, Op: op, Got: value, Want: want})
+	}
+	return nil
+}
+
+// violate records the first violation, and returns v.
+func (r *run) violate(v *Violation) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.first == nil {
+		r.first = v
+	}
+	return v
+}
+
+func (r *run) violation() *Violation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.first
+}
+
+// worker runs the workload on one goroutine, writing the keys from first to
+// first+KeysPerWorker.
+type worker struct {
+	*run
+	rand  *rand.Rand
+	first int
+}
+
+func (w *worker) step() {
+	opts := w.opts
+	pick := w.rand.Intn(opts.ReadWeight + opts.WriteWeight + opts.DeleteWeight)
+	if pick < opts.ReadWeight {
+		w.reads.Add(1)
+		w.check(&w.keys[w.rand.Intn(len(w.keys))], "read")
+		return
+	}
+	k := &w.keys[w.first+w.rand.Intn(opts.KeysPerWorker)]
+	seq := k.issued.Load() + 1
+	k.issued.Store(seq)
+	var err error
+	if pick < opts.ReadWeight+opts.WriteWeight {
+		w.writes.Add(1)
+		err = w.store.Put(k.name, formatValue(k.name, seq, 1+w.rand.Intn(opts.MaxValueSize)))
+	} else {
+		w.deletes.Add(1)
+		k.deleted.Store(seq)
+		err = w.store.Delete(k.name)
+	}
+	if err != nil {
+		w.failures.Add(1)
+		return
+	}
+	k.acked.Store(seq)
+}
+
+// formatValue returns the value of the seq-th write of the key, of size bytes,
+// or longer if the key and seq do not fit.
+func formatValue(key string, seq int64, size int) string {
+	head := key + "@" + strconv.FormatInt(seq, 10) + ":"
+	if size <= len(head) {
+		return head
+	}
+	// the byte depends on the size too, so that a truncated value does not pass
+	return head + strings.Repeat(string(rune('a'+(seq+int64(size))%26)), size-len(head))
+}
+
+// parseValue returns the number of the write of the key which wrote the value,
+// and whether the value is one formatValue returned for the key.
+func parseValue(key string, value string) (int64, bool) {
+	if !strings.HasPrefix(value, key+"@") {
+		return 0, false
+	}
+	n, _, ok := strings.Cut(value[len(key)+1:], ":")
+	if !ok {
+		return 0, false
+	}
+	seq, err := strconv.ParseInt(n, 10, 64)
+	if err != nil || formatValue(key, seq, len(value)) != value {
+		return 0, false
+	}
+	return seq, true
+}
@@ -0,0 +1,109 @@
+package stress
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+func TestRun(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := caskdb.NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	reopened := false
+	report, err := Run(context.Background(), store, Options{
+		Duration:      100 * time.Millisecond,
+		KeysPerWorker: 10,
+		Reopen: func() (Store, error) {
+			reopened = true
+			store.Close()
+			store, err = caskdb.NewDiskStore(fileName)
+			return store, err
+		},
+	})
+	defer store.Close()
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if !reopened {
+		t.Errorf("Run() did not call Reopen")
+	}
+	if report.Reads == 0 || report.Writes == 0 || report.Deletes == 0 || report.Errors != 0 {
+		t.Errorf("Run() = %+v, want reads, writes and deletes without errors", report)
+	}
+	if report.Checked != DefaultWorkers*10 {
+		t.Errorf("Run() checked = %v, want %v", report.Checked, DefaultWorkers*10)
+	}
+}
+
+// lossyStore acknowledges every write, and stops applying them once it had enough.
+type lossyStore struct {
+	mu     sync.Mutex
+	values map[string]string
+	writes int
+}
+
+func (s *lossyStore) Lookup(key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.values[key]
+	if !ok {
+		return "", caskdb.ErrKeyNotFound
+	}
+	return value, nil
+}
+
+func (s *lossyStore) Put(key string, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.writes++; s.writes < 100 {
+		s.values[key] = value
+	}
+	return nil
+}
+
+func (s *lossyStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+	return nil
+}
+
+func TestRun_violation(t *testing.T) {
+	store := &lossyStore{values: make(map[string]string)}
+	_, err := Run(context.Background(), store, Options{Duration: time.Second, Workers: 1, KeysPerWorker: 1, WriteWeight: 1, ReadWeight: 1})
+	var v *Violation
+	if !errors.As(err, &v) {
+		t.Fatalf("Run() error = %v, want a violation", err)
+	}
+	if v.Key != "stress/0/0" {
+		t.Errorf("Violation.Key = %v, want stress/0/0", v.Key)
+	}
+}
+
+func Test_parseValue(t *testing.T) {
+	value := formatValue("dune", 42, 20)
+	if len(value) != 20 {
+		t.Errorf("formatValue() = %q, want 20 bytes", value)
+	}
+	if seq, ok := parseValue("dune", value); !ok || seq != 42 {
+		t.Errorf("parseValue() = %v, %v, want 42, true", seq, ok)
+	}
+	for _, tt := range []struct{ key, value string }{
+		{"emma", value},
+		{"dune", value[:19]},
+		{"dune", value[:19] + "x"},
+		{"dune", "dune@x:"},
+	} {
+		if _, ok := parseValue(tt.key, tt.value); ok {
+			t.Errorf("parseValue(%q, %q) = true, want false", tt.key, tt.value)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package caskdb
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// supervisor runs the goroutines a store starts in the background, e.g. to move
+// segments to the cold tier, and stops them all when the store is closed. It
+// keeps the first error one of them returned, which Close reports.
+type supervisor struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	err    error
+}
+
+func newSupervisor() *supervisor {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &supervisor{ctx: ctx, cancel: cancel}
+}
+
+// Go runs fn in a goroutine. A long running fn, e.g. a loop, should return soon
+// after ctx is done; a short one may ignore it.
+func (s *supervisor) Go(fn func(ctx context.Context) error) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := fn(s.ctx); err != nil && !errors.Is(err, context.Canceled) {
+			s.mu.Lock()
+			if s.err == nil {
+				s.err = err
+			}
+			s.mu.Unlock()
+		}
+	}()
+}
+
+// stop cancels the context of the goroutines, waits for them to return, and
+// returns the first error one of them returned.
+func (s *supervisor) stop() error {
+	s.cancel()
+	s.wg.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
@@ -0,0 +1,24 @@
+package caskdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func Test_supervisor(t *testing.T) {
+	s := newSupervisor()
+	failed := errors.New("failed")
+	s.Go(func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	s.Go(func(ctx context.Context) error { return failed })
+	done := make(chan error)
+	go func() { done <- s.stop() }()
+	// stop cancels the goroutine waiting for it, and reports the failure rather
+	// than the cancellation
+	if err := <-done; err != failed {
+		t.Errorf("stop() = %v, want %v", err, failed)
+	}
+}
@@ -0,0 +1,81 @@
+package caskdb
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// syncEvery syncs the writes left unsynced every Options.SyncInterval, plus up to
+// Options.SyncJitter, until ctx is done. A failed sync is tried again at the next
+// interval, but the writes it was for may be lost already, check syncFile.
+func (d *DiskStore) syncEvery(ctx context.Context) error {
+	timer := time.NewTimer(d.syncWait())
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+			d.syncUnsynced()
+			timer.Reset(d.syncWait())
+		}
+	}
+}
+
+// syncWait returns how long to wait for the next sync.
+func (d *DiskStore) syncWait() time.Duration {
+	wait := d.opts.SyncInterval
+	if d.opts.SyncJitter > 0 {
+		wait += time.Duration(rand.Int63n(int64(d.opts.SyncJitter)))
+	}
+	return wait
+}
+
+// syncUnsynced syncs the active file if it has writes not synced yet.
+func (d *DiskStore) syncUnsynced() {
+	start, synced := time.Now(), false
+	defer func() {
+		if synced {
+			d.observe("Sync", "", 0, d.fileName, start)
+		}
+	}()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.unsynced {
+		return
+	}
+	synced = true
+	d.syncFile()
+}
+
+// syncFile fsyncs the active file, and records the outcome in lastSyncErr. When it
+// fails with writes left unsynced, whose callers were told they succeeded, the
+// error sticks in syncErr: the kernel may drop the pages it failed to write, so
+// that the next fsync succeeds without them. The store must be locked.
+func (d *DiskStore) syncFile() error {
+	if d.lastSyncErr = d.file.Sync(); d.lastSyncErr != nil {
+		d.log.Error("sync failed", "file", d.file.Name(), "error", d.lastSyncErr)
+		if d.unsynced && d.syncErr == nil {
+			d.syncErr = d.lastSyncErr
+		}
+		return d.lastSyncErr
+	}
+	d.unsynced = false
+	return nil
+}
+
+// syncFailure returns ErrSyncFailed if the writes made may not be on the disk: the
+// last fsync failed, or one failed with writes left unsynced since the store was
+// opened. The store must be locked.
+func (d *DiskStore) syncFailure() error {
+	err := d.syncErr
+	if err == nil {
+		err = d.lastSyncErr
+	}
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%w: %v", ErrSyncFailed, err)
+}
@@ -0,0 +1,118 @@
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_SyncInterval(t *testing.T) {
+	store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{SyncInterval: 10 * time.Millisecond, SyncJitter: 5 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	for i := 0; i < 100; i++ {
+		if wait := store.syncWait(); wait < 10*time.Millisecond || wait >= 15*time.Millisecond {
+			t.Fatalf("syncWait() = %v, want between 10ms and 15ms", wait)
+		}
+	}
+
+	unsynced := func() bool {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return store.unsynced
+	}
+	store.mu.Lock()
+	store.putAt("othello", "shakespeare", 1000, 0, "", 0)
+	if !store.unsynced {
+		t.Errorf("unsynced = false after a write, want true")
+	}
+	store.mu.Unlock()
+	for deadline := time.Now().Add(5 * time.Second); unsynced(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("unsynced = true, want the write synced in the background")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// a txn is synced as it is committed
+	store.mu.Lock()
+	store.putAt("dune", "herbert", 1000, 0, "", 0)
+	store.mu.Unlock()
+	txn := store.Begin()
+	if err := txn.Put("anathem", "stephenson"); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+	if unsynced() {
+		t.Errorf("unsynced = true after a commit, want false")
+	}
+
+	store.Set("othello", "<the moor>")
+	if err := store.Rotate(); err != nil {
+		t.Fatalf("Rotate() error = %v", err)
+	}
+	if unsynced() {
+		t.Errorf("unsynced = true after Rotate, want false")
+	}
+}
+
+func TestDiskStore_SyncInterval_failed(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{SyncInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if err := store.Put("othello", "shakespeare"); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	// the fsync of the write fails, through a closed handle of the active file
+	closed, err := os.Open(fileName)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", fileName, err)
+	}
+	closed.Close()
+	store.mu.Lock()
+	file := store.file
+	store.file = closed
+	store.mu.Unlock()
+	store.syncUnsynced()
+	store.mu.Lock()
+	store.file = file
+	store.mu.Unlock()
+
+	// the next fsync succeeds, but the write may be lost already
+	if err := store.Sync(); !errors.Is(err, ErrSyncFailed) {
+		t.Errorf("Sync() error = %v, want ErrSyncFailed", err)
+	}
+	if err := store.Healthy(); !errors.Is(err, ErrSyncFailed) {
+		t.Errorf("Healthy() error = %v, want ErrSyncFailed", err)
+	}
+	if err := store.Put("dune", "herbert"); !errors.Is(err, ErrSyncFailed) {
+		t.Errorf("Put() error = %v, want ErrSyncFailed", err)
+	}
+	txn := store.Begin()
+	txn.Put("anathem", "stephenson")
+	if err := txn.Commit(); !errors.Is(err, ErrSyncFailed) {
+		t.Errorf("Commit() error = %v, want ErrSyncFailed", err)
+	}
+	store.Close()
+
+	store, err = NewDiskStoreWithOptions(fileName, Options{SyncInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	if err := store.Healthy(); err != nil {
+		t.Errorf("Healthy() after reopening error = %v, want nil", err)
+	}
+	if err := store.Put("dune", "herbert"); err != nil {
+		t.Errorf("Put() after reopening error = %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package caskdb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+)
+
+// With Options.ColdDir set, the storage is tiered: the active file, which takes
+// every write and fsync, stays on the fast volume it was opened on, while sealed
+// segments, which are only read from, move to the cold directory.
+
+// demote moves the sealed segment to Options.ColdDir in the background, unless it
+// is there already or was offloaded. The store must be locked.
+func (d *DiskStore) demote(seg *segment) {
+	if d.opts.ColdDir == "" || seg.remote || seg.moving || filepath.Dir(seg.path) == filepath.Clean(d.opts.ColdDir) {
+		return
+	}
+	seg.moving = true
+	src := seg.path
+	d.background.Go(func(ctx context.Context) error {
+		// a move under way is finished rather than cancelled when the store is
+		// closed, so that Close leaves the segments where they belong
+		err := d.moveToColdDir(seg, src)
+		if err != nil {
+			// the segment keeps being read from where it is, and the move is
+			// retried the next time the store is opened
+			d.log.Error("failed to move segment to the cold tier", "file", src, "dir", d.opts.ColdDir, "error", err)
+		}
+		d.mu.Lock()
+		removed, path := seg.removed, seg.path
+		if removed && d.keepPinned(path) {
+			removed = false
+		}
+		d.mu.Unlock()
+		if removed {
+			// DeleteAll dropped it while it was moving, and left it to us
+			d.removeSegmentFiles(path)
+		}
+		return err
+	})
+}
+
+// moveToColdDir moves the segment from src to Options.ColdDir, with a rename when
+// both are on the same volume, or by copying it otherwise.
+func (d *DiskStore) moveToColdDir(seg *segment, src string) error {
+	dst := filepath.Join(d.opts.ColdDir, filepath.Base(src))
+	d.mu.Lock()
+	if err := renameFile(src, dst); err == nil {
+		seg.path, seg.moving = dst, false
+		d.mu.Unlock()
+		d.log.Info("moved segment to the cold tier", "file", dst)
+		return nil
+	}
+	d.mu.Unlock()
+	// most likely another volume; the segment does not change, so we copy it
+	// without holding the store
+	err := copyFileSync(dst, src)
+	d.mu.Lock()
+	if err == nil {
+		if seg.file != nil {
+			seg.file.Close()
+			seg.file = nil
+		}
+		seg.path = dst
+	}
+	seg.moving = false
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	d.log.Info("moved segment to the cold tier", "file", dst)
+	// the hint is written anew next to the segment the next time it is loaded
+	os.Remove(src + hintSuffix)
+	return os.Remove(src)
+}
+
+// copyFileSync copies the file at src to dst, syncing it to the disk.
+func copyFileSync(dst string, src string) error {
+	file, err := openFile(src, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return writeFileSync(dst, file)
+}
@@ -0,0 +1,54 @@
+package caskdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskStore_ColdDir(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	coldDir := filepath.Join(t.TempDir(), "cold")
+	recordSize, _ := encodeKV(0, "othello", "shakespeare")
+	opts := Options{MaxSegmentBytes: int64(recordSize)}
+	books := map[string]string{"othello": "shakespeare", "dune": "herbert", "emma": "austen"}
+
+	// a store sealing its segments next to the active file, then tiered
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("othello", "shakespeare")
+	store.Set("dune", "herbert")
+	store.Close()
+	opts.ColdDir = coldDir
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	store.Set("emma", "austen")
+	store.Close()
+
+	for _, id := range []uint32{1, 2} {
+		if _, err := os.Stat(sealedPath(fileName, id)); !os.IsNotExist(err) {
+			t.Errorf("segment %d is still next to the active file", id)
+		}
+		if _, err := os.Stat(sealedPath(filepath.Join(coldDir, "test.db"), id)); err != nil {
+			t.Errorf("segment %d is not in the cold directory: %v", id, err)
+		}
+	}
+	if _, err := os.Stat(fileName); err != nil {
+		t.Errorf("the active file is not where it was opened: %v", err)
+	}
+
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	for key, value := range books {
+		if got := store.Get(key); got != value {
+			t.Errorf("Get(%q) = %v, want %v", key, got, value)
+		}
+	}
+}
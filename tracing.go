@@ -0,0 +1,56 @@
+package caskdb
+
+import "context"
+
+// Tracer starts a span for each operation on the store, so that the time spent in
+// the store shows up in the caller's distributed traces. It is deliberately small
+// so that we need no dependencies; an adapter to OpenTelemetry is a few lines:
+//
+//	type otelTracer struct{ tracer trace.Tracer }
+//
+//	func (t otelTracer) Start(ctx context.Context, operation string) caskdb.Span {
+//		_, span := t.tracer.Start(ctx, operation)
+//		return otelSpan{span}
+//	}
+//
+// The operations are named "caskdb.Get", "caskdb.Set", "caskdb.Delete",
+// "caskdb.Expire" and "caskdb.Compact". The parent span is taken from the context
+// passed to LookupContext, PutContext, DeleteContext and Compact; the methods
+// without a context start root spans.
+type Tracer interface {
+	Start(ctx context.Context, operation string) Span
+}
+
+// Span is a single traced operation, from before it waits for the rate limits and
+// the lock of the store. SetAttribute is called with the byte counts of the
+// operation and the time it waited, and End is called exactly once, with the error
+// the operation returned, if any.
+type Span interface {
+	SetAttribute(key string, value int64)
+	End(err error)
+}
+
+// the attributes we set on the spans
+const (
+	// spanAttrBytes is the number of bytes the operation read from or wrote to
+	// the disk, header included
+	spanAttrBytes = "caskdb.bytes"
+	// spanAttrValueSize is the size of the value read or written, in bytes
+	spanAttrValueSize = "caskdb.value_size"
+	// spanAttrFreed is the number of bytes Compact freed
+	spanAttrFreed = "caskdb.freed_bytes"
+	// spanAttrWait is how long the operation waited for Options.WriteOpsPerSecond
+	// and Options.WriteBytesPerSecond, and for the lock of the store, in
+	// nanoseconds
+	spanAttrWait = "caskdb.wait_ns"
+)
+
+// nopTracer is used when Options.Tracer is not set.
+type nopTracer struct{}
+
+func (nopTracer) Start(ctx context.Context, operation string) Span { return nopSpan{} }
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttribute(key string, value int64) {}
+func (nopSpan) End(err error)                        {}
@@ -0,0 +1,88 @@
+package caskdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testSpan struct {
+	operation  string
+	attributes map[string]int64
+	err        error
+	ended      bool
+}
+
+func (s *testSpan) SetAttribute(key string, value int64) { s.attributes[key] = value }
+func (s *testSpan) End(err error)                        { s.err, s.ended = err, true }
+
+type testTracer struct {
+	spans []*testSpan
+}
+
+func (t *testTracer) Start(ctx context.Context, operation string) Span {
+	span := &testSpan{operation: operation, attributes: make(map[string]int64)}
+	t.spans = append(t.spans, span)
+	return span
+}
+
+func TestDiskStore_Tracer(t *testing.T) {
+	tracer := &testTracer{}
+	store, err := NewDiskStoreWithOptions("test.db", Options{Tracer: tracer})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	size, _ := encodeKV(0, "othello", "shakespeare")
+	store.Set("othello", "shakespeare")
+	store.Get("othello")
+	store.Get("hamlet")
+	if len(tracer.spans) != 3 {
+		t.Fatalf("got %v spans, want %v", len(tracer.spans), 3)
+	}
+	set, get, missing := tracer.spans[0], tracer.spans[1], tracer.spans[2]
+	if set.operation != "caskdb.Set" || !set.ended || set.attributes[spanAttrBytes] != int64(size) {
+		t.Errorf("set span = %+v, want caskdb.Set of %v bytes", set, size)
+	}
+	if get.operation != "caskdb.Get" || !get.ended || get.attributes[spanAttrValueSize] != int64(len("shakespeare")) {
+		t.Errorf("get span = %+v, want caskdb.Get of the value", get)
+	}
+	if !errors.Is(missing.err, ErrKeyNotFound) {
+		t.Errorf("missing key span error = %v, want %v", missing.err, ErrKeyNotFound)
+	}
+
+	freed, err := store.Compact(context.Background())
+	if err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	compact := tracer.spans[len(tracer.spans)-1]
+	if n, ok := compact.attributes[spanAttrFreed]; compact.operation != "caskdb.Compact" || !compact.ended || !ok || n != freed {
+		t.Errorf("compact span = %+v, want caskdb.Compact freeing %v bytes", compact, freed)
+	}
+}
+
+func TestDiskStore_TracerWait(t *testing.T) {
+	tracer := &testTracer{}
+	store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{Tracer: tracer, WriteOpsPerSecond: 20})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+
+	// the write after a second's worth waits for its turn, within its span
+	for i := 0; i <= 20; i++ {
+		store.Set(fmt.Sprintf("key-%d", i), "shakespeare")
+	}
+	if len(tracer.spans) != 21 {
+		t.Fatalf("got %v spans, want %v", len(tracer.spans), 21)
+	}
+	if wait := tracer.spans[20].attributes[spanAttrWait]; wait < int64(25*time.Millisecond) {
+		t.Errorf("throttled set span waited %v, want at least %v", time.Duration(wait), 25*time.Millisecond)
+	}
+}
@@ -0,0 +1,110 @@
+package caskdb
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// With Options.TrashDelay set, the segments Compact, DeleteAll and Retention drop
+// are moved to a trash directory next to them, books.db.trash, rather than
+// deleted: a reader which still has one open keeps reading it, and until the delay
+// is over, the segments are there to go back to, e.g. to undo a compaction by
+// hand. The trash is emptied of the segments trashed longer ago than the delay,
+// but for those a copy such as CopyTo is still reading from.
+
+// trashSuffix is appended to the name of the store for its trash directory
+const trashSuffix = ".trash"
+
+// maxTrashSweepInterval bounds how long a trashed segment outlives its delay
+const maxTrashSweepInterval = time.Minute
+
+// trashDir returns the trash directory for the file of a segment, in the same
+// directory, so that trashing it is a rename.
+func trashDir(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + trashSuffix
+}
+
+// trashSegmentFiles moves the data file and the remote index of a segment to the
+// trash, whichever exist, and deletes its hint. A trashed file's modification
+// time is when it was trashed.
+func (d *DiskStore) trashSegmentFiles(path string) {
+	dir := trashDir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		d.log.Error("failed to trash segment", "file", path, "error", err)
+		return
+	}
+	now := time.Now()
+	for _, name := range []string{path, path + remoteIndexSuffix} {
+		dst := filepath.Join(dir, filepath.Base(name))
+		err := renameFile(name, dst)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err == nil {
+			err = os.Chtimes(dst, now, now)
+		}
+		if err != nil {
+			// the next time the store is opened, we try again
+			d.log.Error("failed to trash segment", "file", name, "error", err)
+		}
+	}
+	if err := os.Remove(path + hintSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		d.log.Error("failed to delete segment", "file", path+hintSuffix, "error", err)
+	}
+}
+
+// emptyTrash deletes the files trashed longer than Options.TrashDelay ago, but for
+// those of the segments a copy is reading from.
+func (d *DiskStore) emptyTrash(fileName string, now time.Time) {
+	dirs := []string{fileName + trashSuffix}
+	if d.opts.ColdDir != "" {
+		dirs = append(dirs, filepath.Join(d.opts.ColdDir, filepath.Base(fileName)+trashSuffix))
+	}
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			d.log.Error("failed to empty trash", "dir", dir, "error", err)
+			continue
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil || now.Sub(info.ModTime()) < d.opts.TrashDelay || d.pinned(strings.TrimSuffix(entry.Name(), remoteIndexSuffix)) {
+				continue
+			}
+			name := filepath.Join(dir, entry.Name())
+			if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				d.log.Error("failed to delete segment", "file", name, "error", err)
+				continue
+			}
+			d.log.Info("deleted trashed segment", "file", name)
+		}
+	}
+}
+
+// emptyTrashEvery empties the trash now, and then until ctx is done, as often as
+// it takes for no segment to outlive its delay by more than maxTrashSweepInterval.
+func (d *DiskStore) emptyTrashEvery(ctx context.Context, fileName string) error {
+	d.emptyTrash(fileName, time.Now())
+	interval := d.opts.TrashDelay
+	if interval > maxTrashSweepInterval {
+		interval = maxTrashSweepInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			d.emptyTrash(fileName, now)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package caskdb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_TrashDelay(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{MaxSegmentBytes: 100, TrashDelay: time.Hour}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		store.Set(fmt.Sprintf("key-%d", i%3), fmt.Sprintf("value-%d", i))
+	}
+	if _, err := store.Compact(context.Background()); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	store.Close()
+
+	// the compacted segments are in the trash rather than deleted
+	if _, err := os.Stat(sealedPath(fileName, 1)); !os.IsNotExist(err) {
+		t.Errorf("segment 1 is still in place: %v", err)
+	}
+	trashed, err := os.ReadDir(fileName + trashSuffix)
+	if err != nil || len(trashed) == 0 {
+		t.Fatalf("trash holds %v, %v, want the compacted segments", trashed, err)
+	}
+
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	if got := store.Get("key-1"); got != "value-19" {
+		t.Errorf("Get(key-1) = %q, want %q", got, "value-19")
+	}
+	// a segment a copy reads from outlives its delay
+	store.mu.Lock()
+	pinned := store.pin([]*segment{{path: sealedPath(fileName, 1)}})
+	store.mu.Unlock()
+	store.emptyTrash(fileName, time.Now().Add(2*time.Hour))
+	left, _ := os.ReadDir(fileName + trashSuffix)
+	if len(left) != 1 || left[0].Name() != filepath.Base(sealedPath(fileName, 1)) {
+		t.Errorf("trash holds %v past the delay, want only the pinned segment", left)
+	}
+	store.unpin(pinned)
+	store.emptyTrash(fileName, time.Now().Add(2*time.Hour))
+	if left, _ := os.ReadDir(fileName + trashSuffix); len(left) != 0 {
+		t.Errorf("trash holds %v past the delay, want none", left)
+	}
+}
@@ -0,0 +1,130 @@
+package caskdb
+
+import (
+	"context"
+	"time"
+)
+
+// PutWithTTL is like Put, and the key expires once ttl has passed. Expired keys
+// behave as if they were deleted. The expiry is stored with a precision of a
+// second, rounded up. A ttl of zero or less means the key has expired already,
+// so it is deleted.
+func (d *DiskStore) PutWithTTL(key string, value string, ttl time.Duration) (err error) {
+	key = d.normalizeKey(key)
+	if value == "" || ttl <= 0 {
+		return d.Delete(key)
+	}
+	span := d.tracer.Start(context.Background(), "caskdb.Set")
+	defer func() { span.End(err) }()
+	span.SetAttribute(spanAttrValueSize, int64(len(value)))
+	waited := time.Now()
+	if err := d.throttle(context.Background(), headerSize+len(key)+len(value)); err != nil {
+		return err
+	}
+	start, size := time.Now(), 0
+	defer func() { d.observe("Set", key, size, d.fileName, start) }()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	span.SetAttribute(spanAttrWait, int64(time.Since(waited)))
+	if size, err = d.put(key, value, expiryAfter(start, ttl)); err != nil {
+		return err
+	}
+	span.SetAttribute(spanAttrBytes, int64(size))
+	if d.opts.OnSet != nil {
+		d.opts.OnSet(key, value)
+	}
+	return nil
+}
+
+// Expire sets the key to expire once ttl has passed, replacing its current expiry
+// if it has one. It returns ErrKeyNotFound if the key does not exist. Like
+// PutWithTTL, a ttl of zero or less deletes the key.
+func (d *DiskStore) Expire(key string, ttl time.Duration) (err error) {
+	key = d.normalizeKey(key)
+	if ttl <= 0 {
+		if !d.Has(key) {
+			return ErrKeyNotFound
+		}
+		return d.Delete(key)
+	}
+	span := d.tracer.Start(context.Background(), "caskdb.Expire")
+	defer func() { span.End(err) }()
+	start, size := time.Now(), 0
+	defer func() { d.observe("Set", key, size, d.fileName, start) }()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	span.SetAttribute(spanAttrWait, int64(time.Since(start)))
+	kEntry, ok := d.keyDir.get(key)
+	if !ok || kEntry.expired(start) {
+		return ErrKeyNotFound
+	}
+	// the expiry is part of the record, so we write the record again with the
+	// same value and the new expiry
+	value, flags, err := d.readFlags(key, kEntry)
+	if err != nil {
+		return err
+	}
+	if flags&FlagMeta != 0 {
+		block, err := d.readMetaBlock(key, kEntry)
+		if err != nil {
+			return err
+		}
+		value = block + value
+	}
+	size, err = d.putAt(key, value, uint32(start.Unix()), expiryAfter(start, ttl), "", flags&contentFlags)
+	span.SetAttribute(spanAttrBytes, int64(size))
+	return err
+}
+
+// TTL returns the time left until the key expires, or 0 if it does not expire. It
+// returns ErrKeyNotFound if the key does not exist.
+func (d *DiskStore) TTL(key string) (time.Duration, error) {
+	key = d.normalizeKey(key)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	kEntry, ok := d.keyDir.get(key)
+	if !ok || kEntry.expired(now) {
+		return 0, ErrKeyNotFound
+	}
+	if kEntry.expiry == 0 {
+		return 0, nil
+	}
+	return time.Unix(int64(kEntry.expiry), 0).Sub(now), nil
+}
+
+// Has reports whether the key exists. Unlike Get, it does not read the disk.
+func (d *DiskStore) Has(key string) bool {
+	key = d.normalizeKey(key)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	kEntry, ok := d.keyDir.get(key)
+	return ok && !kEntry.expired(time.Now())
+}
+
+// Keys returns all the keys in the store, in no particular order. It does not
+// read the disk, but it does copy every key, so it is costly for a large store.
+func (d *DiskStore) Keys() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	keys := make([]string, 0, d.keyDir.size())
+	d.keyDir.each(func(key string, kEntry KeyEntry) bool {
+		if !kEntry.expired(now) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys
+}
+
+// expiryAfter returns the unix time ttl after now, rounded up to the second so
+// that a key never expires before its ttl has passed.
+func expiryAfter(now time.Time, ttl time.Duration) uint32 {
+	t := now.Add(ttl)
+	expiry := t.Unix()
+	if t.Nanosecond() > 0 {
+		expiry++
+	}
+	return uint32(expiry)
+}
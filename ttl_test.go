@@ -0,0 +1,66 @@
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_TTL(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	if err := store.PutWithTTL("session", "jojo", time.Hour); err != nil {
+		t.Fatalf("PutWithTTL() error = %v", err)
+	}
+	store.Set("hamlet", "shakespeare")
+	if ttl, err := store.TTL("session"); err != nil || ttl <= 59*time.Minute || ttl > time.Hour+time.Second {
+		t.Errorf("TTL() = %v, %v, want about an hour", ttl, err)
+	}
+	if ttl, err := store.TTL("hamlet"); err != nil || ttl != 0 {
+		t.Errorf("TTL() = %v, %v, want 0 for a key without expiry", ttl, err)
+	}
+	if err := store.Expire("hamlet", time.Minute); err != nil {
+		t.Fatalf("Expire() error = %v", err)
+	}
+	if val := store.Get("hamlet"); val != "shakespeare" {
+		t.Errorf("Get() after Expire() = %v, want %v", val, "shakespeare")
+	}
+	if err := store.Expire("dune", time.Minute); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expire() error = %v, want %v", err, ErrKeyNotFound)
+	}
+
+	// a key whose expiry has passed is gone
+	store.put("expired", "yes", uint32(time.Now().Add(-time.Second).Unix()))
+	if _, err := store.Lookup("expired"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Lookup() of an expired key error = %v, want %v", err, ErrKeyNotFound)
+	}
+	if store.Has("expired") || len(store.Keys()) != 2 {
+		t.Errorf("Has() = %v, Keys() = %v, want the expired key left out", store.Has("expired"), store.Keys())
+	}
+	store.Close()
+
+	// the expiry survives a restart
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if ttl, err := store.TTL("hamlet"); err != nil || ttl <= 0 || ttl > time.Minute+time.Second {
+		t.Errorf("TTL() after reopening = %v, %v, want about a minute", ttl, err)
+	}
+	if store.Has("expired") {
+		t.Errorf("Has() of an expired key after reopening = true, want false")
+	}
+	// a ttl of zero deletes the key
+	if err := store.Expire("session", 0); err != nil {
+		t.Fatalf("Expire() error = %v", err)
+	}
+	if store.Has("session") {
+		t.Errorf("Has() after Expire(0) = true, want false")
+	}
+}
@@ -0,0 +1,338 @@
+package caskdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrTxnDone is returned by the methods of a Txn which was committed or rolled
+	// back already
+	ErrTxnDone = errors.New("caskdb: transaction is done")
+	// ErrInvalidSavepoint is returned by RollbackTo for a savepoint the Txn did not
+	// hand out, or which an earlier RollbackTo went back past
+	ErrInvalidSavepoint = errors.New("caskdb: invalid savepoint")
+	// ErrTxnPrepared is returned by the methods of a Txn changing or reading it
+	// between Prepare and Commit or Rollback
+	ErrTxnPrepared = errors.New("caskdb: transaction is prepared")
+)
+
+// Txn collects writes to a store, to apply them all at once with Commit. Until
+// then, only the Txn sees them: Get and Has read its own writes first, and the
+// store for the keys it did not write, which gives read-your-writes within the Txn
+// on top of read-committed reads of the store. The reads of the store are not a
+// snapshot: a key read twice may change in between, and Commit does not check
+// whether the keys read were written since.
+//
+// A Savepoint marks where the Txn is, and RollbackTo goes back there, undoing the
+// writes made since while keeping those made before, so that a step of a
+// multi-step mutation can be given up on without starting over:
+//
+//	txn := store.Begin()
+//	txn.Put("order:42", order)
+//	sp := txn.Savepoint()
+//	if err := reserve(txn, items); err != nil {
+//		// the order is still placed, without the items
+//		txn.RollbackTo(sp)
+//	}
+//	err := txn.Commit()
+//
+// Commit holds the store while it writes, so no reader sees some of the writes
+// without the others, and its records are written between an intent record and an
+// end record, so that a crash in the middle of Commit loses them all rather than
+// leaving some of them applied. A Txn is not safe to use from multiple goroutines.
+type Txn struct {
+	store *DiskStore
+	// writes are those made so far, oldest first; an empty value is a delete
+	writes []txnWrite
+	// last maps the keys written to the index of their last write, for the reads
+	last map[string]int
+	// savepoints holds the number of writes at each savepoint
+	savepoints []int
+	// prepared is set between Prepare and Commit or Rollback, while the Txn holds
+	// the store
+	prepared bool
+	done     bool
+}
+
+type txnWrite struct {
+	key   string
+	value string
+	// expiry and flags are those a write of Migrate carries over, check putAt
+	expiry uint32
+	flags  RecordFlags
+}
+
+// Begin starts a transaction on the store.
+func (d *DiskStore) Begin() *Txn {
+	return &Txn{store: d, last: make(map[string]int)}
+}
+
+// Put sets the key to the value when the Txn is committed. Setting a key to an
+// empty value deletes it, as with DiskStore.Put.
+func (t *Txn) Put(key string, value string) error {
+	if err := t.check(); err != nil {
+		return err
+	}
+	return t.put(txnWrite{key: key, value: value})
+}
+
+// put is Put, with the expiry and flags of the write given.
+func (t *Txn) put(w txnWrite) error {
+	w.key = t.store.normalizeKey(w.key)
+	if err := checkKey(w.key); err != nil {
+		return err
+	}
+	t.last[w.key] = len(t.writes)
+	t.writes = append(t.writes, w)
+	return nil
+}
+
+// Delete deletes the key when the Txn is committed.
+func (t *Txn) Delete(key string) error {
+	return t.Put(key, "")
+}
+
+// Get returns the value of the key as the Txn sees it: the last value it set the
+// key to, or else the value in the store. Like Lookup, it fails with
+// ErrKeyNotFound for a key which does not exist, or which the Txn deleted.
+func (t *Txn) Get(key string) (string, error) {
+	if err := t.check(); err != nil {
+		return "", err
+	}
+	key = t.store.normalizeKey(key)
+	if i, ok := t.last[key]; ok {
+		if t.writes[i].value == "" {
+			return "", ErrKeyNotFound
+		}
+		return t.writes[i].value, nil
+	}
+	return t.store.Lookup(key)
+}
+
+// Has reports whether the key exists as the Txn sees it, check Get.
+func (t *Txn) Has(key string) bool {
+	_, err := t.Get(key)
+	return err == nil
+}
+
+// check returns the error of the methods of a Txn which is done or prepared.
+func (t *Txn) check() error {
+	if t.done {
+		return ErrTxnDone
+	}
+	if t.prepared {
+		return ErrTxnPrepared
+	}
+	return nil
+}
+
+// Savepoint marks the current point of the Txn, for RollbackTo.
+func (t *Txn) Savepoint() int {
+	t.savepoints = append(t.savepoints, len(t.writes))
+	return len(t.savepoints) - 1
+}
+
+// RollbackTo undoes the writes made since the savepoint. The savepoint stays, so
+// the Txn can go back to it again, while those taken after it are released.
+func (t *Txn) RollbackTo(savepoint int) error {
+	if err := t.check(); err != nil {
+		return err
+	}
+	if savepoint < 0 || savepoint >= len(t.savepoints) {
+		return ErrInvalidSavepoint
+	}
+	t.writes = t.writes[:t.savepoints[savepoint]]
+	t.savepoints = t.savepoints[:savepoint+1]
+	t.last = make(map[string]int, len(t.writes))
+	for i, w := range t.writes {
+		t.last[w.key] = i
+	}
+	return nil
+}
+
+// Rollback discards the Txn, and all its writes. A prepared Txn lets go of the
+// store.
+func (t *Txn) Rollback() {
+	if t.prepared {
+		t.prepared = false
+		t.store.mu.Unlock()
+	}
+	t.done = true
+	t.writes, t.savepoints, t.last = nil, nil, nil
+}
+
+// Prepare is the first phase of a two-phase commit, for coordinating the writes
+// of the Txn with another system, e.g. publishing a message along with them:
+//
+//	if err := txn.Prepare(); err != nil {
+//		return err
+//	}
+//	if err := publish(msg); err != nil {
+//		txn.Rollback()
+//		return err
+//	}
+//	return txn.Commit()
+//
+// Prepare checks that the writes can be applied: that the store is writable, its
+// last fsync succeeded, and the writes fit in Options.MaxBytes, Options.MaxKeys
+// and Options.PrefixQuotas. The size of the records is estimated from the keys and values,
+// before compression and encryption. It then holds the store until Commit or
+// Rollback, so that nothing written in between makes them fail after all: keep
+// the other phase short, as every read and write of the store waits for it.
+// Commit can still fail on an I/O error. On failure, the Txn is left as it was,
+// and can be rolled back, or changed and prepared again.
+//
+// Once prepared, the Txn can only be committed or rolled back: the other methods
+// fail with ErrTxnPrepared.
+func (t *Txn) Prepare() error {
+	if t.done {
+		return ErrTxnDone
+	}
+	if t.prepared {
+		return nil
+	}
+	writes := t.latest()
+	d := t.store
+	if err := d.throttle(context.Background(), txnSize(writes)); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	if err := d.checkWrites(writes); err != nil {
+		d.mu.Unlock()
+		return err
+	}
+	t.prepared = true
+	return nil
+}
+
+// Commit applies the writes of the Txn to the store, and ends it. The writes
+// superseded by a later one of the same key are skipped, which leaves a single
+// write per key: the deletes go first, making room for the puts within
+// Options.MaxKeys, then the puts, in order. A Txn which was not prepared is
+// prepared first. On failure, the writes applied before are taken back, check Txn.
+func (t *Txn) Commit() error {
+	if t.done {
+		return ErrTxnDone
+	}
+	if err := t.Prepare(); err != nil {
+		t.done = true
+		return err
+	}
+	t.done, t.prepared = true, false
+	d := t.store
+	start, writes := time.Now(), t.latest()
+	defer func() { d.observe("Commit", "", txnSize(writes), d.fileName, start) }()
+	defer d.mu.Unlock()
+	timestamp := uint32(start.Unix())
+	// the deletes of keys which do not exist write nothing
+	var applied []txnWrite
+	for _, w := range writes {
+		if _, ok := d.keyDir.get(w.key); w.value != "" || ok {
+			applied = append(applied, w)
+		}
+	}
+	// a single write is not batched, but is synced all the same
+	d.committing = true
+	defer func() { d.committing = false }()
+	intent := len(applied) > 1
+	if intent {
+		if err := d.beginIntent(len(applied), txnSize(applied), timestamp); err != nil {
+			return err
+		}
+	}
+	undo := make([]txnUndo, 0, len(applied))
+	for _, w := range applied {
+		old, ok := d.keyDir.get(w.key)
+		undo = append(undo, txnUndo{w.key, old, ok})
+		var err error
+		if w.value == "" {
+			_, err = d.tombstone(w.key, timestamp, "")
+		} else {
+			_, err = d.putAt(w.key, w.value, timestamp, w.expiry, "", w.flags)
+		}
+		if err == nil && intent && len(undo) == len(applied) {
+			err = d.endIntent(timestamp)
+		}
+		if err != nil {
+			if intent {
+				d.abortIntent(undo)
+			}
+			return err
+		}
+	}
+	for _, w := range applied {
+		if w.value == "" && d.opts.OnDelete != nil {
+			d.opts.OnDelete(w.key)
+		} else if w.value != "" && d.opts.OnSet != nil {
+			d.opts.OnSet(w.key, w.value)
+		}
+	}
+	return nil
+}
+
+// checkWrites returns the error applying the writes is bound to fail with, check
+// Txn.Prepare. The store must be locked.
+func (d *DiskStore) checkWrites(writes []txnWrite) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	if err := d.syncFailure(); err != nil {
+		return err
+	}
+	if max := d.opts.MaxBytes; max > 0 {
+		if used := d.diskSize(); used+int64(txnSize(writes)) > max {
+			return fmt.Errorf("%w: %d of %d bytes used", ErrStoreFull, used, max)
+		}
+	}
+	if err := d.checkPrefixQuotas(writes); err != nil {
+		return err
+	}
+	if max := d.opts.MaxKeys; max > 0 && d.opts.Eviction == EvictNone {
+		keys := func() int {
+			n := d.keyDir.size()
+			for _, w := range writes {
+				_, ok := d.keyDir.get(w.key)
+				if w.value == "" && ok {
+					n--
+				} else if w.value != "" && !ok {
+					n++
+				}
+			}
+			return n
+		}
+		if keys() > max {
+			d.dropExpired(time.Now())
+			if n := keys(); n > max {
+				return fmt.Errorf("%w: %d of %d keys needed", ErrStoreFull, n, max)
+			}
+		}
+	}
+	return nil
+}
+
+// txnSize returns the size of the records of the writes, before compression and
+// encryption.
+func txnSize(writes []txnWrite) int {
+	size := 0
+	for _, w := range writes {
+		size += headerSize + len(w.key) + len(w.value)
+	}
+	return size
+}
+
+// latest returns the last write of each key, the deletes first, in the order of
+// those writes.
+func (t *Txn) latest() []txnWrite {
+	writes := make([]txnWrite, 0, len(t.last))
+	for _, deletes := range []bool{true, false} {
+		for i, w := range t.writes {
+			if t.last[w.key] == i && (w.value == "") == deletes {
+				writes = append(writes, w)
+			}
+		}
+	}
+	return writes
+}
@@ -0,0 +1,230 @@
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTxn(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("othello", "shakespeare")
+	store.Set("dune", "herbert")
+
+	txn := store.Begin()
+	txn.Put("emma", "austen")
+	txn.Delete("dune")
+	sp := txn.Savepoint()
+	txn.Put("emma", "austen!")
+	txn.Put("ulysses", "joyce")
+	if got, _ := txn.Get("emma"); got != "austen!" {
+		t.Errorf("Get() = %v, want the write of the Txn", got)
+	}
+	if _, err := txn.Get("dune"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get() of a key the Txn deleted error = %v, want %v", err, ErrKeyNotFound)
+	}
+	if got := store.Get("emma"); got != "" {
+		t.Errorf("Get() of the store before Commit() = %v, want no value", got)
+	}
+	inner := txn.Savepoint()
+	if err := txn.RollbackTo(sp); err != nil {
+		t.Fatalf("RollbackTo() error = %v", err)
+	}
+	if err := txn.RollbackTo(inner); !errors.Is(err, ErrInvalidSavepoint) {
+		t.Errorf("RollbackTo() a released savepoint error = %v, want %v", err, ErrInvalidSavepoint)
+	}
+	if got, _ := txn.Get("emma"); got != "austen" {
+		t.Errorf("Get() after RollbackTo() = %v, want austen", got)
+	}
+	txn.Put("lolita", "nabokov")
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+	want := map[string]string{"othello": "shakespeare", "dune": "", "emma": "austen", "ulysses": "", "lolita": "nabokov"}
+	for key, value := range want {
+		if got := store.Get(key); got != value {
+			t.Errorf("Get(%q) = %v, want %v", key, got, value)
+		}
+	}
+	if err := txn.Commit(); !errors.Is(err, ErrTxnDone) {
+		t.Errorf("Commit() twice error = %v, want %v", err, ErrTxnDone)
+	}
+
+	txn = store.Begin()
+	txn.Put("othello", "verdi")
+	txn.Rollback()
+	if err := txn.Put("dune", "herbert"); !errors.Is(err, ErrTxnDone) {
+		t.Errorf("Put() after Rollback() error = %v, want %v", err, ErrTxnDone)
+	}
+	if got := store.Get("othello"); got != "shakespeare" {
+		t.Errorf("Get() after Rollback() = %v, want shakespeare", got)
+	}
+	if err := store.Begin().Put(truncateKey, "x"); !errors.Is(err, ErrReservedKey) {
+		t.Errorf("Put() of a reserved key error = %v, want %v", err, ErrReservedKey)
+	}
+}
+
+func TestTxn_readYourWrites(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("copies", "1")
+	store.Set("dune", "herbert")
+
+	txn := store.Begin()
+	// a read-modify-write loop, each step reading what the one before wrote
+	for i := 0; i < 3; i++ {
+		value, err := txn.Get("copies")
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		n, _ := strconv.Atoi(value)
+		txn.Put("copies", strconv.Itoa(n+1))
+	}
+	txn.Delete("dune")
+	if txn.Has("dune") {
+		t.Errorf("Has() of a key the Txn deleted = true, want false")
+	}
+	sp := txn.Savepoint()
+	txn.Put("dune", "herbert!")
+	if got, _ := txn.Get("dune"); got != "herbert!" {
+		t.Errorf("Get() = %v, want herbert!", got)
+	}
+	txn.RollbackTo(sp)
+	if txn.Has("dune") {
+		t.Errorf("Has() after RollbackTo() = true, want the key deleted still")
+	}
+	// the keys the Txn did not write are read from the store as committed
+	store.Set("emma", "austen")
+	if got, _ := txn.Get("emma"); got != "austen" {
+		t.Errorf("Get() of a key committed since = %v, want austen", got)
+	}
+	if got := store.Get("copies"); got != "1" {
+		t.Errorf("Get() of the store = %v, want 1 until Commit()", got)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+	if got := store.Get("copies"); got != "4" {
+		t.Errorf("Get() = %v, want 4", got)
+	}
+	if store.Has("dune") {
+		t.Errorf("Has() = true, want the key deleted")
+	}
+}
+
+func TestTxn_Prepare(t *testing.T) {
+	store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{MaxKeys: 2})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("othello", "shakespeare")
+
+	txn := store.Begin()
+	txn.Put("dune", "herbert")
+	txn.Put("emma", "austen")
+	if err := txn.Prepare(); !errors.Is(err, ErrStoreFull) {
+		t.Fatalf("Prepare() of a key too many error = %v, want %v", err, ErrStoreFull)
+	}
+	// the Txn is left as it was
+	txn.Delete("othello")
+	if err := txn.Prepare(); err != nil {
+		t.Fatalf("Prepare() error = %v", err)
+	}
+	if err := txn.Put("ulysses", "joyce"); !errors.Is(err, ErrTxnPrepared) {
+		t.Errorf("Put() of a prepared Txn error = %v, want %v", err, ErrTxnPrepared)
+	}
+	// the writes wait for the Txn
+	written := make(chan struct{})
+	go func() {
+		store.Put("dune", "herbert!")
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatalf("Put() went through while the Txn was prepared")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+	<-written
+	want := map[string]string{"othello": "", "dune": "herbert!", "emma": "austen"}
+	for key, value := range want {
+		if got := store.Get(key); got != value {
+			t.Errorf("Get(%q) = %v, want %v", key, got, value)
+		}
+	}
+
+	txn = store.Begin()
+	txn.Delete("dune")
+	if err := txn.Prepare(); err != nil {
+		t.Fatalf("Prepare() error = %v", err)
+	}
+	txn.Rollback()
+	if got := store.Get("dune"); got != "herbert!" {
+		t.Errorf("Get() after Rollback() = %v, want herbert!", got)
+	}
+	if err := txn.Prepare(); !errors.Is(err, ErrTxnDone) {
+		t.Errorf("Prepare() after Rollback() error = %v, want %v", err, ErrTxnDone)
+	}
+}
+
+func TestTxn_Commit_crash(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{MaxSegmentBytes: 100})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("a", "0")
+	txn := store.Begin()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		txn.Put(key, "committed-value-of-"+key)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+	if n := len(store.segments); n != 2 {
+		t.Errorf("Commit() wrote to %v segments, want all its records in the second", n)
+	}
+	txn = store.Begin()
+	txn.Put("a", "1")
+	txn.Delete("b")
+	txn.Put("e", "1")
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+	store.Close()
+
+	// a crash before the end record of the second commit was written
+	_, end := encodeRecord(0, 0, intentEndKey, intentCommit)
+	if err := os.Truncate(fileName, int64(store.writePosition-len(end))); err != nil {
+		t.Fatal(err)
+	}
+	store, err = NewDiskStoreWithOptions(fileName, Options{MaxSegmentBytes: 100})
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if value := store.Get(key); value != "committed-value-of-"+key {
+			t.Errorf("Get(%q) = %q, want the first commit's", key, value)
+		}
+	}
+	if value := store.Get("e"); value != "" {
+		t.Errorf("Get(e) = %q, want none of the second commit", value)
+	}
+	if store.writePosition != len(formatRecord(0)) {
+		t.Errorf("writePosition = %v, want the format record only, the second commit having started a segment", store.writePosition)
+	}
+}
@@ -0,0 +1,190 @@
+package caskdb
+
+import (
+	"bytes"
+	"context"
+	"encoding"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Codec encodes the values of a TypedStore to the bytes the store holds, and
+// decodes them back. JSONCodec and GobCodec cover the standard library, and
+// BinaryCodec the types encoding themselves; for
+// protocol buffers, a codec calling proto.Marshal and proto.Unmarshal is a few
+// lines, which keeps CaskDB free of the dependency.
+type Codec[T any] interface {
+	Encode(v T) ([]byte, error)
+	Decode(data []byte) (T, error)
+}
+
+// JSONCodec encodes the values with encoding/json. The records it writes are
+// flagged FlagJSON, like those of SetJSON.
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+// GobCodec encodes the values with encoding/gob. Every value carries the
+// description of its type, so it is larger than the same value in a stream, but it
+// decodes on its own.
+type GobCodec[T any] struct{}
+
+func (GobCodec[T]) Encode(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v)
+	return v, err
+}
+
+// BinaryCodec encodes the values with their own MarshalBinary, and decodes them
+// with UnmarshalBinary, for the types which control their representation. PT is
+// the pointer to T, as UnmarshalBinary is usually a method of it:
+//
+//	books := caskdb.NewTypedStore[Book](store, "books/", caskdb.BinaryCodec[Book, *Book]{})
+type BinaryCodec[T any, PT interface {
+	*T
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}] struct{}
+
+func (BinaryCodec[T, PT]) Encode(v T) ([]byte, error) {
+	return PT(&v).MarshalBinary()
+}
+
+func (BinaryCodec[T, PT]) Decode(data []byte) (T, error) {
+	var v T
+	err := PT(&v).UnmarshalBinary(data)
+	return v, err
+}
+
+// TypedStore holds values of type T under a prefix of a DiskStore, encoded with a
+// codec, e.g. the books under "books/":
+//
+//	books := caskdb.NewTypedStore[Book](store, "books/", caskdb.GobCodec[Book]{})
+//	err := books.Put("othello", Book{Author: "Shakespeare"})
+//	book, err := books.Get("othello")
+//
+// The keys passed to it are those under the prefix, i.e. without it.
+type TypedStore[T any] struct {
+	store  *DiskStore
+	prefix string
+	codec  Codec[T]
+	flags  RecordFlags
+}
+
+// NewTypedStore returns a TypedStore over the keys of the store starting with
+// prefix, and registers a renderer for them, check RegisterRenderer, which shows
+// the decoded values as JSON.
+func NewTypedStore[T any](store *DiskStore, prefix string, codec Codec[T]) *TypedStore[T] {
+	t := &TypedStore[T]{store: store, prefix: prefix, codec: codec}
+	if _, ok := codec.(JSONCodec[T]); ok {
+		t.flags = FlagJSON
+	}
+	RegisterRenderer(prefix, func(value []byte) (string, error) {
+		v, err := codec.Decode(value)
+		if err != nil {
+			return "", err
+		}
+		rendered, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprintf("%+v", v), nil
+		}
+		return string(rendered), nil
+	})
+	return t
+}
+
+// Put encodes v and stores it as the value of the key. The codec must not encode
+// a value to nothing, which is how a delete is recorded.
+func (t *TypedStore[T]) Put(key string, v T) error {
+	data, err := t.codec.Encode(v)
+	if err != nil {
+		return fmt.Errorf("caskdb: encoding the value of %q: %w", t.prefix+key, err)
+	}
+	if len(data) == 0 {
+		return fmt.Errorf("caskdb: the value of %q encodes to nothing", t.prefix+key)
+	}
+	return t.store.putContext(context.Background(), t.prefix+key, string(data), t.flags)
+}
+
+// Get returns the decoded value of the key. Like Lookup, it fails with
+// ErrKeyNotFound if the key does not exist, and it fails with ErrInvalidValue if
+// the value does not decode.
+func (t *TypedStore[T]) Get(key string) (T, error) {
+	var v T
+	value, err := t.store.Lookup(t.prefix + key)
+	if err != nil {
+		return v, err
+	}
+	v, err = t.codec.Decode([]byte(value))
+	if err != nil {
+		return v, fmt.Errorf("%w: value of %q: %v", ErrInvalidValue, t.prefix+key, err)
+	}
+	return v, nil
+}
+
+// Delete removes the key. Deleting a key which does not exist is not an error.
+func (t *TypedStore[T]) Delete(key string) error {
+	return t.store.Delete(t.prefix + key)
+}
+
+// renderers are the functions registered with RegisterRenderer, by prefix
+var renderers = struct {
+	sync.RWMutex
+	byPrefix map[string]func(value []byte) (string, error)
+}{byPrefix: make(map[string]func(value []byte) (string, error))}
+
+// RegisterRenderer makes RenderValue show the values of the keys starting with
+// prefix with render, e.g. by decoding them, for the tools printing values such as
+// dump. NewTypedStore registers one for its prefix. Registering a prefix again
+// replaces its renderer.
+func RegisterRenderer(prefix string, render func(value []byte) (string, error)) {
+	renderers.Lock()
+	defer renderers.Unlock()
+	renderers.byPrefix[prefix] = render
+}
+
+// RenderValue returns the value of the key as text: rendered by the renderer
+// registered for the longest prefix of the key, as is if the flags of its record
+// say it is JSON, or quoted otherwise. A value the renderer fails on is quoted,
+// along with the error.
+func RenderValue(key string, value string, flags RecordFlags) string {
+	renderers.RLock()
+	match, found := "", false
+	for prefix := range renderers.byPrefix {
+		if strings.HasPrefix(key, prefix) && (!found || len(prefix) > len(match)) {
+			match, found = prefix, true
+		}
+	}
+	render := renderers.byPrefix[match]
+	renderers.RUnlock()
+	if found {
+		rendered, err := render([]byte(value))
+		if err == nil {
+			return rendered
+		}
+		return fmt.Sprintf("%q (%v)", value, err)
+	}
+	if flags&FlagJSON != 0 {
+		return value
+	}
+	return fmt.Sprintf("%q", value)
+}
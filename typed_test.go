@@ -0,0 +1,121 @@
+package caskdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"testing"
+)
+
+// edition encodes itself in 10 bytes, the year then the number of copies.
+type edition struct {
+	Year   uint16
+	Copies uint64
+}
+
+func (e edition) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 10)
+	binary.BigEndian.PutUint16(data, e.Year)
+	binary.BigEndian.PutUint64(data[2:], e.Copies)
+	return data, nil
+}
+
+func (e *edition) UnmarshalBinary(data []byte) error {
+	if len(data) != 10 {
+		return errors.New("an edition is 10 bytes")
+	}
+	e.Year, e.Copies = binary.BigEndian.Uint16(data), binary.BigEndian.Uint64(data[2:])
+	return nil
+}
+
+func TestTypedStore(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	want := book{Title: "Othello", Author: "Shakespeare", Year: 1603}
+	for _, codec := range []Codec[book]{JSONCodec[book]{}, GobCodec[book]{}} {
+		books := NewTypedStore[book](store, "typed/", codec)
+		if err := books.Put("othello", want); err != nil {
+			t.Fatalf("Put() error = %v", err)
+		}
+		got, err := books.Get("othello")
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		if got.Title != want.Title || got.Author != want.Author || got.Year != want.Year {
+			t.Errorf("Get() = %+v, want %+v", got, want)
+		}
+		if !store.Has("typed/othello") {
+			t.Errorf("Has() = false, want the key under the prefix")
+		}
+		// the renderer registered for the prefix decodes the value
+		value := store.Get("typed/othello")
+		if got, want := RenderValue("typed/othello", value, 0), `{"title":"Othello","author":"Shakespeare","year":1603}`; got != want {
+			t.Errorf("RenderValue() = %v, want %v", got, want)
+		}
+		if _, err := books.Get("beloved"); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Get() error = %v, want %v", err, ErrKeyNotFound)
+		}
+	}
+
+	gobBooks := NewTypedStore[book](store, "gob/", GobCodec[book]{})
+	store.Set("gob/gitanjali", "tagore")
+	if _, err := gobBooks.Get("gitanjali"); !errors.Is(err, ErrInvalidValue) {
+		t.Errorf("Get() error = %v, want %v", err, ErrInvalidValue)
+	}
+	if err := gobBooks.Delete("gitanjali"); err != nil || store.Has("gob/gitanjali") {
+		t.Errorf("Delete() error = %v, want the key gone", err)
+	}
+}
+
+func TestRenderValue(t *testing.T) {
+	RegisterRenderer("render/", func(value []byte) (string, error) { return "short", nil })
+	RegisterRenderer("render/long/", func(value []byte) (string, error) { return "long", nil })
+	RegisterRenderer("render/failing/", func(value []byte) (string, error) { return "", errors.New("bad value") })
+	tests := []struct {
+		key   string
+		flags RecordFlags
+		want  string
+	}{
+		{"render/x", 0, "short"},
+		{"render/long/x", 0, "long"},
+		{"render/failing/x", 0, `"v" (bad value)`},
+		{"other", FlagJSON, "v"},
+		{"other", 0, `"v"`},
+	}
+	for _, tt := range tests {
+		if got := RenderValue(tt.key, "v", tt.flags); got != tt.want {
+			t.Errorf("RenderValue(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestTypedStore_binary(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	editions := NewTypedStore[edition](store, "editions/", BinaryCodec[edition, *edition]{})
+	want := edition{Year: 1603, Copies: 1 << 40}
+	if err := editions.Put("othello", want); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if got := store.Get("editions/othello"); len(got) != 10 {
+		t.Errorf("Get() = %q, want the 10 bytes of MarshalBinary", got)
+	}
+	got, err := editions.Get("othello")
+	if err != nil || got != want {
+		t.Errorf("Get() = %+v, %v, want %+v", got, err, want)
+	}
+	store.Set("editions/gitanjali", "tagore")
+	if _, err := editions.Get("gitanjali"); !errors.Is(err, ErrInvalidValue) {
+		t.Errorf("Get() error = %v, want %v", err, ErrInvalidValue)
+	}
+}
@@ -0,0 +1,134 @@
+package caskdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// UpgradeFormat rewrites the files of the store at fileName which are of an older
+// version of the format, 1 or 2, in the current one, so that the store opens
+// rather than failing with ErrUnsupportedFormat, and returns the number of files
+// it rewrote. The records keep their timestamps; a partially written record at the
+// end of a file is dropped, as loading the store did. Each file is replaced once
+// rewritten, so an interrupted UpgradeFormat can be run again. The store must not
+// be open, or it fails with ErrLocked, nor offloaded to cold storage.
+func UpgradeFormat(fileName string) (int, error) {
+	lock, err := lockStore(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Close()
+	segments, err := findSegments(fileName, "")
+	if err != nil {
+		return 0, err
+	}
+	var paths []string
+	for _, seg := range segments {
+		if seg.remote {
+			return 0, fmt.Errorf("caskdb: %s is in cold storage", seg.path)
+		}
+		paths = append(paths, seg.path)
+	}
+	n := 0
+	for _, path := range append(paths, fileName) {
+		upgraded, err := upgradeFile(path)
+		if err != nil {
+			return n, err
+		}
+		if upgraded {
+			// the hint and the snapshot of the KeyDir point at the old offsets
+			os.Remove(path + hintSuffix)
+			n++
+		}
+	}
+	if n > 0 {
+		os.Remove(fileName + keyDirSuffix)
+	}
+	return n, nil
+}
+
+// upgradeFile rewrites the file in the current format, if it is of an older one.
+func upgradeFile(path string) (bool, error) {
+	file, err := openFile(path, os.O_RDONLY, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	version := legacyFormat(file, info.Size())
+	if version == 0 {
+		return false, nil
+	}
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(upgradeRecords(w, file, info.Size(), version))
+	}()
+	if err := writeFileSync(path, r); err != nil {
+		r.CloseWithError(err)
+		return false, err
+	}
+	return true, nil
+}
+
+// upgradeRecords writes the records of the file of size bytes, in the layout of
+// the version, to w in the current one, after a format record.
+func upgradeRecords(w io.Writer, file *os.File, size int64, version int) error {
+	n := 12
+	if version == 2 {
+		n = 16
+	}
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(formatRecord(uint32(time.Now().Unix()))); err != nil {
+		return err
+	}
+	r := bufio.NewReader(io.NewSectionReader(file, 0, size))
+	header := make([]byte, n)
+	for offset := int64(0); ; {
+		if _, err := io.ReadFull(r, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		// the timestamp, key_size and value_size end every header
+		timestamp := binary.LittleEndian.Uint32(header[n-12:])
+		keySize := binary.LittleEndian.Uint32(header[n-8:])
+		valueSize := binary.LittleEndian.Uint32(header[n-4:])
+		if int64(keySize)+int64(valueSize) > size-offset-int64(n) {
+			break
+		}
+		if keySize > maxKeySize {
+			return fmt.Errorf("%w: %s offset %d: %d bytes", ErrKeyTooLarge, file.Name(), offset, keySize)
+		}
+		data := make([]byte, int(keySize)+int(valueSize))
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+		if version == 2 {
+			crc := crc32.NewIEEE()
+			crc.Write(header[4:])
+			crc.Write(data)
+			if crc.Sum32() != binary.LittleEndian.Uint32(header[0:4]) {
+				return fmt.Errorf("%w: %s offset %d", ErrCorruptRecord, file.Name(), offset)
+			}
+		}
+		_, record := encodeKV(timestamp, string(data[:keySize]), string(data[keySize:]))
+		if _, err := bw.Write(record); err != nil {
+			return err
+		}
+		offset += int64(n) + int64(len(data))
+	}
+	return bw.Flush()
+}
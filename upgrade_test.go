@@ -0,0 +1,65 @@
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpgradeFormat(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		fileName := filepath.Join(t.TempDir(), "test.db")
+		// a sealed segment, and the active file
+		sealed := append(legacyRecord(version, "othello", "shakespeare"), legacyRecord(version, "hamlet", "shakespeare")...)
+		active := append(legacyRecord(version, "dune", "herbert"), legacyRecord(version, "hamlet", "")...)
+		if version == 2 {
+			// a torn write at the end
+			active = append(active, legacyRecord(version, "lear", "shakespeare")[:20]...)
+		}
+		if err := os.WriteFile(sealedPath(fileName, 1), sealed, 0666); err != nil {
+			t.Fatalf("failed to write the records: %v", err)
+		}
+		if err := os.WriteFile(fileName, active, 0666); err != nil {
+			t.Fatalf("failed to write the records: %v", err)
+		}
+		if n, err := UpgradeFormat(fileName); n != 2 || err != nil {
+			t.Fatalf("UpgradeFormat() of version %d = %v, %v, want 2 files", version, n, err)
+		}
+		// the files of the current version are left as they are
+		if n, err := UpgradeFormat(fileName); n != 0 || err != nil {
+			t.Errorf("UpgradeFormat() of version 3 = %v, %v, want no file", n, err)
+		}
+
+		store, err := NewDiskStore(fileName)
+		if err != nil {
+			t.Fatalf("NewDiskStore() after UpgradeFormat() of version %d error = %v", version, err)
+		}
+		want := map[string]string{"othello": "shakespeare", "dune": "herbert", "hamlet": "", "lear": ""}
+		for key, value := range want {
+			if got := store.Get(key); got != value {
+				t.Errorf("Get(%q) of version %d = %q, want %q", key, version, got, value)
+			}
+		}
+		if _, err := UpgradeFormat(fileName); !errors.Is(err, ErrLocked) {
+			t.Errorf("UpgradeFormat() of an open store error = %v, want %v", err, ErrLocked)
+		}
+		store.Close()
+	}
+}
+
+func TestUpgradeFormat_corrupt(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	data := append(legacyRecord(2, "othello", "shakespeare"), legacyRecord(2, "hamlet", "shakespeare")...)
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(fileName, data, 0666); err != nil {
+		t.Fatalf("failed to write the records: %v", err)
+	}
+	if _, err := UpgradeFormat(fileName); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("UpgradeFormat() error = %v, want %v", err, ErrCorruptRecord)
+	}
+	// the file is left as it was
+	if got, err := os.ReadFile(fileName); err != nil || string(got) != string(data) {
+		t.Errorf("UpgradeFormat() changed the file")
+	}
+}
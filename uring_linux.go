@@ -0,0 +1,324 @@
+//go:build linux && (amd64 || arm64)
+
+package caskdb
+
+import (
+	"errors"
+	"io"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// the system calls and the ABI of io_uring, from linux/io_uring.h
+const (
+	sysIOUringSetup = 425
+	sysIOUringEnter = 426
+
+	uringOffSQRing = 0
+	uringOffCQRing = 0x8000000
+	uringOffSQEs   = 0x10000000
+
+	uringFeatSingleMmap = 1 << 0
+	uringFeatRWCurPos   = 1 << 3
+
+	uringEnterGetEvents = 1 << 0
+
+	uringOpWritev = 2
+	uringOpRead   = 22
+)
+
+// uringEntries is the size of the submission queue of a ring; the reads of a
+// larger batch are submitted in as many rounds as it takes
+const uringEntries = 64
+
+type uringParams struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFD         uint32
+	resv         [3]uint32
+	sqOff        uringSQOffsets
+	cqOff        uringCQOffsets
+}
+
+type uringSQOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type uringCQOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+// uringSQE is a submission queue entry, an operation for the kernel to carry out.
+type uringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	rwFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFDIn  int32
+	addr3       uint64
+	pad         uint64
+}
+
+// uringCQE is a completion queue entry, the result of an operation.
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// uringEngine is the ioEngine of io_uring: the reads of a batch are submitted at
+// once, and completed with a single system call rather than a pread each. The
+// rings are shared with the kernel: we write the tail of the submission queue and
+// the head of the completion queue, and the kernel the others, so those are read
+// and written atomically.
+type uringEngine struct {
+	fd      int
+	entries int
+	// sqRing and cqRing are the mappings of the rings, the same one on kernels
+	// with IORING_FEAT_SINGLE_MMAP, and sqeRing that of the entries
+	sqRing, cqRing, sqeRing []byte
+	sqHead, sqTail          *uint32
+	sqMask                  uint32
+	sqArray                 []uint32
+	sqes                    []uringSQE
+	cqHead, cqTail          *uint32
+	cqMask                  uint32
+	cqes                    []uringCQE
+	// reads and iovecs hold what the kernel gets the addresses of, as a uintptr in
+	// the entries, until the operations complete. The Go runtime moves a goroutine
+	// stack as it grows, but never what is on the heap: kept by the engine, which
+	// is on the heap, the reads and the iovecs are too, and so are the buffers they
+	// point at, rather than on a stack. runtime.KeepAlive only keeps them from
+	// being freed.
+	reads  []ioRead
+	iovecs []syscall.Iovec
+	// err is set once io_uring_enter failed in a way which may leave operations in
+	// flight; the engine is not used again then
+	err error
+}
+
+// newIOEngine returns the ioEngine of io_uring with Options.IOUring, if the kernel
+// supports it, and that of plain syscalls otherwise.
+func newIOEngine(opts Options, log Logger) ioEngine {
+	if !opts.IOUring {
+		return syscallEngine{}
+	}
+	u, err := newURing(uringEntries)
+	if err != nil {
+		log.Warn("io_uring is not available, using plain syscalls", "error", err)
+		return syscallEngine{}
+	}
+	return u
+}
+
+// newURing sets up a ring of the entries, and maps it.
+func newURing(entries int) (*uringEngine, error) {
+	var p uringParams
+	fd, _, errno := syscall.Syscall(sysIOUringSetup, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, os.NewSyscallError("io_uring_setup", errno)
+	}
+	u := &uringEngine{fd: int(fd), entries: int(p.sqEntries)}
+	if p.features&uringFeatRWCurPos == 0 {
+		// IORING_OP_READ came along with it, in Linux 5.6
+		u.close()
+		return nil, errors.New("io_uring of this kernel is too old")
+	}
+	sqSize := int(p.sqOff.array) + int(p.sqEntries)*4
+	cqSize := int(p.cqOff.cqes) + int(p.cqEntries)*int(unsafe.Sizeof(uringCQE{}))
+	single := p.features&uringFeatSingleMmap != 0
+	if single && cqSize > sqSize {
+		sqSize = cqSize
+	}
+	var err error
+	if u.sqRing, err = mmapRing(u.fd, uringOffSQRing, sqSize); err != nil {
+		u.close()
+		return nil, err
+	}
+	u.cqRing = u.sqRing
+	if !single {
+		if u.cqRing, err = mmapRing(u.fd, uringOffCQRing, cqSize); err != nil {
+			u.close()
+			return nil, err
+		}
+	}
+	if u.sqeRing, err = mmapRing(u.fd, uringOffSQEs, int(p.sqEntries)*int(unsafe.Sizeof(uringSQE{}))); err != nil {
+		u.close()
+		return nil, err
+	}
+	u.sqHead = (*uint32)(unsafe.Pointer(&u.sqRing[p.sqOff.head]))
+	u.sqTail = (*uint32)(unsafe.Pointer(&u.sqRing[p.sqOff.tail]))
+	u.sqMask = *(*uint32)(unsafe.Pointer(&u.sqRing[p.sqOff.ringMask]))
+	u.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&u.sqRing[p.sqOff.array])), p.sqEntries)
+	u.sqes = unsafe.Slice((*uringSQE)(unsafe.Pointer(&u.sqeRing[0])), p.sqEntries)
+	u.cqHead = (*uint32)(unsafe.Pointer(&u.cqRing[p.cqOff.head]))
+	u.cqTail = (*uint32)(unsafe.Pointer(&u.cqRing[p.cqOff.tail]))
+	u.cqMask = *(*uint32)(unsafe.Pointer(&u.cqRing[p.cqOff.ringMask]))
+	u.cqes = unsafe.Slice((*uringCQE)(unsafe.Pointer(&u.cqRing[p.cqOff.cqes])), p.cqEntries)
+	return u, nil
+}
+
+func mmapRing(fd int, offset int64, size int) ([]byte, error) {
+	data, err := syscall.Mmap(fd, offset, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	if err != nil {
+		return nil, os.NewSyscallError("mmap", err)
+	}
+	return data, nil
+}
+
+func (u *uringEngine) close() error {
+	if u.sqeRing != nil {
+		syscall.Munmap(u.sqeRing)
+	}
+	if u.cqRing != nil && &u.cqRing[0] != &u.sqRing[0] {
+		syscall.Munmap(u.cqRing)
+	}
+	if u.sqRing != nil {
+		syscall.Munmap(u.sqRing)
+	}
+	return syscall.Close(u.fd)
+}
+
+// readAt submits the reads, as many at a time as the ring takes. A read which
+// comes short, or which the kernel asks to retry, is finished with a pread.
+func (u *uringEngine) readAt(reads []ioRead) error {
+	u.reads = reads
+	defer func() { u.reads = nil }()
+	for len(reads) > 0 {
+		batch := reads
+		if len(batch) > u.entries {
+			batch = batch[:u.entries]
+		}
+		res, err := u.submit(len(batch), func(i int, sqe *uringSQE) {
+			r := batch[i]
+			*sqe = uringSQE{opcode: uringOpRead, fd: int32(r.file.Fd()), off: uint64(r.off), len: uint32(len(r.buf))}
+			if len(r.buf) > 0 {
+				sqe.addr = uint64(uintptr(unsafe.Pointer(&r.buf[0])))
+			}
+		})
+		// the kernel wrote to the buffers, which are ours again only now
+		runtime.KeepAlive(batch)
+		if err != nil {
+			return err
+		}
+		for i, r := range batch {
+			n := int(res[i])
+			switch {
+			case n < 0 && retryable(syscall.Errno(-n)):
+				n = 0
+			case n < 0:
+				return &os.PathError{Op: "read", Path: r.file.Name(), Err: syscall.Errno(-n)}
+			}
+			if n < len(r.buf) {
+				if _, err := r.file.ReadAt(r.buf[n:], r.off+int64(n)); err != nil {
+					return err
+				}
+			}
+		}
+		reads = reads[len(batch):]
+	}
+	return nil
+}
+
+// writev appends the buffers to the file with a single IORING_OP_WRITEV, or as
+// few as it takes, like writev.
+func (u *uringEngine) writev(file *os.File, bufs [][]byte) error {
+	// the iovecs point at the buffers, which are kept on the heap along with them
+	defer func() { u.iovecs = u.iovecs[:0] }()
+	for {
+		u.iovecs = u.iovecs[:0]
+		for _, b := range bufs {
+			if len(u.iovecs) == maxIovecs {
+				break
+			}
+			if len(b) > 0 {
+				iov := syscall.Iovec{Base: &b[0]}
+				iov.SetLen(len(b))
+				u.iovecs = append(u.iovecs, iov)
+			}
+		}
+		iovecs := u.iovecs
+		if len(iovecs) == 0 {
+			return nil
+		}
+		res, err := u.submit(1, func(_ int, sqe *uringSQE) {
+			// an offset of -1 writes at the position of the file, which is its
+			// end for the active file, opened with O_APPEND
+			*sqe = uringSQE{opcode: uringOpWritev, fd: int32(file.Fd()), off: ^uint64(0), addr: uint64(uintptr(unsafe.Pointer(&iovecs[0]))), len: uint32(len(iovecs))}
+		})
+		runtime.KeepAlive(iovecs)
+		runtime.KeepAlive(bufs)
+		if err != nil {
+			return err
+		}
+		n := int(res[0])
+		switch {
+		case n < 0 && retryable(syscall.Errno(-n)):
+			continue
+		case n < 0:
+			return &os.PathError{Op: "writev", Path: file.Name(), Err: syscall.Errno(-n)}
+		case n == 0:
+			return io.ErrShortWrite
+		}
+		bufs = consumeBufs(bufs, n)
+	}
+}
+
+// submit queues n operations, filled in by fill, and waits for all of them to
+// complete. It returns their results, by the order they were filled in: the bytes
+// read or written, or the negated errno.
+func (u *uringEngine) submit(n int, fill func(i int, sqe *uringSQE)) ([]int32, error) {
+	if u.err != nil {
+		return nil, u.err
+	}
+	tail := atomic.LoadUint32(u.sqTail)
+	for i := 0; i < n; i++ {
+		index := (tail + uint32(i)) & u.sqMask
+		sqe := &u.sqes[index]
+		fill(i, sqe)
+		sqe.userData = uint64(i)
+		u.sqArray[index] = index
+	}
+	atomic.StoreUint32(u.sqTail, tail+uint32(n))
+	res := make([]int32, n)
+	for submitted, completed := 0, 0; completed < n; {
+		r, _, errno := syscall.Syscall6(sysIOUringEnter, uintptr(u.fd), uintptr(n-submitted), uintptr(n-completed), uringEnterGetEvents, 0, 0)
+		switch {
+		case errno == 0:
+			submitted += int(r)
+		case !retryable(errno) && errno != syscall.EBUSY:
+			u.err = os.NewSyscallError("io_uring_enter", errno)
+			return nil, u.err
+		}
+		head := atomic.LoadUint32(u.cqHead)
+		for tail := atomic.LoadUint32(u.cqTail); head != tail; head++ {
+			cqe := u.cqes[head&u.cqMask]
+			res[cqe.userData] = cqe.res
+			completed++
+		}
+		atomic.StoreUint32(u.cqHead, head)
+	}
+	return res, nil
+}
+
+// retryable reports whether an operation failing with errno may succeed if tried
+// again.
+func retryable(errno syscall.Errno) bool {
+	return errno == syscall.EINTR || errno == syscall.EAGAIN
+}
@@ -0,0 +1,97 @@
+//go:build linux && (amd64 || arm64)
+
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiskStore_IOUring(t *testing.T) {
+	if u, err := newURing(uringEntries); err != nil {
+		t.Skipf("io_uring is not available: %v", err)
+	} else {
+		u.close()
+	}
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{IOUring: true, MaxSegmentBytes: 1 << 10}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	// more runs than the ring takes at once, spread over the segments
+	want := make(map[string]string)
+	var keys []string
+	for i := 0; i < 3*uringEntries; i++ {
+		key, value := fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%d-%0*d", i, i%50, 0)
+		store.Set(key, value)
+		keys, want[key] = append(keys, key), value
+		// far apart, so that each record is a run of its own
+		store.Set(fmt.Sprintf("filler-%03d", i), string(make([]byte, getManyGapBytes)))
+	}
+	txn := store.Begin()
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("txn-%d", i)
+		txn.Put(key, "committed")
+		keys, want[key] = append(keys, key), "committed"
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+	store.mu.Lock()
+	_, ok := store.engine().(*uringEngine)
+	store.mu.Unlock()
+	if !ok {
+		t.Fatalf("engine() = %T, want *uringEngine", store.io)
+	}
+	got, err := store.GetMany(keys)
+	if err != nil {
+		t.Fatalf("GetMany() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetMany() = %d values, want %d matching those set", len(got), len(want))
+	}
+	if !store.Close() {
+		t.Fatalf("Close() = false")
+	}
+
+	// what went through the ring is on the disk
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	if got, err := store.GetMany(keys); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("GetMany() after reopening = %d values, %v, want %d matching those set", len(got), err, len(want))
+	}
+}
+
+func Test_uringEngine_readAt(t *testing.T) {
+	u, err := newURing(uringEntries)
+	if err != nil {
+		t.Skipf("io_uring is not available: %v", err)
+	}
+	defer u.close()
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("othello", "shakespeare")
+
+	// a read past the end of the file comes short
+	size := int64(store.writePosition)
+	reads := []ioRead{{file: store.file, buf: make([]byte, 4), off: 0}, {file: store.file, buf: make([]byte, 4), off: size - 2}}
+	if err := u.readAt(reads); !errors.Is(err, io.EOF) {
+		t.Errorf("readAt() past the end error = %v, want io.EOF", err)
+	}
+	var want [4]byte
+	store.file.ReadAt(want[:], 0)
+	if string(reads[0].buf) != string(want[:]) {
+		t.Errorf("readAt() = %q, want %q", reads[0].buf, want)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux || !(amd64 || arm64)
+
+package caskdb
+
+// newIOEngine returns the ioEngine of plain syscalls: io_uring is only supported on
+// Linux.
+func newIOEngine(opts Options, log Logger) ioEngine {
+	if opts.IOUring {
+		log.Warn("io_uring is not supported on this platform, using plain syscalls")
+	}
+	return syscallEngine{}
+}
@@ -0,0 +1,145 @@
+package caskdb
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+)
+
+// warmupChunkBytes is how much Warmup reads at a time, checking ctx and letting go
+// of the store in between
+const warmupChunkBytes = 1 << 20
+
+// warmupGapBytes is the largest gap between two records Warmup reads through
+// rather than skipping: reading a few dead bytes costs less than a seek
+const warmupGapBytes = 64 << 10
+
+// warmupRange is a run of bytes of a segment for Warmup to read.
+type warmupRange struct {
+	segment uint32
+	start   int64
+	end     int64
+}
+
+// Warmup reads the records of the live keys, to get them into the page cache of
+// the OS, e.g. right after a restart, so that the first reads of the keys do not
+// all wait on the disk. The records are read segment by segment, in the order
+// they are in the files, skipping the dead records but for short runs of them,
+// and a chunk at a time, so reads and writes carry on meanwhile. Segments moved to
+// Options.ColdStorage are not read.
+//
+// It returns the number of bytes read. When ctx is done, it stops and returns its
+// error along with them.
+func (d *DiskStore) Warmup(ctx context.Context) (int64, error) {
+	d.mu.Lock()
+	var entries []KeyEntry
+	d.keyDir.each(func(key string, kEntry KeyEntry) bool {
+		entries = d.appendWarmup(entries, kEntry)
+		return true
+	})
+	d.mu.Unlock()
+	return d.warmup(ctx, entries)
+}
+
+// WarmupKeys is like Warmup, for the records of the keys only, e.g. a list of the
+// hottest keys kept by the application. The keys which do not exist are skipped.
+func (d *DiskStore) WarmupKeys(ctx context.Context, keys []string) (int64, error) {
+	d.mu.Lock()
+	var entries []KeyEntry
+	for _, key := range keys {
+		if kEntry, ok := d.keyDir.get(d.normalizeKey(key)); ok {
+			entries = d.appendWarmup(entries, kEntry)
+		}
+	}
+	d.mu.Unlock()
+	return d.warmup(ctx, entries)
+}
+
+// appendWarmup appends the records of the key entry to entries: its own, and the
+// blob holding its value, if any.
+func (d *DiskStore) appendWarmup(entries []KeyEntry, kEntry KeyEntry) []KeyEntry {
+	entries = append(entries, kEntry)
+	if kEntry.blob != nil && kEntry.blob.at.segment != 0 {
+		entries = append(entries, kEntry.blob.at)
+	}
+	return entries
+}
+
+// warmup reads the records of the entries, in the order of the files.
+func (d *DiskStore) warmup(ctx context.Context, entries []KeyEntry) (int64, error) {
+	var read int64
+	buf := make([]byte, warmupChunkBytes)
+	for _, r := range warmupRanges(entries) {
+		for start := r.start; start < r.end; start += warmupChunkBytes {
+			if err := ctx.Err(); err != nil {
+				return read, err
+			}
+			end := start + warmupChunkBytes
+			if end > r.end {
+				end = r.end
+			}
+			file, ok, err := d.warmupFile(r.segment)
+			if err != nil {
+				return read, err
+			}
+			if !ok {
+				break
+			}
+			n, err := file.ReadAt(buf[:end-start], start)
+			read += int64(n)
+			// a segment compacted or moved away since is skipped
+			if errors.Is(err, os.ErrClosed) {
+				break
+			}
+			if err != nil && err != io.EOF {
+				return read, err
+			}
+		}
+	}
+	return read, nil
+}
+
+// warmupFile returns the file of the segment to read from, and false if the
+// segment is gone or remote.
+func (d *DiskStore) warmupFile(id uint32) (*os.File, bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	seg := d.segment(id)
+	if seg == nil || seg.remote || seg.removed {
+		return nil, false, nil
+	}
+	if seg == d.active() {
+		return d.file, true, nil
+	}
+	file, err := d.openSegment(seg)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, false, nil
+	}
+	return file, err == nil, err
+}
+
+// warmupRanges sorts the records of the entries by segment and position, and
+// merges those which are close into ranges.
+func warmupRanges(entries []KeyEntry) []warmupRange {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].segment != entries[j].segment {
+			return entries[i].segment < entries[j].segment
+		}
+		return entries[i].position < entries[j].position
+	})
+	var ranges []warmupRange
+	for _, e := range entries {
+		start, end := int64(e.position), int64(e.position)+int64(e.totalSize)
+		if n := len(ranges); n > 0 && ranges[n-1].segment == e.segment && start <= ranges[n-1].end+warmupGapBytes {
+			if end > ranges[n-1].end {
+				ranges[n-1].end = end
+			}
+			continue
+		}
+		ranges = append(ranges, warmupRange{segment: e.segment, start: start, end: end})
+	}
+	return ranges
+}
@@ -0,0 +1,75 @@
+package caskdb
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiskStore_Warmup(t *testing.T) {
+	store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{MaxSegmentBytes: 200})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	books := map[string]string{"othello": "shakespeare", "dune": "herbert", "emma": "austen", "ulysses": "joyce", "lolita": "nabokov"}
+	for key, value := range books {
+		store.Set(key, value)
+		store.Set(key, value)
+	}
+	if len(store.segments) < 2 {
+		t.Fatalf("segments = %v, want the store to have rotated", len(store.segments))
+	}
+	var live int64
+	for key, value := range books {
+		live += int64(headerSize + len(key) + len(value))
+	}
+
+	read, err := store.Warmup(context.Background())
+	if err != nil {
+		t.Fatalf("Warmup() error = %v", err)
+	}
+	// the dead records between two live ones are read too
+	if read < live || read > store.diskSize() {
+		t.Errorf("Warmup() = %v, want between %v and %v", read, live, store.diskSize())
+	}
+	read, err = store.WarmupKeys(context.Background(), []string{"dune", "hamlet"})
+	if want := int64(headerSize + len("dune") + len("herbert")); err != nil || read != want {
+		t.Errorf("WarmupKeys() = %v, %v, want %v", read, err, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := store.Warmup(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Warmup() with a cancelled context error = %v, want %v", err, context.Canceled)
+	}
+
+	// the records of a store compacted since are skipped
+	store.Set("emma", strings.Repeat("austen", 10))
+	if _, err := store.Compact(context.Background()); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if _, err := store.Warmup(context.Background()); err != nil {
+		t.Errorf("Warmup() after Compact() error = %v", err)
+	}
+}
+
+func Test_warmupRanges(t *testing.T) {
+	entries := []KeyEntry{
+		{segment: 2, position: 0, totalSize: 10},
+		{segment: 1, position: warmupGapBytes + 100, totalSize: 10},
+		{segment: 1, position: 0, totalSize: 50},
+		{segment: 1, position: 60, totalSize: 10},
+	}
+	want := []warmupRange{
+		{segment: 1, start: 0, end: 70},
+		{segment: 1, start: warmupGapBytes + 100, end: warmupGapBytes + 110},
+		{segment: 2, start: 0, end: 10},
+	}
+	if got := warmupRanges(entries); !reflect.DeepEqual(got, want) {
+		t.Errorf("warmupRanges() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux && !darwin && !freebsd
+
+package caskdb
+
+import "os"
+
+// writev appends the buffers to the file. Without writev, they are copied
+// together for a single write.
+func writev(file *os.File, bufs [][]byte) error {
+	size := 0
+	for _, b := range bufs {
+		size += len(b)
+	}
+	data := make([]byte, 0, size)
+	for _, b := range bufs {
+		data = append(data, b...)
+	}
+	_, err := file.Write(data)
+	return err
+}
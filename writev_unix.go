@@ -0,0 +1,72 @@
+//go:build linux || darwin || freebsd
+
+package caskdb
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// maxIovecs is the most buffers a single writev takes, IOV_MAX on the systems we
+// build for
+const maxIovecs = 1024
+
+// writev appends the buffers to the file with a single writev, or as few as it
+// takes when there are more than maxIovecs of them or the kernel writes part of
+// them.
+func writev(file *os.File, bufs [][]byte) error {
+	conn, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	iovecs := make([]syscall.Iovec, 0, len(bufs))
+	for {
+		iovecs = iovecs[:0]
+		for _, b := range bufs {
+			if len(iovecs) == maxIovecs {
+				break
+			}
+			if len(b) > 0 {
+				iov := syscall.Iovec{Base: &b[0]}
+				iov.SetLen(len(b))
+				iovecs = append(iovecs, iov)
+			}
+		}
+		if len(iovecs) == 0 {
+			return nil
+		}
+		var n uintptr
+		var errno syscall.Errno
+		err := conn.Write(func(fd uintptr) bool {
+			for {
+				n, _, errno = syscall.Syscall(syscall.SYS_WRITEV, fd, uintptr(unsafe.Pointer(&iovecs[0])), uintptr(len(iovecs)))
+				if errno != syscall.EINTR {
+					return true
+				}
+			}
+		})
+		switch {
+		case err != nil:
+			return err
+		case errno != 0:
+			return &os.PathError{Op: "writev", Path: file.Name(), Err: errno}
+		case n == 0:
+			return io.ErrShortWrite
+		}
+		bufs = consumeBufs(bufs, int(n))
+	}
+}
+
+// consumeBufs drops the first n bytes off the buffers.
+func consumeBufs(bufs [][]byte, n int) [][]byte {
+	for len(bufs) > 0 && n >= len(bufs[0]) {
+		n -= len(bufs[0])
+		bufs = bufs[1:]
+	}
+	if len(bufs) > 0 {
+		bufs[0] = bufs[0][n:]
+	}
+	return bufs
+}